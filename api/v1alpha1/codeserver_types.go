@@ -18,6 +18,7 @@ package v1alpha1
 
 import (
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -40,6 +41,179 @@ const (
 	RuntimeGeneric RuntimeType = "generic"
 )
 
+// DockerEngineType describes the container engine injected for building images inside instance
+type DockerEngineType string
+
+const (
+	// DockerEngineDind stands for docker in docker daemon.
+	DockerEngineDind DockerEngineType = "dind"
+	// DockerEngineBuildkit stands for buildkit daemon.
+	DockerEngineBuildkit DockerEngineType = "buildkit"
+)
+
+// DockerSpec describes the container engine sidecar used for building images inside instance
+type DockerSpec struct {
+	// Whether to inject the container engine sidecar
+	Enabled bool `json:"enabled,omitempty" protobuf:"bytes,1,opt,name=enabled"`
+	// Specifies the container engine, 'dind' and 'buildkit' are supported, defaults to dind.
+	// +kubebuilder:validation:Enum=dind;buildkit
+	Engine DockerEngineType `json:"engine,omitempty" protobuf:"bytes,2,opt,name=engine"`
+	// Specifies the image used to run the container engine, operator default will be used if empty.
+	Image string `json:"image,omitempty" protobuf:"bytes,3,opt,name=image"`
+	// Specifies the resource requirements for container engine sidecar.
+	Resources v1.ResourceRequirements `json:"resources,omitempty" protobuf:"bytes,4,opt,name=resources"`
+}
+
+// RootlessSpec describes the non-root user which instance runs as
+type RootlessSpec struct {
+	// Whether to run instance as non-root user, ownership of workspace volume will be prepared accordingly.
+	Enabled bool `json:"enabled,omitempty" protobuf:"varint,1,opt,name=enabled"`
+	// Specifies the uid which instance runs as, defaults to 1000.
+	// +kubebuilder:validation:Minimum=1
+	UID *int64 `json:"uid,omitempty" protobuf:"varint,2,opt,name=uid"`
+	// Specifies the gid which instance runs as, defaults to uid.
+	// +kubebuilder:validation:Minimum=1
+	GID *int64 `json:"gid,omitempty" protobuf:"varint,3,opt,name=gid"`
+}
+
+// SSHSpec describes the ssh server which allows attaching local IDE to instance over ssh
+type SSHSpec struct {
+	// Whether to enable the ssh server sidecar
+	Enabled bool `json:"enabled,omitempty" protobuf:"bytes,1,opt,name=enabled"`
+	// Specifies the public keys which are allowed to login
+	PublicKeys []string `json:"publicKeys,omitempty" protobuf:"bytes,2,rep,name=publicKeys"`
+	// Specifies the secret key which holds additional authorized keys
+	PublicKeysSecretRef *v1.SecretKeySelector `json:"publicKeysSecretRef,omitempty" protobuf:"bytes,3,opt,name=publicKeysSecretRef"`
+	// Specifies the service type used to expose ssh server, NodePort and LoadBalancer are supported, defaults to NodePort.
+	// +kubebuilder:validation:Enum=NodePort;LoadBalancer
+	ServiceType v1.ServiceType `json:"serviceType,omitempty" protobuf:"bytes,4,opt,name=serviceType"`
+	// Specifies the image used to run ssh server, operator default will be used if empty.
+	Image string `json:"image,omitempty" protobuf:"bytes,5,opt,name=image"`
+}
+
+// NotificationEvent describes the state transition which triggers notification
+type NotificationEvent string
+
+const (
+	// NotifyReady is fired when code server becomes ready.
+	NotifyReady NotificationEvent = "Ready"
+	// NotifyRecycleWarning is fired when code server is about to be recycled.
+	NotifyRecycleWarning NotificationEvent = "RecycleWarning"
+	// NotifyFailed is fired when code server failed to reconcile.
+	NotifyFailed NotificationEvent = "Failed"
+)
+
+// NotificationFormat describes the payload format of notification
+type NotificationFormat string
+
+const (
+	// NotificationJSON stands for plain json payload.
+	NotificationJSON NotificationFormat = "json"
+	// NotificationSlack stands for slack compatible payload.
+	NotificationSlack NotificationFormat = "slack"
+)
+
+// NotificationSpec describes the webhook which will be notified on state transitions
+type NotificationSpec struct {
+	// Specifies the webhook url
+	URL string `json:"url" protobuf:"bytes,1,opt,name=url"`
+	// Specifies the payload format, 'json' and 'slack' are supported, defaults to json.
+	// +kubebuilder:validation:Enum=json;slack
+	Format NotificationFormat `json:"format,omitempty" protobuf:"bytes,2,opt,name=format"`
+	// Specifies the events to be notified, all events will be notified if empty.
+	Events []NotificationEvent `json:"events,omitempty" protobuf:"bytes,3,rep,name=events"`
+}
+
+// ArchType describes the cpu architecture of node which instance is scheduled to
+type ArchType string
+
+const (
+	// ArchAMD64 stands for x86_64 nodes.
+	ArchAMD64 ArchType = "amd64"
+	// ArchARM64 stands for aarch64 nodes.
+	ArchARM64 ArchType = "arm64"
+)
+
+// StorageSpec describes how the workspace volume is provisioned
+type StorageSpec struct {
+	// Specifies the VolumeSnapshot in the same namespace which the workspace volume is restored from, backups
+	// created by operator can be restored in this way.
+	SourceSnapshot string `json:"sourceSnapshot,omitempty" protobuf:"bytes,1,opt,name=sourceSnapshot"`
+	// Specifies the golden PersistentVolumeClaim in the same namespace which the workspace volume is cloned from.
+	SourcePVC string `json:"sourcePVC,omitempty" protobuf:"bytes,2,opt,name=sourcePVC"`
+	// Specifies the CodeServerPrebuild in the same namespace whose latest snapshot of branch the workspace volume
+	// is restored from, volume starts empty if no prebuild succeeded yet.
+	SourcePrebuild *PrebuildReference `json:"sourcePrebuild,omitempty" protobuf:"bytes,3,opt,name=sourcePrebuild"`
+	// Specifies the url of a tar.gz archive which the workspace volume is populated from when it's created, e.g. a
+	// workspace exported from another cluster.
+	SourceArchive string `json:"sourceArchive,omitempty" protobuf:"bytes,4,opt,name=sourceArchive"`
+}
+
+// PrebuildReference refers to the prebuild of a branch
+type PrebuildReference struct {
+	// Name of the CodeServerPrebuild.
+	Name string `json:"name" protobuf:"bytes,1,opt,name=name"`
+	// Branch prebuilt.
+	Branch string `json:"branch" protobuf:"bytes,2,opt,name=branch"`
+}
+
+// BackupSpec describes the scheduled VolumeSnapshot backups of workspace volume
+type BackupSpec struct {
+	// Specifies the cron schedule of backups, for example '0 2 * * *'.
+	Schedule string `json:"schedule" protobuf:"bytes,1,opt,name=schedule"`
+	// Specifies the number of backups to keep, defaults to 3.
+	// +kubebuilder:validation:Minimum=1
+	Retention int `json:"retention,omitempty" protobuf:"varint,2,opt,name=retention"`
+	// Specifies the VolumeSnapshotClass used to create backups, cluster default will be used if empty.
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty" protobuf:"bytes,3,opt,name=volumeSnapshotClassName"`
+}
+
+// GPUVendor describes the vendor of gpu device plugin
+type GPUVendor string
+
+const (
+	// GPUNvidia stands for nvidia.com/gpu resource.
+	GPUNvidia GPUVendor = "nvidia"
+	// GPUAMD stands for amd.com/gpu resource.
+	GPUAMD GPUVendor = "amd"
+)
+
+// GPUSpec describes the accelerators requested by instance
+type GPUSpec struct {
+	// Specifies the gpu vendor, 'nvidia' and 'amd' are supported, defaults to nvidia.
+	// +kubebuilder:validation:Enum=nvidia;amd
+	Vendor GPUVendor `json:"vendor,omitempty" protobuf:"bytes,1,opt,name=vendor"`
+	// Specifies the number of gpus requested.
+	// +kubebuilder:validation:Minimum=1
+	Count int64 `json:"count" protobuf:"varint,2,opt,name=count"`
+	// Specifies the node selector of gpu node pool, merged into node selector of instance.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty" protobuf:"bytes,3,opt,name=nodeSelector"`
+	// Whether to tolerate the NoSchedule taint keyed by gpu resource name which is commonly used for gpu node pools.
+	TolerateTaint bool `json:"tolerateTaint,omitempty" protobuf:"bytes,4,opt,name=tolerateTaint"`
+}
+
+// GPUAllocation describes the accelerators allocated to instance
+type GPUAllocation struct {
+	// The gpu resource name.
+	Resource string `json:"resource,omitempty" protobuf:"bytes,1,opt,name=resource"`
+	// The number of gpus allocated.
+	Count int64 `json:"count,omitempty" protobuf:"varint,2,opt,name=count"`
+	// The node where gpus are allocated.
+	NodeName string `json:"nodeName,omitempty" protobuf:"bytes,3,opt,name=nodeName"`
+}
+
+// UpdatePolicy describes how operator wide image rollout is applied to instance
+type UpdatePolicy string
+
+const (
+	// UpdateNever means instance keeps running its own image.
+	UpdateNever UpdatePolicy = "Never"
+	// UpdateOnRecycle means new image is applied when instance is inactive and will be recreated on next activation.
+	UpdateOnRecycle UpdatePolicy = "OnRecycle"
+	// UpdateRolling means new image is rolled out to instance in batches, idle instances will be restarted first.
+	UpdateRolling UpdatePolicy = "Rolling"
+)
+
 // CodeServerSpec defines the desired state of CodeServer
 type CodeServerSpec struct {
 	// Specifies the runtime used for pod boostrap
@@ -65,7 +239,7 @@ type CodeServerSpec struct {
 	// Specifies the subdomain for pod visiting
 	Subdomain string `json:"subdomain,omitempty" protobuf:"bytes,11,opt,name=subdomain"`
 	// Specifies the envs
-	Envs []v1.EnvVar `json:"envs,omitempty" protobuf:"bytes,12,opt,name=envs"`
+	Envs []v1.EnvVar `json:"envs,omitempty" patchStrategy:"merge" patchMergeKey:"name" protobuf:"bytes,12,opt,name=envs"`
 	// Specifies the command
 	Command []string `json:"command,omitempty" protobuf:"bytes,13,rep,name=command"`
 	// Specifies the args, will be ignored if command specified
@@ -81,15 +255,529 @@ type CodeServerSpec struct {
 	InitPlugins map[string][]string `json:"initPlugins,omitempty" protobuf:"bytes,18,opt,name=initPlugins"`
 	// Specifies the node selector for scheduling.
 	NodeSelector map[string]string `json:"nodeSelector,omitempty" protobuf:"bytes,19,opt,name=nodeSelector"`
-	// Specifies the liveness Probe.
+	// Specifies the liveness Probe, in vscode runtime the health endpoint of IDE is probed by default.
 	LivenessProbe *v1.Probe `json:"livenessProbe,omitempty" protobuf:"bytes,20,opt,name=livenessProbe"`
-	// Specifies the readiness Probe.
+	// Specifies the readiness Probe, in vscode runtime the health endpoint of IDE is probed by default.
 	ReadinessProbe *v1.Probe `json:"readinessProbe,omitempty" protobuf:"bytes,19,opt,name=readinessProbe"`
 	// Specifies the terminal container port for connection, defaults in 8080.
 	ContainerPort string `json:"containerPort,omitempty" protobuf:"bytes,20,opt,name=containerPort"`
 	// Specifies the connectionString for frontend to connect, MUST within to string placeholder for subdomain and
 	// hostname, for example https://%s.%s/terminal or wss://%s.%s/ws, NOTE, tls MUST be enabled
 	ConnectionString string `json:"connectionString,omitempty" protobuf:"bytes,21,opt,name=connectionString"`
+	// Specifies the sidecar containers (databases, docs servers, language servers) running along with code server,
+	// sidecars share the workspace volume and localhost network with code server container.
+	Sidecars []v1.Container `json:"sidecars,omitempty" patchStrategy:"merge" patchMergeKey:"name" protobuf:"bytes,22,rep,name=sidecars"`
+	// Specifies the docker in docker or buildkit sidecar which shares its socket with code server container.
+	Docker *DockerSpec `json:"docker,omitempty" protobuf:"bytes,23,opt,name=docker"`
+	// Specifies the ssh server sidecar for attaching local VS Code or JetBrains Gateway over ssh.
+	SSH *SSHSpec `json:"ssh,omitempty" protobuf:"bytes,24,opt,name=ssh"`
+	// Specifies the webhooks notified when code server becomes ready, is about to be recycled or fails.
+	Notifications []NotificationSpec `json:"notifications,omitempty" patchStrategy:"merge" patchMergeKey:"url" protobuf:"bytes,25,rep,name=notifications"`
+	// Specifies how operator wide image rollout is applied, 'Never', 'OnRecycle' and 'Rolling' are supported,
+	// defaults to Never.
+	// +kubebuilder:validation:Enum=Never;OnRecycle;Rolling
+	UpdatePolicy UpdatePolicy `json:"updatePolicy,omitempty" protobuf:"bytes,26,opt,name=updatePolicy"`
+	// Specifies the cpu architecture of node to schedule, 'amd64' and 'arm64' are supported. The image manifest will
+	// be checked to contain the architecture.
+	// +kubebuilder:validation:Enum=amd64;arm64
+	Arch ArchType `json:"arch,omitempty" protobuf:"bytes,27,opt,name=arch"`
+	// Specifies the gpus requested, gpu resources such as nvidia.com/gpu and amd.com/gpu in resources are also
+	// supported.
+	GPU *GPUSpec `json:"gpu,omitempty" protobuf:"bytes,28,opt,name=gpu"`
+	// Specifies the provisioning options of workspace volume, only used when persistent volume claim is created.
+	Storage *StorageSpec `json:"storage,omitempty" protobuf:"bytes,29,opt,name=storage"`
+	// Specifies the scheduled backups of workspace volume, only persistent volume claim is supported.
+	Backup *BackupSpec `json:"backup,omitempty" protobuf:"bytes,30,opt,name=backup"`
+	// Specifies how the instance is scheduled across failure domains.
+	Scheduling *SchedulingSpec `json:"scheduling,omitempty" protobuf:"bytes,31,opt,name=scheduling"`
+	// Specifies the outbound network of the instance.
+	Network *NetworkSpec `json:"network,omitempty" protobuf:"bytes,32,opt,name=network"`
+	// Specifies the security context of instance pod, e.g. runAsUser, fsGroup and seccompProfile.
+	PodSecurityContext *v1.PodSecurityContext `json:"podSecurityContext,omitempty" protobuf:"bytes,33,opt,name=podSecurityContext"`
+	// Specifies the security context of instance container, e.g. capabilities and readOnlyRootFilesystem,
+	// privileged is still controlled by spec.privileged if absent.
+	SecurityContext *v1.SecurityContext `json:"securityContext,omitempty" protobuf:"bytes,34,opt,name=securityContext"`
+	// Specifies the rootless mode in which instance runs as a non-root user.
+	Rootless *RootlessSpec `json:"rootless,omitempty" protobuf:"bytes,35,opt,name=rootless"`
+	// Specifies the secrets and config maps whose keys are injected as environments of code server container,
+	// unsupported for lxd runtime.
+	EnvFrom []v1.EnvFromSource `json:"envFrom,omitempty" protobuf:"bytes,36,rep,name=envFrom"`
+	// Specifies how resource recommendations are applied.
+	RightSizing *RightSizingSpec `json:"rightSizing,omitempty" protobuf:"bytes,37,opt,name=rightSizing"`
+	// Specifies the sources used to detect whether instance is active, defaults to exporter.
+	Activity *ActivitySpec `json:"activity,omitempty" protobuf:"bytes,38,opt,name=activity"`
+	// Specifies how users are authenticated by code server, 'None', 'Password' and 'Token' are supported, the
+	// password or token is generated by operator and stored in the secret reported in status. Authentication of
+	// image is kept if not specified, only work in vscode runtime.
+	// +kubebuilder:validation:Enum=None;Password;Token
+	Auth AuthType `json:"auth,omitempty" protobuf:"bytes,39,opt,name=auth"`
+	// Specifies the repository whose .gitpod.yml is imported, only work in vscode runtime.
+	GitpodConfig *GitpodConfigSpec `json:"gitpodConfig,omitempty" protobuf:"bytes,40,opt,name=gitpodConfig"`
+	// Specifies the secrets in the same namespace used to pull images of instance, the default pull secret of
+	// operator is appended if configured.
+	ImagePullSecrets []v1.LocalObjectReference `json:"imagePullSecrets,omitempty" patchStrategy:"merge" patchMergeKey:"name" protobuf:"bytes,41,rep,name=imagePullSecrets"`
+	// Specifies the extensions installed before code server starts, e.g. ms-python.python, only work in vscode
+	// runtime.
+	Extensions []string `json:"extensions,omitempty" protobuf:"bytes,42,rep,name=extensions"`
+	// Specifies how developer activity in instance is audited.
+	Audit *AuditSpec `json:"audit,omitempty" protobuf:"bytes,43,opt,name=audit"`
+	// Specifies the home volume mounted at /home/coder, which keeps dotfiles, shell history and extension state
+	// across recycles and re-clones of workspace, only work in vscode runtime.
+	Home *HomeSpec `json:"home,omitempty" protobuf:"bytes,44,opt,name=home"`
+	// Specifies the ReadOnlyMany volumes mounted read only, e.g. a shared go module or npm cache, set in template to
+	// share them across all instances of the template.
+	SharedCaches []SharedCacheSpec `json:"sharedCaches,omitempty" patchStrategy:"merge" patchMergeKey:"mountPath" protobuf:"bytes,45,rep,name=sharedCaches"`
+	// Specifies the ephemeral storage of code server container and the scratch dirs, e.g. /tmp and build dirs.
+	EphemeralStorage *EphemeralStorageSpec `json:"ephemeralStorage,omitempty" protobuf:"bytes,46,opt,name=ephemeralStorage"`
+	// Specifies the arguments and config.yaml of code server, only work in vscode runtime.
+	CodeServer *CodeServerConfigSpec `json:"codeServer,omitempty" protobuf:"bytes,47,opt,name=codeServer"`
+	// Specifies the IDE backend served by image, only work in vscode runtime.
+	IDE *IDESpec `json:"ide,omitempty" protobuf:"bytes,48,opt,name=ide"`
+	// Specifies the remediation of instance whose containers keep crashing or failing to pull image.
+	CrashLoop *CrashLoopSpec `json:"crashLoop,omitempty" protobuf:"bytes,49,opt,name=crashLoop"`
+	// Specifies time in seconds after creation the instance expires regardless of activity.
+	// +kubebuilder:validation:Minimum=1
+	TTLSecondsAfterCreation *int64 `json:"ttlSecondsAfterCreation,omitempty" protobuf:"varint,50,opt,name=ttlSecondsAfterCreation"`
+	// Specifies time in seconds after the instance first became ready it expires regardless of activity.
+	// +kubebuilder:validation:Minimum=1
+	TTLSecondsAfterReady *int64 `json:"ttlSecondsAfterReady,omitempty" protobuf:"varint,51,opt,name=ttlSecondsAfterReady"`
+	// Specifies what happens to expired instance, 'Delete' deletes it and 'Hibernate' marks it inactive so that
+	// compute resources are released while workspace is kept, defaults to Delete.
+	// +kubebuilder:validation:Enum=Delete;Hibernate
+	TTLAction TTLAction `json:"ttlAction,omitempty" protobuf:"bytes,52,opt,name=ttlAction"`
+	// Specifies the weekly budget of running hours or estimated cost, instance exceeding it is hibernated or
+	// recycled until next week.
+	Budget *BudgetSpec `json:"budget,omitempty" protobuf:"bytes,53,opt,name=budget"`
+	// Specifies the teammates workspace is shared with, every collaborator gets its own credential until access
+	// expires.
+	Collaborators []Collaborator `json:"collaborators,omitempty" patchStrategy:"merge" patchMergeKey:"name" protobuf:"bytes,54,rep,name=collaborators"`
+	// Specifies where the user data of code server, i.e. settings and state of extensions, lives. 'Full' keeps it on
+	// workspace volume, 'WorkspaceOnly' on a dedicated small volume so that workspace volume only holds workspace and
+	// 'Ephemeral' on an empty dir which is lost whenever pod is recreated, defaults to Ephemeral. Only works in vscode
+	// runtime, home volume takes precedence.
+	// +kubebuilder:validation:Enum=Full;WorkspaceOnly;Ephemeral
+	Persistence PersistenceStrategy `json:"persistence,omitempty" protobuf:"bytes,55,opt,name=persistence"`
+	// Specifies the standard editor configuration provisioned into user data of new instance, only works in vscode
+	// runtime.
+	SettingsSync *SettingsSyncSpec `json:"settingsSync,omitempty" protobuf:"bytes,56,opt,name=settingsSync"`
+	// Specifies the dataset instance is placed on or near, e.g. a local volume holding terabytes of training data.
+	DataLocality *DataLocalitySpec `json:"dataLocality,omitempty" protobuf:"bytes,57,opt,name=dataLocality"`
+	// Specifies the directories of node mounted into code server container, e.g. fast local NVMe, only the paths
+	// allowed by operator are mounted and instance is pinned to the node it first runs on.
+	HostPaths []HostPathSpec `json:"hostPaths,omitempty" patchStrategy:"merge" patchMergeKey:"mountPath" protobuf:"bytes,58,rep,name=hostPaths"`
+	// Specifies the NFS exports and SMB shares mounted into code server container, e.g. team assets on network
+	// shares.
+	SharedFolders []SharedFolderSpec `json:"sharedFolders,omitempty" patchStrategy:"merge" patchMergeKey:"mountPath" protobuf:"bytes,59,rep,name=sharedFolders"`
+	// Specifies the S3 or GCS buckets mounted into code server container by FUSE sidecars, so that bucket contents
+	// can be browsed in the file tree of editor.
+	Buckets []BucketMountSpec `json:"buckets,omitempty" patchStrategy:"merge" patchMergeKey:"mountPath" protobuf:"bytes,60,rep,name=buckets"`
+}
+
+// BucketProvider describes the object storage bucket lives in
+type BucketProvider string
+
+const (
+	// BucketS3 is Amazon S3 or any S3 compatible storage, e.g. MinIO.
+	BucketS3 BucketProvider = "S3"
+	// BucketGCS is Google Cloud Storage.
+	BucketGCS BucketProvider = "GCS"
+)
+
+// BucketMountSpec describes the object storage bucket mounted into code server container
+type BucketMountSpec struct {
+	// Specifies the object storage of bucket, 'S3' or 'GCS'.
+	// +kubebuilder:validation:Enum=S3;GCS
+	Provider BucketProvider `json:"provider" protobuf:"bytes,1,opt,name=provider"`
+	// Specifies the name of bucket.
+	Bucket string `json:"bucket" protobuf:"bytes,2,opt,name=bucket"`
+	// Specifies the directory in bucket mounted, the root of bucket if empty.
+	Prefix string `json:"prefix,omitempty" protobuf:"bytes,3,opt,name=prefix"`
+	// Specifies the endpoint of S3 compatible storage, e.g. https://minio.example.com, only works with S3.
+	Endpoint string `json:"endpoint,omitempty" protobuf:"bytes,4,opt,name=endpoint"`
+	// Specifies the region of bucket, only works with S3.
+	Region string `json:"region,omitempty" protobuf:"bytes,5,opt,name=region"`
+	// Specifies the path bucket is mounted at in code server container.
+	MountPath string `json:"mountPath" protobuf:"bytes,6,opt,name=mountPath"`
+	// Specifies whether bucket is mounted read only.
+	ReadOnly bool `json:"readOnly,omitempty" protobuf:"varint,7,opt,name=readOnly"`
+	// Specifies the secret of credentials in the namespace of instance, i.e. AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY for S3 or the service account key.json for GCS. Credentials of environment, e.g.
+	// workload identity, are used if empty.
+	CredentialsSecret string `json:"credentialsSecret,omitempty" protobuf:"bytes,8,opt,name=credentialsSecret"`
+}
+
+// SharedFolderProtocol describes the protocol of network share
+type SharedFolderProtocol string
+
+const (
+	// SharedFolderNFS mounts NFS export with the in-tree nfs volume.
+	SharedFolderNFS SharedFolderProtocol = "NFS"
+	// SharedFolderSMB mounts SMB share with the csi driver of operator, e.g. smb.csi.k8s.io.
+	SharedFolderSMB SharedFolderProtocol = "SMB"
+)
+
+// SharedFolderSpec describes the network share mounted into code server container
+type SharedFolderSpec struct {
+	// Specifies the protocol of share, 'NFS' or 'SMB', defaults to NFS.
+	// +kubebuilder:validation:Enum=NFS;SMB
+	Protocol SharedFolderProtocol `json:"protocol,omitempty" protobuf:"bytes,1,opt,name=protocol"`
+	// Specifies the host name or address of file server.
+	Server string `json:"server" protobuf:"bytes,2,opt,name=server"`
+	// Specifies the exported path of NFS or the share name of SMB, e.g. /exports/assets or assets.
+	Path string `json:"path" protobuf:"bytes,3,opt,name=path"`
+	// Specifies the path share is mounted at in code server container.
+	MountPath string `json:"mountPath" protobuf:"bytes,4,opt,name=mountPath"`
+	// Specifies whether share is mounted read only.
+	ReadOnly bool `json:"readOnly,omitempty" protobuf:"varint,5,opt,name=readOnly"`
+	// Specifies the secret with username and password of SMB share in the namespace of instance, guest access is
+	// used if empty. NFS doesn't support credentials.
+	CredentialsSecret string `json:"credentialsSecret,omitempty" protobuf:"bytes,6,opt,name=credentialsSecret"`
+}
+
+// HostPathSpec describes the directory of node mounted into code server container
+type HostPathSpec struct {
+	// Specifies the directory on node, it must be under one of the host path prefixes allowed by operator.
+	Path string `json:"path" protobuf:"bytes,1,opt,name=path"`
+	// Specifies the path directory is mounted at in code server container.
+	MountPath string `json:"mountPath" protobuf:"bytes,2,opt,name=mountPath"`
+	// Specifies whether directory is mounted read only.
+	ReadOnly bool `json:"readOnly,omitempty" protobuf:"varint,3,opt,name=readOnly"`
+	// Specifies the type of host path, defaults to DirectoryOrCreate.
+	// +kubebuilder:validation:Enum=DirectoryOrCreate;Directory
+	Type v1.HostPathType `json:"type,omitempty" protobuf:"bytes,4,opt,name=type"`
+}
+
+// SettingsSyncSpec describes where the settings.json and keybindings.json provisioned into instance come from,
+// files already in user data are never overwritten.
+type SettingsSyncSpec struct {
+	// Specifies the url of settings sync server compatible with vs code, settings are fetched once when instance
+	// is created.
+	URL string `json:"url,omitempty" protobuf:"bytes,1,opt,name=url"`
+	// Specifies the secret in the same namespace whose 'token' key authenticates with settings sync server.
+	TokenSecret string `json:"tokenSecret,omitempty" protobuf:"bytes,2,opt,name=tokenSecret"`
+	// Specifies the ConfigMap in the same namespace with settings.json and keybindings.json keys, it's used
+	// instead of settings sync server.
+	ConfigMap string `json:"configMap,omitempty" protobuf:"bytes,3,opt,name=configMap"`
+}
+
+// PersistenceStrategy describes where the user data of code server lives
+type PersistenceStrategy string
+
+const (
+	// PersistenceFull keeps user data in a sub path of workspace volume.
+	PersistenceFull PersistenceStrategy = "Full"
+	// PersistenceWorkspaceOnly keeps user data on a dedicated volume owned by instance.
+	PersistenceWorkspaceOnly PersistenceStrategy = "WorkspaceOnly"
+	// PersistenceEphemeral keeps user data on an empty dir.
+	PersistenceEphemeral PersistenceStrategy = "Ephemeral"
+)
+
+// CollaboratorAccess describes how collaborator accesses the shared workspace
+type CollaboratorAccess string
+
+const (
+	// CollaboratorReadOnly serves workspace mounted read-only.
+	CollaboratorReadOnly CollaboratorAccess = "ReadOnly"
+	// CollaboratorReadWrite serves workspace mounted read-write.
+	CollaboratorReadWrite CollaboratorAccess = "ReadWrite"
+)
+
+// Collaborator describes the teammate workspace is temporarily shared with
+type Collaborator struct {
+	// Specifies the identity of collaborator, e.g. email, which is the user name of basic auth or the email
+	// allowed by oauth2 proxy.
+	Name string `json:"name" protobuf:"bytes,1,opt,name=name"`
+	// Specifies the access of collaborator, defaults to ReadOnly.
+	// +kubebuilder:validation:Enum=ReadOnly;ReadWrite
+	Access CollaboratorAccess `json:"access,omitempty" protobuf:"bytes,2,opt,name=access"`
+	// Specifies the time access expires, never if empty.
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty" protobuf:"bytes,3,opt,name=expiresAt"`
+}
+
+// BudgetAction describes what happens to instance once its budget is exceeded
+type BudgetAction string
+
+const (
+	// BudgetHibernate marks instance inactive and keeps it inactive until next week.
+	BudgetHibernate BudgetAction = "Hibernate"
+	// BudgetRecycle marks instance recycled, which releases its workspace volume as well.
+	BudgetRecycle BudgetAction = "Recycle"
+)
+
+// BudgetSpec describes the weekly budget of instance, weeks start on Monday 00:00 UTC
+type BudgetSpec struct {
+	// Specifies the maximum running hours per week.
+	// +kubebuilder:validation:Minimum=1
+	MaxHoursPerWeek *int64 `json:"maxHoursPerWeek,omitempty" protobuf:"varint,1,opt,name=maxHoursPerWeek"`
+	// Specifies the maximum estimated cost per week in currency of price sheet of operator, e.g. '25.5'.
+	// +kubebuilder:validation:Pattern=`^[0-9]+(\.[0-9]+)?$`
+	MaxCostPerWeek string `json:"maxCostPerWeek,omitempty" protobuf:"bytes,2,opt,name=maxCostPerWeek"`
+	// Specifies what happens to instance exceeding its budget, defaults to Hibernate.
+	// +kubebuilder:validation:Enum=Hibernate;Recycle
+	Action BudgetAction `json:"action,omitempty" protobuf:"bytes,3,opt,name=action"`
+	// Specifies the percentage of budget used when warning condition is set, defaults to 80.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	WarningPercent *int32 `json:"warningPercent,omitempty" protobuf:"varint,4,opt,name=warningPercent"`
+}
+
+// TTLAction describes what happens to instance once its ttl expires
+type TTLAction string
+
+const (
+	// TTLDelete deletes expired instance.
+	TTLDelete TTLAction = "Delete"
+	// TTLHibernate marks expired instance inactive and keeps it inactive.
+	TTLHibernate TTLAction = "Hibernate"
+)
+
+// CrashLoopSpec describes the remediation of crash looping instance
+type CrashLoopSpec struct {
+	// Rolls back to the last-known-good image of template after the number of container restarts, image pull
+	// failures are rolled back immediately. Zero disables rollback.
+	// +kubebuilder:validation:Minimum=0
+	RollbackAfter int32 `json:"rollbackAfter,omitempty" protobuf:"varint,1,opt,name=rollbackAfter"`
+}
+
+// IDEFlavor describes the IDE backend of instance
+type IDEFlavor string
+
+const (
+	// IDECodeServer is code-server of coder.
+	IDECodeServer IDEFlavor = "codeserver"
+	// IDEOpenVSCode is OpenVSCode Server of gitpod.
+	IDEOpenVSCode IDEFlavor = "openvscode"
+	// IDEJetBrains is JetBrains Projector.
+	IDEJetBrains IDEFlavor = "jetbrains"
+)
+
+// IDESpec describes the IDE backend served by image of instance
+type IDESpec struct {
+	// Specifies the IDE backend, 'codeserver', 'openvscode' and 'jetbrains' are supported, defaults to codeserver.
+	// Authentication, extensions and code server arguments only work with codeserver.
+	// +kubebuilder:validation:Enum=codeserver;openvscode;jetbrains
+	Flavor IDEFlavor `json:"flavor,omitempty" protobuf:"bytes,1,opt,name=flavor"`
+}
+
+// CodeServerConfigSpec customizes code server without building custom images
+type CodeServerConfigSpec struct {
+	// Specifies the additional arguments of code server, e.g. --disable-telemetry.
+	Args []string `json:"args,omitempty" protobuf:"bytes,1,rep,name=args"`
+	// Specifies the entries of config.yaml, e.g. proxy-domain and user-data-dir, arguments generated by operator
+	// take precedence over them.
+	Config map[string]string `json:"config,omitempty" protobuf:"bytes,2,rep,name=config"`
+}
+
+// EphemeralStorageSpec describes the node local storage used by code server container
+type EphemeralStorageSpec struct {
+	// Specifies the ephemeral-storage request of code server container.
+	Request *resource.Quantity `json:"request,omitempty" protobuf:"bytes,1,opt,name=request"`
+	// Specifies the ephemeral-storage limit of code server container, pod is evicted once exceeded.
+	Limit *resource.Quantity `json:"limit,omitempty" protobuf:"bytes,2,opt,name=limit"`
+	// Specifies the scratch dirs mounted as empty dirs.
+	ScratchDirs []ScratchDirSpec `json:"scratchDirs,omitempty" patchStrategy:"merge" patchMergeKey:"path" protobuf:"bytes,3,rep,name=scratchDirs"`
+}
+
+// ScratchDirSpec describes an empty dir mounted into code server container
+type ScratchDirSpec struct {
+	// Specifies the path scratch dir is mounted at, e.g. /tmp.
+	Path string `json:"path" protobuf:"bytes,1,opt,name=path"`
+	// Specifies the size limit of scratch dir.
+	Size *resource.Quantity `json:"size,omitempty" protobuf:"bytes,2,opt,name=size"`
+	// Whether to back scratch dir by tmpfs, the usage counts against memory limit of container.
+	Tmpfs bool `json:"tmpfs,omitempty" protobuf:"varint,3,opt,name=tmpfs"`
+}
+
+// SharedCacheSpec describes a cache volume shared by instances
+type SharedCacheSpec struct {
+	// Specifies the PersistentVolumeClaim in the same namespace, which supports ReadOnlyMany or ReadWriteMany.
+	ClaimName string `json:"claimName" protobuf:"bytes,1,opt,name=claimName"`
+	// Specifies the path cache is mounted at in code server container, e.g. /home/coder/go/pkg/mod.
+	MountPath string `json:"mountPath" protobuf:"bytes,2,opt,name=mountPath"`
+	// Specifies the sub path of volume mounted, the root of volume if empty.
+	SubPath string `json:"subPath,omitempty" protobuf:"bytes,3,opt,name=subPath"`
+}
+
+// HomeSpec describes the home volume of user, which isn't owned by instance and survives recycles
+type HomeSpec struct {
+	// Specifies the storage class of home volume, storage class of instance is used if empty.
+	StorageName string `json:"storageName,omitempty" protobuf:"bytes,1,opt,name=storageName"`
+	// Specifies the size of home volume.
+	StorageSize string `json:"storageSize" protobuf:"bytes,2,opt,name=storageSize"`
+	// Specifies the access modes of home volume, defaults to ReadWriteOnce. ReadWriteMany is required when the
+	// user runs multiple instances on different nodes.
+	AccessModes []v1.PersistentVolumeAccessMode `json:"accessModes,omitempty" protobuf:"bytes,3,rep,name=accessModes"`
+	// Specifies the name of home volume, defaults to home-<user> for instances of user, <name>-home otherwise.
+	ClaimName string `json:"claimName,omitempty" protobuf:"bytes,4,opt,name=claimName"`
+}
+
+// AuditSpec describes the auditing of developer activity in instance
+type AuditSpec struct {
+	// Whether to record terminal sessions of code server and upload the recordings to the object store of operator,
+	// only work in vscode runtime. Instances may only opt in, recording enforced by operator can't be disabled.
+	RecordSessions bool `json:"recordSessions,omitempty" protobuf:"varint,1,opt,name=recordSessions"`
+	// Deprecated: retention of recordings is the policy of operator, the field is ignored.
+	// +kubebuilder:validation:Minimum=1
+	RetentionDays *int `json:"retentionDays,omitempty" protobuf:"varint,2,opt,name=retentionDays"`
+}
+
+// GitpodConfigSpec describes the repository with .gitpod.yml, the image and init tasks run in init containers,
+// command tasks are started once code server started, and ports are exposed by service.
+type GitpodConfigSpec struct {
+	// Git url of repository which is cloned into workspace.
+	Repository string `json:"repository" protobuf:"bytes,1,opt,name=repository"`
+	// Branch or tag to clone, default branch is used if not specified.
+	Revision string `json:"revision,omitempty" protobuf:"bytes,2,opt,name=revision"`
+	// Raw url of .gitpod.yml, derived from repository for github and gitlab if not specified.
+	ConfigURL string `json:"configURL,omitempty" protobuf:"bytes,3,opt,name=configURL"`
+	// Folder under workspace which repository is cloned into, defaults to repository name.
+	Folder string `json:"folder,omitempty" protobuf:"bytes,4,opt,name=folder"`
+}
+
+// AuthType describes how users are authenticated by code server
+type AuthType string
+
+const (
+	// AuthNone disables authentication of code server.
+	AuthNone AuthType = "None"
+	// AuthPassword authenticates users with a generated password, only the hash is passed to code server.
+	AuthPassword AuthType = "Password"
+	// AuthToken authenticates users and scripts with a generated long random token.
+	AuthToken AuthType = "Token"
+)
+
+// ActivitySourceType describes where the activity of instance is observed
+type ActivitySourceType string
+
+const (
+	// ActivitySourceExporter stands for the status exporter sidecar, either probed or pushing events.
+	ActivitySourceExporter ActivitySourceType = "exporter"
+	// ActivitySourceEndpoints stands for the established client connections on ready endpoints of service.
+	ActivitySourceEndpoints ActivitySourceType = "endpoints"
+	// ActivitySourceIngress stands for the ingress controller access logs tailed by operator.
+	ActivitySourceIngress ActivitySourceType = "ingress"
+)
+
+// ActivityMode describes how multiple activity sources are combined
+type ActivityMode string
+
+const (
+	// ActivityModeAny treats instance active if any source is active (OR).
+	ActivityModeAny ActivityMode = "Any"
+	// ActivityModeAll treats instance active only if all sources are active (AND).
+	ActivityModeAll ActivityMode = "All"
+)
+
+// ActivitySpec describes how the activity of instance is detected
+type ActivitySpec struct {
+	// Sources used to detect activity, 'exporter', 'endpoints' and 'ingress' are supported.
+	Sources []ActivitySourceType `json:"sources,omitempty" protobuf:"bytes,1,rep,name=sources"`
+	// Specifies how sources are combined, 'Any' and 'All' are supported, defaults to Any.
+	// +kubebuilder:validation:Enum=Any;All
+	Mode ActivityMode `json:"mode,omitempty" protobuf:"bytes,2,opt,name=mode"`
+}
+
+// RightSizingSpec describes how resource recommendations are applied
+type RightSizingSpec struct {
+	// Whether to replace cpu and memory requests of code server container with recommendations when instance is
+	// started next time, running instance is never restarted for resizing.
+	AutoResize bool `json:"autoResize,omitempty" protobuf:"varint,1,opt,name=autoResize"`
+}
+
+// NetworkSpec describes the outbound network of instance
+type NetworkSpec struct {
+	// Proxy for http requests, injected as HTTP_PROXY and http_proxy.
+	HTTPProxy string `json:"httpProxy,omitempty" protobuf:"bytes,1,opt,name=httpProxy"`
+	// Proxy for https requests, injected as HTTPS_PROXY and https_proxy.
+	HTTPSProxy string `json:"httpsProxy,omitempty" protobuf:"bytes,2,opt,name=httpsProxy"`
+	// Comma separated hosts which are accessed directly, injected as NO_PROXY and no_proxy.
+	NoProxy string `json:"noProxy,omitempty" protobuf:"bytes,3,opt,name=noProxy"`
+	// Whether to block direct egress with a NetworkPolicy, only DNS and proxy CIDRs are reachable then.
+	BlockDirectEgress bool `json:"blockDirectEgress,omitempty" protobuf:"varint,4,opt,name=blockDirectEgress"`
+	// CIDRs of proxy servers which are allowed when direct egress is blocked.
+	ProxyCIDRs []string `json:"proxyCIDRs,omitempty" protobuf:"bytes,5,rep,name=proxyCIDRs"`
+	// How instance is routed by ingress, 'Subdomain' and 'PathPrefix' are supported, defaults to Subdomain.
+	// +kubebuilder:validation:Enum=Subdomain;PathPrefix
+	Routing RoutingMode `json:"routing,omitempty" protobuf:"bytes,6,opt,name=routing"`
+	// Whether to route instance with istio VirtualService and mutual TLS instead of Ingress, operator wide
+	// provider is used if not specified.
+	Mesh *bool `json:"mesh,omitempty" protobuf:"varint,7,opt,name=mesh"`
+	// Non-http ports of instance exposed on the load balancer ip shared by instances or on node ports, external
+	// ports are reported in ready condition.
+	AdditionalPorts []AdditionalPort `json:"additionalPorts,omitempty" patchStrategy:"merge" patchMergeKey:"name" protobuf:"bytes,8,rep,name=additionalPorts"`
+	// IP families of the generated services, e.g. [IPv6, IPv4] for dual-stack preferring IPv6, the first family
+	// must be reachable by the ingress controller. Cluster default is used if not specified.
+	// +kubebuilder:validation:MaxItems=2
+	IPFamilies []v1.IPFamily `json:"ipFamilies,omitempty" protobuf:"bytes,9,rep,name=ipFamilies"`
+	// IP family policy of the generated services, 'SingleStack', 'PreferDualStack' and 'RequireDualStack' are
+	// supported. Cluster default is used if not specified.
+	// +kubebuilder:validation:Enum=SingleStack;PreferDualStack;RequireDualStack
+	IPFamilyPolicy *v1.IPFamilyPolicyType `json:"ipFamilyPolicy,omitempty" protobuf:"bytes,10,opt,name=ipFamilyPolicy"`
+	// Whether to route instance at all, headless instance is only reachable via its cluster ip service, e.g.
+	// through the access proxy of api server or kubectl port-forward.
+	Headless bool `json:"headless,omitempty" protobuf:"varint,11,opt,name=headless"`
+}
+
+// AdditionalPort describes a tcp or udp port of instance exposed outside cluster
+type AdditionalPort struct {
+	// Specifies the name of port, which is unique in instance.
+	// +kubebuilder:validation:MaxLength=15
+	// +kubebuilder:validation:Pattern=^[a-z0-9]([-a-z0-9]*[a-z0-9])?$
+	Name string `json:"name" protobuf:"bytes,1,opt,name=name"`
+	// Specifies the port listened in instance.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port" protobuf:"varint,2,opt,name=port"`
+	// Specifies the protocol of port, 'TCP' and 'UDP' are supported, defaults to TCP.
+	// +kubebuilder:validation:Enum=TCP;UDP
+	Protocol v1.Protocol `json:"protocol,omitempty" protobuf:"bytes,3,opt,name=protocol"`
+}
+
+// RoutingMode describes how the url of instance is built
+type RoutingMode string
+
+const (
+	// RoutingSubdomain serves instance on https://<subdomain>.<domain>/.
+	RoutingSubdomain RoutingMode = "Subdomain"
+	// RoutingPathPrefix serves instance on https://<domain>/ws/<namespace>/<name>/, neither wildcard DNS nor wildcard
+	// certificate is required.
+	RoutingPathPrefix RoutingMode = "PathPrefix"
+)
+
+// SchedulingSpec describes how the instance pod is scheduled
+type SchedulingSpec struct {
+	// Topology spread constraints passed to the instance pod, operator default spreading is disabled once
+	// specified.
+	TopologySpreadConstraints []v1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty" protobuf:"bytes,1,rep,name=topologySpreadConstraints"`
+	// Name of the scheduling profile defined in operator config, which expands to node selector, tolerations
+	// and affinity.
+	Profile string `json:"profile,omitempty" protobuf:"bytes,2,opt,name=profile"`
+}
+
+// DataLocalityMode describes how strictly instance is placed near its dataset
+type DataLocalityMode string
+
+const (
+	// DataLocalityRequired only schedules instance on or near the nodes holding dataset.
+	DataLocalityRequired DataLocalityMode = "Required"
+	// DataLocalityPreferred schedules instance elsewhere if the nodes holding dataset have no room.
+	DataLocalityPreferred DataLocalityMode = "Preferred"
+)
+
+// DataLocalitySpec describes the nodes holding the dataset of instance, either by the volume of dataset or by node
+// labels
+type DataLocalitySpec struct {
+	// Specifies the PersistentVolumeClaim of dataset in the same namespace, instance is placed on the nodes its
+	// volume is accessible from, i.e. the node affinity of local or hostPath volume.
+	ClaimName string `json:"claimName,omitempty" protobuf:"bytes,1,opt,name=claimName"`
+	// Specifies the labels of the nodes holding dataset, e.g. dataset.example.com/imagenet: "true".
+	NodeLabels map[string]string `json:"nodeLabels,omitempty" protobuf:"bytes,2,opt,name=nodeLabels"`
+	// Specifies the topology key, e.g. topology.kubernetes.io/zone, instance is placed in the same topology domain
+	// as the nodes holding dataset rather than on them.
+	TopologyKey string `json:"topologyKey,omitempty" protobuf:"bytes,3,opt,name=topologyKey"`
+	// Specifies whether locality is 'Required' or only 'Preferred', defaults to Required.
+	// +kubebuilder:validation:Enum=Required;Preferred
+	Mode DataLocalityMode `json:"mode,omitempty" protobuf:"bytes,4,opt,name=mode"`
 }
 
 // ServerConditionType describes the type of state of code server condition
@@ -108,6 +796,24 @@ const (
 	ServerInactive ServerConditionType = "ServerInactive"
 	// ServerErrored means failed to reconcile code server.
 	ServerErrored ServerConditionType = "ServerErrored"
+	// ServerPendingRecycle means the code server has been detected inactive and will be marked inactive after grace period.
+	ServerPendingRecycle ServerConditionType = "ServerPendingRecycle"
+	// ServerInitialized means the init containers of instance pod, e.g. repository clone, have finished.
+	ServerInitialized ServerConditionType = "ServerInitialized"
+	// ServerExtensionsInstalled means the extensions in spec have been installed.
+	ServerExtensionsInstalled ServerConditionType = "ServerExtensionsInstalled"
+	// ServerBootstrapped means the bootstrap scripts, e.g. init tasks of .gitpod.yml, have finished.
+	ServerBootstrapped ServerConditionType = "ServerBootstrapped"
+	// ServerFailed means containers of the code server keep crashing or failing to pull image.
+	ServerFailed ServerConditionType = "ServerFailed"
+	// ServerDrifted means generated resources have been modified out of band and are not reverted.
+	ServerDrifted ServerConditionType = "ServerDrifted"
+	// ServerPaused means reconciliation and recycling of the code server have been paused.
+	ServerPaused ServerConditionType = "ServerPaused"
+	// ServerBudgetWarning means the code server has used most of its weekly budget.
+	ServerBudgetWarning ServerConditionType = "ServerBudgetWarning"
+	// ServerBudgetExceeded means the code server has exceeded its weekly budget and is kept stopped.
+	ServerBudgetExceeded ServerConditionType = "ServerBudgetExceeded"
 )
 
 // ServerCondition describes the state of the code server at a certain point.
@@ -130,6 +836,160 @@ type ServerCondition struct {
 type CodeServerStatus struct {
 	//Server conditions
 	Conditions []ServerCondition `json:"conditions,omitempty" protobuf:"bytes,1,opt,name=conditions"`
+	// Gpus allocated to the running instance
+	GPUAllocation *GPUAllocation `json:"gpuAllocation,omitempty" protobuf:"bytes,2,opt,name=gpuAllocation"`
+	// The last time workspace backup was taken
+	LastBackupTime *metav1.Time `json:"lastBackupTime,omitempty" protobuf:"bytes,3,opt,name=lastBackupTime"`
+	// The name of last workspace backup
+	LastBackupName string `json:"lastBackupName,omitempty" protobuf:"bytes,4,opt,name=lastBackupName"`
+	// Resource consumption of the running instance, refreshed every probe
+	Usage *UsageStatus `json:"usage,omitempty" protobuf:"bytes,5,opt,name=usage"`
+	// Resource recommendations based on historical usage
+	RightSizing *RightSizingStatus `json:"rightSizing,omitempty" protobuf:"bytes,6,opt,name=rightSizing"`
+	// The name of secret holding the generated password or token of instance
+	AuthSecretName string `json:"authSecretName,omitempty" protobuf:"bytes,7,opt,name=authSecretName"`
+	// The provisioning progress of instance until it becomes ready
+	Progress *ProgressStatus `json:"progress,omitempty" protobuf:"bytes,8,opt,name=progress"`
+	// Resources generated for instance and the state operator applied
+	ManagedResources []ManagedResource `json:"managedResources,omitempty" protobuf:"bytes,9,rep,name=managedResources"`
+	// The first time instance became ready
+	FirstReadyTime *metav1.Time `json:"firstReadyTime,omitempty" protobuf:"bytes,10,opt,name=firstReadyTime"`
+	// Estimated cost of instance from resource requests and price sheet of operator.
+	Cost *CostStatus `json:"cost,omitempty" protobuf:"bytes,11,opt,name=cost"`
+	// Budget used in the current week.
+	Budget *BudgetStatus `json:"budget,omitempty" protobuf:"bytes,12,opt,name=budget"`
+	// Access of collaborators workspace is shared with.
+	Collaborators []CollaboratorStatus `json:"collaborators,omitempty" protobuf:"bytes,13,rep,name=collaborators"`
+	// The https certificate instance is served with.
+	Certificate *CertificateStatus `json:"certificate,omitempty" protobuf:"bytes,14,opt,name=certificate"`
+}
+
+// CertificateStatus describes the https certificate of instance and whether ingress already serves it
+type CertificateStatus struct {
+	// Sha256 fingerprint of the certificate in https secret.
+	Fingerprint string `json:"fingerprint" protobuf:"bytes,1,opt,name=fingerprint"`
+	// The time certificate expires.
+	NotAfter *metav1.Time `json:"notAfter,omitempty" protobuf:"bytes,2,opt,name=notAfter"`
+	// Sha256 fingerprint of the certificate observed on the host of instance, empty if it couldn't be probed.
+	Served string `json:"served,omitempty" protobuf:"bytes,3,opt,name=served"`
+	// Whether the host of instance still serves another certificate, e.g. the one before rotation.
+	Stale bool `json:"stale,omitempty" protobuf:"varint,4,opt,name=stale"`
+}
+
+// CollaboratorStatus describes the access of collaborator
+type CollaboratorStatus struct {
+	// Name of collaborator.
+	Name string `json:"name" protobuf:"bytes,1,opt,name=name"`
+	// Access of collaborator.
+	Access CollaboratorAccess `json:"access" protobuf:"bytes,2,opt,name=access"`
+	// Url collaborator opens the shared workspace with.
+	URL string `json:"url,omitempty" protobuf:"bytes,3,opt,name=url"`
+	// Key of the password of collaborator in secret <name>-collaborators, empty if authenticated by oauth2 proxy.
+	SecretKey string `json:"secretKey,omitempty" protobuf:"bytes,4,opt,name=secretKey"`
+	// Whether access has expired.
+	Expired bool `json:"expired,omitempty" protobuf:"varint,5,opt,name=expired"`
+	// Key of the password of code server serving the access in secret <name>-collaborators, which is shared by
+	// collaborators of the same access.
+	AccessSecretKey string `json:"accessSecretKey,omitempty" protobuf:"bytes,6,opt,name=accessSecretKey"`
+}
+
+// BudgetStatus describes the budget used in the current week
+type BudgetStatus struct {
+	// The start of the current week.
+	WeekStart metav1.Time `json:"weekStart" protobuf:"bytes,1,opt,name=weekStart"`
+	// Seconds instance has been running in the current week.
+	RunningSeconds int64 `json:"runningSeconds" protobuf:"varint,2,opt,name=runningSeconds"`
+	// Estimated cost accrued in the current week.
+	Cost string `json:"cost,omitempty" protobuf:"bytes,3,opt,name=cost"`
+	// The last time budget was accounted.
+	UpdateTime metav1.Time `json:"updateTime" protobuf:"bytes,4,opt,name=updateTime"`
+}
+
+// CostStatus describes the estimated hourly cost of instance, amounts are decimals in currency of price sheet
+type CostStatus struct {
+	// Hourly cost of compute resources (cpu, memory and gpu) requested while instance is running.
+	Compute string `json:"compute" protobuf:"bytes,1,opt,name=compute"`
+	// Hourly cost of workspace volume, which is charged while instance is inactive as well.
+	Storage string `json:"storage" protobuf:"bytes,2,opt,name=storage"`
+	// Hourly cost of instance in its current state.
+	Hourly string `json:"hourly" protobuf:"bytes,3,opt,name=hourly"`
+	// Currency of amounts.
+	Currency string `json:"currency,omitempty" protobuf:"bytes,4,opt,name=currency"`
+}
+
+// ManagedResource records the state of generated resource applied by operator, so that out-of-band edits are detected.
+type ManagedResource struct {
+	// Kind of resource, e.g. Deployment
+	Kind string `json:"kind" protobuf:"bytes,1,opt,name=kind"`
+	// Name of resource
+	Name string `json:"name" protobuf:"bytes,2,opt,name=name"`
+	// Generation of resource after operator applied it
+	Generation int64 `json:"generation,omitempty" protobuf:"varint,3,opt,name=generation"`
+	// Hash of the desired spec applied by operator
+	Hash string `json:"hash,omitempty" protobuf:"bytes,4,opt,name=hash"`
+	// Whether resource has been modified out of band and left as is
+	Drifted bool `json:"drifted,omitempty" protobuf:"varint,5,opt,name=drifted"`
+}
+
+// StagePhase describes the phase of provisioning stage
+type StagePhase string
+
+const (
+	StagePending StagePhase = "Pending"
+	StageRunning StagePhase = "Running"
+	StageDone    StagePhase = "Done"
+	StageFailed  StagePhase = "Failed"
+)
+
+// ProgressStatus describes the provisioning stages of instance, e.g. volume bound, bootstrap and extension
+// installation, so that portals can render a progress bar.
+type ProgressStatus struct {
+	// The first stage not done yet, empty if all stages are done
+	Stage string `json:"stage,omitempty" protobuf:"bytes,1,opt,name=stage"`
+	// Percentage of stages done
+	Percent int32 `json:"percent" protobuf:"varint,2,opt,name=percent"`
+	// Stages in the order of execution
+	Stages []ProgressStage `json:"stages,omitempty" protobuf:"bytes,3,rep,name=stages"`
+}
+
+// ProgressStage describes a provisioning stage of instance
+type ProgressStage struct {
+	// Name of stage
+	Name string `json:"name" protobuf:"bytes,1,opt,name=name"`
+	// Phase of stage, 'Pending', 'Running', 'Done' and 'Failed'
+	Phase StagePhase `json:"phase" protobuf:"bytes,2,opt,name=phase"`
+	// Human readable message of stage
+	Message string `json:"message,omitempty" protobuf:"bytes,3,opt,name=message"`
+}
+
+// RightSizingStatus describes the resource recommendations of instance
+type RightSizingStatus struct {
+	// Recommended cpu request of code server container
+	RecommendedCPU *resource.Quantity `json:"recommendedCPU,omitempty" protobuf:"bytes,1,opt,name=recommendedCPU"`
+	// Recommended memory request of code server container
+	RecommendedMemory *resource.Quantity `json:"recommendedMemory,omitempty" protobuf:"bytes,2,opt,name=recommendedMemory"`
+	// Count of usage samples which recommendations are based on
+	Samples int32 `json:"samples,omitempty" protobuf:"varint,3,opt,name=samples"`
+	// Cpu request applied when instance was started last time
+	AppliedCPU *resource.Quantity `json:"appliedCPU,omitempty" protobuf:"bytes,4,opt,name=appliedCPU"`
+	// Memory request applied when instance was started last time
+	AppliedMemory *resource.Quantity `json:"appliedMemory,omitempty" protobuf:"bytes,5,opt,name=appliedMemory"`
+}
+
+// UsageStatus describes the resource consumption of instance
+type UsageStatus struct {
+	// Current cpu usage of all containers
+	CPU *resource.Quantity `json:"cpu,omitempty" protobuf:"bytes,1,opt,name=cpu"`
+	// Current memory usage of all containers
+	Memory *resource.Quantity `json:"memory,omitempty" protobuf:"bytes,2,opt,name=memory"`
+	// Used bytes of workspace volume
+	StorageUsed *resource.Quantity `json:"storageUsed,omitempty" protobuf:"bytes,3,opt,name=storageUsed"`
+	// Capacity bytes of workspace volume
+	StorageCapacity *resource.Quantity `json:"storageCapacity,omitempty" protobuf:"bytes,4,opt,name=storageCapacity"`
+	// The last time instance was active
+	LastActiveTime *metav1.Time `json:"lastActiveTime,omitempty" protobuf:"bytes,5,opt,name=lastActiveTime"`
+	// The last time usage was refreshed
+	UpdateTime *metav1.Time `json:"updateTime,omitempty" protobuf:"bytes,6,opt,name=updateTime"`
 }
 
 // +kubebuilder:object:root=true
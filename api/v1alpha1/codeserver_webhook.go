@@ -0,0 +1,74 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"strings"
+)
+
+// log is for logging in this package.
+var codeserverlog = logf.Log.WithName("codeserver-resource")
+
+func (r *CodeServer) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-cs-opensourceways-com-v1alpha1-codeserver,mutating=true,failurePolicy=fail,sideEffects=None,groups=cs.opensourceways.com,resources=codeservers,verbs=create;update,versions=v1alpha1,name=mcodeserver.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &CodeServer{}
+
+// Default implements webhook.Defaulter so that instances run under the "restricted" Pod Security Standard unless
+// they require root, i.e. privileged, docker or ssh sidecars and lxd runtime. Fields specified are kept.
+func (r *CodeServer) Default() {
+	if r.requireRoot() {
+		return
+	}
+	codeserverlog.Info("default security context", "namespace", r.Namespace, "name", r.Name)
+	if r.Spec.PodSecurityContext == nil {
+		r.Spec.PodSecurityContext = &v1.PodSecurityContext{}
+	}
+	if r.Spec.PodSecurityContext.RunAsNonRoot == nil {
+		runAsNonRoot := true
+		r.Spec.PodSecurityContext.RunAsNonRoot = &runAsNonRoot
+	}
+	if r.Spec.PodSecurityContext.SeccompProfile == nil {
+		r.Spec.PodSecurityContext.SeccompProfile = &v1.SeccompProfile{Type: v1.SeccompProfileTypeRuntimeDefault}
+	}
+	if r.Spec.SecurityContext == nil {
+		r.Spec.SecurityContext = &v1.SecurityContext{}
+	}
+	if r.Spec.SecurityContext.AllowPrivilegeEscalation == nil {
+		allowPrivilegeEscalation := false
+		r.Spec.SecurityContext.AllowPrivilegeEscalation = &allowPrivilegeEscalation
+	}
+	if r.Spec.SecurityContext.Capabilities == nil {
+		r.Spec.SecurityContext.Capabilities = &v1.Capabilities{Drop: []v1.Capability{"ALL"}}
+	}
+}
+
+func (r *CodeServer) requireRoot() bool {
+	return (r.Spec.Privileged != nil && *r.Spec.Privileged) ||
+		(r.Spec.Docker != nil && r.Spec.Docker.Enabled) ||
+		(r.Spec.SSH != nil && r.Spec.SSH.Enabled) ||
+		strings.EqualFold(string(r.Spec.Runtime), string(RuntimeLxd))
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CodeServerFleetStatusStatus summarizes all code servers watched by operator
+type CodeServerFleetStatusStatus struct {
+	// The last time summary was refreshed.
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty" protobuf:"bytes,1,opt,name=lastUpdateTime"`
+	// Number of code servers.
+	Total int32 `json:"total" protobuf:"varint,2,opt,name=total"`
+	// Number of code servers by phase, e.g. Ready and Inactive.
+	Phases map[string]int32 `json:"phases,omitempty" protobuf:"bytes,3,rep,name=phases"`
+	// Number of code servers by namespace.
+	Namespaces map[string]int32 `json:"namespaces,omitempty" protobuf:"bytes,4,rep,name=namespaces"`
+	// Number of code servers by the template they are created from, instances created without template are
+	// counted as 'none'.
+	Templates map[string]int32 `json:"templates,omitempty" protobuf:"bytes,5,rep,name=templates"`
+	// Number of running code server pods by node.
+	Nodes map[string]int32 `json:"nodes,omitempty" protobuf:"bytes,6,rep,name=nodes"`
+	// Code servers whose hosts still serve another certificate than the one in https secret, in the format of
+	// namespace/name.
+	StaleCertificates []string `json:"staleCertificates,omitempty" protobuf:"bytes,7,rep,name=staleCertificates"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=csfs
+
+// CodeServerFleetStatus is the Schema for the codeserverfleetstatuses API, it's maintained by operator only.
+type CodeServerFleetStatus struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status CodeServerFleetStatusStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CodeServerFleetStatusList contains a list of CodeServerFleetStatus
+type CodeServerFleetStatusList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CodeServerFleetStatus `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CodeServerFleetStatus{}, &CodeServerFleetStatusList{})
+}
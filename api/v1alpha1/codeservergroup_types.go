@@ -0,0 +1,61 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CodeServerGroupSpec defines the members of a group templates are entitled to
+type CodeServerGroupSpec struct {
+	// Specifies the name of group as referred in allowedGroups of templates, e.g. the common name of directory
+	// group.
+	Group string `json:"group" protobuf:"bytes,1,opt,name=group"`
+	// Specifies the users of group, as recorded in the user annotation of code servers, e.g. emails.
+	Members []string `json:"members,omitempty" protobuf:"bytes,2,rep,name=members"`
+}
+
+// CodeServerGroupStatus defines the observed state of CodeServerGroup
+type CodeServerGroupStatus struct {
+	// The last time members were synced from directory, empty for groups maintained by hand.
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty" protobuf:"bytes,1,opt,name=lastSyncTime"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=csg
+
+// CodeServerGroup is the Schema for the codeservergroups API, groups labeled with source are synced by operator.
+type CodeServerGroup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CodeServerGroupSpec   `json:"spec,omitempty"`
+	Status CodeServerGroupStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CodeServerGroupList contains a list of CodeServerGroup
+type CodeServerGroupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CodeServerGroup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CodeServerGroup{}, &CodeServerGroupList{})
+}
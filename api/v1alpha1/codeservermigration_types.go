@@ -0,0 +1,104 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MigrationRole describes the role of the cluster in a migration
+type MigrationRole string
+
+const (
+	// MigrationSource stops the instance and exports its workspace and spec.
+	MigrationSource MigrationRole = "Source"
+	// MigrationTarget creates the instance from exported workspace and spec.
+	MigrationTarget MigrationRole = "Target"
+)
+
+// CodeServerMigrationSpec defines the desired state of CodeServerMigration
+type CodeServerMigrationSpec struct {
+	// Name of the code server migrated in the namespace of migration.
+	CodeServer string `json:"codeServer" protobuf:"bytes,1,opt,name=codeServer"`
+	// Role of this cluster in the migration, a migration is created with role 'Source' on the cluster moved from
+	// and with role 'Target' on the cluster moved to.
+	// +kubebuilder:validation:Enum=Source;Target
+	Role MigrationRole `json:"role" protobuf:"bytes,2,opt,name=role"`
+	// Signed url of the tar.gz workspace archive, it must accept PUT on source cluster and GET on target cluster.
+	ArchiveURL string `json:"archiveURL" protobuf:"bytes,3,opt,name=archiveURL"`
+	// Spec of the instance created on target cluster, it's usually copied from status.exportedSpec of the
+	// migration on source cluster. Required on target cluster.
+	Template *CodeServerSpec `json:"template,omitempty" protobuf:"bytes,4,opt,name=template"`
+	// Url of the instance on target cluster, requests to the instance on source cluster are redirected to it once
+	// migration completed, redirection is disabled if empty.
+	TargetURL string `json:"targetURL,omitempty" protobuf:"bytes,5,opt,name=targetURL"`
+}
+
+// MigrationPhase describes the phase of migration
+type MigrationPhase string
+
+const (
+	// MigrationStopping means the instance is being stopped on source cluster.
+	MigrationStopping MigrationPhase = "Stopping"
+	// MigrationExporting means the workspace is being exported on source cluster.
+	MigrationExporting MigrationPhase = "Exporting"
+	// MigrationImporting means the instance is being created from archive on target cluster.
+	MigrationImporting MigrationPhase = "Importing"
+	// MigrationCompleted means the instance has been exported or is ready on target cluster.
+	MigrationCompleted MigrationPhase = "Completed"
+	// MigrationFailed means the migration failed, the instance on source cluster can be started again.
+	MigrationFailed MigrationPhase = "Failed"
+)
+
+// CodeServerMigrationStatus defines the observed state of CodeServerMigration
+type CodeServerMigrationStatus struct {
+	// Phase of the migration.
+	Phase MigrationPhase `json:"phase,omitempty" protobuf:"bytes,1,opt,name=phase"`
+	// Error message of the failed migration.
+	Message string `json:"message,omitempty" protobuf:"bytes,2,opt,name=message"`
+	// Spec of the instance exported on source cluster, it's used as template of migration on target cluster.
+	ExportedSpec *CodeServerSpec `json:"exportedSpec,omitempty" protobuf:"bytes,3,opt,name=exportedSpec"`
+	// The time migration started.
+	StartTime *metav1.Time `json:"startTime,omitempty" protobuf:"bytes,4,opt,name=startTime"`
+	// The time migration completed or failed.
+	CompletionTime *metav1.Time `json:"completionTime,omitempty" protobuf:"bytes,5,opt,name=completionTime"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=csm
+
+// CodeServerMigration is the Schema for the codeservermigrations API
+type CodeServerMigration struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CodeServerMigrationSpec   `json:"spec,omitempty"`
+	Status CodeServerMigrationStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CodeServerMigrationList contains a list of CodeServerMigration
+type CodeServerMigrationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CodeServerMigration `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CodeServerMigration{}, &CodeServerMigrationList{})
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CodeServerOperatorConfigSpec defines the operator options which override the command line flags, options
+// not specified fall back to the flags.
+type CodeServerOperatorConfigSpec struct {
+	// Specifies the code server domain name.
+	DomainName string `json:"domainName,omitempty" protobuf:"bytes,1,opt,name=domainName"`
+	// Specifies the exporter image used as a code server sidecar for VS code instance.
+	VSExporterImage string `json:"vsExporterImage,omitempty" protobuf:"bytes,2,opt,name=vsExporterImage"`
+	// Specifies time in seconds between two probes on code server instance.
+	// +kubebuilder:validation:Minimum=1
+	ProbeInterval *int `json:"probeInterval,omitempty" protobuf:"varint,3,opt,name=probeInterval"`
+	// Specifies count before marking code server inactive when failed to probe liveness.
+	// +kubebuilder:validation:Minimum=0
+	MaxProbeRetry *int `json:"maxProbeRetry,omitempty" protobuf:"varint,4,opt,name=maxProbeRetry"`
+	// Specifies the secret which holds the https cert(tls.crt) and key file(tls.key).
+	HttpsSecretName string `json:"httpsSecretName,omitempty" protobuf:"bytes,5,opt,name=httpsSecretName"`
+	// Specifies the secret which holds the key and secret for lxc client to communicate to server.
+	LxdClientSecretName string `json:"lxdClientSecretName,omitempty" protobuf:"bytes,6,opt,name=lxdClientSecretName"`
+	// Whether to enable user ingress for visiting.
+	EnableUserIngress *bool `json:"enableUserIngress,omitempty" protobuf:"varint,7,opt,name=enableUserIngress"`
+	// Whether to disallow docker in docker or buildkit sidecar for all instances.
+	DisableDocker *bool `json:"disableDocker,omitempty" protobuf:"varint,8,opt,name=disableDocker"`
+	// Specifies the default image used for docker in docker sidecar.
+	DindImage string `json:"dindImage,omitempty" protobuf:"bytes,9,opt,name=dindImage"`
+	// Specifies the default image used for buildkit sidecar.
+	BuildkitImage string `json:"buildkitImage,omitempty" protobuf:"bytes,10,opt,name=buildkitImage"`
+	// Specifies the default image used for ssh server sidecar.
+	SSHImage string `json:"sshImage,omitempty" protobuf:"bytes,11,opt,name=sshImage"`
+	// Specifies the webhook notified for all code server instances.
+	NotificationURL string `json:"notificationURL,omitempty" protobuf:"bytes,12,opt,name=notificationURL"`
+	// Specifies the payload format of operator webhook, 'json' and 'slack' are supported.
+	// +kubebuilder:validation:Enum=json;slack
+	NotificationFormat string `json:"notificationFormat,omitempty" protobuf:"bytes,13,opt,name=notificationFormat"`
+	// Specifies time in seconds before recycle to send recycle warning notification.
+	RecycleNotifyLead *int `json:"recycleNotifyLead,omitempty" protobuf:"varint,14,opt,name=recycleNotifyLead"`
+	// Specifies time in seconds code server stays pending recycle before marking inactive.
+	InactiveGracePeriod *int `json:"inactiveGracePeriod,omitempty" protobuf:"varint,15,opt,name=inactiveGracePeriod"`
+	// Specifies the code server image rolled out to vs code instances whose update policy is not Never.
+	RolloutImage string `json:"rolloutImage,omitempty" protobuf:"bytes,16,opt,name=rolloutImage"`
+	// Specifies the maximum number of instances that can be unavailable during rolling image update.
+	// +kubebuilder:validation:Minimum=1
+	RolloutMaxUnavailable *int `json:"rolloutMaxUnavailable,omitempty" protobuf:"varint,17,opt,name=rolloutMaxUnavailable"`
+	// Whether to skip checking image manifest contains the architecture specified in code server.
+	SkipArchCheck *bool `json:"skipArchCheck,omitempty" protobuf:"varint,18,opt,name=skipArchCheck"`
+	// Specifies the default pull secret attached to pods of all instances.
+	ImagePullSecret string `json:"imagePullSecret,omitempty" protobuf:"bytes,19,opt,name=imagePullSecret"`
+	// Specifies the namespace the default pull secret is replicated from into namespaces of instances.
+	PullSecretNamespace string `json:"pullSecretNamespace,omitempty" protobuf:"bytes,20,opt,name=pullSecretNamespace"`
+	// Specifies the named scheduling profiles instances refer to in spec.scheduling.profile.
+	SchedulingProfiles []SchedulingProfile `json:"schedulingProfiles,omitempty" protobuf:"bytes,21,rep,name=schedulingProfiles"`
+	// Specifies how out-of-band edits of generated resources are handled, 'enforce' reverts them and 'detect'
+	// only records the drift.
+	// +kubebuilder:validation:Enum=enforce;detect
+	DriftMode string `json:"driftMode,omitempty" protobuf:"bytes,22,opt,name=driftMode"`
+	// Specifies the bounds of resources instances can request, enforced by validating webhook.
+	ResourceBounds []ResourceBounds `json:"resourceBounds,omitempty" protobuf:"bytes,23,rep,name=resourceBounds"`
+	// Specifies the mirrors of registries applied to all images of instances and jobs, e.g. ghcr.io mapped to
+	// internal.registry/ghcr. Sources may contain repository path and docker hub is referred as docker.io.
+	RegistryMirrors map[string]string `json:"registryMirrors,omitempty" protobuf:"bytes,24,rep,name=registryMirrors"`
+	// Specifies the defaults of spec of all instances, templates and instances take precedence over them. Lists
+	// with merge keys (e.g. envs by name) are merged, see MergeCodeServerSpec.
+	InstanceDefaults *CodeServerSpec `json:"instanceDefaults,omitempty" protobuf:"bytes,25,opt,name=instanceDefaults"`
+}
+
+// ResourceBounds describes the minimum and maximum resources of instances in namespaces or created from templates.
+// Storage bounds the size of workspace volume and gpu resources (e.g. nvidia.com/gpu) the gpu count, all other
+// resources are checked against both requests and limits.
+type ResourceBounds struct {
+	// Namespaces the bounds apply to, all namespaces if empty.
+	Namespaces []string `json:"namespaces,omitempty" protobuf:"bytes,1,rep,name=namespaces"`
+	// Templates the bounds apply to, instances of all templates and without template if empty.
+	Templates []string `json:"templates,omitempty" protobuf:"bytes,2,rep,name=templates"`
+	// Minimum amount of resources.
+	Min v1.ResourceList `json:"min,omitempty" protobuf:"bytes,3,rep,name=min"`
+	// Maximum amount of resources.
+	Max v1.ResourceList `json:"max,omitempty" protobuf:"bytes,4,rep,name=max"`
+}
+
+// SchedulingProfile describes where instances of the profile are scheduled, e.g. gpu, highmem or spot nodes.
+type SchedulingProfile struct {
+	// Name referred by instances.
+	Name string `json:"name" protobuf:"bytes,1,opt,name=name"`
+	// Node labels merged into node selector of instance pod, the ones specified by instance take precedence.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty" protobuf:"bytes,2,rep,name=nodeSelector"`
+	// Tolerations appended to instance pod.
+	Tolerations []v1.Toleration `json:"tolerations,omitempty" protobuf:"bytes,3,rep,name=tolerations"`
+	// Affinity of instance pod.
+	Affinity *v1.Affinity `json:"affinity,omitempty" protobuf:"bytes,4,opt,name=affinity"`
+}
+
+// CodeServerOperatorConfigStatus defines the observed state of CodeServerOperatorConfig
+type CodeServerOperatorConfigStatus struct {
+	// The generation of config which has been applied by operator.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty" protobuf:"varint,1,opt,name=observedGeneration"`
+	// The last time config was applied.
+	AppliedTime *metav1.Time `json:"appliedTime,omitempty" protobuf:"bytes,2,opt,name=appliedTime"`
+	// Health of lxd remotes which lxd instances are scheduled on.
+	LxdRemotes []LxdRemoteStatus `json:"lxdRemotes,omitempty" protobuf:"bytes,3,rep,name=lxdRemotes"`
+}
+
+// LxdRemoteStatus describes the health and load of a lxd remote
+type LxdRemoteStatus struct {
+	// Name of the remote.
+	Name string `json:"name" protobuf:"bytes,1,opt,name=name"`
+	// Endpoint of the remote.
+	Endpoint string `json:"endpoint" protobuf:"bytes,2,opt,name=endpoint"`
+	// Whether the remote is reachable in last probe.
+	Healthy bool `json:"healthy" protobuf:"varint,3,opt,name=healthy"`
+	// Count of instances scheduled on the remote.
+	Instances int32 `json:"instances" protobuf:"varint,4,opt,name=instances"`
+	// Maximum count of instances on the remote, 0 means unlimited.
+	Capacity int32 `json:"capacity,omitempty" protobuf:"varint,5,opt,name=capacity"`
+	// Error message of last probe if any.
+	Message string `json:"message,omitempty" protobuf:"bytes,6,opt,name=message"`
+	// The last time health or load of the remote changed.
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty" protobuf:"bytes,7,opt,name=lastTransitionTime"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=csoc
+
+// CodeServerOperatorConfig is the Schema for the codeserveroperatorconfigs API
+type CodeServerOperatorConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CodeServerOperatorConfigSpec   `json:"spec,omitempty"`
+	Status CodeServerOperatorConfigStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CodeServerOperatorConfigList contains a list of CodeServerOperatorConfig
+type CodeServerOperatorConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CodeServerOperatorConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CodeServerOperatorConfig{}, &CodeServerOperatorConfigList{})
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CodeServerPrebuildSpec defines the desired state of CodeServerPrebuild
+type CodeServerPrebuildSpec struct {
+	// Git url of repository which is prebuilt.
+	Repository string `json:"repository" protobuf:"bytes,1,opt,name=repository"`
+	// Branches prebuilt, every branch has its own snapshots.
+	// +kubebuilder:validation:MinItems=1
+	Branches []string `json:"branches" protobuf:"bytes,2,rep,name=branches"`
+	// Folder under workspace which repository is cloned into, defaults to repository name.
+	Folder string `json:"folder,omitempty" protobuf:"bytes,3,opt,name=folder"`
+	// Image which runs the bootstrap commands, it should be the image of instances or compatible with it.
+	Image string `json:"image" protobuf:"bytes,4,opt,name=image"`
+	// Commands run in repository after cloned, e.g. dependency installation and build.
+	Commands []string `json:"commands,omitempty" protobuf:"bytes,5,rep,name=commands"`
+	// Specifies the cron schedule of prebuilds, for example '0 2 * * *', prebuilds are only triggered via api
+	// server if empty.
+	Schedule string `json:"schedule,omitempty" protobuf:"bytes,6,opt,name=schedule"`
+	// Storage class of the volume prebuilt into, it must be the storage class of instances.
+	StorageName string `json:"storageName" protobuf:"bytes,7,opt,name=storageName"`
+	// Size of the volume prebuilt into, it must not be larger than the storage size of instances.
+	StorageSize string `json:"storageSize" protobuf:"bytes,8,opt,name=storageSize"`
+	// Specifies the VolumeSnapshotClass used to create snapshots, cluster default will be used if empty.
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty" protobuf:"bytes,9,opt,name=volumeSnapshotClassName"`
+	// Specifies the number of snapshots to keep per branch, defaults to 2.
+	// +kubebuilder:validation:Minimum=1
+	Retention int `json:"retention,omitempty" protobuf:"varint,10,opt,name=retention"`
+}
+
+// PrebuildPhase describes the phase of prebuild of a branch
+type PrebuildPhase string
+
+const (
+	// PrebuildBuilding means the bootstrap job is running.
+	PrebuildBuilding PrebuildPhase = "Building"
+	// PrebuildSnapshotting means the volume is being snapshotted after bootstrap succeeded.
+	PrebuildSnapshotting PrebuildPhase = "Snapshotting"
+	// PrebuildSucceeded means the last prebuild is ready to be used.
+	PrebuildSucceeded PrebuildPhase = "Succeeded"
+	// PrebuildFailed means the last prebuild failed, the previous snapshot is still used.
+	PrebuildFailed PrebuildPhase = "Failed"
+)
+
+// PrebuildBranchStatus describes the prebuild of a branch
+type PrebuildBranchStatus struct {
+	// Name of the branch.
+	Branch string `json:"branch" protobuf:"bytes,1,opt,name=branch"`
+	// Phase of the last prebuild.
+	Phase PrebuildPhase `json:"phase,omitempty" protobuf:"bytes,2,opt,name=phase"`
+	// Name of the job, volume and snapshot of the last prebuild.
+	Current string `json:"current,omitempty" protobuf:"bytes,3,opt,name=current"`
+	// The time last prebuild started.
+	StartTime *metav1.Time `json:"startTime,omitempty" protobuf:"bytes,4,opt,name=startTime"`
+	// The latest snapshot ready to be used by instances.
+	Snapshot string `json:"snapshot,omitempty" protobuf:"bytes,5,opt,name=snapshot"`
+	// Error message of the last failed prebuild.
+	Message string `json:"message,omitempty" protobuf:"bytes,6,opt,name=message"`
+}
+
+// CodeServerPrebuildStatus defines the observed state of CodeServerPrebuild
+type CodeServerPrebuildStatus struct {
+	// Prebuilds of branches.
+	Branches []PrebuildBranchStatus `json:"branches,omitempty" protobuf:"bytes,1,rep,name=branches"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=csp
+
+// CodeServerPrebuild is the Schema for the codeserverprebuilds API
+type CodeServerPrebuild struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CodeServerPrebuildSpec   `json:"spec,omitempty"`
+	Status CodeServerPrebuildStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CodeServerPrebuildList contains a list of CodeServerPrebuild
+type CodeServerPrebuildList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CodeServerPrebuild `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CodeServerPrebuild{}, &CodeServerPrebuildList{})
+}
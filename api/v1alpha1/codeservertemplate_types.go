@@ -0,0 +1,75 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CodeServerTemplateSpec defines the desired state of CodeServerTemplate
+type CodeServerTemplateSpec struct {
+	// Specifies the labels added to code servers created from template.
+	Labels map[string]string `json:"labels,omitempty" protobuf:"bytes,1,opt,name=labels"`
+	// Specifies the annotations added to code servers created from template.
+	Annotations map[string]string `json:"annotations,omitempty" protobuf:"bytes,2,opt,name=annotations"`
+	// Specifies the spec of code servers created from template.
+	Template CodeServerSpec `json:"template" protobuf:"bytes,3,opt,name=template"`
+	// Specifies the groups whose members may instantiate template, e.g. the directory groups entitled to gpu
+	// templates. Everyone may instantiate template if empty.
+	AllowedGroups []string `json:"allowedGroups,omitempty" protobuf:"bytes,4,rep,name=allowedGroups"`
+	// Specifies the ResourceQuota and LimitRange provisioned in the namespace of template, nothing is provisioned
+	// if empty.
+	Quota *TemplateQuotaSpec `json:"quota,omitempty" protobuf:"bytes,5,opt,name=quota"`
+}
+
+// TemplateQuotaSpec describes the tenancy guardrails of a namespace dedicated to the workspaces of template.
+type TemplateQuotaSpec struct {
+	// Specifies the number of instances expected in namespace, quota allows as many instances and the resources
+	// they need according to template.
+	// +kubebuilder:validation:Minimum=1
+	Instances int32 `json:"instances" protobuf:"varint,1,opt,name=instances"`
+	// Specifies the resources allowed on top of instances, e.g. for backup and archive jobs.
+	Headroom v1.ResourceList `json:"headroom,omitempty" protobuf:"bytes,2,rep,name=headroom"`
+	// Whether to skip the LimitRange which defaults requests and limits of containers without them to those of
+	// sidecars.
+	SkipLimitRange bool `json:"skipLimitRange,omitempty" protobuf:"varint,3,opt,name=skipLimitRange"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=cst
+
+// CodeServerTemplate is the Schema for the codeservertemplates API
+type CodeServerTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec CodeServerTemplateSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CodeServerTemplateList contains a list of CodeServerTemplate
+type CodeServerTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CodeServerTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CodeServerTemplate{}, &CodeServerTemplateList{})
+}
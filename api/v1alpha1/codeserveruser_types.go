@@ -0,0 +1,76 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CodeServerUserSpec defines the desired state of CodeServerUser
+type CodeServerUserSpec struct {
+	// Specifies the OIDC subject of user.
+	Subject string `json:"subject,omitempty" protobuf:"bytes,1,opt,name=subject"`
+	// Specifies the email of user.
+	Email string `json:"email,omitempty" protobuf:"bytes,2,opt,name=email"`
+	// Specifies the CodeServerTemplate in the same namespace which environments are created from.
+	TemplateRef string `json:"templateRef" protobuf:"bytes,3,opt,name=templateRef"`
+	// Specifies the maximum number of environments user can own, defaults to 1.
+	// +kubebuilder:validation:Minimum=0
+	MaxInstances *int32 `json:"maxInstances,omitempty" protobuf:"varint,4,opt,name=maxInstances"`
+	// Specifies the upper bound of resources every environment can request.
+	Limits v1.ResourceList `json:"limits,omitempty" protobuf:"bytes,5,rep,name=limits"`
+	// Specifies the environments requested on demand, code server named '<user>-<environment>' will be created for
+	// every environment and deleted once environment is removed.
+	Environments []string `json:"environments,omitempty" protobuf:"bytes,6,rep,name=environments"`
+}
+
+// CodeServerUserStatus defines the observed state of CodeServerUser
+type CodeServerUserStatus struct {
+	// Code servers currently owned by user.
+	Instances []string `json:"instances,omitempty" protobuf:"bytes,1,rep,name=instances"`
+	// Environments whose code servers have been recycled, they will not be created again until removed from and
+	// added back to spec.
+	Recycled []string `json:"recycled,omitempty" protobuf:"bytes,2,rep,name=recycled"`
+	// Human readable message about the last reconciliation.
+	Message string `json:"message,omitempty" protobuf:"bytes,3,opt,name=message"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=csu
+
+// CodeServerUser is the Schema for the codeserverusers API
+type CodeServerUser struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CodeServerUserSpec   `json:"spec,omitempty"`
+	Status CodeServerUserStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CodeServerUserList contains a list of CodeServerUser
+type CodeServerUserList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CodeServerUser `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CodeServerUser{}, &CodeServerUserList{})
+}
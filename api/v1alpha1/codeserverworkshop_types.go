@@ -0,0 +1,102 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CodeServerWorkshopSpec defines the desired state of CodeServerWorkshop
+type CodeServerWorkshopSpec struct {
+	// Specifies the CodeServerTemplate in the same namespace which instances of participants are created from.
+	TemplateRef string `json:"templateRef" protobuf:"bytes,1,opt,name=templateRef"`
+	// Specifies the participants, e.g. user names or emails, every participant gets its own instance.
+	Participants []string `json:"participants,omitempty" protobuf:"bytes,2,rep,name=participants"`
+	// Specifies the number of anonymous participants when participants are not listed.
+	// +kubebuilder:validation:Minimum=0
+	Count *int32 `json:"count,omitempty" protobuf:"varint,3,opt,name=count"`
+	// Specifies the authentication of instances, every participant gets its own credentials, defaults to Password.
+	// +kubebuilder:validation:Enum=Password;Token
+	Auth AuthType `json:"auth,omitempty" protobuf:"bytes,4,opt,name=auth"`
+	// Whether the workshop has finished, all instances are deleted once finished.
+	Finished bool `json:"finished,omitempty" protobuf:"varint,5,opt,name=finished"`
+}
+
+// WorkshopPhase describes the phase of workshop
+type WorkshopPhase string
+
+const (
+	// WorkshopProvisioning means some instances are not ready yet.
+	WorkshopProvisioning WorkshopPhase = "Provisioning"
+	// WorkshopReady means instances of all participants are ready.
+	WorkshopReady WorkshopPhase = "Ready"
+	// WorkshopFinished means the workshop has finished and instances have been torn down.
+	WorkshopFinished WorkshopPhase = "Finished"
+)
+
+// WorkshopParticipantStatus describes the instance of participant
+type WorkshopParticipantStatus struct {
+	// Name of participant.
+	Name string `json:"name" protobuf:"bytes,1,opt,name=name"`
+	// Name of the code server of participant.
+	Instance string `json:"instance" protobuf:"bytes,2,opt,name=instance"`
+	// Whether the code server is ready.
+	Ready bool `json:"ready,omitempty" protobuf:"varint,3,opt,name=ready"`
+	// Url of the code server.
+	URL string `json:"url,omitempty" protobuf:"bytes,4,opt,name=url"`
+	// The secret holding the password or token of participant.
+	CredentialsSecret string `json:"credentialsSecret,omitempty" protobuf:"bytes,5,opt,name=credentialsSecret"`
+}
+
+// CodeServerWorkshopStatus defines the observed state of CodeServerWorkshop
+type CodeServerWorkshopStatus struct {
+	// Phase of workshop.
+	Phase WorkshopPhase `json:"phase,omitempty" protobuf:"bytes,1,opt,name=phase"`
+	// Number of participants.
+	Total int32 `json:"total" protobuf:"varint,2,opt,name=total"`
+	// Number of participants whose instances are ready.
+	Ready int32 `json:"ready" protobuf:"varint,3,opt,name=ready"`
+	// Instances of participants.
+	Participants []WorkshopParticipantStatus `json:"participants,omitempty" protobuf:"bytes,4,rep,name=participants"`
+	// Human readable message about the last reconciliation.
+	Message string `json:"message,omitempty" protobuf:"bytes,5,opt,name=message"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=csw
+
+// CodeServerWorkshop is the Schema for the codeserverworkshops API
+type CodeServerWorkshop struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CodeServerWorkshopSpec   `json:"spec,omitempty"`
+	Status CodeServerWorkshopStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CodeServerWorkshopList contains a list of CodeServerWorkshop
+type CodeServerWorkshopList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CodeServerWorkshop `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CodeServerWorkshop{}, &CodeServerWorkshopList{})
+}
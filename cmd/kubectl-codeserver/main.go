@@ -0,0 +1,458 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-codeserver is a kubectl plugin used to manage code server instances, install it into PATH and invoke
+// it via 'kubectl codeserver'.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+	"github.com/opensourceways/code-server-operator/controllers"
+	corev1 "k8s.io/api/core/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const usage = `Manage code server instances.
+
+Usage:
+  kubectl codeserver [-n namespace] [--kubeconfig path] <command> [flags] <name>
+
+Commands:
+  list                          List code servers and their phases
+  create <name> --template <t>  Create code server from CodeServerTemplate
+  open <name> [--browser] [--show-password]
+                                Print or open the instance url, and the generated
+                                password or token
+  port-forward <name> [--port p] [--show-password]
+                                Forward a local port to the instance service, e.g.
+                                for headless instances which have no ingress
+  logs <name> [-c container] [-f]
+                                Print logs of the code server pod
+  ssh <name> [--host node]      Attach to code server via ssh sidecar
+  snapshot <name> [--class c] [--restore s]
+                                Take a VolumeSnapshot of the workspace volume, or a
+                                snapshot of the instance for lxd runtime which can
+                                be restored via --restore
+  recycle <name>                Recycle code server and release all its resources
+`
+
+type plugin struct {
+	client     client.Client
+	config     *rest.Config
+	namespace  string
+	kubeconfig string
+}
+
+func main() {
+	global := flag.NewFlagSet("kubectl-codeserver", flag.ExitOnError)
+	global.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	namespace := global.String("n", "", "Namespace of code server, defaults to namespace of current context.")
+	kubeconfig := global.String("kubeconfig", "", "Path to kubeconfig file.")
+	global.Parse(os.Args[1:])
+	if global.NArg() == 0 {
+		global.Usage()
+		os.Exit(1)
+	}
+	p, err := newPlugin(*kubeconfig, *namespace)
+	if err != nil {
+		fail(err)
+	}
+	command, args := global.Arg(0), global.Args()[1:]
+	switch command {
+	case "list":
+		err = p.list()
+	case "create":
+		err = p.create(args)
+	case "open":
+		err = p.open(args)
+	case "port-forward":
+		err = p.portForward(args)
+	case "logs":
+		err = p.logs(args)
+	case "ssh":
+		err = p.ssh(args)
+	case "snapshot":
+		err = p.snapshot(args)
+	case "recycle":
+		err = p.recycle(args)
+	default:
+		global.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	os.Exit(1)
+}
+
+func newPlugin(kubeconfig, namespace string) (*plugin, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(namespace) == 0 {
+		if namespace, _, err = clientConfig.Namespace(); err != nil {
+			return nil, err
+		}
+	}
+	scheme := k8sruntime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = csv1alpha1.AddToScheme(scheme)
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	return &plugin{client: c, config: config, namespace: namespace, kubeconfig: kubeconfig}, nil
+}
+
+// parse parses flags of sub command and returns the code server name.
+func parse(fs *flag.FlagSet, args []string) (string, error) {
+	// allow flags after name, e.g. 'open demo --browser'
+	var positional []string
+	for len(args) > 0 {
+		if err := fs.Parse(args); err != nil {
+			return "", err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != 1 {
+		return "", fmt.Errorf("exactly one code server name is required")
+	}
+	return positional[0], nil
+}
+
+func (p *plugin) get(name string) (*csv1alpha1.CodeServer, error) {
+	codeServer := &csv1alpha1.CodeServer{}
+	err := p.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: p.namespace}, codeServer)
+	return codeServer, err
+}
+
+func (p *plugin) list() error {
+	codeServers := &csv1alpha1.CodeServerList{}
+	if err := p.client.List(context.TODO(), codeServers, client.InNamespace(p.namespace)); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tRUNTIME\tPHASE\tUSER\tAGE")
+	for i := range codeServers.Items {
+		m := &codeServers.Items[i]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", m.Name, m.Spec.Runtime, controllers.CodeServerPhase(m),
+			m.Annotations[controllers.UserAnnotation], time.Since(m.CreationTimestamp.Time).Round(time.Second))
+	}
+	return w.Flush()
+}
+
+func (p *plugin) create(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	template := fs.String("template", "", "CodeServerTemplate the code server is created from.")
+	user := fs.String("user", os.Getenv("USER"), "User the code server belongs to.")
+	name, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(*template) == 0 {
+		return fmt.Errorf("--template is required")
+	}
+	tmpl := &csv1alpha1.CodeServerTemplate{}
+	if err := p.client.Get(context.TODO(), types.NamespacedName{Name: *template, Namespace: p.namespace}, tmpl); err != nil {
+		return err
+	}
+	if err := p.client.Create(context.TODO(), controllers.NewCodeServerFromTemplate(tmpl, name, p.namespace, *user)); err != nil {
+		return err
+	}
+	fmt.Printf("codeserver/%s created\n", name)
+	return nil
+}
+
+func (p *plugin) open(args []string) error {
+	fs := flag.NewFlagSet("open", flag.ExitOnError)
+	browser := fs.Bool("browser", false, "Open the url in default browser.")
+	showPassword := fs.Bool("show-password", false, "Print the generated password or token as well.")
+	name, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	codeServer, err := p.get(name)
+	if err != nil {
+		return err
+	}
+	ready := controllers.GetCondition(codeServer.Status, csv1alpha1.ServerReady)
+	if ready == nil || ready.Status != corev1.ConditionTrue {
+		return fmt.Errorf("code server %s is not ready, current phase %s", name, controllers.CodeServerPhase(codeServer))
+	}
+	url := ready.Message[controllers.InstanceEndpoint]
+	fmt.Println(url)
+	if *showPassword {
+		if err := p.printPassword(codeServer); err != nil {
+			return err
+		}
+	}
+	if !*browser {
+		return nil
+	}
+	opener := "xdg-open"
+	switch runtime.GOOS {
+	case "darwin":
+		opener = "open"
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	}
+	return exec.Command(opener, url).Start()
+}
+
+// printPassword prints the password or token generated by operator.
+func (p *plugin) printPassword(codeServer *csv1alpha1.CodeServer) error {
+	if len(codeServer.Status.AuthSecretName) == 0 {
+		return fmt.Errorf("code server %s has no generated password", codeServer.Name)
+	}
+	secret := &corev1.Secret{}
+	if err := p.client.Get(context.TODO(), types.NamespacedName{Name: codeServer.Status.AuthSecretName,
+		Namespace: p.namespace}, secret); err != nil {
+		return err
+	}
+	for _, key := range []string{controllers.AuthPasswordKey, controllers.AuthTokenKey} {
+		if value, found := secret.Data[key]; found {
+			fmt.Printf("%s: %s\n", key, value)
+		}
+	}
+	return nil
+}
+
+// portForward forwards local port to the service of code server with 'kubectl port-forward' until interrupted.
+func (p *plugin) portForward(args []string) error {
+	fs := flag.NewFlagSet("port-forward", flag.ExitOnError)
+	port := fs.Int("port", controllers.HttpPort, "Local port forwarded to the code server.")
+	showPassword := fs.Bool("show-password", false, "Print the generated password or token as well.")
+	name, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	codeServer, err := p.get(name)
+	if err != nil {
+		return err
+	}
+	if !controllers.HasCondition(codeServer.Status, csv1alpha1.ServerReady) {
+		return fmt.Errorf("code server %s is not ready, current phase %s", name, controllers.CodeServerPhase(codeServer))
+	}
+	fmt.Printf("http://localhost:%d/\n", *port)
+	if *showPassword {
+		if err := p.printPassword(codeServer); err != nil {
+			return err
+		}
+	}
+	kubectlArgs := []string{"port-forward", "-n", p.namespace, fmt.Sprintf("svc/%s", name),
+		fmt.Sprintf("%d:%d", *port, controllers.HttpPort)}
+	if len(p.kubeconfig) != 0 {
+		kubectlArgs = append(kubectlArgs, "--kubeconfig", p.kubeconfig)
+	}
+	cmd := exec.Command("kubectl", kubectlArgs...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+func (p *plugin) logs(args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	container := fs.String("c", controllers.CSNAME, "Container to print logs from.")
+	follow := fs.Bool("f", false, "Follow the logs.")
+	name, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	pod, err := p.runningPod(name)
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(p.config)
+	if err != nil {
+		return err
+	}
+	stream, err := clientset.CoreV1().Pods(p.namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: *container,
+		Follow:    *follow,
+	}).Stream(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	_, err = io.Copy(os.Stdout, stream)
+	return err
+}
+
+func (p *plugin) runningPod(name string) (*corev1.Pod, error) {
+	pods := &corev1.PodList{}
+	if err := p.client.List(context.TODO(), pods, client.InNamespace(p.namespace),
+		client.MatchingLabels{"app": "codeserver", "cs_name": name}); err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		if pods.Items[i].Status.Phase == corev1.PodRunning {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no running pod found for code server %s", name)
+}
+
+func (p *plugin) ssh(args []string) error {
+	fs := flag.NewFlagSet("ssh", flag.ExitOnError)
+	host := fs.String("host", "", "Node address used with node port, defaults to address of the first node.")
+	name, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	codeServer, err := p.get(name)
+	if err != nil {
+		return err
+	}
+	ready := controllers.GetCondition(codeServer.Status, csv1alpha1.ServerReady)
+	if ready == nil || ready.Status != corev1.ConditionTrue {
+		return fmt.Errorf("code server %s is not ready, current phase %s", name, controllers.CodeServerPhase(codeServer))
+	}
+	var sshArgs []string
+	if endpoint, ok := ready.Message[controllers.SSHEndpoint]; ok {
+		sshArgs = []string{endpoint}
+	} else if nodePort, ok := ready.Message[controllers.SSHNodePort]; ok {
+		if len(*host) == 0 {
+			if *host, err = p.nodeAddress(); err != nil {
+				return err
+			}
+		}
+		sshArgs = []string{"-p", nodePort, fmt.Sprintf("coder@%s", *host)}
+	} else {
+		return fmt.Errorf("ssh is not enabled for code server %s", name)
+	}
+	cmd := exec.Command("ssh", sshArgs...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+func (p *plugin) nodeAddress() (string, error) {
+	nodes := &corev1.NodeList{}
+	if err := p.client.List(context.TODO(), nodes); err != nil {
+		return "", err
+	}
+	for _, addressType := range []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP} {
+		for _, node := range nodes.Items {
+			for _, address := range node.Status.Addresses {
+				if address.Type == addressType {
+					return address.Address, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("no node address found, please specify --host")
+}
+
+func (p *plugin) snapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	className := fs.String("class", "", "VolumeSnapshotClass used to create snapshot.")
+	restore := fs.String("restore", "", "Snapshot to restore lxd instance from.")
+	name, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	codeServer, err := p.get(name)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(string(codeServer.Spec.Runtime), string(csv1alpha1.RuntimeLxd)) {
+		return p.lxdSnapshot(codeServer, *restore)
+	}
+	if len(*restore) != 0 {
+		return fmt.Errorf("restore is only supported by lxd runtime, use spec.storage.sourceSnapshot instead")
+	}
+	if codeServer.Spec.StorageName == controllers.StorageEmptyDir || len(codeServer.Spec.StorageName) == 0 {
+		return fmt.Errorf("code server %s doesn't use persistent volume claim", name)
+	}
+	snapshot := controllers.NewVolumeSnapshot(codeServer, fmt.Sprintf(controllers.SnapshotResource, name,
+		time.Now().UTC().Format(controllers.BackupTimeLayout)), *className, controllers.SnapshotLabel)
+	if err := p.client.Create(context.TODO(), snapshot); err != nil {
+		return err
+	}
+	fmt.Printf("volumesnapshot/%s created, restore it via spec.storage.sourceSnapshot\n", snapshot.GetName())
+	return nil
+}
+
+// lxdSnapshot requests operator to snapshot or restore lxd instance via annotations.
+func (p *plugin) lxdSnapshot(codeServer *csv1alpha1.CodeServer, restore string) error {
+	if codeServer.Annotations == nil {
+		codeServer.Annotations = map[string]string{}
+	}
+	if len(restore) != 0 {
+		codeServer.Annotations[controllers.LxdRestoreAnnotation] = restore
+	} else {
+		codeServer.Annotations[controllers.LxdSnapshotAnnotation] = ""
+	}
+	if err := p.client.Update(context.TODO(), codeServer); err != nil {
+		return err
+	}
+	if len(restore) != 0 {
+		fmt.Printf("codeserver/%s will be restored from snapshot %s\n", codeServer.Name, restore)
+	} else {
+		fmt.Printf("codeserver/%s will be snapshotted, see status.lastBackupName\n", codeServer.Name)
+	}
+	return nil
+}
+
+func (p *plugin) recycle(args []string) error {
+	fs := flag.NewFlagSet("recycle", flag.ExitOnError)
+	name, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	codeServer, err := p.get(name)
+	if err != nil {
+		return err
+	}
+	condition := controllers.NewStateCondition(csv1alpha1.ServerRecycled,
+		"code server has been recycled via kubectl plugin", map[string]string{}, corev1.ConditionTrue)
+	if !controllers.SetCondition(&codeServer.Status, condition) {
+		fmt.Printf("codeserver/%s already recycled\n", name)
+		return nil
+	}
+	if err := p.client.Update(context.TODO(), codeServer); err != nil {
+		return err
+	}
+	fmt.Printf("codeserver/%s recycled\n", name)
+	return nil
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// AccessProxyPrefix is where api server proxies headless instances, e.g.
+	// /proxy/namespaces/{namespace}/codeservers/{name}/.
+	AccessProxyPrefix = "/proxy/namespaces/"
+	// AccessResource names the secret holding the key access tokens of instance are signed with, deleting it
+	// revokes all issued tokens.
+	AccessResource       = "%s-access"
+	AccessKey            = "key"
+	AccessTokenParam     = "token"
+	AccessCookie         = "codeserver-access"
+	DefaultAccessMinutes = 60
+	MaxAccessMinutes     = 720
+)
+
+type accessCodeServerRequest struct {
+	// Minutes is the lifetime of access token, DefaultAccessMinutes if zero.
+	Minutes int `json:"minutes,omitempty"`
+}
+
+// AccessToken is the short-lived token of headless code server, URL logs in to the access proxy with it.
+type AccessToken struct {
+	URL       string      `json:"url"`
+	Token     string      `json:"token"`
+	ExpiresAt metav1.Time `json:"expiresAt"`
+}
+
+// headless returns whether instance is routed by nothing.
+func headless(m *csv1alpha1.CodeServer, options *CodeServerOption) bool {
+	return (m.Spec.Network != nil && m.Spec.Network.Headless) || options.Load().IngressProvider == IngressProviderNone
+}
+
+// accessKey returns the signing key of access tokens of instance, it's generated on first use.
+func accessKey(c client.Client, m *csv1alpha1.CodeServer) ([]byte, error) {
+	name := ChildName(AccessResource, m.Name)
+	secret := &corev1.Secret{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: m.Namespace}, secret)
+	if err == nil && len(secret.Data[AccessKey]) != 0 {
+		return secret.Data[AccessKey], nil
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	key, err := randomHex(AuthPasswordBytes)
+	if err != nil {
+		return nil, err
+	}
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: m.Namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(m, csv1alpha1.GroupVersion.WithKind("CodeServer"))},
+		},
+		Data: map[string][]byte{AccessKey: []byte(key)},
+	}
+	setOwnedLabels(secret, m.Name)
+	return secret.Data[AccessKey], c.Create(context.TODO(), secret)
+}
+
+func accessSignature(key []byte, m *csv1alpha1.CodeServer, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(fmt.Sprintf("%s/%s/%d", m.Namespace, m.Name, expires)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newAccessToken returns the token of instance valid until expires, in the format of '<expiry>.<signature>'.
+func newAccessToken(key []byte, m *csv1alpha1.CodeServer, expires time.Time) string {
+	return fmt.Sprintf("%d.%s", expires.Unix(), accessSignature(key, m, expires.Unix()))
+}
+
+// verifyAccessToken returns the expiry of token if it's signed by key and not expired.
+func verifyAccessToken(key []byte, m *csv1alpha1.CodeServer, token string, now time.Time) (time.Time, bool) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return time.Time{}, false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || !hmac.Equal([]byte(parts[1]), []byte(accessSignature(key, m, expires))) {
+		return time.Time{}, false
+	}
+	return time.Unix(expires, 0), now.Unix() < expires
+}
+
+func accessProxyPath(namespace, name string) string {
+	return fmt.Sprintf("%s%s/codeservers/%s/", AccessProxyPrefix, namespace, name)
+}
+
+// requestScheme returns the scheme client used, the one forwarded by load balancer takes precedence.
+func requestScheme(req *http.Request) string {
+	if scheme := req.Header.Get("X-Forwarded-Proto"); len(scheme) != 0 {
+		return scheme
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// accessCodeServer issues the short-lived access token of headless code server.
+func (s *CodeServerAPIServer) accessCodeServer(w http.ResponseWriter, req *http.Request, namespace, name string,
+	token *APIToken) {
+	request := accessCodeServerRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil && err != io.EOF {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if request.Minutes == 0 {
+		request.Minutes = DefaultAccessMinutes
+	}
+	if request.Minutes < 0 || request.Minutes > MaxAccessMinutes {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("minutes must be between 1 and %d", MaxAccessMinutes))
+		return
+	}
+	codeServer, ok := s.getOwnedCodeServer(w, namespace, name, token)
+	if !ok {
+		return
+	}
+	if !headless(codeServer, s.Options) {
+		writeAPIError(w, http.StatusConflict, fmt.Sprintf("code server %s is routed by ingress", name))
+		return
+	}
+	key, err := accessKey(s.Client, codeServer)
+	if err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	expires := time.Now().Add(time.Duration(request.Minutes) * time.Minute).UTC().Truncate(time.Second)
+	value := newAccessToken(key, codeServer, expires)
+	s.Log.Info(fmt.Sprintf("access token of code server %s/%s has been issued to %s until %s", namespace, name,
+		token.User, expires.Format(time.RFC3339)))
+	writeAPIResponse(w, http.StatusOK, AccessToken{
+		URL: fmt.Sprintf("%s://%s%s?%s=%s", requestScheme(req), req.Host, accessProxyPath(namespace, name),
+			AccessTokenParam, url.QueryEscape(value)),
+		Token:     value,
+		ExpiresAt: metav1.NewTime(expires),
+	})
+}
+
+// serveAccessProxy proxies requests to headless code server authenticated by access token, the token in query
+// is moved into a cookie scoped to the proxy path of instance so that it doesn't leak via urls.
+func (s *CodeServerAPIServer) serveAccessProxy(w http.ResponseWriter, req *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, AccessProxyPrefix), "/", 4)
+	if len(parts) < 3 || parts[1] != "codeservers" {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	namespace, name := parts[0], parts[2]
+	prefix := accessProxyPath(namespace, name)
+	if len(parts) == 3 {
+		// relative urls of code server require the trailing slash
+		http.Redirect(w, req, prefix+queryOf(req.URL), http.StatusMovedPermanently)
+		return
+	}
+	codeServer := &csv1alpha1.CodeServer{}
+	if err := s.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, codeServer); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	if !headless(codeServer, s.Options) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("code server %s is routed by ingress", name))
+		return
+	}
+	key, err := accessKey(s.Client, codeServer)
+	if err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	query := req.URL.Query()
+	if token := query.Get(AccessTokenParam); len(token) != 0 {
+		expires, valid := verifyAccessToken(key, codeServer, token, time.Now())
+		if !valid {
+			writeAPIError(w, http.StatusUnauthorized, "invalid or expired access token")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     AccessCookie,
+			Value:    token,
+			Path:     prefix,
+			Expires:  expires,
+			HttpOnly: true,
+			Secure:   requestScheme(req) == "https",
+			SameSite: http.SameSiteStrictMode,
+		})
+		query.Del(AccessTokenParam)
+		location := *req.URL
+		location.RawQuery = query.Encode()
+		http.Redirect(w, req, location.String(), http.StatusFound)
+		return
+	}
+	cookie, err := req.Cookie(AccessCookie)
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, "access token is required")
+		return
+	}
+	if _, valid := verifyAccessToken(key, codeServer, cookie.Value, time.Now()); !valid {
+		writeAPIError(w, http.StatusUnauthorized, "invalid or expired access token")
+		return
+	}
+	if !HasCondition(codeServer.Status, csv1alpha1.ServerReady) {
+		writeAPIError(w, http.StatusServiceUnavailable, "code server is not ready yet, please retry later")
+		return
+	}
+	target := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(fmt.Sprintf(ServiceHostTemplate, name, namespace), strconv.Itoa(HttpPort)),
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(out *http.Request) {
+		director(out)
+		out.URL.Path = "/" + strings.TrimPrefix(out.URL.Path, prefix)
+		out.URL.RawPath = ""
+		out.Header.Set(ForwardedPrefixHeader, strings.TrimSuffix(prefix, "/"))
+	}
+	proxy.ServeHTTP(w, req)
+}
+
+func queryOf(u *url.URL) string {
+	if len(u.RawQuery) == 0 {
+		return ""
+	}
+	return "?" + u.RawQuery
+}
@@ -0,0 +1,390 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
+	"sync"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// ACMESecretResource names the tls secret holding the certificate issued for the host of instance.
+	ACMESecretResource = "%s-tls"
+	// ACMEChallengeResource names the service and ingress routing http-01 challenges of instance host to gateway.
+	ACMEChallengeResource = "%s-acme"
+	ACMEChallengePath     = "/.well-known/acme-challenge/"
+	// ACMERenewBefore is how long before expiry the certificate is renewed.
+	ACMERenewBefore = 30 * 24 * time.Hour
+	// ACMERetryInterval throttles the orders of host after a failure, so that rate limits of CA aren't hit.
+	ACMERetryInterval = time.Hour
+	// ACMEAccountKey is the key of account secret holding the pem encoded account key.
+	ACMEAccountKey = "account.pem"
+	// ACMEOrderQueue is the number of orders waiting to be placed, hosts beyond are ordered on next reconcile.
+	ACMEOrderQueue = 64
+)
+
+// acmeIssuer serializes the account of operator and tracks the orders in flight, orders are placed in background
+// by the runnable of reconciler since validation takes a while.
+type acmeIssuer struct {
+	sync.Mutex
+	client   *acmeClient
+	inflight map[string]bool
+	failed   map[string]time.Time
+}
+
+var certificateIssuer = &acmeIssuer{inflight: map[string]bool{}, failed: map[string]time.Time{}}
+
+// acmeOrderRequest is the certificate of host queued for instance.
+type acmeOrderRequest struct {
+	codeServer *csv1alpha1.CodeServer
+	host       string
+}
+
+// acmeClientOf returns the client of acme account, account key is loaded from file if specified, otherwise from
+// the account secret, where it's stored once generated so that restarts and replicas share the account.
+func acmeClientOf(c client.Client, options *CodeServerOption) (*acmeClient, error) {
+	certificateIssuer.Lock()
+	defer certificateIssuer.Unlock()
+	if certificateIssuer.client != nil {
+		return certificateIssuer.client, nil
+	}
+	var key *ecdsa.PrivateKey
+	var err error
+	if len(options.Load().ACMEAccountKeyFile) != 0 {
+		var content []byte
+		if content, err = ioutil.ReadFile(options.Load().ACMEAccountKeyFile); err != nil {
+			return nil, err
+		}
+		key, err = parseACMEAccountKey(content)
+	} else {
+		key, err = acmeAccountKeyOf(c, options.Load().ACMEAccountSecret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	certificateIssuer.client = newACMEClient(options.Load().ACMEDirectoryURL, options.Load().ACMEEmail, key)
+	return certificateIssuer.client, nil
+}
+
+// acmeAccountKeyOf returns the account key kept in secret <namespace>/<name>, the key is generated if secret
+// doesn't exist, whoever creates the secret first wins.
+func acmeAccountKeyOf(c client.Client, namespacedName string) (*ecdsa.PrivateKey, error) {
+	parts := strings.SplitN(namespacedName, "/", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return nil, fmt.Errorf("acme account secret %q must be <namespace>/<name>", namespacedName)
+	}
+	name := types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+	secret := &corev1.Secret{}
+	err := c.Get(context.TODO(), name, secret)
+	if errors.IsNotFound(err) {
+		var key *ecdsa.PrivateKey
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+		var der []byte
+		if der, err = x509.MarshalECPrivateKey(key); err != nil {
+			return nil, err
+		}
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace},
+			Data: map[string][]byte{
+				ACMEAccountKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+			},
+		}
+		if err = c.Create(context.TODO(), secret); err == nil {
+			return key, nil
+		}
+		if errors.IsAlreadyExists(err) {
+			err = c.Get(context.TODO(), name, secret)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseACMEAccountKey(secret.Data[ACMEAccountKey])
+}
+
+// start marks the order of host in flight, it returns false if host is being ordered or failed recently.
+func (i *acmeIssuer) start(host string, now time.Time) bool {
+	i.Lock()
+	defer i.Unlock()
+	if i.inflight[host] || now.Sub(i.failed[host]) < ACMERetryInterval {
+		return false
+	}
+	i.inflight[host] = true
+	return true
+}
+
+// release forgets the order of host which hasn't been placed, so that it's ordered again on next reconcile.
+func (i *acmeIssuer) release(host string) {
+	i.Lock()
+	defer i.Unlock()
+	delete(i.inflight, host)
+}
+
+func (i *acmeIssuer) finish(host string, err error) {
+	i.Lock()
+	defer i.Unlock()
+	delete(i.inflight, host)
+	if err != nil {
+		i.failed[host] = time.Now()
+	} else {
+		delete(i.failed, host)
+	}
+}
+
+// acmeEnabled returns whether certificate of instance is issued by the built-in acme client, http-01 challenges
+// are answered by the gateway, so that subdomain routing of ingress provider and gateway are required.
+func (r *CodeServerReconciler) acmeEnabled(m *csv1alpha1.CodeServer) bool {
+	return len(r.Options.Load().ACMEDirectoryURL) != 0 && r.activatorEnabled(m) &&
+		routingMode(m) == csv1alpha1.RoutingSubdomain
+}
+
+// tlsSecretName returns the secret the ingress of instance terminates tls with.
+func (r *CodeServerReconciler) tlsSecretName(m *csv1alpha1.CodeServer) string {
+	if r.acmeEnabled(m) {
+		return ChildName(ACMESecretResource, m.Name)
+	}
+	return r.Options.Load().HttpsSecretName
+}
+
+// acmeCertificateValid returns true if secret holds the certificate of host which isn't due for renewal.
+func acmeCertificateValid(secret *corev1.Secret, host string, now time.Time) bool {
+	block, _ := pem.Decode(secret.Data[corev1.TLSCertKey])
+	if block == nil || len(secret.Data[corev1.TLSPrivateKeyKey]) == 0 {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	return cert.VerifyHostname(host) == nil && now.Add(ACMERenewBefore).Before(cert.NotAfter)
+}
+
+// reconcileForACME routes the http-01 challenges of instance host to gateway and orders the certificate in
+// background if it's missing or due for renewal. It returns the tls secret of instance, nil until the first
+// certificate has been issued.
+func (r *CodeServerReconciler) reconcileForACME(codeServer *csv1alpha1.CodeServer) (*corev1.Secret, error) {
+	name := ChildName(ACMEChallengeResource, codeServer.Name)
+	if err := r.applyOwned(codeServer, r.newACMEChallengeService(codeServer), &corev1.Service{}); err != nil {
+		return nil, err
+	}
+	if err := r.applyOwned(codeServer, r.newACMEChallengeIngress(codeServer), &extv1.Ingress{}); err != nil {
+		return nil, err
+	}
+	secret := &corev1.Secret{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: ChildName(ACMESecretResource, codeServer.Name),
+		Namespace: codeServer.Namespace}, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if errors.IsNotFound(err) {
+		secret = nil
+	}
+	host := r.instanceHost(codeServer)
+	if secret != nil && acmeCertificateValid(secret, host, time.Now()) {
+		return secret, nil
+	}
+	if certificateIssuer.start(host, time.Now()) {
+		select {
+		case r.acmeOrders <- &acmeOrderRequest{codeServer: codeServer.DeepCopy(), host: host}:
+			r.instanceLog(codeServer).Info(fmt.Sprintf("ordering certificate of %s via challenge %s", host, name))
+		default:
+			certificateIssuer.release(host)
+		}
+	}
+	return secret, nil
+}
+
+// runACMEOrders places the queued orders one by one until manager stops, it runs as runnable of manager so that
+// orders in flight are abandoned on shutdown.
+func (r *CodeServerReconciler) runACMEOrders(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case order := <-r.acmeOrders:
+			r.issueCertificate(ctx, order.codeServer, order.host)
+		}
+	}
+}
+
+// issueCertificate orders the certificate of host and stores it in the tls secret of instance, the secret watch
+// then rolls it into ingress.
+func (r *CodeServerReconciler) issueCertificate(ctx context.Context, codeServer *csv1alpha1.CodeServer,
+	host string) {
+	var err error
+	defer func() {
+		if ctx.Err() != nil {
+			certificateIssuer.release(host)
+			return
+		}
+		certificateIssuer.finish(host, err)
+		if err != nil {
+			r.instanceLog(codeServer).Error(err, fmt.Sprintf("Failed to issue certificate of %s.", host))
+			r.Recorder.Eventf(codeServer, corev1.EventTypeWarning, EventCertificateIssueFailed,
+				"Failed to issue certificate of %s: %v", host, err)
+		}
+	}()
+	client, err := acmeClientOf(r.Client, r.Options)
+	if err != nil {
+		return
+	}
+	chain, key, err := client.obtain(ctx, host)
+	if err != nil {
+		return
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ChildName(ACMESecretResource, codeServer.Name),
+			Namespace: codeServer.Namespace,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       chain,
+			corev1.TLSPrivateKeyKey: key,
+		},
+	}
+	setOwnedLabels(secret, codeServer.Name)
+	r.addCostLabels(codeServer, secret)
+	if err = controllerutil.SetControllerReference(codeServer, secret, r.Scheme); err != nil {
+		return
+	}
+	live := &corev1.Secret{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: secret.Name, Namespace: secret.Namespace}, live)
+	switch {
+	case errors.IsNotFound(err):
+		if err = r.Client.Create(context.TODO(), secret); err == nil {
+			r.recordCreated(codeServer, secret)
+		}
+	case err == nil:
+		live.Data = secret.Data
+		err = r.Client.Update(context.TODO(), live)
+	}
+	if err == nil {
+		r.Recorder.Eventf(codeServer, corev1.EventTypeNormal, EventCertificateIssued,
+			"Certificate of %s has been issued", host)
+	}
+}
+
+// newACMEChallengeService points at the gateway with an ExternalName service, since ingress can only refer to
+// services in the same namespace.
+func (r *CodeServerReconciler) newACMEChallengeService(m *csv1alpha1.CodeServer) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ChildName(ACMEChallengeResource, m.Name),
+			Namespace: m.Namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:         corev1.ServiceTypeExternalName,
+			ExternalName: r.Options.Load().ActivatorService,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "acme-challenge",
+					Protocol:   corev1.ProtocolTCP,
+					Port:       HttpPort,
+					TargetPort: intstr.FromInt(HttpPort),
+				},
+			},
+		},
+	}
+}
+
+// newACMEChallengeIngress routes the challenge path of instance host to gateway over plain http, it takes
+// precedence over the ingress of instance as the longer path.
+func (r *CodeServerReconciler) newACMEChallengeIngress(m *csv1alpha1.CodeServer) *extv1.Ingress {
+	name := ChildName(ACMEChallengeResource, m.Name)
+	return &extv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: m.Namespace,
+			Annotations: map[string]string{
+				"nginx.ingress.kubernetes.io/ssl-redirect": "false",
+			},
+		},
+		Spec: extv1.IngressSpec{
+			Rules: []extv1.IngressRule{
+				{
+					Host: r.instanceHost(m),
+					IngressRuleValue: extv1.IngressRuleValue{
+						HTTP: &extv1.HTTPIngressRuleValue{
+							Paths: []extv1.HTTPIngressPath{
+								{
+									Path: ACMEChallengePath,
+									Backend: extv1.IngressBackend{
+										ServiceName: name,
+										ServicePort: intstr.FromInt(HttpPort),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// deleteACMEChallenge deletes the challenge routing of instance, issued certificate is kept until instance is
+// recycled.
+func (r *CodeServerReconciler) deleteACMEChallenge(name, namespace string) error {
+	if len(r.Options.Load().ACMEDirectoryURL) == 0 {
+		return nil
+	}
+	if err := r.deleteResourceIfExists(&extv1.Ingress{}, ChildName(ACMEChallengeResource, name),
+		namespace); err != nil {
+		return err
+	}
+	return r.deleteResourceIfExists(&corev1.Service{}, ChildName(ACMEChallengeResource, name), namespace)
+}
+
+// serveACMEChallenge answers the http-01 challenges of operator account, key authorization only depends on
+// token and account key, so that no state of orders is shared with gateway.
+func (a *CodeServerActivator) serveACMEChallenge(w http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.URL.Path, ACMEChallengePath)
+	if len(token) == 0 || strings.Contains(token, "/") {
+		http.NotFound(w, req)
+		return
+	}
+	client, err := acmeClientOf(a.Client, a.Options)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(client.keyAuthorization(token)))
+}
@@ -0,0 +1,443 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ACMEJoseContentType = "application/jose+json"
+	ACMEPEMChainType    = "application/pem-certificate-chain"
+	ACMEBadNonceError   = "urn:ietf:params:acme:error:badNonce"
+	ACMEStatusValid     = "valid"
+	ACMEStatusInvalid   = "invalid"
+	ACMEChallengeHTTP01 = "http-01"
+	// ACMEPollInterval and ACMEPollAttempts bound the wait for validation and issuance of an order.
+	ACMEPollInterval   = 2 * time.Second
+	ACMEPollAttempts   = 60
+	ACMERequestTimeout = 30 * time.Second
+)
+
+// acmeDirectory is the subset of ACME directory (RFC 8555 section 7.1.1) used by client.
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("acme error %s: %s", p.Type, p.Detail)
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// acmeClient is a minimal ACME (RFC 8555) client which orders certificates of single dns names with http-01
+// challenges, requests are signed with ES256 by the account key.
+type acmeClient struct {
+	sync.Mutex
+	directoryURL string
+	email        string
+	key          *ecdsa.PrivateKey
+	http         *http.Client
+	directory    *acmeDirectory
+	// kid is the account url, it's empty until the account has been registered
+	kid   string
+	nonce string
+}
+
+func newACMEClient(directoryURL, email string, key *ecdsa.PrivateKey) *acmeClient {
+	return &acmeClient{
+		directoryURL: directoryURL,
+		email:        email,
+		key:          key,
+		http:         &http.Client{Timeout: ACMERequestTimeout},
+	}
+}
+
+func acmeEncode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// jwk returns the json web key of account key, members are in lexical order as required by thumbprint
+// (RFC 7638).
+func (c *acmeClient) jwk() string {
+	size := (c.key.Curve.Params().BitSize + 7) / 8
+	return fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, c.key.Curve.Params().Name,
+		acmeEncode(padBytes(c.key.X, size)), acmeEncode(padBytes(c.key.Y, size)))
+}
+
+// padBytes returns the big-endian bytes of n left padded to size.
+func padBytes(n *big.Int, size int) []byte {
+	data := n.Bytes()
+	if len(data) >= size {
+		return data
+	}
+	return append(make([]byte, size-len(data)), data...)
+}
+
+// thumbprint returns the thumbprint of account key which key authorizations of challenges end with.
+func (c *acmeClient) thumbprint() string {
+	digest := sha256.Sum256([]byte(c.jwk()))
+	return acmeEncode(digest[:])
+}
+
+// keyAuthorization returns the content served for the http-01 challenge of token.
+func (c *acmeClient) keyAuthorization(token string) string {
+	return token + "." + c.thumbprint()
+}
+
+// sign returns the flattened JWS of payload, the account is referred by kid once registered. Empty payload makes
+// a POST-as-GET request.
+func (c *acmeClient) sign(url string, payload []byte) ([]byte, error) {
+	protected := map[string]interface{}{"alg": "ES256", "nonce": c.nonce, "url": url}
+	if len(c.kid) != 0 {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = json.RawMessage(c.jwk())
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	input := acmeEncode(header) + "." + acmeEncode(payload)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	size := (c.key.Curve.Params().BitSize + 7) / 8
+	signature := append(padBytes(r, size), padBytes(s, size)...)
+	return json.Marshal(map[string]string{
+		"protected": acmeEncode(header),
+		"payload":   acmeEncode(payload),
+		"signature": acmeEncode(signature),
+	})
+}
+
+func (c *acmeClient) discover(ctx context.Context) error {
+	if c.directory != nil {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get acme directory %s: %s", c.directoryURL, resp.Status)
+	}
+	directory := &acmeDirectory{}
+	if err := json.NewDecoder(resp.Body).Decode(directory); err != nil {
+		return err
+	}
+	c.directory = directory
+	return nil
+}
+
+func (c *acmeClient) fetchNonce(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.directory.NewNonce, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	if len(c.nonce) == 0 {
+		return fmt.Errorf("no nonce returned by %s", c.directory.NewNonce)
+	}
+	return nil
+}
+
+// post sends the signed request and decodes the response into result if not nil, requests rejected for bad
+// nonce are retried once with the fresh nonce.
+func (c *acmeClient) post(ctx context.Context, url string, payload interface{}, accept string, result interface{}) (*http.Response,
+	[]byte, error) {
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		if len(c.nonce) == 0 {
+			if err := c.fetchNonce(ctx); err != nil {
+				return nil, nil, err
+			}
+		}
+		body, err := c.sign(url, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", ACMEJoseContentType)
+		if len(accept) != 0 {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		c.nonce = resp.Header.Get("Replay-Nonce")
+		if resp.StatusCode >= http.StatusBadRequest {
+			problem := &acmeProblem{}
+			if json.Unmarshal(content, problem) != nil || len(problem.Type) == 0 {
+				return nil, nil, fmt.Errorf("acme request to %s failed: %s", url, resp.Status)
+			}
+			if problem.Type == ACMEBadNonceError && attempt == 0 {
+				continue
+			}
+			return nil, nil, problem
+		}
+		if result != nil {
+			if err := json.Unmarshal(content, result); err != nil {
+				return nil, nil, err
+			}
+		}
+		return resp, content, nil
+	}
+}
+
+// register registers the account of key, registering an existing account returns its url as well.
+func (c *acmeClient) register(ctx context.Context) error {
+	if err := c.discover(ctx); err != nil {
+		return err
+	}
+	if len(c.kid) != 0 {
+		return nil
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if len(c.email) != 0 {
+		account["contact"] = []string{"mailto:" + c.email}
+	}
+	resp, _, err := c.post(ctx, c.directory.NewAccount, account, "", nil)
+	if err != nil {
+		return err
+	}
+	c.kid = resp.Header.Get("Location")
+	if len(c.kid) == 0 {
+		return fmt.Errorf("no account url returned by %s", c.directory.NewAccount)
+	}
+	return nil
+}
+
+// poll fetches resource until its status is one of done, result must expose its status via status function.
+// Polling stops once ctx is done.
+func (c *acmeClient) poll(ctx context.Context, url string, result interface{}, status func() string,
+	done ...string) error {
+	for attempt := 0; attempt < ACMEPollAttempts; attempt++ {
+		if _, _, err := c.post(ctx, url, nil, "", result); err != nil {
+			return err
+		}
+		current := status()
+		for _, expected := range done {
+			if current == expected {
+				return nil
+			}
+		}
+		if current == ACMEStatusInvalid {
+			return fmt.Errorf("acme resource %s became invalid", url)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(ACMEPollInterval):
+		}
+	}
+	return fmt.Errorf("timed out waiting for acme resource %s", url)
+}
+
+// authorize responds to the http-01 challenge of authorization and waits until it's validated, key
+// authorization must be served on the host by then.
+func (c *acmeClient) authorize(ctx context.Context, url string) error {
+	authz := &acmeAuthorization{}
+	if _, _, err := c.post(ctx, url, nil, "", authz); err != nil {
+		return err
+	}
+	if authz.Status == ACMEStatusValid {
+		return nil
+	}
+	var challenge *acmeChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == ACMEChallengeHTTP01 {
+			challenge = &authz.Challenges[i]
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+	if _, _, err := c.post(ctx, challenge.URL, struct{}{}, "", nil); err != nil {
+		return err
+	}
+	err := c.poll(ctx, url, authz, func() string { return authz.Status }, ACMEStatusValid)
+	if err != nil {
+		for _, challenge := range authz.Challenges {
+			if challenge.Type == ACMEChallengeHTTP01 && challenge.Error != nil {
+				return fmt.Errorf("http-01 challenge of %s failed: %w", authz.Identifier.Value, challenge.Error)
+			}
+		}
+	}
+	return err
+}
+
+// obtain orders the certificate of host, it returns the pem encoded certificate chain and private key. The order
+// is abandoned once ctx is done.
+func (c *acmeClient) obtain(ctx context.Context, host string) ([]byte, []byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.register(ctx); err != nil {
+		return nil, nil, err
+	}
+	order := &acmeOrder{}
+	resp, _, err := c.post(ctx, c.directory.NewOrder, map[string]interface{}{
+		"identifiers": []acmeIdentifier{{Type: "dns", Value: host}},
+	}, "", order)
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := resp.Header.Get("Location")
+	for _, authz := range order.Authorizations {
+		if err := c.authorize(ctx, authz); err != nil {
+			return nil, nil, err
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: host},
+		DNSNames: []string{host},
+	}, crypto.Signer(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := c.post(ctx, order.Finalize, map[string]string{"csr": acmeEncode(csr)}, "", order); err != nil {
+		return nil, nil, err
+	}
+	if order.Status != ACMEStatusValid {
+		if err := c.poll(ctx, orderURL, order, func() string { return order.Status }, ACMEStatusValid); err != nil {
+			if order.Error != nil {
+				return nil, nil, order.Error
+			}
+			return nil, nil, err
+		}
+	}
+	_, chain, err := c.post(ctx, order.Certificate, nil, ACMEPEMChainType, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.Contains(string(chain), "BEGIN CERTIFICATE") {
+		return nil, nil, fmt.Errorf("no certificate chain returned by %s", order.Certificate)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// parseACMEAccountKey parses the pem encoded ecdsa P-256 account key, both SEC 1 and PKCS #8 forms are accepted.
+func parseACMEAccountKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem encoded key found")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return acmeP256Key(key)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("acme account key must be an ecdsa key")
+	}
+	return acmeP256Key(key)
+}
+
+func acmeP256Key(key *ecdsa.PrivateKey) (*ecdsa.PrivateKey, error) {
+	if key.Curve.Params().BitSize != 256 {
+		return nil, fmt.Errorf("acme account key must be on curve P-256 for ES256")
+	}
+	return key, nil
+}
@@ -0,0 +1,264 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseACMEAccountKey(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	sec1 := func(key *ecdsa.PrivateKey) []byte {
+		der, _ := x509.MarshalECPrivateKey(key)
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	}
+	pkcs8 := func(key interface{}) []byte {
+		der, _ := x509.MarshalPKCS8PrivateKey(key)
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "sec1 p256", data: sec1(p256)},
+		{name: "pkcs8 p256", data: pkcs8(p256)},
+		{name: "sec1 p384", data: sec1(p384), wantErr: true},
+		{name: "pkcs8 p384", data: pkcs8(p384), wantErr: true},
+		{name: "pkcs8 rsa", data: pkcs8(rsaKey), wantErr: true},
+		{name: "not pem", data: []byte("key"), wantErr: true},
+		{name: "garbage der", data: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}}),
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := parseACMEAccountKey(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseACMEAccountKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !key.Equal(p256) {
+				t.Errorf("parseACMEAccountKey() returned another key")
+			}
+		})
+	}
+}
+
+func TestACMESign(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name    string
+		kid     string
+		payload []byte
+	}{
+		{name: "new account by jwk", payload: []byte(`{"termsOfServiceAgreed":true}`)},
+		{name: "registered account by kid", kid: "https://ca/acct/1", payload: []byte(`{}`)},
+		{name: "post as get", kid: "https://ca/acct/1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newACMEClient("https://ca/dir", "", key)
+			c.kid, c.nonce = tt.kid, "nonce"
+			body, err := c.sign("https://ca/order", tt.payload)
+			if err != nil {
+				t.Fatalf("sign() error = %v", err)
+			}
+			header, payload, err := verifyACMEJWS(&key.PublicKey, body)
+			if err != nil {
+				t.Fatalf("sign() = %s, %v", body, err)
+			}
+			if string(payload) != string(tt.payload) {
+				t.Errorf("sign() payload = %q, want %q", payload, tt.payload)
+			}
+			if header["nonce"] != "nonce" || header["url"] != "https://ca/order" || header["alg"] != "ES256" {
+				t.Errorf("sign() header = %v", header)
+			}
+			_, hasJWK := header["jwk"]
+			if kid, _ := header["kid"].(string); kid != tt.kid || hasJWK != (len(tt.kid) == 0) {
+				t.Errorf("sign() header = %v, want account referred by kid %q", header, tt.kid)
+			}
+		})
+	}
+}
+
+// verifyACMEJWS verifies the flattened JWS signed with key, it returns the protected header and payload.
+func verifyACMEJWS(key *ecdsa.PublicKey, body []byte) (map[string]interface{}, []byte, error) {
+	jws := map[string]string{}
+	if err := json.Unmarshal(body, &jws); err != nil {
+		return nil, nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(jws["signature"])
+	if err != nil || len(signature) != 64 {
+		return nil, nil, fmt.Errorf("malformed signature %q", jws["signature"])
+	}
+	digest := sha256.Sum256([]byte(jws["protected"] + "." + jws["payload"]))
+	if !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, nil, fmt.Errorf("invalid signature")
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(jws["protected"])
+	if err != nil {
+		return nil, nil, err
+	}
+	header := map[string]interface{}{}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws["payload"])
+	return header, payload, err
+}
+
+// fakeACMEServer is a CA accepting orders of single host, challenge decides whether http-01 challenge passes.
+type fakeACMEServer struct {
+	sync.Mutex
+	key          *ecdsa.PublicKey
+	challenge    string
+	badNonceOnce bool
+	responded    bool
+	nonces       int
+	posts        []string
+}
+
+func (f *fakeACMEServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	base := "http://" + req.Host
+	f.nonces++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", f.nonces))
+	if req.Method == http.MethodGet && req.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(acmeDirectory{NewNonce: base + "/nonce", NewAccount: base + "/account",
+			NewOrder: base + "/order"})
+		return
+	}
+	if req.Method == http.MethodHead && req.URL.Path == "/nonce" {
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	header, _, err := verifyACMEJWS(f.key, body)
+	if req.Method != http.MethodPost || err != nil || header["url"] != base+req.URL.Path {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(acmeProblem{Type: "urn:ietf:params:acme:error:malformed"})
+		return
+	}
+	if f.badNonceOnce {
+		f.badNonceOnce = false
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(acmeProblem{Type: ACMEBadNonceError})
+		return
+	}
+	f.posts = append(f.posts, req.URL.Path)
+	switch req.URL.Path {
+	case "/account":
+		w.Header().Set("Location", base+"/acct/1")
+		w.WriteHeader(http.StatusCreated)
+	case "/order":
+		w.Header().Set("Location", base+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(acmeOrder{Status: "pending", Authorizations: []string{base + "/authz/1"},
+			Finalize: base + "/finalize"})
+	case "/authz/1":
+		authz := acmeAuthorization{Status: "pending", Identifier: acmeIdentifier{Type: "dns", Value: "host"},
+			Challenges: []acmeChallenge{{Type: ACMEChallengeHTTP01, URL: base + "/challenge/1", Token: "token"}}}
+		if f.responded {
+			authz.Status = f.challenge
+			if f.challenge == ACMEStatusInvalid {
+				authz.Challenges[0].Error = &acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized"}
+			}
+		}
+		json.NewEncoder(w).Encode(authz)
+	case "/challenge/1":
+		f.responded = true
+		w.Write([]byte("{}"))
+	case "/finalize":
+		json.NewEncoder(w).Encode(acmeOrder{Status: ACMEStatusValid, Certificate: base + "/certificate"})
+	case "/certificate":
+		w.Write([]byte("-----BEGIN CERTIFICATE-----\nMA==\n-----END CERTIFICATE-----\n"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(acmeProblem{Type: "urn:ietf:params:acme:error:malformed"})
+	}
+}
+
+func TestACMEClientObtain(t *testing.T) {
+	tests := []struct {
+		name         string
+		challenge    string
+		badNonceOnce bool
+		wantErr      string
+		wantPosts    string
+	}{
+		{name: "issued", challenge: ACMEStatusValid,
+			wantPosts: "/account /order /authz/1 /challenge/1 /authz/1 /finalize /certificate"},
+		{name: "bad nonce retried", challenge: ACMEStatusValid, badNonceOnce: true,
+			wantPosts: "/account /order /authz/1 /challenge/1 /authz/1 /finalize /certificate"},
+		{name: "challenge failed", challenge: ACMEStatusInvalid, wantErr: "http-01 challenge of host failed",
+			wantPosts: "/account /order /authz/1 /challenge/1 /authz/1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			ca := &fakeACMEServer{key: &key.PublicKey, challenge: tt.challenge, badNonceOnce: tt.badNonceOnce}
+			server := httptest.NewServer(ca)
+			defer server.Close()
+			c := newACMEClient(server.URL+"/dir", "admin@example.com", key)
+			chain, certificateKey, err := c.obtain(context.Background(), "host")
+			if len(tt.wantErr) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("obtain() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("obtain() error = %v", err)
+			} else if !strings.Contains(string(chain), "BEGIN CERTIFICATE") || len(certificateKey) == 0 {
+				t.Errorf("obtain() = %q, %q", chain, certificateKey)
+			}
+			if got := strings.Join(ca.posts, " "); got != tt.wantPosts {
+				t.Errorf("obtain() posted %q, want %q", got, tt.wantPosts)
+			}
+			if c.kid != server.URL+"/acct/1" {
+				t.Errorf("obtain() registered account %q, want %q", c.kid, server.URL+"/acct/1")
+			}
+		})
+	}
+}
+
+func TestACMEClientObtainCanceled(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := httptest.NewServer(&fakeACMEServer{key: &key.PublicKey, challenge: "pending"})
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := newACMEClient(server.URL+"/dir", "", key).obtain(ctx, "host"); err == nil {
+		t.Errorf("obtain() with canceled context succeeded")
+	}
+}
@@ -0,0 +1,375 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	ActivatorResource = "%s-activator"
+	// ActivatorPollInterval is the interval activator checks whether woken instance becomes ready
+	ActivatorPollInterval = 1 * time.Second
+	ForwardedPrefixHeader = "X-Forwarded-Prefix"
+	// ActivatorPasswordField is the form field the credential of instance is posted in to wake it up
+	ActivatorPasswordField = "password"
+)
+
+// activatorWakeForm asks for the credential of instance before waking it up.
+const activatorWakeForm = `<!DOCTYPE html>
+<html><body>
+<p>Code server is inactive, enter its password to wake it up.</p>
+<form method="post"><input type="password" name="password" autofocus><input type="submit" value="Wake up"></form>
+</body></html>
+`
+
+// activatorEnabled returns whether requests to the inactive instance are routed to activator, only the ingress
+// provider is supported.
+func (r *CodeServerReconciler) activatorEnabled(m *csv1alpha1.CodeServer) bool {
+	return len(r.Options.Load().ActivatorService) != 0 && r.ingressProvider(m) == IngressProviderIngress
+}
+
+// routeServiceName returns the service which ingress routes to, activator takes over inactive and recycled
+// instance.
+func (r *CodeServerReconciler) routeServiceName(m *csv1alpha1.CodeServer) string {
+	if r.activatorEnabled(m) && (HasCondition(m.Status, csv1alpha1.ServerInactive) ||
+		HasCondition(m.Status, csv1alpha1.ServerRecycled)) {
+		return ChildName(ActivatorResource, m.Name)
+	}
+	return m.Name
+}
+
+// reconcileForActivator routes inactive instance to activator with an ExternalName service, since ingress can
+// only refer to services in the same namespace.
+func (r *CodeServerReconciler) reconcileForActivator(codeServer *csv1alpha1.CodeServer) error {
+	if !r.activatorEnabled(codeServer) {
+		return nil
+	}
+	reqLogger := r.instanceLog(codeServer)
+	newService := r.newActivatorService(codeServer)
+	oldService := &corev1.Service{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: newService.Name, Namespace: newService.Namespace},
+		oldService)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating an activator Service.")
+		r.addCostLabels(codeServer, newService)
+		if err = r.Client.Create(context.TODO(), newService); err != nil {
+			reqLogger.Error(err, "Failed to create activator Service.")
+			return err
+		}
+		r.recordCreated(codeServer, newService)
+	} else if err != nil {
+		reqLogger.Error(err, "Failed to get activator Service.")
+		return err
+	} else if !equality.Semantic.DeepEqual(oldService.Spec.ExternalName, newService.Spec.ExternalName) ||
+		!equality.Semantic.DeepEqual(oldService.Spec.Ports, newService.Spec.Ports) {
+		oldService.Spec.ExternalName = newService.Spec.ExternalName
+		oldService.Spec.Ports = newService.Spec.Ports
+		reqLogger.Info("Updating an activator Service.")
+		if err = r.Client.Update(context.TODO(), oldService); err != nil {
+			reqLogger.Error(err, "Failed to update activator Service.")
+			return err
+		}
+		r.recordUpdated(codeServer, oldService)
+	}
+	_, err = r.reconcileForIngress(codeServer)
+	return err
+}
+
+// deleteActivatorService deletes activator service once instance is active again.
+func (r *CodeServerReconciler) deleteActivatorService(name, namespace string) error {
+	if len(r.Options.Load().ActivatorService) == 0 {
+		return nil
+	}
+	return r.deleteResourceIfExists(&corev1.Service{}, ChildName(ActivatorResource, name), namespace)
+}
+
+func (r *CodeServerReconciler) newActivatorService(m *csv1alpha1.CodeServer) *corev1.Service {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ChildName(ActivatorResource, m.Name),
+			Namespace: m.Namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:         corev1.ServiceTypeExternalName,
+			ExternalName: r.Options.Load().ActivatorService,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "web-ui",
+					Protocol:   corev1.ProtocolTCP,
+					Port:       HttpPort,
+					TargetPort: intstr.FromInt(HttpPort),
+				},
+			},
+		},
+	}
+	setOwnedLabels(service, m.Name)
+	// Set CodeServer instance as the owner of the activator service.
+	controllerutil.SetControllerReference(m, service, r.Scheme)
+	return service
+}
+
+// CodeServerActivator receives requests routed to inactive instances, it wakes the instance up, holds the
+// request until instance becomes ready and then forwards it, so that users only need to wait rather than
+// finding their url dead.
+type CodeServerActivator struct {
+	client.Client
+	Log      logr.Logger
+	Options  *CodeServerOption
+	recorder record.EventRecorder
+}
+
+func NewCodeServerActivator(client client.Client, log logr.Logger, options *CodeServerOption,
+	recorder record.EventRecorder) *CodeServerActivator {
+	return &CodeServerActivator{
+		Client:   client,
+		Log:      log,
+		Options:  options,
+		recorder: recorder,
+	}
+}
+
+func (a *CodeServerActivator) Run(stopCh <-chan struct{}) {
+	server := &http.Server{Addr: a.Options.Load().ActivatorAddr, Handler: a}
+	go func() {
+		a.Log.Info(fmt.Sprintf("activator listening on %s", a.Options.Load().ActivatorAddr))
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			a.Log.Error(err, "activator stopped unexpectedly")
+		}
+	}()
+	<-stopCh
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+func (a *CodeServerActivator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if len(a.Options.Load().ACMEDirectoryURL) != 0 && strings.HasPrefix(req.URL.Path, ACMEChallengePath) {
+		a.serveACMEChallenge(w, req)
+		return
+	}
+	codeServer, err := a.lookup(req)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if codeServer == nil {
+		writeAPIError(w, http.StatusNotFound, "code server not found")
+		return
+	}
+	if movedTo, found := codeServer.Annotations[MovedToAnnotation]; found {
+		http.Redirect(w, req, strings.TrimSuffix(movedTo, "/")+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+	if HasCondition(codeServer.Status, csv1alpha1.ServerRecycled) {
+		writeAPIError(w, http.StatusGone, "code server has been recycled")
+		return
+	}
+	if _, found := codeServer.Annotations[MigratingAnnotation]; found {
+		writeAPIError(w, http.StatusServiceUnavailable, "code server is being migrated, please retry later")
+		return
+	}
+	key := types.NamespacedName{Namespace: codeServer.Namespace, Name: codeServer.Name}
+	if HasCondition(codeServer.Status, csv1alpha1.ServerBudgetExceeded) &&
+		HasCondition(codeServer.Status, csv1alpha1.ServerInactive) {
+		writeAPIError(w, http.StatusTooManyRequests, "weekly budget of code server exceeded")
+		return
+	}
+	if !HasCondition(codeServer.Status, csv1alpha1.ServerReady) {
+		// requests routed to activator skip the auth of code server, so only its credential wakes it up
+		authorized, err := a.wakeAuthorized(req, codeServer)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !authorized {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(activatorWakeForm))
+			return
+		}
+		if err := a.wake(key); err != nil {
+			a.Log.Error(err, "Failed to wake code server.", "codeserver", key)
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !a.waitReady(req.Context(), key) {
+			writeAPIError(w, http.StatusGatewayTimeout, "code server is not ready yet, please retry later")
+			return
+		}
+		if req.Method == http.MethodPost && len(req.PostFormValue(ActivatorPasswordField)) != 0 {
+			// the wake form is not meant for code server
+			http.Redirect(w, req, req.URL.RequestURI(), http.StatusSeeOther)
+			return
+		}
+	}
+	target := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(fmt.Sprintf(ServiceHostTemplate, codeServer.Name, codeServer.Namespace), fmt.Sprint(HttpPort)),
+	}
+	httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, req)
+}
+
+// wakeAuthorized returns whether request may wake the instance up, instance protected by password or token is
+// only woken by requests presenting its credential as bearer token or in the wake form. Instance without auth is
+// open to everyone anyway.
+func (a *CodeServerActivator) wakeAuthorized(req *http.Request, m *csv1alpha1.CodeServer) (bool, error) {
+	var key string
+	switch m.Spec.Auth {
+	case csv1alpha1.AuthNone:
+		return true, nil
+	case csv1alpha1.AuthPassword:
+		key = AuthPasswordKey
+	case csv1alpha1.AuthToken:
+		key = AuthTokenKey
+	default:
+		// credential is generated by code server itself
+		return false, nil
+	}
+	credential := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if req.Method == http.MethodPost {
+		if password := req.PostFormValue(ActivatorPasswordField); len(password) != 0 {
+			credential = password
+		}
+	}
+	if len(credential) == 0 {
+		return false, nil
+	}
+	secret := &corev1.Secret{}
+	if err := a.Client.Get(context.TODO(), types.NamespacedName{Name: ChildName(AuthResource, m.Name),
+		Namespace: m.Namespace}, secret); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	expected := secret.Data[key]
+	return len(expected) != 0 && subtle.ConstantTimeCompare([]byte(credential), expected) == 1, nil
+}
+
+// lookup finds the instance of request by host, the path prefix is taken from X-Forwarded-Prefix header since
+// prefix has been stripped by ingress.
+func (a *CodeServerActivator) lookup(req *http.Request) (*csv1alpha1.CodeServer, error) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	prefix := strings.TrimSuffix(req.Header.Get(ForwardedPrefixHeader), "/")
+	codeServers := &csv1alpha1.CodeServerList{}
+	// path prefix names the instance which is fetched directly, otherwise candidates are narrowed down by subdomain
+	// which is the first label of host
+	if len(prefix) != 0 {
+		segments := strings.Split(strings.TrimPrefix(prefix, PathPrefixRoot), "/")
+		if len(segments) != 2 {
+			return nil, nil
+		}
+		codeServer := csv1alpha1.CodeServer{}
+		err := a.Client.Get(context.TODO(), types.NamespacedName{Namespace: segments[0], Name: segments[1]}, &codeServer)
+		if errors.IsNotFound(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		codeServers.Items = append(codeServers.Items, codeServer)
+	} else if err := a.Client.List(context.TODO(), codeServers,
+		client.MatchingFields{IndexRoute: strings.SplitN(host, ".", 2)[0]}); err != nil {
+		return nil, err
+	}
+	for i := range codeServers.Items {
+		m := &codeServers.Items[i]
+		if routeHost(m, a.Options.Load().DomainName) == host && instancePathPrefix(m) == prefix {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// wake marks the inactive instance active again, reconciler then recreates the released resources.
+func (a *CodeServerActivator) wake(key types.NamespacedName) error {
+	codeServer, woken, err := wakeCodeServer(a.Client, key, "code server has been woken by request")
+	if err == nil && woken {
+		a.Log.Info("code server has been woken by request", "codeserver", key)
+		a.recorder.Event(codeServer, corev1.EventTypeNormal, EventWoken,
+			"Code server has been woken by request")
+	}
+	return err
+}
+
+// wakeCodeServer clears the inactive condition of code server, conflict is treated as woken by others. Instances
+// migrated or being migrated to another cluster are never woken.
+func wakeCodeServer(c client.Client, key types.NamespacedName, reason string) (*csv1alpha1.CodeServer, bool, error) {
+	codeServer := &csv1alpha1.CodeServer{}
+	if err := c.Get(context.TODO(), key, codeServer); err != nil {
+		return nil, false, err
+	}
+	if !HasCondition(codeServer.Status, csv1alpha1.ServerInactive) ||
+		HasCondition(codeServer.Status, csv1alpha1.ServerRecycled) || migrating(codeServer) ||
+		HasCondition(codeServer.Status, csv1alpha1.ServerBudgetExceeded) {
+		return codeServer, false, nil
+	}
+	clearPendingRecycle(codeServer, reason)
+	SetCondition(&codeServer.Status, NewStateCondition(csv1alpha1.ServerInactive,
+		reason, map[string]string{}, corev1.ConditionFalse))
+	err := c.Update(context.TODO(), codeServer)
+	if errors.IsConflict(err) {
+		return codeServer, false, nil
+	}
+	return codeServer, err == nil, err
+}
+
+// waitReady waits until instance becomes ready, client cancellation and activator timeout are honored.
+func (a *CodeServerActivator) waitReady(ctx context.Context, key types.NamespacedName) bool {
+	timeout := time.After(time.Duration(a.Options.Load().ActivatorTimeout) * time.Second)
+	ticker := time.NewTicker(ActivatorPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			codeServer := &csv1alpha1.CodeServer{}
+			if err := a.Client.Get(context.TODO(), key, codeServer); err != nil {
+				return false
+			}
+			if HasCondition(codeServer.Status, csv1alpha1.ServerReady) {
+				return true
+			}
+		case <-timeout:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -19,6 +19,9 @@ package controllers
 import (
 	"k8s.io/apimachinery/pkg/types"
 	"sync"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
 )
 
 type CodeServerActiveCache struct {
@@ -28,9 +31,20 @@ type CodeServerActiveCache struct {
 
 type CodeServerActiveStatus struct {
 	ProbeEndpoint  string
+	NotifyEndpoint string
 	Duration       int64
 	FailureCount   int
 	NamespacedName types.NamespacedName
+	PendingSince   time.Time
+	KeepAliveAt    time.Time
+	PushedAt       time.Time
+	LastActivity   time.Time
+	Clients        int
+	Activity       *csv1alpha1.ActivitySpec
+	Host           string
+	WatchedAt      time.Time
+	ConnectedAt    time.Time
+	NextProbeAt    time.Time
 }
 
 func (c *CodeServerActiveCache) AddOrUpdate(req CodeServerRequest) {
@@ -39,12 +53,20 @@ func (c *CodeServerActiveCache) AddOrUpdate(req CodeServerRequest) {
 	if obj, found := c.InactiveCaches[req.resource.String()]; found {
 		obj.Duration = req.duration
 		obj.ProbeEndpoint = req.endpoint
+		obj.NotifyEndpoint = req.notifyEndpoint
+		obj.Activity = req.activity
+		obj.Host = req.host
 	} else {
 		c.InactiveCaches[req.resource.String()] = &CodeServerActiveStatus{
 			ProbeEndpoint:  req.endpoint,
+			NotifyEndpoint: req.notifyEndpoint,
 			Duration:       req.duration,
 			FailureCount:   0,
 			NamespacedName: req.resource,
+			Activity:       req.activity,
+			Host:           req.host,
+			WatchedAt:      time.Now(),
+			PendingSince:   req.pendingSince,
 		}
 	}
 }
@@ -65,18 +87,77 @@ func (c *CodeServerActiveCache) DeleteFromName(req types.NamespacedName) {
 	}
 }
 
-func (c *CodeServerActiveCache) BumpFailureCount(key string) {
+// BumpFailureCount counts a failed probe, instance won't be probed again until next probe time.
+func (c *CodeServerActiveCache) BumpFailureCount(key string, nextProbeAt time.Time) {
 	c.Lock()
 	defer c.Unlock()
 	if obj, found := c.InactiveCaches[key]; found {
 		obj.FailureCount += 1
+		obj.NextProbeAt = nextProbeAt
+	}
+}
+
+func (c *CodeServerActiveCache) ResetFailureCount(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if obj, found := c.InactiveCaches[key]; found {
+		obj.FailureCount = 0
+		obj.NextProbeAt = time.Time{}
+	}
+}
+func (c *CodeServerActiveCache) MarkPending(key string, since time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if obj, found := c.InactiveCaches[key]; found {
+		obj.PendingSince = since
+	}
+}
+
+func (c *CodeServerActiveCache) ClearPending(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if obj, found := c.InactiveCaches[key]; found {
+		obj.PendingSince = time.Time{}
 	}
 }
+
+func (c *CodeServerActiveCache) KeepAlive(key string, at time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if obj, found := c.InactiveCaches[key]; found {
+		obj.KeepAliveAt = at
+	}
+}
+
+func (c *CodeServerActiveCache) Push(key string, event ActivityEvent) {
+	c.Lock()
+	defer c.Unlock()
+	if obj, found := c.InactiveCaches[key]; found {
+		obj.PushedAt = time.Now()
+		if event.Type == ActivityClients {
+			obj.Clients = event.Clients
+		}
+		if event.Time.After(obj.LastActivity) {
+			obj.LastActivity = event.Time
+		}
+	}
+}
+
+func (c *CodeServerActiveCache) Connected(key string, at time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if obj, found := c.InactiveCaches[key]; found {
+		obj.ConnectedAt = at
+	}
+}
+
 func (c *CodeServerActiveCache) Get(key string) *CodeServerActiveStatus {
 	c.RLock()
 	defer c.RUnlock()
 	if obj, found := c.InactiveCaches[key]; found {
-		return obj
+		// a snapshot is returned as cache is updated by worker of watcher concurrently
+		snapshot := *obj
+		return &snapshot
 	}
 	return nil
 }
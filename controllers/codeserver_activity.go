@@ -0,0 +1,214 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	ActivityPath      = "/api/v1/activity"
+	ExporterContainer = "status-exporter"
+	// ActivityEventBuffer is the number of pushed events buffered before the activity server rejects new ones
+	ActivityEventBuffer = 1024
+	// ActivityPushFactor is the number of probe intervals a pushing instance is trusted without any event
+	ActivityPushFactor = 3
+)
+
+// Types of activity events reported by exporter
+const (
+	ActivityKeystroke = "keystroke"
+	ActivityTerminal  = "terminal"
+	ActivityClients   = "clients"
+	ActivityHeartbeat = "heartbeat"
+)
+
+// ActivityEvent is pushed by status exporter sidecar whenever user activity is observed
+type ActivityEvent struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Clients   int       `json:"clients,omitempty"`
+	Time      time.Time `json:"time,omitempty"`
+}
+
+func (e *ActivityEvent) NamespacedName() types.NamespacedName {
+	return types.NamespacedName{Namespace: e.Namespace, Name: e.Name}
+}
+
+// CodeServerActivityServer receives activity events pushed by exporters, so that the watcher doesn't need to
+// probe every instance on each interval.
+type CodeServerActivityServer struct {
+	client.Client
+	Log     logr.Logger
+	Options *CodeServerOption
+	eventCh chan<- ActivityEvent
+}
+
+func NewCodeServerActivityServer(client client.Client, log logr.Logger, options *CodeServerOption,
+	eventCh chan<- ActivityEvent) *CodeServerActivityServer {
+	return &CodeServerActivityServer{
+		Client:  client,
+		Log:     log,
+		Options: options,
+		eventCh: eventCh,
+	}
+}
+
+func (s *CodeServerActivityServer) Run(stopCh <-chan struct{}) {
+	server := &http.Server{Addr: s.Options.Load().ActivityAddr, Handler: s}
+	go func() {
+		s.Log.Info(fmt.Sprintf("activity server listening on %s", s.Options.Load().ActivityAddr))
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.Log.Error(err, "activity server stopped unexpectedly")
+		}
+	}()
+	<-stopCh
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+// ServeHTTP serves the following endpoint:
+//
+//	POST /api/v1/activity
+func (s *CodeServerActivityServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != ActivityPath {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if req.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	event := ActivityEvent{}
+	if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid activity event: %v", err))
+		return
+	}
+	if len(event.Namespace) == 0 || len(event.Name) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "namespace and name are required")
+		return
+	}
+	switch event.Type {
+	case ActivityKeystroke, ActivityTerminal, ActivityClients, ActivityHeartbeat:
+	default:
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("unsupported activity type %s", event.Type))
+		return
+	}
+	if !s.fromInstance(req, &event) {
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("activity of %s is not reported from its instance",
+			event.NamespacedName()))
+		return
+	}
+	// heartbeat without time means exporter has not observed any activity yet
+	now := time.Now()
+	if (event.Time.IsZero() && event.Type != ActivityHeartbeat) || event.Time.After(now) {
+		event.Time = now
+	}
+	select {
+	case s.eventCh <- event:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeAPIError(w, http.StatusServiceUnavailable, "too many activity events")
+	}
+}
+
+// fromInstance verifies the event is sent from one pod of the reported code server, which prevents
+// other workloads from keeping an instance alive.
+func (s *CodeServerActivityServer) fromInstance(req *http.Request, event *ActivityEvent) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	pods := &corev1.PodList{}
+	if err := s.Client.List(context.TODO(), pods, client.InNamespace(event.Namespace),
+		client.MatchingLabels(appLabel(event.Name))); err != nil {
+		s.Log.Error(err, "Failed to list pods for activity event.", "codeserver", event.NamespacedName())
+		return false
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP == host {
+			return true
+		}
+		for _, ip := range pod.Status.PodIPs {
+			if ip.IP == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addActivityPushForPod configures status exporter to push activity events to operator.
+func (r *CodeServerReconciler) addActivityPushForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	if len(r.Options.Load().ActivityPushURL) == 0 {
+		return
+	}
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name != ExporterContainer {
+			continue
+		}
+		podSpec.Containers[i].Env = append(podSpec.Containers[i].Env,
+			corev1.EnvVar{Name: "ACTIVITY_PUSH_URL", Value: strings.TrimSuffix(r.Options.Load().ActivityPushURL, "/") + ActivityPath},
+			corev1.EnvVar{Name: "CS_NAMESPACE", Value: m.Namespace},
+			corev1.EnvVar{Name: "CS_NAME", Value: m.Name})
+	}
+}
+
+// receiveActivity records pushed event and cancels pending recycle at once instead of waiting for next probe.
+func (cs *CodeServerWatcher) receiveActivity(event ActivityEvent) {
+	key := event.NamespacedName().String()
+	css := cs.inActiveCache.Get(key)
+	if css == nil {
+		return
+	}
+	cs.inActiveCache.Push(key, event)
+	if !css.PendingSince.IsZero() && cs.pushedActivity(css).After(css.PendingSince) {
+		cs.Log.Info(fmt.Sprintf("code server %s reported %s activity, cancel pending recycle", key, event.Type))
+		cs.cancelPendingRecycle(css, fmt.Sprintf("code server reported %s activity", event.Type))
+	}
+}
+
+// activityPushed returns whether exporter of the instance keeps pushing events, the http probe is skipped then.
+// Instances without any reported activity are still probed, so that their failures are counted as before.
+func (cs *CodeServerWatcher) activityPushed(css *CodeServerActiveStatus) bool {
+	if css.PushedAt.IsZero() || (css.LastActivity.IsZero() && css.Clients == 0) {
+		return false
+	}
+	return time.Since(css.PushedAt) < time.Duration(ActivityPushFactor*cs.Options.Load().ProbeInterval)*time.Second
+}
+
+// pushedActivity returns the last active time derived from pushed events, connected clients keep instance active.
+func (cs *CodeServerWatcher) pushedActivity(css *CodeServerActiveStatus) time.Time {
+	if css.Clients > 0 {
+		return time.Now()
+	}
+	return css.LastActivity
+}
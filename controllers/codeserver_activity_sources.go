@@ -0,0 +1,289 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	"io"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	ConnectionsPath        = "/connections"
+	IngressLogTailInterval = 1 * time.Second
+)
+
+// ActivitySource tells the last active time of instance observed from one place
+type ActivitySource interface {
+	// LastActive returns false if the source fails to observe the instance, failures are counted towards max
+	// probe retry.
+	LastActive(css *CodeServerActiveStatus) (bool, *time.Time)
+}
+
+func (cs *CodeServerWatcher) RegisterActivitySource(name csv1alpha1.ActivitySourceType, source ActivitySource) {
+	cs.sources[name] = source
+}
+
+// activitySources returns the enabled sources and combination mode configured for instance, exporter is used if
+// none of configured sources is enabled.
+func (cs *CodeServerWatcher) activitySources(css *CodeServerActiveStatus) ([]csv1alpha1.ActivitySourceType, csv1alpha1.ActivityMode) {
+	mode := csv1alpha1.ActivityModeAny
+	var sources []csv1alpha1.ActivitySourceType
+	if css.Activity != nil {
+		if css.Activity.Mode == csv1alpha1.ActivityModeAll {
+			mode = csv1alpha1.ActivityModeAll
+		}
+		for _, name := range css.Activity.Sources {
+			if _, found := cs.sources[name]; !found {
+				cs.Log.Info(fmt.Sprintf("activity source %s of code server %s is not enabled, ignored",
+					name, css.NamespacedName))
+				continue
+			}
+			sources = append(sources, name)
+		}
+	}
+	if len(sources) == 0 {
+		sources = []csv1alpha1.ActivitySourceType{csv1alpha1.ActivitySourceExporter}
+	}
+	return sources, mode
+}
+
+// lastActive combines the sources of instance, the latest active time is used in Any mode while the earliest one
+// is used in All mode so that instance is only active when all sources are active.
+func (cs *CodeServerWatcher) lastActive(css *CodeServerActiveStatus) (bool, *time.Time) {
+	sources, mode := cs.activitySources(css)
+	var result *time.Time
+	for _, name := range sources {
+		valid, t := cs.sources[name].LastActive(css)
+		if !valid {
+			if mode == csv1alpha1.ActivityModeAll {
+				return false, nil
+			}
+			continue
+		}
+		if result == nil || (mode == csv1alpha1.ActivityModeAny && t.After(*result)) ||
+			(mode == csv1alpha1.ActivityModeAll && t.Before(*result)) {
+			result = t
+		}
+	}
+	return result != nil, result
+}
+
+// exporterActivitySource uses the events pushed by exporter and probes the exporter otherwise
+type exporterActivitySource struct {
+	cs *CodeServerWatcher
+}
+
+func (s *exporterActivitySource) LastActive(css *CodeServerActiveStatus) (bool, *time.Time) {
+	if s.cs.activityPushed(css) {
+		pushed := s.cs.pushedActivity(css)
+		return true, &pushed
+	}
+	key := css.NamespacedName.String()
+	s.cs.Log.Info(fmt.Sprintf("starting to probe code server endpoint %s", key))
+	return s.cs.ProbeCodeServer(key, css)
+}
+
+// endpointsActivitySource treats instance active when clients are connected to any ready endpoint of its service,
+// connections are counted by exporter in the network namespace of pod.
+type endpointsActivitySource struct {
+	cs     *CodeServerWatcher
+	client *http.Client
+}
+
+func (s *endpointsActivitySource) LastActive(css *CodeServerActiveStatus) (bool, *time.Time) {
+	reqLogger := keyLogger(s.cs.Log, css.NamespacedName)
+	endpoints := &corev1.Endpoints{}
+	if err := s.cs.Client.Get(context.TODO(), css.NamespacedName, endpoints); err != nil {
+		reqLogger.Error(err, "Failed to get endpoints of code server.")
+		return false, nil
+	}
+	connections := 0
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			count, err := s.connections(address.IP)
+			if err != nil {
+				reqLogger.Error(err, fmt.Sprintf("Failed to count connections of endpoint %s.", address.IP))
+				return false, nil
+			}
+			connections += count
+		}
+	}
+	now := time.Now()
+	if connections > 0 {
+		s.cs.inActiveCache.Connected(css.NamespacedName.String(), now)
+		return true, &now
+	}
+	last := css.ConnectedAt
+	if last.IsZero() {
+		last = css.WatchedAt
+	}
+	return true, &last
+}
+
+func (s *endpointsActivitySource) connections(ip string) (int, error) {
+	resp, err := s.client.Get(fmt.Sprintf("http://%s%s", net.JoinHostPort(ip, strconv.Itoa(ExporterPort)),
+		ConnectionsPath))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(body)))
+}
+
+type ingressAccessLog struct {
+	Host string `json:"host"`
+	Time string `json:"time"`
+	URI  string `json:"uri"`
+}
+
+// IngressLogSource tails the access logs of ingress controller which are written by a log adapter in json lines,
+// e.g. ingress-nginx with log-format-upstream '{"host":"$host","time":"$time_iso8601","uri":"$request_uri"}', the
+// uri is only required by instances routed by path prefix.
+type IngressLogSource struct {
+	Log     logr.Logger
+	path    string
+	lock    sync.RWMutex
+	hosts   map[string]time.Time
+	offset  int64
+	started bool
+	partial []byte
+}
+
+func NewIngressLogSource(log logr.Logger, path string) *IngressLogSource {
+	return &IngressLogSource{
+		Log:   log,
+		path:  path,
+		hosts: map[string]time.Time{},
+	}
+}
+
+func (s *IngressLogSource) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(IngressLogTailInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.tail(); err != nil {
+				s.Log.Error(err, "Failed to tail ingress access logs.", "file", s.path)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// tail reads the lines appended since last time, the file is read from beginning again once it's truncated or
+// rotated. Logs written before operator started are skipped.
+func (s *IngressLogSource) tail() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if !s.started {
+		s.started = true
+		s.offset = size
+		return nil
+	}
+	if size < s.offset {
+		s.offset = 0
+		s.partial = nil
+	}
+	if size == s.offset {
+		return nil
+	}
+	if _, err := file.Seek(s.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(file, size-s.offset))
+	if err != nil {
+		return err
+	}
+	s.offset += int64(len(data))
+	lines := bytes.Split(append(s.partial, data...), []byte("\n"))
+	s.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		s.record(line)
+	}
+	return nil
+}
+
+func (s *IngressLogSource) record(line []byte) {
+	entry := ingressAccessLog{}
+	if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil || len(entry.Host) == 0 {
+		return
+	}
+	t, err := time.Parse(time.RFC3339, entry.Time)
+	if err != nil || t.After(time.Now()) {
+		t = time.Now()
+	}
+	host := entry.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	keys := []string{host}
+	if strings.HasPrefix(entry.URI, PathPrefixRoot) {
+		uri := strings.SplitN(strings.TrimPrefix(entry.URI, PathPrefixRoot), "?", 2)[0]
+		if segments := strings.SplitN(uri, "/", 3); len(segments) >= 2 {
+			keys = append(keys, host+fmt.Sprintf(PathPrefixFormat, segments[0], segments[1]))
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, key := range keys {
+		if t.After(s.hosts[key]) {
+			s.hosts[key] = t
+		}
+	}
+}
+
+func (s *IngressLogSource) LastActive(css *CodeServerActiveStatus) (bool, *time.Time) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	t, found := s.hosts[css.Host]
+	if !found {
+		t = css.WatchedAt
+	}
+	return true, &t
+}
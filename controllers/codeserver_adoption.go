@@ -0,0 +1,56 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// adoptResource takes over the resource which matches the naming scheme of code server but misses owner reference
+// or labels, e.g. created by older operator versions or manually, so that it's reconciled in place rather than
+// duplicated. Resources controlled by other objects are never taken over. Since all code servers are reconciled
+// when operator starts, existing resources are adopted on operator upgrade.
+func (r *CodeServerReconciler) adoptResource(codeServer *csv1alpha1.CodeServer, obj client.Object) error {
+	owner := metav1.GetControllerOf(obj)
+	if owner != nil && owner.UID != codeServer.UID {
+		return fmt.Errorf("%s %s is controlled by %s %s, refuse to adopt it", resourceKind(obj), obj.GetName(),
+			owner.Kind, owner.Name)
+	}
+	labels := obj.GetLabels()
+	if owner != nil && labels[ManagedByLabel] == ManagedBy && labels[InstanceLabel] == codeServer.Name {
+		return nil
+	}
+	if err := controllerutil.SetControllerReference(codeServer, obj, r.Scheme); err != nil {
+		return err
+	}
+	setOwnedLabels(obj, codeServer.Name)
+	r.instanceLog(codeServer).Info(
+		fmt.Sprintf("Adopting %s %s.", resourceKind(obj), obj.GetName()))
+	if err := r.Client.Update(context.TODO(), obj); err != nil {
+		return err
+	}
+	r.Recorder.Eventf(codeServer, corev1.EventTypeNormal, EventAdopted, "Adopted %s %s", resourceKind(obj),
+		obj.GetName())
+	return nil
+}
@@ -0,0 +1,748 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	errrorlib "errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	APIServerPrefix = "/api/v1/namespaces/"
+	AllNamespaces   = "*"
+	// AdminRole grants the token to open view sessions into instances of its namespaces.
+	AdminRole = "admin"
+	// JupyterHubRole grants the token to act on behalf of the users in spawner hooks.
+	JupyterHubRole = "jupyterhub"
+)
+
+// Phases of code server derived from conditions
+const (
+	PhasePending        = "Pending"
+	PhaseReady          = "Ready"
+	PhasePendingRecycle = "PendingRecycle"
+	PhaseInactive       = "Inactive"
+	PhaseRecycled       = "Recycled"
+	PhaseErrored        = "Errored"
+)
+
+// APIToken describes the identity and namespaces granted to a bearer token
+type APIToken struct {
+	User       string
+	Namespaces []string
+	Roles      []string
+}
+
+// CodeServerSummary is the view of code server exposed by api server
+type CodeServerSummary struct {
+	Name      string                     `json:"name"`
+	Namespace string                     `json:"namespace"`
+	User      string                     `json:"user,omitempty"`
+	Runtime   string                     `json:"runtime"`
+	Image     string                     `json:"image,omitempty"`
+	Phase     string                     `json:"phase"`
+	Endpoint  string                     `json:"endpoint,omitempty"`
+	Progress  *csv1alpha1.ProgressStatus `json:"progress,omitempty"`
+	CreatedAt metav1.Time                `json:"createdAt"`
+}
+
+type createCodeServerRequest struct {
+	Name     string                  `json:"name"`
+	Template string                  `json:"template"`
+	Spec     *CodeServerSpecOverride `json:"spec,omitempty"`
+	// Archive is the url of tar.gz archive the workspace is populated from.
+	Archive string `json:"archive,omitempty"`
+}
+
+// CodeServerSpecOverride is the part of spec callers of api server may override on top of template, other fields
+// are only configured by templates. The created instance is still subject to the validating webhooks, e.g. bounds
+// of resources.
+type CodeServerSpecOverride struct {
+	Resources            *corev1.ResourceRequirements `json:"resources,omitempty"`
+	StorageSize          string                       `json:"storageSize,omitempty"`
+	InactiveAfterSeconds *int64                       `json:"inactiveAfterSeconds,omitempty"`
+	RecycleAfterSeconds  *int64                       `json:"recycleAfterSeconds,omitempty"`
+	Envs                 []corev1.EnvVar              `json:"envs,omitempty"`
+	InitPlugins          map[string][]string          `json:"initPlugins,omitempty"`
+	Extensions           []string                     `json:"extensions,omitempty"`
+}
+
+// Spec returns the override as spec of code server, envs must be literal values so that secrets of namespace are
+// not exposed to callers. Map keys must not be directives of strategic merge patch, e.g. $patch, since the override
+// is merged into template as a patch.
+func (o *CodeServerSpecOverride) Spec() (*csv1alpha1.CodeServerSpec, error) {
+	for _, env := range o.Envs {
+		if env.ValueFrom != nil {
+			return nil, fmt.Errorf("env %s must not reference other resources", env.Name)
+		}
+	}
+	keys := make([]string, 0, len(o.InitPlugins))
+	for key := range o.InitPlugins {
+		keys = append(keys, key)
+	}
+	if o.Resources != nil {
+		for _, list := range []corev1.ResourceList{o.Resources.Limits, o.Resources.Requests} {
+			for name := range list {
+				keys = append(keys, string(name))
+			}
+		}
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, "$") {
+			return nil, fmt.Errorf("key %s must not be a patch directive", key)
+		}
+	}
+	spec := &csv1alpha1.CodeServerSpec{
+		StorageSize:          o.StorageSize,
+		InactiveAfterSeconds: o.InactiveAfterSeconds,
+		RecycleAfterSeconds:  o.RecycleAfterSeconds,
+		Envs:                 o.Envs,
+		InitPlugins:          o.InitPlugins,
+		Extensions:           o.Extensions,
+	}
+	if o.Resources != nil {
+		spec.Resources = *o.Resources
+	}
+	return spec, nil
+}
+
+type cloneCodeServerRequest struct {
+	Name string `json:"name"`
+}
+
+type exportCodeServerRequest struct {
+	// URL is the signed url the workspace archive is uploaded to with PUT.
+	URL string `json:"url"`
+}
+
+type viewCodeServerRequest struct {
+	// Minutes is the duration of view session, DefaultViewSessionMinutes if zero.
+	Minutes int `json:"minutes,omitempty"`
+}
+
+// PreviewPort is the port inside code server exposed on its own host.
+type PreviewPort struct {
+	Port int32  `json:"port"`
+	URL  string `json:"url"`
+}
+
+// ViewSession is the read-only view session opened for admin, password is asked for by code server and also by
+// basic auth unless admin is authenticated by oauth2 proxy.
+type ViewSession struct {
+	URL       string      `json:"url"`
+	User      string      `json:"user"`
+	Password  string      `json:"password,omitempty"`
+	ExpiresAt metav1.Time `json:"expiresAt"`
+}
+
+// CodeServerAPIServer exposes authenticated endpoints to create, list, stop, clone, export and delete code
+// servers, so that portals don't need kubernetes api access.
+type CodeServerAPIServer struct {
+	client.Client
+	Log        logr.Logger
+	Options    *CodeServerOption
+	tokens     map[string]APIToken
+	certs      *certwatcher.CertWatcher
+	selfSigned *tls.Certificate
+}
+
+func NewCodeServerAPIServer(client client.Client, log logr.Logger, options *CodeServerOption) (*CodeServerAPIServer, error) {
+	tokens, err := loadAPITokens(options.Load().APITokenFile)
+	if err != nil {
+		return nil, err
+	}
+	server := &CodeServerAPIServer{
+		Client:  client,
+		Log:     log,
+		Options: options,
+		tokens:  tokens,
+	}
+	if len(options.Load().APIServerCertDir) != 0 {
+		server.certs, err = certwatcher.New(filepath.Join(options.Load().APIServerCertDir, "tls.crt"),
+			filepath.Join(options.Load().APIServerCertDir, "tls.key"))
+	} else {
+		server.selfSigned, err = selfSignedCertificate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// loadAPITokens reads token file in which every line is in the format of 'token,user,namespace1;namespace2',
+// '*' grants all namespaces. Roles may follow in an optional fourth field, e.g. 'token,user,*,admin'.
+func loadAPITokens(path string) (map[string]APIToken, error) {
+	if len(path) == 0 {
+		return nil, errrorlib.New("api server requires token file")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	tokens := map[string]APIToken{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("invalid token line, expected 'token,user,namespaces[,roles]': %s", line)
+		}
+		token := APIToken{
+			User:       fields[1],
+			Namespaces: strings.Split(fields[2], ";"),
+		}
+		if len(fields) == 4 && len(fields[3]) != 0 {
+			token.Roles = strings.Split(fields[3], ";")
+		}
+		tokens[fields[0]] = token
+	}
+	return tokens, scanner.Err()
+}
+
+// Run serves api over https, bearer tokens are never sent in plain text.
+func (s *CodeServerAPIServer) Run(stopCh <-chan struct{}) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.certs != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			if err := s.certs.Start(ctx); err != nil {
+				s.Log.Error(err, "api server certificate watcher stopped unexpectedly")
+			}
+		}()
+		config.GetCertificate = s.certs.GetCertificate
+	} else {
+		config.Certificates = []tls.Certificate{*s.selfSigned}
+	}
+	ServerTLSOptions(s.Options)(config)
+	server := &http.Server{Addr: s.Options.Load().APIServerAddr, Handler: s, TLSConfig: config}
+	go func() {
+		s.Log.Info(fmt.Sprintf("api server listening on %s", s.Options.Load().APIServerAddr))
+		if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			s.Log.Error(err, "api server stopped unexpectedly")
+		}
+	}()
+	<-stopCh
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+func (s *CodeServerAPIServer) authenticate(req *http.Request) (*APIToken, bool) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, false
+	}
+	token, found := s.tokens[strings.TrimPrefix(auth, "Bearer ")]
+	return &token, found
+}
+
+func (t *APIToken) allowed(namespace string) bool {
+	for _, ns := range t.Namespaces {
+		if ns == AllNamespaces || ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *APIToken) hasRole(role string) bool {
+	return containsString(t.Roles, role)
+}
+
+// owns returns whether the token may manage code server, which is created by or for its user. Admin manages all
+// code servers of its namespaces.
+func (t *APIToken) owns(m *csv1alpha1.CodeServer) bool {
+	return t.hasRole(AdminRole) || (len(t.User) != 0 && m.Annotations[UserAnnotation] == t.User)
+}
+
+// getOwnedCodeServer gets code server and writes the error if it's not found or not owned by the token, code
+// servers of other users are reported as not found so that their names are not disclosed.
+func (s *CodeServerAPIServer) getOwnedCodeServer(w http.ResponseWriter, namespace, name string,
+	token *APIToken) (*csv1alpha1.CodeServer, bool) {
+	codeServer := &csv1alpha1.CodeServer{}
+	if err := s.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, codeServer); err != nil {
+		writeKubeError(w, err)
+		return nil, false
+	}
+	if !token.owns(codeServer) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("code server %s/%s not found", namespace, name))
+		return nil, false
+	}
+	return codeServer, true
+}
+
+// ServeHTTP serves the following endpoints:
+//
+//	GET    /api/v1/namespaces/{namespace}/codeservers
+//	POST   /api/v1/namespaces/{namespace}/codeservers
+//	GET    /api/v1/namespaces/{namespace}/codeservers/{name}
+//	DELETE /api/v1/namespaces/{namespace}/codeservers/{name}
+//	POST   /api/v1/namespaces/{namespace}/codeservers/{name}/stop
+//	POST   /api/v1/namespaces/{namespace}/codeservers/{name}/view (admin only)
+//	POST   /api/v1/namespaces/{namespace}/codeservers/{name}/access (headless only)
+//	PUT    /api/v1/namespaces/{namespace}/codeservers/{name}/ports/{port}
+//	DELETE /api/v1/namespaces/{namespace}/codeservers/{name}/ports/{port}
+//	GET    /api/v1/namespaces/{namespace}/codeservers/{name}/progress (server sent events)
+//	POST   /api/v1/namespaces/{namespace}/prebuilds/{name}/trigger
+//
+// and the JupyterHub spawner hooks under /spawner/v1/. Headless code servers are proxied under /proxy/, where
+// requests are authenticated by access tokens instead.
+func (s *CodeServerAPIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.URL.Path, AccessProxyPrefix) {
+		s.serveAccessProxy(w, req)
+		return
+	}
+	token, ok := s.authenticate(req)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "invalid bearer token")
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, SpawnerPrefix) {
+		s.serveSpawner(w, req, token)
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, APIServerPrefix) {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, APIServerPrefix), "/"), "/")
+	if len(parts) < 2 || (parts[1] != "codeservers" && parts[1] != "prebuilds") {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	namespace := parts[0]
+	if !token.allowed(namespace) {
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("user %s is not allowed to access namespace %s",
+			token.User, namespace))
+		return
+	}
+	switch {
+	case parts[1] == "prebuilds":
+		if len(parts) == 4 && parts[3] == "trigger" && req.Method == http.MethodPost {
+			s.triggerPrebuild(w, namespace, parts[2])
+			return
+		}
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	case len(parts) == 2 && req.Method == http.MethodGet:
+		s.listCodeServers(w, namespace, token)
+	case len(parts) == 2 && req.Method == http.MethodPost:
+		s.createCodeServer(w, req, namespace, token.User)
+	case len(parts) == 3 && req.Method == http.MethodGet:
+		s.getCodeServer(w, namespace, parts[2], token)
+	case len(parts) == 3 && req.Method == http.MethodDelete:
+		s.deleteCodeServer(w, namespace, parts[2], token)
+	case len(parts) == 4 && parts[3] == "stop" && req.Method == http.MethodPost:
+		s.stopCodeServer(w, namespace, parts[2], token)
+	case len(parts) == 4 && parts[3] == "clone" && req.Method == http.MethodPost:
+		s.cloneCodeServer(w, req, namespace, parts[2], token)
+	case len(parts) == 4 && parts[3] == "export" && req.Method == http.MethodPost:
+		s.exportCodeServer(w, req, namespace, parts[2], token)
+	case len(parts) == 4 && parts[3] == "view" && req.Method == http.MethodPost:
+		s.viewCodeServer(w, req, namespace, parts[2], token)
+	case len(parts) == 4 && parts[3] == "access" && req.Method == http.MethodPost:
+		s.accessCodeServer(w, req, namespace, parts[2], token)
+	case len(parts) == 5 && parts[3] == "ports" && (req.Method == http.MethodPut || req.Method == http.MethodDelete):
+		s.exposePort(w, namespace, parts[2], parts[4], req.Method == http.MethodPut, token)
+	case len(parts) == 4 && parts[3] == "progress" && req.Method == http.MethodGet:
+		s.streamProgress(w, req, namespace, parts[2], token)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// listCodeServers lists code servers of namespace owned by the caller, all of them for admin.
+func (s *CodeServerAPIServer) listCodeServers(w http.ResponseWriter, namespace string, token *APIToken) {
+	codeServers := &csv1alpha1.CodeServerList{}
+	if err := s.Client.List(context.TODO(), codeServers, client.InNamespace(namespace)); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	summaries := []CodeServerSummary{}
+	for i := range codeServers.Items {
+		if token.owns(&codeServers.Items[i]) {
+			summaries = append(summaries, summarizeCodeServer(&codeServers.Items[i]))
+		}
+	}
+	writeAPIResponse(w, http.StatusOK, summaries)
+}
+
+func (s *CodeServerAPIServer) getCodeServer(w http.ResponseWriter, namespace, name string, token *APIToken) {
+	codeServer, ok := s.getOwnedCodeServer(w, namespace, name, token)
+	if !ok {
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, summarizeCodeServer(codeServer))
+}
+
+func (s *CodeServerAPIServer) createCodeServer(w http.ResponseWriter, req *http.Request, namespace, user string) {
+	request := createCodeServerRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if len(request.Name) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if len(request.Template) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "template is required")
+		return
+	}
+	if len(request.Archive) != 0 && !archiveURLAllowed(s.Options.Load().ArchiveURLPrefixes, request.Archive) {
+		writeAPIError(w, http.StatusForbidden, "archive url is not allowed by operator")
+		return
+	}
+	template := &csv1alpha1.CodeServerTemplate{}
+	if err := s.Client.Get(context.TODO(), types.NamespacedName{Name: request.Template, Namespace: namespace},
+		template); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	if request.Spec != nil {
+		// overridable fields of request take precedence over template
+		override, err := request.Spec.Spec()
+		if err == nil {
+			override, err = MergeCodeServerSpec(&template.Spec.Template, override)
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid spec: %v", err))
+			return
+		}
+		template.Spec.Template = *override
+	}
+	codeServer := NewCodeServerFromTemplate(template, request.Name, namespace, user)
+	if len(request.Archive) != 0 {
+		codeServer.Spec.Storage = &csv1alpha1.StorageSpec{SourceArchive: request.Archive}
+	}
+	if err := s.Client.Create(context.TODO(), codeServer); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	s.Log.Info(fmt.Sprintf("code server %s/%s has been created by %s", namespace, request.Name, user))
+	writeAPIResponse(w, http.StatusCreated, summarizeCodeServer(codeServer))
+}
+
+// deleteCodeServer deletes code server on behalf of user, who is recorded on instance first so that the deletion
+// is audited with user rather than the service account of api server.
+func (s *CodeServerAPIServer) deleteCodeServer(w http.ResponseWriter, namespace, name string, token *APIToken) {
+	codeServer, ok := s.getOwnedCodeServer(w, namespace, name, token)
+	if !ok {
+		return
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]string{DeletedByAnnotation: token.User}},
+	})
+	if err := s.Client.Patch(context.TODO(), codeServer, client.RawPatch(types.MergePatchType, patch)); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	if err := s.Client.Delete(context.TODO(), codeServer); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stopCodeServer marks code server inactive, resources except volume will be released by reconciler.
+func (s *CodeServerAPIServer) stopCodeServer(w http.ResponseWriter, namespace, name string, token *APIToken) {
+	codeServer, ok := s.getOwnedCodeServer(w, namespace, name, token)
+	if !ok {
+		return
+	}
+	if !HasCondition(codeServer.Status, csv1alpha1.ServerInactive) && !HasCondition(codeServer.Status, csv1alpha1.ServerRecycled) {
+		clearPendingRecycle(codeServer, "code server has been stopped via api")
+		SetCondition(&codeServer.Status, NewStateCondition(csv1alpha1.ServerInactive,
+			"code server has been stopped via api", map[string]string{}, corev1.ConditionTrue))
+		if err := s.Client.Update(context.TODO(), codeServer); err != nil {
+			writeKubeError(w, err)
+			return
+		}
+	}
+	writeAPIResponse(w, http.StatusOK, summarizeCodeServer(codeServer))
+}
+
+// cloneCodeServer creates a clone of code server owned by the caller (any one for admin) with a copy of its workspace,
+// the clone is owned by the caller.
+func (s *CodeServerAPIServer) cloneCodeServer(w http.ResponseWriter, req *http.Request, namespace, name string,
+	token *APIToken) {
+	request := cloneCodeServerRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if len(request.Name) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	source, ok := s.getOwnedCodeServer(w, namespace, name, token)
+	if !ok {
+		return
+	}
+	clone, err := CloneCodeServer(s.Client, source, request.Name, token.User)
+	if errrorlib.Is(err, errNoCloneSource) {
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	s.Log.Info(fmt.Sprintf("code server %s/%s has been cloned to %s by %s", namespace, name, request.Name,
+		token.User))
+	writeAPIResponse(w, http.StatusCreated, summarizeCodeServer(clone))
+}
+
+// exportCodeServer requests an export of workspace owned by the caller, which is uploaded by reconciler to the url in
+// request.
+func (s *CodeServerAPIServer) exportCodeServer(w http.ResponseWriter, req *http.Request, namespace, name string,
+	token *APIToken) {
+	request := exportCodeServerRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if len(request.URL) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "url is required")
+		return
+	}
+	if !archiveURLAllowed(s.Options.Load().ArchiveURLPrefixes, request.URL) {
+		writeAPIError(w, http.StatusForbidden, "url is not allowed by operator")
+		return
+	}
+	codeServer, ok := s.getOwnedCodeServer(w, namespace, name, token)
+	if !ok {
+		return
+	}
+	if _, found := codeServer.Annotations[ExportAnnotation]; found {
+		writeAPIError(w, http.StatusConflict, "export is already in progress")
+		return
+	}
+	if codeServer.Annotations == nil {
+		codeServer.Annotations = map[string]string{}
+	}
+	codeServer.Annotations[ExportAnnotation] = request.URL
+	if err := s.Client.Update(context.TODO(), codeServer); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusAccepted, summarizeCodeServer(codeServer))
+}
+
+// viewCodeServer opens a read-only view session into code server for admin, the session is served by reconciler
+// with its own credentials so that admin never needs the credentials of user. Opening again rotates password and
+// extends the session.
+func (s *CodeServerAPIServer) viewCodeServer(w http.ResponseWriter, req *http.Request, namespace, name string,
+	token *APIToken) {
+	if !token.hasRole(AdminRole) {
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("user %s is not allowed to open view sessions",
+			token.User))
+		return
+	}
+	request := viewCodeServerRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil && err != io.EOF {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if request.Minutes == 0 {
+		request.Minutes = DefaultViewSessionMinutes
+	}
+	if request.Minutes < 0 || request.Minutes > MaxViewSessionMinutes {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("minutes must be between 1 and %d",
+			MaxViewSessionMinutes))
+		return
+	}
+	codeServer := &csv1alpha1.CodeServer{}
+	if err := s.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, codeServer); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	secret, err := viewSessionCredentials(s.Client, codeServer, token.User, true)
+	if err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	expires := metav1.NewTime(time.Now().Add(time.Duration(request.Minutes) * time.Minute).UTC().Truncate(time.Second))
+	if codeServer.Annotations == nil {
+		codeServer.Annotations = map[string]string{}
+	}
+	codeServer.Annotations[ViewSessionAnnotation] = token.User
+	codeServer.Annotations[ViewSessionExpiresAnnotation] = expires.Format(time.RFC3339)
+	if err := s.Client.Update(context.TODO(), codeServer); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	s.Log.Info(fmt.Sprintf("view session into code server %s/%s has been opened by %s until %s", namespace, name,
+		token.User, expires.Format(time.RFC3339)))
+	session := ViewSession{
+		URL:       fmt.Sprintf("https://%s/", shareHost(codeServer, viewSessionAccess, s.Options.Load().DomainName)),
+		User:      token.User,
+		Password:  string(secret.Data["password"]),
+		ExpiresAt: expires,
+	}
+	writeAPIResponse(w, http.StatusOK, session)
+}
+
+// exposePort adds port to or removes it from the preview ports of code server owned by the caller, the ingress is
+// updated by reconciler.
+func (s *CodeServerAPIServer) exposePort(w http.ResponseWriter, namespace, name, value string, expose bool,
+	token *APIToken) {
+	port, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || port <= 0 || port > 65535 || port == HttpPort || port == ExporterPort {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid port %s", value))
+		return
+	}
+	if expose && len(s.Options.Load().OAuth2ProxyURL) == 0 {
+		writeAPIError(w, http.StatusForbidden, "preview ports require oauth2 proxy")
+		return
+	}
+	codeServer, ok := s.getOwnedCodeServer(w, namespace, name, token)
+	if !ok {
+		return
+	}
+	var ports []int32
+	for _, existing := range previewPorts(codeServer) {
+		if existing != int32(port) {
+			ports = append(ports, existing)
+		}
+	}
+	if expose {
+		ports = append(ports, int32(port))
+	}
+	if codeServer.Annotations == nil {
+		codeServer.Annotations = map[string]string{}
+	}
+	if len(ports) == 0 {
+		delete(codeServer.Annotations, PreviewPortsAnnotation)
+	} else {
+		codeServer.Annotations[PreviewPortsAnnotation] = formatPreviewPorts(ports)
+	}
+	if err := s.Client.Update(context.TODO(), codeServer); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	if !expose {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, PreviewPort{
+		Port: int32(port),
+		URL:  fmt.Sprintf("https://%s/", previewHost(codeServer, int32(port), s.Options.Load().DomainName)),
+	})
+}
+
+// triggerPrebuild requests prebuild of all branches, it's used as the push webhook of repository.
+func (s *CodeServerAPIServer) triggerPrebuild(w http.ResponseWriter, namespace, name string) {
+	prebuild := &csv1alpha1.CodeServerPrebuild{}
+	if err := s.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, prebuild); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	if prebuild.Annotations == nil {
+		prebuild.Annotations = map[string]string{}
+	}
+	prebuild.Annotations[PrebuildRequestedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	if err := s.Client.Update(context.TODO(), prebuild); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	s.Log.Info(fmt.Sprintf("prebuild %s/%s has been triggered via api", namespace, name))
+	writeAPIResponse(w, http.StatusAccepted, prebuild.Status)
+}
+
+func summarizeCodeServer(m *csv1alpha1.CodeServer) CodeServerSummary {
+	summary := CodeServerSummary{
+		Name:      m.Name,
+		Namespace: m.Namespace,
+		User:      m.Annotations[UserAnnotation],
+		Runtime:   string(m.Spec.Runtime),
+		Image:     m.Spec.Image,
+		Phase:     CodeServerPhase(m),
+		Progress:  m.Status.Progress,
+		CreatedAt: m.CreationTimestamp,
+	}
+	if ready := GetCondition(m.Status, csv1alpha1.ServerReady); ready != nil && ready.Status == corev1.ConditionTrue {
+		summary.Endpoint = ready.Message[InstanceEndpoint]
+	}
+	return summary
+}
+
+// CodeServerPhase derives a single phase from conditions of code server
+func CodeServerPhase(m *csv1alpha1.CodeServer) string {
+	switch {
+	case HasCondition(m.Status, csv1alpha1.ServerRecycled):
+		return PhaseRecycled
+	case HasCondition(m.Status, csv1alpha1.ServerInactive):
+		return PhaseInactive
+	case HasCondition(m.Status, csv1alpha1.ServerErrored):
+		return PhaseErrored
+	case HasCondition(m.Status, csv1alpha1.ServerPendingRecycle):
+		return PhasePendingRecycle
+	case HasCondition(m.Status, csv1alpha1.ServerReady):
+		return PhaseReady
+	default:
+		return PhasePending
+	}
+}
+
+func writeAPIResponse(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func writeAPIError(w http.ResponseWriter, code int, message string) {
+	writeAPIResponse(w, code, map[string]string{"error": message})
+}
+
+func writeKubeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.IsNotFound(err):
+		writeAPIError(w, http.StatusNotFound, err.Error())
+	case errors.IsAlreadyExists(err), errors.IsConflict(err):
+		writeAPIError(w, http.StatusConflict, err.Error())
+	case errors.IsInvalid(err):
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+	case errors.IsForbidden(err):
+		writeAPIError(w, http.StatusForbidden, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+	}
+}
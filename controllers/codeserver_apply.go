@@ -0,0 +1,114 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	appsv1ac "k8s.io/client-go/applyconfigurations/apps/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	extv1ac "k8s.io/client-go/applyconfigurations/extensions/v1beta1"
+	networkingv1ac "k8s.io/client-go/applyconfigurations/networking/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// FieldManager is the field manager of resources applied by operator
+const FieldManager = "code-server-operator"
+
+// applyConfiguration converts desired resource into its apply configuration, whose fields are all optional, so that
+// only the fields operator sets are applied. Zero values of typed structs, e.g. creation timestamp of pod template
+// and status, are left to their owners rather than applied.
+func applyConfiguration(desired client.Object) (*unstructured.Unstructured, error) {
+	var configuration interface{}
+	switch desired.(type) {
+	case *appsv1.Deployment:
+		configuration = &appsv1ac.DeploymentApplyConfiguration{}
+	case *corev1.Service:
+		configuration = &corev1ac.ServiceApplyConfiguration{}
+	case *corev1.Secret:
+		configuration = &corev1ac.SecretApplyConfiguration{}
+	case *extv1.Ingress:
+		configuration = &extv1ac.IngressApplyConfiguration{}
+	case *networkingv1.NetworkPolicy:
+		configuration = &networkingv1ac.NetworkPolicyApplyConfiguration{}
+	default:
+		return nil, fmt.Errorf("no apply configuration for %T", desired)
+	}
+	data, err := json.Marshal(desired)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, configuration); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(configuration); err != nil {
+		return nil, err
+	}
+	object := &unstructured.Unstructured{}
+	if err := object.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	// status is never owned by operator
+	unstructured.RemoveNestedField(object.Object, "status")
+	return object, nil
+}
+
+// applyResource applies the desired resource of code server with server-side apply, desired is updated with the
+// applied resource. Only the fields set in desired are owned by operator, fields set by other controllers, e.g.
+// annotations added by admission webhooks, are kept, and conflicting fields are taken over.
+func (r *CodeServerReconciler) applyResource(codeServer *csv1alpha1.CodeServer, desired, live client.Object,
+	found bool) error {
+	gvk, err := apiutil.GVKForObject(desired, r.Scheme)
+	if err != nil {
+		return err
+	}
+	desired.GetObjectKind().SetGroupVersionKind(gvk)
+	if err := controllerutil.SetControllerReference(codeServer, desired, r.Scheme); err != nil {
+		return err
+	}
+	r.addCostLabels(codeServer, desired)
+	desired.SetResourceVersion("")
+	desired.SetManagedFields(nil)
+	configuration, err := applyConfiguration(desired)
+	if err != nil {
+		return err
+	}
+	if err := r.Client.Patch(context.TODO(), configuration, client.Apply, client.FieldOwner(FieldManager),
+		client.ForceOwnership); err != nil {
+		return err
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(configuration.Object, desired); err != nil {
+		return err
+	}
+	if !found {
+		r.recordCreated(codeServer, desired)
+	} else if desired.GetResourceVersion() != live.GetResourceVersion() {
+		r.recordUpdated(codeServer, desired)
+	}
+	return nil
+}
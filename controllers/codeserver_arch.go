@@ -0,0 +1,279 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	errrorlib "errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	DockerHubRegistry  = "registry-1.docker.io"
+	ArchCacheSeconds   = 600
+	MediaTypeDockerV2  = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerSet = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCI       = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex  = "application/vnd.oci.image.index.v1+json"
+)
+
+type archCacheEntry struct {
+	archs     []string
+	expiredAt time.Time
+}
+
+// imageArchitectures caches architectures of images to avoid querying registry on every reconcile
+var imageArchitectures = struct {
+	sync.Mutex
+	entries map[string]archCacheEntry
+}{entries: map[string]archCacheEntry{}}
+
+// nodeSelectorForPod merges architecture into node selector specified in code server, pinned node is required by
+// node affinity instead, see pinPodToNode.
+func nodeSelectorForPod(m *csv1alpha1.CodeServer) map[string]string {
+	if len(m.Spec.Arch) == 0 {
+		return m.Spec.NodeSelector
+	}
+	selector := map[string]string{}
+	for key, value := range m.Spec.NodeSelector {
+		selector[key] = value
+	}
+	selector[corev1.LabelArchStable] = string(m.Spec.Arch)
+	return selector
+}
+
+// validateArch checks whether the image manifest contains the architecture specified, the check will be
+// skipped if registry is unreachable or requires credentials.
+func (r *CodeServerReconciler) validateArch(m *csv1alpha1.CodeServer) error {
+	if len(m.Spec.Arch) == 0 || r.Options.Load().SkipArchCheck || len(m.Spec.Image) == 0 ||
+		strings.EqualFold(string(m.Spec.Runtime), string(csv1alpha1.RuntimeLxd)) {
+		return nil
+	}
+	reqLogger := r.instanceLog(m)
+	archs, err := getImageArchitectures(mirrorImage(m.Spec.Image, r.Options.Load().RegistryMirrors))
+	if err != nil {
+		reqLogger.Info(fmt.Sprintf("skip checking architecture of image %s: %v", m.Spec.Image, err))
+		return nil
+	}
+	for _, arch := range archs {
+		if arch == string(m.Spec.Arch) {
+			return nil
+		}
+	}
+	return errrorlib.New(fmt.Sprintf("image %s doesn't contain architecture %s, available architectures: %s",
+		m.Spec.Image, m.Spec.Arch, strings.Join(archs, ",")))
+}
+
+func getImageArchitectures(image string) ([]string, error) {
+	imageArchitectures.Lock()
+	entry, found := imageArchitectures.entries[image]
+	imageArchitectures.Unlock()
+	if found && time.Now().Before(entry.expiredAt) {
+		return entry.archs, nil
+	}
+	registry, repository, reference := parseImageReference(image)
+	client := &registryClient{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		registry:   registry,
+		repository: repository,
+	}
+	archs, err := client.architectures(reference)
+	if err != nil {
+		return nil, err
+	}
+	imageArchitectures.Lock()
+	imageArchitectures.entries[image] = archCacheEntry{
+		archs:     archs,
+		expiredAt: time.Now().Add(ArchCacheSeconds * time.Second),
+	}
+	imageArchitectures.Unlock()
+	return archs, nil
+}
+
+// parseImageReference splits image into registry, repository and tag or digest.
+func parseImageReference(image string) (string, string, string) {
+	name, reference := image, "latest"
+	if index := strings.Index(image, "@"); index >= 0 {
+		name, reference = image[:index], image[index+1:]
+	} else if index := strings.LastIndex(image, ":"); index > strings.LastIndex(image, "/") {
+		name, reference = image[:index], image[index+1:]
+	}
+	registry := DockerHubRegistry
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry, name = parts[0], parts[1]
+	}
+	if registry == "docker.io" || registry == "index.docker.io" {
+		registry = DockerHubRegistry
+	}
+	if registry == DockerHubRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return registry, name, reference
+}
+
+type registryClient struct {
+	client     *http.Client
+	registry   string
+	repository string
+	token      string
+}
+
+type manifestPlatform struct {
+	Architecture string `json:"architecture"`
+}
+
+type imageManifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string           `json:"digest"`
+		Platform manifestPlatform `json:"platform"`
+	} `json:"manifests"`
+}
+
+// architectures issues HEAD request to detect manifest type first, manifest list or config blob will be fetched
+// to collect the architectures.
+func (c *registryClient) architectures(reference string) ([]string, error) {
+	accept := strings.Join([]string{MediaTypeDockerSet, MediaTypeOCIIndex, MediaTypeDockerV2, MediaTypeOCI}, ",")
+	resp, err := c.do(http.MethodHead, fmt.Sprintf("manifests/%s", reference), accept)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	mediaType := strings.Split(resp.Header.Get("Content-Type"), ";")[0]
+	if mediaType != MediaTypeDockerSet && mediaType != MediaTypeOCIIndex && mediaType != MediaTypeDockerV2 &&
+		mediaType != MediaTypeOCI {
+		return nil, fmt.Errorf("unsupported manifest media type %s", mediaType)
+	}
+	manifest := imageManifest{}
+	if err := c.getJSON(fmt.Sprintf("manifests/%s", reference), accept, &manifest); err != nil {
+		return nil, err
+	}
+	var archs []string
+	if mediaType == MediaTypeDockerSet || mediaType == MediaTypeOCIIndex {
+		for _, m := range manifest.Manifests {
+			if len(m.Platform.Architecture) != 0 && m.Platform.Architecture != "unknown" {
+				archs = append(archs, m.Platform.Architecture)
+			}
+		}
+		return archs, nil
+	}
+	config := manifestPlatform{}
+	if err := c.getJSON(fmt.Sprintf("blobs/%s", manifest.Config.Digest), "*/*", &config); err != nil {
+		return nil, err
+	}
+	return []string{config.Architecture}, nil
+}
+
+func (c *registryClient) getJSON(path, accept string, obj interface{}) error {
+	resp, err := c.do(http.MethodGet, path, accept)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(obj)
+}
+
+// do sends request to registry, anonymous bearer token will be requested if registry challenges.
+func (c *registryClient) do(method, path, accept string) (*http.Response, error) {
+	endpoint := fmt.Sprintf("https://%s/v2/%s/%s", c.registry, c.repository, path)
+	for retry := 0; retry < 2; retry++ {
+		req, err := http.NewRequest(method, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", accept)
+		if len(c.token) != 0 {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && len(c.token) == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if err := c.requestToken(challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("registry %s responded %d for %s", c.registry, resp.StatusCode, path)
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("registry %s requires credentials", c.registry)
+}
+
+func (c *registryClient) requestToken(challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("unsupported registry auth challenge %s", challenge)
+	}
+	params := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], "\"")
+		}
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || len(params["realm"]) == 0 {
+		return fmt.Errorf("invalid registry auth realm in challenge %s", challenge)
+	}
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", c.repository))
+	realm.RawQuery = query.Encode()
+	resp, err := c.client.Get(realm.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to request registry token, status code %d", resp.StatusCode)
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	c.token = token.Token
+	if len(c.token) == 0 {
+		c.token = token.AccessToken
+	}
+	if len(c.token) == 0 {
+		return errrorlib.New("registry returned empty token")
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/url"
+	"path"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// ExportAnnotation requests an export of the workspace as a tar.gz archive, the value is the (signed) url the
+	// archive is uploaded to with PUT.
+	ExportAnnotation = "codeserver.io/export"
+	// LastExportAnnotation records the result of the last export, either ExportSucceeded or ExportFailed.
+	LastExportAnnotation = "codeserver.io/last-export"
+	// ArchiveImportedAnnotation records when the workspace volume has been populated from source archive.
+	ArchiveImportedAnnotation = "codeserver.io/archive-imported"
+	ExportResource            = "%s-export"
+	ImportResource            = "%s-import"
+	ArchiveMountPath          = "/workspace"
+	ArchiveBackoffLimit       = 3
+	ExportSucceeded           = "Succeeded"
+	ExportFailed              = "Failed"
+	// ArchiveUser is the user archive jobs run as if instance is not rootless, which is the user of code server image.
+	ArchiveUser = DefaultRootlessUID
+	// exportScript archives into a temporary file rather than streaming, since signed urls of object stores
+	// require the content length.
+	exportScript = `tar czf /tmp/workspace.tar.gz -C /workspace . && ` +
+		`curl -fsS -X PUT -H 'Content-Type: application/gzip' --upload-file /tmp/workspace.tar.gz "$ARCHIVE_URL"`
+	// importScript extracts as the user of workspace, ownership and permissions recorded in archive are ignored.
+	importScript = `curl -fsSL "$ARCHIVE_URL" | tar xzf - --no-same-owner --no-same-permissions -C /workspace`
+	// prepareImportScript hands over the root of workspace volume to the user extracting archive.
+	prepareImportScript = `chown "$WORKSPACE_OWNER" /workspace`
+)
+
+// archiveURLAllowed returns whether url of archive is under one of the allowed urls of operator, scheme and host
+// have to match exactly.
+func archiveURLAllowed(prefixes []string, rawURL string) bool {
+	archive, err := url.Parse(rawURL)
+	if err != nil || (archive.Scheme != "https" && archive.Scheme != "http") || archive.User != nil {
+		return false
+	}
+	archivePath := path.Clean("/" + archive.Path)
+	for _, prefix := range prefixes {
+		allowed, err := url.Parse(prefix)
+		if err != nil || !strings.EqualFold(allowed.Scheme, archive.Scheme) || !strings.EqualFold(allowed.Host,
+			archive.Host) {
+			continue
+		}
+		allowedPath := path.Clean("/" + allowed.Path)
+		if archivePath == allowedPath || strings.HasPrefix(archivePath, strings.TrimSuffix(allowedPath, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveUser returns uid and gid which workspace files are owned by.
+func archiveUser(m *csv1alpha1.CodeServer) (int64, int64) {
+	if rootlessEnabled(m) {
+		return rootlessUser(m)
+	}
+	return ArchiveUser, ArchiveUser
+}
+
+// reconcileForExport exports the workspace volume via a job if requested by annotation, the annotation is removed
+// once the job finished. It returns true while export is in progress.
+func (r *CodeServerReconciler) reconcileForExport(codeServer *csv1alpha1.CodeServer) (bool, error) {
+	url, found := codeServer.Annotations[ExportAnnotation]
+	if !found {
+		return false, nil
+	}
+	reqLogger := r.instanceLog(codeServer)
+	name := ChildName(ExportResource, codeServer.Name)
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: codeServer.Name, Namespace: codeServer.Namespace}, pvc)
+	if err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+	if len(url) == 0 || errors.IsNotFound(err) {
+		r.Recorder.Event(codeServer, corev1.EventTypeWarning, EventExportFailed,
+			"Export requires both the url in annotation and the workspace volume")
+		return false, r.finishExport(codeServer, name, ExportFailed)
+	}
+	if !archiveURLAllowed(r.Options.Load().ArchiveURLPrefixes, url) {
+		r.Recorder.Event(codeServer, corev1.EventTypeWarning, EventExportFailed,
+			"Export url is not allowed by operator")
+		return false, r.finishExport(codeServer, name, ExportFailed)
+	}
+	job := &batchv1.Job{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, job)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating job to export workspace.")
+		// volume may only be attached to the node of running instance
+		node := codeServer.Annotations[PinnedNodeAnnotation]
+		if pod, err := r.latestPod(codeServer); err == nil && pod != nil && len(pod.Spec.NodeName) != 0 {
+			node = pod.Spec.NodeName
+		}
+		newJob := r.newArchiveJob(codeServer, name, exportScript, url, true, node)
+		if err = r.Client.Create(context.TODO(), newJob); err != nil {
+			return false, err
+		}
+		r.recordCreated(codeServer, newJob)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if job.Status.Succeeded > 0 {
+		reqLogger.Info("workspace has been exported")
+		r.Recorder.Event(codeServer, corev1.EventTypeNormal, EventExported, "Workspace has been exported")
+		return false, r.finishExport(codeServer, name, ExportSucceeded)
+	}
+	if job.Status.Failed > ArchiveBackoffLimit {
+		r.Recorder.Eventf(codeServer, corev1.EventTypeWarning, EventExportFailed,
+			"Job %s failed to export workspace", name)
+		return false, r.finishExport(codeServer, name, ExportFailed)
+	}
+	return true, nil
+}
+
+// finishExport removes the export job and annotation and records the result, url is not kept on instance after
+// export.
+func (r *CodeServerReconciler) finishExport(codeServer *csv1alpha1.CodeServer, name, result string) error {
+	if err := r.deleteJob(name, codeServer.Namespace); err != nil {
+		return err
+	}
+	delete(codeServer.Annotations, ExportAnnotation)
+	codeServer.Annotations[LastExportAnnotation] = result
+	return r.Client.Update(context.TODO(), codeServer)
+}
+
+// reconcileForArchiveImport populates the new workspace volume from source archive via a job before instance
+// starts, it returns true once volume is populated.
+func (r *CodeServerReconciler) reconcileForArchiveImport(codeServer *csv1alpha1.CodeServer) (bool, error) {
+	if codeServer.Spec.Storage == nil || len(codeServer.Spec.Storage.SourceArchive) == 0 ||
+		!r.needDeployPVC(codeServer.Spec.StorageName) {
+		return true, nil
+	}
+	if !archiveURLAllowed(r.Options.Load().ArchiveURLPrefixes, codeServer.Spec.Storage.SourceArchive) {
+		return false, fmt.Errorf("source archive url is not allowed by operator")
+	}
+	name := ChildName(ImportResource, codeServer.Name)
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: codeServer.Name, Namespace: codeServer.Namespace}, pvc)
+	if err != nil {
+		return false, err
+	}
+	if len(pvc.Annotations[ArchiveImportedAnnotation]) != 0 {
+		return true, r.deleteJob(name, codeServer.Namespace)
+	}
+	job := &batchv1.Job{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, job)
+	if err != nil && errors.IsNotFound(err) {
+		r.instanceLog(codeServer).Info("Creating job to import workspace archive.")
+		newJob := r.newArchiveJob(codeServer, name, importScript, codeServer.Spec.Storage.SourceArchive, false,
+			codeServer.Annotations[PinnedNodeAnnotation])
+		if err = r.Client.Create(context.TODO(), newJob); err != nil {
+			return false, err
+		}
+		r.recordCreated(codeServer, newJob)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if job.Status.Succeeded > 0 {
+		if pvc.Annotations == nil {
+			pvc.Annotations = map[string]string{}
+		}
+		pvc.Annotations[ArchiveImportedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		if err := r.Client.Update(context.TODO(), pvc); err != nil {
+			return false, err
+		}
+		r.instanceLog(codeServer).Info("workspace archive has been imported")
+		return true, r.deleteJob(name, codeServer.Namespace)
+	}
+	if job.Status.Failed > ArchiveBackoffLimit {
+		return false, fmt.Errorf("job %s failed to import workspace archive", name)
+	}
+	return false, nil
+}
+
+// newArchiveJob returns the job which transfers workspace archive from or to url, url is passed by environment so
+// that it doesn't show up in the command line. Job is pinned to node if not empty.
+func (r *CodeServerReconciler) newArchiveJob(m *csv1alpha1.CodeServer, name, script, url string, readOnly bool,
+	node string) *batchv1.Job {
+	backoffLimit := int32(ArchiveBackoffLimit)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: m.Namespace,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyOnFailure,
+					NodeSelector:  nodeSelectorForPod(m),
+					Containers: []corev1.Container{
+						{
+							Name:    "archive",
+							Image:   r.Options.Load().ArchiveImage,
+							Command: []string{"sh", "-c", script},
+							Env: []corev1.EnvVar{
+								{
+									Name:  "ARCHIVE_URL",
+									Value: url,
+								},
+							},
+							SecurityContext: archiveSecurityContext(m, readOnly),
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "workspace",
+									MountPath: ArchiveMountPath,
+									ReadOnly:  readOnly,
+								},
+								{
+									Name:      "tmp",
+									MountPath: "/tmp",
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "workspace",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: m.Name,
+									ReadOnly:  readOnly,
+								},
+							},
+						},
+						{
+							Name: "tmp",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if !readOnly {
+		uid, gid := archiveUser(m)
+		prepare := *job.Spec.Template.Spec.Containers[0].DeepCopy()
+		prepare.Name = "prepare"
+		prepare.Command = []string{"sh", "-c", prepareImportScript}
+		prepare.Env = []corev1.EnvVar{
+			{
+				Name:  "WORKSPACE_OWNER",
+				Value: fmt.Sprintf("%d:%d", uid, gid),
+			},
+		}
+		rootUser := int64(0)
+		prepare.SecurityContext = &corev1.SecurityContext{
+			RunAsUser: &rootUser,
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+				Add:  []corev1.Capability{"CHOWN"},
+			},
+		}
+		job.Spec.Template.Spec.InitContainers = []corev1.Container{prepare}
+	}
+	pinPodToNode(&job.Spec.Template.Spec, node)
+	addRegistryMirrorsForPod(&job.Spec.Template.Spec, r.Options.Load().RegistryMirrors)
+	r.addCostLabels(m, job)
+	// Set CodeServer instance as the owner of the job.
+	controllerutil.SetControllerReference(m, job, r.Scheme)
+	return job
+}
+
+// archiveSecurityContext returns the security context of archive container. Export only reads files of every owner,
+// while import runs as the user of workspace without any capability, so that archives can't plant files owned by
+// others, e.g. setuid binaries.
+func archiveSecurityContext(m *csv1alpha1.CodeServer, export bool) *corev1.SecurityContext {
+	if export {
+		rootUser := int64(0)
+		return &corev1.SecurityContext{
+			RunAsUser: &rootUser,
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+				Add:  []corev1.Capability{"DAC_READ_SEARCH"},
+			},
+		}
+	}
+	uid, gid := archiveUser(m)
+	runAsNonRoot := true
+	allowPrivilegeEscalation := false
+	return &corev1.SecurityContext{
+		RunAsUser:                &uid,
+		RunAsGroup:               &gid,
+		RunAsNonRoot:             &runAsNonRoot,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	UserAnnotation = "codeserver.io/user"
+	// DeletedByAnnotation records the user on whose behalf a service account, e.g. api server, deletes instance.
+	DeletedByAnnotation = "codeserver.io/deleted-by"
+	AuditBufferSize     = 100
+	AuditSource         = "code-server-operator"
+)
+
+// AuditEvent describes the lifecycle transition of code server
+type AuditEvent string
+
+const (
+	AuditCreated  AuditEvent = "Created"
+	AuditReady    AuditEvent = "Ready"
+	AuditInactive AuditEvent = "Inactive"
+	AuditRecycled AuditEvent = "Recycled"
+	AuditDeleted  AuditEvent = "Deleted"
+	// AuditViewSessionStarted and AuditViewSessionEnded record read-only view sessions of support.
+	AuditViewSessionStarted AuditEvent = "ViewSessionStarted"
+	AuditViewSessionEnded   AuditEvent = "ViewSessionEnded"
+)
+
+// AuditSinkType describes where the audit records are shipped
+type AuditSinkType string
+
+const (
+	AuditSinkWebhook     AuditSinkType = "webhook"
+	AuditSinkCloudEvents AuditSinkType = "cloudevents"
+	AuditSinkKafka       AuditSinkType = "kafka"
+)
+
+// AuditRecord is a single lifecycle transition of code server
+type AuditRecord struct {
+	Event     AuditEvent `json:"event"`
+	Namespace string     `json:"namespace"`
+	Name      string     `json:"name"`
+	User      string     `json:"user,omitempty"`
+	// Actor is the identity which requested the transition, e.g. the user deleting instance, empty if it's the
+	// operator itself.
+	Actor     string    `json:"actor,omitempty"`
+	Runtime   string    `json:"runtime,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// AuditSink ships audit records to external system
+type AuditSink interface {
+	Send(record AuditRecord) error
+}
+
+// Auditor records lifecycle transitions and ships them asynchronously to the configured sink
+type Auditor struct {
+	Log      logr.Logger
+	sink     AuditSink
+	recordCh chan AuditRecord
+}
+
+// NewAuditor creates auditor according to options, nil will be returned if audit sink is not configured.
+func NewAuditor(log logr.Logger, options *CodeServerOption) (*Auditor, error) {
+	if len(options.Load().AuditSinkURL) == 0 {
+		return nil, nil
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	var sink AuditSink
+	switch AuditSinkType(strings.ToLower(options.Load().AuditSinkType)) {
+	case AuditSinkWebhook, "":
+		sink = &webhookAuditSink{client: client, url: options.Load().AuditSinkURL}
+	case AuditSinkCloudEvents:
+		sink = &cloudEventsAuditSink{client: client, url: options.Load().AuditSinkURL}
+	case AuditSinkKafka:
+		if len(options.Load().AuditKafkaTopic) == 0 {
+			return nil, fmt.Errorf("kafka topic is required for kafka audit sink")
+		}
+		sink = &kafkaAuditSink{client: client, url: options.Load().AuditSinkURL, topic: options.Load().AuditKafkaTopic}
+	default:
+		return nil, fmt.Errorf("unsupported audit sink type %s", options.Load().AuditSinkType)
+	}
+	return &Auditor{
+		Log:      log,
+		sink:     sink,
+		recordCh: make(chan AuditRecord, AuditBufferSize),
+	}, nil
+}
+
+// Record enqueues lifecycle transition of code server, it's safe to call on nil auditor.
+func (a *Auditor) Record(m *csv1alpha1.CodeServer, event AuditEvent, message string) {
+	a.RecordBy(m, event, message, "")
+}
+
+// RecordBy enqueues lifecycle transition of code server requested by actor, it's safe to call on nil auditor.
+func (a *Auditor) RecordBy(m *csv1alpha1.CodeServer, event AuditEvent, message, actor string) {
+	if a == nil {
+		return
+	}
+	record := AuditRecord{
+		Event:     event,
+		Namespace: m.Namespace,
+		Name:      m.Name,
+		User:      m.Annotations[UserAnnotation],
+		Actor:     actor,
+		Runtime:   string(m.Spec.Runtime),
+		Message:   message,
+		Timestamp: time.Now().UTC(),
+	}
+	select {
+	case a.recordCh <- record:
+	default:
+		a.Log.Info(fmt.Sprintf("audit buffer is full, record %s for %s/%s dropped", event, m.Namespace, m.Name))
+	}
+}
+
+// Run ships audit records until stop channel closed, records queued by then are still shipped.
+func (a *Auditor) Run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case record := <-a.recordCh:
+			a.ship(record)
+		case <-stopCh:
+			for {
+				select {
+				case record := <-a.recordCh:
+					a.ship(record)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *Auditor) ship(record AuditRecord) {
+	var err error
+	for retry := 0; retry < 3; retry++ {
+		if err = a.sink.Send(record); err == nil {
+			break
+		}
+		time.Sleep(time.Duration(retry+1) * time.Second)
+	}
+	if err != nil {
+		a.Log.Error(err, fmt.Sprintf("failed to ship audit record %s for %s/%s", record.Event,
+			record.Namespace, record.Name))
+	}
+}
+
+func postJSON(client *http.Client, url, contentType string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, url)
+	}
+	return nil
+}
+
+type webhookAuditSink struct {
+	client *http.Client
+	url    string
+}
+
+func (s *webhookAuditSink) Send(record AuditRecord) error {
+	return postJSON(s.client, s.url, "application/json", record)
+}
+
+// cloudEventsAuditSink sends records in cloud events structured content mode.
+type cloudEventsAuditSink struct {
+	client *http.Client
+	url    string
+}
+
+func (s *cloudEventsAuditSink) Send(record AuditRecord) error {
+	event := map[string]interface{}{
+		"specversion":     "1.0",
+		"id":              string(uuid.NewUUID()),
+		"source":          AuditSource,
+		"type":            fmt.Sprintf("%s.codeserver.%s", csv1alpha1.GroupVersion.Group, strings.ToLower(string(record.Event))),
+		"subject":         fmt.Sprintf("%s/%s", record.Namespace, record.Name),
+		"time":            record.Timestamp.Format(time.RFC3339),
+		"datacontenttype": "application/json",
+		"data":            record,
+	}
+	return postJSON(s.client, s.url, "application/cloudevents+json", event)
+}
+
+// kafkaAuditSink produces records to kafka topic via kafka rest proxy.
+type kafkaAuditSink struct {
+	client *http.Client
+	url    string
+	topic  string
+}
+
+func (s *kafkaAuditSink) Send(record AuditRecord) error {
+	payload := map[string]interface{}{
+		"records": []map[string]interface{}{
+			{
+				"key":   fmt.Sprintf("%s/%s", record.Namespace, record.Name),
+				"value": record,
+			},
+		},
+	}
+	return postJSON(s.client, fmt.Sprintf("%s/topics/%s", strings.TrimRight(s.url, "/"), s.topic),
+		"application/vnd.kafka.json.v2+json", payload)
+}
+
+// DeletionAuditWebhookPath is the path of validating webhook which records who deleted instances.
+const DeletionAuditWebhookPath = "/validate-cs-opensourceways-com-v1alpha1-codeserver-deletion"
+
+// +kubebuilder:webhook:path=/validate-cs-opensourceways-com-v1alpha1-codeserver-deletion,mutating=false,failurePolicy=ignore,sideEffects=None,groups=cs.opensourceways.com,resources=codeservers,verbs=delete,versions=v1alpha1,name=vcodeserverdeletion.kb.io,admissionReviewVersions=v1
+
+// CodeServerDeletionAuditor records the deletion of instances together with the identity of request, which the
+// reconciler never learns since instance is gone by the time it's reconciled. Deletions are always allowed.
+type CodeServerDeletionAuditor struct {
+	Log     logr.Logger
+	Auditor *Auditor
+}
+
+func NewCodeServerDeletionAuditor(log logr.Logger, auditor *Auditor) *CodeServerDeletionAuditor {
+	return &CodeServerDeletionAuditor{
+		Log:     log,
+		Auditor: auditor,
+	}
+}
+
+func (a *CodeServerDeletionAuditor) Handle(ctx context.Context, req admission.Request) admission.Response {
+	codeServer := &csv1alpha1.CodeServer{}
+	if err := json.Unmarshal(req.OldObject.Raw, codeServer); err != nil {
+		a.Log.Error(err, "Failed to decode deleted code server.", "namespace", req.Namespace, "name", req.Name)
+		return admission.Allowed("")
+	}
+	codeServer.Namespace = req.Namespace
+	actor := req.UserInfo.Username
+	if deletedBy := codeServer.Annotations[DeletedByAnnotation]; len(deletedBy) != 0 {
+		actor = fmt.Sprintf("%s via %s", deletedBy, req.UserInfo.Username)
+	}
+	a.Auditor.RecordBy(codeServer, AuditDeleted, "code server deletion has been requested", actor)
+	return admission.Allowed("")
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	AuthResource = "%s-auth"
+	// ExporterTokenResource holds the token operator presents to mutating endpoints of status exporter
+	ExporterTokenResource = "%s-exporter-token"
+	// Keys of auth secret, hashed password is only present in password mode
+	AuthPasswordKey       = "password"
+	AuthHashedPasswordKey = "hashed-password"
+	AuthTokenKey          = "token"
+	// Bytes of random password and token before hex encoding
+	AuthPasswordBytes = 12
+	AuthTokenBytes    = 32
+)
+
+// authArguments returns the arguments of code server for the auth type.
+func authArguments(m *csv1alpha1.CodeServer) []string {
+	switch m.Spec.Auth {
+	case csv1alpha1.AuthNone:
+		return []string{"--auth", "none"}
+	case csv1alpha1.AuthPassword, csv1alpha1.AuthToken:
+		return []string{"--auth", "password"}
+	}
+	return nil
+}
+
+// addAuthForPod injects the generated secret into code server container, password is passed as hash of sha256
+// so that it's never exposed by environments of container.
+func addAuthForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	var env corev1.EnvVar
+	switch m.Spec.Auth {
+	case csv1alpha1.AuthPassword:
+		env = authSecretEnv(m, "HASHED_PASSWORD", AuthHashedPasswordKey)
+	case csv1alpha1.AuthToken:
+		env = authSecretEnv(m, "PASSWORD", AuthTokenKey)
+	default:
+		return
+	}
+	for index := range podSpec.Containers {
+		if podSpec.Containers[index].Name == CSNAME {
+			podSpec.Containers[index].Env = append(podSpec.Containers[index].Env, env)
+		}
+	}
+}
+
+func authSecretEnv(m *csv1alpha1.CodeServer, name, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: ChildName(AuthResource, m.Name)},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+// reconcileForAuth generates the password or token of instance once and returns the name of secret, the secret
+// is regenerated only if keys required by auth type are missing, e.g. auth type changed.
+func (r *CodeServerReconciler) reconcileForAuth(codeServer *csv1alpha1.CodeServer) (string, error) {
+	reqLogger := r.instanceLog(codeServer)
+	name := ChildName(AuthResource, codeServer.Name)
+	if codeServer.Spec.Auth != csv1alpha1.AuthPassword && codeServer.Spec.Auth != csv1alpha1.AuthToken {
+		return "", r.deleteResourceIfExists(&corev1.Secret{}, name, codeServer.Namespace)
+	}
+	oldSecret := &corev1.Secret{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, oldSecret)
+	notFound := errors.IsNotFound(err)
+	if err != nil && !notFound {
+		reqLogger.Error(err, fmt.Sprintf("Failed to get auth secret for %s.", codeServer.Name))
+		return "", err
+	}
+	data, err := newAuthData(codeServer.Spec.Auth)
+	if err != nil {
+		return "", err
+	}
+	if notFound {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: codeServer.Namespace,
+			},
+			Data: data,
+		}
+		setOwnedLabels(secret, codeServer.Name)
+		// Set CodeServer instance as the owner of the secret.
+		controllerutil.SetControllerReference(codeServer, secret, r.Scheme)
+		r.addCostLabels(codeServer, secret)
+		reqLogger.Info("Creating auth secret.")
+		if err = r.Client.Create(context.TODO(), secret); err != nil {
+			reqLogger.Error(err, "Failed to create auth secret.")
+			return "", err
+		}
+		r.recordCreated(codeServer, secret)
+		return name, nil
+	}
+	for key := range data {
+		if _, found := oldSecret.Data[key]; !found {
+			oldSecret.Data = data
+			reqLogger.Info("Regenerating auth secret.")
+			if err = r.Client.Update(context.TODO(), oldSecret); err != nil {
+				reqLogger.Error(err, "Failed to update auth secret.")
+				return "", err
+			}
+			r.recordUpdated(codeServer, oldSecret)
+			break
+		}
+	}
+	return name, nil
+}
+
+// addExporterTokenForPod injects the exporter token, requests from outside of the pod without it are rejected by
+// the keep alive and notify endpoints of status exporter.
+func addExporterTokenForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name != ExporterContainer {
+			continue
+		}
+		podSpec.Containers[i].Env = append(podSpec.Containers[i].Env, corev1.EnvVar{
+			Name: "EXPORTER_TOKEN",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: ChildName(ExporterTokenResource, m.Name)},
+					Key:                  AuthTokenKey,
+				},
+			},
+		})
+	}
+}
+
+// reconcileForExporterToken generates the exporter token of instance once, only code runtime runs status exporter.
+func (r *CodeServerReconciler) reconcileForExporterToken(codeServer *csv1alpha1.CodeServer) error {
+	reqLogger := r.instanceLog(codeServer)
+	name := ChildName(ExporterTokenResource, codeServer.Name)
+	if !strings.EqualFold(string(codeServer.Spec.Runtime), string(csv1alpha1.RuntimeCode)) {
+		return r.deleteResourceIfExists(&corev1.Secret{}, name, codeServer.Namespace)
+	}
+	oldSecret := &corev1.Secret{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, oldSecret)
+	if err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+	token, err := randomHex(AuthTokenBytes)
+	if err != nil {
+		return err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: codeServer.Namespace,
+		},
+		Data: map[string][]byte{AuthTokenKey: []byte(token)},
+	}
+	setOwnedLabels(secret, codeServer.Name)
+	controllerutil.SetControllerReference(codeServer, secret, r.Scheme)
+	r.addCostLabels(codeServer, secret)
+	reqLogger.Info("Creating exporter token secret.")
+	if err = r.Client.Create(context.TODO(), secret); err != nil {
+		reqLogger.Error(err, "Failed to create exporter token secret.")
+		return err
+	}
+	r.recordCreated(codeServer, secret)
+	return nil
+}
+
+// exporterToken returns the token to authenticate against status exporter, empty if it's not generated yet.
+func exporterToken(c client.Reader, namespace, name string) string {
+	secret := &corev1.Secret{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: ChildName(ExporterTokenResource, name), Namespace: namespace}, secret)
+	if err != nil {
+		return ""
+	}
+	return string(secret.Data[AuthTokenKey])
+}
+
+// newAuthData generates random password or token for auth type.
+func newAuthData(authType csv1alpha1.AuthType) (map[string][]byte, error) {
+	if authType == csv1alpha1.AuthToken {
+		token, err := randomHex(AuthTokenBytes)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{AuthTokenKey: []byte(token)}, nil
+	}
+	password, err := randomHex(AuthPasswordBytes)
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256([]byte(password))
+	return map[string][]byte{
+		AuthPasswordKey:       []byte(password),
+		AuthHashedPasswordKey: []byte(hex.EncodeToString(hashed[:])),
+	}, nil
+}
+
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
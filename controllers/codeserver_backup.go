@@ -0,0 +1,177 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	BackupCheckInterval    = 60
+	DefaultBackupRetention = 3
+	BackupLabel            = "codeserver.io/backup-of"
+	BackupResource         = "%s-backup-%s"
+	// SnapshotLabel marks snapshots taken on demand by users, which are never pruned by backup retention.
+	SnapshotLabel    = "codeserver.io/snapshot-of"
+	SnapshotResource = "%s-snapshot-%s"
+	BackupTimeLayout = "20060102-150405"
+)
+
+var VolumeSnapshotGVK = schema.GroupVersionKind{
+	Group:   SnapshotAPIGroup,
+	Version: "v1",
+	Kind:    SnapshotKind,
+}
+
+// CodeServerBackup takes scheduled VolumeSnapshot backups of workspace volumes. Backups are not owned by code
+// server, so that they can be used to restore workspace after instance deleted.
+type CodeServerBackup struct {
+	client.Client
+	Log     logr.Logger
+	Options *CodeServerOption
+}
+
+func NewCodeServerBackup(client client.Client, log logr.Logger, options *CodeServerOption) *CodeServerBackup {
+	return &CodeServerBackup{
+		client,
+		log,
+		options,
+	}
+}
+
+func (b *CodeServerBackup) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(BackupCheckInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.BackupAll()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (b *CodeServerBackup) BackupAll() {
+	reqLogger := b.Log.WithName("codeserverbackup")
+	codeServers, err := listCodeServers(b.Client, UnrecycledPhases)
+	if err != nil {
+		reqLogger.Error(err, "Failed to list code servers for backup.")
+		return
+	}
+	for i := range codeServers {
+		codeServer := &codeServers[i]
+		if !InShard(b.Options, codeServer) {
+			continue
+		}
+		if codeServer.Spec.Backup == nil || codeServer.Spec.StorageName == StorageEmptyDir ||
+			len(codeServer.Spec.StorageName) == 0 || HasCondition(codeServer.Status, csv1alpha1.ServerRecycled) {
+			continue
+		}
+		schedule, err := ParseCronSchedule(codeServer.Spec.Backup.Schedule)
+		if err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to parse backup schedule of code server %s/%s.",
+				codeServer.Namespace, codeServer.Name))
+			continue
+		}
+		last := codeServer.CreationTimestamp.Time
+		if codeServer.Status.LastBackupTime != nil {
+			last = codeServer.Status.LastBackupTime.Time
+		}
+		next := schedule.Next(last)
+		if next.IsZero() || time.Now().Before(next) {
+			continue
+		}
+		b.backupCodeServer(codeServer)
+	}
+}
+
+func (b *CodeServerBackup) backupCodeServer(codeServer *csv1alpha1.CodeServer) {
+	reqLogger := instanceLogger(b.Log, codeServer)
+	now := metav1.Now()
+	snapshot := NewVolumeSnapshot(codeServer, ChildName(BackupResource, codeServer.Name,
+		now.UTC().Format(BackupTimeLayout)), codeServer.Spec.Backup.VolumeSnapshotClassName, BackupLabel)
+	if err := b.Client.Create(context.TODO(), snapshot); err != nil && !errors.IsAlreadyExists(err) {
+		reqLogger.Error(err, "Failed to create workspace backup.")
+		return
+	}
+	reqLogger.Info(fmt.Sprintf("workspace backup %s has been created", snapshot.GetName()))
+	codeServer.Status.LastBackupTime = &now
+	codeServer.Status.LastBackupName = snapshot.GetName()
+	if err := b.Client.Update(context.TODO(), codeServer); err != nil {
+		reqLogger.Error(err, "Failed to update code server backup status.")
+	}
+	b.pruneBackups(codeServer)
+}
+
+// pruneBackups deletes the oldest backups which exceed retention count.
+func (b *CodeServerBackup) pruneBackups(codeServer *csv1alpha1.CodeServer) {
+	reqLogger := instanceLogger(b.Log, codeServer)
+	retention := codeServer.Spec.Backup.Retention
+	if retention <= 0 {
+		retention = DefaultBackupRetention
+	}
+	snapshots := &unstructured.UnstructuredList{}
+	snapshots.SetGroupVersionKind(VolumeSnapshotGVK.GroupVersion().WithKind(SnapshotKind + "List"))
+	if err := b.Client.List(context.TODO(), snapshots, client.InNamespace(codeServer.Namespace),
+		client.MatchingLabels{BackupLabel: codeServer.Name}); err != nil {
+		reqLogger.Error(err, "Failed to list workspace backups.")
+		return
+	}
+	items := snapshots.Items
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].GetCreationTimestamp().After(items[j].GetCreationTimestamp().Time)
+	})
+	for i := retention; i < len(items); i++ {
+		if err := b.Client.Delete(context.TODO(), &items[i]); err != nil && !errors.IsNotFound(err) {
+			reqLogger.Error(err, fmt.Sprintf("Failed to delete workspace backup %s.", items[i].GetName()))
+			continue
+		}
+		reqLogger.Info(fmt.Sprintf("workspace backup %s has been pruned", items[i].GetName()))
+	}
+}
+
+// NewVolumeSnapshot returns a VolumeSnapshot of the workspace volume labeled with code server under label, i.e.
+// BackupLabel for scheduled backups or SnapshotLabel for the ones of users.
+func NewVolumeSnapshot(codeServer *csv1alpha1.CodeServer, name, className, label string) *unstructured.Unstructured {
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(VolumeSnapshotGVK)
+	snapshot.SetName(name)
+	snapshot.SetNamespace(codeServer.Namespace)
+	snapshot.SetLabels(map[string]string{label: codeServer.Name})
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": codeServer.Name,
+		},
+	}
+	if len(className) != 0 {
+		spec["volumeSnapshotClassName"] = className
+	}
+	snapshot.Object["spec"] = spec
+	return snapshot
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sort"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// BoundsWebhookPath is the path of validating webhook which enforces resource bounds of operator config.
+const BoundsWebhookPath = "/validate-cs-opensourceways-com-v1alpha1-codeserver-resources"
+
+// +kubebuilder:webhook:path=/validate-cs-opensourceways-com-v1alpha1-codeserver-resources,mutating=false,failurePolicy=fail,sideEffects=None,groups=cs.opensourceways.com,resources=codeservers,verbs=create;update,versions=v1alpha1,name=vcodeserverresources.kb.io,admissionReviewVersions=v1
+
+// CodeServerBoundsValidator denies code servers requesting resources out of the bounds configured for their
+// namespace or template, e.g. 64 core workspaces. Updates are only checked if resources changed, so that instances
+// created before bounds are tightened keep working.
+type CodeServerBoundsValidator struct {
+	Log     logr.Logger
+	Options *CodeServerOption
+}
+
+func NewCodeServerBoundsValidator(log logr.Logger, options *CodeServerOption) *CodeServerBoundsValidator {
+	return &CodeServerBoundsValidator{
+		Log:     log,
+		Options: options,
+	}
+}
+
+func (v *CodeServerBoundsValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	codeServer := &csv1alpha1.CodeServer{}
+	if err := json.Unmarshal(req.Object.Raw, codeServer); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if req.Operation == admissionv1.Update {
+		old := &csv1alpha1.CodeServer{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if equality.Semantic.DeepEqual(old.Spec.Resources, codeServer.Spec.Resources) &&
+			old.Spec.StorageSize == codeServer.Spec.StorageSize &&
+			equality.Semantic.DeepEqual(old.Spec.GPU, codeServer.Spec.GPU) {
+			return admission.Allowed("")
+		}
+	}
+	codeServer.Namespace = req.Namespace
+	var violations []string
+	bounds := v.Options.Load().ResourceBounds
+	for i := range bounds {
+		if boundsApply(&bounds[i], codeServer) {
+			violations = append(violations, checkBounds(&bounds[i], codeServer)...)
+		}
+	}
+	if len(violations) != 0 {
+		v.Log.Info(fmt.Sprintf("code server %s/%s is denied: %s", req.Namespace, codeServer.Name,
+			strings.Join(violations, "; ")))
+		return admission.Denied(strings.Join(violations, "; "))
+	}
+	return admission.Allowed("")
+}
+
+// boundsApply returns true if instance is in the namespaces and created from the templates of bounds.
+func boundsApply(bounds *csv1alpha1.ResourceBounds, m *csv1alpha1.CodeServer) bool {
+	return (len(bounds.Namespaces) == 0 || containsString(bounds.Namespaces, m.Namespace)) &&
+		(len(bounds.Templates) == 0 || containsString(bounds.Templates, m.Annotations[TemplateAnnotation]))
+}
+
+func containsString(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// boundedQuantities returns the amounts of resource requested by instance together with their field paths,
+// nothing if resource is not specified.
+func boundedQuantities(m *csv1alpha1.CodeServer, name corev1.ResourceName) map[string]resource.Quantity {
+	quantities := map[string]resource.Quantity{}
+	if name == corev1.ResourceStorage {
+		if size, err := resource.ParseQuantity(m.Spec.StorageSize); err == nil {
+			quantities["spec.storageSize"] = size
+		}
+		return quantities
+	}
+	if gpuName, count := requestedGPU(m); count > 0 && gpuName == name {
+		quantities["gpu count"] = *resource.NewQuantity(count, resource.DecimalSI)
+		return quantities
+	}
+	if value, ok := m.Spec.Resources.Requests[name]; ok {
+		quantities[fmt.Sprintf("spec.resources.requests.%s", name)] = value
+	}
+	if value, ok := m.Spec.Resources.Limits[name]; ok {
+		quantities[fmt.Sprintf("spec.resources.limits.%s", name)] = value
+	}
+	return quantities
+}
+
+// unboundedField returns the field path which has to be set for resource to be bounded by maximum, i.e. the size
+// of workspace volume or the limit of compute resources, instances without it could use the resource unbounded.
+// Extended resources, e.g. gpus, can't be overcommitted and are bounded by their requests.
+func unboundedField(m *csv1alpha1.CodeServer, name corev1.ResourceName) (string, bool) {
+	switch name {
+	case corev1.ResourceStorage:
+		if _, err := resource.ParseQuantity(m.Spec.StorageSize); err != nil {
+			return "spec.storageSize", true
+		}
+	case corev1.ResourceCPU, corev1.ResourceMemory, corev1.ResourceEphemeralStorage:
+		if _, ok := m.Spec.Resources.Limits[name]; !ok {
+			return fmt.Sprintf("spec.resources.limits.%s", name), true
+		}
+	}
+	return "", false
+}
+
+// checkBounds returns the violations of bounds in human readable messages, resources bounded by maximum must be
+// limited.
+func checkBounds(bounds *csv1alpha1.ResourceBounds, m *csv1alpha1.CodeServer) []string {
+	scope := describeBoundsScope(bounds)
+	var violations []string
+	for name, min := range bounds.Min {
+		for field, value := range boundedQuantities(m, name) {
+			if value.Cmp(min) < 0 {
+				violations = append(violations, fmt.Sprintf("%s %s is less than the minimum %s %s of %s", field,
+					value.String(), min.String(), name, scope))
+			}
+		}
+	}
+	for name, max := range bounds.Max {
+		if field, unbounded := unboundedField(m, name); unbounded {
+			violations = append(violations, fmt.Sprintf("%s is required by the maximum %s %s of %s", field,
+				max.String(), name, scope))
+		}
+		for field, value := range boundedQuantities(m, name) {
+			if value.Cmp(max) > 0 {
+				violations = append(violations, fmt.Sprintf("%s %s exceeds the maximum %s %s of %s", field,
+					value.String(), max.String(), name, scope))
+			}
+		}
+	}
+	// resource lists are maps, keep messages stable
+	sort.Strings(violations)
+	return violations
+}
+
+func describeBoundsScope(bounds *csv1alpha1.ResourceBounds) string {
+	var scopes []string
+	if len(bounds.Namespaces) != 0 {
+		scopes = append(scopes, fmt.Sprintf("namespaces %s", strings.Join(bounds.Namespaces, ", ")))
+	}
+	if len(bounds.Templates) != 0 {
+		scopes = append(scopes, fmt.Sprintf("templates %s", strings.Join(bounds.Templates, ", ")))
+	}
+	if len(scopes) == 0 {
+		return "all instances"
+	}
+	return strings.Join(scopes, " and ")
+}
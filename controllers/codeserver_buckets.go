@@ -0,0 +1,174 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	errrorlib "errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"path"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	BucketMountName         = "bucket-mount-%d"
+	BucketVolume            = "bucket-%d"
+	BucketCredentialsVolume = "bucket-credentials-%d"
+	BucketMountDir          = "/mnt/bucket"
+	BucketCredentialsDir    = "/etc/bucket"
+	// BucketGCSKey is the key of service account key in the credentials secret of GCS bucket.
+	BucketGCSKey = "key.json"
+	// BucketUnmountScript lazily unmounts bucket with whichever fusermount the image ships.
+	BucketUnmountScript = "fusermount -uz " + BucketMountDir + " || fusermount3 -uz " + BucketMountDir
+)
+
+func (r *CodeServerReconciler) validateBuckets(m *csv1alpha1.CodeServer) error {
+	if len(m.Spec.Buckets) == 0 {
+		return nil
+	}
+	if !r.Options.Load().EnableBucketMounts {
+		return errrorlib.New("bucket mounts haven't been enabled by operator")
+	}
+	for _, bucket := range m.Spec.Buckets {
+		if len(bucket.Bucket) == 0 || len(bucket.MountPath) == 0 {
+			return errrorlib.New("bucket mount requires bucket and mount path")
+		}
+		if bucket.Provider != csv1alpha1.BucketS3 && (len(bucket.Endpoint) != 0 || len(bucket.Region) != 0) {
+			return fmt.Errorf("endpoint and region of bucket %s only work with S3", bucket.Bucket)
+		}
+	}
+	return nil
+}
+
+// bucketRemote returns the on the fly remote of rclone, e.g. :s3:bucket/prefix, whose backend is configured by
+// environment.
+func bucketRemote(bucket *csv1alpha1.BucketMountSpec) string {
+	remote := bucket.Bucket
+	if prefix := strings.Trim(bucket.Prefix, "/"); len(prefix) != 0 {
+		remote = path.Join(remote, prefix)
+	}
+	if bucket.Provider == csv1alpha1.BucketGCS {
+		return ":gcs:" + remote
+	}
+	return ":s3:" + remote
+}
+
+// bucketEnvs returns the environment configuring the rclone backend of bucket, S3 credentials are read from the
+// environment populated by the credentials secret.
+func bucketEnvs(bucket *csv1alpha1.BucketMountSpec) []corev1.EnvVar {
+	if bucket.Provider == csv1alpha1.BucketGCS {
+		if len(bucket.CredentialsSecret) == 0 {
+			return []corev1.EnvVar{{Name: "RCLONE_GCS_ENV_AUTH", Value: "true"}}
+		}
+		return []corev1.EnvVar{{Name: "RCLONE_GCS_SERVICE_ACCOUNT_FILE",
+			Value: path.Join(BucketCredentialsDir, BucketGCSKey)}}
+	}
+	provider := "AWS"
+	if len(bucket.Endpoint) != 0 {
+		provider = "Other"
+	}
+	envs := []corev1.EnvVar{
+		{Name: "RCLONE_S3_PROVIDER", Value: provider},
+		{Name: "RCLONE_S3_ENV_AUTH", Value: "true"},
+	}
+	if len(bucket.Endpoint) != 0 {
+		envs = append(envs, corev1.EnvVar{Name: "RCLONE_S3_ENDPOINT", Value: bucket.Endpoint})
+	}
+	if len(bucket.Region) != 0 {
+		envs = append(envs, corev1.EnvVar{Name: "RCLONE_S3_REGION", Value: bucket.Region})
+	}
+	return envs
+}
+
+// addBucketsForPod injects a FUSE sidecar per bucket, the sidecar mounts bucket into an empty dir which is
+// propagated into code server container. Propagating mounts out of container requires privileged sidecar, the
+// mount is released before sidecar stops, otherwise a stale mount on node would block the removal of empty dir.
+func (r *CodeServerReconciler) addBucketsForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	privileged := true
+	bidirectional := corev1.MountPropagationBidirectional
+	hostToContainer := corev1.MountPropagationHostToContainer
+	for index := range m.Spec.Buckets {
+		bucket := &m.Spec.Buckets[index]
+		volume := fmt.Sprintf(BucketVolume, index)
+		args := []string{"mount", bucketRemote(bucket), BucketMountDir, "--allow-other", "--vfs-cache-mode",
+			"writes", "--dir-cache-time", "1m"}
+		if bucket.ReadOnly {
+			args = append(args, "--read-only")
+		}
+		sidecar := corev1.Container{
+			Name:            fmt.Sprintf(BucketMountName, index),
+			Image:           r.Options.Load().BucketMountImage,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Args:            args,
+			Env:             bucketEnvs(bucket),
+			SecurityContext: &corev1.SecurityContext{
+				Privileged: &privileged,
+			},
+			Lifecycle: &corev1.Lifecycle{
+				PreStop: &corev1.LifecycleHandler{
+					Exec: &corev1.ExecAction{Command: []string{"sh", "-c", BucketUnmountScript}},
+				},
+			},
+			VolumeMounts: []corev1.VolumeMount{
+				{
+					Name:             volume,
+					MountPath:        BucketMountDir,
+					MountPropagation: &bidirectional,
+				},
+			},
+		}
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: volume,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+		if len(bucket.CredentialsSecret) != 0 {
+			if bucket.Provider == csv1alpha1.BucketGCS {
+				credentials := fmt.Sprintf(BucketCredentialsVolume, index)
+				podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+					Name: credentials,
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{SecretName: bucket.CredentialsSecret},
+					},
+				})
+				sidecar.VolumeMounts = append(sidecar.VolumeMounts, corev1.VolumeMount{
+					Name:      credentials,
+					MountPath: BucketCredentialsDir,
+					ReadOnly:  true,
+				})
+			} else {
+				sidecar.EnvFrom = []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: bucket.CredentialsSecret},
+				}}}
+			}
+		}
+		for i := range podSpec.Containers {
+			if podSpec.Containers[i].Name != CSNAME {
+				continue
+			}
+			podSpec.Containers[i].VolumeMounts = append(podSpec.Containers[i].VolumeMounts, corev1.VolumeMount{
+				Name:             volume,
+				MountPath:        bucket.MountPath,
+				MountPropagation: &hostToContainer,
+			})
+		}
+		podSpec.Containers = append(podSpec.Containers, sidecar)
+	}
+}
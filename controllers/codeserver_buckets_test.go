@@ -0,0 +1,96 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+func TestValidateBuckets(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		buckets []csv1alpha1.BucketMountSpec
+		wantErr string
+	}{
+		{name: "no buckets"},
+		{name: "denied by default", buckets: []csv1alpha1.BucketMountSpec{{Bucket: "data", MountPath: "/data"}},
+			wantErr: "haven't been enabled"},
+		{name: "enabled", enabled: true, buckets: []csv1alpha1.BucketMountSpec{{Bucket: "data", MountPath: "/data"}}},
+		{name: "missing mount path", enabled: true, buckets: []csv1alpha1.BucketMountSpec{{Bucket: "data"}},
+			wantErr: "requires bucket and mount path"},
+		{name: "endpoint of gcs", enabled: true, buckets: []csv1alpha1.BucketMountSpec{{Bucket: "data",
+			MountPath: "/data", Provider: csv1alpha1.BucketGCS, Endpoint: "https://minio"}},
+			wantErr: "only work with S3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &CodeServerReconciler{Options: &CodeServerOption{EnableBucketMounts: tt.enabled}}
+			err := r.validateBuckets(&csv1alpha1.CodeServer{Spec: csv1alpha1.CodeServerSpec{Buckets: tt.buckets}})
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Errorf("validateBuckets() error = %v", err)
+			}
+			if len(tt.wantErr) != 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateBuckets() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAddBucketsForPod(t *testing.T) {
+	tests := []struct {
+		name       string
+		bucket     csv1alpha1.BucketMountSpec
+		wantRemote string
+		wantArg    string
+	}{
+		{name: "s3", bucket: csv1alpha1.BucketMountSpec{Bucket: "data", Prefix: "/sets/", MountPath: "/data"},
+			wantRemote: ":s3:data/sets"},
+		{name: "gcs read only", bucket: csv1alpha1.BucketMountSpec{Bucket: "notes", MountPath: "/notes",
+			Provider: csv1alpha1.BucketGCS, ReadOnly: true}, wantRemote: ":gcs:notes", wantArg: "--read-only"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &CodeServerReconciler{Options: &CodeServerOption{EnableBucketMounts: true}}
+			podSpec := &corev1.PodSpec{Containers: []corev1.Container{{Name: CSNAME}}}
+			r.addBucketsForPod(&csv1alpha1.CodeServer{Spec: csv1alpha1.CodeServerSpec{
+				Buckets: []csv1alpha1.BucketMountSpec{tt.bucket}}}, podSpec)
+			if len(podSpec.Containers) != 2 {
+				t.Fatalf("addBucketsForPod() containers = %d, want 2", len(podSpec.Containers))
+			}
+			sidecar := podSpec.Containers[1]
+			args := strings.Join(sidecar.Args, " ")
+			if sidecar.Args[1] != tt.wantRemote || !strings.Contains(args, tt.wantArg) {
+				t.Errorf("addBucketsForPod() args = %q, want remote %q and %q", args, tt.wantRemote, tt.wantArg)
+			}
+			if sidecar.Lifecycle == nil || sidecar.Lifecycle.PreStop == nil || sidecar.Lifecycle.PreStop.Exec == nil ||
+				!strings.Contains(strings.Join(sidecar.Lifecycle.PreStop.Exec.Command, " "),
+					"fusermount -uz "+BucketMountDir) {
+				t.Errorf("addBucketsForPod() sidecar doesn't unmount %s before stopping", BucketMountDir)
+			}
+			mounts := podSpec.Containers[0].VolumeMounts
+			if len(mounts) != 1 || mounts[0].MountPath != tt.bucket.MountPath {
+				t.Errorf("addBucketsForPod() mounts = %+v, want %s", mounts, tt.bucket.MountPath)
+			}
+		})
+	}
+}
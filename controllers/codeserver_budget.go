@@ -0,0 +1,203 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const DefaultBudgetWarningPercent = 80
+
+// CodeServerBudget accounts running hours and estimated cost of instances per week, and hibernates or recycles
+// instances exceeding their budget until next week.
+type CodeServerBudget struct {
+	client.Client
+	Log      logr.Logger
+	Options  *CodeServerOption
+	recorder record.EventRecorder
+}
+
+func NewCodeServerBudget(client client.Client, log logr.Logger, options *CodeServerOption,
+	recorder record.EventRecorder) *CodeServerBudget {
+	return &CodeServerBudget{
+		client,
+		log,
+		options,
+		recorder,
+	}
+}
+
+func (b *CodeServerBudget) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(b.Options.Load().BudgetInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.Sweep()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// weekStart returns the start of the week of t, weeks start on Monday 00:00 UTC.
+func weekStart(t time.Time) time.Time {
+	day := t.UTC().Truncate(24 * time.Hour)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// consumingBudget returns true if instance holds compute resources.
+func consumingBudget(m *csv1alpha1.CodeServer) bool {
+	return !HasCondition(m.Status, csv1alpha1.ServerInactive) && !HasCondition(m.Status, csv1alpha1.ServerRecycled)
+}
+
+// hourlyCost returns the estimated hourly cost of instance in its current state, zero if not estimated.
+func hourlyCost(m *csv1alpha1.CodeServer) float64 {
+	if m.Status.Cost == nil {
+		return 0
+	}
+	cost, _ := strconv.ParseFloat(m.Status.Cost.Hourly, 64)
+	return cost
+}
+
+// accountBudget adds the time and cost since last accounting to the budget used in the current week.
+func accountBudget(m *csv1alpha1.CodeServer, now time.Time) *csv1alpha1.BudgetStatus {
+	start := weekStart(now)
+	budget := m.Status.Budget.DeepCopy()
+	if budget == nil || budget.WeekStart.Time.Before(start) {
+		budget = &csv1alpha1.BudgetStatus{WeekStart: metav1.NewTime(start), UpdateTime: metav1.NewTime(start)}
+	}
+	since := budget.UpdateTime.Time
+	if since.Before(start) {
+		since = start
+	}
+	elapsed := now.Sub(since)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	if consumingBudget(m) {
+		budget.RunningSeconds += int64(elapsed / time.Second)
+	}
+	cost, _ := strconv.ParseFloat(budget.Cost, 64)
+	cost += elapsed.Hours() * hourlyCost(m)
+	budget.Cost = formatAmount(cost)
+	// the fraction of second not accounted is carried to next accounting
+	budget.UpdateTime = metav1.NewTime(since.Add(elapsed.Truncate(time.Second)))
+	return budget
+}
+
+// budgetUsed returns the fraction of budget used, the larger one of hours and cost.
+func budgetUsed(spec *csv1alpha1.BudgetSpec, budget *csv1alpha1.BudgetStatus) float64 {
+	used := 0.0
+	if spec.MaxHoursPerWeek != nil && *spec.MaxHoursPerWeek > 0 {
+		used = float64(budget.RunningSeconds) / float64(*spec.MaxHoursPerWeek*3600)
+	}
+	if maxCost, err := strconv.ParseFloat(spec.MaxCostPerWeek, 64); err == nil && maxCost > 0 {
+		cost, _ := strconv.ParseFloat(budget.Cost, 64)
+		if cost/maxCost > used {
+			used = cost / maxCost
+		}
+	}
+	return used
+}
+
+// Sweep accounts the budget of instances of this shard, paused instances are skipped.
+func (b *CodeServerBudget) Sweep() {
+	codeServers := &csv1alpha1.CodeServerList{}
+	if err := b.Client.List(context.TODO(), codeServers); err != nil {
+		b.Log.Error(err, "Failed to list code servers for budget.")
+		return
+	}
+	now := time.Now()
+	for i := range codeServers.Items {
+		codeServer := &codeServers.Items[i]
+		if codeServer.Spec.Budget == nil || !InShard(b.Options, codeServer) || paused(codeServer) ||
+			!codeServer.DeletionTimestamp.IsZero() {
+			continue
+		}
+		b.enforce(codeServer, now)
+	}
+}
+
+func (b *CodeServerBudget) enforce(codeServer *csv1alpha1.CodeServer, now time.Time) {
+	reqLogger := instanceLogger(b.Log, codeServer)
+	spec := codeServer.Spec.Budget
+	budget := accountBudget(codeServer, now)
+	used := budgetUsed(spec, budget)
+	warningPercent := int32(DefaultBudgetWarningPercent)
+	if spec.WarningPercent != nil {
+		warningPercent = *spec.WarningPercent
+	}
+	exceeded := used >= 1
+	warned := !exceeded && used*100 >= float64(warningPercent)
+	reason := fmt.Sprintf("%.0f%% of weekly budget used, %.1f running hours and %s cost", used*100,
+		float64(budget.RunningSeconds)/3600, budget.Cost)
+	warningChanged := setBudgetCondition(codeServer, csv1alpha1.ServerBudgetWarning, warned, reason)
+	exceededChanged := setBudgetCondition(codeServer, csv1alpha1.ServerBudgetExceeded, exceeded, reason)
+	stopped := false
+	if exceeded && consumingBudget(codeServer) {
+		stopped = true
+		clearPendingRecycle(codeServer, "weekly budget exceeded")
+		conditionType := csv1alpha1.ServerInactive
+		if spec.Action == csv1alpha1.BudgetRecycle {
+			conditionType = csv1alpha1.ServerRecycled
+		}
+		SetCondition(&codeServer.Status, NewStateCondition(conditionType, "weekly budget exceeded",
+			map[string]string{}, corev1.ConditionTrue))
+	}
+	if !warningChanged && !exceededChanged && !stopped && equality.Semantic.DeepEqual(budget, codeServer.Status.Budget) {
+		return
+	}
+	codeServer.Status.Budget = budget
+	if err := b.Client.Update(context.TODO(), codeServer); err != nil {
+		reqLogger.Error(err, "Failed to update budget of code server.")
+		return
+	}
+	if warningChanged && warned {
+		b.recorder.Event(codeServer, corev1.EventTypeWarning, EventBudgetWarning, reason)
+	}
+	if exceededChanged && exceeded {
+		b.recorder.Event(codeServer, corev1.EventTypeWarning, EventBudgetExceeded, reason)
+	}
+	if stopped {
+		reqLogger.Info(fmt.Sprintf("code server exceeded its weekly budget and has been stopped: %s", reason))
+	}
+}
+
+// setBudgetCondition sets the budget condition if active and removes it otherwise, it returns true if changed.
+func setBudgetCondition(m *csv1alpha1.CodeServer, conditionType csv1alpha1.ServerConditionType, active bool,
+	reason string) bool {
+	if !active {
+		return removeCondition(&m.Status, conditionType)
+	}
+	if HasCondition(m.Status, conditionType) {
+		return false
+	}
+	return SetCondition(&m.Status, NewStateCondition(conditionType, reason, map[string]string{},
+		corev1.ConditionTrue))
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// SharedCacheVolume is the volume name of shared cache with index
+const SharedCacheVolume = "shared-cache-%d"
+
+// validateSharedCaches checks the cache volumes exist and can be mounted by multiple nodes.
+func (r *CodeServerReconciler) validateSharedCaches(m *csv1alpha1.CodeServer) error {
+	for _, cache := range m.Spec.SharedCaches {
+		if len(cache.ClaimName) == 0 || len(cache.MountPath) == 0 {
+			return fmt.Errorf("claimName and mountPath are required by shared cache")
+		}
+		pvc := &corev1.PersistentVolumeClaim{}
+		if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: cache.ClaimName, Namespace: m.Namespace},
+			pvc); err != nil {
+			return fmt.Errorf("failed to get shared cache %s: %v", cache.ClaimName, err)
+		}
+		shared := false
+		for _, mode := range pvc.Spec.AccessModes {
+			if mode == corev1.ReadOnlyMany || mode == corev1.ReadWriteMany {
+				shared = true
+			}
+		}
+		if !shared {
+			return fmt.Errorf("shared cache %s supports neither ReadOnlyMany nor ReadWriteMany", cache.ClaimName)
+		}
+	}
+	return nil
+}
+
+// addSharedCachesForPod mounts the shared caches read only into code server container.
+func addSharedCachesForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	for index, cache := range m.Spec.SharedCaches {
+		name := fmt.Sprintf(SharedCacheVolume, index)
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: cache.ClaimName,
+					ReadOnly:  true,
+				},
+			},
+		})
+		for i := range podSpec.Containers {
+			if podSpec.Containers[i].Name != CSNAME {
+				continue
+			}
+			podSpec.Containers[i].VolumeMounts = append(podSpec.Containers[i].VolumeMounts, corev1.VolumeMount{
+				Name:      name,
+				MountPath: cache.MountPath,
+				SubPath:   cache.SubPath,
+				ReadOnly:  true,
+			})
+		}
+	}
+}
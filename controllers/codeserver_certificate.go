@@ -0,0 +1,263 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sync"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// CertificateAnnotation records the fingerprint of https certificate on generated ingresses and on the pods
+	// mounting https secret, so that rotated certificate rolls into them.
+	CertificateAnnotation   = "codeserver.io/certificate"
+	CertificateProbeTimeout = 5 * time.Second
+	// CertificateRecheckSeconds is the interval host of instance is probed again while it serves stale certificate.
+	CertificateRecheckSeconds = 30
+	// CertificateProbeQueue is the number of hosts waiting to be probed, hosts beyond are queued on next reconcile.
+	CertificateProbeQueue = 256
+	// CertificateProbeRetention is how long probed certificate of host is kept after it was last asked for.
+	CertificateProbeRetention = 10 * time.Minute
+)
+
+// servedCertificate is the certificate last probed on host.
+type servedCertificate struct {
+	fingerprint string
+	probedAt    time.Time
+	askedAt     time.Time
+	probing     bool
+}
+
+// CertificateProber probes the certificates served on hosts of instances in the background as a runnable of
+// manager, so that reconcile never waits for tls handshakes.
+type CertificateProber struct {
+	Options *CodeServerOption
+	Log     logr.Logger
+	lock    sync.Mutex
+	served  map[string]*servedCertificate
+	pending chan string
+}
+
+func NewCertificateProber(options *CodeServerOption, log logr.Logger) *CertificateProber {
+	return &CertificateProber{
+		Options: options,
+		Log:     log,
+		served:  map[string]*servedCertificate{},
+		pending: make(chan string, CertificateProbeQueue),
+	}
+}
+
+// Served returns the fingerprint last probed on host, empty if unknown yet. Host is queued for probing if it
+// hasn't been probed within CertificateRecheckSeconds.
+func (p *CertificateProber) Served(host string) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	served, found := p.served[host]
+	if !found {
+		served = &servedCertificate{}
+		p.served[host] = served
+	}
+	served.askedAt = now
+	if !served.probing && now.Sub(served.probedAt) >= CertificateRecheckSeconds*time.Second {
+		select {
+		case p.pending <- host:
+			served.probing = true
+		default:
+		}
+	}
+	return served.fingerprint
+}
+
+// Start probes queued hosts until manager stops, certificates of hosts no longer asked for are forgotten.
+func (p *CertificateProber) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case host := <-p.pending:
+			fingerprint, err := servedFingerprint(p.Options, host)
+			if err != nil {
+				p.Log.Info(fmt.Sprintf("failed to probe certificate served on %s: %v", host, err))
+			}
+			p.record(host, fingerprint, err == nil)
+		}
+	}
+}
+
+func (p *CertificateProber) record(host, fingerprint string, succeeded bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	if served, found := p.served[host]; found {
+		served.probing = false
+		served.probedAt = now
+		if succeeded {
+			served.fingerprint = fingerprint
+		}
+	}
+	for name, served := range p.served {
+		if !served.probing && now.Sub(served.askedAt) > CertificateProbeRetention {
+			delete(p.served, name)
+		}
+	}
+}
+
+// certificateFingerprint returns the sha256 fingerprint and expiry of the leaf certificate in tls secret.
+func certificateFingerprint(secret *corev1.Secret) (string, *metav1.Time) {
+	block, _ := pem.Decode(secret.Data[corev1.TLSCertKey])
+	if block == nil {
+		return "", nil
+	}
+	digest := sha256.Sum256(block.Bytes)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return hex.EncodeToString(digest[:]), nil
+	}
+	notAfter := metav1.NewTime(cert.NotAfter)
+	return hex.EncodeToString(digest[:]), &notAfter
+}
+
+// servedFingerprint returns the sha256 fingerprint of the leaf certificate served on host, certificate is only
+// verified if required by options since only its identity matters.
+func servedFingerprint(options *CodeServerOption, host string) (string, error) {
+	dialer := &net.Dialer{Timeout: CertificateProbeTimeout}
+	config := probeTLSConfig(options, !options.Load().ProbeVerifyCertificates)
+	config.ServerName = host
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, "443"), config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no certificate served on %s", host)
+	}
+	digest := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// certificateOf returns the fingerprint of https certificate instance is served with, empty if unknown.
+func certificateOf(m *csv1alpha1.CodeServer) string {
+	if m.Status.Certificate == nil {
+		return ""
+	}
+	return m.Status.Certificate.Fingerprint
+}
+
+// reconcileForCertificate records the certificate of https secret in status, and once instance is ready has its
+// host probed in the background until the certificate is served. It returns whether status changed and whether
+// host still serves another certificate.
+func (r *CodeServerReconciler) reconcileForCertificate(codeServer *csv1alpha1.CodeServer,
+	secret *corev1.Secret) (bool, bool) {
+	fingerprint, notAfter := certificateFingerprint(secret)
+	old := codeServer.Status.Certificate
+	status := &csv1alpha1.CertificateStatus{Fingerprint: fingerprint, NotAfter: notAfter}
+	if old != nil {
+		status.Served = old.Served
+	}
+	if len(fingerprint) != 0 && status.Served != fingerprint &&
+		HasCondition(codeServer.Status, csv1alpha1.ServerReady) {
+		if served := r.certificates.Served(r.instanceHost(codeServer)); len(served) != 0 {
+			status.Served = served
+		}
+	}
+	status.Stale = len(status.Served) != 0 && status.Served != fingerprint
+	if old != nil && old.Fingerprint != fingerprint && len(old.Fingerprint) != 0 {
+		r.Recorder.Eventf(codeServer, corev1.EventTypeNormal, EventCertificateRotated,
+			"Https certificate rotated to %s", shortFingerprint(fingerprint))
+	}
+	changed := old == nil || old.Fingerprint != status.Fingerprint || old.Served != status.Served ||
+		old.Stale != status.Stale || !old.NotAfter.Equal(status.NotAfter)
+	codeServer.Status.Certificate = status
+	return changed, status.Stale
+}
+
+func shortFingerprint(fingerprint string) string {
+	if len(fingerprint) > 16 {
+		return fingerprint[:16]
+	}
+	return fingerprint
+}
+
+// addCertificateAnnotation stamps the certificate of instance on ingress annotations, ingress controllers which
+// don't watch secrets pick up the rotated certificate once the ingress changes.
+func addCertificateAnnotation(m *csv1alpha1.CodeServer, annotations map[string]string) {
+	if fingerprint := certificateOf(m); len(fingerprint) != 0 {
+		annotations[CertificateAnnotation] = shortFingerprint(fingerprint)
+	}
+}
+
+// addCertificateForPod restarts pod on rotation only if it mounts the https secret.
+func (r *CodeServerReconciler) addCertificateForPod(m *csv1alpha1.CodeServer, template *corev1.PodTemplateSpec) {
+	fingerprint := certificateOf(m)
+	if len(fingerprint) == 0 {
+		return
+	}
+	for _, volume := range template.Spec.Volumes {
+		if volume.Secret != nil && volume.Secret.SecretName == r.Options.Load().HttpsSecretName {
+			if template.Annotations == nil {
+				template.Annotations = map[string]string{}
+			}
+			template.Annotations[CertificateAnnotation] = shortFingerprint(fingerprint)
+			return
+		}
+	}
+}
+
+// certificateSecretRequests maps the https secret to the code servers of its namespace, and the secret of issued
+// certificate to its instance.
+func (r *CodeServerReconciler) certificateSecretRequests(obj client.Object) []reconcile.Request {
+	if instance := obj.GetLabels()[InstanceLabel]; len(r.Options.Load().ACMEDirectoryURL) != 0 && len(instance) != 0 &&
+		obj.GetName() == ChildName(ACMESecretResource, instance) {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: instance,
+			Namespace: obj.GetNamespace()}}}
+	}
+	if obj.GetName() != r.Options.Load().HttpsSecretName {
+		return nil
+	}
+	codeServers := &csv1alpha1.CodeServerList{}
+	if err := r.Client.List(context.TODO(), codeServers, client.InNamespace(obj.GetNamespace())); err != nil {
+		r.Log.Error(err, fmt.Sprintf("Failed to list code servers of rotated certificate in %s.",
+			obj.GetNamespace()))
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range codeServers.Items {
+		if InShard(r.Options, &codeServers.Items[i]) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+				Name: codeServers.Items[i].Name, Namespace: codeServers.Items[i].Namespace}})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	errrorlib "errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// CloneAnnotation requests a clone of the instance, the value is the name of the clone and will be generated
+	// if empty.
+	CloneAnnotation = "codeserver.io/clone"
+	// ClonedFromAnnotation records the instance which the clone is created from.
+	ClonedFromAnnotation = "codeserver.io/cloned-from"
+	CloneResource        = "%s-clone-%s"
+)
+
+var errNoCloneSource = errrorlib.New("neither workspace volume nor backup to clone from")
+
+// cloneStorage returns the storage of clone whose workspace volume is cloned from the volume of source, the latest
+// backup of source is restored instead if the volume no longer exists, e.g. after source has been recycled.
+func cloneStorage(c client.Client, source *csv1alpha1.CodeServer) (*csv1alpha1.StorageSpec, error) {
+	err := c.Get(context.TODO(), types.NamespacedName{Name: source.Name, Namespace: source.Namespace},
+		&corev1.PersistentVolumeClaim{})
+	if err == nil {
+		return &csv1alpha1.StorageSpec{SourcePVC: source.Name}, nil
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if source.Spec.Backup != nil && len(source.Status.LastBackupName) != 0 {
+		return &csv1alpha1.StorageSpec{SourceSnapshot: source.Status.LastBackupName}, nil
+	}
+	return nil, fmt.Errorf("code server %s has %w", source.Name, errNoCloneSource)
+}
+
+// NewCodeServerClone returns a code server with the same spec as source, it's routed by its own name and its
+// workspace volume is populated from storage. Clone is assigned to shard by its own name as well.
+func NewCodeServerClone(source *csv1alpha1.CodeServer, name, user string,
+	storage *csv1alpha1.StorageSpec) *csv1alpha1.CodeServer {
+	labels := map[string]string{}
+	for key, value := range source.Labels {
+		if key != ShardLabel {
+			labels[key] = value
+		}
+	}
+	annotations := map[string]string{ClonedFromAnnotation: source.Name}
+	if template, found := source.Annotations[TemplateAnnotation]; found {
+		annotations[TemplateAnnotation] = template
+	}
+	if len(user) == 0 {
+		user = source.Annotations[UserAnnotation]
+	}
+	if len(user) != 0 {
+		annotations[UserAnnotation] = user
+	}
+	spec := source.Spec.DeepCopy()
+	spec.Subdomain = name
+	spec.Storage = storage
+	return &csv1alpha1.CodeServer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   source.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: *spec,
+	}
+}
+
+// CloneCodeServer creates the clone of source named name on behalf of user, user of source is kept if empty.
+func CloneCodeServer(c client.Client, source *csv1alpha1.CodeServer, name, user string) (*csv1alpha1.CodeServer,
+	error) {
+	storage, err := cloneStorage(c, source)
+	if err != nil {
+		return nil, err
+	}
+	clone := NewCodeServerClone(source, name, user, storage)
+	if err := c.Create(context.TODO(), clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// reconcileForClone clones the instance if requested by annotation, the annotation is removed once the clone has
+// been created or can never be created, it returns true if instance has been updated.
+func (r *CodeServerReconciler) reconcileForClone(codeServer *csv1alpha1.CodeServer) (bool, error) {
+	name, found := codeServer.Annotations[CloneAnnotation]
+	if !found {
+		return false, nil
+	}
+	if len(name) == 0 {
+		// generation stays the same until the annotation is removed, retries don't create another clone
+		name = ChildName(CloneResource, codeServer.Name, strconv.FormatInt(codeServer.Generation, 10))
+	}
+	reqLogger := r.instanceLog(codeServer)
+	clone, err := CloneCodeServer(r.Client, codeServer, name, "")
+	if errors.IsAlreadyExists(err) && r.clonedFrom(codeServer, name) {
+		reqLogger.Info(fmt.Sprintf("instance has already been cloned to %s", name))
+		err = nil
+	}
+	switch {
+	case clone != nil:
+		reqLogger.Info(fmt.Sprintf("instance has been cloned to %s", name))
+		r.Recorder.Eventf(codeServer, corev1.EventTypeNormal, EventCloned, "Cloned to %s from %s", name,
+			describeStorageSource(clone.Spec.Storage))
+	case err == nil:
+	case errors.IsAlreadyExists(err), errors.IsInvalid(err), errrorlib.Is(err, errNoCloneSource):
+		// retrying never succeeds
+		reqLogger.Error(err, "Failed to clone instance.")
+		r.Recorder.Eventf(codeServer, corev1.EventTypeWarning, EventCloneFailed, "Failed to clone to %s: %v",
+			name, err)
+	default:
+		return false, err
+	}
+	delete(codeServer.Annotations, CloneAnnotation)
+	return true, r.Client.Update(context.TODO(), codeServer)
+}
+
+// clonedFrom returns true if code server named name is a clone of source.
+func (r *CodeServerReconciler) clonedFrom(source *csv1alpha1.CodeServer, name string) bool {
+	clone := &csv1alpha1.CodeServer{}
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: source.Namespace},
+		clone); err != nil {
+		return false
+	}
+	return clone.Annotations[ClonedFromAnnotation] == source.Name
+}
+
+func describeStorageSource(storage *csv1alpha1.StorageSpec) string {
+	if len(storage.SourceSnapshot) != 0 {
+		return fmt.Sprintf("backup %s", storage.SourceSnapshot)
+	}
+	return fmt.Sprintf("volume %s", storage.SourcePVC)
+}
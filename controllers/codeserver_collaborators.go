@@ -0,0 +1,700 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	errrorlib "errors"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"net/url"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// ShareResource names the network policy of share pods, deployment and service of the same name served all
+	// accesses before.
+	ShareResource = "%s-share"
+	// ShareAccessResource names the deployment and service serving access, e.g. <name>-share-readonly.
+	ShareAccessResource = "%s-share-%s"
+	// ShareAccessKey is the key of password of code server serving access in collaborators secret, keys of
+	// collaborators never start with '_' followed by a letter beyond hex digits.
+	ShareAccessKey = "_share.%s"
+	// CollaboratorsResource names the secret which holds the passwords of collaborators.
+	CollaboratorsResource = "%s-collaborators"
+	// ShareAuthResource names the htpasswd secret of ingress of access, e.g. <name>-readwrite-auth.
+	ShareAuthResource = "%s-%s-auth"
+	// ShareIngress names the ingress of access, e.g. <name>-readonly.
+	ShareIngress = "%s-%s"
+	// SharePasswordAnnotation is the digest of password of code server on share pod, which restarts it on rotation.
+	SharePasswordAnnotation = "codeserver.io/share-password"
+	SharePortBase           = 8081
+	ShareDataDir            = "/tmp/code-server-share"
+)
+
+// shareAccesses are the accesses in the order of their ports, access is served by its own pod and host.
+var shareAccesses = []csv1alpha1.CollaboratorAccess{csv1alpha1.CollaboratorReadWrite, csv1alpha1.CollaboratorReadOnly,
+	viewSessionAccess}
+
+func collaboratorAccess(collaborator *csv1alpha1.Collaborator) csv1alpha1.CollaboratorAccess {
+	if collaborator.Access == csv1alpha1.CollaboratorReadWrite {
+		return csv1alpha1.CollaboratorReadWrite
+	}
+	return csv1alpha1.CollaboratorReadOnly
+}
+
+// accessName returns the lower case name of access used in resource names and hosts.
+func accessName(access csv1alpha1.CollaboratorAccess) string {
+	return strings.ToLower(string(access))
+}
+
+func sharePort(access csv1alpha1.CollaboratorAccess) int {
+	switch access {
+	case csv1alpha1.CollaboratorReadOnly:
+		return SharePortBase + 1
+	case viewSessionAccess:
+		return SharePortBase + 2
+	}
+	return SharePortBase
+}
+
+// shareReadOnly returns true if workspace is mounted read-only for access.
+func shareReadOnly(access csv1alpha1.CollaboratorAccess) bool {
+	return access != csv1alpha1.CollaboratorReadWrite
+}
+
+// shareHost returns the host collaborators of access open the workspace with, e.g. <subdomain>-readonly.<domain>.
+func shareHost(m *csv1alpha1.CodeServer, access csv1alpha1.CollaboratorAccess, domain string) string {
+	return fmt.Sprintf("%s-%s.%s", m.Spec.Subdomain, accessName(access), domain)
+}
+
+func (r *CodeServerReconciler) shareHost(m *csv1alpha1.CodeServer, access csv1alpha1.CollaboratorAccess) string {
+	return shareHost(m, access, r.Options.Load().DomainName)
+}
+
+// collaboratorSecretKey returns the key of password of collaborator, names like emails aren't valid keys. Bytes other
+// than letters, digits, '-' and non leading '.' are escaped as '_' and two hex digits, so that names never share keys.
+func collaboratorSecretKey(name string) string {
+	var key strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || c == '-' ||
+			(c == '.' && i != 0) {
+			key.WriteByte(c)
+		} else {
+			fmt.Fprintf(&key, "_%02x", c)
+		}
+	}
+	return key.String()
+}
+
+// shareAccessKey returns the key of password of code server serving access.
+func shareAccessKey(access csv1alpha1.CollaboratorAccess) string {
+	return fmt.Sprintf(ShareAccessKey, accessName(access))
+}
+
+// activeCollaborators returns the collaborators whose access hasn't expired by access, and the time until the
+// next access expires, negative if none expires.
+func activeCollaborators(m *csv1alpha1.CodeServer, now time.Time) (map[csv1alpha1.CollaboratorAccess][]string,
+	time.Duration) {
+	active := map[csv1alpha1.CollaboratorAccess][]string{}
+	next := time.Duration(-1)
+	for i := range m.Spec.Collaborators {
+		collaborator := &m.Spec.Collaborators[i]
+		if collaborator.ExpiresAt != nil {
+			remaining := collaborator.ExpiresAt.Sub(now)
+			if remaining <= 0 {
+				continue
+			}
+			if next < 0 || remaining < next {
+				next = remaining
+			}
+		}
+		access := collaboratorAccess(collaborator)
+		active[access] = append(active[access], collaborator.Name)
+	}
+	return active, next
+}
+
+// validateCollaborators checks instance can be shared, collaborators open their own code server on the workspace
+// volume through ingress of ingress-nginx.
+func (r *CodeServerReconciler) validateCollaborators(m *csv1alpha1.CodeServer) error {
+	if !strings.EqualFold(string(m.Spec.Runtime), string(csv1alpha1.RuntimeCode)) ||
+		(m.Spec.IDE != nil && len(m.Spec.IDE.Flavor) != 0 && m.Spec.IDE.Flavor != csv1alpha1.IDECodeServer) {
+		return errrorlib.New("collaborators are only supported by code server flavor of vs code runtime")
+	}
+	if !r.needDeployPVC(m.Spec.StorageName) {
+		return errrorlib.New("collaborators require workspace volume")
+	}
+	if r.ingressProvider(m) != IngressProviderIngress || routingMode(m) != csv1alpha1.RoutingSubdomain {
+		return errrorlib.New("collaborators require subdomain routing of ingress provider")
+	}
+	return nil
+}
+
+// reconcileForCollaborators serves the workspace to collaborators whose access hasn't expired and removes the
+// access of the others, every access has its own code server container, host and credentials. View session of
+// support is served the same way. It returns whether status changed and the time until next access expires.
+func (r *CodeServerReconciler) reconcileForCollaborators(codeServer *csv1alpha1.CodeServer) (bool, time.Duration,
+	error) {
+	now := time.Now()
+	session, sessionNext, err := r.reconcileForViewSession(codeServer, now)
+	if err != nil {
+		return false, -1, err
+	}
+	if len(codeServer.Spec.Collaborators) == 0 && session == nil {
+		if err := r.deleteShareResources(codeServer.Name, codeServer.Namespace, true); err != nil {
+			return false, -1, err
+		}
+		changed := codeServer.Status.Collaborators != nil
+		codeServer.Status.Collaborators = nil
+		return changed, -1, nil
+	}
+	if err := r.validateCollaborators(codeServer); err != nil {
+		return false, -1, err
+	}
+	active, next := activeCollaborators(codeServer, now)
+	passwords, err := r.reconcileForCollaboratorPasswords(codeServer, active)
+	if err != nil {
+		return false, -1, err
+	}
+	statuses := r.collaboratorStatuses(codeServer, active, passwords)
+	if session != nil {
+		active[viewSessionAccess] = []string{session.Admin}
+		if next < 0 || sessionNext < next {
+			next = sessionNext
+		}
+	}
+	if len(active) == 0 {
+		err = r.deleteShareResources(codeServer.Name, codeServer.Namespace, false)
+	} else {
+		err = r.reconcileForShare(codeServer, active, passwords, session)
+	}
+	if err != nil {
+		return false, -1, err
+	}
+	if equalCollaboratorStatuses(statuses, codeServer.Status.Collaborators) {
+		return false, next, nil
+	}
+	codeServer.Status.Collaborators = statuses
+	return true, next, nil
+}
+
+func equalCollaboratorStatuses(a, b []csv1alpha1.CollaboratorStatus) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *CodeServerReconciler) collaboratorStatuses(m *csv1alpha1.CodeServer,
+	active map[csv1alpha1.CollaboratorAccess][]string, passwords map[string][]byte) []csv1alpha1.CollaboratorStatus {
+	var statuses []csv1alpha1.CollaboratorStatus
+	for i := range m.Spec.Collaborators {
+		collaborator := &m.Spec.Collaborators[i]
+		access := collaboratorAccess(collaborator)
+		status := csv1alpha1.CollaboratorStatus{
+			Name:    collaborator.Name,
+			Access:  access,
+			Expired: !containsString(active[access], collaborator.Name),
+		}
+		if !status.Expired {
+			status.URL = fmt.Sprintf("https://%s/", r.shareHost(m, access))
+			status.AccessSecretKey = shareAccessKey(access)
+			if _, found := passwords[collaboratorSecretKey(collaborator.Name)]; found {
+				status.SecretKey = collaboratorSecretKey(collaborator.Name)
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// reconcileForCollaboratorPasswords generates the password of every active collaborator and of code server of every
+// active access once, passwords of expired collaborators and accesses are removed. No password of collaborator is
+// generated if collaborators are authenticated by oauth2 proxy.
+func (r *CodeServerReconciler) reconcileForCollaboratorPasswords(codeServer *csv1alpha1.CodeServer,
+	active map[csv1alpha1.CollaboratorAccess][]string) (map[string][]byte, error) {
+	name := ChildName(CollaboratorsResource, codeServer.Name)
+	secret := &corev1.Secret{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, secret)
+	found := err == nil
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	passwords := map[string][]byte{}
+	keep := func(key string) error {
+		if password, found := secret.Data[key]; found {
+			passwords[key] = password
+			return nil
+		}
+		password, err := randomHex(AuthPasswordBytes)
+		if err != nil {
+			return err
+		}
+		passwords[key] = []byte(password)
+		return nil
+	}
+	for access, names := range active {
+		if err := keep(shareAccessKey(access)); err != nil {
+			return nil, err
+		}
+		if len(r.Options.Load().OAuth2ProxyURL) != 0 {
+			continue
+		}
+		for _, collaborator := range names {
+			if err := keep(collaboratorSecretKey(collaborator)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (found && equalSecretData(secret.Data, passwords)) || (!found && len(passwords) == 0) {
+		return passwords, nil
+	}
+	desired := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: codeServer.Namespace,
+		},
+		Data: passwords,
+	}
+	setOwnedLabels(desired, codeServer.Name)
+	if !found {
+		return passwords, r.applyResource(codeServer, desired, secret, found)
+	}
+	// keys of expired collaborators must be removed which apply doesn't do for maps owned by others
+	secret.Data = passwords
+	if err := r.Client.Update(context.TODO(), secret); err != nil {
+		return nil, err
+	}
+	r.recordUpdated(codeServer, secret)
+	return passwords, nil
+}
+
+func equalSecretData(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if string(b[key]) != string(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// htpasswdLine returns the htpasswd entry of user in salted sha1, which nginx supports without crypt(3). Salt is
+// derived from password so that entry stays the same across reconciles.
+func htpasswdLine(user string, password []byte) string {
+	salt := sha256.Sum256(append([]byte(user+":"), password...))
+	digest := sha1.Sum(append(append([]byte{}, password...), salt[:8]...))
+	return fmt.Sprintf("%s:{SSHA}%s", user, base64.StdEncoding.EncodeToString(append(digest[:], salt[:8]...)))
+}
+
+// reconcileForShare applies the deployments, services, ingresses and htpasswd secrets serving the workspace to
+// active collaborators and view session, and the network policy which only admits ingress controller to them.
+// Workspace volume can only be attached to one node unless it's ReadWriteMany, the share pods follow the instance pod.
+func (r *CodeServerReconciler) reconcileForShare(codeServer *csv1alpha1.CodeServer,
+	active map[csv1alpha1.CollaboratorAccess][]string, passwords map[string][]byte, session *viewSession) error {
+	nodeName := ""
+	pvc := &corev1.PersistentVolumeClaim{}
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: codeServer.Name, Namespace: codeServer.Namespace},
+		pvc); err != nil {
+		return err
+	}
+	if !containsAccessMode(pvc.Spec.AccessModes, corev1.ReadWriteMany) {
+		pod, err := r.latestPod(codeServer)
+		if err != nil {
+			return err
+		}
+		if pod == nil || len(pod.Spec.NodeName) == 0 {
+			// share pod is created once instance pod is scheduled
+			return nil
+		}
+		nodeName = pod.Spec.NodeName
+	}
+	// pods of accesses are only reachable through ingress, policy is applied before them
+	if err := r.applyOwned(codeServer, r.newSharePolicy(codeServer), &networkingv1.NetworkPolicy{}); err != nil {
+		return err
+	}
+	// all accesses were served by a single deployment before
+	if err := r.deleteResourceIfExists(&appsv1.Deployment{}, ChildName(ShareResource, codeServer.Name),
+		codeServer.Namespace); err != nil {
+		return err
+	}
+	if err := r.deleteResourceIfExists(&corev1.Service{}, ChildName(ShareResource, codeServer.Name),
+		codeServer.Namespace); err != nil {
+		return err
+	}
+	for _, access := range shareAccesses {
+		authName := ChildName(ShareAuthResource, codeServer.Name, accessName(access))
+		if len(active[access]) == 0 {
+			if err := r.deleteShareAccess(codeServer.Name, codeServer.Namespace, access); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(r.Options.Load().OAuth2ProxyURL) == 0 {
+			var lines []string
+			for _, collaborator := range active[access] {
+				password := passwords[collaboratorSecretKey(collaborator)]
+				if access == viewSessionAccess {
+					password = session.Password
+				}
+				lines = append(lines, htpasswdLine(collaborator, password))
+			}
+			sort.Strings(lines)
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      authName,
+					Namespace: codeServer.Namespace,
+				},
+				Data: map[string][]byte{"auth": []byte(strings.Join(lines, "\n") + "\n")},
+			}
+			if err := r.applyOwned(codeServer, secret, &corev1.Secret{}); err != nil {
+				return err
+			}
+		} else if err := r.deleteResourceIfExists(&corev1.Secret{}, authName, codeServer.Namespace); err != nil {
+			return err
+		}
+		if err := r.applyOwned(codeServer, r.newShareService(codeServer, access), &corev1.Service{}); err != nil {
+			return err
+		}
+		password := passwords[shareAccessKey(access)]
+		if access == viewSessionAccess {
+			password = session.Password
+		}
+		if err := r.applyOwned(codeServer, r.newShareDeployment(codeServer, access, password, nodeName),
+			&appsv1.Deployment{}); err != nil {
+			return err
+		}
+		if err := r.applyOwned(codeServer, r.newShareIngress(codeServer, access, active[access]),
+			&extv1.Ingress{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsAccessMode(modes []corev1.PersistentVolumeAccessMode, mode corev1.PersistentVolumeAccessMode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOwned applies desired object owned by instance, live is the empty object of the same kind.
+func (r *CodeServerReconciler) applyOwned(codeServer *csv1alpha1.CodeServer, desired, live client.Object) error {
+	setOwnedLabels(desired, codeServer.Name)
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: desired.GetName(), Namespace: desired.GetNamespace()},
+		live)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return r.applyResource(codeServer, desired, live, err == nil)
+}
+
+func shareLabels(name string) map[string]string {
+	return map[string]string{"app": "codeserver-share", "cs_name": name}
+}
+
+func shareAccessLabels(name string, access csv1alpha1.CollaboratorAccess) map[string]string {
+	ls := shareLabels(name)
+	ls["access"] = accessName(access)
+	return ls
+}
+
+// newShareDeployment returns the deployment of code server serving workspace to access, collaborators are
+// authenticated by ingress and then by password of code server, which is shared by collaborators of the access.
+// Pod is restarted when password changes.
+func (r *CodeServerReconciler) newShareDeployment(m *csv1alpha1.CodeServer, access csv1alpha1.CollaboratorAccess,
+	password []byte, nodeName string) *appsv1.Deployment {
+	replicas := int32(1)
+	podSpec := corev1.PodSpec{
+		NodeSelector: nodeSelectorForPod(m),
+		Volumes: []corev1.Volume{
+			{
+				Name: VSCodeProjectVolume,
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: m.Name,
+					},
+				},
+			},
+		},
+	}
+	if len(nodeName) == 0 {
+		nodeName = m.Annotations[PinnedNodeAnnotation]
+	}
+	pinPodToNode(&podSpec, nodeName)
+	port := sharePort(access)
+	args := []string{"--bind-addr", fmt.Sprintf("0.0.0.0:%d", port), "--auth", "password",
+		"--user-data-dir", ShareDataDir, "--disable-telemetry", VSCodeProjectDir}
+	if access == viewSessionAccess {
+		// support never touches the settings and extensions shared with collaborators
+		args = []string{"--bind-addr", fmt.Sprintf("0.0.0.0:%d", port), "--auth", "password",
+			"--user-data-dir", ViewSessionDataDir, "--extensions-dir", ViewSessionDataDir + "/extensions",
+			"--disable-telemetry", "--disable-update-check", VSCodeProjectDir}
+	}
+	secretName, secretKey := ChildName(CollaboratorsResource, m.Name), shareAccessKey(access)
+	if access == viewSessionAccess {
+		secretName, secretKey = ChildName(ViewSessionResource, m.Name), "password"
+	}
+	podSpec.Containers = append(podSpec.Containers, corev1.Container{
+		Name:            accessName(access),
+		Image:           m.Spec.Image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Args:            args,
+		Env: []corev1.EnvVar{
+			{
+				Name: "PASSWORD",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+						Key:                  secretKey,
+					},
+				},
+			},
+		},
+		Ports: []corev1.ContainerPort{{
+			ContainerPort: int32(port),
+			Name:          accessName(access),
+		}},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      VSCodeProjectVolume,
+				MountPath: VSCodeProjectDir,
+				ReadOnly:  shareReadOnly(access),
+			},
+		},
+	})
+	if access == viewSessionAccess {
+		addViewSessionSettings(m, &podSpec)
+	}
+	addSecurityContextForPod(m, &podSpec)
+	r.addPullSecretsForPod(m, &podSpec)
+	addRegistryMirrorsForPod(&podSpec, r.Options.Load().RegistryMirrors)
+	ls := shareAccessLabels(m.Name, access)
+	digest := sha256.Sum256(password)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ChildName(ShareAccessResource, m.Name, accessName(access)),
+			Namespace: m.Namespace,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: ls},
+			// both pods can't attach the volume on different nodes
+			Strategy: appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      ls,
+					Annotations: map[string]string{SharePasswordAnnotation: hex.EncodeToString(digest[:8])},
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+}
+
+func (r *CodeServerReconciler) newShareService(m *csv1alpha1.CodeServer,
+	access csv1alpha1.CollaboratorAccess) *corev1.Service {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ChildName(ShareAccessResource, m.Name, accessName(access)),
+			Namespace: m.Namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: shareAccessLabels(m.Name, access),
+			Ports: []corev1.ServicePort{
+				{
+					Name:       accessName(access),
+					Port:       int32(sharePort(access)),
+					Protocol:   corev1.ProtocolTCP,
+					TargetPort: intstr.FromInt(sharePort(access)),
+				},
+			},
+		},
+	}
+	addIPFamiliesForService(m, service)
+	return service
+}
+
+// newSharePolicy returns the network policy which only admits ingress controller to share pods, so that the
+// workspace can't be reached around the authentication of ingress.
+func (r *CodeServerReconciler) newSharePolicy(m *csv1alpha1.CodeServer) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ChildName(ShareResource, m.Name),
+			Namespace: m.Namespace,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: shareLabels(m.Name)},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					From: []networkingv1.NetworkPolicyPeer{
+						{
+							NamespaceSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{
+									corev1.LabelMetadataName: r.Options.Load().ShareIngressNamespace,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// newShareIngress returns the ingress of access, collaborators are authenticated by basic auth with their
+// passwords, or by oauth2 proxy which only allows their emails.
+func (r *CodeServerReconciler) newShareIngress(m *csv1alpha1.CodeServer, access csv1alpha1.CollaboratorAccess,
+	collaborators []string) *extv1.Ingress {
+	annotations := r.annotationsForIngress()
+	addCertificateAnnotation(m, annotations)
+	if len(r.Options.Load().OAuth2ProxyURL) == 0 {
+		annotations["nginx.ingress.kubernetes.io/auth-type"] = "basic"
+		annotations["nginx.ingress.kubernetes.io/auth-secret"] = ChildName(ShareAuthResource, m.Name,
+			accessName(access))
+		annotations["nginx.ingress.kubernetes.io/auth-realm"] = fmt.Sprintf("%s shared by %s", m.Name,
+			m.Annotations[UserAnnotation])
+		if access == viewSessionAccess {
+			annotations["nginx.ingress.kubernetes.io/auth-realm"] = fmt.Sprintf("view session of %s", m.Name)
+		}
+	} else {
+		sorted := append([]string{}, collaborators...)
+		sort.Strings(sorted)
+		proxy := strings.TrimSuffix(r.Options.Load().OAuth2ProxyURL, "/")
+		annotations["nginx.ingress.kubernetes.io/auth-url"] = fmt.Sprintf("%s/oauth2/auth?allowed_emails=%s", proxy,
+			url.QueryEscape(strings.Join(sorted, ",")))
+		annotations["nginx.ingress.kubernetes.io/auth-signin"] = proxy + "/oauth2/start?rd=https://$host$escaped_request_uri"
+	}
+	host := r.shareHost(m, access)
+	return &extv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        ChildName(ShareIngress, m.Name, accessName(access)),
+			Namespace:   m.Namespace,
+			Annotations: annotations,
+		},
+		Spec: extv1.IngressSpec{
+			TLS: []extv1.IngressTLS{
+				{
+					Hosts:      []string{host},
+					SecretName: r.Options.Load().HttpsSecretName,
+				},
+			},
+			Rules: []extv1.IngressRule{
+				{
+					Host: host,
+					IngressRuleValue: extv1.IngressRuleValue{
+						HTTP: &extv1.HTTPIngressRuleValue{
+							Paths: []extv1.HTTPIngressPath{
+								{
+									Path: "/",
+									Backend: extv1.IngressBackend{
+										ServiceName: ChildName(ShareAccessResource, m.Name,
+											accessName(access)),
+										ServicePort: intstr.FromInt(sharePort(access)),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// deleteShareAccess deletes the resources serving workspace to access.
+func (r *CodeServerReconciler) deleteShareAccess(name, namespace string, access csv1alpha1.CollaboratorAccess) error {
+	if err := r.deleteResourceIfExists(&extv1.Ingress{}, ChildName(ShareIngress, name, accessName(access)),
+		namespace); err != nil {
+		return err
+	}
+	if err := r.deleteResourceIfExists(&corev1.Secret{}, ChildName(ShareAuthResource, name, accessName(access)),
+		namespace); err != nil {
+		return err
+	}
+	if err := r.deleteResourceIfExists(&appsv1.Deployment{}, ChildName(ShareAccessResource, name,
+		accessName(access)), namespace); err != nil {
+		return err
+	}
+	return r.deleteResourceIfExists(&corev1.Service{}, ChildName(ShareAccessResource, name, accessName(access)),
+		namespace)
+}
+
+// deleteShareResources deletes the resources serving workspace to collaborators, passwords are kept unless
+// includePasswords so that collaborators keep their passwords while instance is inactive.
+func (r *CodeServerReconciler) deleteShareResources(name, namespace string, includePasswords bool) error {
+	share := ChildName(ShareResource, name)
+	if err := r.deleteResourceIfExists(&appsv1.Deployment{}, share, namespace); err != nil {
+		return err
+	}
+	if err := r.deleteResourceIfExists(&corev1.Service{}, share, namespace); err != nil {
+		return err
+	}
+	for _, access := range shareAccesses {
+		if err := r.deleteShareAccess(name, namespace, access); err != nil {
+			return err
+		}
+	}
+	if err := r.deleteResourceIfExists(&networkingv1.NetworkPolicy{}, share, namespace); err != nil {
+		return err
+	}
+	if !includePasswords {
+		return nil
+	}
+	if err := r.deleteResourceIfExists(&corev1.Secret{}, ChildName(ViewSessionResource, name),
+		namespace); err != nil {
+		return err
+	}
+	return r.deleteResourceIfExists(&corev1.Secret{}, ChildName(CollaboratorsResource, name), namespace)
+}
+
+// shareRequeue returns the seconds to requeue after so that access is removed once it expires.
+func shareRequeue(next time.Duration) int {
+	if next < 0 {
+		return -1
+	}
+	return int(next/time.Second) + 1
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"path"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	ConfigResource = "%s-config"
+	ConfigFile     = "config.yaml"
+	ConfigVolume   = "code-server-config"
+	ConfigDir      = "/etc/code-server"
+	// ConfigChecksumEnv rolls out pod once config changed since code server only reads config on start
+	ConfigChecksumEnv = "CODE_SERVER_CONFIG_CHECKSUM"
+)
+
+func codeServerConfigEnabled(m *csv1alpha1.CodeServer) bool {
+	return m.Spec.CodeServer != nil && len(m.Spec.CodeServer.Config) != 0
+}
+
+// renderCodeServerConfig renders config entries as yaml sorted by key, values which are neither booleans nor
+// numbers are quoted.
+func renderCodeServerConfig(config map[string]string) string {
+	var keys []string
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var lines []string
+	for _, key := range keys {
+		value := config[key]
+		if _, err := strconv.ParseBool(value); err != nil {
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				value = strconv.Quote(value)
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", key, value))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// codeServerArguments returns the arguments of instance and the one loading generated config.
+func codeServerArguments(m *csv1alpha1.CodeServer) []string {
+	if m.Spec.CodeServer == nil {
+		return nil
+	}
+	arguments := append([]string{}, m.Spec.CodeServer.Args...)
+	if codeServerConfigEnabled(m) {
+		arguments = append(arguments, "--config", path.Join(ConfigDir, ConfigFile))
+	}
+	return arguments
+}
+
+// addCodeServerConfigForPod mounts the generated config into code server container.
+func addCodeServerConfigForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	if !codeServerConfigEnabled(m) {
+		return
+	}
+	checksum := sha256.Sum256([]byte(renderCodeServerConfig(m.Spec.CodeServer.Config)))
+	for index := range podSpec.Containers {
+		container := &podSpec.Containers[index]
+		if container.Name != CSNAME {
+			continue
+		}
+		container.Env = append(container.Env, corev1.EnvVar{Name: ConfigChecksumEnv, Value: hex.EncodeToString(checksum[:])})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      ConfigVolume,
+			MountPath: ConfigDir,
+			ReadOnly:  true,
+		})
+	}
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: ConfigVolume,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: ChildName(ConfigResource, m.Name)},
+			},
+		},
+	})
+}
+
+// reconcileForCodeServerConfig keeps the ConfigMap holding config.yaml of code server in sync with spec.
+func (r *CodeServerReconciler) reconcileForCodeServerConfig(codeServer *csv1alpha1.CodeServer) error {
+	reqLogger := r.instanceLog(codeServer)
+	name := ChildName(ConfigResource, codeServer.Name)
+	if !codeServerConfigEnabled(codeServer) {
+		return r.deleteResourceIfExists(&corev1.ConfigMap{}, name, codeServer.Namespace)
+	}
+	data := map[string]string{ConfigFile: renderCodeServerConfig(codeServer.Spec.CodeServer.Config)}
+	oldConfig := &corev1.ConfigMap{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, oldConfig)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			reqLogger.Error(err, fmt.Sprintf("Failed to get config map for %s.", codeServer.Name))
+			return err
+		}
+		config := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: codeServer.Namespace,
+			},
+			Data: data,
+		}
+		setOwnedLabels(config, codeServer.Name)
+		// Set CodeServer instance as the owner of the config map.
+		controllerutil.SetControllerReference(codeServer, config, r.Scheme)
+		r.addCostLabels(codeServer, config)
+		reqLogger.Info("Creating code server config.")
+		if err = r.Client.Create(context.TODO(), config); err != nil {
+			reqLogger.Error(err, "Failed to create code server config.")
+			return err
+		}
+		r.recordCreated(codeServer, config)
+		return nil
+	}
+	if oldConfig.Data[ConfigFile] == data[ConfigFile] {
+		return nil
+	}
+	oldConfig.Data = data
+	reqLogger.Info("Updating code server config.")
+	if err = r.Client.Update(context.TODO(), oldConfig); err != nil {
+		reqLogger.Error(err, "Failed to update code server config.")
+		return err
+	}
+	r.recordUpdated(codeServer, oldConfig)
+	return nil
+}
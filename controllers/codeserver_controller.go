@@ -26,6 +26,7 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	extv1 "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
@@ -33,13 +34,18 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	"net/http"
 	"path"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	"strconv"
 	"strings"
 	"time"
@@ -52,55 +58,168 @@ const (
 	MaxActiveSeconds = 60 * 60 * 24
 	MaxKeepSeconds   = 60 * 60 * 24 * 30
 	HttpPort         = 8080
-	DefaultWorkspace = "/workspace"
-	IngressLimitKey  = "kubernetes.io/ingress-bandwidth"
-	EgressLimitKey   = "kubernetes.io/egress-bandwidth"
-	StorageEmptyDir  = "emptyDir"
-	InstanceEndpoint = "instanceEndpoint"
-	TerminalIngress  = "%s-terminal"
+	// VSCodeProjectDir is the workspace of vs code instance, backed by volume VSCodeProjectVolume
+	VSCodeProjectDir    = "/home/coder/project"
+	VSCodeProjectVolume = "code-server-project-dir"
+	ExporterPort        = 8000
+	DefaultWorkspace    = "/workspace"
+	IngressLimitKey     = "kubernetes.io/ingress-bandwidth"
+	EgressLimitKey      = "kubernetes.io/egress-bandwidth"
+	StorageEmptyDir     = "emptyDir"
+	InstanceEndpoint    = "instanceEndpoint"
+	TerminalIngress     = "%s-terminal"
 )
 
 // CodeServerReconciler reconciles a CodeServer object
 type CodeServerReconciler struct {
 	client.Client
-	Log     logr.Logger
-	Scheme  *runtime.Scheme
-	Options *CodeServerOption
-	ReqCh   chan CodeServerRequest
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Options  *CodeServerOption
+	Watches  *WatchQueue
+	Auditor  *Auditor
+	Notifier *Notifier
+	Recorder record.EventRecorder
+	// Scheduler prioritizes user facing work and rate limits instance creation, no limit applies if nil.
+	Scheduler *ReconcileScheduler
+	// Runtimes are the registered runtime backends keyed by lower cased runtime type.
+	Runtimes map[csv1alpha1.RuntimeType]Runtime
+	// Tracer records spans of reconciles, nil if tracing is disabled.
+	Tracer *Tracer
+	// probeTransport is shared by readiness probes of instances.
+	probeTransport *http.Transport
+	// certificates probes certificates served on hosts of instances.
+	certificates *CertificateProber
+	// acmeOrders queues the certificates ordered by runACMEOrders.
+	acmeOrders chan *acmeOrderRequest
 }
 
 // +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeservers,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeservers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeservers/finalizers,verbs=update
 // +kubebuilder:rbac:groups=,resources=services,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=,resources=endpoints,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=,resources=events,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=extensions,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=extensions,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups=,resources=secrets,verbs=get;list;watch
-func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+// +kubebuilder:rbac:groups=apps,resources=deployments;daemonsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=,resources=nodes/proxy,verbs=get
+// +kubebuilder:rbac:groups=,resources=nodes;persistentvolumes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=metrics.k8s.io,resources=pods,verbs=get;list
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=networking.istio.io,resources=virtualservices;destinationrules,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=traefik.containo.us,resources=ingressroutes;middlewares,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeservertemplates,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeserverfleetstatuses,verbs=get;list;watch;create;update
+// +kubebuilder:rbac:groups=kubefledged.io,resources=imagecaches,verbs=get;list;watch;create;update;patch;delete
+func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
 	reQueueInterval := -1
 	_ = context.Background()
-	reqLogger := r.Log.WithValues("codeserver", req.NamespacedName)
+	reqLogger := keyLogger(r.Log, req.NamespacedName)
+	span := r.Tracer.StartInstance(nil, req.NamespacedName, "reconcile")
+	defer func() {
+		span.End(err)
+	}()
 	// Fetch the CodeServer instance
 	codeServer := &csv1alpha1.CodeServer{}
-	err := r.Client.Get(context.TODO(), req.NamespacedName, codeServer)
+	err = r.Client.Get(context.TODO(), req.NamespacedName, codeServer)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			reqLogger.Info("CodeServer has been deleted. Trying to delete its related resources.")
 			r.deleteFromInactiveWatch(req.NamespacedName)
 			r.deleteFromRecycleWatch(req.NamespacedName)
+			r.Scheduler.Forget(req.NamespacedName)
 			if err := r.deleteCodeServerResource(req.Name, req.Namespace, codeServer.Spec.StorageName,
 				true); err != nil {
 				return reconcile.Result{Requeue: true}, err
 			}
+			if !r.Options.Load().AuditDeletionWebhook {
+				// deletion has been recorded with its requester by webhook otherwise
+				codeServer.Name, codeServer.Namespace = req.Name, req.Namespace
+				r.Auditor.Record(codeServer, AuditDeleted, "code server has been deleted")
+			}
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
 		reqLogger.Error(err, "Failed to get CoderServer.")
 		return reconcile.Result{}, err
 	}
+	// owned resources of code servers in other shards are still watched
+	if !InShard(r.Options, codeServer) {
+		return reconcile.Result{}, nil
+	}
+	reqLogger = r.instanceLog(codeServer)
+	if !codeServer.DeletionTimestamp.IsZero() {
+		reqLogger.Info("CodeServer is being deleted. Trying to clean up its resources.")
+		return r.finalizeCodeServer(codeServer)
+	}
+	// paused instance and its generated resources are left untouched until resumed, only deletion goes on
+	if updated, err := r.reconcilePaused(codeServer); err != nil {
+		reqLogger.Error(err, "Failed to update paused condition of CoderServer.")
+		return reconcile.Result{Requeue: true}, err
+	} else if updated || paused(codeServer) {
+		return reconcile.Result{}, nil
+	}
+	if updated, err := r.ensureFinalizer(codeServer); err != nil {
+		reqLogger.Error(err, "Failed to add finalizer to CoderServer.")
+		return reconcile.Result{Requeue: true}, err
+	} else if updated {
+		// the update triggers another reconcile
+		return reconcile.Result{}, nil
+	}
+	if updated, err := r.assignShard(codeServer); err != nil {
+		reqLogger.Error(err, "Failed to assign shard to CoderServer.")
+		return reconcile.Result{Requeue: true}, err
+	} else if updated {
+		return reconcile.Result{}, nil
+	}
+	if updated, err := r.reconcileForDefaults(codeServer); err != nil {
+		reqLogger.Error(err, "Failed to apply defaults to CoderServer.")
+		return reconcile.Result{Requeue: true}, err
+	} else if updated {
+		return reconcile.Result{}, nil
+	}
+	if updated, err := r.reconcileForNaming(codeServer); err != nil {
+		reqLogger.Error(err, "Failed to migrate names of resources of CoderServer.")
+		return reconcile.Result{Requeue: true}, err
+	} else if updated {
+		return reconcile.Result{}, nil
+	}
+	if updated, err := r.reconcileForClone(codeServer); err != nil {
+		reqLogger.Error(err, "Failed to clone CoderServer.")
+		return reconcile.Result{Requeue: true}, err
+	} else if updated {
+		return reconcile.Result{}, nil
+	}
+	if exporting, err := r.reconcileForExport(codeServer); err != nil {
+		reqLogger.Error(err, "Failed to export workspace of CoderServer.")
+		reQueueInterval = 20
+	} else if exporting {
+		reQueueInterval = 5
+	}
+	if dryRunEnabled(r.Options, codeServer) {
+		reqLogger.Info("CodeServer is in dry run, recording its manifests.")
+		return r.reconcileDryRun(codeServer)
+	} else if err := r.deleteResourceIfExists(&corev1.ConfigMap{}, ChildName(DryRunResource, codeServer.Name),
+		codeServer.Namespace); err != nil {
+		return reconcile.Result{Requeue: true}, err
+	}
+	// user facing work preempts background work
+	if foregroundWork(codeServer) {
+		defer r.Scheduler.BeginForeground()()
+	} else {
+		release, ok := r.Scheduler.BeginBackground(req.NamespacedName, urgentWork(codeServer))
+		if !ok {
+			return reconcile.Result{RequeueAfter: BackgroundRetryDelay}, nil
+		}
+		defer release()
+	}
 
 	//case1. code server now stays inactive, we will delete all resources except volume.
 	//case2. code server will be directly deleted after RecycleAfterSeconds if.
@@ -125,6 +244,16 @@ func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			false); err != nil {
 			return reconcile.Result{Requeue: true}, err
 		}
+		if err := r.deleteRuntimeResource(codeServer); err != nil {
+			return reconcile.Result{Requeue: true}, err
+		}
+		// route requests to activator which wakes the instance up
+		if err := r.reconcileForActivator(codeServer); err != nil {
+			return reconcile.Result{Requeue: true}, err
+		}
+		if err := r.updateCost(codeServer); err != nil {
+			return reconcile.Result{Requeue: true}, err
+		}
 	} else if !HasCondition(codeServer.Status, csv1alpha1.ServerRecycled) &&
 		*codeServer.Spec.InactiveAfterSeconds == 0 && HasCondition(codeServer.Status, csv1alpha1.ServerReady) {
 		current := metav1.Time{
@@ -150,54 +279,212 @@ func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		//remove it from watch list
 		r.deleteFromInactiveWatch(req.NamespacedName)
 		r.deleteFromRecycleWatch(req.NamespacedName)
+		// runtime resources left here are cleaned up by finalizer when code server is deleted
+		if err := r.cleanupRuntimeResource(codeServer); err != nil {
+			reqLogger.Error(err, "Failed to clean up runtime resources.")
+		}
 		if err := r.deleteCodeServerResource(codeServer.Name, codeServer.Namespace, codeServer.Spec.StorageName,
 			true); err != nil {
 			return reconcile.Result{Requeue: true}, err
 		}
+		if err := r.deleteRuntimeResource(codeServer); err != nil {
+			return reconcile.Result{Requeue: true}, err
+		}
+		// activator tells users the instance has been recycled
+		if err := r.reconcileForActivator(codeServer); err != nil {
+			return reconcile.Result{Requeue: true}, err
+		}
+		if err := r.updateCost(codeServer); err != nil {
+			return reconcile.Result{Requeue: true}, err
+		}
 	} else {
+		managed := append([]csv1alpha1.ManagedResource{}, codeServer.Status.ManagedResources...)
 		var failed error
 		var service *corev1.Service
+		var sshService *corev1.Service
 		var deployment *appsv1.Deployment
 		var condition csv1alpha1.ServerCondition
 		// 0/5 check whether tls secret exists
-		_, failed = r.findLegalCertSecrets(codeServer.Name, codeServer.Namespace, r.Options.HttpsSecretName)
+		var tlsSecret *corev1.Secret
+		if r.acmeEnabled(codeServer) {
+			// instance is served with the default certificate of ingress until its own one has been issued
+			tlsSecret, failed = r.reconcileForACME(codeServer)
+		} else {
+			tlsSecret, failed = r.findLegalCertSecrets(codeServer.Name, codeServer.Namespace, r.Options.Load().HttpsSecretName)
+		}
+		// track the rotation of certificate until host of instance serves it
+		certificateChanged, certificateStale := false, false
+		if failed == nil && tlsSecret != nil {
+			certificateChanged, certificateStale = r.reconcileForCertificate(codeServer, tlsSecret)
+		}
+		var instanceRuntime Runtime
 		if failed == nil {
-			// check LxdClientSecretName secret if needed
-			if strings.EqualFold(string(codeServer.Spec.Runtime), string(csv1alpha1.RuntimeLxd)) {
-				if len(r.Options.LxdClientSecretName) == 0 {
-					_, failed = r.findLegalCertSecrets(codeServer.Name, codeServer.Namespace, r.Options.LxdClientSecretName)
-				}
-			}
+			instanceRuntime, failed = r.getRuntime(codeServer)
+		}
+		if failed == nil {
+			failed = r.reconcileForPullSecret(codeServer)
 		}
 		// 1/5: reconcile PVC
+		volumeBound := true
 		if failed == nil {
 			if r.needDeployPVC(codeServer.Spec.StorageName) {
-				_, failed = r.reconcileForPVC(codeServer)
+				var pvc *corev1.PersistentVolumeClaim
+				stage := span.Child("reconcile pvc")
+				pvc, failed = r.reconcileForPVC(codeServer)
+				stage.End(failed)
+				volumeBound = failed == nil && pvc.Status.Phase == corev1.ClaimBound
+				if volumeBound {
+					failed = r.recordVolumeBound(codeServer, pvc)
+				}
 			}
 		}
+		// home volume of user survives recycles of instance
+		if failed == nil {
+			failed = r.reconcileForHome(codeServer)
+		}
+		// user data of code server is kept on volume according to persistence strategy
+		if failed == nil {
+			failed = r.reconcileForUserData(codeServer)
+		}
 		// 2/5: reconcile service
 		if failed == nil {
+			stage := span.Child("reconcile service")
 			service, failed = r.reconcileForService(codeServer)
+			stage.End(failed)
+		}
+		// reconcile ssh access if enabled
+		if failed == nil {
+			sshService, failed = r.reconcileForSSH(codeServer)
+		}
+		// reconcile additional tcp and udp ports
+		var portsService *corev1.Service
+		if failed == nil {
+			portsService, failed = r.reconcileForAdditionalPorts(codeServer)
+		}
+		// reconcile generated password or token
+		authSecret := ""
+		if failed == nil {
+			authSecret, failed = r.reconcileForAuth(codeServer)
+		}
+		// reconcile token of status exporter
+		if failed == nil {
+			failed = r.reconcileForExporterToken(codeServer)
+		}
+		// reconcile config.yaml of code server
+		if failed == nil && strings.EqualFold(string(codeServer.Spec.Runtime), string(csv1alpha1.RuntimeCode)) {
+			failed = r.reconcileForCodeServerConfig(codeServer)
+		}
+		// provision standard editor configuration from settings sync server
+		if failed == nil {
+			failed = r.reconcileForSettingsSync(codeServer)
+		}
+		// reconcile egress network policy if direct egress is blocked
+		if failed == nil {
+			failed = r.reconcileForEgress(codeServer)
 		}
 		// 3/5:reconcile ingress
 		if failed == nil {
-			_, failed = r.reconcileForIngress(codeServer)
+			stage := span.Child("reconcile route")
+			failed = r.reconcileForRoute(codeServer)
+			stage.End(failed)
 		}
-		// 4/5: reconcile deployment
+		// route ports exposed on demand
 		if failed == nil {
+			failed = r.reconcileForPreview(codeServer)
+		}
+		// instance woken by activator is no longer inactive
+		if failed == nil {
+			failed = r.deleteActivatorService(codeServer.Name, codeServer.Namespace)
+		}
+		if inactive := GetCondition(codeServer.Status, csv1alpha1.ServerInactive); inactive != nil &&
+			inactive.Status == corev1.ConditionFalse && !HasCondition(codeServer.Status, csv1alpha1.ServerReady) {
+			r.deleteFromRecycleWatch(req.NamespacedName)
+		}
+		// populate workspace from archive and prepare its ownership for rootless instance before deployment
+		ownershipReady := true
+		if failed == nil {
+			ownershipReady, failed = r.reconcileForArchiveImport(codeServer)
+		}
+		if failed == nil && ownershipReady {
+			ownershipReady, failed = r.reconcileForWorkspaceOwnership(codeServer)
+		}
+		// apply resource recommendations before instance starts
+		rightSizingChanged := false
+		if failed == nil && ownershipReady {
+			rightSizingChanged, failed = r.reconcileForRightSizing(codeServer)
+		}
+		// pin instance to the node of its local workspace volume or host paths
+		if failed == nil && ownershipReady {
+			failed = r.reconcileForPinning(codeServer)
+		}
+		// place instance on backend of runtime, e.g. lxd remote
+		if failed == nil && ownershipReady {
+			failed = r.reconcileForRuntimeScheduling(codeServer)
+		}
+		// rate limit creation of new instances
+		throttled := false
+		if failed == nil && ownershipReady && !r.deploymentExists(codeServer) && !r.Scheduler.AllowCreate() {
+			throttled = true
+		}
+		// 4/5: reconcile deployment
+		if failed == nil && ownershipReady && !throttled {
+			stage := span.Child("reconcile deployment")
 			deployment, failed = r.reconcileForDeployment(codeServer)
+			stage.End(failed)
+		}
+		// share workspace with collaborators until their access expires
+		collaboratorsChanged := false
+		if failed == nil && deployment != nil {
+			var next time.Duration
+			collaboratorsChanged, next, failed = r.reconcileForCollaborators(codeServer)
+			if requeue := shareRequeue(next); requeue >= 0 && (reQueueInterval < 0 || requeue < reQueueInterval) {
+				reQueueInterval = requeue
+			}
+		}
+		// snapshot or restore instance if requested
+		if failed == nil {
+			if pending, err := r.reconcileForRuntimeSnapshot(codeServer, instanceRuntime); err != nil {
+				reqLogger.Error(err, "Failed to snapshot or restore instance.")
+				reQueueInterval = 20
+			} else if pending && (reQueueInterval < 0 || reQueueInterval > LxdOperationPollInterval) {
+				reQueueInterval = LxdOperationPollInterval
+			}
 		}
 		// 5/5: update code server status
+		statusStage := span.Child("reconcile status")
+		defer statusStage.End(nil)
 		createCondition := false
 		if !HasCondition(codeServer.Status, csv1alpha1.ServerCreated) {
 			createdCondition := NewStateCondition(csv1alpha1.ServerCreated,
 				"code server has been accepted", map[string]string{}, corev1.ConditionTrue)
 			createCondition = SetCondition(&codeServer.Status, createdCondition)
 		}
-		if failed == nil {
+		var pod *corev1.Pod
+		if failed == nil && deployment != nil {
+			if pod, err = r.latestPod(codeServer); err != nil {
+				reqLogger.Error(err, "Failed to get pod of code server.")
+			}
+		}
+		stepsChanged := false
+		if failed == nil && !ownershipReady {
+			condition = NewStateCondition(csv1alpha1.ServerReady,
+				"waiting workspace volume to be prepared", map[string]string{}, corev1.ConditionFalse)
+			reQueueInterval = 5
+		} else if failed == nil && throttled {
+			condition = NewStateCondition(csv1alpha1.ServerReady,
+				"waiting instance creation rate limit", map[string]string{}, corev1.ConditionFalse)
+			reQueueInterval = 1
+		} else if failed == nil {
+			var pendingStep *csv1alpha1.ServerCondition
+			stepsChanged, pendingStep = reconcileStartupSteps(codeServer, pod)
 			condition = NewStateCondition(csv1alpha1.ServerReady,
 				"code server now available", map[string]string{}, corev1.ConditionTrue)
-			if !HasDeploymentCondition(deployment.Status, appsv1.DeploymentAvailable) || !r.serverReady(
+			if pendingStep != nil {
+				// ready is only declared once init containers, extensions and bootstrap scripts finished
+				condition.Status = corev1.ConditionFalse
+				condition.Reason = fmt.Sprintf("waiting %s: %s", pendingStep.Type, pendingStep.Reason)
+				reQueueInterval = 5
+			} else if !HasDeploymentCondition(deployment.Status, appsv1.DeploymentAvailable) || !r.serverReady(
 				codeServer) {
 				condition.Status = corev1.ConditionFalse
 				condition.Reason = "waiting deployment to be available and endpoint ready"
@@ -208,17 +495,20 @@ func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 				}
 			} else {
 				//add it to watch list
-				var endPoint string
-				// No matter tls is enabled or nor we both expose upstream via http for internal probe
-				endPoint = fmt.Sprintf("http://%s:%d/%s", service.Spec.ClusterIP, HttpPort,
-					strings.TrimLeft(codeServer.Spec.ConnectProbe, "/"))
-				condition.Message[InstanceEndpoint] = r.getInstanceEndpoint(codeServer)
+				endPoint, notifyEndpoint := instanceRuntime.Probe(codeServer, service)
+				condition.Message[InstanceEndpoint] = instanceRuntime.URL(codeServer)
+				for key, value := range sshConnectionInfo(sshService) {
+					condition.Message[key] = value
+				}
+				for key, value := range additionalPortsInfo(portsService) {
+					condition.Message[key] = value
+				}
 
 				boundStatus := GetCondition(codeServer.Status, csv1alpha1.ServerBound)
 				if (codeServer.Spec.InactiveAfterSeconds == nil) || *codeServer.Spec.InactiveAfterSeconds < 0 || *codeServer.Spec.InactiveAfterSeconds >= MaxActiveSeconds {
 					// we keep the instance within MaxActiveSeconds maximumly
 					if boundStatus != nil && boundStatus.Status == corev1.ConditionTrue {
-						r.addToInactiveWatch(req.NamespacedName, MaxActiveSeconds, endPoint)
+						r.addToInactiveWatch(codeServer, MaxActiveSeconds, endPoint, notifyEndpoint)
 						reqLogger.Info(fmt.Sprintf("Code server will be disactived after %d non-connection.",
 							MaxActiveSeconds))
 					}
@@ -227,7 +517,8 @@ func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 					reqLogger.Info("Code server will never be disactived")
 				} else {
 					if boundStatus != nil && boundStatus.Status == corev1.ConditionTrue {
-						r.addToInactiveWatch(req.NamespacedName, *codeServer.Spec.InactiveAfterSeconds, endPoint)
+						r.addToInactiveWatch(codeServer, *codeServer.Spec.InactiveAfterSeconds, endPoint,
+							notifyEndpoint)
 						reqLogger.Info(fmt.Sprintf("Code server will be disactived after %d non-connection.",
 							*codeServer.Spec.InactiveAfterSeconds))
 					}
@@ -239,6 +530,41 @@ func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 				"code server errored", map[string]string{"detail": failed.Error()}, corev1.ConditionTrue)
 		}
 		updateCondition := SetCondition(&codeServer.Status, condition)
+		failedChanged, rollbackImage := false, ""
+		if failed == nil {
+			failedChanged, rollbackImage = r.reconcileCrashLoop(codeServer, pod, condition)
+		}
+		gpuChanged := false
+		if failed == nil {
+			allocation := r.gpuAllocation(codeServer)
+			if !equality.Semantic.DeepEqual(allocation, codeServer.Status.GPUAllocation) {
+				codeServer.Status.GPUAllocation = allocation
+				gpuChanged = true
+			}
+		}
+		progressChanged := false
+		if failed == nil {
+			progress := provisioningProgress(codeServer, pod, volumeBound)
+			if !equality.Semantic.DeepEqual(progress, codeServer.Status.Progress) {
+				codeServer.Status.Progress = progress
+				progressChanged = true
+			}
+		}
+		driftChanged := !equality.Semantic.DeepEqual(managed, codeServer.Status.ManagedResources)
+		if reconcileDriftCondition(codeServer) {
+			driftChanged = true
+		}
+		firstReadyChanged := false
+		if codeServer.Status.FirstReadyTime == nil && HasCondition(codeServer.Status, csv1alpha1.ServerReady) {
+			now := metav1.Now()
+			codeServer.Status.FirstReadyTime = &now
+			firstReadyChanged = true
+		}
+		authChanged := false
+		if failed == nil && codeServer.Status.AuthSecretName != authSecret {
+			codeServer.Status.AuthSecretName = authSecret
+			authChanged = true
+		}
 		boundCondition := false
 		//if it's ready and missing server bound status, add default condition here.
 		if HasCondition(codeServer.Status, csv1alpha1.ServerReady) && MissingCondition(
@@ -247,7 +573,10 @@ func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 				"code server waiting to be bound", map[string]string{}, corev1.ConditionFalse)
 			boundCondition = SetCondition(&codeServer.Status, additionCondition)
 		}
-		if createCondition || updateCondition || boundCondition {
+		costChanged := r.reconcileCost(codeServer)
+		if createCondition || updateCondition || boundCondition || gpuChanged || rightSizingChanged || authChanged ||
+			stepsChanged || progressChanged || failedChanged || driftChanged || firstReadyChanged || costChanged ||
+			collaboratorsChanged || certificateChanged {
 			updateStatus := codeServer.Status
 			err = r.Client.Get(context.TODO(), req.NamespacedName, codeServer)
 			if err != nil {
@@ -260,12 +589,34 @@ func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 				reqLogger.Error(err, "Failed to update code server status.")
 				return reconcile.Result{Requeue: true}, nil
 			}
+			if createCondition {
+				r.Auditor.Record(codeServer, AuditCreated, "code server has been accepted")
+			}
+			if updateCondition && condition.Type == csv1alpha1.ServerReady && condition.Status == corev1.ConditionTrue {
+				r.Auditor.Record(codeServer, AuditReady, condition.Message[InstanceEndpoint])
+				r.Notifier.Notify(codeServer, csv1alpha1.NotifyReady, condition.Message[InstanceEndpoint])
+				r.Recorder.Eventf(codeServer, corev1.EventTypeNormal, EventReady, "Code server is ready at %s",
+					condition.Message[InstanceEndpoint])
+			}
+			if updateCondition && condition.Type == csv1alpha1.ServerErrored {
+				r.Notifier.Notify(codeServer, csv1alpha1.NotifyFailed, condition.Message["detail"])
+				r.Recorder.Event(codeServer, corev1.EventTypeWarning, EventReconcileFailed, condition.Message["detail"])
+			}
 		}
 		if failed != nil {
 			return reconcile.Result{
 				Requeue:      true,
 				RequeueAfter: time.Second * 20}, failed
 		}
+		if len(rollbackImage) != 0 {
+			if err := r.rollbackImage(req.NamespacedName, rollbackImage); err != nil {
+				return reconcile.Result{Requeue: true}, err
+			}
+			return reconcile.Result{Requeue: true}, nil
+		}
+		if certificateStale && (reQueueInterval < 0 || reQueueInterval > CertificateRecheckSeconds) {
+			reQueueInterval = CertificateRecheckSeconds
+		}
 	}
 	if reQueueInterval >= 0 {
 		return reconcile.Result{Requeue: true, RequeueAfter: time.Second * time.Duration(reQueueInterval)}, nil
@@ -274,14 +625,19 @@ func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 
 }
 
-func (r *CodeServerReconciler) addToInactiveWatch(resource types.NamespacedName, duration int64, endpoint string) {
+func (r *CodeServerReconciler) addToInactiveWatch(m *csv1alpha1.CodeServer, duration int64, endpoint,
+	notifyEndpoint string) {
 	request := CodeServerRequest{
-		resource: resource,
-		duration: duration,
-		operate:  AddInactiveWatch,
-		endpoint: endpoint,
-	}
-	r.ReqCh <- request
+		resource:       types.NamespacedName{Namespace: m.Namespace, Name: m.Name},
+		duration:       duration,
+		operate:        AddInactiveWatch,
+		endpoint:       endpoint,
+		notifyEndpoint: notifyEndpoint,
+		activity:       m.Spec.Activity.DeepCopy(),
+		host:           r.activityHost(m),
+		pendingSince:   pendingRecycleSince(m, r.Options.Load().InactiveGracePeriod),
+	}
+	r.Watches.Add(request)
 }
 
 func (r *CodeServerReconciler) deleteFromInactiveWatch(resource types.NamespacedName) {
@@ -289,11 +645,11 @@ func (r *CodeServerReconciler) deleteFromInactiveWatch(resource types.Namespaced
 		resource: resource,
 		operate:  DeleteInactiveWatch,
 	}
-	r.ReqCh <- request
+	r.Watches.Add(request)
 }
 
 func (r *CodeServerReconciler) findLegalCertSecrets(name, namespace, secretName string) (*corev1.Secret, error) {
-	reqLogger := r.Log.WithValues("namespace", namespace, "name", name)
+	reqLogger := r.Log.WithValues("instance", name, "namespace", namespace)
 	tlsSecret := &corev1.Secret{}
 	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: secretName, Namespace: namespace}, tlsSecret)
 	if err == nil {
@@ -321,7 +677,7 @@ func (r *CodeServerReconciler) addToRecycleWatch(resource types.NamespacedName,
 		duration:     duration,
 		inactiveTime: inactivetime,
 	}
-	r.ReqCh <- request
+	r.Watches.Add(request)
 }
 
 func (r *CodeServerReconciler) deleteFromRecycleWatch(resource types.NamespacedName) {
@@ -329,11 +685,11 @@ func (r *CodeServerReconciler) deleteFromRecycleWatch(resource types.NamespacedN
 		resource: resource,
 		operate:  DeleteRecycleWatch,
 	}
-	r.ReqCh <- request
+	r.Watches.Add(request)
 }
 
 func (r *CodeServerReconciler) deleteCodeServerResource(name, namespace string, storageName string, includePVC bool) error {
-	reqLogger := r.Log.WithValues("namespace", name, "name", namespace)
+	reqLogger := r.Log.WithValues("instance", name, "namespace", namespace)
 	reqLogger.Info("Deleting code server resources.")
 	//delete ingress
 	ing := &extv1.Ingress{}
@@ -374,6 +730,70 @@ func (r *CodeServerReconciler) deleteCodeServerResource(name, namespace string,
 	} else if !errors.IsNotFound(err) {
 		reqLogger.Info(fmt.Sprintf("failed to get development resource for deletion: %v", err))
 	}
+	//delete mesh routing
+	if len(r.Options.Load().MeshGateway) != 0 {
+		if err = r.deleteMeshResources(name, namespace); err != nil {
+			return err
+		}
+	}
+	if r.Options.Load().IngressProvider == IngressProviderTraefik {
+		if err = r.deleteTraefikResources(name, namespace); err != nil {
+			return err
+		}
+	}
+	//delete preview ingress
+	err = r.deleteResourceIfExists(&extv1.Ingress{}, ChildName(PreviewResource, name), namespace)
+	if err != nil {
+		return err
+	}
+	err = r.deleteACMEChallenge(name, namespace)
+	if err != nil {
+		return err
+	}
+	//delete egress network policy
+	err = r.deleteResourceIfExists(&networkingv1.NetworkPolicy{}, ChildName(EgressResource, name), namespace)
+	if err != nil {
+		return err
+	}
+	//delete ssh service and secret
+	err = r.deleteResourceIfExists(&corev1.Service{}, ChildName(SSHResource, name), namespace)
+	if err != nil {
+		return err
+	}
+	err = r.deleteResourceIfExists(&corev1.Secret{}, ChildName(SSHResource, name), namespace)
+	if err != nil {
+		return err
+	}
+	//delete workspace shared with collaborators
+	err = r.deleteShareResources(name, namespace, includePVC)
+	if err != nil {
+		return err
+	}
+	err = r.deleteResourceIfExists(&corev1.ConfigMap{}, ChildName(ConfigResource, name), namespace)
+	if err != nil {
+		return err
+	}
+	//generated password, external ports and issued certificate are kept until instance is recycled
+	if includePVC {
+		err = r.deleteAdditionalPorts(name, namespace)
+		if err != nil {
+			return err
+		}
+		err = r.deleteResourceIfExists(&corev1.Secret{}, ChildName(AuthResource, name), namespace)
+		if err != nil {
+			return err
+		}
+		err = r.deleteResourceIfExists(&corev1.Secret{}, ChildName(AccessResource, name), namespace)
+		if err != nil {
+			return err
+		}
+		if len(r.Options.Load().ACMEDirectoryURL) != 0 {
+			err = r.deleteResourceIfExists(&corev1.Secret{}, ChildName(ACMESecretResource, name), namespace)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	if includePVC && r.needDeployPVC(storageName) {
 		//delete pvc
 		pvc := &corev1.PersistentVolumeClaim{}
@@ -388,12 +808,35 @@ func (r *CodeServerReconciler) deleteCodeServerResource(name, namespace string,
 		} else if !errors.IsNotFound(err) {
 			reqLogger.Info(fmt.Sprintf("failed to get PVC resource for deletion: %v", err))
 		}
+		err = r.deleteResourceIfExists(&corev1.PersistentVolumeClaim{}, ChildName(UserDataResource, name),
+			namespace)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteResourceIfExists deletes the resource with specified name, error of not found is ignored.
+func (r *CodeServerReconciler) deleteResourceIfExists(obj client.Object, name, namespace string) error {
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, obj)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	err = r.Client.Delete(context.TODO(), obj)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
 	}
+	r.Log.WithValues("namespace", namespace, "name", name).Info(
+		fmt.Sprintf("%T resource has been successfully deleted.", obj))
 	return nil
 }
 
 func (r *CodeServerReconciler) reconcileForPVC(codeServer *csv1alpha1.CodeServer) (*corev1.PersistentVolumeClaim, error) {
-	reqLogger := r.Log.WithValues("namespace", codeServer.Namespace, "name", codeServer.Name)
+	reqLogger := r.instanceLog(codeServer)
 	reqLogger.Info("Reconciling persistent volume claim.")
 	//reconcile pvc for code server
 	newPvc, err := r.newPVC(codeServer)
@@ -401,15 +844,18 @@ func (r *CodeServerReconciler) reconcileForPVC(codeServer *csv1alpha1.CodeServer
 		reqLogger.Error(err, "Failed to create new PersistentVolumeClaim.")
 		return nil, err
 	}
+	setOwnedLabels(newPvc, codeServer.Name)
 	oldPvc := &corev1.PersistentVolumeClaim{}
 	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: codeServer.Name, Namespace: codeServer.Namespace}, oldPvc)
 	if err != nil && errors.IsNotFound(err) {
 		reqLogger.Info("Creating a PersistentVolumeClaim.")
+		r.addCostLabels(codeServer, newPvc)
 		err = r.Client.Create(context.TODO(), newPvc)
 		if err != nil {
 			reqLogger.Error(err, "Failed to create PersistentVolumeClaim.")
 			return nil, err
 		}
+		r.recordCreated(codeServer, newPvc)
 		return newPvc, nil
 	} else {
 		if err != nil {
@@ -417,6 +863,10 @@ func (r *CodeServerReconciler) reconcileForPVC(codeServer *csv1alpha1.CodeServer
 			reqLogger.Error(err, fmt.Sprintf("Failed to get PVC for %s.", codeServer.Name))
 			return nil, err
 		}
+		if err = r.adoptResource(codeServer, oldPvc); err != nil {
+			reqLogger.Error(err, "Failed to adopt PersistentVolumeClaim.")
+			return nil, err
+		}
 		if needUpdatePVC(oldPvc, newPvc) {
 			reqLogger.Error(err, "Updating PersistentVolumeClaim is not supported.")
 			return oldPvc, nil
@@ -426,12 +876,12 @@ func (r *CodeServerReconciler) reconcileForPVC(codeServer *csv1alpha1.CodeServer
 }
 
 func (r *CodeServerReconciler) serverReady(codeServer *csv1alpha1.CodeServer) bool {
-	reqLogger := r.Log.WithValues("namespace", codeServer.Namespace, "name", codeServer.Name)
+	reqLogger := r.instanceLog(codeServer)
 	reqLogger.Info("Waiting Service Ready.")
 	instEndpoint := ""
-	instEndpoint = fmt.Sprintf("https://%s.%s/%s", codeServer.Spec.Subdomain, r.Options.DomainName,
-		strings.TrimLeft(codeServer.Spec.ConnectProbe, "/"))
-	resp, err := http.Get(instEndpoint)
+	instEndpoint = r.instanceURL(codeServer, "https", connectProbe(codeServer))
+	client := http.Client{Transport: r.probeTransport}
+	resp, err := client.Get(instEndpoint)
 	if err != nil {
 		reqLogger.Error(err, fmt.Sprintf("failed to detect instance endpoint for code server %s",
 			codeServer.Name))
@@ -445,7 +895,7 @@ func (r *CodeServerReconciler) serverReady(codeServer *csv1alpha1.CodeServer) bo
 	return false
 }
 func (r *CodeServerReconciler) reconcileForDeployment(codeServer *csv1alpha1.CodeServer) (*appsv1.Deployment, error) {
-	reqLogger := r.Log.WithValues("namespace", codeServer.Namespace, "name", codeServer.Name)
+	reqLogger := r.instanceLog(codeServer)
 	reqLogger.Info("Reconciling Deployment.")
 	//reconcile pvc for code server
 	newDev, err := r.newDeployment(codeServer)
@@ -453,100 +903,102 @@ func (r *CodeServerReconciler) reconcileForDeployment(codeServer *csv1alpha1.Cod
 		reqLogger.Error(err, "Failed to generate Deployment.")
 		return nil, err
 	}
+	setOwnedLabels(newDev, codeServer.Name)
+	hash := specHash(newDev.Spec)
 	oldDev := &appsv1.Deployment{}
 	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: codeServer.Name, Namespace: codeServer.Namespace}, oldDev)
-	if err != nil && errors.IsNotFound(err) {
-		reqLogger.Info("Creating a Deployment.")
-		err = r.Client.Create(context.TODO(), newDev)
-		if err != nil {
-			reqLogger.Error(err, "Failed to create Deployment.")
-			return nil, err
-		}
-	} else {
-		if err != nil {
-			//Reschedule the event
-			reqLogger.Error(err, fmt.Sprintf("Failed to get Deployment for %s.", codeServer.Name))
+	if err != nil && !errors.IsNotFound(err) {
+		//Reschedule the event
+		reqLogger.Error(err, fmt.Sprintf("Failed to get Deployment for %s.", codeServer.Name))
+		return nil, err
+	}
+	found := err == nil
+	if found {
+		if err = r.adoptResource(codeServer, oldDev); err != nil {
+			reqLogger.Error(err, "Failed to adopt Deployment.")
 			return nil, err
 		}
-		if needUpdateDeployment(oldDev, newDev) {
-			oldDev.Spec = newDev.Spec
-			reqLogger.Info("Updating a Development.")
-			err = r.Client.Update(context.TODO(), oldDev)
-			if err != nil {
-				reqLogger.Error(err, "Failed to update Deployment.")
-				return nil, err
-			}
+		if !r.shouldApply(codeServer, oldDev, hash, false) {
+			return oldDev, nil
 		}
 	}
-	return oldDev, nil
+	reqLogger.Info("Applying a Deployment.")
+	if err = r.applyResource(codeServer, newDev, oldDev, found); err != nil {
+		reqLogger.Error(err, "Failed to apply Deployment.")
+		return nil, err
+	}
+	recordApplied(codeServer, newDev, hash)
+	return newDev, nil
 }
 
 func (r *CodeServerReconciler) reconcileForIngress(codeServer *csv1alpha1.CodeServer) (*extv1.Ingress, error) {
-	reqLogger := r.Log.WithValues("namespace", codeServer.Namespace, "name", codeServer.Name)
+	reqLogger := r.instanceLog(codeServer)
 	reqLogger.Info("Reconciling ingress.")
 	//reconcile ingress for code server
 	newIngress := r.NewIngress(codeServer)
+	setOwnedLabels(newIngress, codeServer.Name)
+	hash := specHash(newIngress.Spec)
 	oldIngress := &extv1.Ingress{}
-	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: fmt.Sprintf(TerminalIngress, codeServer.Name), Namespace: codeServer.Namespace}, oldIngress)
-	if err != nil && errors.IsNotFound(err) {
-		reqLogger.Info("Creating an ingress.")
-		err = r.Client.Create(context.TODO(), newIngress)
-		if err != nil {
-			reqLogger.Error(err, "Failed to create ingress.")
-			return nil, err
-		}
-		// if update is required
-	} else {
-		if err != nil {
-			//Reschedule the event
-			reqLogger.Error(err, fmt.Sprintf("Failed to get Ingress for %s.", codeServer.Name))
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: ChildName(TerminalIngress, codeServer.Name), Namespace: codeServer.Namespace}, oldIngress)
+	if err != nil && !errors.IsNotFound(err) {
+		//Reschedule the event
+		reqLogger.Error(err, fmt.Sprintf("Failed to get Ingress for %s.", codeServer.Name))
+		return nil, err
+	}
+	found := err == nil
+	if found {
+		if err = r.adoptResource(codeServer, oldIngress); err != nil {
+			reqLogger.Error(err, "Failed to adopt Ingress.")
 			return nil, err
 		}
-		if !equality.Semantic.DeepEqual(oldIngress.Spec, newIngress.Spec) {
-			oldIngress.Spec = newIngress.Spec
-			reqLogger.Info("Updating an ingress.")
-			err = r.Client.Update(context.TODO(), oldIngress)
-			if err != nil {
-				reqLogger.Error(err, "Failed to update ingress.")
-				return nil, err
-			}
+		if !r.shouldApply(codeServer, oldIngress, hash, false) {
+			return oldIngress, nil
 		}
 	}
-	return oldIngress, nil
+	reqLogger.Info("Applying an ingress.")
+	if err = r.applyResource(codeServer, newIngress, oldIngress, found); err != nil {
+		reqLogger.Error(err, "Failed to apply ingress.")
+		return nil, err
+	}
+	recordApplied(codeServer, newIngress, hash)
+	return newIngress, nil
 }
 
 func (r *CodeServerReconciler) reconcileForService(codeServer *csv1alpha1.CodeServer) (*corev1.Service, error) {
-	reqLogger := r.Log.WithValues("namespace", codeServer.Namespace, "name", codeServer.Name)
+	reqLogger := r.instanceLog(codeServer)
 	reqLogger.Info("Reconciling service.")
 	//reconcile service for code server
+	if err := r.validateIPFamilies(codeServer); err != nil {
+		reqLogger.Error(err, "Invalid ip families of instance.")
+		return nil, err
+	}
 	newService := r.newService(codeServer)
+	setOwnedLabels(newService, codeServer.Name)
+	hash := specHash(newService.Spec)
 	oldService := &corev1.Service{}
 	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: codeServer.Name, Namespace: codeServer.Namespace}, oldService)
-	if err != nil && errors.IsNotFound(err) {
-		reqLogger.Info("Creating a Service.")
-		err = r.Client.Create(context.TODO(), newService)
-		if err != nil {
-			reqLogger.Error(err, "Failed to create Service.")
-			return nil, err
-		}
-		// if update is required
-	} else {
-		if err != nil {
-			//Reschedule the event
-			reqLogger.Error(err, fmt.Sprintf("Failed to get Service for %s.", codeServer.Name))
+	if err != nil && !errors.IsNotFound(err) {
+		//Reschedule the event
+		reqLogger.Error(err, fmt.Sprintf("Failed to get Service for %s.", codeServer.Name))
+		return nil, err
+	}
+	found := err == nil
+	if found {
+		if err = r.adoptResource(codeServer, oldService); err != nil {
+			reqLogger.Error(err, "Failed to adopt Service.")
 			return nil, err
 		}
-		if needUpdateService(oldService, newService) {
-			oldService.Spec = newService.Spec
-			reqLogger.Info("Updating a Service.")
-			err = r.Client.Update(context.TODO(), oldService)
-			if err != nil {
-				reqLogger.Error(err, "Failed to update Service.")
-				return nil, err
-			}
+		if !r.shouldApply(codeServer, oldService, hash, needUpdateService(oldService, newService)) {
+			return oldService, nil
 		}
 	}
-	return oldService, nil
+	reqLogger.Info("Applying a Service.")
+	if err = r.applyResource(codeServer, newService, oldService, found); err != nil {
+		reqLogger.Error(err, "Failed to apply Service.")
+		return nil, err
+	}
+	recordApplied(codeServer, newService, hash)
+	return newService, nil
 }
 
 func (r *CodeServerReconciler) addInitContainersForDeployment(m *csv1alpha1.CodeServer, baseDir, baseDirVolume string) []corev1.Container {
@@ -554,7 +1006,7 @@ func (r *CodeServerReconciler) addInitContainersForDeployment(m *csv1alpha1.Code
 	if len(m.Spec.InitPlugins) == 0 {
 		return containers
 	}
-	reqLogger := r.Log.WithValues("namespace", m.Namespace, "name", m.Name)
+	reqLogger := r.instanceLog(m)
 	clientSet := _interface.PluginClients{Client: r.Client}
 	for p, arguments := range m.Spec.InitPlugins {
 		plugin, err := initplugins.CreatePlugin(clientSet, p, arguments, baseDir)
@@ -573,38 +1025,123 @@ func (r *CodeServerReconciler) addInitContainersForDeployment(m *csv1alpha1.Code
 	return containers
 }
 
-func (r *CodeServerReconciler) newDeployment(m *csv1alpha1.CodeServer) (*appsv1.Deployment, error) {
-	instanceRuntime := string(m.Spec.Runtime)
-	if strings.EqualFold(instanceRuntime, string(csv1alpha1.RuntimeCode)) {
-		//Create code server environment with vs code
-		return r.deploymentForVSCodeServer(m), nil
-	} else if strings.EqualFold(instanceRuntime, string(csv1alpha1.RuntimeGotty)) || strings.EqualFold(instanceRuntime, string(csv1alpha1.RuntimePGWeb)) || strings.EqualFold(instanceRuntime, string(csv1alpha1.RuntimeGeneric)) {
-		//Create code server environment with generic container
-		return r.deploymentForGeneric(m), nil
-	} else if strings.EqualFold(instanceRuntime, string(csv1alpha1.RuntimeLxd)) {
-		//Create code server environment with gotty based terminal which runs on lxd
-		return r.deploymentForLxd(m), nil
-	} else {
-		return nil, errrorlib.New(fmt.Sprintf("unsupported runtime %s", m.Spec.Runtime))
+func (r *CodeServerReconciler) addSidecarsForDeployment(m *csv1alpha1.CodeServer, baseDir, baseDirVolume string,
+	existing []corev1.Container) []corev1.Container {
+	var containers []corev1.Container
+	if len(m.Spec.Sidecars) == 0 {
+		return containers
 	}
+	reqLogger := r.instanceLog(m)
+	names := map[string]bool{}
+	for _, c := range existing {
+		names[c.Name] = true
+	}
+	for _, sidecar := range m.Spec.Sidecars {
+		if names[sidecar.Name] {
+			reqLogger.Info(fmt.Sprintf("sidecar %s conflicts with existing container, skipped", sidecar.Name))
+			continue
+		}
+		names[sidecar.Name] = true
+		container := sidecar.DeepCopy()
+		//Add work space volume in default
+		shared := false
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == baseDirVolume {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				MountPath: baseDir,
+				Name:      baseDirVolume,
+			})
+		}
+		if len(container.ImagePullPolicy) == 0 {
+			container.ImagePullPolicy = corev1.PullIfNotPresent
+		}
+		containers = append(containers, *container)
+	}
+	return containers
 }
 
-func (r *CodeServerReconciler) getInstanceEndpoint(m *csv1alpha1.CodeServer) string {
-	instanceRuntime := string(m.Spec.Runtime)
-	if strings.EqualFold(instanceRuntime, string(csv1alpha1.RuntimeGotty)) || strings.EqualFold(instanceRuntime, string(csv1alpha1.RuntimeLxd)) {
-		return fmt.Sprintf("wss://%s.%s/ws", m.Spec.Subdomain, r.Options.DomainName)
-	} else if strings.EqualFold(instanceRuntime, string(csv1alpha1.RuntimeGeneric)) {
-		return fmt.Sprintf(m.Spec.ConnectionString, m.Spec.Subdomain, r.Options.DomainName)
-	} else {
-		return fmt.Sprintf("https://%s.%s/", m.Spec.Subdomain, r.Options.DomainName)
+func (r *CodeServerReconciler) newDeployment(m *csv1alpha1.CodeServer) (*appsv1.Deployment, error) {
+	if err := r.validateDocker(m); err != nil {
+		return nil, err
+	}
+	if err := validateSecurityContext(m, r.Options.Load().DisableDocker); err != nil {
+		return nil, err
+	}
+	if err := r.validateArch(m); err != nil {
+		return nil, err
+	}
+	if err := r.validateRootless(m); err != nil {
+		return nil, err
 	}
+	if err := r.validateSessionRecording(m); err != nil {
+		return nil, err
+	}
+	if err := r.validateSharedCaches(m); err != nil {
+		return nil, err
+	}
+	if err := validateIDE(m); err != nil {
+		return nil, err
+	}
+	if err := validateHostPaths(m, r.Options.Load().HostPathPrefixes); err != nil {
+		return nil, err
+	}
+	if err := validateSharedFolders(m); err != nil {
+		return nil, err
+	}
+	if err := r.validateBuckets(m); err != nil {
+		return nil, err
+	}
+	instanceRuntime, err := r.getRuntime(m)
+	if err != nil {
+		return nil, err
+	}
+	dep, err := instanceRuntime.CreateWorkload(m)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.addSchedulingForPod(m, &dep.Spec.Template); err != nil {
+		return nil, err
+	}
+	r.addCertificateForPod(m, &dep.Spec.Template)
+	addProxyForPod(m, &dep.Spec.Template.Spec)
+	addSecurityContextForPod(m, &dep.Spec.Template.Spec)
+	addRootlessForPod(m, &dep.Spec.Template.Spec)
+	addRightSizingForPod(m, &dep.Spec.Template.Spec)
+	r.addPullSecretsForPod(m, &dep.Spec.Template.Spec)
+	addSharedCachesForPod(m, &dep.Spec.Template.Spec)
+	addHostPathsForPod(m, &dep.Spec.Template.Spec)
+	r.addSharedFoldersForPod(m, &dep.Spec.Template.Spec)
+	r.addBucketsForPod(m, &dep.Spec.Template.Spec)
+	addEphemeralStorageForPod(m, &dep.Spec.Template.Spec)
+	if strings.EqualFold(string(m.Spec.Runtime), string(csv1alpha1.RuntimeCode)) {
+		addCodeServerConfigForPod(m, &dep.Spec.Template.Spec)
+		addProbesForPod(m, &dep.Spec.Template.Spec)
+		addExtensionsForPod(m, &dep.Spec.Template.Spec)
+		addSettingsSyncForPod(m, &dep.Spec.Template.Spec)
+		r.addSessionRecorderForPod(m, &dep.Spec.Template.Spec)
+		addHomeForPod(m, &dep.Spec.Template.Spec)
+		r.addPersistenceForPod(m, &dep.Spec.Template.Spec)
+		if err := r.addGitpodForPod(m, &dep.Spec.Template.Spec); err != nil {
+			return nil, err
+		}
+	}
+	if r.ingressProvider(m) == IngressProviderIstio {
+		addMeshForPod(&dep.Spec.Template)
+	}
+	addRegistryMirrorsForPod(&dep.Spec.Template.Spec, r.Options.Load().RegistryMirrors)
+	return dep, nil
 }
 
 // deploymentForVSCodeServer returns a code server with VSCode Deployment object
 func (r *CodeServerReconciler) deploymentForVSCodeServer(m *csv1alpha1.CodeServer) *appsv1.Deployment {
-	reqLogger := r.Log.WithValues("namespace", m.Namespace, "name", m.Name)
-	baseCodeDir := "/home/coder/project"
-	baseCodeVolume := "code-server-project-dir"
+	reqLogger := r.instanceLog(m)
+	baseCodeDir := VSCodeProjectDir
+	baseCodeVolume := VSCodeProjectVolume
 	ls := appLabel(m.Name)
 	replicas := int32(1)
 	enablePriviledge := m.Spec.Privileged
@@ -618,10 +1155,7 @@ func (r *CodeServerReconciler) deploymentForVSCodeServer(m *csv1alpha1.CodeServe
 		Medium:    "",
 		SizeLimit: &shareQuantity,
 	}
-	var arguments []string
-	arguments = append(arguments, []string{"--port", strconv.Itoa(HttpPort)}...)
-	arguments = append(arguments, []string{"--verbose"}...)
-	arguments = append(arguments, baseCodeDir)
+	arguments := ideFlavorOf(m).arguments(m, baseCodeDir)
 
 	initContainer := r.addInitContainersForDeployment(m, baseCodeDir, baseCodeVolume)
 	reqLogger.Info(fmt.Sprintf("init containers has been injected into deployment %v", initContainer))
@@ -641,7 +1175,7 @@ func (r *CodeServerReconciler) deploymentForVSCodeServer(m *csv1alpha1.CodeServe
 					Labels: ls,
 				},
 				Spec: corev1.PodSpec{
-					NodeSelector:   m.Spec.NodeSelector,
+					NodeSelector:   nodeSelectorForPod(m),
 					InitContainers: initContainer,
 					Containers: []corev1.Container{
 						{
@@ -650,11 +1184,12 @@ func (r *CodeServerReconciler) deploymentForVSCodeServer(m *csv1alpha1.CodeServe
 							ImagePullPolicy: corev1.PullIfNotPresent,
 							Args:            arguments,
 							SecurityContext: &priviledged,
-							Env:             m.Spec.Envs,
+							Env:             ideEnvs(m),
+							EnvFrom:         m.Spec.EnvFrom,
 							VolumeMounts: []corev1.VolumeMount{
 								{
-									MountPath: "/home/coder/.local/share/code-server",
-									Name:      "code-server-share-dir",
+									MountPath: VSCodeShareDir,
+									Name:      VSCodeShareVolume,
 								},
 								{
 									MountPath: baseCodeDir,
@@ -667,13 +1202,13 @@ func (r *CodeServerReconciler) deploymentForVSCodeServer(m *csv1alpha1.CodeServe
 							}},
 						},
 						{
-							Image:           r.Options.VSExporterImage,
-							Name:            "status-exporter",
+							Image:           r.Options.Load().VSExporterImage,
+							Name:            ExporterContainer,
 							ImagePullPolicy: corev1.PullIfNotPresent,
 							VolumeMounts: []corev1.VolumeMount{
 								{
-									MountPath: "/home/coder/.local/share/code-server",
-									Name:      "code-server-share-dir",
+									MountPath: VSCodeShareDir,
+									Name:      VSCodeShareVolume,
 								},
 							},
 							Env: []corev1.EnvVar{
@@ -683,18 +1218,22 @@ func (r *CodeServerReconciler) deploymentForVSCodeServer(m *csv1alpha1.CodeServe
 								},
 								{
 									Name:  "LISTEN_PORT",
-									Value: "8000",
+									Value: strconv.Itoa(ExporterPort),
+								},
+								{
+									Name:  "CONNECTION_PORT",
+									Value: strconv.Itoa(HttpPort),
 								},
 							},
 							Ports: []corev1.ContainerPort{{
-								ContainerPort: 8000,
+								ContainerPort: ExporterPort,
 								Name:          "statusreporter",
 							}},
 						},
 					},
 					Volumes: []corev1.Volume{
 						{
-							Name: "code-server-share-dir",
+							Name: VSCodeShareVolume,
 							VolumeSource: corev1.VolumeSource{
 								EmptyDir: &shareVolume,
 							},
@@ -704,6 +1243,14 @@ func (r *CodeServerReconciler) deploymentForVSCodeServer(m *csv1alpha1.CodeServe
 			},
 		},
 	}
+	sidecars := r.addSidecarsForDeployment(m, baseCodeDir, baseCodeVolume, dep.Spec.Template.Spec.Containers)
+	dep.Spec.Template.Spec.Containers = append(dep.Spec.Template.Spec.Containers, sidecars...)
+	r.addDockerEngineForPod(m, &dep.Spec.Template.Spec, CSNAME)
+	r.addGPUForPod(m, &dep.Spec.Template.Spec, CSNAME)
+	r.addSSHServerForPod(m, &dep.Spec.Template.Spec, baseCodeDir, baseCodeVolume)
+	r.addActivityPushForPod(m, &dep.Spec.Template.Spec)
+	addExporterTokenForPod(m, &dep.Spec.Template.Spec)
+	addAuthForPod(m, &dep.Spec.Template.Spec)
 
 	// add volume pvc pr emptyDir
 	if r.needDeployPVC(m.Spec.StorageName) {
@@ -735,7 +1282,7 @@ func (r *CodeServerReconciler) deploymentForVSCodeServer(m *csv1alpha1.CodeServe
 
 // deploymentForGeneric returns a code server with generic temporary environments
 func (r *CodeServerReconciler) deploymentForGeneric(m *csv1alpha1.CodeServer) *appsv1.Deployment {
-	reqLogger := r.Log.WithValues("namespace", m.Namespace, "name", m.Name)
+	reqLogger := r.instanceLog(m)
 	ls := appLabel(m.Name)
 	baseCodeDir := r.getDefaultWorkSpace(m)
 	baseCodeVolume := "code-server-workspace"
@@ -773,12 +1320,13 @@ func (r *CodeServerReconciler) deploymentForGeneric(m *csv1alpha1.CodeServer) *a
 				},
 				Spec: corev1.PodSpec{
 					InitContainers: initContainer,
-					NodeSelector:   m.Spec.NodeSelector,
+					NodeSelector:   nodeSelectorForPod(m),
 					Containers: []corev1.Container{
 						{
 							Image:           m.Spec.Image,
 							Name:            CSNAME,
 							Env:             m.Spec.Envs,
+							EnvFrom:         m.Spec.EnvFrom,
 							ImagePullPolicy: corev1.PullIfNotPresent,
 							SecurityContext: &priviledged,
 							VolumeMounts: []corev1.VolumeMount{
@@ -796,6 +1344,11 @@ func (r *CodeServerReconciler) deploymentForGeneric(m *csv1alpha1.CodeServer) *a
 			},
 		},
 	}
+	sidecars := r.addSidecarsForDeployment(m, baseCodeDir, baseCodeVolume, dep.Spec.Template.Spec.Containers)
+	dep.Spec.Template.Spec.Containers = append(dep.Spec.Template.Spec.Containers, sidecars...)
+	r.addDockerEngineForPod(m, &dep.Spec.Template.Spec, CSNAME)
+	r.addGPUForPod(m, &dep.Spec.Template.Spec, CSNAME)
+	r.addSSHServerForPod(m, &dep.Spec.Template.Spec, baseCodeDir, baseCodeVolume)
 	// add volume pvc pr emptyDir
 	if r.needDeployPVC(m.Spec.StorageName) {
 		dataVolume := corev1.PersistentVolumeClaimVolumeSource{
@@ -857,6 +1410,10 @@ func (r *CodeServerReconciler) assembleBaseLxdEnvs(
 	for _, env := range m.Spec.Envs {
 		if strings.HasPrefix(env.Name, "LAUNCHER") {
 			instanceEnvs = append(instanceEnvs, env)
+		} else if env.ValueFrom != nil {
+			// resolve it in pod env and refer to it via dependent environment
+			instanceEnvs = append(instanceEnvs, env)
+			gottyEnvs = append(gottyEnvs, fmt.Sprintf("%s=$(%s)", env.Name, env.Name))
 		} else {
 			// append to the lxd instance env
 			gottyEnvs = append(gottyEnvs, fmt.Sprintf("%s=%s", env.Name, env.Value))
@@ -940,7 +1497,7 @@ func (r *CodeServerReconciler) assembleBaseLxdEnvs(
 
 // deploymentForLxd returns an instance with gotty based terminal on lxd Deployment object for lxc launcher
 func (r *CodeServerReconciler) deploymentForLxd(m *csv1alpha1.CodeServer) *appsv1.Deployment {
-	reqLogger := r.Log.WithValues("namespace", m.Namespace, "name", m.Name)
+	reqLogger := r.instanceLog(m)
 	ls := appLabel(m.Name)
 	baseProxyDir := r.getDefaultWorkSpace(m)
 	baseProxyVolume := "code-server-workspace"
@@ -951,6 +1508,21 @@ func (r *CodeServerReconciler) deploymentForLxd(m *csv1alpha1.CodeServer) *appsv
 		Privileged: enablePriviledge,
 	}
 	reqLogger.Info("lxd container doesn't support init containers.")
+	if len(m.Spec.Sidecars) != 0 {
+		reqLogger.Info("lxd container doesn't support sidecars, sidecars will be ignored.")
+	}
+	if dockerEnabled(m) {
+		reqLogger.Info("lxd container doesn't support docker sidecar, docker will be ignored.")
+	}
+	if sshEnabled(m) {
+		reqLogger.Info("lxd container doesn't support ssh sidecar, ssh will be ignored.")
+	}
+	if m.Spec.GPU != nil {
+		reqLogger.Info("lxd container doesn't support gpu spec, gpu will be ignored.")
+	}
+	if len(m.Spec.EnvFrom) != 0 {
+		reqLogger.Info("lxd container doesn't support envFrom, envFrom will be ignored.")
+	}
 	ProxyPort := fmt.Sprintf("80:80,%d:%d", HttpPort, HttpPort)
 	additionalEnvs = append(additionalEnvs, corev1.EnvVar{
 		Name:  "GOTTY_PORT",
@@ -986,7 +1558,7 @@ func (r *CodeServerReconciler) deploymentForLxd(m *csv1alpha1.CodeServer) *appsv
 					Labels: ls,
 				},
 				Spec: corev1.PodSpec{
-					NodeSelector: m.Spec.NodeSelector,
+					NodeSelector: nodeSelectorForPod(m),
 					Containers: []corev1.Container{
 						{
 							Image:           m.Spec.Image,
@@ -1016,7 +1588,7 @@ func (r *CodeServerReconciler) deploymentForLxd(m *csv1alpha1.CodeServer) *appsv
 		Name: baseProxyVolume,
 		VolumeSource: corev1.VolumeSource{
 			Secret: &corev1.SecretVolumeSource{
-				SecretName: r.Options.LxdClientSecretName,
+				SecretName: r.Options.Load().LxdClientSecretName,
 			},
 		},
 	}
@@ -1077,6 +1649,22 @@ func (r *CodeServerReconciler) newService(m *csv1alpha1.CodeServer) *corev1.Serv
 		Protocol:   corev1.ProtocolTCP,
 		TargetPort: r.getContainerPort(m),
 	})
+	// status exporter only lives in vs code pod, expose it for in-IDE notifications
+	if strings.EqualFold(string(m.Spec.Runtime), string(csv1alpha1.RuntimeCode)) {
+		ser.Spec.Ports = append(ser.Spec.Ports, corev1.ServicePort{
+			Port:       ExporterPort,
+			Name:       "statusreporter",
+			Protocol:   corev1.ProtocolTCP,
+			TargetPort: intstr.FromInt(ExporterPort),
+		})
+	}
+	// ports declared in .gitpod.yml, failure of fetching is reported when reconciling deployment
+	if config, err := r.loadGitpodConfig(m); err == nil {
+		ser.Spec.Ports = append(ser.Spec.Ports, gitpodServicePorts(config)...)
+	}
+	// ports exposed on demand for previews
+	ser.Spec.Ports = append(ser.Spec.Ports, previewServicePorts(m, ser.Spec.Ports)...)
+	addIPFamiliesForService(m, ser)
 	// Set CodeServer instance as the owner of the Service.
 	controllerutil.SetControllerReference(m, ser, r.Scheme)
 	return ser
@@ -1111,6 +1699,16 @@ func (r *CodeServerReconciler) newPVC(m *csv1alpha1.CodeServer) (*corev1.Persist
 			},
 		},
 	}
+	dataSource, err := workspaceDataSource(m)
+	if err != nil {
+		return nil, err
+	}
+	if dataSource == nil && m.Spec.Storage != nil && m.Spec.Storage.SourcePrebuild != nil {
+		if dataSource, err = r.prebuildDataSource(m); err != nil {
+			return nil, err
+		}
+	}
+	pvc.Spec.DataSource = dataSource
 	// Set CodeServer instance as the owner of the pvc.
 	controllerutil.SetControllerReference(m, pvc, r.Scheme)
 	return pvc, nil
@@ -1122,24 +1720,27 @@ func (r *CodeServerReconciler) NewIngress(m *csv1alpha1.CodeServer) *extv1.Ingre
 	httpValue := extv1.HTTPIngressRuleValue{
 		Paths: []extv1.HTTPIngressPath{
 			{
-				Path: "/",
+				Path: ingressPath(m),
 				Backend: extv1.IngressBackend{
-					ServiceName: m.Name,
+					ServiceName: r.routeServiceName(m),
 					ServicePort: servicePort,
 				},
 			},
 		},
 	}
+	annotations := r.annotationsForIngress()
+	addRoutingAnnotations(m, annotations)
+	addCertificateAnnotation(m, annotations)
 	ingress := &extv1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        fmt.Sprintf(TerminalIngress, m.Name),
+			Name:        ChildName(TerminalIngress, m.Name),
 			Namespace:   m.Namespace,
-			Annotations: r.annotationsForIngress(),
+			Annotations: annotations,
 		},
 		Spec: extv1.IngressSpec{
 			Rules: []extv1.IngressRule{
 				{
-					Host: fmt.Sprintf("%s.%s", m.Spec.Subdomain, r.Options.DomainName),
+					Host: r.instanceHost(m),
 					IngressRuleValue: extv1.IngressRuleValue{
 						HTTP: &httpValue,
 					},
@@ -1149,8 +1750,8 @@ func (r *CodeServerReconciler) NewIngress(m *csv1alpha1.CodeServer) *extv1.Ingre
 	}
 	ingress.Spec.TLS = []extv1.IngressTLS{
 		{
-			Hosts:      []string{fmt.Sprintf("%s.%s", m.Spec.Subdomain, r.Options.DomainName)},
-			SecretName: r.Options.HttpsSecretName,
+			Hosts:      []string{r.instanceHost(m)},
+			SecretName: r.tlsSecretName(m),
 		},
 	}
 	// Set CodeServer instance as the owner of the ingress.
@@ -1262,7 +1863,7 @@ func filterOutCondition(states *csv1alpha1.CodeServerStatus, currentCondition cs
 		}
 
 		if currentCondition.Type == csv1alpha1.ServerInactive || currentCondition.Type == csv1alpha1.ServerRecycled ||
-			currentCondition.Type == csv1alpha1.ServerErrored {
+			currentCondition.Type == csv1alpha1.ServerErrored || currentCondition.Type == csv1alpha1.ServerFailed {
 			if currentCondition.Status == corev1.ConditionTrue && condition.Type == csv1alpha1.ServerReady {
 				condition.Status = corev1.ConditionFalse
 				condition.LastUpdateTime = metav1.Now()
@@ -1277,7 +1878,8 @@ func filterOutCondition(states *csv1alpha1.CodeServerStatus, currentCondition cs
 				condition.LastUpdateTime = metav1.Now()
 				condition.LastTransitionTime = metav1.Now()
 			}
-			if condition.Type == csv1alpha1.ServerErrored || condition.Status == corev1.ConditionTrue {
+			if condition.Type == csv1alpha1.ServerErrored || (condition.Status == corev1.ConditionTrue &&
+				!isStartupStep(condition.Type)) {
 				//update error condition if ready is true
 				condition.Status = corev1.ConditionFalse
 				condition.LastUpdateTime = metav1.Now()
@@ -1298,21 +1900,32 @@ func needUpdatePVC(old, new *corev1.PersistentVolumeClaim) bool {
 
 func needUpdateService(old, new *corev1.Service) bool {
 	return !equality.Semantic.DeepEqual(old.Spec.Ports, new.Spec.Ports) ||
-		!equality.Semantic.DeepEqual(old.Spec.Selector, new.Spec.Selector)
-}
-
-func needUpdateDeployment(old, new *appsv1.Deployment) bool {
-	return !equality.Semantic.DeepEqual(old.Spec.Template.Spec.Volumes, new.Spec.Template.Spec.Volumes) ||
-		!equality.Semantic.DeepEqual(old.Spec.Template.Spec.Containers, new.Spec.Template.Spec.Containers)
+		!equality.Semantic.DeepEqual(old.Spec.Selector, new.Spec.Selector) || ipFamiliesChanged(old, new)
 }
 
 func (r *CodeServerReconciler) SetupWithManager(mgr ctrl.Manager, maxConcurrency int) error {
 	options := controller.Options{
 		MaxConcurrentReconciles: maxConcurrency,
 	}
+	r.probeTransport = newProbeTransport(r.Options)
+	r.certificates = NewCertificateProber(r.Options, r.Log.WithName("certificates"))
+	if err := mgr.Add(r.certificates); err != nil {
+		return err
+	}
+	r.acmeOrders = make(chan *acmeOrderRequest, ACMEOrderQueue)
+	if err := mgr.Add(manager.RunnableFunc(r.runACMEOrders)); err != nil {
+		return err
+	}
 	//watch codeserver, server, ingress, pvc and deployment.
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&csv1alpha1.CodeServer{}).Owns(&corev1.Service{}).
-		Owns(&extv1.Ingress{}).Owns(&appsv1.Deployment{}).Owns(&corev1.PersistentVolumeClaim{}).WithOptions(options).
+		For(&csv1alpha1.CodeServer{}, builder.WithPredicates(r.shardPredicate(), r.updatePredicate())).
+		Owns(&corev1.Service{}, builder.WithPredicates(r.ownedPredicate())).
+		Owns(&extv1.Ingress{}, builder.WithPredicates(r.ownedPredicate())).
+		Owns(&appsv1.Deployment{}, builder.WithPredicates(r.ownedPredicate())).
+		Owns(&corev1.PersistentVolumeClaim{}, builder.WithPredicates(r.ownedPredicate())).
+		// rotated certificate is rolled into instances of namespace, only metadata of secrets is cached
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.certificateSecretRequests),
+			builder.OnlyMetadata).
+		WithOptions(options).
 		Complete(r)
 }
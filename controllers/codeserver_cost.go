@@ -0,0 +1,211 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"regexp"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// Cost allocation labels stamped on generated resources and pods besides instance label
+const (
+	CostUserLabel     = "codeserver.io/cost-user"
+	CostTeamLabel     = "codeserver.io/cost-team"
+	CostTemplateLabel = "codeserver.io/cost-template"
+	// DefaultStorageClassPrice is the key of storage price used for storage classes not listed in price sheet.
+	DefaultStorageClassPrice = "default"
+	gibibyte                 = float64(1 << 30)
+)
+
+var invalidLabelChars = regexp.MustCompile("[^A-Za-z0-9._-]+")
+
+// PriceSheet holds the hourly prices which instance costs are estimated with
+type PriceSheet struct {
+	// Currency of prices, e.g. USD.
+	Currency string `json:"currency,omitempty"`
+	// Hourly prices of a core of cpu, a GiB of memory and a unit of other resources, e.g. nvidia.com/gpu.
+	Resources map[corev1.ResourceName]float64 `json:"resources,omitempty"`
+	// Hourly prices of a GiB of workspace volume per storage class.
+	Storage map[string]float64 `json:"storage,omitempty"`
+}
+
+// LoadPriceSheet loads price sheet from yaml or json file.
+func LoadPriceSheet(path string) (*PriceSheet, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sheet := &PriceSheet{}
+	if err := yaml.UnmarshalStrict(content, sheet); err != nil {
+		return nil, fmt.Errorf("failed to parse price sheet %s: %v", path, err)
+	}
+	return sheet, nil
+}
+
+// labelValue turns value, e.g. email of user, into a valid label value.
+func labelValue(value string) string {
+	value = invalidLabelChars.ReplaceAllString(value, "_")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "._-")
+}
+
+// costLabels returns the cost allocation labels of instance, team is taken from the team label of instance.
+func costLabels(options *CodeServerOption, m *csv1alpha1.CodeServer) map[string]string {
+	labels := map[string]string{InstanceLabel: m.Name}
+	values := map[string]string{
+		CostUserLabel:     m.Annotations[UserAnnotation],
+		CostTemplateLabel: m.Annotations[TemplateAnnotation],
+	}
+	if len(options.Load().TeamLabel) != 0 {
+		values[CostTeamLabel] = m.Labels[options.Load().TeamLabel]
+	}
+	for key, value := range values {
+		if value = labelValue(value); len(value) != 0 {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+func mergeLabels(labels, extra map[string]string) map[string]string {
+	merged := make(map[string]string, len(labels)+len(extra))
+	for key, value := range labels {
+		merged[key] = value
+	}
+	for key, value := range extra {
+		merged[key] = value
+	}
+	return merged
+}
+
+// addCostLabels stamps cost allocation labels on the generated resource and pods it creates. Labels of pod
+// template are replaced by a copy since they are usually shared with the selector.
+func (r *CodeServerReconciler) addCostLabels(m *csv1alpha1.CodeServer, obj client.Object) {
+	if !r.Options.Load().CostLabels {
+		return
+	}
+	labels := costLabels(r.Options, m)
+	obj.SetLabels(mergeLabels(obj.GetLabels(), labels))
+	switch typed := obj.(type) {
+	case *appsv1.Deployment:
+		typed.Spec.Template.Labels = mergeLabels(typed.Spec.Template.Labels, labels)
+	case *batchv1.Job:
+		typed.Spec.Template.Labels = mergeLabels(typed.Spec.Template.Labels, labels)
+	}
+}
+
+// requestedQuantity returns the request of resource, limit is taken if request is missing.
+func requestedQuantity(m *csv1alpha1.CodeServer, name corev1.ResourceName) (resource.Quantity, bool) {
+	if autoResizeEnabled(m) && m.Status.RightSizing != nil {
+		if name == corev1.ResourceCPU && m.Status.RightSizing.AppliedCPU != nil {
+			return *m.Status.RightSizing.AppliedCPU, true
+		}
+		if name == corev1.ResourceMemory && m.Status.RightSizing.AppliedMemory != nil {
+			return *m.Status.RightSizing.AppliedMemory, true
+		}
+	}
+	if value, ok := m.Spec.Resources.Requests[name]; ok {
+		return value, true
+	}
+	value, ok := m.Spec.Resources.Limits[name]
+	return value, ok
+}
+
+// estimateCost estimates the hourly cost of instance, cpu is priced per core, memory and ephemeral storage per
+// GiB and other resources per unit.
+func (r *CodeServerReconciler) estimateCost(sheet *PriceSheet, m *csv1alpha1.CodeServer) *csv1alpha1.CostStatus {
+	compute := 0.0
+	gpuName, gpuCount := requestedGPU(m)
+	for name, price := range sheet.Resources {
+		if name == gpuName {
+			compute += float64(gpuCount) * price
+			continue
+		}
+		value, ok := requestedQuantity(m, name)
+		if !ok {
+			continue
+		}
+		switch name {
+		case corev1.ResourceCPU:
+			compute += float64(value.MilliValue()) / 1000 * price
+		case corev1.ResourceMemory, corev1.ResourceEphemeralStorage:
+			compute += float64(value.Value()) / gibibyte * price
+		default:
+			compute += float64(value.Value()) * price
+		}
+	}
+	storage := 0.0
+	if size, err := resource.ParseQuantity(m.Spec.StorageSize); err == nil && r.needDeployPVC(m.Spec.StorageName) {
+		price, found := sheet.Storage[m.Spec.StorageName]
+		if !found {
+			price = sheet.Storage[DefaultStorageClassPrice]
+		}
+		storage = float64(size.Value()) / gibibyte * price
+	}
+	hourly := compute + storage
+	if HasCondition(m.Status, csv1alpha1.ServerRecycled) {
+		hourly = 0
+	} else if HasCondition(m.Status, csv1alpha1.ServerInactive) {
+		hourly = storage
+	}
+	return &csv1alpha1.CostStatus{
+		Compute:  formatAmount(compute),
+		Storage:  formatAmount(storage),
+		Hourly:   formatAmount(hourly),
+		Currency: sheet.Currency,
+	}
+}
+
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 4, 64)
+}
+
+// reconcileCost keeps the cost estimate in status up to date, it returns true if status changed.
+func (r *CodeServerReconciler) reconcileCost(m *csv1alpha1.CodeServer) bool {
+	var cost *csv1alpha1.CostStatus
+	if r.Options.Load().PriceSheet != nil {
+		cost = r.estimateCost(r.Options.Load().PriceSheet, m)
+	}
+	if equality.Semantic.DeepEqual(cost, m.Status.Cost) {
+		return false
+	}
+	m.Status.Cost = cost
+	return true
+}
+
+// updateCost updates the cost estimate of instance whose status is not updated otherwise, e.g. inactive ones.
+func (r *CodeServerReconciler) updateCost(m *csv1alpha1.CodeServer) error {
+	if !r.reconcileCost(m) {
+		return nil
+	}
+	return r.Client.Update(context.TODO(), m)
+}
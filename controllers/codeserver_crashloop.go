@@ -0,0 +1,166 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"strconv"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// TemplateAnnotation records the template which code server is created from
+	TemplateAnnotation = "codeserver.io/template"
+	// LastGoodImageAnnotation records the last image of template which instances became ready with
+	LastGoodImageAnnotation = "codeserver.io/last-good-image"
+	// RolledBackAnnotation records the image rolled back from due to crash loop
+	RolledBackAnnotation = "codeserver.io/rolled-back-from"
+)
+
+// crashLoopReasons are the waiting reasons of containers which won't recover without intervention.
+var crashLoopReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+}
+
+// crashLoop describes the failing container of pod
+type crashLoop struct {
+	container string
+	reason    string
+	message   string
+	restarts  int32
+}
+
+func (c *crashLoop) imagePullFailure() bool {
+	return c.reason != "CrashLoopBackOff" && c.reason != "CreateContainerConfigError"
+}
+
+// podCrashLoop returns the first init or app container of pod stuck in crash loop or image pull failure.
+func podCrashLoop(pod *corev1.Pod) *crashLoop {
+	if pod == nil {
+		return nil
+	}
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...),
+		pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if status.State.Waiting != nil && crashLoopReasons[status.State.Waiting.Reason] {
+			return &crashLoop{
+				container: status.Name,
+				reason:    status.State.Waiting.Reason,
+				message:   status.State.Waiting.Message,
+				restarts:  status.RestartCount,
+			}
+		}
+	}
+	return nil
+}
+
+// reconcileCrashLoop sets failed condition with the reason of failing container, and records the image of template
+// once instance becomes ready. It returns whether condition changed and the last-known-good image of template to
+// roll back to if configured, which is applied by rollbackImage once status has been written.
+func (r *CodeServerReconciler) reconcileCrashLoop(codeServer *csv1alpha1.CodeServer, pod *corev1.Pod,
+	ready csv1alpha1.ServerCondition) (bool, string) {
+	if ready.Type == csv1alpha1.ServerReady && ready.Status == corev1.ConditionTrue {
+		r.recordLastGoodImage(codeServer)
+	}
+	failing := podCrashLoop(pod)
+	if failing == nil {
+		return removeCondition(&codeServer.Status, csv1alpha1.ServerFailed), ""
+	}
+	condition := NewStateCondition(csv1alpha1.ServerFailed,
+		fmt.Sprintf("container %s: %s", failing.container, failing.reason), map[string]string{
+			"container": failing.container,
+			"reason":    failing.reason,
+			"detail":    failing.message,
+			"restarts":  strconv.Itoa(int(failing.restarts)),
+		}, corev1.ConditionTrue)
+	changed := SetCondition(&codeServer.Status, condition)
+	if changed {
+		r.Recorder.Eventf(codeServer, corev1.EventTypeWarning, EventCrashLooping, "Container %s is %s: %s",
+			failing.container, failing.reason, failing.message)
+	}
+	if spec := codeServer.Spec.CrashLoop; spec != nil && spec.RollbackAfter > 0 &&
+		(failing.imagePullFailure() || failing.restarts >= spec.RollbackAfter) {
+		if _, image := r.lastGoodImage(codeServer); image != codeServer.Spec.Image {
+			return changed, image
+		}
+	}
+	return changed, ""
+}
+
+// lastGoodImage returns the last-known-good image of the template which instance is created from.
+func (r *CodeServerReconciler) lastGoodImage(codeServer *csv1alpha1.CodeServer) (*csv1alpha1.CodeServerTemplate, string) {
+	name := codeServer.Annotations[TemplateAnnotation]
+	if len(name) == 0 {
+		return nil, ""
+	}
+	template := &csv1alpha1.CodeServerTemplate{}
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace},
+		template); err != nil {
+		return nil, ""
+	}
+	return template, template.Annotations[LastGoodImageAnnotation]
+}
+
+// recordLastGoodImage records the image of template once an instance running it becomes ready, images chosen by
+// instances themselves are never recorded.
+func (r *CodeServerReconciler) recordLastGoodImage(codeServer *csv1alpha1.CodeServer) {
+	template, image := r.lastGoodImage(codeServer)
+	if template == nil || image == codeServer.Spec.Image || template.Spec.Template.Image != codeServer.Spec.Image {
+		return
+	}
+	reqLogger := r.instanceLog(codeServer)
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[LastGoodImageAnnotation] = codeServer.Spec.Image
+	if err := r.Client.Update(context.TODO(), template); err != nil {
+		reqLogger.Error(err, "Failed to record last-known-good image of template.")
+	}
+}
+
+// rollbackImage rolls the image of crash looping instance back to image, reconcile returns afterwards and the
+// workloads are rolled back by the reconcile triggered by the update.
+func (r *CodeServerReconciler) rollbackImage(key types.NamespacedName, image string) error {
+	codeServer := &csv1alpha1.CodeServer{}
+	if err := r.Client.Get(context.TODO(), key, codeServer); err != nil {
+		return err
+	}
+	previous := codeServer.Spec.Image
+	if previous == image {
+		return nil
+	}
+	codeServer.Spec.Image = image
+	if codeServer.Annotations == nil {
+		codeServer.Annotations = map[string]string{}
+	}
+	codeServer.Annotations[RolledBackAnnotation] = previous
+	if err := r.Client.Update(context.TODO(), codeServer); err != nil {
+		r.instanceLog(codeServer).Error(err, "Failed to roll back image of crash looping code server.")
+		return err
+	}
+	r.Recorder.Eventf(codeServer, corev1.EventTypeWarning, EventRolledBack, "Image has been rolled back from %s to %s",
+		previous, image)
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// DefaultedAnnotation records that instance spec has been defaulted by operator config and template, defaults
+	// are applied once so that later changes of them don't restart existing instances.
+	DefaultedAnnotation = "codeserver.io/defaulted"
+	// DefaultedSkipped marks the instances which existed before defaulting, their spec is left as it is.
+	DefaultedSkipped = "skipped"
+)
+
+// MergeCodeServerSpec merges override into base with the semantics of strategic merge patch: fields set in override
+// take precedence, maps are merged by key and lists with merge keys (envs, sidecars and their env, ports and volume
+// mounts, image pull secrets, shared caches, scratch dirs, additional ports, collaborators and notifications) are
+// merged by key, other lists are replaced. Zero values (e.g. false) in override can't unset the ones of base.
+func MergeCodeServerSpec(base, override *csv1alpha1.CodeServerSpec) (*csv1alpha1.CodeServerSpec, error) {
+	if base == nil {
+		return override.DeepCopy(), nil
+	}
+	if override == nil {
+		return base.DeepCopy(), nil
+	}
+	original, err := json.Marshal(base)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := json.Marshal(override)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := strategicpatch.StrategicMergePatch(original, patch, csv1alpha1.CodeServerSpec{})
+	if err != nil {
+		return nil, err
+	}
+	spec := &csv1alpha1.CodeServerSpec{}
+	if err := json.Unmarshal(merged, spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// DefaultCodeServerSpec returns the spec of instance defaulted in order of precedence, operator config defaults
+// are overridden by template which is overridden by instance.
+func DefaultCodeServerSpec(defaults *csv1alpha1.CodeServerSpec, template *csv1alpha1.CodeServerTemplate,
+	spec *csv1alpha1.CodeServerSpec) (*csv1alpha1.CodeServerSpec, error) {
+	merged := defaults
+	if template != nil {
+		var err error
+		if merged, err = MergeCodeServerSpec(merged, &template.Spec.Template); err != nil {
+			return nil, err
+		}
+	}
+	return MergeCodeServerSpec(merged, spec)
+}
+
+// reconcileForDefaults applies the defaults of operator config and template to spec of instance once, it returns
+// true if instance has been updated. Template is looked up in the namespace of instance, instances created from
+// templates elsewhere already carry the spec of their templates. Instances which have been reconciled before, i.e.
+// existed before defaulting was introduced, are only marked, so that their running pods aren't changed.
+func (r *CodeServerReconciler) reconcileForDefaults(codeServer *csv1alpha1.CodeServer) (bool, error) {
+	if _, found := codeServer.Annotations[DefaultedAnnotation]; found {
+		return false, nil
+	}
+	if codeServer.Annotations == nil {
+		codeServer.Annotations = map[string]string{}
+	}
+	if len(codeServer.Status.Conditions) != 0 || len(codeServer.Status.ManagedResources) != 0 {
+		codeServer.Annotations[DefaultedAnnotation] = DefaultedSkipped
+		return true, r.Client.Update(context.TODO(), codeServer)
+	}
+	var template *csv1alpha1.CodeServerTemplate
+	if name := codeServer.Annotations[TemplateAnnotation]; len(name) != 0 {
+		template = &csv1alpha1.CodeServerTemplate{}
+		err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace},
+			template)
+		if errors.IsNotFound(err) {
+			template = nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	spec, err := DefaultCodeServerSpec(r.Options.Load().InstanceDefaults, template, &codeServer.Spec)
+	if err != nil {
+		r.Recorder.Eventf(codeServer, corev1.EventTypeWarning, EventDefaultingFailed,
+			"Failed to apply defaults: %v", err)
+		return false, fmt.Errorf("failed to apply defaults: %v", err)
+	}
+	codeServer.Annotations[DefaultedAnnotation] = "true"
+	if !equality.Semantic.DeepEqual(*spec, codeServer.Spec) {
+		r.instanceLog(codeServer).Info("applying defaults of operator config and template to spec")
+		codeServer.Spec = *spec
+	}
+	return true, r.Client.Update(context.TODO(), codeServer)
+}
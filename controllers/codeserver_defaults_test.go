@@ -0,0 +1,136 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+func TestMergeCodeServerSpec(t *testing.T) {
+	seconds := func(value int64) *int64 { return &value }
+	tests := []struct {
+		name     string
+		base     *csv1alpha1.CodeServerSpec
+		override *csv1alpha1.CodeServerSpec
+		want     *csv1alpha1.CodeServerSpec
+	}{
+		{name: "nil base", override: &csv1alpha1.CodeServerSpec{Image: "image"},
+			want: &csv1alpha1.CodeServerSpec{Image: "image"}},
+		{name: "nil override", base: &csv1alpha1.CodeServerSpec{Image: "image"},
+			want: &csv1alpha1.CodeServerSpec{Image: "image"}},
+		{name: "scalars of override win",
+			base:     &csv1alpha1.CodeServerSpec{Image: "base", StorageSize: "1Gi"},
+			override: &csv1alpha1.CodeServerSpec{Image: "override"},
+			want:     &csv1alpha1.CodeServerSpec{Image: "override", StorageSize: "1Gi"}},
+		{name: "zero values keep base",
+			base:     &csv1alpha1.CodeServerSpec{InactiveAfterSeconds: seconds(60), StorageSize: "1Gi"},
+			override: &csv1alpha1.CodeServerSpec{},
+			want:     &csv1alpha1.CodeServerSpec{InactiveAfterSeconds: seconds(60), StorageSize: "1Gi"}},
+		{name: "envs merged by name",
+			base: &csv1alpha1.CodeServerSpec{Envs: []corev1.EnvVar{{Name: "A", Value: "1"},
+				{Name: "B", Value: "1"}}},
+			override: &csv1alpha1.CodeServerSpec{Envs: []corev1.EnvVar{{Name: "B", Value: "2"},
+				{Name: "C", Value: "2"}}},
+			want: &csv1alpha1.CodeServerSpec{Envs: []corev1.EnvVar{{Name: "A", Value: "1"},
+				{Name: "B", Value: "2"}, {Name: "C", Value: "2"}}}},
+		{name: "other lists replaced",
+			base:     &csv1alpha1.CodeServerSpec{Extensions: []string{"a", "b"}},
+			override: &csv1alpha1.CodeServerSpec{Extensions: []string{"c"}},
+			want:     &csv1alpha1.CodeServerSpec{Extensions: []string{"c"}}},
+		{name: "maps merged by key",
+			base: &csv1alpha1.CodeServerSpec{Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+				corev1.ResourceCPU: resourcev1.MustParse("1"), corev1.ResourceMemory: resourcev1.MustParse("1Gi")}}},
+			override: &csv1alpha1.CodeServerSpec{Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+				corev1.ResourceCPU: resourcev1.MustParse("2")}}},
+			want: &csv1alpha1.CodeServerSpec{Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+				corev1.ResourceCPU: resourcev1.MustParse("2"), corev1.ResourceMemory: resourcev1.MustParse("1Gi")}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MergeCodeServerSpec(tt.base, tt.override)
+			if err != nil {
+				t.Fatalf("MergeCodeServerSpec() error = %v", err)
+			}
+			if !equality.Semantic.DeepEqual(got, tt.want) {
+				t.Errorf("MergeCodeServerSpec() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodeServerSpecOverride(t *testing.T) {
+	seconds := int64(600)
+	template := &csv1alpha1.CodeServerSpec{
+		Image:       "image",
+		Subdomain:   "dev",
+		Command:     []string{"code-server"},
+		Envs:        []corev1.EnvVar{{Name: "A", Value: "1"}},
+		Extensions:  []string{"a"},
+		InitPlugins: map[string][]string{"git": {"clone"}},
+		Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+			corev1.ResourceCPU: resourcev1.MustParse("1")}},
+	}
+	tests := []struct {
+		name     string
+		override *CodeServerSpecOverride
+		want     func(spec *csv1alpha1.CodeServerSpec)
+		wantErr  bool
+	}{
+		{name: "empty override keeps template", override: &CodeServerSpecOverride{},
+			want: func(spec *csv1alpha1.CodeServerSpec) {}},
+		{name: "overridable fields", override: &CodeServerSpecOverride{
+			StorageSize: "10Gi", InactiveAfterSeconds: &seconds, Extensions: []string{"b"},
+			Envs: []corev1.EnvVar{{Name: "A", Value: "2"}}},
+			want: func(spec *csv1alpha1.CodeServerSpec) {
+				spec.StorageSize, spec.InactiveAfterSeconds, spec.Extensions = "10Gi", &seconds, []string{"b"}
+				spec.Envs = []corev1.EnvVar{{Name: "A", Value: "2"}}
+			}},
+		{name: "env from secret", override: &CodeServerSpecOverride{Envs: []corev1.EnvVar{{Name: "B",
+			ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{Key: "key"}}}}}, wantErr: true},
+		{name: "patch directive in init plugins", override: &CodeServerSpecOverride{
+			InitPlugins: map[string][]string{"$retainKeys": {"none"}}}, wantErr: true},
+		{name: "patch directive in resources", override: &CodeServerSpecOverride{
+			Resources: &corev1.ResourceRequirements{Limits: corev1.ResourceList{
+				"$patch": resourcev1.MustParse("1")}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			override, err := tt.override.Spec()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Spec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := MergeCodeServerSpec(template, override)
+			if err != nil {
+				t.Fatalf("MergeCodeServerSpec() error = %v", err)
+			}
+			want := template.DeepCopy()
+			tt.want(want)
+			if !equality.Semantic.DeepEqual(got, want) {
+				t.Errorf("MergeCodeServerSpec() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	errrorlib "errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"path"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	DockerEngineName    = "docker-engine"
+	DockerSocketVolume  = "docker-socket-dir"
+	DockerStorageVolume = "docker-storage-dir"
+	DockerSocketDir     = "/var/run/docker"
+	BuildkitSocketDir   = "/run/buildkit"
+)
+
+func dockerEnabled(m *csv1alpha1.CodeServer) bool {
+	return m.Spec.Docker != nil && m.Spec.Docker.Enabled
+}
+
+func (r *CodeServerReconciler) validateDocker(m *csv1alpha1.CodeServer) error {
+	if dockerEnabled(m) && r.Options.Load().DisableDocker {
+		return errrorlib.New("docker sidecar has been disallowed by operator")
+	}
+	return nil
+}
+
+// addDockerEngineForPod injects docker in docker or buildkit sidecar into pod and exposes the engine socket
+// to the container specified via shared volume.
+func (r *CodeServerReconciler) addDockerEngineForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec, containerName string) {
+	if !dockerEnabled(m) {
+		return
+	}
+	privileged := true
+	var engine corev1.Container
+	var socketDir, envName, envValue string
+	if m.Spec.Docker.Engine == csv1alpha1.DockerEngineBuildkit {
+		socketDir = BuildkitSocketDir
+		socket := fmt.Sprintf("unix://%s", path.Join(socketDir, "buildkitd.sock"))
+		envName, envValue = "BUILDKIT_HOST", socket
+		engine = corev1.Container{
+			Image: r.Options.Load().BuildkitImage,
+			Args:  []string{"--addr", socket},
+		}
+	} else {
+		socketDir = DockerSocketDir
+		socket := fmt.Sprintf("unix://%s", path.Join(socketDir, "docker.sock"))
+		envName, envValue = "DOCKER_HOST", socket
+		engine = corev1.Container{
+			Image: r.Options.Load().DindImage,
+			Args:  []string{fmt.Sprintf("--host=%s", socket)},
+			Env: []corev1.EnvVar{
+				{
+					Name:  "DOCKER_TLS_CERTDIR",
+					Value: "",
+				},
+			},
+			VolumeMounts: []corev1.VolumeMount{
+				{
+					MountPath: "/var/lib/docker",
+					Name:      DockerStorageVolume,
+				},
+			},
+		}
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: DockerStorageVolume,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+	}
+	if len(m.Spec.Docker.Image) != 0 {
+		engine.Image = m.Spec.Docker.Image
+	}
+	engine.Name = DockerEngineName
+	engine.ImagePullPolicy = corev1.PullIfNotPresent
+	engine.Resources = m.Spec.Docker.Resources
+	engine.SecurityContext = &corev1.SecurityContext{
+		Privileged: &privileged,
+	}
+	engine.VolumeMounts = append(engine.VolumeMounts, corev1.VolumeMount{
+		MountPath: socketDir,
+		Name:      DockerSocketVolume,
+	})
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: DockerSocketVolume,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	})
+	for index, con := range podSpec.Containers {
+		if con.Name == containerName {
+			podSpec.Containers[index].Env = append(podSpec.Containers[index].Env, corev1.EnvVar{
+				Name:  envName,
+				Value: envValue,
+			})
+			podSpec.Containers[index].VolumeMounts = append(podSpec.Containers[index].VolumeMounts,
+				corev1.VolumeMount{
+					MountPath: socketDir,
+					Name:      DockerSocketVolume,
+				})
+		}
+	}
+	podSpec.Containers = append(podSpec.Containers, engine)
+}
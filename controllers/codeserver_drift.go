@@ -0,0 +1,122 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// Modes handling out-of-band edits of generated resources
+const (
+	DriftModeEnforce = "enforce"
+	DriftModeDetect  = "detect"
+)
+
+// generationTracked are the kinds whose generation is bumped on every spec change, other kinds are compared with
+// the desired spec.
+var generationTracked = map[string]bool{
+	"Deployment": true,
+	"Ingress":    true,
+}
+
+func specHash(spec interface{}) string {
+	content, _ := json.Marshal(spec)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:8])
+}
+
+func managedResource(status *csv1alpha1.CodeServerStatus, kind, name string) *csv1alpha1.ManagedResource {
+	for index := range status.ManagedResources {
+		if status.ManagedResources[index].Kind == kind && status.ManagedResources[index].Name == name {
+			return &status.ManagedResources[index]
+		}
+	}
+	return nil
+}
+
+// shouldApply decides whether the desired spec is applied to the live object. Object is drifted when it has been
+// modified while the desired spec stays the same as the one operator applied last time, drift is reverted in
+// enforce mode and only recorded in detect mode. Kinds whose generation is not tracked are drifted if they differ
+// from the desired spec.
+func (r *CodeServerReconciler) shouldApply(codeServer *csv1alpha1.CodeServer, live client.Object, hash string,
+	differs bool) bool {
+	kind := resourceKind(live)
+	record := managedResource(&codeServer.Status, kind, live.GetName())
+	if record == nil || record.Hash != hash {
+		return true
+	}
+	drifted := differs
+	if generationTracked[kind] {
+		drifted = live.GetGeneration() != record.Generation
+	}
+	if !drifted {
+		return true
+	}
+	if r.Options.Load().DriftMode == DriftModeDetect {
+		if !record.Drifted {
+			r.Recorder.Eventf(codeServer, corev1.EventTypeWarning, EventDrifted, "%s %s has been modified out of band",
+				kind, live.GetName())
+		}
+		record.Drifted = true
+		return false
+	}
+	r.Recorder.Eventf(codeServer, corev1.EventTypeNormal, EventDriftReverted,
+		"%s %s has been modified out of band, reverted", kind, live.GetName())
+	return true
+}
+
+// recordApplied records the generation of object and the hash of desired spec applied by operator.
+func recordApplied(codeServer *csv1alpha1.CodeServer, live client.Object, hash string) {
+	applied := csv1alpha1.ManagedResource{
+		Kind:       resourceKind(live),
+		Name:       live.GetName(),
+		Generation: live.GetGeneration(),
+		Hash:       hash,
+	}
+	if record := managedResource(&codeServer.Status, applied.Kind, applied.Name); record != nil {
+		*record = applied
+		return
+	}
+	codeServer.Status.ManagedResources = append(codeServer.Status.ManagedResources, applied)
+}
+
+// reconcileDriftCondition sets drifted condition with the drifted resources, it returns true if status changed.
+func reconcileDriftCondition(codeServer *csv1alpha1.CodeServer) bool {
+	var drifted []string
+	for _, record := range codeServer.Status.ManagedResources {
+		if record.Drifted {
+			drifted = append(drifted, fmt.Sprintf("%s/%s", record.Kind, record.Name))
+		}
+	}
+	if len(drifted) == 0 {
+		return removeCondition(&codeServer.Status, csv1alpha1.ServerDrifted)
+	}
+	sort.Strings(drifted)
+	resources := strings.Join(drifted, ",")
+	return SetCondition(&codeServer.Status, NewStateCondition(csv1alpha1.ServerDrifted,
+		fmt.Sprintf("modified out of band: %s", resources), map[string]string{"resources": resources},
+		corev1.ConditionTrue))
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// DryRunAnnotation makes operator record the resources it would apply for instance without applying them
+	DryRunAnnotation = "codeserver.io/dry-run"
+	// DryRunResource is the config map holding the manifests computed in dry run
+	DryRunResource = "%s-dry-run"
+	// DryRunSummary is the key of the actions on resources in dry run config map
+	DryRunSummary = "summary"
+	// DryRunError is the key of the error failing to compute manifests in dry run config map
+	DryRunError = "error"
+)
+
+// Actions on resources reported in dry run
+const (
+	DryRunCreate    = "create"
+	DryRunUpdate    = "update"
+	DryRunUnchanged = "unchanged"
+)
+
+func dryRunEnabled(options *CodeServerOption, codeServer *csv1alpha1.CodeServer) bool {
+	return options.Load().DryRun || strings.EqualFold(codeServer.Annotations[DryRunAnnotation], "true")
+}
+
+// dryRunManifests computes the resources which would be applied for instance, keyed by file name.
+func (r *CodeServerReconciler) dryRunManifests(codeServer *csv1alpha1.CodeServer) (map[string]string, error) {
+	var objects []client.Object
+	if r.needDeployPVC(codeServer.Spec.StorageName) {
+		pvc, err := r.newPVC(codeServer)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, pvc)
+	}
+	objects = append(objects, r.newService(codeServer))
+	if r.ingressProvider(codeServer) == IngressProviderIngress {
+		objects = append(objects, r.NewIngress(codeServer))
+	}
+	deployment, err := r.newDeployment(codeServer)
+	if err != nil {
+		return nil, err
+	}
+	objects = append(objects, deployment)
+
+	serializer := json.NewSerializerWithOptions(json.DefaultMetaFactory, r.Scheme, r.Scheme,
+		json.SerializerOptions{Yaml: true})
+	data := map[string]string{}
+	var summary []string
+	for _, obj := range objects {
+		setOwnedLabels(obj, codeServer.Name)
+		gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+		if err != nil {
+			return nil, err
+		}
+		obj.GetObjectKind().SetGroupVersionKind(gvk)
+		action, err := r.dryRunAction(codeServer, obj)
+		if err != nil {
+			return nil, err
+		}
+		buffer := &bytes.Buffer{}
+		if err := serializer.Encode(obj, buffer); err != nil {
+			return nil, err
+		}
+		data[strings.ToLower(gvk.Kind)+".yaml"] = buffer.String()
+		summary = append(summary, fmt.Sprintf("%s %s: %s", gvk.Kind, obj.GetName(), action))
+	}
+	data[DryRunSummary] = strings.Join(summary, "\n")
+	return data, nil
+}
+
+// dryRunAction returns the action operator would take on resource, resources are unchanged if the desired spec
+// equals the one operator applied last time.
+func (r *CodeServerReconciler) dryRunAction(codeServer *csv1alpha1.CodeServer, obj client.Object) (string, error) {
+	live := obj.DeepCopyObject().(client.Object)
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}, live)
+	if errors.IsNotFound(err) {
+		return DryRunCreate, nil
+	} else if err != nil {
+		return "", err
+	}
+	var hash string
+	switch typed := obj.(type) {
+	case *appsv1.Deployment:
+		hash = specHash(typed.Spec)
+	case *corev1.Service:
+		hash = specHash(typed.Spec)
+	case *extv1.Ingress:
+		hash = specHash(typed.Spec)
+	default:
+		// other resources, e.g. volume claims, are never updated in place
+		return DryRunUnchanged, nil
+	}
+	record := managedResource(&codeServer.Status, resourceKind(obj), obj.GetName())
+	if record != nil && record.Hash == hash {
+		return DryRunUnchanged, nil
+	}
+	return DryRunUpdate, nil
+}
+
+// reconcileDryRun records the manifests of instance in config map instead of applying them.
+func (r *CodeServerReconciler) reconcileDryRun(codeServer *csv1alpha1.CodeServer) (reconcile.Result, error) {
+	reqLogger := r.instanceLog(codeServer)
+	data, err := r.dryRunManifests(codeServer)
+	if err != nil {
+		reqLogger.Error(err, "Failed to compute manifests in dry run.")
+		data = map[string]string{DryRunError: err.Error()}
+	}
+	name := ChildName(DryRunResource, codeServer.Name)
+	oldConfig := &corev1.ConfigMap{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, oldConfig)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return reconcile.Result{Requeue: true}, err
+		}
+		config := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: codeServer.Namespace,
+			},
+			Data: data,
+		}
+		setOwnedLabels(config, codeServer.Name)
+		controllerutil.SetControllerReference(codeServer, config, r.Scheme)
+		if err = r.Client.Create(context.TODO(), config); err != nil {
+			reqLogger.Error(err, "Failed to create dry run config map.")
+			return reconcile.Result{Requeue: true}, err
+		}
+		r.Recorder.Eventf(codeServer, corev1.EventTypeNormal, EventDryRun, "Manifests have been recorded in %s", name)
+		return reconcile.Result{}, nil
+	}
+	if equality.Semantic.DeepEqual(oldConfig.Data, data) {
+		return reconcile.Result{}, nil
+	}
+	oldConfig.Data = data
+	if err = r.Client.Update(context.TODO(), oldConfig); err != nil {
+		reqLogger.Error(err, "Failed to update dry run config map.")
+		return reconcile.Result{Requeue: true}, err
+	}
+	r.Recorder.Eventf(codeServer, corev1.EventTypeNormal, EventDryRun, "Manifests have been recorded in %s", name)
+	return reconcile.Result{}, nil
+}
@@ -0,0 +1,310 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	"hash/fnv"
+	"io/ioutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"regexp"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sort"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// GroupSourceLabel marks the groups synced by operator, groups without it are maintained by hand.
+	GroupSourceLabel = "codeserver.io/group-source"
+	GroupSourceLDAP  = "ldap"
+	// EntitlementWebhookPath is the path of validating webhook which enforces allowed groups of templates.
+	EntitlementWebhookPath = "/validate-cs-opensourceways-com-v1alpha1-codeserver-entitlement"
+	serviceAccountPrefix   = "system:serviceaccount:"
+)
+
+var invalidGroupNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeservergroups,verbs=get;list;watch;create;update;delete
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeservertemplates,verbs=get;list;watch
+
+// CodeServerEntitlement syncs the membership of directory groups referred by allowedGroups of templates into
+// CodeServerGroups, which the entitlement webhook checks users against.
+type CodeServerEntitlement struct {
+	client.Client
+	Log     logr.Logger
+	Options *CodeServerOption
+}
+
+func NewCodeServerEntitlement(client client.Client, log logr.Logger, options *CodeServerOption) *CodeServerEntitlement {
+	return &CodeServerEntitlement{
+		client,
+		log,
+		options,
+	}
+}
+
+func (e *CodeServerEntitlement) Run(stopCh <-chan struct{}) {
+	e.Sync()
+	ticker := time.NewTicker(time.Duration(e.Options.Load().EntitlementInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Sync()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// groupObjectName returns the name of CodeServerGroup synced for group, directory group names may contain
+// characters invalid in names and are suffixed with hash to stay unique.
+func groupObjectName(group string) string {
+	name := strings.Trim(invalidGroupNameChars.ReplaceAllString(strings.ToLower(group), "-"), "-")
+	if len(name) > 40 {
+		name = strings.Trim(name[:40], "-")
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(group))
+	return fmt.Sprintf("%s-%s-%08x", GroupSourceLDAP, name, hash.Sum32())
+}
+
+// referencedGroups returns the groups referred by templates, keyed by lower case name since directory names are
+// case insensitive.
+func (e *CodeServerEntitlement) referencedGroups() (map[string]string, error) {
+	templates := &csv1alpha1.CodeServerTemplateList{}
+	if err := e.Client.List(context.TODO(), templates); err != nil {
+		return nil, err
+	}
+	groups := map[string]string{}
+	for _, template := range templates.Items {
+		for _, group := range template.Spec.AllowedGroups {
+			groups[strings.ToLower(group)] = group
+		}
+	}
+	return groups, nil
+}
+
+// ldapMembers searches users in directory and returns the members of groups, groups of user are taken from its
+// group attribute, e.g. memberOf of active directory.
+func (e *CodeServerEntitlement) ldapMembers(groups map[string]string) (map[string][]string, error) {
+	password := ""
+	if len(e.Options.Load().LDAPBindPasswordFile) != 0 {
+		content, err := ioutil.ReadFile(e.Options.Load().LDAPBindPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		password = strings.TrimSpace(string(content))
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	ServerTLSOptions(e.Options)(config)
+	conn, err := dialLDAP(e.Options.Load().LDAPURL, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.Bind(e.Options.Load().LDAPBindDN, password); err != nil {
+		return nil, err
+	}
+	entries, err := conn.Search(e.Options.Load().LDAPUserBaseDN, e.Options.Load().LDAPUserFilter,
+		[]string{e.Options.Load().LDAPUserAttribute, e.Options.Load().LDAPGroupAttribute})
+	if err != nil {
+		return nil, err
+	}
+	members := map[string][]string{}
+	for _, entry := range entries {
+		users := entry.Attributes[strings.ToLower(e.Options.Load().LDAPUserAttribute)]
+		if len(users) == 0 {
+			continue
+		}
+		for _, dn := range entry.Attributes[strings.ToLower(e.Options.Load().LDAPGroupAttribute)] {
+			if group, found := groups[strings.ToLower(rdnValue(dn))]; found {
+				members[group] = append(members[group], users[0])
+			}
+		}
+	}
+	return members, nil
+}
+
+// Sync updates the synced groups to the current membership in directory, groups no longer referred by templates
+// are deleted. Groups are left untouched if directory is unavailable.
+func (e *CodeServerEntitlement) Sync() {
+	groups, err := e.referencedGroups()
+	if err != nil {
+		e.Log.Error(err, "Failed to list templates for entitlement.")
+		return
+	}
+	members := map[string][]string{}
+	if len(groups) != 0 {
+		if members, err = e.ldapMembers(groups); err != nil {
+			e.Log.Error(err, "Failed to search group members in ldap.", "url", e.Options.Load().LDAPURL)
+			return
+		}
+	}
+	existing := &csv1alpha1.CodeServerGroupList{}
+	if err := e.Client.List(context.TODO(), existing, client.MatchingLabels{GroupSourceLabel: GroupSourceLDAP}); err != nil {
+		e.Log.Error(err, "Failed to list synced groups.")
+		return
+	}
+	synced := map[string]*csv1alpha1.CodeServerGroup{}
+	for i := range existing.Items {
+		synced[existing.Items[i].Name] = &existing.Items[i]
+	}
+	now := metav1.Now()
+	for _, group := range groups {
+		name := groupObjectName(group)
+		users := members[group]
+		sort.Strings(users)
+		if current, found := synced[name]; found {
+			delete(synced, name)
+			if equality.Semantic.DeepEqual(current.Spec.Members, users) {
+				continue
+			}
+			current.Spec.Members = users
+			current.Status.LastSyncTime = &now
+			if err := e.Client.Update(context.TODO(), current); err != nil {
+				e.Log.Error(err, "Failed to update synced group.", "group", group)
+				continue
+			}
+			e.Log.Info(fmt.Sprintf("group %s has been synced with %d members", group, len(users)))
+			continue
+		}
+		newGroup := &csv1alpha1.CodeServerGroup{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{GroupSourceLabel: GroupSourceLDAP},
+			},
+			Spec: csv1alpha1.CodeServerGroupSpec{
+				Group:   group,
+				Members: users,
+			},
+			Status: csv1alpha1.CodeServerGroupStatus{LastSyncTime: &now},
+		}
+		if err := e.Client.Create(context.TODO(), newGroup); err != nil {
+			e.Log.Error(err, "Failed to create synced group.", "group", group)
+			continue
+		}
+		e.Log.Info(fmt.Sprintf("group %s has been synced with %d members", group, len(users)))
+	}
+	for _, stale := range synced {
+		if err := e.Client.Delete(context.TODO(), stale); err != nil && !errors.IsNotFound(err) {
+			e.Log.Error(err, "Failed to delete group no longer referred by templates.", "group", stale.Spec.Group)
+		}
+	}
+}
+
+// +kubebuilder:webhook:path=/validate-cs-opensourceways-com-v1alpha1-codeserver-entitlement,mutating=false,failurePolicy=fail,sideEffects=None,groups=cs.opensourceways.com,resources=codeservers,verbs=create;update,versions=v1alpha1,name=vcodeserverentitlement.kb.io,admissionReviewVersions=v1
+
+// CodeServerEntitlementValidator denies code servers created from templates the user isn't entitled to. Groups
+// of user are the groups of request, i.e. the groups claim of oidc tokens, and the CodeServerGroups user is member
+// of. Instances created by service accounts, e.g. api server and workshops, are checked for the user in annotation.
+type CodeServerEntitlementValidator struct {
+	client.Client
+	Log logr.Logger
+}
+
+func NewCodeServerEntitlementValidator(client client.Client, log logr.Logger) *CodeServerEntitlementValidator {
+	return &CodeServerEntitlementValidator{
+		client,
+		log,
+	}
+}
+
+func (v *CodeServerEntitlementValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	codeServer := &csv1alpha1.CodeServer{}
+	if err := json.Unmarshal(req.Object.Raw, codeServer); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	templateName := codeServer.Annotations[TemplateAnnotation]
+	if len(templateName) == 0 {
+		return admission.Allowed("")
+	}
+	if req.Operation == admissionv1.Update {
+		old := &csv1alpha1.CodeServer{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if old.Annotations[TemplateAnnotation] == templateName {
+			return admission.Allowed("")
+		}
+	}
+	template := &csv1alpha1.CodeServerTemplate{}
+	err := v.Client.Get(ctx, types.NamespacedName{Name: templateName, Namespace: req.Namespace}, template)
+	if errors.IsNotFound(err) {
+		return admission.Allowed("")
+	}
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if len(template.Spec.AllowedGroups) == 0 {
+		return admission.Allowed("")
+	}
+	user, groups := req.UserInfo.Username, req.UserInfo.Groups
+	if strings.HasPrefix(user, serviceAccountPrefix) {
+		user, groups = codeServer.Annotations[UserAnnotation], nil
+		if len(user) == 0 {
+			return admission.Denied(fmt.Sprintf("template %s requires the user annotation %s", templateName,
+				UserAnnotation))
+		}
+	}
+	memberOf, err := v.memberOf(ctx, user)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	groups = append(groups, memberOf...)
+	for _, allowed := range template.Spec.AllowedGroups {
+		for _, group := range groups {
+			if strings.EqualFold(allowed, group) {
+				return admission.Allowed("")
+			}
+		}
+	}
+	v.Log.Info(fmt.Sprintf("user %s is denied to instantiate template %s/%s", user, req.Namespace, templateName))
+	return admission.Denied(fmt.Sprintf("user %s is not a member of groups %s entitled to template %s", user,
+		strings.Join(template.Spec.AllowedGroups, ", "), templateName))
+}
+
+// memberOf returns the CodeServerGroups user is member of.
+func (v *CodeServerEntitlementValidator) memberOf(ctx context.Context, user string) ([]string, error) {
+	groups := &csv1alpha1.CodeServerGroupList{}
+	if err := v.Client.List(ctx, groups); err != nil {
+		return nil, err
+	}
+	var memberOf []string
+	for _, group := range groups.Items {
+		for _, member := range group.Spec.Members {
+			if strings.EqualFold(member, user) {
+				memberOf = append(memberOf, group.Spec.Group)
+				break
+			}
+		}
+	}
+	return memberOf, nil
+}
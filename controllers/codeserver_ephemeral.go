@@ -0,0 +1,77 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// ScratchVolume is the volume name of scratch dir with index
+const ScratchVolume = "scratch-%d"
+
+// addEphemeralStorageForPod applies ephemeral-storage request and limit to code server container and mounts the
+// scratch dirs, tmpfs ones are backed by memory.
+func addEphemeralStorageForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	spec := m.Spec.EphemeralStorage
+	if spec == nil {
+		return
+	}
+	for index, dir := range spec.ScratchDirs {
+		emptyDir := &corev1.EmptyDirVolumeSource{SizeLimit: dir.Size}
+		if dir.Tmpfs {
+			emptyDir.Medium = corev1.StorageMediumMemory
+		}
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name:         fmt.Sprintf(ScratchVolume, index),
+			VolumeSource: corev1.VolumeSource{EmptyDir: emptyDir},
+		})
+	}
+	for index := range podSpec.Containers {
+		container := &podSpec.Containers[index]
+		if container.Name != CSNAME {
+			continue
+		}
+		if spec.Request != nil {
+			container.Resources.Requests = withResource(container.Resources.Requests,
+				corev1.ResourceEphemeralStorage, *spec.Request)
+		}
+		if spec.Limit != nil {
+			container.Resources.Limits = withResource(container.Resources.Limits,
+				corev1.ResourceEphemeralStorage, *spec.Limit)
+		}
+		for i, dir := range spec.ScratchDirs {
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      fmt.Sprintf(ScratchVolume, i),
+				MountPath: dir.Path,
+			})
+		}
+	}
+}
+
+// withResource returns a copy of resources with the quantity of name set, the list may be shared by instances.
+func withResource(resources corev1.ResourceList, name corev1.ResourceName, quantity resource.Quantity) corev1.ResourceList {
+	result := corev1.ResourceList{}
+	for key, value := range resources {
+		result[key] = value
+	}
+	result[name] = quantity
+	return result
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const EventSource = "code-server-operator"
+
+// VolumeBoundAnnotation marks the claim whose binding has been recorded on code server.
+const VolumeBoundAnnotation = "codeserver.io/volume-bound"
+
+// Reasons of events recorded on code server
+const (
+	EventCreated                = "Created"
+	EventUpdated                = "Updated"
+	EventVolumeBound            = "VolumeBound"
+	EventReady                  = "Ready"
+	EventReconcileFailed        = "ReconcileFailed"
+	EventProbeFailed            = "ProbeFailed"
+	EventPendingRecycle         = "PendingRecycle"
+	EventRecycleCanceled        = "RecycleCanceled"
+	EventInactive               = "Inactive"
+	EventRecycled               = "Recycled"
+	EventCleanupFailed          = "CleanupFailed"
+	EventForceDeleted           = "ForceDeleted"
+	EventAdopted                = "Adopted"
+	EventWoken                  = "Woken"
+	EventCrashLooping           = "CrashLooping"
+	EventRolledBack             = "RolledBack"
+	EventDriftReverted          = "DriftReverted"
+	EventDrifted                = "Drifted"
+	EventDryRun                 = "DryRun"
+	EventPaused                 = "Paused"
+	EventResumed                = "Resumed"
+	EventExpired                = "Expired"
+	EventReconcileLog           = "ReconcileLog"
+	EventCloned                 = "Cloned"
+	EventCloneFailed            = "CloneFailed"
+	EventExported               = "Exported"
+	EventExportFailed           = "ExportFailed"
+	EventBudgetWarning          = "BudgetWarning"
+	EventBudgetExceeded         = "BudgetExceeded"
+	EventViewSessionStarted     = "ViewSessionStarted"
+	EventViewSessionEnded       = "ViewSessionEnded"
+	EventPreviewFailed          = "PreviewFailed"
+	EventCertificateRotated     = "CertificateRotated"
+	EventCertificateIssued      = "CertificateIssued"
+	EventCertificateIssueFailed = "CertificateIssueFailed"
+	EventDefaultingFailed       = "DefaultingFailed"
+	EventNodePinned             = "NodePinned"
+)
+
+// resourceKind returns the kind used in event messages, e.g. Deployment for *appsv1.Deployment, the kind of
+// unstructured object is taken from its group version kind.
+func resourceKind(obj runtime.Object) string {
+	if kind := obj.GetObjectKind().GroupVersionKind().Kind; len(kind) != 0 {
+		return kind
+	}
+	kind := fmt.Sprintf("%T", obj)
+	return kind[strings.LastIndex(kind, ".")+1:]
+}
+
+// recordCreated records the creation of resource owned by code server
+func (r *CodeServerReconciler) recordCreated(m *csv1alpha1.CodeServer, obj client.Object) {
+	r.Recorder.Eventf(m, corev1.EventTypeNormal, EventCreated, "Created %s %s", resourceKind(obj), obj.GetName())
+}
+
+// recordUpdated records the update of resource owned by code server
+func (r *CodeServerReconciler) recordUpdated(m *csv1alpha1.CodeServer, obj client.Object) {
+	r.Recorder.Eventf(m, corev1.EventTypeNormal, EventUpdated, "Updated %s %s", resourceKind(obj), obj.GetName())
+}
+
+// recordVolumeBound records the binding of claim once, the claim is marked so that later reconciles skip it.
+func (r *CodeServerReconciler) recordVolumeBound(m *csv1alpha1.CodeServer, pvc *corev1.PersistentVolumeClaim) error {
+	if _, ok := pvc.Annotations[VolumeBoundAnnotation]; ok {
+		return nil
+	}
+	original := pvc.DeepCopy()
+	if pvc.Annotations == nil {
+		pvc.Annotations = map[string]string{}
+	}
+	pvc.Annotations[VolumeBoundAnnotation] = pvc.Spec.VolumeName
+	if err := r.Client.Patch(context.TODO(), pvc, client.MergeFrom(original)); err != nil {
+		r.instanceLog(m).Error(err, "Failed to mark PersistentVolumeClaim as bound.")
+		return err
+	}
+	r.Recorder.Eventf(m, corev1.EventTypeNormal, EventVolumeBound,
+		"PersistentVolumeClaim %s is bound to volume %s", pvc.Name, pvc.Spec.VolumeName)
+	return nil
+}
+
+// recordEvent records event on code server from watcher, which only knows the name of code server.
+func (cs *CodeServerWatcher) recordEvent(req types.NamespacedName, eventType, reason, message string) {
+	codeServer := &csv1alpha1.CodeServer{}
+	if err := cs.Client.Get(context.TODO(), req, codeServer); err != nil {
+		return
+	}
+	cs.recorder.Event(codeServer, eventType, reason, message)
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// CodeServerFinalizer guarantees external resources (e.g. lxd instances and their snapshots) are cleaned up
+// before code server disappears.
+const CodeServerFinalizer = "codeserver.io/cleanup"
+
+// ensureFinalizer adds the finalizer to code server, returns true if code server has been updated.
+func (r *CodeServerReconciler) ensureFinalizer(codeServer *csv1alpha1.CodeServer) (bool, error) {
+	if controllerutil.ContainsFinalizer(codeServer, CodeServerFinalizer) {
+		return false, nil
+	}
+	controllerutil.AddFinalizer(codeServer, CodeServerFinalizer)
+	if err := r.Client.Update(context.TODO(), codeServer); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// finalizeCodeServer cleans up the resources of code server being deleted and removes the finalizer afterwards,
+// finalizer is removed anyway once the force delete timeout passes so that broken external systems don't block
+// the deletion forever.
+func (r *CodeServerReconciler) finalizeCodeServer(codeServer *csv1alpha1.CodeServer) (reconcile.Result, error) {
+	if !controllerutil.ContainsFinalizer(codeServer, CodeServerFinalizer) {
+		return reconcile.Result{}, nil
+	}
+	reqLogger := r.instanceLog(codeServer)
+	req := types.NamespacedName{Namespace: codeServer.Namespace, Name: codeServer.Name}
+	r.deleteFromInactiveWatch(req)
+	r.deleteFromRecycleWatch(req)
+	// external resources go first, lxd server of instance is found via its pod
+	err := r.cleanupRuntimeResource(codeServer)
+	if err == nil {
+		err = r.deleteCodeServerResource(codeServer.Name, codeServer.Namespace, codeServer.Spec.StorageName, true)
+	}
+	if err != nil {
+		timeout := time.Duration(r.Options.Load().FinalizerTimeout) * time.Second
+		if timeout <= 0 || time.Since(codeServer.DeletionTimestamp.Time) < timeout {
+			reqLogger.Error(err, "Failed to clean up code server resources, will retry later.")
+			r.Recorder.Event(codeServer, corev1.EventTypeWarning, EventCleanupFailed, err.Error())
+			return reconcile.Result{Requeue: true, RequeueAfter: time.Second * 20}, nil
+		}
+		reqLogger.Error(err, "Failed to clean up code server resources, finalizer is removed since force delete timeout passed.")
+		r.Recorder.Event(codeServer, corev1.EventTypeWarning, EventForceDeleted,
+			fmt.Sprintf("Resources may be orphaned since cleanup didn't finish in %s: %v", timeout, err))
+	}
+	controllerutil.RemoveFinalizer(codeServer, CodeServerFinalizer)
+	if err := r.Client.Update(context.TODO(), codeServer); err != nil {
+		reqLogger.Error(err, "Failed to remove finalizer of code server.")
+		return reconcile.Result{Requeue: true}, err
+	}
+	return reconcile.Result{}, nil
+}
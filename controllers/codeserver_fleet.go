@@ -0,0 +1,129 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// FleetStatusName is the name of the cluster scoped fleet status maintained by operator
+	FleetStatusName = "fleet"
+	// NoTemplate counts the instances created without template
+	NoTemplate = "none"
+)
+
+// CodeServerFleetReporter periodically summarizes all code servers into the fleet status, so that admins don't
+// need to list and aggregate instances client side.
+type CodeServerFleetReporter struct {
+	client.Client
+	Log     logr.Logger
+	Options *CodeServerOption
+}
+
+func NewCodeServerFleetReporter(client client.Client, log logr.Logger, options *CodeServerOption) *CodeServerFleetReporter {
+	return &CodeServerFleetReporter{
+		client,
+		log,
+		options,
+	}
+}
+
+func (f *CodeServerFleetReporter) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(f.Options.Load().FleetStatusInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.Report(); err != nil {
+				f.Log.Error(err, "Failed to report fleet status.")
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// summarize counts code servers by phase, namespace and template, and running pods by node.
+func summarize(codeServers []csv1alpha1.CodeServer, pods []corev1.Pod) csv1alpha1.CodeServerFleetStatusStatus {
+	status := csv1alpha1.CodeServerFleetStatusStatus{
+		Phases:     map[string]int32{},
+		Namespaces: map[string]int32{},
+		Templates:  map[string]int32{},
+		Nodes:      map[string]int32{},
+	}
+	for i := range codeServers {
+		codeServer := &codeServers[i]
+		template := codeServer.Annotations[TemplateAnnotation]
+		if len(template) == 0 {
+			template = NoTemplate
+		}
+		status.Total++
+		status.Phases[CodeServerPhase(codeServer)]++
+		status.Namespaces[codeServer.Namespace]++
+		status.Templates[template]++
+		if codeServer.Status.Certificate != nil && codeServer.Status.Certificate.Stale {
+			status.StaleCertificates = append(status.StaleCertificates,
+				fmt.Sprintf("%s/%s", codeServer.Namespace, codeServer.Name))
+		}
+	}
+	sort.Strings(status.StaleCertificates)
+	for _, pod := range pods {
+		if len(pod.Spec.NodeName) != 0 && pod.Status.Phase == corev1.PodRunning {
+			status.Nodes[pod.Spec.NodeName]++
+		}
+	}
+	return status
+}
+
+// Report refreshes the fleet status, it's created if missing.
+func (f *CodeServerFleetReporter) Report() error {
+	codeServers := &csv1alpha1.CodeServerList{}
+	if err := f.Client.List(context.TODO(), codeServers); err != nil {
+		return err
+	}
+	pods := &corev1.PodList{}
+	if err := f.Client.List(context.TODO(), pods, client.MatchingLabels{"app": "codeserver"}); err != nil {
+		return err
+	}
+	status := summarize(codeServers.Items, pods.Items)
+	status.LastUpdateTime = metav1.Now()
+	fleet := &csv1alpha1.CodeServerFleetStatus{}
+	err := f.Client.Get(context.TODO(), types.NamespacedName{Name: FleetStatusName}, fleet)
+	if errors.IsNotFound(err) {
+		fleet = &csv1alpha1.CodeServerFleetStatus{
+			ObjectMeta: metav1.ObjectMeta{Name: FleetStatusName},
+			Status:     status,
+		}
+		return f.Client.Create(context.TODO(), fleet)
+	} else if err != nil {
+		return err
+	}
+	fleet.Status = status
+	return f.Client.Update(context.TODO(), fleet)
+}
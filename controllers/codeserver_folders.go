@@ -0,0 +1,102 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"path"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const SharedFolderVolume = "shared-folder-%d"
+
+func sharedFolderProtocol(folder *csv1alpha1.SharedFolderSpec) csv1alpha1.SharedFolderProtocol {
+	if len(folder.Protocol) == 0 {
+		return csv1alpha1.SharedFolderNFS
+	}
+	return folder.Protocol
+}
+
+// validateSharedFolders checks the shared folders of instance can be mounted.
+func validateSharedFolders(m *csv1alpha1.CodeServer) error {
+	for i := range m.Spec.SharedFolders {
+		folder := &m.Spec.SharedFolders[i]
+		if len(folder.Server) == 0 || len(folder.Path) == 0 || len(folder.MountPath) == 0 {
+			return fmt.Errorf("shared folder %d requires server, path and mount path", i)
+		}
+		if sharedFolderProtocol(folder) == csv1alpha1.SharedFolderNFS {
+			if !path.IsAbs(folder.Path) {
+				return fmt.Errorf("nfs export %s of shared folder must be absolute", folder.Path)
+			}
+			if len(folder.CredentialsSecret) != 0 {
+				return fmt.Errorf("nfs export %s of shared folder doesn't support credentials", folder.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// sharedFolderSource returns the volume of shared folder, SMB shares are inline volumes of csi driver whose
+// credentials are passed as node publish secret.
+func (r *CodeServerReconciler) sharedFolderSource(folder *csv1alpha1.SharedFolderSpec) corev1.VolumeSource {
+	if sharedFolderProtocol(folder) == csv1alpha1.SharedFolderNFS {
+		return corev1.VolumeSource{
+			NFS: &corev1.NFSVolumeSource{
+				Server:   folder.Server,
+				Path:     folder.Path,
+				ReadOnly: folder.ReadOnly,
+			},
+		}
+	}
+	readOnly := folder.ReadOnly
+	source := &corev1.CSIVolumeSource{
+		Driver:   r.Options.Load().SMBDriver,
+		ReadOnly: &readOnly,
+		VolumeAttributes: map[string]string{
+			"source": fmt.Sprintf("//%s/%s", folder.Server, strings.Trim(folder.Path, "/")),
+		},
+	}
+	if len(folder.CredentialsSecret) != 0 {
+		source.NodePublishSecretRef = &corev1.LocalObjectReference{Name: folder.CredentialsSecret}
+	}
+	return corev1.VolumeSource{CSI: source}
+}
+
+// addSharedFoldersForPod mounts the NFS exports and SMB shares into code server container.
+func (r *CodeServerReconciler) addSharedFoldersForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	for index := range m.Spec.SharedFolders {
+		folder := &m.Spec.SharedFolders[index]
+		name := fmt.Sprintf(SharedFolderVolume, index)
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: r.sharedFolderSource(folder),
+		})
+		for i := range podSpec.Containers {
+			if podSpec.Containers[i].Name != CSNAME {
+				continue
+			}
+			podSpec.Containers[i].VolumeMounts = append(podSpec.Containers[i].VolumeMounts, corev1.VolumeMount{
+				Name:      name,
+				MountPath: folder.MountPath,
+				ReadOnly:  folder.ReadOnly,
+			})
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sort"
+	"sync"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// ManagedByLabel and InstanceLabel are set on resources created for code server.
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	InstanceLabel  = "codeserver.io/instance"
+	ManagedBy      = "code-server-operator"
+	// OrphanGracePeriod protects resources just created from being collected before cache catches up.
+	OrphanGracePeriod = 5 * time.Minute
+)
+
+// setOwnedLabels labels the resource as owned by code server, so that it can be found by orphan collector.
+func setOwnedLabels(obj metav1.Object, name string) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[ManagedByLabel] = ManagedBy
+	labels[InstanceLabel] = name
+	obj.SetLabels(labels)
+}
+
+// OrphanCollector periodically deletes the resources whose code server no longer exists (e.g. operator crashed
+// during deletion) and adopts the resources which miss owner reference of their existing code server.
+type OrphanCollector struct {
+	client.Client
+	Log     logr.Logger
+	Scheme  *runtime.Scheme
+	Options *CodeServerOption
+	// sweeping yields to user facing work of reconciler
+	scheduler *ReconcileScheduler
+	lock      sync.RWMutex
+	sweeps    int
+	deleted   map[string]int
+	adopted   map[string]int
+}
+
+func NewOrphanCollector(client client.Client, log logr.Logger, scheme *runtime.Scheme,
+	options *CodeServerOption, scheduler *ReconcileScheduler) *OrphanCollector {
+	return &OrphanCollector{
+		Client:    client,
+		Log:       log,
+		Scheme:    scheme,
+		Options:   options,
+		scheduler: scheduler,
+		deleted:   map[string]int{},
+		adopted:   map[string]int{},
+	}
+}
+
+func (o *OrphanCollector) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(o.Options.Load().GCInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			o.Sweep()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// Sweep checks all resources labeled as owned by code servers once.
+func (o *OrphanCollector) Sweep() {
+	o.sweepList(&appsv1.DeploymentList{})
+	o.sweepList(&corev1.ServiceList{})
+	o.sweepList(&extv1.IngressList{})
+	o.sweepList(&corev1.PersistentVolumeClaimList{})
+	o.lock.Lock()
+	o.sweeps += 1
+	o.lock.Unlock()
+}
+
+func (o *OrphanCollector) sweepList(list client.ObjectList) {
+	// resources controlled by code servers are deleted along with them by garbage collector of kubernetes
+	if err := o.Client.List(context.TODO(), list, client.MatchingLabels{ManagedByLabel: ManagedBy},
+		client.MatchingFields{IndexOwner: ""}); err != nil {
+		o.Log.Error(err, fmt.Sprintf("Failed to list %s for orphan collection.", resourceKind(list)))
+		return
+	}
+	var objects []client.Object
+	switch l := list.(type) {
+	case *appsv1.DeploymentList:
+		for i := range l.Items {
+			objects = append(objects, &l.Items[i])
+		}
+	case *corev1.ServiceList:
+		for i := range l.Items {
+			objects = append(objects, &l.Items[i])
+		}
+	case *extv1.IngressList:
+		for i := range l.Items {
+			objects = append(objects, &l.Items[i])
+		}
+	case *corev1.PersistentVolumeClaimList:
+		for i := range l.Items {
+			objects = append(objects, &l.Items[i])
+		}
+	}
+	for _, obj := range objects {
+		// remaining objects are checked in next sweep
+		if o.scheduler.Busy() {
+			return
+		}
+		o.sweep(obj)
+	}
+}
+
+func (o *OrphanCollector) sweep(obj client.Object) {
+	name, found := obj.GetLabels()[InstanceLabel]
+	if !found || time.Since(obj.GetCreationTimestamp().Time) < OrphanGracePeriod || !obj.GetDeletionTimestamp().IsZero() {
+		return
+	}
+	kind := resourceKind(obj)
+	reqLogger := o.Log.WithValues("namespace", obj.GetNamespace(), "name", obj.GetName(), "kind", kind)
+	codeServer := &csv1alpha1.CodeServer{}
+	err := o.Client.Get(context.TODO(), types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}, codeServer)
+	if err != nil && errors.IsNotFound(err) {
+		if err := o.Client.Delete(context.TODO(), obj); err != nil && !errors.IsNotFound(err) {
+			reqLogger.Error(err, "Failed to delete orphan resource.")
+			return
+		}
+		reqLogger.Info(fmt.Sprintf("orphan resource of code server %s has been deleted", name))
+		o.count(o.deleted, kind)
+		return
+	}
+	if err != nil {
+		reqLogger.Error(err, "Failed to get code server of resource.")
+		return
+	}
+	if metav1.GetControllerOf(obj) != nil || !codeServer.DeletionTimestamp.IsZero() {
+		return
+	}
+	if err := controllerutil.SetControllerReference(codeServer, obj, o.Scheme); err != nil {
+		reqLogger.Error(err, "Failed to set owner reference of resource.")
+		return
+	}
+	if err := o.Client.Update(context.TODO(), obj); err != nil {
+		reqLogger.Error(err, "Failed to adopt resource.")
+		return
+	}
+	reqLogger.Info(fmt.Sprintf("resource has been adopted by code server %s", name))
+	o.count(o.adopted, kind)
+}
+
+func (o *OrphanCollector) count(counter map[string]int, kind string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	counter[kind] += 1
+}
+
+// ServeHTTP exposes the collection counters in prometheus text format.
+func (o *OrphanCollector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP codeserver_orphan_sweeps_total Number of orphan resource sweeps.")
+	fmt.Fprintln(w, "# TYPE codeserver_orphan_sweeps_total counter")
+	fmt.Fprintf(w, "codeserver_orphan_sweeps_total %d\n", o.sweeps)
+	writeKindCounter(w, "codeserver_orphan_resources_deleted_total",
+		"Number of resources deleted since their code server no longer exists.", o.deleted)
+	writeKindCounter(w, "codeserver_orphan_resources_adopted_total",
+		"Number of resources adopted by their existing code server.", o.adopted)
+}
+
+func writeKindCounter(w http.ResponseWriter, name, help string, counter map[string]int) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	var kinds []string
+	for kind := range counter {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "%s{kind=%q} %d\n", name, kind, counter[kind])
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+	"github.com/opensourceways/code-server-operator/controllers/initplugins/git"
+)
+
+const (
+	GitpodConfigFile = ".gitpod.yml"
+	// GitpodConfigTTL is the time fetched .gitpod.yml is cached before fetched again
+	GitpodConfigTTL    = 5 * time.Minute
+	GitpodFetchTimeout = 10 * time.Second
+	GitpodPortName     = "gitpod-%d"
+	// GitpodInitMarker is created in repository once init tasks succeeded, so that they only run once
+	GitpodInitMarker = ".gitpod-init-done"
+	// GitpodInitContainer runs init tasks of .gitpod.yml
+	GitpodInitContainer = "gitpod-init"
+	GitpodTaskLog       = "/tmp/gitpod-task-%d.log"
+)
+
+// GitpodConfig is the subset of .gitpod.yml imported by operator
+type GitpodConfig struct {
+	// Image is either an image name or a dockerfile reference which isn't supported
+	Image interface{}  `json:"image,omitempty"`
+	Tasks []GitpodTask `json:"tasks,omitempty"`
+	Ports []GitpodPort `json:"ports,omitempty"`
+}
+
+type GitpodTask struct {
+	Name    string `json:"name,omitempty"`
+	Before  string `json:"before,omitempty"`
+	Init    string `json:"init,omitempty"`
+	Command string `json:"command,omitempty"`
+}
+
+type GitpodPort struct {
+	// Port is either a number or a range which isn't supported
+	Port intstr.IntOrString `json:"port"`
+	Name string             `json:"name,omitempty"`
+}
+
+type cachedGitpodConfig struct {
+	config    *GitpodConfig
+	fetchedAt time.Time
+}
+
+var gitpodConfigs = struct {
+	sync.Mutex
+	items map[string]cachedGitpodConfig
+}{items: map[string]cachedGitpodConfig{}}
+
+// gitpodConfigURL returns the raw url of .gitpod.yml, which is derived for github and gitlab repositories.
+func gitpodConfigURL(spec *csv1alpha1.GitpodConfigSpec) (string, error) {
+	if len(spec.ConfigURL) != 0 {
+		return spec.ConfigURL, nil
+	}
+	revision := spec.Revision
+	if len(revision) == 0 {
+		revision = "HEAD"
+	}
+	repository := strings.TrimSuffix(strings.TrimSuffix(spec.Repository, "/"), ".git")
+	switch {
+	case strings.HasPrefix(repository, "https://github.com/"):
+		return fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s",
+			strings.TrimPrefix(repository, "https://github.com/"), revision, GitpodConfigFile), nil
+	case strings.HasPrefix(repository, "https://gitlab.com/"):
+		return fmt.Sprintf("%s/-/raw/%s/%s", repository, revision, GitpodConfigFile), nil
+	}
+	return "", fmt.Errorf("config url is required for gitpod repository %s", spec.Repository)
+}
+
+// gitpodFolder returns the folder repository is cloned into under workspace.
+func gitpodFolder(spec *csv1alpha1.GitpodConfigSpec) string {
+	if len(spec.Folder) != 0 {
+		return spec.Folder
+	}
+	return path.Base(strings.TrimSuffix(strings.TrimSuffix(spec.Repository, "/"), ".git"))
+}
+
+// loadGitpodConfig fetches and parses .gitpod.yml of instance, nil is returned if not specified.
+func (r *CodeServerReconciler) loadGitpodConfig(m *csv1alpha1.CodeServer) (*GitpodConfig, error) {
+	if m.Spec.GitpodConfig == nil {
+		return nil, nil
+	}
+	url, err := gitpodConfigURL(m.Spec.GitpodConfig)
+	if err != nil {
+		return nil, err
+	}
+	gitpodConfigs.Lock()
+	cached, found := gitpodConfigs.items[url]
+	gitpodConfigs.Unlock()
+	if found && time.Since(cached.fetchedAt) < GitpodConfigTTL {
+		return cached.config, nil
+	}
+	client := http.Client{Timeout: GitpodFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s, status code %d", url, resp.StatusCode)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	config := &GitpodConfig{}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", url, err)
+	}
+	gitpodConfigs.Lock()
+	gitpodConfigs.items[url] = cachedGitpodConfig{config: config, fetchedAt: time.Now()}
+	gitpodConfigs.Unlock()
+	return config, nil
+}
+
+// gitpodServicePorts returns the service ports declared in .gitpod.yml, port ranges and ports used by
+// operator are skipped.
+func gitpodServicePorts(config *GitpodConfig) []corev1.ServicePort {
+	var ports []corev1.ServicePort
+	if config == nil {
+		return ports
+	}
+	for _, port := range config.Ports {
+		if port.Port.Type != intstr.Int || port.Port.IntVal == HttpPort || port.Port.IntVal == ExporterPort {
+			continue
+		}
+		ports = append(ports, corev1.ServicePort{
+			Name:       fmt.Sprintf(GitpodPortName, port.Port.IntVal),
+			Port:       port.Port.IntVal,
+			Protocol:   corev1.ProtocolTCP,
+			TargetPort: intstr.FromInt(int(port.Port.IntVal)),
+		})
+	}
+	return ports
+}
+
+// addGitpodForPod clones repository, runs init tasks with the image of .gitpod.yml in init containers and
+// starts the command tasks in background once code server container started.
+func (r *CodeServerReconciler) addGitpodForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) error {
+	config, err := r.loadGitpodConfig(m)
+	if err != nil || config == nil {
+		return err
+	}
+	workDir := path.Join(VSCodeProjectDir, gitpodFolder(m.Spec.GitpodConfig))
+	if !strings.HasPrefix(workDir, VSCodeProjectDir+"/") {
+		return fmt.Errorf("gitpod folder %s is outside of %s", m.Spec.GitpodConfig.Folder, VSCodeProjectDir)
+	}
+	mounts := []corev1.VolumeMount{{MountPath: VSCodeProjectDir, Name: VSCodeProjectVolume}}
+	// values from spec are passed in environments rather than interpolated into the script
+	clone := `[ -d "$GITPOD_WORKDIR" ] || git clone -- "$GITPOD_REPOSITORY" "$GITPOD_WORKDIR"`
+	if len(m.Spec.GitpodConfig.Revision) != 0 {
+		clone = `[ -d "$GITPOD_WORKDIR" ] || git clone --branch "$GITPOD_REVISION" -- "$GITPOD_REPOSITORY" "$GITPOD_WORKDIR"`
+	}
+	podSpec.InitContainers = append(podSpec.InitContainers, corev1.Container{
+		Name:            "gitpod-clone",
+		Image:           git.DefaultImageUrl,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"sh", "-c", clone},
+		Env: []corev1.EnvVar{
+			{Name: "GITPOD_REPOSITORY", Value: m.Spec.GitpodConfig.Repository},
+			{Name: "GITPOD_REVISION", Value: m.Spec.GitpodConfig.Revision},
+			{Name: "GITPOD_WORKDIR", Value: workDir},
+		},
+		VolumeMounts: mounts,
+	})
+	var inits, commands []string
+	for _, task := range config.Tasks {
+		if len(task.Init) != 0 {
+			inits = append(inits, joinGitpodScripts(task.Before, task.Init))
+		}
+		if len(task.Command) != 0 {
+			commands = append(commands, joinGitpodScripts(task.Before, task.Command))
+		}
+	}
+	if len(inits) != 0 {
+		image := m.Spec.Image
+		if name, ok := config.Image.(string); ok && len(name) != 0 {
+			image = name
+		}
+		marker := path.Join(workDir, GitpodInitMarker)
+		script := fmt.Sprintf("cd %s && { [ -f %s ] || { (%s) && touch %s; }; }", shellQuote(workDir),
+			shellQuote(marker), strings.Join(inits, ") && ("), shellQuote(marker))
+		podSpec.InitContainers = append(podSpec.InitContainers, corev1.Container{
+			Name:            GitpodInitContainer,
+			Image:           image,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Command:         []string{"bash", "-c", script},
+			WorkingDir:      workDir,
+			VolumeMounts:    mounts,
+		})
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	// postStart blocks the container until it returns, so commands are detached
+	var detached []string
+	for index, command := range commands {
+		detached = append(detached, fmt.Sprintf("(nohup bash -c %s > %s 2>&1 &)", shellQuote(command),
+			fmt.Sprintf(GitpodTaskLog, index)))
+	}
+	for index := range podSpec.Containers {
+		if podSpec.Containers[index].Name != CSNAME {
+			continue
+		}
+		podSpec.Containers[index].Lifecycle = &corev1.Lifecycle{
+			PostStart: &corev1.LifecycleHandler{
+				Exec: &corev1.ExecAction{
+					Command: []string{"sh", "-c", fmt.Sprintf("cd %s && %s", shellQuote(workDir),
+						strings.Join(detached, "; "))},
+				},
+			},
+		}
+	}
+	return nil
+}
+
+func joinGitpodScripts(scripts ...string) string {
+	var lines []string
+	for _, script := range scripts {
+		if script = strings.TrimSpace(script); len(script) != 0 {
+			lines = append(lines, script)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// shellQuote quotes value in single quotes for sh.
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'"'"'`, -1) + "'"
+}
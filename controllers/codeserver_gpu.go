@@ -0,0 +1,130 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// GPUResources maps gpu vendors to the resources exposed by their device plugins
+var GPUResources = map[csv1alpha1.GPUVendor]corev1.ResourceName{
+	csv1alpha1.GPUNvidia: "nvidia.com/gpu",
+	csv1alpha1.GPUAMD:    "amd.com/gpu",
+}
+
+// requestedGPU returns the gpu resource and count requested either via gpu spec or resources.
+func requestedGPU(m *csv1alpha1.CodeServer) (corev1.ResourceName, int64) {
+	if m.Spec.GPU != nil && m.Spec.GPU.Count > 0 {
+		vendor := m.Spec.GPU.Vendor
+		if len(vendor) == 0 {
+			vendor = csv1alpha1.GPUNvidia
+		}
+		return GPUResources[vendor], m.Spec.GPU.Count
+	}
+	for _, name := range []corev1.ResourceName{GPUResources[csv1alpha1.GPUNvidia], GPUResources[csv1alpha1.GPUAMD]} {
+		if value, ok := m.Spec.Resources.Limits[name]; ok {
+			return name, value.Value()
+		}
+		if value, ok := m.Spec.Resources.Requests[name]; ok {
+			return name, value.Value()
+		}
+	}
+	return "", 0
+}
+
+// addGPUForPod requests gpus for the container specified and schedules pod to gpu node pool if configured.
+// Extended resources must be specified in limits, therefore limits and requests are both set.
+func (r *CodeServerReconciler) addGPUForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec, containerName string) {
+	resourceName, count := requestedGPU(m)
+	if count == 0 {
+		return
+	}
+	quantity := *resourcev1.NewQuantity(count, resourcev1.DecimalSI)
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name != containerName {
+			continue
+		}
+		resources := podSpec.Containers[i].Resources.DeepCopy()
+		if resources.Limits == nil {
+			resources.Limits = corev1.ResourceList{}
+		}
+		if resources.Requests == nil {
+			resources.Requests = corev1.ResourceList{}
+		}
+		resources.Limits[resourceName] = quantity
+		resources.Requests[resourceName] = quantity
+		podSpec.Containers[i].Resources = *resources
+	}
+	if m.Spec.GPU == nil {
+		return
+	}
+	if len(m.Spec.GPU.NodeSelector) != 0 {
+		selector := map[string]string{}
+		for key, value := range podSpec.NodeSelector {
+			selector[key] = value
+		}
+		for key, value := range m.Spec.GPU.NodeSelector {
+			selector[key] = value
+		}
+		podSpec.NodeSelector = selector
+	}
+	if m.Spec.GPU.TolerateTaint {
+		podSpec.Tolerations = append(podSpec.Tolerations, corev1.Toleration{
+			Key:      string(resourceName),
+			Operator: corev1.TolerationOpExists,
+			Effect:   corev1.TaintEffectNoSchedule,
+		})
+	}
+}
+
+// gpuAllocation collects the gpus allocated to the running pod of code server.
+func (r *CodeServerReconciler) gpuAllocation(m *csv1alpha1.CodeServer) *csv1alpha1.GPUAllocation {
+	resourceName, count := requestedGPU(m)
+	if count == 0 {
+		return nil
+	}
+	reqLogger := r.instanceLog(m)
+	pods := &corev1.PodList{}
+	if err := r.Client.List(context.TODO(), pods, client.InNamespace(m.Namespace),
+		client.MatchingLabels(appLabel(m.Name))); err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to list pods for gpu allocation of %s.", m.Name))
+		return m.Status.GPUAllocation
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		allocated := int64(0)
+		for _, container := range pod.Spec.Containers {
+			if value, ok := container.Resources.Limits[resourceName]; ok {
+				allocated += value.Value()
+			}
+		}
+		return &csv1alpha1.GPUAllocation{
+			Resource: string(resourceName),
+			Count:    allocated,
+			NodeName: pod.Spec.NodeName,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	HomeVolume = "code-server-home"
+	HomeDir    = "/home/coder"
+	// HomeLabel marks the home volume with its owner, home volumes are never deleted by operator
+	HomeLabel        = "codeserver.io/home-of"
+	HomeClaimPrefix  = "home-"
+	HomeClaimSuffix  = "-home"
+	HomeMaxClaimName = 63
+)
+
+func homeEnabled(m *csv1alpha1.CodeServer) bool {
+	return m.Spec.Home != nil && strings.EqualFold(string(m.Spec.Runtime), string(csv1alpha1.RuntimeCode))
+}
+
+// homeClaimName returns the home volume shared by instances of the same user, the name is suffixed by the hash of
+// the raw owner so that users whose names normalize to the same name or share a long prefix get distinct volumes.
+func homeClaimName(m *csv1alpha1.CodeServer) string {
+	if len(m.Spec.Home.ClaimName) != 0 {
+		return m.Spec.Home.ClaimName
+	}
+	name := m.Name + HomeClaimSuffix
+	if user := m.Annotations[UserAnnotation]; len(user) != 0 {
+		name = HomeClaimPrefix + user
+	}
+	return identityName(normalizeName(name), HomeMaxClaimName, homeIdentity(m))
+}
+
+// rawHomeOwner returns the user of instance, or the name of instance without user.
+func rawHomeOwner(m *csv1alpha1.CodeServer) string {
+	if user := m.Annotations[UserAnnotation]; len(user) != 0 {
+		return user
+	}
+	return m.Name
+}
+
+// homeIdentity returns the raw owner of home volume, users and instances are told apart.
+func homeIdentity(m *csv1alpha1.CodeServer) string {
+	if user := m.Annotations[UserAnnotation]; len(user) != 0 {
+		return "user/" + user
+	}
+	return "instance/" + m.Name
+}
+
+// homeOwner returns the label value of home volume of instance.
+func homeOwner(m *csv1alpha1.CodeServer) string {
+	return identityName(normalizeName(rawHomeOwner(m)), MaxChildNameLength, homeIdentity(m))
+}
+
+// ownsHome returns whether home volume belongs to the owner of instance.
+func ownsHome(m *csv1alpha1.CodeServer, pvc *corev1.PersistentVolumeClaim) bool {
+	return pvc.Labels[HomeLabel] == homeOwner(m)
+}
+
+// reconcileForHome creates the home volume if absent, it's not owned by instance so that it survives recycles
+// and deletion of instance.
+func (r *CodeServerReconciler) reconcileForHome(codeServer *csv1alpha1.CodeServer) error {
+	if !homeEnabled(codeServer) {
+		return nil
+	}
+	reqLogger := r.instanceLog(codeServer)
+	name := homeClaimName(codeServer)
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, pvc)
+	if err == nil {
+		// claims of other users, e.g. specified by spec.home.claimName, are never mounted
+		if ownsHome(codeServer, pvc) {
+			return nil
+		}
+		return fmt.Errorf("home volume %s doesn't belong to %s", name, rawHomeOwner(codeServer))
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+	quantity, err := resourcev1.ParseQuantity(codeServer.Spec.Home.StorageSize)
+	if err != nil {
+		return fmt.Errorf("invalid home storage size %s: %v", codeServer.Spec.Home.StorageSize, err)
+	}
+	storageName := codeServer.Spec.Home.StorageName
+	if len(storageName) == 0 {
+		storageName = codeServer.Spec.StorageName
+	}
+	accessModes := codeServer.Spec.Home.AccessModes
+	if len(accessModes) == 0 {
+		accessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+	}
+	pvc = &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: codeServer.Namespace,
+			Labels:    map[string]string{HomeLabel: homeOwner(codeServer)},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: accessModes,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: quantity},
+			},
+		},
+	}
+	if len(storageName) != 0 && storageName != StorageEmptyDir {
+		pvc.Spec.StorageClassName = &storageName
+	}
+	reqLogger.Info(fmt.Sprintf("creating home volume %s", name))
+	return r.Client.Create(context.TODO(), pvc)
+}
+
+// addHomeForPod mounts home volume at home dir, the share dir of code server is moved into home volume so that
+// extensions and their state are kept.
+func addHomeForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	if !homeEnabled(m) {
+		return
+	}
+	relocate := func(container *corev1.Container) {
+		for index := range container.VolumeMounts {
+			if container.VolumeMounts[index].Name == VSCodeShareVolume {
+				container.VolumeMounts[index].Name = HomeVolume
+				container.VolumeMounts[index].SubPath = strings.TrimPrefix(VSCodeShareDir, HomeDir+"/")
+			}
+		}
+	}
+	for index := range podSpec.InitContainers {
+		relocate(&podSpec.InitContainers[index])
+	}
+	for index := range podSpec.Containers {
+		relocate(&podSpec.Containers[index])
+		if podSpec.Containers[index].Name == CSNAME {
+			podSpec.Containers[index].VolumeMounts = append([]corev1.VolumeMount{{Name: HomeVolume, MountPath: HomeDir}},
+				podSpec.Containers[index].VolumeMounts...)
+		}
+	}
+	var volumes []corev1.Volume
+	for _, volume := range podSpec.Volumes {
+		if volume.Name != VSCodeShareVolume {
+			volumes = append(volumes, volume)
+		}
+	}
+	podSpec.Volumes = append(volumes, corev1.Volume{
+		Name: HomeVolume,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: homeClaimName(m)},
+		},
+	})
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"path"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	HostPathVolume = "host-path-%d"
+	// PinnedNodeAnnotation records the node instance is pinned to, since its workspace or host paths only exist on
+	// that node. Remove it to let instance be scheduled elsewhere.
+	PinnedNodeAnnotation = "codeserver.io/pinned-node"
+)
+
+// hostPathTenant returns the directory of tenant of instance under the prefixes, i.e. its namespace and user, so
+// that tenants can't mount the data of each other.
+func hostPathTenant(m *csv1alpha1.CodeServer) string {
+	if user := normalizeName(m.Annotations[UserAnnotation]); len(user) != 0 {
+		return path.Join(m.Namespace, user)
+	}
+	return m.Namespace
+}
+
+// hostPathAllowed returns true if path is the directory of tenant under one of prefixes or under that directory.
+func hostPathAllowed(prefixes []string, tenant, hostPath string) bool {
+	if !path.IsAbs(hostPath) || len(tenant) == 0 || path.IsAbs(tenant) || path.Clean(tenant) != tenant ||
+		strings.HasPrefix(tenant, "..") {
+		return false
+	}
+	hostPath = path.Clean(hostPath)
+	for _, prefix := range prefixes {
+		if !path.IsAbs(prefix) {
+			continue
+		}
+		dir := path.Join(prefix, tenant)
+		if hostPath == dir || strings.HasPrefix(hostPath, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHostPaths checks the host paths of instance are allowed by operator.
+func validateHostPaths(m *csv1alpha1.CodeServer, prefixes []string) error {
+	tenant := hostPathTenant(m)
+	for _, hostPath := range m.Spec.HostPaths {
+		if !hostPathAllowed(prefixes, tenant, hostPath.Path) {
+			return fmt.Errorf("host path %s is not allowed by operator, it must be under <prefix>/%s",
+				hostPath.Path, tenant)
+		}
+	}
+	return nil
+}
+
+// pinPodToNode requires pod to be scheduled on node, the node is matched by name since the hostname label may differ
+// from the node name, e.g. on cloud providers. Required node affinity of profile and data locality is kept.
+func pinPodToNode(podSpec *corev1.PodSpec, node string) {
+	if len(node) == 0 {
+		return
+	}
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = &corev1.Affinity{}
+	}
+	if podSpec.Affinity.NodeAffinity == nil {
+		podSpec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := podSpec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	required := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	required.NodeSelectorTerms = andNodeSelectorTerms(required.NodeSelectorTerms, []corev1.NodeSelectorTerm{{
+		MatchFields: []corev1.NodeSelectorRequirement{{
+			Key:      metav1.ObjectNameField,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{node},
+		}},
+	}})
+}
+
+// addHostPathsForPod mounts the host paths into code server container.
+func addHostPathsForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	for index, hostPath := range m.Spec.HostPaths {
+		name := fmt.Sprintf(HostPathVolume, index)
+		hostPathType := hostPath.Type
+		if len(hostPathType) == 0 {
+			hostPathType = corev1.HostPathDirectoryOrCreate
+		}
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: path.Clean(hostPath.Path),
+					Type: &hostPathType,
+				},
+			},
+		})
+		for i := range podSpec.Containers {
+			if podSpec.Containers[i].Name != CSNAME {
+				continue
+			}
+			podSpec.Containers[i].VolumeMounts = append(podSpec.Containers[i].VolumeMounts, corev1.VolumeMount{
+				Name:      name,
+				MountPath: hostPath.MountPath,
+				ReadOnly:  hostPath.ReadOnly,
+			})
+		}
+	}
+}
+
+// volumeNode returns the node local or host path volume lives on, either its name or its hostname label, empty if
+// volume isn't pinned to a single node.
+func volumeNode(pv *corev1.PersistentVolume) (name string, hostname string) {
+	if (pv.Spec.Local == nil && pv.Spec.HostPath == nil) || pv.Spec.NodeAffinity == nil ||
+		pv.Spec.NodeAffinity.Required == nil || len(pv.Spec.NodeAffinity.Required.NodeSelectorTerms) != 1 {
+		return "", ""
+	}
+	term := pv.Spec.NodeAffinity.Required.NodeSelectorTerms[0]
+	for _, requirement := range term.MatchFields {
+		if requirement.Key == metav1.ObjectNameField && requirement.Operator == corev1.NodeSelectorOpIn &&
+			len(requirement.Values) == 1 {
+			return requirement.Values[0], ""
+		}
+	}
+	for _, requirement := range term.MatchExpressions {
+		if requirement.Key == corev1.LabelHostname && requirement.Operator == corev1.NodeSelectorOpIn &&
+			len(requirement.Values) == 1 {
+			return "", requirement.Values[0]
+		}
+	}
+	return "", ""
+}
+
+// nodeOfHostname returns the name of the only node labeled with hostname, empty if there isn't exactly one.
+func (r *CodeServerReconciler) nodeOfHostname(hostname string) (string, error) {
+	nodes := &corev1.NodeList{}
+	if err := r.Client.List(context.TODO(), nodes, client.MatchingLabels{corev1.LabelHostname: hostname}); err != nil {
+		return "", err
+	}
+	if len(nodes.Items) != 1 {
+		return "", nil
+	}
+	return nodes.Items[0].Name, nil
+}
+
+// pinnedNode returns the node instance is to be pinned to, i.e. the node of its local workspace volume, or the node
+// it runs on if it mounts host paths. Empty is returned until the node is known.
+func (r *CodeServerReconciler) pinnedNode(codeServer *csv1alpha1.CodeServer) (string, error) {
+	if r.needDeployPVC(codeServer.Spec.StorageName) {
+		pvc := &corev1.PersistentVolumeClaim{}
+		err := r.Client.Get(context.TODO(), types.NamespacedName{Name: codeServer.Name, Namespace: codeServer.Namespace},
+			pvc)
+		if err != nil && !errors.IsNotFound(err) {
+			return "", err
+		}
+		if err == nil && len(pvc.Spec.VolumeName) != 0 {
+			pv := &corev1.PersistentVolume{}
+			if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: pvc.Spec.VolumeName}, pv); err != nil {
+				return "", err
+			}
+			name, hostname := volumeNode(pv)
+			if len(hostname) != 0 {
+				var err error
+				if name, err = r.nodeOfHostname(hostname); err != nil {
+					return "", err
+				}
+			}
+			if len(name) != 0 {
+				return name, nil
+			}
+		}
+	}
+	if len(codeServer.Spec.HostPaths) == 0 {
+		return "", nil
+	}
+	pod, err := r.latestPod(codeServer)
+	if err != nil || pod == nil || pod.Status.Phase != corev1.PodRunning {
+		return "", err
+	}
+	return pod.Spec.NodeName, nil
+}
+
+// reconcileForPinning pins instance to the node of its local workspace volume or host paths, so that the pods of
+// instance, e.g. after hibernation, and its jobs are scheduled where the data lives.
+func (r *CodeServerReconciler) reconcileForPinning(codeServer *csv1alpha1.CodeServer) error {
+	if len(codeServer.Annotations[PinnedNodeAnnotation]) != 0 {
+		return nil
+	}
+	node, err := r.pinnedNode(codeServer)
+	if err != nil || len(node) == 0 {
+		return err
+	}
+	if codeServer.Annotations == nil {
+		codeServer.Annotations = map[string]string{}
+	}
+	codeServer.Annotations[PinnedNodeAnnotation] = node
+	if err := r.Client.Update(context.TODO(), codeServer); err != nil {
+		return err
+	}
+	r.instanceLog(codeServer).Info(fmt.Sprintf("instance has been pinned to node %s", node))
+	r.Recorder.Eventf(codeServer, corev1.EventTypeNormal, EventNodePinned, "Pinned to node %s", node)
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+func TestHostPathAllowed(t *testing.T) {
+	prefixes := []string{"/mnt/nvme", "/data/"}
+	tests := []struct {
+		name     string
+		prefixes []string
+		tenant   string
+		path     string
+		want     bool
+	}{
+		{name: "tenant directory", prefixes: prefixes, tenant: "team/alice", path: "/mnt/nvme/team/alice", want: true},
+		{name: "under tenant directory", prefixes: prefixes, tenant: "team/alice", path: "/data/team/alice/x/",
+			want: true},
+		{name: "namespace tenant", prefixes: prefixes, tenant: "team", path: "/mnt/nvme/team/x", want: true},
+		{name: "prefix itself", prefixes: prefixes, tenant: "team/alice", path: "/mnt/nvme"},
+		{name: "other tenant", prefixes: prefixes, tenant: "team/alice", path: "/mnt/nvme/team/bob"},
+		{name: "tenant name prefix", prefixes: prefixes, tenant: "team/alice", path: "/mnt/nvme/team/alice2"},
+		{name: "escaping by dot dot", prefixes: prefixes, tenant: "team/alice",
+			path: "/mnt/nvme/team/alice/../bob"},
+		{name: "relative path", prefixes: prefixes, tenant: "team/alice", path: "mnt/nvme/team/alice"},
+		{name: "other directory", prefixes: prefixes, tenant: "team/alice", path: "/etc/team/alice"},
+		{name: "no prefixes", tenant: "team/alice", path: "/mnt/nvme/team/alice"},
+		{name: "relative prefix ignored", prefixes: []string{"mnt"}, tenant: "team", path: "/mnt/team"},
+		{name: "empty tenant", prefixes: prefixes, path: "/mnt/nvme/team"},
+		{name: "escaping tenant", prefixes: prefixes, tenant: "../etc", path: "/mnt/etc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hostPathAllowed(tt.prefixes, tt.tenant, tt.path); got != tt.want {
+				t.Errorf("hostPathAllowed(%v, %q, %q) = %v, want %v", tt.prefixes, tt.tenant, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostPathTenant(t *testing.T) {
+	tests := []struct {
+		name string
+		user string
+		want string
+	}{
+		{name: "namespace without user", want: "team"},
+		{name: "namespace and user", user: "alice", want: "team/alice"},
+		{name: "normalized user", user: "Alice@Example.com", want: "team/alice-example-com"},
+		{name: "user escaping directory", user: "../bob", want: "team/bob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &csv1alpha1.CodeServer{ObjectMeta: metav1.ObjectMeta{Namespace: "team",
+				Annotations: map[string]string{UserAnnotation: tt.user}}}
+			if got := hostPathTenant(m); got != tt.want {
+				t.Errorf("hostPathTenant(%q) = %q, want %q", tt.user, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinPodToNode(t *testing.T) {
+	pinned := corev1.NodeSelectorRequirement{Key: metav1.ObjectNameField, Operator: corev1.NodeSelectorOpIn,
+		Values: []string{"node-1"}}
+	zone := corev1.NodeSelectorRequirement{Key: corev1.LabelTopologyZone, Operator: corev1.NodeSelectorOpExists}
+	tests := []struct {
+		name     string
+		affinity *corev1.Affinity
+		node     string
+		want     []corev1.NodeSelectorTerm
+	}{
+		{name: "not pinned"},
+		{name: "no affinity", node: "node-1",
+			want: []corev1.NodeSelectorTerm{{MatchFields: []corev1.NodeSelectorRequirement{pinned}}}},
+		{name: "required affinity kept", node: "node-1", affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{zone}}}}}},
+			want: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{zone},
+				MatchFields: []corev1.NodeSelectorRequirement{pinned}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			podSpec := &corev1.PodSpec{Affinity: tt.affinity}
+			pinPodToNode(podSpec, tt.node)
+			var got []corev1.NodeSelectorTerm
+			if podSpec.Affinity != nil && podSpec.Affinity.NodeAffinity != nil &&
+				podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+				got = podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			}
+			if !equality.Semantic.DeepEqual(got, tt.want) {
+				t.Errorf("pinPodToNode() terms = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"strconv"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// ideFlavor describes how an IDE backend is started, probed and opened, every backend listens on HttpPort.
+type ideFlavor struct {
+	// arguments returns the arguments of IDE serving workspace dir.
+	arguments func(m *csv1alpha1.CodeServer, workDir string) []string
+	// envs are the environments required by IDE.
+	envs []corev1.EnvVar
+	// healthPath is probed when instance doesn't specify connect probe.
+	healthPath string
+	// urlQuery returns the query of URL opening workspace dir.
+	urlQuery func(workDir string) string
+}
+
+var ideFlavors = map[csv1alpha1.IDEFlavor]ideFlavor{
+	csv1alpha1.IDECodeServer: {
+		arguments: func(m *csv1alpha1.CodeServer, workDir string) []string {
+			// arguments of instance come first so that the ones generated by operator take precedence
+			arguments := codeServerArguments(m)
+			arguments = append(arguments, []string{"--port", strconv.Itoa(HttpPort)}...)
+			arguments = append(arguments, []string{"--verbose"}...)
+			arguments = append(arguments, absProxyArguments(m)...)
+			arguments = append(arguments, authArguments(m)...)
+			return append(arguments, workDir)
+		},
+		healthPath: "healthz",
+		urlQuery: func(workDir string) string {
+			return ""
+		},
+	},
+	csv1alpha1.IDEOpenVSCode: {
+		arguments: func(m *csv1alpha1.CodeServer, workDir string) []string {
+			arguments := []string{"--host", "0.0.0.0", "--port", strconv.Itoa(HttpPort), "--without-connection-token",
+				"--default-folder", workDir}
+			if prefix := ideBasePath(m); len(prefix) != 0 {
+				arguments = append(arguments, "--server-base-path", prefix)
+			}
+			return arguments
+		},
+		healthPath: "version",
+		urlQuery: func(workDir string) string {
+			return "?folder=" + workDir
+		},
+	},
+	csv1alpha1.IDEJetBrains: {
+		arguments: func(m *csv1alpha1.CodeServer, workDir string) []string {
+			// projector is started by run script of image
+			return nil
+		},
+		envs: []corev1.EnvVar{
+			{Name: "ORG_JETBRAINS_PROJECTOR_SERVER_PORT", Value: strconv.Itoa(HttpPort)},
+		},
+		urlQuery: func(workDir string) string {
+			return ""
+		},
+	},
+}
+
+func ideFlavorOf(m *csv1alpha1.CodeServer) ideFlavor {
+	if m.Spec.IDE != nil {
+		if flavor, found := ideFlavors[m.Spec.IDE.Flavor]; found {
+			return flavor
+		}
+	}
+	return ideFlavors[csv1alpha1.IDECodeServer]
+}
+
+// validateIDE checks the features specific to code server are not used by other IDE backends.
+func validateIDE(m *csv1alpha1.CodeServer) error {
+	if m.Spec.IDE == nil || len(m.Spec.IDE.Flavor) == 0 || m.Spec.IDE.Flavor == csv1alpha1.IDECodeServer {
+		return nil
+	}
+	if _, found := ideFlavors[m.Spec.IDE.Flavor]; !found {
+		return fmt.Errorf("unsupported ide flavor %s", m.Spec.IDE.Flavor)
+	}
+	if m.Spec.Auth == csv1alpha1.AuthPassword || m.Spec.Auth == csv1alpha1.AuthToken {
+		return fmt.Errorf("auth %s is only supported by codeserver flavor", m.Spec.Auth)
+	}
+	if len(m.Spec.Extensions) != 0 || m.Spec.CodeServer != nil {
+		return errors.New("extensions and code server arguments are only supported by codeserver flavor")
+	}
+	if m.Spec.IDE.Flavor == csv1alpha1.IDEJetBrains && routingMode(m) == csv1alpha1.RoutingPathPrefix {
+		return errors.New("path prefix routing is not supported by jetbrains flavor")
+	}
+	return nil
+}
+
+// ideEnvs returns environments of IDE container, environments specified by instance take precedence.
+func ideEnvs(m *csv1alpha1.CodeServer) []corev1.EnvVar {
+	envs := append([]corev1.EnvVar{}, m.Spec.Envs...)
+	existing := map[string]bool{}
+	for _, env := range envs {
+		existing[env.Name] = true
+	}
+	for _, env := range ideFlavorOf(m).envs {
+		if !existing[env.Name] {
+			envs = append(envs, env)
+		}
+	}
+	return envs
+}
+
+// ideBasePath returns the path IDE serves under inside the pod without trailing slash, only openvscode flavor
+// serves under the path prefix of instance.
+func ideBasePath(m *csv1alpha1.CodeServer) string {
+	if m.Spec.IDE != nil && m.Spec.IDE.Flavor == csv1alpha1.IDEOpenVSCode {
+		return instancePathPrefix(m)
+	}
+	return ""
+}
+
+// connectProbe returns the relative path probed to detect whether instance is reachable.
+func connectProbe(m *csv1alpha1.CodeServer) string {
+	if len(m.Spec.ConnectProbe) != 0 || !strings.EqualFold(string(m.Spec.Runtime), string(csv1alpha1.RuntimeCode)) {
+		return m.Spec.ConnectProbe
+	}
+	return ideFlavorOf(m).healthPath
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// field indexes of cached objects, which let lists select matching objects rather than scanning all of them
+const (
+	// IndexOwner indexes resources by name of the code server controlling them, empty if not controlled by one
+	IndexOwner = ".metadata.controller"
+	// IndexPhase indexes code servers by phase
+	IndexPhase = ".status.phase"
+	// IndexRoute indexes code servers by subdomain, or path prefix in path prefix routing mode
+	IndexRoute = ".spec.route"
+
+	codeServerKind = "CodeServer"
+)
+
+// UnrecycledPhases are the phases of code servers whose resources are not released yet.
+var UnrecycledPhases = []string{PhasePending, PhaseReady, PhaseErrored, PhasePendingRecycle, PhaseInactive}
+
+// SetupIndexes registers field indexes to the cache of manager.
+func SetupIndexes(mgr ctrl.Manager) error {
+	indexer := mgr.GetFieldIndexer()
+	for _, obj := range []client.Object{&appsv1.Deployment{}, &corev1.Service{}, &extv1.Ingress{},
+		&corev1.PersistentVolumeClaim{}} {
+		if err := indexer.IndexField(context.TODO(), obj, IndexOwner, func(obj client.Object) []string {
+			owner := metav1.GetControllerOf(obj)
+			if owner == nil || owner.Kind != codeServerKind {
+				return []string{""}
+			}
+			return []string{owner.Name}
+		}); err != nil {
+			return err
+		}
+	}
+	if err := indexer.IndexField(context.TODO(), &csv1alpha1.CodeServer{}, IndexPhase,
+		func(obj client.Object) []string {
+			return []string{CodeServerPhase(obj.(*csv1alpha1.CodeServer))}
+		}); err != nil {
+		return err
+	}
+	return indexer.IndexField(context.TODO(), &csv1alpha1.CodeServer{}, IndexRoute, func(obj client.Object) []string {
+		return []string{routeKey(obj.(*csv1alpha1.CodeServer))}
+	})
+}
+
+// routeKey returns the value code server is indexed by in IndexRoute.
+func routeKey(m *csv1alpha1.CodeServer) string {
+	if routingMode(m) == csv1alpha1.RoutingPathPrefix {
+		return instancePathPrefix(m)
+	}
+	return m.Spec.Subdomain
+}
+
+// listCodeServers lists code servers in any of phases.
+func listCodeServers(c client.Client, phases []string, opts ...client.ListOption) ([]csv1alpha1.CodeServer, error) {
+	var codeServers []csv1alpha1.CodeServer
+	for _, phase := range phases {
+		list := &csv1alpha1.CodeServerList{}
+		if err := c.List(context.TODO(), list, append(opts, client.MatchingFields{IndexPhase: phase})...); err != nil {
+			return nil, err
+		}
+		codeServers = append(codeServers, list.Items...)
+	}
+	return codeServers, nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"net"
+	"strconv"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// ipFamiliesOf returns the ip families and policy of instance services, both are nil if not specified.
+func ipFamiliesOf(m *csv1alpha1.CodeServer) ([]corev1.IPFamily, *corev1.IPFamilyPolicyType) {
+	if m.Spec.Network == nil {
+		return nil, nil
+	}
+	return m.Spec.Network.IPFamilies, m.Spec.Network.IPFamilyPolicy
+}
+
+// validateIPFamilies checks the ip families of instance are consistent with policy, and that the ingress controller
+// can reach the service of instance: the primary family for single-stack, any family for dual-stack since
+// endpoints of both families are published then.
+func (r *CodeServerReconciler) validateIPFamilies(m *csv1alpha1.CodeServer) error {
+	families, policy := ipFamiliesOf(m)
+	seen := map[corev1.IPFamily]bool{}
+	for _, family := range families {
+		if family != corev1.IPv4Protocol && family != corev1.IPv6Protocol {
+			return fmt.Errorf("ip family %s is not supported, only IPv4 and IPv6 are allowed", family)
+		}
+		if seen[family] {
+			return fmt.Errorf("ip family %s is duplicated", family)
+		}
+		seen[family] = true
+	}
+	singleStack := policy == nil || *policy == corev1.IPFamilyPolicySingleStack
+	if singleStack && len(families) > 1 {
+		return fmt.Errorf("dual-stack ip families require PreferDualStack or RequireDualStack policy")
+	}
+	if len(families) == 0 || len(r.Options.Load().IngressIPFamilies) == 0 {
+		return nil
+	}
+	reachable := families[:1]
+	if !singleStack {
+		reachable = families
+	}
+	for _, family := range reachable {
+		if containsString(r.Options.Load().IngressIPFamilies, string(family)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("ip families %v of instance can't be reached by ingress controller supporting %v",
+		families, r.Options.Load().IngressIPFamilies)
+}
+
+// addIPFamiliesForService passes the ip families of instance through to service.
+func addIPFamiliesForService(m *csv1alpha1.CodeServer, service *corev1.Service) {
+	families, policy := ipFamiliesOf(m)
+	if len(families) != 0 {
+		service.Spec.IPFamilies = append([]corev1.IPFamily{}, families...)
+	}
+	if policy != nil {
+		value := *policy
+		service.Spec.IPFamilyPolicy = &value
+	}
+}
+
+// ipFamiliesChanged returns true if the specified ip families or policy differ from live service, unspecified
+// ones are defaulted by cluster and left alone.
+func ipFamiliesChanged(old, new *corev1.Service) bool {
+	return (len(new.Spec.IPFamilies) != 0 && !equality.Semantic.DeepEqual(old.Spec.IPFamilies, new.Spec.IPFamilies)) ||
+		(new.Spec.IPFamilyPolicy != nil && !equality.Semantic.DeepEqual(old.Spec.IPFamilyPolicy, new.Spec.IPFamilyPolicy))
+}
+
+// endpointAddress joins host and port, IPv6 addresses of load balancers are bracketed.
+func endpointAddress(host string, port int32) string {
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"regexp"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	SpawnerPrefix = "/spawner/v1/namespaces/"
+	// SpawnerNamePrefix is the prefix of code servers spawned for JupyterHub users
+	SpawnerNamePrefix = "jupyter-"
+	// SpawnerMaxName keeps the instance name short enough for the derived host names
+	SpawnerMaxName = 52
+)
+
+var invalidNameChars = regexp.MustCompile("[^a-z0-9-]+")
+
+// SpawnerStatus is the view of spawned code server returned to JupyterHub spawner
+type SpawnerStatus struct {
+	Name    string `json:"name"`
+	Phase   string `json:"phase"`
+	Running bool   `json:"running"`
+	URL     string `json:"url,omitempty"`
+}
+
+type spawnRequest struct {
+	Template string `json:"template,omitempty"`
+}
+
+// spawnerName returns the code server name of server of JupyterHub user, the default server is named after user.
+// The name is suffixed by the hash of raw user and server, so that users whose names normalize to the same name or
+// share a long prefix get distinct servers.
+func spawnerName(user, server string) string {
+	return identityName(rawSpawnerName(user, server), SpawnerMaxName, fmt.Sprintf("%q/%q", user, server))
+}
+
+func rawSpawnerName(user, server string) string {
+	name := SpawnerNamePrefix + user
+	if len(server) != 0 {
+		name = fmt.Sprintf("%s-%s", name, server)
+	}
+	return normalizeName(name)
+}
+
+// serveSpawner serves the hooks called by JupyterHub spawner:
+//
+//	POST   /spawner/v1/namespaces/{namespace}/users/{user}/servers/{server}  start or wake server
+//	GET    /spawner/v1/namespaces/{namespace}/users/{user}/servers/{server}  poll server
+//	DELETE /spawner/v1/namespaces/{namespace}/users/{user}/servers/{server}  stop server, removed if ?remove=true
+//
+// The server segment is optional for the default server of user. Only tokens with the jupyterhub role may act on
+// behalf of the user in path, and only on the code servers of that user.
+func (s *CodeServerAPIServer) serveSpawner(w http.ResponseWriter, req *http.Request, token *APIToken) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, SpawnerPrefix), "/"), "/")
+	if len(parts) < 3 || parts[1] != "users" || len(parts[2]) == 0 ||
+		(len(parts) > 3 && (len(parts) != 5 || parts[3] != "servers")) {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	namespace, user, server := parts[0], parts[2], ""
+	if len(parts) == 5 {
+		server = parts[4]
+	}
+	if !token.hasRole(JupyterHubRole) {
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("user %s is not allowed to spawn code servers",
+			token.User))
+		return
+	}
+	if !token.allowed(namespace) {
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("user %s is not allowed to access namespace %s",
+			token.User, namespace))
+		return
+	}
+	key := types.NamespacedName{Namespace: namespace, Name: spawnerName(user, server)}
+	// hub acts on behalf of the user in path
+	owner := &APIToken{User: user, Namespaces: token.Namespaces}
+	switch req.Method {
+	case http.MethodPost:
+		s.spawn(w, req, key, user)
+	case http.MethodGet:
+		s.pollSpawned(w, key, owner)
+	case http.MethodDelete:
+		if req.URL.Query().Get("remove") == "true" {
+			s.deleteCodeServer(w, namespace, key.Name, owner)
+		} else {
+			s.stopCodeServer(w, namespace, key.Name, owner)
+		}
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// spawn creates the code server of user from template, or wakes it up if it exists already. Recycled code
+// server is deleted so that it's created again by the next spawn, code server of another user is never touched.
+func (s *CodeServerAPIServer) spawn(w http.ResponseWriter, req *http.Request, key types.NamespacedName, user string) {
+	codeServer := &csv1alpha1.CodeServer{}
+	err := s.Client.Get(context.TODO(), key, codeServer)
+	if err == nil {
+		if codeServer.Annotations[UserAnnotation] != user {
+			writeAPIError(w, http.StatusConflict, fmt.Sprintf("code server %s belongs to another user", key))
+			return
+		}
+		if HasCondition(codeServer.Status, csv1alpha1.ServerRecycled) {
+			if err := s.Client.Delete(context.TODO(), codeServer); err != nil && !errors.IsNotFound(err) {
+				writeKubeError(w, err)
+				return
+			}
+			writeAPIError(w, http.StatusServiceUnavailable, "code server has been recycled and is being removed, retry later")
+			return
+		}
+		if codeServer, _, err = wakeCodeServer(s.Client, key, "code server has been spawned by jupyterhub"); err != nil {
+			writeKubeError(w, err)
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, spawnerStatus(codeServer))
+		return
+	}
+	if !errors.IsNotFound(err) {
+		writeKubeError(w, err)
+		return
+	}
+	request := spawnRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil && err != io.EOF {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if len(request.Template) == 0 {
+		request.Template = s.Options.Load().JupyterHubTemplate
+	}
+	if len(request.Template) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "template is required")
+		return
+	}
+	template := &csv1alpha1.CodeServerTemplate{}
+	if err := s.Client.Get(context.TODO(), types.NamespacedName{Name: request.Template, Namespace: key.Namespace},
+		template); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	codeServer = NewCodeServerFromTemplate(template, key.Name, key.Namespace, user)
+	if err := s.Client.Create(context.TODO(), codeServer); err != nil {
+		writeKubeError(w, err)
+		return
+	}
+	s.Log.Info(fmt.Sprintf("code server %s has been spawned by jupyterhub for %s", key, user))
+	writeAPIResponse(w, http.StatusCreated, spawnerStatus(codeServer))
+}
+
+func (s *CodeServerAPIServer) pollSpawned(w http.ResponseWriter, key types.NamespacedName, owner *APIToken) {
+	codeServer, ok := s.getOwnedCodeServer(w, key.Namespace, key.Name, owner)
+	if !ok {
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, spawnerStatus(codeServer))
+}
+
+// spawnerStatus treats pending code server as running, so that JupyterHub keeps waiting rather than
+// spawning again.
+func spawnerStatus(m *csv1alpha1.CodeServer) SpawnerStatus {
+	summary := summarizeCodeServer(m)
+	return SpawnerStatus{
+		Name:    m.Name,
+		Phase:   summary.Phase,
+		Running: summary.Phase == PhaseReady || summary.Phase == PhasePending || summary.Phase == PhasePendingRecycle,
+		URL:     summary.Endpoint,
+	}
+}
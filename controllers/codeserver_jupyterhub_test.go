@@ -0,0 +1,102 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// spawnerClient serves code servers from memory, every other call panics on the nil embedded client.
+type spawnerClient struct {
+	client.Client
+	codeServers map[types.NamespacedName]*csv1alpha1.CodeServer
+}
+
+func (c *spawnerClient) Get(_ context.Context, key client.ObjectKey, obj client.Object) error {
+	codeServer, found := c.codeServers[key]
+	if !found {
+		return errors.NewNotFound(csv1alpha1.GroupVersion.WithResource("codeservers").GroupResource(), key.Name)
+	}
+	codeServer.DeepCopyInto(obj.(*csv1alpha1.CodeServer))
+	return nil
+}
+
+func TestServeSpawner(t *testing.T) {
+	codeServers := map[types.NamespacedName]*csv1alpha1.CodeServer{}
+	for user, owner := range map[string]string{"alice": "alice", "bob": "mallory"} {
+		key := types.NamespacedName{Namespace: "tenant", Name: spawnerName(user, "")}
+		codeServers[key] = &csv1alpha1.CodeServer{ObjectMeta: metav1.ObjectMeta{Name: key.Name,
+			Namespace: key.Namespace, Annotations: map[string]string{UserAnnotation: owner}}}
+	}
+	server := &CodeServerAPIServer{
+		Client: &spawnerClient{codeServers: codeServers},
+		tokens: map[string]APIToken{
+			"hub":    {User: "hub", Namespaces: []string{"tenant"}, Roles: []string{JupyterHubRole}},
+			"portal": {User: "portal", Namespaces: []string{AllNamespaces}},
+			"admin":  {User: "admin", Namespaces: []string{AllNamespaces}, Roles: []string{AdminRole}},
+		},
+	}
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		want   int
+	}{
+		{name: "portal token spawns", token: "portal", method: http.MethodPost,
+			path: "/spawner/v1/namespaces/tenant/users/alice", want: http.StatusForbidden},
+		{name: "portal token polls", token: "portal", method: http.MethodGet,
+			path: "/spawner/v1/namespaces/tenant/users/alice", want: http.StatusForbidden},
+		{name: "admin token removes", token: "admin", method: http.MethodDelete,
+			path: "/spawner/v1/namespaces/tenant/users/alice?remove=true", want: http.StatusForbidden},
+		{name: "hub token of other namespace", token: "hub", method: http.MethodGet,
+			path: "/spawner/v1/namespaces/other/users/alice", want: http.StatusForbidden},
+		{name: "hub polls server of user", token: "hub", method: http.MethodGet,
+			path: "/spawner/v1/namespaces/tenant/users/alice", want: http.StatusOK},
+		{name: "hub wakes server of user", token: "hub", method: http.MethodPost,
+			path: "/spawner/v1/namespaces/tenant/users/alice", want: http.StatusOK},
+		{name: "hub polls server of another user", token: "hub", method: http.MethodGet,
+			path: "/spawner/v1/namespaces/tenant/users/bob", want: http.StatusNotFound},
+		{name: "hub spawns over server of another user", token: "hub", method: http.MethodPost,
+			path: "/spawner/v1/namespaces/tenant/users/bob", want: http.StatusConflict},
+		{name: "hub removes server of another user", token: "hub", method: http.MethodDelete,
+			path: "/spawner/v1/namespaces/tenant/users/bob?remove=true", want: http.StatusNotFound},
+		{name: "empty user", token: "hub", method: http.MethodGet,
+			path: "/spawner/v1/namespaces/tenant/users//servers/lab", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d: %s", tt.method, tt.path, w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
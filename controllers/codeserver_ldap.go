@@ -0,0 +1,566 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	errrorlib "errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The subset of LDAPv3 (RFC 4511) needed to sync group membership: StartTLS, simple bind and paged subtree search
+// with equality, presence, and, or filters.
+const (
+	ldapTagInteger     = 0x02
+	ldapTagOctetString = 0x04
+	ldapTagBoolean     = 0x01
+	ldapTagEnumerated  = 0x0a
+	ldapTagSequence    = 0x30
+	ldapTagSet         = 0x31
+
+	ldapBindRequest          = 0x60
+	ldapBindResponse         = 0x61
+	ldapUnbindRequest        = 0x42
+	ldapSearchRequest        = 0x63
+	ldapSearchResultEntry    = 0x64
+	ldapSearchResultDone     = 0x65
+	ldapSearchResultRef      = 0x73
+	ldapExtendedRequest      = 0x77
+	ldapExtendedResponse     = 0x78
+	ldapExtendedRequestName  = 0x80
+	ldapControls             = 0xa0
+	ldapSimpleAuthentication = 0x80
+
+	ldapFilterAnd      = 0xa0
+	ldapFilterOr       = 0xa1
+	ldapFilterEquality = 0xa3
+	ldapFilterPresent  = 0x87
+
+	ldapScopeSubtree    = 2
+	ldapPagedResultsOID = "1.2.840.113556.1.4.319"
+	ldapPageSize        = 500
+	ldapStartTLSOID     = "1.3.6.1.4.1.1466.20037"
+	ldapTimeout         = 30 * time.Second
+	// ldapMaxMessageSize caps the length of elements read, so that a broken or hostile server can't exhaust memory.
+	ldapMaxMessageSize = 16 << 20
+)
+
+// berElement is a decoded BER tag-length-value, content of constructed elements is decoded into children on demand.
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var length []byte
+	for ; n > 0; n >>= 8 {
+		length = append([]byte{byte(n)}, length...)
+	}
+	return append([]byte{0x80 | byte(len(length))}, length...)
+}
+
+func berEncode(tag byte, children ...[]byte) []byte {
+	content := bytes.Join(children, nil)
+	return append(append([]byte{tag}, berLength(len(content))...), content...)
+}
+
+func berString(tag byte, value string) []byte {
+	return berEncode(tag, []byte(value))
+}
+
+func berInteger(tag byte, value int64) []byte {
+	content := []byte{byte(value)}
+	for value >>= 8; value != 0 && value != -1; value >>= 8 {
+		content = append([]byte{byte(value)}, content...)
+	}
+	// keep positive values positive
+	if value == 0 && content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	}
+	return berEncode(tag, content)
+}
+
+func berBoolean(value bool) []byte {
+	if value {
+		return berEncode(ldapTagBoolean, []byte{0xff})
+	}
+	return berEncode(ldapTagBoolean, []byte{0})
+}
+
+// readBER reads one element from r.
+func readBER(r io.ByteReader) (*berElement, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		octets := int(first & 0x7f)
+		if octets == 0 || octets > 4 {
+			return nil, fmt.Errorf("unsupported ber length of %d octets", octets)
+		}
+		length = 0
+		for i := 0; i < octets; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > ldapMaxMessageSize {
+		return nil, fmt.Errorf("ber length %d exceeds the limit of %d bytes", length, ldapMaxMessageSize)
+	}
+	if limited, ok := r.(interface{ Len() int }); ok && length > limited.Len() {
+		return nil, fmt.Errorf("ber length %d exceeds the %d bytes remaining", length, limited.Len())
+	}
+	content := make([]byte, length)
+	for i := range content {
+		if content[i], err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+	}
+	return &berElement{tag: tag, content: content}, nil
+}
+
+// children decodes the content of constructed element.
+func (e *berElement) children() ([]*berElement, error) {
+	var children []*berElement
+	reader := bytes.NewReader(e.content)
+	for reader.Len() > 0 {
+		child, err := readBER(reader)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+func (e *berElement) integer() int64 {
+	var value int64
+	for i, b := range e.content {
+		if i == 0 && b&0x80 != 0 {
+			value = -1
+		}
+		value = value<<8 | int64(b)
+	}
+	return value
+}
+
+// encodeLDAPFilter encodes the string representation of filter (RFC 4515), only equality, presence, and, or are
+// supported, which is enough to select users or groups by object class and attributes.
+func encodeLDAPFilter(filter string) ([]byte, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	encoded, rest, err := parseLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("unexpected '%s' in ldap filter", rest)
+	}
+	return encoded, nil
+}
+
+func parseLDAPFilter(filter string) ([]byte, string, error) {
+	if !strings.HasPrefix(filter, "(") {
+		return nil, "", fmt.Errorf("ldap filter must be enclosed in parentheses: %s", filter)
+	}
+	filter = filter[1:]
+	if strings.HasPrefix(filter, "&") || strings.HasPrefix(filter, "|") {
+		tag := byte(ldapFilterAnd)
+		if filter[0] == '|' {
+			tag = ldapFilterOr
+		}
+		rest := filter[1:]
+		var children [][]byte
+		for strings.HasPrefix(rest, "(") {
+			child, remaining, err := parseLDAPFilter(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			children = append(children, child)
+			rest = remaining
+		}
+		if !strings.HasPrefix(rest, ")") || len(children) == 0 {
+			return nil, "", fmt.Errorf("invalid ldap filter: %s", filter)
+		}
+		return berEncode(tag, children...), rest[1:], nil
+	}
+	end := strings.Index(filter, ")")
+	if end < 0 {
+		return nil, "", fmt.Errorf("unterminated ldap filter: %s", filter)
+	}
+	item, rest := filter[:end], filter[end+1:]
+	separator := strings.Index(item, "=")
+	if separator <= 0 || strings.ContainsAny(item[:separator], "~<>:") {
+		return nil, "", fmt.Errorf("only equality and presence ldap filters are supported: %s", item)
+	}
+	attribute, value := item[:separator], item[separator+1:]
+	if value == "*" {
+		return berString(ldapFilterPresent, attribute), rest, nil
+	}
+	if strings.Contains(value, "*") {
+		return nil, "", fmt.Errorf("substring ldap filters are not supported: %s", item)
+	}
+	unescaped, err := unescapeLDAPFilterValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berEncode(ldapFilterEquality, berString(ldapTagOctetString, attribute),
+		berString(ldapTagOctetString, unescaped)), rest, nil
+}
+
+// unescapeLDAPFilterValue decodes the assertion value of filter, where '(', ')', '*', '\' and NUL are escaped as
+// '\' followed by two hex digits (RFC 4515), e.g. 'Sales \28EMEA\29' is 'Sales (EMEA)'.
+func unescapeLDAPFilterValue(value string) (string, error) {
+	var unescaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if i+2 >= len(value) {
+				return "", fmt.Errorf("incomplete escape in ldap filter value: %s", value)
+			}
+			decoded, err := hex.DecodeString(value[i+1 : i+3])
+			if err != nil {
+				return "", fmt.Errorf("invalid escape in ldap filter value: %s", value)
+			}
+			unescaped.Write(decoded)
+			i += 2
+		case '(', ')', 0:
+			return "", fmt.Errorf("unescaped '%c' in ldap filter value: %s", value[i], value)
+		default:
+			unescaped.WriteByte(value[i])
+		}
+	}
+	return unescaped.String(), nil
+}
+
+// LDAPEntry is the distinguished name and the requested attributes of entry found.
+type LDAPEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// ldapConn is a synchronous ldap connection, requests are sent one at a time.
+type ldapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int64
+}
+
+// dialLDAP connects to ldaps:// url, or ldap:// url upgraded by StartTLS (RFC 4511 4.14), so that bind password and
+// directory entries are never sent in plain text. config is cloned with the host of url as server name.
+func dialLDAP(rawURL string, config *tls.Config) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	config = config.Clone()
+	config.ServerName = u.Hostname()
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	switch u.Scheme {
+	case "ldap":
+		host := u.Host
+		if len(u.Port()) == 0 {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err := dialer.Dial("tcp", host)
+		if err != nil {
+			return nil, err
+		}
+		l := &ldapConn{conn: conn, reader: bufio.NewReader(conn)}
+		if err := l.startTLS(config); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return l, nil
+	case "ldaps":
+		host := u.Host
+		if len(u.Port()) == 0 {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		conn, err := tls.DialWithDialer(dialer, "tcp", host, config)
+		if err != nil {
+			return nil, err
+		}
+		return &ldapConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported ldap url scheme '%s'", u.Scheme)
+	}
+}
+
+// startTLS upgrades the plain connection to tls, the connection must not be used if it fails.
+func (l *ldapConn) startTLS(config *tls.Config) error {
+	id, err := l.send(berEncode(ldapExtendedRequest, berString(ldapExtendedRequestName, ldapStartTLSOID)))
+	if err != nil {
+		return err
+	}
+	op, _, err := l.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapExtendedResponse {
+		return fmt.Errorf("unexpected ldap response 0x%x to StartTLS", op.tag)
+	}
+	if err := ldapResult(op); err != nil {
+		return fmt.Errorf("StartTLS refused: %v", err)
+	}
+	if l.reader.Buffered() != 0 {
+		return errrorlib.New("unexpected data before tls handshake")
+	}
+	conn := tls.Client(l.conn, config)
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	l.conn = conn
+	l.reader = bufio.NewReader(conn)
+	return nil
+}
+
+func (l *ldapConn) Close() error {
+	l.send(berEncode(ldapUnbindRequest))
+	return l.conn.Close()
+}
+
+func (l *ldapConn) send(op []byte, controls ...[]byte) (int64, error) {
+	l.messageID++
+	message := [][]byte{berInteger(ldapTagInteger, l.messageID), op}
+	if len(controls) != 0 {
+		message = append(message, berEncode(ldapControls, controls...))
+	}
+	l.conn.SetDeadline(time.Now().Add(ldapTimeout))
+	_, err := l.conn.Write(berEncode(ldapTagSequence, message...))
+	return l.messageID, err
+}
+
+// receive reads the next message of request id, it returns the protocol op and the controls if any.
+func (l *ldapConn) receive(id int64) (*berElement, *berElement, error) {
+	for {
+		message, err := readBER(l.reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		parts, err := message.children()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(parts) < 2 {
+			return nil, nil, errrorlib.New("malformed ldap message")
+		}
+		if parts[0].integer() != id {
+			continue
+		}
+		var controls *berElement
+		if len(parts) > 2 && parts[2].tag == ldapControls {
+			controls = parts[2]
+		}
+		return parts[1], controls, nil
+	}
+}
+
+// ldapResult checks the result code of response.
+func ldapResult(op *berElement) error {
+	fields, err := op.children()
+	if err != nil {
+		return err
+	}
+	if len(fields) < 3 || fields[0].tag != ldapTagEnumerated {
+		return errrorlib.New("malformed ldap result")
+	}
+	if code := fields[0].integer(); code != 0 {
+		return fmt.Errorf("ldap result code %d: %s", code, string(fields[2].content))
+	}
+	return nil
+}
+
+// Bind authenticates with dn and password, anonymous if both empty.
+func (l *ldapConn) Bind(dn, password string) error {
+	id, err := l.send(berEncode(ldapBindRequest, berInteger(ldapTagInteger, 3), berString(ldapTagOctetString, dn),
+		berString(ldapSimpleAuthentication, password)))
+	if err != nil {
+		return err
+	}
+	op, _, err := l.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return fmt.Errorf("unexpected ldap response 0x%x to bind", op.tag)
+	}
+	return ldapResult(op)
+}
+
+// Search returns the entries in the subtree of base matching filter, results are paged so that size limit of
+// servers, e.g. 1000 entries of active directory, doesn't apply.
+func (l *ldapConn) Search(base, filter string, attributes []string) ([]LDAPEntry, error) {
+	encodedFilter, err := encodeLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var requested [][]byte
+	for _, attribute := range attributes {
+		requested = append(requested, berString(ldapTagOctetString, attribute))
+	}
+	request := berEncode(ldapSearchRequest,
+		berString(ldapTagOctetString, base),
+		berInteger(ldapTagEnumerated, ldapScopeSubtree),
+		berInteger(ldapTagEnumerated, 0),
+		berInteger(ldapTagInteger, 0),
+		berInteger(ldapTagInteger, 0),
+		berBoolean(false),
+		encodedFilter,
+		berEncode(ldapTagSequence, requested...))
+	var entries []LDAPEntry
+	var cookie []byte
+	for {
+		paging := berEncode(ldapTagSequence, berString(ldapTagOctetString, ldapPagedResultsOID),
+			berString(ldapTagOctetString, string(berEncode(ldapTagSequence, berInteger(ldapTagInteger, ldapPageSize),
+				berEncode(ldapTagOctetString, cookie)))))
+		id, err := l.send(request, paging)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			op, controls, err := l.receive(id)
+			if err != nil {
+				return nil, err
+			}
+			if op.tag == ldapSearchResultEntry {
+				entry, err := decodeLDAPEntry(op)
+				if err != nil {
+					return nil, err
+				}
+				entries = append(entries, *entry)
+				continue
+			}
+			if op.tag == ldapSearchResultRef {
+				// referrals to other servers are not followed
+				continue
+			}
+			if op.tag != ldapSearchResultDone {
+				return nil, fmt.Errorf("unexpected ldap response 0x%x to search", op.tag)
+			}
+			if err := ldapResult(op); err != nil {
+				return nil, err
+			}
+			cookie = pagingCookie(controls)
+			break
+		}
+		if len(cookie) == 0 {
+			return entries, nil
+		}
+	}
+}
+
+func decodeLDAPEntry(op *berElement) (*LDAPEntry, error) {
+	fields, err := op.children()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != 2 {
+		return nil, errrorlib.New("malformed ldap search entry")
+	}
+	entry := &LDAPEntry{DN: string(fields[0].content), Attributes: map[string][]string{}}
+	attributes, err := fields[1].children()
+	if err != nil {
+		return nil, err
+	}
+	for _, attribute := range attributes {
+		parts, err := attribute.children()
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) != 2 {
+			return nil, errrorlib.New("malformed ldap attribute")
+		}
+		values, err := parts[1].children()
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(string(parts[0].content))
+		for _, value := range values {
+			entry.Attributes[name] = append(entry.Attributes[name], string(value.content))
+		}
+	}
+	return entry, nil
+}
+
+// pagingCookie returns the cookie of paged results control, empty once all pages have been returned.
+func pagingCookie(controls *berElement) []byte {
+	if controls == nil {
+		return nil
+	}
+	list, err := controls.children()
+	if err != nil {
+		return nil
+	}
+	for _, control := range list {
+		fields, err := control.children()
+		if err != nil || len(fields) == 0 || string(fields[0].content) != ldapPagedResultsOID {
+			continue
+		}
+		value := fields[len(fields)-1]
+		paging, err := readBER(bytes.NewReader(value.content))
+		if err != nil {
+			return nil
+		}
+		parts, err := paging.children()
+		if err != nil || len(parts) != 2 {
+			return nil
+		}
+		return parts[1].content
+	}
+	return nil
+}
+
+// rdnValue returns the value of the first relative distinguished name of dn, e.g. 'GPU Users' of
+// 'CN=GPU Users,OU=Groups,DC=example,DC=com'.
+func rdnValue(dn string) string {
+	first := dn
+	for i := 0; i < len(dn); i++ {
+		if dn[i] == '\\' {
+			i++
+			continue
+		}
+		if dn[i] == ',' {
+			first = dn[:i]
+			break
+		}
+	}
+	separator := strings.Index(first, "=")
+	return strings.TrimSpace(strings.ReplaceAll(first[separator+1:], "\\", ""))
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadBER(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		tag     byte
+		content []byte
+		wantErr bool
+	}{
+		{name: "short length", data: []byte{0x04, 0x02, 'h', 'i'}, tag: 0x04, content: []byte("hi")},
+		{name: "long length", data: append([]byte{0x04, 0x81, 0x80}, bytes.Repeat([]byte{'a'}, 0x80)...), tag: 0x04,
+			content: bytes.Repeat([]byte{'a'}, 0x80)},
+		{name: "empty content", data: []byte{0x30, 0x00}, tag: 0x30, content: []byte{}},
+		{name: "truncated content", data: []byte{0x04, 0x03, 'h', 'i'}, wantErr: true},
+		{name: "indefinite length", data: []byte{0x30, 0x80, 0x00, 0x00}, wantErr: true},
+		{name: "too many length octets", data: []byte{0x04, 0x85, 0, 0, 0, 0, 1}, wantErr: true},
+		{name: "length over limit", data: []byte{0x04, 0x84, 0x7f, 0xff, 0xff, 0xff}, wantErr: true},
+		{name: "length over remaining", data: []byte{0x04, 0x83, 0x01, 0x00, 0x00, 'a'}, wantErr: true},
+		{name: "missing length", data: []byte{0x04}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			element, err := readBER(bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readBER() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if element.tag != tt.tag || !bytes.Equal(element.content, tt.content) {
+				t.Errorf("readBER() = 0x%x %q, want 0x%x %q", element.tag, element.content, tt.tag, tt.content)
+			}
+		})
+	}
+}
+
+func TestBERRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value int64
+	}{
+		{name: "zero", value: 0},
+		{name: "small", value: 3},
+		{name: "sign bit of first octet", value: 0x80},
+		{name: "page size", value: ldapPageSize},
+		{name: "multiple octets", value: 0x123456},
+		{name: "negative", value: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			element, err := readBER(bytes.NewReader(berInteger(ldapTagInteger, tt.value)))
+			if err != nil {
+				t.Fatalf("readBER() error = %v", err)
+			}
+			if got := element.integer(); got != tt.value {
+				t.Errorf("integer() = %d, want %d", got, tt.value)
+			}
+		})
+	}
+}
+
+func TestEncodeLDAPFilter(t *testing.T) {
+	equality := func(attribute, value string) []byte {
+		return berEncode(ldapFilterEquality, berString(ldapTagOctetString, attribute),
+			berString(ldapTagOctetString, value))
+	}
+	tests := []struct {
+		name    string
+		filter  string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "equality", filter: "(objectClass=person)", want: equality("objectClass", "person")},
+		{name: "without parentheses", filter: "objectClass=person", want: equality("objectClass", "person")},
+		{name: "presence", filter: "(mail=*)", want: berString(ldapFilterPresent, "mail")},
+		{name: "and", filter: "(&(objectClass=person)(mail=*))", want: berEncode(ldapFilterAnd,
+			equality("objectClass", "person"), berString(ldapFilterPresent, "mail"))},
+		{name: "nested or", filter: "(&(|(ou=a)(ou=b))(mail=*))", want: berEncode(ldapFilterAnd,
+			berEncode(ldapFilterOr, equality("ou", "a"), equality("ou", "b")), berString(ldapFilterPresent, "mail"))},
+		{name: "escaped parentheses", filter: `(ou=Sales \28EMEA\29)`, want: equality("ou", "Sales (EMEA)")},
+		{name: "escaped asterisk and backslash", filter: `(cn=a\2ab\5cc)`, want: equality("cn", `a*b\c`)},
+		{name: "escaped utf-8", filter: `(cn=J\c3\bcrgen)`, want: equality("cn", "Jürgen")},
+		{name: "incomplete escape", filter: `(cn=a\2)`, wantErr: true},
+		{name: "invalid escape", filter: `(cn=a\zz)`, wantErr: true},
+		{name: "unescaped parenthesis", filter: "(cn=a(b)", wantErr: true},
+		{name: "substring", filter: "(cn=a*)", wantErr: true},
+		{name: "approximate", filter: "(cn~=a)", wantErr: true},
+		{name: "empty and", filter: "(&)", wantErr: true},
+		{name: "unterminated", filter: "(cn=a", wantErr: true},
+		{name: "trailing", filter: "(cn=a)(cn=b)", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeLDAPFilter(tt.filter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("encodeLDAPFilter(%q) error = %v, wantErr %v", tt.filter, err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, tt.want) {
+				t.Errorf("encodeLDAPFilter(%q) = %x, want %x", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRDNValue(t *testing.T) {
+	tests := []struct {
+		name string
+		dn   string
+		want string
+	}{
+		{name: "common name", dn: "CN=GPU Users,OU=Groups,DC=example,DC=com", want: "GPU Users"},
+		{name: "escaped comma", dn: `CN=Sales\, EMEA,OU=Groups,DC=example,DC=com`, want: "Sales, EMEA"},
+		{name: "single rdn", dn: "cn=admins", want: "admins"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rdnValue(tt.dn); got != tt.want {
+				t.Errorf("rdnValue(%q) = %q, want %q", tt.dn, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"sort"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// DataLocalityWeight is the weight of preferred data locality, which outweighs the other preferences.
+const DataLocalityWeight = 100
+
+// dataLocalityTerms returns the node selector terms of the nodes holding the dataset of instance, the terms are
+// ORed. Nil is returned if the nodes can't be told, e.g. the volume of dataset isn't bound or isn't pinned to nodes.
+func (r *CodeServerReconciler) dataLocalityTerms(m *csv1alpha1.CodeServer) ([]corev1.NodeSelectorTerm, error) {
+	locality := m.Spec.DataLocality
+	var terms []corev1.NodeSelectorTerm
+	if len(locality.ClaimName) != 0 {
+		pvc := &corev1.PersistentVolumeClaim{}
+		if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: locality.ClaimName, Namespace: m.Namespace},
+			pvc); err != nil {
+			return nil, fmt.Errorf("failed to get volume %s of dataset: %v", locality.ClaimName, err)
+		}
+		if len(pvc.Spec.VolumeName) == 0 {
+			r.instanceLog(m).Info(fmt.Sprintf("volume %s of dataset isn't bound, locality is skipped",
+				locality.ClaimName))
+			return nil, nil
+		}
+		pv := &corev1.PersistentVolume{}
+		if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: pvc.Spec.VolumeName}, pv); err != nil {
+			return nil, fmt.Errorf("failed to get volume %s of dataset: %v", pvc.Spec.VolumeName, err)
+		}
+		if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+			r.instanceLog(m).Info(fmt.Sprintf("volume %s of dataset isn't pinned to nodes, locality is skipped",
+				pv.Name))
+			return nil, nil
+		}
+		terms = pv.Spec.NodeAffinity.Required.DeepCopy().NodeSelectorTerms
+	}
+	if len(locality.NodeLabels) != 0 {
+		terms = andNodeSelectorTerms(terms, []corev1.NodeSelectorTerm{{MatchExpressions: labelRequirements(
+			locality.NodeLabels)}})
+	}
+	if len(terms) == 0 || len(locality.TopologyKey) == 0 {
+		return terms, nil
+	}
+	return r.topologyTerms(terms, locality.TopologyKey)
+}
+
+// topologyTerms returns the term matching the topology domains of the nodes matching terms.
+func (r *CodeServerReconciler) topologyTerms(terms []corev1.NodeSelectorTerm,
+	topologyKey string) ([]corev1.NodeSelectorTerm, error) {
+	nodes := &corev1.NodeList{}
+	if err := r.Client.List(context.TODO(), nodes); err != nil {
+		return nil, err
+	}
+	domains := map[string]bool{}
+	for _, node := range nodes.Items {
+		domain, found := node.Labels[topologyKey]
+		if !found {
+			continue
+		}
+		for _, term := range terms {
+			if matched, err := nodeMatchesTerm(&node, term); err != nil {
+				return nil, err
+			} else if matched {
+				domains[domain] = true
+				break
+			}
+		}
+	}
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("no node holding dataset is labeled with %s", topologyKey)
+	}
+	values := make([]string, 0, len(domains))
+	for domain := range domains {
+		values = append(values, domain)
+	}
+	// keep the order stable so that the deployment isn't updated on every reconcile
+	sort.Strings(values)
+	return []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{{
+		Key:      topologyKey,
+		Operator: corev1.NodeSelectorOpIn,
+		Values:   values,
+	}}}}, nil
+}
+
+// labelRequirements returns the requirements matching labels, sorted by key.
+func labelRequirements(labels map[string]string) []corev1.NodeSelectorRequirement {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	requirements := make([]corev1.NodeSelectorRequirement, 0, len(keys))
+	for _, key := range keys {
+		requirements = append(requirements, corev1.NodeSelectorRequirement{
+			Key:      key,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{labels[key]},
+		})
+	}
+	return requirements
+}
+
+// nodeMatchesTerm returns true if node matches both expressions and fields of term, metadata.name is the only field
+// supported by node selector.
+func nodeMatchesTerm(node *corev1.Node, term corev1.NodeSelectorTerm) (bool, error) {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return false, nil
+	}
+	matches := func(requirements []corev1.NodeSelectorRequirement, set labels.Set) (bool, error) {
+		for _, requirement := range requirements {
+			selected, err := labels.NewRequirement(requirement.Key, nodeSelectorOperators[requirement.Operator],
+				requirement.Values)
+			if err != nil {
+				return false, err
+			}
+			if !selected.Matches(set) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	if matched, err := matches(term.MatchExpressions, node.Labels); err != nil || !matched {
+		return false, err
+	}
+	return matches(term.MatchFields, labels.Set{"metadata.name": node.Name})
+}
+
+// nodeSelectorOperators maps the operators of node selector to the ones of label selector.
+var nodeSelectorOperators = map[corev1.NodeSelectorOperator]selection.Operator{
+	corev1.NodeSelectorOpIn:           selection.In,
+	corev1.NodeSelectorOpNotIn:        selection.NotIn,
+	corev1.NodeSelectorOpExists:       selection.Exists,
+	corev1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+	corev1.NodeSelectorOpGt:           selection.GreaterThan,
+	corev1.NodeSelectorOpLt:           selection.LessThan,
+}
+
+// andNodeSelectorTerms returns the terms matching both terms and others, terms are ORed so every pair of them is
+// combined. Nil or empty terms match every node.
+func andNodeSelectorTerms(terms, others []corev1.NodeSelectorTerm) []corev1.NodeSelectorTerm {
+	if len(terms) == 0 {
+		return others
+	}
+	if len(others) == 0 {
+		return terms
+	}
+	combined := make([]corev1.NodeSelectorTerm, 0, len(terms)*len(others))
+	for _, term := range terms {
+		for _, other := range others {
+			combined = append(combined, corev1.NodeSelectorTerm{
+				MatchExpressions: append(append([]corev1.NodeSelectorRequirement{}, term.MatchExpressions...),
+					other.MatchExpressions...),
+				MatchFields: append(append([]corev1.NodeSelectorRequirement{}, term.MatchFields...),
+					other.MatchFields...),
+			})
+		}
+	}
+	return combined
+}
+
+// addDataLocalityForPod places the instance pod on or near the nodes holding its dataset, required locality is
+// combined with the required node affinity of scheduling profile.
+func (r *CodeServerReconciler) addDataLocalityForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) error {
+	if m.Spec.DataLocality == nil {
+		return nil
+	}
+	terms, err := r.dataLocalityTerms(m)
+	if err != nil || len(terms) == 0 {
+		return err
+	}
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = &corev1.Affinity{}
+	}
+	if podSpec.Affinity.NodeAffinity == nil {
+		podSpec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := podSpec.Affinity.NodeAffinity
+	if m.Spec.DataLocality.Mode == csv1alpha1.DataLocalityPreferred {
+		for _, term := range terms {
+			nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(
+				nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution, corev1.PreferredSchedulingTerm{
+					Weight:     DataLocalityWeight,
+					Preference: term,
+				})
+		}
+		return nil
+	}
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	required := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	required.NodeSelectorTerms = andNodeSelectorTerms(required.NodeSelectorTerms, terms)
+	return nil
+}
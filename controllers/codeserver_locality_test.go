@@ -0,0 +1,69 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+func TestAndNodeSelectorTerms(t *testing.T) {
+	requirement := func(key string) corev1.NodeSelectorRequirement {
+		return corev1.NodeSelectorRequirement{Key: key, Operator: corev1.NodeSelectorOpExists}
+	}
+	term := func(keys ...string) corev1.NodeSelectorTerm {
+		term := corev1.NodeSelectorTerm{}
+		for _, key := range keys {
+			term.MatchExpressions = append(term.MatchExpressions, requirement(key))
+		}
+		return term
+	}
+	tests := []struct {
+		name   string
+		terms  []corev1.NodeSelectorTerm
+		others []corev1.NodeSelectorTerm
+		want   []corev1.NodeSelectorTerm
+	}{
+		{name: "no terms", others: []corev1.NodeSelectorTerm{term("a")}, want: []corev1.NodeSelectorTerm{term("a")}},
+		{name: "no others", terms: []corev1.NodeSelectorTerm{term("a")}, want: []corev1.NodeSelectorTerm{term("a")}},
+		{name: "single terms", terms: []corev1.NodeSelectorTerm{term("a")},
+			others: []corev1.NodeSelectorTerm{term("b")}, want: []corev1.NodeSelectorTerm{term("a", "b")}},
+		{name: "distributed over disjunctions", terms: []corev1.NodeSelectorTerm{term("a"), term("b")},
+			others: []corev1.NodeSelectorTerm{term("c"), term("d")},
+			want:   []corev1.NodeSelectorTerm{term("a", "c"), term("a", "d"), term("b", "c"), term("b", "d")}},
+		{name: "fields combined", terms: []corev1.NodeSelectorTerm{{MatchFields: []corev1.NodeSelectorRequirement{
+			{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node"}}}}},
+			others: []corev1.NodeSelectorTerm{term("a")},
+			want: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{requirement("a")},
+				MatchFields: []corev1.NodeSelectorRequirement{
+					{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node"}}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			terms := append([]corev1.NodeSelectorTerm{}, tt.terms...)
+			got := andNodeSelectorTerms(tt.terms, tt.others)
+			if !equality.Semantic.DeepEqual(got, tt.want) {
+				t.Errorf("andNodeSelectorTerms() = %+v, want %+v", got, tt.want)
+			}
+			if !equality.Semantic.DeepEqual(tt.terms, terms) {
+				t.Errorf("andNodeSelectorTerms() modified terms to %+v", tt.terms)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"net/http"
+	"sync/atomic"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// log levels adjustable at runtime, error only logs errors while debug also logs V(1) lines.
+const (
+	LogLevelError = "error"
+	LogLevelInfo  = "info"
+	LogLevelDebug = "debug"
+)
+
+var logLevels = map[string]int32{
+	LogLevelError: -1,
+	LogLevelInfo:  0,
+	LogLevelDebug: 1,
+}
+
+// instanceLogger returns the logger carrying the structured fields of instance shared by all log lines about it.
+func instanceLogger(log logr.Logger, m *csv1alpha1.CodeServer) logr.Logger {
+	return log.WithValues("instance", m.Name, "namespace", m.Namespace, "phase", CodeServerPhase(m),
+		"generation", m.Generation)
+}
+
+// keyLogger returns the logger of instance which is only known by name.
+func keyLogger(log logr.Logger, key types.NamespacedName) logr.Logger {
+	return log.WithValues("instance", key.Name, "namespace", key.Namespace)
+}
+
+// instanceLog returns the logger of reconciling instance, its lines are also recorded as events of instance if
+// log events is enabled.
+func (r *CodeServerReconciler) instanceLog(m *csv1alpha1.CodeServer) logr.Logger {
+	log := instanceLogger(r.Log, m)
+	if !r.Options.Load().LogEvents || r.Recorder == nil {
+		return log
+	}
+	return logr.New(&eventSink{LogSink: callerSkipped(log.GetSink()), recorder: r.Recorder, object: m})
+}
+
+// callerSkipped skips the frame of wrapping sink when reporting caller of log line.
+func callerSkipped(sink logr.LogSink) logr.LogSink {
+	if withCallDepth, ok := sink.(logr.CallDepthLogSink); ok {
+		return withCallDepth.WithCallDepth(1)
+	}
+	return sink
+}
+
+// eventSink tees log lines into events of the code server.
+type eventSink struct {
+	logr.LogSink
+	recorder record.EventRecorder
+	object   *csv1alpha1.CodeServer
+}
+
+// Init is a no-op, the wrapped sink has been initialized by its own logger.
+func (s *eventSink) Init(logr.RuntimeInfo) {}
+
+func (s *eventSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	s.LogSink.Info(level, msg, keysAndValues...)
+	s.recorder.Event(s.object, corev1.EventTypeNormal, EventReconcileLog, msg)
+}
+
+func (s *eventSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	s.LogSink.Error(err, msg, keysAndValues...)
+	s.recorder.Event(s.object, corev1.EventTypeWarning, EventReconcileLog, fmt.Sprintf("%s: %v", msg, err))
+}
+
+func (s *eventSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return &eventSink{LogSink: s.LogSink.WithValues(keysAndValues...), recorder: s.recorder, object: s.object}
+}
+
+func (s *eventSink) WithName(name string) logr.LogSink {
+	return &eventSink{LogSink: s.LogSink.WithName(name), recorder: s.recorder, object: s.object}
+}
+
+// LogLevel is the log level of operator adjustable at runtime, it's served on the metrics server where GET
+// returns the level and PUT sets it with body {"level": "debug"}.
+type LogLevel struct {
+	level int32
+}
+
+func NewLogLevel(level string) (*LogLevel, error) {
+	value, ok := logLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("unsupported log level %s", level)
+	}
+	return &LogLevel{level: value}, nil
+}
+
+// Wrap returns the logger whose info lines are filtered by the log level.
+func (l *LogLevel) Wrap(log logr.Logger) logr.Logger {
+	return logr.New(&levelSink{LogSink: callerSkipped(log.GetSink()), level: l})
+}
+
+func (l *LogLevel) String() string {
+	value := atomic.LoadInt32(&l.level)
+	for name, level := range logLevels {
+		if level == value {
+			return name
+		}
+	}
+	return LogLevelInfo
+}
+
+func (l *LogLevel) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		// requests reaching the manager directly aren't authenticated, only the metrics server proxies them
+		// after authorizing, so changes are accepted from within the pod only.
+		if !loopbackRequest(req) {
+			http.Error(w, "changing log level requires metrics auth", http.StatusForbidden)
+			return
+		}
+		body := struct {
+			Level string `json:"level"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		value, ok := logLevels[body.Level]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unsupported log level %s", body.Level), http.StatusBadRequest)
+			return
+		}
+		atomic.StoreInt32(&l.level, value)
+	default:
+		http.Error(w, "only GET and PUT are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": l.String()})
+}
+
+// levelSink drops info lines above the log level, errors are always logged.
+type levelSink struct {
+	logr.LogSink
+	level *LogLevel
+}
+
+// Init is a no-op, the wrapped sink has been initialized by its own logger.
+func (s *levelSink) Init(logr.RuntimeInfo) {}
+
+func (s *levelSink) Enabled(level int) bool {
+	return int32(level) <= atomic.LoadInt32(&s.level.level) && s.LogSink.Enabled(level)
+}
+
+func (s *levelSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return &levelSink{LogSink: s.LogSink.WithValues(keysAndValues...), level: s.level}
+}
+
+func (s *levelSink) WithName(name string) logr.LogSink {
+	return &levelSink{LogSink: s.LogSink.WithName(name), level: s.level}
+}
@@ -0,0 +1,382 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	errrorlib "errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// LxdRemoteAnnotation records the lxd remote which the instance is scheduled on.
+	LxdRemoteAnnotation = "codeserver.io/lxd-remote"
+	LxdDefaultPort      = "8443"
+)
+
+// LxdRemote is a lxd server which lxd instances can be launched on.
+type LxdRemote struct {
+	Name       string
+	Endpoint   string
+	SecretName string
+	Capacity   int
+	// Fingerprint is the sha256 fingerprint of the certificate lxd server serves with.
+	Fingerprint []byte
+}
+
+// LoadLxdRemotes reads remotes file in which every line is in the format of
+// 'name,endpoint,secret,capacity,fingerprint', capacity of 0 means unlimited. Fingerprint is the sha256 fingerprint
+// of server certificate, e.g. the one reported by 'lxc info'.
+func LoadLxdRemotes(path string) ([]LxdRemote, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var remotes []LxdRemote
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("invalid remote line, expected 'name,endpoint,secret,capacity,fingerprint': %s",
+				line)
+		}
+		capacity, err := strconv.Atoi(fields[3])
+		if err != nil || capacity < 0 {
+			return nil, fmt.Errorf("invalid capacity of remote %s: %s", fields[0], fields[3])
+		}
+		fingerprint, err := parseLxdFingerprint(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid fingerprint of remote %s: %v", fields[0], err)
+		}
+		if names[fields[0]] {
+			return nil, fmt.Errorf("duplicated remote %s", fields[0])
+		}
+		names[fields[0]] = true
+		remotes = append(remotes, LxdRemote{
+			Name:        fields[0],
+			Endpoint:    fields[1],
+			SecretName:  fields[2],
+			Capacity:    capacity,
+			Fingerprint: fingerprint,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(remotes) == 0 {
+		return nil, errrorlib.New("no lxd remote found in remotes file")
+	}
+	return remotes, nil
+}
+
+// parseLxdFingerprint parses the hex encoded sha256 fingerprint, colons between bytes are allowed.
+func parseLxdFingerprint(value string) ([]byte, error) {
+	fingerprint, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(value), ":", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("expected %d bytes of sha256 fingerprint, found %d", sha256.Size, len(fingerprint))
+	}
+	return fingerprint, nil
+}
+
+// lxdTLSConfig pins the certificate of lxd server to fingerprint, lxd servers usually serve with self signed
+// certificates, so the certificate itself is verified instead of its chain and host name.
+func lxdTLSConfig(fingerprint []byte, certificates ...tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: certificates,
+		// chain verification is replaced by VerifyPeerCertificate below
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errrorlib.New("lxd server presented no certificate")
+			}
+			actual := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(actual[:], fingerprint) != 1 {
+				return fmt.Errorf("certificate of lxd server doesn't match fingerprint %x", fingerprint)
+			}
+			return nil
+		},
+	}
+}
+
+// LxdRemotePool probes lxd remotes periodically and schedules lxd instances across healthy remotes by capacity.
+type LxdRemotePool struct {
+	client.Client
+	Log     logr.Logger
+	Options *CodeServerOption
+	remotes []LxdRemote
+	lock    sync.Mutex
+	status  map[string]csv1alpha1.LxdRemoteStatus
+	clients map[string]*http.Client
+}
+
+func NewLxdRemotePool(client client.Client, log logr.Logger, options *CodeServerOption,
+	remotes []LxdRemote) *LxdRemotePool {
+	status := make(map[string]csv1alpha1.LxdRemoteStatus)
+	clients := make(map[string]*http.Client)
+	for _, remote := range remotes {
+		status[remote.Name] = csv1alpha1.LxdRemoteStatus{
+			Name:     remote.Name,
+			Endpoint: remote.Endpoint,
+			Capacity: int32(remote.Capacity),
+		}
+		clients[remote.Name] = &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: lxdTLSConfig(remote.Fingerprint)},
+		}
+	}
+	return &LxdRemotePool{
+		Client:  client,
+		Log:     log,
+		Options: options,
+		remotes: remotes,
+		status:  status,
+		clients: clients,
+	}
+}
+
+func (p *LxdRemotePool) Run(stopCh <-chan struct{}) {
+	p.ProbeAll()
+	interval := p.Options.Load().ProbeInterval
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.ProbeAll()
+			// probe interval may be changed by operator config at runtime
+			if current := p.Options.Load().ProbeInterval; current > 0 && current != interval {
+				interval = current
+				ticker.Reset(time.Duration(interval) * time.Second)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// ProbeAll probes all remotes and records their health in operator config status.
+func (p *LxdRemotePool) ProbeAll() {
+	counts, err := p.countInstances()
+	if err != nil {
+		p.Log.Error(err, "Failed to count instances on lxd remotes.")
+		return
+	}
+	changed := false
+	for _, remote := range p.remotes {
+		current := csv1alpha1.LxdRemoteStatus{
+			Name:      remote.Name,
+			Endpoint:  remote.Endpoint,
+			Healthy:   true,
+			Instances: int32(counts[remote.Name]),
+			Capacity:  int32(remote.Capacity),
+		}
+		if err := p.probe(remote); err != nil {
+			current.Healthy = false
+			current.Message = err.Error()
+		}
+		p.lock.Lock()
+		last := p.status[remote.Name]
+		current.LastTransitionTime = last.LastTransitionTime
+		if !equality.Semantic.DeepEqual(current, last) {
+			if current.Healthy != last.Healthy {
+				p.Log.Info(fmt.Sprintf("lxd remote %s becomes healthy: %t", remote.Name, current.Healthy))
+			}
+			current.LastTransitionTime = metav1.Now()
+			p.status[remote.Name] = current
+			changed = true
+		}
+		p.lock.Unlock()
+	}
+	if changed {
+		p.updateStatus()
+	}
+}
+
+// lxdAPIEndpoint returns the url of lxd api, https and default port are used if absent.
+func lxdAPIEndpoint(endpoint string) string {
+	if !strings.HasPrefix(endpoint, "http") {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			endpoint = net.JoinHostPort(endpoint, LxdDefaultPort)
+		}
+		endpoint = "https://" + endpoint
+	}
+	return strings.TrimRight(endpoint, "/")
+}
+
+// probe checks the remote via the lxd api which is accessible for untrusted clients.
+func (p *LxdRemotePool) probe(remote LxdRemote) error {
+	resp, err := p.clients[remote.Name].Get(lxdAPIEndpoint(remote.Endpoint) + "/1.0")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// countInstances counts lxd instances which are not recycled per remote.
+func (p *LxdRemotePool) countInstances() (map[string]int, error) {
+	codeServers, err := listCodeServers(p.Client, UnrecycledPhases)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, codeServer := range codeServers {
+		if name, ok := codeServer.Annotations[LxdRemoteAnnotation]; ok {
+			counts[name]++
+		}
+	}
+	return counts, nil
+}
+
+func (p *LxdRemotePool) updateStatus() {
+	// cluster scoped operator config is inaccessible when watching specified namespaces
+	if len(p.Options.Load().WatchNamespaces) != 0 {
+		return
+	}
+	config := &csv1alpha1.CodeServerOperatorConfig{}
+	err := p.Client.Get(context.TODO(), types.NamespacedName{Name: p.Options.Load().OperatorConfigName}, config)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			p.Log.Error(err, "Failed to get operator config for lxd remotes status.")
+		}
+		return
+	}
+	config.Status.LxdRemotes = p.Status()
+	if err := p.Client.Update(context.TODO(), config); err != nil {
+		p.Log.Error(err, "Failed to update lxd remotes status.")
+	}
+}
+
+// Status returns the status of all remotes.
+func (p *LxdRemotePool) Status() []csv1alpha1.LxdRemoteStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var status []csv1alpha1.LxdRemoteStatus
+	for _, remote := range p.remotes {
+		status = append(status, p.status[remote.Name])
+	}
+	return status
+}
+
+// Remote returns the remote with the name, nil if not found.
+func (p *LxdRemotePool) Remote(name string) *LxdRemote {
+	for index := range p.remotes {
+		if p.remotes[index].Name == name {
+			return &p.remotes[index]
+		}
+	}
+	return nil
+}
+
+// Schedule picks the healthy remote with the most free slots and records it in instance annotation unless the
+// instance has been scheduled on an existing remote, it returns true if the annotation is changed. Instance is not
+// updated here.
+func (p *LxdRemotePool) Schedule(m *csv1alpha1.CodeServer) (bool, error) {
+	reqLogger := instanceLogger(p.Log, m)
+	if name, ok := m.Annotations[LxdRemoteAnnotation]; ok {
+		if remote := p.Remote(name); remote != nil {
+			return false, nil
+		}
+		reqLogger.Info(fmt.Sprintf("lxd remote %s no longer exists, instance will be rescheduled", name))
+	}
+	counts, err := p.countInstances()
+	if err != nil {
+		return false, err
+	}
+	var selected *LxdRemote
+	maxFree := 0
+	p.lock.Lock()
+	for index, remote := range p.remotes {
+		if !p.status[remote.Name].Healthy {
+			continue
+		}
+		free := math.MaxInt32
+		if remote.Capacity > 0 {
+			free = remote.Capacity - counts[remote.Name]
+		}
+		if free > maxFree || (free == maxFree && selected != nil && counts[remote.Name] < counts[selected.Name]) {
+			selected = &p.remotes[index]
+			maxFree = free
+		}
+	}
+	p.lock.Unlock()
+	if selected == nil {
+		return false, errrorlib.New("no healthy lxd remote has capacity left")
+	}
+	if m.Annotations == nil {
+		m.Annotations = map[string]string{}
+	}
+	m.Annotations[LxdRemoteAnnotation] = selected.Name
+	reqLogger.Info(fmt.Sprintf("lxd instance has been scheduled on remote %s", selected.Name))
+	return true, nil
+}
+
+// useLxdRemote points the lxc launcher in deployment to the remote.
+func useLxdRemote(dep *appsv1.Deployment, remote *LxdRemote, defaultSecret string) {
+	podSpec := &dep.Spec.Template.Spec
+	for index := range podSpec.Containers {
+		if podSpec.Containers[index].Name != CSNAME {
+			continue
+		}
+		for envIndex, env := range podSpec.Containers[index].Env {
+			if env.Name == "LAUNCHER_LXD_SERVER_ADDRESS" {
+				podSpec.Containers[index].Env[envIndex] = corev1.EnvVar{Name: env.Name, Value: remote.Endpoint}
+			}
+		}
+	}
+	for index := range podSpec.Volumes {
+		if podSpec.Volumes[index].Secret != nil && podSpec.Volumes[index].Secret.SecretName == defaultSecret {
+			podSpec.Volumes[index].Secret.SecretName = remote.SecretName
+		}
+	}
+}
@@ -0,0 +1,337 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	errrorlib "errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"net/url"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// LxdSnapshotAnnotation triggers a snapshot of the lxd instance, the value is the snapshot name and will be
+	// generated if empty.
+	LxdSnapshotAnnotation = "codeserver.io/lxd-snapshot"
+	// LxdRestoreAnnotation triggers restoring the lxd instance from the snapshot specified in value.
+	LxdRestoreAnnotation = "codeserver.io/lxd-restore"
+	// LxdOperationAnnotation records the background operation of snapshot or restore in progress.
+	LxdOperationAnnotation = "codeserver.io/lxd-operation"
+	LxdOperationTimeout    = 120
+	// LxdOperationPollInterval is the interval in seconds background operations are polled.
+	LxdOperationPollInterval = 5
+	// LxdServerCertKey is the key of the lxd server certificate in client secret, which the server is pinned to
+	// when lxd server on node is used.
+	LxdServerCertKey = "server.crt"
+)
+
+// lxdResponse is the standard response of lxd api.
+type lxdResponse struct {
+	Type      string          `json:"type"`
+	Operation string          `json:"operation"`
+	ErrorCode int             `json:"error_code"`
+	Error     string          `json:"error"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+// lxdOperation is the metadata of the lxd background operation.
+type lxdOperation struct {
+	StatusCode int    `json:"status_code"`
+	Err        string `json:"err"`
+}
+
+// lxdError is the error returned by lxd api.
+type lxdError struct {
+	code    int
+	message string
+}
+
+func (e *lxdError) Error() string {
+	return e.message
+}
+
+func lxdNotFound(err error) bool {
+	var lxdErr *lxdError
+	return errrorlib.As(err, &lxdErr) && lxdErr.code == http.StatusNotFound
+}
+
+// lxdClient talks to the lxd api with the client certificate trusted by lxd server.
+type lxdClient struct {
+	endpoint string
+	http     *http.Client
+	tracer   *Tracer
+	// instance is the code server on whose behalf the client calls lxd
+	instance types.NamespacedName
+}
+
+func (c *lxdClient) do(method, path string, body interface{}) (*lxdResponse, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, c.endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result := &lxdResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("failed to decode lxd response with status code %d: %v", resp.StatusCode, err)
+	}
+	if result.Type == "error" {
+		return nil, &lxdError{code: result.ErrorCode, message: fmt.Sprintf("lxd api %s %s failed: %s", method, path,
+			result.Error)}
+	}
+	return result, nil
+}
+
+// start calls the lxd api and returns the background operation if any without waiting for it.
+func (c *lxdClient) start(method, path string, body interface{}) (operation string, err error) {
+	span := c.tracer.startClient(c.tracer.Active(c.instance), fmt.Sprintf("lxd %s", method), "lxd.endpoint",
+		c.endpoint, "lxd.path", path)
+	defer func() {
+		span.End(err)
+	}()
+	result, err := c.do(method, path, body)
+	if err != nil || result.Type != "async" {
+		return "", err
+	}
+	return result.Operation, nil
+}
+
+// done returns whether the background operation is done, error is returned if it failed.
+func (c *lxdClient) done(operation string) (bool, error) {
+	result, err := c.do(http.MethodGet, operation, nil)
+	if err != nil {
+		return false, err
+	}
+	status := &lxdOperation{}
+	if err := json.Unmarshal(result.Metadata, status); err != nil {
+		return false, err
+	}
+	switch {
+	case status.StatusCode == http.StatusOK:
+		return true, nil
+	case status.StatusCode >= http.StatusBadRequest:
+		return true, fmt.Errorf("lxd operation %s failed: %s", operation, status.Err)
+	}
+	return false, nil
+}
+
+// execute calls the lxd api and waits for the background operation if any.
+func (c *lxdClient) execute(method, path string, body interface{}) (err error) {
+	span := c.tracer.startClient(c.tracer.Active(c.instance), fmt.Sprintf("lxd %s", method), "lxd.endpoint",
+		c.endpoint, "lxd.path", path)
+	defer func() {
+		span.End(err)
+	}()
+	result, err := c.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	if result.Type != "async" {
+		return nil
+	}
+	result, err = c.do(http.MethodGet, fmt.Sprintf("%s/wait?timeout=%d", result.Operation, LxdOperationTimeout), nil)
+	if err != nil {
+		return err
+	}
+	operation := &lxdOperation{}
+	if err := json.Unmarshal(result.Metadata, operation); err != nil {
+		return err
+	}
+	if operation.StatusCode != http.StatusOK {
+		return fmt.Errorf("lxd operation %s failed: %s", path, operation.Err)
+	}
+	return nil
+}
+
+// newLxdClient returns the client of lxd server which the instance runs on.
+func (l *LxdRuntime) newLxdClient(m *csv1alpha1.CodeServer) (*lxdClient, error) {
+	secretName := l.r.Options.Load().LxdClientSecretName
+	var endpoint string
+	var fingerprint []byte
+	if l.pool != nil {
+		remote := l.pool.Remote(m.Annotations[LxdRemoteAnnotation])
+		if remote == nil {
+			return nil, fmt.Errorf("lxd remote of instance %s not found", m.Name)
+		}
+		endpoint, secretName, fingerprint = remote.Endpoint, remote.SecretName, remote.Fingerprint
+	} else {
+		pods := &corev1.PodList{}
+		if err := l.r.Client.List(context.TODO(), pods, client.InNamespace(m.Namespace),
+			client.MatchingLabels(appLabel(m.Name))); err != nil {
+			return nil, err
+		}
+		for _, pod := range pods.Items {
+			if len(pod.Status.HostIP) != 0 {
+				endpoint = pod.Status.HostIP
+				break
+			}
+		}
+		if len(endpoint) == 0 {
+			return nil, fmt.Errorf("lxd server of instance %s not found", m.Name)
+		}
+	}
+	secret := &corev1.Secret{}
+	if err := l.r.Client.Get(context.TODO(), types.NamespacedName{Name: secretName, Namespace: m.Namespace},
+		secret); err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid lxd client certificate in secret %s: %v", secretName, err)
+	}
+	if fingerprint == nil {
+		block, _ := pem.Decode(secret.Data[LxdServerCertKey])
+		if block == nil {
+			return nil, fmt.Errorf("lxd server certificate %s is required in secret %s", LxdServerCertKey,
+				secretName)
+		}
+		sum := sha256.Sum256(block.Bytes)
+		fingerprint = sum[:]
+	}
+	return &lxdClient{
+		endpoint: lxdAPIEndpoint(endpoint),
+		tracer:   l.r.Tracer,
+		instance: types.NamespacedName{Name: m.Name, Namespace: m.Namespace},
+		http: &http.Client{
+			Timeout:   (LxdOperationTimeout + 10) * time.Second,
+			Transport: &http.Transport{TLSClientConfig: lxdTLSConfig(fingerprint, cert)},
+		},
+	}, nil
+}
+
+func (l *LxdRuntime) Snapshot(m *csv1alpha1.CodeServer, name string) (string, error) {
+	lxd, err := l.newLxdClient(m)
+	if err != nil {
+		return "", err
+	}
+	return lxd.start(http.MethodPost, fmt.Sprintf("/1.0/instances/%s/snapshots", url.PathEscape(m.Name)),
+		map[string]interface{}{"name": name})
+}
+
+func (l *LxdRuntime) Restore(m *csv1alpha1.CodeServer, name string) (string, error) {
+	lxd, err := l.newLxdClient(m)
+	if err != nil {
+		return "", err
+	}
+	return lxd.start(http.MethodPut, fmt.Sprintf("/1.0/instances/%s", url.PathEscape(m.Name)),
+		map[string]interface{}{"restore": name})
+}
+
+func (l *LxdRuntime) OperationDone(m *csv1alpha1.CodeServer, operation string) (bool, error) {
+	lxd, err := l.newLxdClient(m)
+	if err != nil {
+		return false, err
+	}
+	return lxd.done(operation)
+}
+
+// reconcileForRuntimeSnapshot starts the snapshot or restore requested via annotations, the background operation
+// is recorded on instance and polled on later reconciles rather than blocking the worker. Annotations are removed
+// once the action succeeds, it returns true while the operation is in progress.
+func (r *CodeServerReconciler) reconcileForRuntimeSnapshot(codeServer *csv1alpha1.CodeServer,
+	instanceRuntime Runtime) (bool, error) {
+	snapshotName, snapshot := codeServer.Annotations[LxdSnapshotAnnotation]
+	restoreName, restore := codeServer.Annotations[LxdRestoreAnnotation]
+	if !snapshot && !restore {
+		return false, nil
+	}
+	reqLogger := r.instanceLog(codeServer)
+	snapshotter, ok := instanceRuntime.(SnapshotRuntime)
+	if !ok {
+		reqLogger.Info(fmt.Sprintf("runtime %s doesn't support snapshot, annotations will be ignored",
+			codeServer.Spec.Runtime))
+		return false, nil
+	}
+	if operation, found := codeServer.Annotations[LxdOperationAnnotation]; found {
+		done, err := snapshotter.OperationDone(codeServer, operation)
+		if err == nil && !done {
+			return true, nil
+		}
+		delete(codeServer.Annotations, LxdOperationAnnotation)
+		if err != nil {
+			// operation is started again on next reconcile
+			if updateErr := r.Client.Update(context.TODO(), codeServer); updateErr != nil {
+				return false, updateErr
+			}
+			return false, err
+		}
+		return false, r.completeRuntimeSnapshot(codeServer, restore, snapshotName, restoreName)
+	}
+	var operation string
+	var err error
+	if restore {
+		if len(restoreName) == 0 {
+			return false, errrorlib.New("snapshot name to restore is required")
+		}
+		operation, err = snapshotter.Restore(codeServer, restoreName)
+	} else {
+		if len(snapshotName) == 0 {
+			snapshotName = ChildName(BackupResource, codeServer.Name, time.Now().UTC().Format(BackupTimeLayout))
+			codeServer.Annotations[LxdSnapshotAnnotation] = snapshotName
+		}
+		operation, err = snapshotter.Snapshot(codeServer, snapshotName)
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(operation) == 0 {
+		return false, r.completeRuntimeSnapshot(codeServer, restore, snapshotName, restoreName)
+	}
+	codeServer.Annotations[LxdOperationAnnotation] = operation
+	return true, r.Client.Update(context.TODO(), codeServer)
+}
+
+// completeRuntimeSnapshot removes the annotations of the finished snapshot or restore.
+func (r *CodeServerReconciler) completeRuntimeSnapshot(codeServer *csv1alpha1.CodeServer, restore bool,
+	snapshotName, restoreName string) error {
+	reqLogger := r.instanceLog(codeServer)
+	if restore {
+		reqLogger.Info(fmt.Sprintf("instance has been restored from snapshot %s", restoreName))
+		delete(codeServer.Annotations, LxdRestoreAnnotation)
+	} else {
+		now := metav1.Now()
+		reqLogger.Info(fmt.Sprintf("snapshot %s of instance has been taken", snapshotName))
+		delete(codeServer.Annotations, LxdSnapshotAnnotation)
+		codeServer.Status.LastBackupName = snapshotName
+		codeServer.Status.LastBackupTime = &now
+	}
+	return r.Client.Update(context.TODO(), codeServer)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	IstioAPIGroup       = "networking.istio.io"
+	IstioInjectLabel    = "sidecar.istio.io/inject"
+	IstioMutualTLSMode  = "ISTIO_MUTUAL"
+	MeshRouteTimeout    = "1800s"
+	ServiceHostTemplate = "%s.%s.svc.cluster.local"
+)
+
+var VirtualServiceGVK = schema.GroupVersionKind{
+	Group:   IstioAPIGroup,
+	Version: "v1beta1",
+	Kind:    "VirtualService",
+}
+
+var DestinationRuleGVK = schema.GroupVersionKind{
+	Group:   IstioAPIGroup,
+	Version: "v1beta1",
+	Kind:    "DestinationRule",
+}
+
+// reconcileForMesh routes instance through istio gateway, traffic between gateway and instance pod is encrypted
+// with istio mutual TLS.
+func (r *CodeServerReconciler) reconcileForMesh(codeServer *csv1alpha1.CodeServer) error {
+	if len(r.Options.Load().MeshGateway) == 0 {
+		return fmt.Errorf("mesh gateway is required by %s provider", IngressProviderIstio)
+	}
+	if err := r.reconcileForUnstructured(codeServer, r.newDestinationRule(codeServer)); err != nil {
+		return err
+	}
+	return r.reconcileForUnstructured(codeServer, r.newVirtualService(codeServer))
+}
+
+func (r *CodeServerReconciler) deleteMeshResources(name, namespace string) error {
+	if err := r.deleteUnstructuredIfExists(VirtualServiceGVK, ChildName(TerminalIngress, name), namespace); err != nil {
+		return err
+	}
+	return r.deleteUnstructuredIfExists(DestinationRuleGVK, name, namespace)
+}
+
+// newVirtualService returns the VirtualService bound to mesh gateway, in path prefix mode the prefix is rewritten
+// to root and the prefix without trailing slash is redirected.
+func (r *CodeServerReconciler) newVirtualService(m *csv1alpha1.CodeServer) *unstructured.Unstructured {
+	route := map[string]interface{}{
+		"route": []interface{}{
+			map[string]interface{}{
+				"destination": map[string]interface{}{
+					"host": fmt.Sprintf(ServiceHostTemplate, m.Name, m.Namespace),
+					"port": map[string]interface{}{"number": int64(HttpPort)},
+				},
+			},
+		},
+		"timeout": MeshRouteTimeout,
+	}
+	var routes []interface{}
+	if prefix := instancePathPrefix(m); len(prefix) != 0 {
+		routes = append(routes, map[string]interface{}{
+			"match":    []interface{}{map[string]interface{}{"uri": map[string]interface{}{"exact": prefix}}},
+			"redirect": map[string]interface{}{"uri": prefix + "/"},
+		})
+		route["match"] = []interface{}{map[string]interface{}{"uri": map[string]interface{}{"prefix": prefix + "/"}}}
+		route["rewrite"] = map[string]interface{}{"uri": "/"}
+	}
+	routes = append(routes, route)
+	vs := &unstructured.Unstructured{}
+	vs.SetGroupVersionKind(VirtualServiceGVK)
+	vs.SetName(ChildName(TerminalIngress, m.Name))
+	vs.SetNamespace(m.Namespace)
+	vs.Object["spec"] = map[string]interface{}{
+		"hosts":    []interface{}{r.instanceHost(m)},
+		"gateways": []interface{}{r.Options.Load().MeshGateway},
+		"http":     routes,
+	}
+	return vs
+}
+
+// newDestinationRule returns the DestinationRule which enables istio mutual TLS towards instance service.
+func (r *CodeServerReconciler) newDestinationRule(m *csv1alpha1.CodeServer) *unstructured.Unstructured {
+	dr := &unstructured.Unstructured{}
+	dr.SetGroupVersionKind(DestinationRuleGVK)
+	dr.SetName(m.Name)
+	dr.SetNamespace(m.Namespace)
+	dr.Object["spec"] = map[string]interface{}{
+		"host": fmt.Sprintf(ServiceHostTemplate, m.Name, m.Namespace),
+		"trafficPolicy": map[string]interface{}{
+			"tls": map[string]interface{}{"mode": IstioMutualTLSMode},
+		},
+	}
+	return dr
+}
+
+// addMeshForPod requests sidecar injection for instance pod, labels are copied since they are shared with the
+// selector of deployment.
+func addMeshForPod(template *corev1.PodTemplateSpec) {
+	labels := map[string]string{}
+	for key, value := range template.Labels {
+		labels[key] = value
+	}
+	labels[IstioInjectLabel] = "true"
+	template.Labels = labels
+}
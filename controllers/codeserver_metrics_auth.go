@@ -0,0 +1,236 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MetricsAuthNone serves metrics to everyone who can reach the endpoint.
+	MetricsAuthNone = "none"
+	// MetricsAuthToken requires the bearer token of metrics token file.
+	MetricsAuthToken = "token"
+	// MetricsAuthRBAC authenticates bearer tokens by token reviews and authorizes requests by subject access
+	// reviews of the non resource url, the same as kube-rbac-proxy.
+	MetricsAuthRBAC = "rbac"
+	// MetricsAuthCacheTTL is how long allowed reviews are cached, scrapes don't hit api server every time.
+	MetricsAuthCacheTTL = time.Minute
+	// MetricsCertificateValidity is the validity of self signed certificate metrics are served with if no
+	// certificate is configured.
+	MetricsCertificateValidity = 365 * 24 * time.Hour
+)
+
+// MetricsAuthorizer authenticates and authorizes the requests of metrics server.
+type MetricsAuthorizer struct {
+	mode   string
+	token  string
+	client kubernetes.Interface
+	lock   sync.Mutex
+	// allowed caches the expiry of allowed reviews keyed by token digest, verb and path.
+	allowed map[string]time.Time
+}
+
+// NewMetricsAuthorizer returns the authorizer of mode, token file is required by token mode.
+func NewMetricsAuthorizer(mode, tokenFile string, client kubernetes.Interface) (*MetricsAuthorizer, error) {
+	authorizer := &MetricsAuthorizer{mode: mode, client: client, allowed: map[string]time.Time{}}
+	switch mode {
+	case MetricsAuthNone, MetricsAuthRBAC:
+	case MetricsAuthToken:
+		content, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("metrics token auth requires token file: %v", err)
+		}
+		if authorizer.token = strings.TrimSpace(string(content)); len(authorizer.token) == 0 {
+			return nil, fmt.Errorf("metrics token file %s is empty", tokenFile)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported metrics auth %q, 'none', 'token' and 'rbac' are supported", mode)
+	}
+	return authorizer, nil
+}
+
+// Enabled returns true if requests need authentication.
+func (a *MetricsAuthorizer) Enabled() bool {
+	return a != nil && a.mode != MetricsAuthNone
+}
+
+// Authorize returns the status code request is rejected with, zero if it's allowed. Mutating requests, e.g. PUT on
+// /log-level, are refused without auth.
+func (a *MetricsAuthorizer) Authorize(req *http.Request) (int, error) {
+	if !a.Enabled() {
+		if mutatingRequest(req) {
+			return http.StatusForbidden, fmt.Errorf("%s requires metrics auth", req.Method)
+		}
+		return 0, nil
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return http.StatusUnauthorized, fmt.Errorf("missing bearer token")
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if a.mode == MetricsAuthToken {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			return http.StatusUnauthorized, fmt.Errorf("invalid bearer token")
+		}
+		return 0, nil
+	}
+	verb := metricsVerb(req.Method)
+	digest := sha256.Sum256([]byte(token))
+	key := strings.Join([]string{hex.EncodeToString(digest[:]), verb, req.URL.Path}, " ")
+	if a.cached(key) {
+		return 0, nil
+	}
+	review, err := a.client.AuthenticationV1().TokenReviews().Create(context.TODO(),
+		&authenticationv1.TokenReview{Spec: authenticationv1.TokenReviewSpec{Token: token}}, metav1.CreateOptions{})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !review.Status.Authenticated {
+		return http.StatusUnauthorized, fmt.Errorf("token is not authenticated: %s", review.Status.Error)
+	}
+	user := review.Status.User
+	extra := map[string]authorizationv1.ExtraValue{}
+	for name, values := range user.Extra {
+		extra[name] = authorizationv1.ExtraValue(values)
+	}
+	access, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(context.TODO(),
+		&authorizationv1.SubjectAccessReview{Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			Groups: user.Groups,
+			UID:    user.UID,
+			Extra:  extra,
+			NonResourceAttributes: &authorizationv1.NonResourceAttributes{
+				Path: req.URL.Path,
+				Verb: verb,
+			},
+		}}, metav1.CreateOptions{})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !access.Status.Allowed {
+		return http.StatusForbidden, fmt.Errorf("user %s is not allowed to %s %s", user.Username, verb,
+			req.URL.Path)
+	}
+	a.cache(key)
+	return 0, nil
+}
+
+func (a *MetricsAuthorizer) cached(key string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	expiry, found := a.allowed[key]
+	return found && time.Now().Before(expiry)
+}
+
+func (a *MetricsAuthorizer) cache(key string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	for other, expiry := range a.allowed {
+		if now.After(expiry) {
+			delete(a.allowed, other)
+		}
+	}
+	a.allowed[key] = now.Add(MetricsAuthCacheTTL)
+}
+
+// mutatingRequest returns whether request changes the state of operator.
+func mutatingRequest(req *http.Request) bool {
+	return req.Method != http.MethodGet && req.Method != http.MethodHead && req.Method != http.MethodOptions
+}
+
+// loopbackRequest returns whether request comes from within the operator pod, e.g. through kubectl port-forward or
+// the metrics server proxying authorized requests.
+func loopbackRequest(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// metricsVerb maps http method to the verb of non resource url, the same as kube-rbac-proxy.
+func metricsVerb(method string) string {
+	switch method {
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut:
+		return "update"
+	case http.MethodPatch:
+		return "patch"
+	case http.MethodDelete:
+		return "delete"
+	}
+	return "get"
+}
+
+// selfSignedCertificate returns a certificate for the hostname of operator pod, metrics are served with it if no
+// certificate is configured, scrapers either skip verification or pin it.
+func selfSignedCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	hosts := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[len(hosts)-1]},
+		DNSNames:              hosts,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(MetricsCertificateValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/go-logr/logr"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"time"
+)
+
+// MetricsLoopbackAddr is the address manager serves metrics and the extra handlers on in plain http once metrics
+// server serves them over https, it's only reachable from within the operator pod.
+const MetricsLoopbackAddr = "127.0.0.1:8079"
+
+// MetricsServer serves the metrics endpoint of manager over https, requests are proxied to the loopback listener
+// of manager so that metrics and the extra handlers are served as is. Certificate is reloaded on rotation, a self
+// signed one is used if no certificate is configured. Requests are authorized by authorizer.
+type MetricsServer struct {
+	Log        logr.Logger
+	Options    *CodeServerOption
+	addr       string
+	proxy      http.Handler
+	certs      *certwatcher.CertWatcher
+	selfSigned *tls.Certificate
+	authorizer *MetricsAuthorizer
+}
+
+// NewMetricsServer returns the metrics server listening on addr with tls.crt and tls.key of certDir.
+func NewMetricsServer(log logr.Logger, options *CodeServerOption, addr, certDir string,
+	authorizer *MetricsAuthorizer) (*MetricsServer, error) {
+	server := &MetricsServer{
+		Log:        log,
+		Options:    options,
+		addr:       addr,
+		proxy:      httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: MetricsLoopbackAddr}),
+		authorizer: authorizer,
+	}
+	var err error
+	if len(certDir) != 0 {
+		server.certs, err = certwatcher.New(filepath.Join(certDir, "tls.crt"), filepath.Join(certDir, "tls.key"))
+	} else {
+		server.selfSigned, err = selfSignedCertificate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+func (s *MetricsServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if code, err := s.authorizer.Authorize(req); code != 0 {
+		s.Log.V(1).Info(fmt.Sprintf("rejected metrics request %s %s from %s: %v", req.Method, req.URL.Path,
+			req.RemoteAddr, err))
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	// credentials of scraper are not passed on to manager
+	req.Header.Del("Authorization")
+	s.proxy.ServeHTTP(w, req)
+}
+
+func (s *MetricsServer) Run(stopCh <-chan struct{}) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.certs != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			if err := s.certs.Start(ctx); err != nil {
+				s.Log.Error(err, "metrics certificate watcher stopped unexpectedly")
+			}
+		}()
+		config.GetCertificate = s.certs.GetCertificate
+	} else {
+		config.Certificates = []tls.Certificate{*s.selfSigned}
+	}
+	ServerTLSOptions(s.Options)(config)
+	server := &http.Server{Addr: s.addr, Handler: s, TLSConfig: config}
+	go func() {
+		s.Log.Info(fmt.Sprintf("metrics server listening on %s", s.addr))
+		if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			s.Log.Error(err, "metrics server stopped unexpectedly")
+		}
+	}()
+	<-stopCh
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	server.Shutdown(shutdownCtx)
+}
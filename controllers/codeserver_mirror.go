@@ -0,0 +1,86 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+// DockerHubMirrorSource is how images of docker hub are referred in mirror mapping, whether or not their
+// references name the registry.
+const DockerHubMirrorSource = "docker.io"
+
+// ParseRegistryMirrors parses the mapping of registries to their mirrors, e.g. 'ghcr.io=internal.registry/ghcr'
+// and 'docker.io=internal.registry/hub'. Sources may contain repository path, e.g. 'ghcr.io/coder=internal.registry'.
+func ParseRegistryMirrors(pairs []string) (map[string]string, error) {
+	mirrors := map[string]string{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(strings.Trim(parts[0], "/ ")) == 0 || len(strings.Trim(parts[1], "/ ")) == 0 {
+			return nil, fmt.Errorf("invalid registry mirror, expected 'source=mirror': %s", pair)
+		}
+		mirrors[strings.Trim(parts[0], "/ ")] = strings.Trim(parts[1], "/ ")
+	}
+	return mirrors, nil
+}
+
+// canonicalMirrorSource names docker hub uniformly, so that 'index.docker.io' and 'docker.io' sources both match.
+func canonicalMirrorSource(source string) string {
+	parts := strings.SplitN(source, "/", 2)
+	if parts[0] == "index.docker.io" || parts[0] == DockerHubRegistry {
+		parts[0] = DockerHubMirrorSource
+	}
+	return strings.Join(parts, "/")
+}
+
+// mirrorImage rewrites image onto the mirror of its registry, the longest matching source wins and tag or digest
+// is kept, e.g. ghcr.io/coder/code-server:4.9 becomes internal.registry/ghcr/coder/code-server:4.9. Images of
+// docker hub are matched by docker.io with the implicit library namespace.
+func mirrorImage(image string, mirrors map[string]string) string {
+	if len(mirrors) == 0 || len(image) == 0 {
+		return image
+	}
+	name, suffix := image, ""
+	if index := strings.Index(image, "@"); index >= 0 {
+		name, suffix = image[:index], image[index:]
+	} else if index := strings.LastIndex(image, ":"); index > strings.LastIndex(image, "/") {
+		name, suffix = image[:index], image[index:]
+	}
+	registry, repository, _ := parseImageReference(name)
+	canonical := canonicalMirrorSource(registry) + "/" + repository
+	matched := ""
+	for source := range mirrors {
+		prefix := canonicalMirrorSource(source)
+		if (canonical == prefix || strings.HasPrefix(canonical, prefix+"/")) && len(prefix) > len(matched) {
+			matched = prefix
+			image = mirrors[source] + strings.TrimPrefix(canonical, prefix) + suffix
+		}
+	}
+	return image
+}
+
+// addRegistryMirrorsForPod rewrites the images of all containers in pod onto their mirrors.
+func addRegistryMirrorsForPod(podSpec *corev1.PodSpec, mirrors map[string]string) {
+	for i := range podSpec.InitContainers {
+		podSpec.InitContainers[i].Image = mirrorImage(podSpec.InitContainers[i].Image, mirrors)
+	}
+	for i := range podSpec.Containers {
+		podSpec.Containers[i].Image = mirrorImage(podSpec.Containers[i].Image, mirrors)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+)
+
+func TestMirrorImage(t *testing.T) {
+	mirrors := map[string]string{
+		"ghcr.io":          "internal.registry/ghcr",
+		"ghcr.io/coder":    "internal.registry/coder",
+		"docker.io":        "internal.registry/hub",
+		"quay.io/jetstack": "internal.registry/jetstack",
+		"localhost:5000":   "internal.registry/local",
+	}
+	tests := []struct {
+		name    string
+		image   string
+		mirrors map[string]string
+		want    string
+	}{
+		{name: "no mirrors", image: "ghcr.io/org/app:1", want: "ghcr.io/org/app:1"},
+		{name: "empty image", image: "", mirrors: mirrors, want: ""},
+		{name: "registry mirrored", image: "ghcr.io/org/app:1", mirrors: mirrors,
+			want: "internal.registry/ghcr/org/app:1"},
+		{name: "longest source wins", image: "ghcr.io/coder/code-server:4.9", mirrors: mirrors,
+			want: "internal.registry/coder/code-server:4.9"},
+		{name: "digest kept", image: "ghcr.io/org/app@sha256:abc", mirrors: mirrors,
+			want: "internal.registry/ghcr/org/app@sha256:abc"},
+		{name: "docker hub official image", image: "busybox", mirrors: mirrors,
+			want: "internal.registry/hub/library/busybox"},
+		{name: "docker hub tagged", image: "rclone/rclone:1.59", mirrors: mirrors,
+			want: "internal.registry/hub/rclone/rclone:1.59"},
+		{name: "docker hub by registry name", image: "index.docker.io/library/alpine:3", mirrors: mirrors,
+			want: "internal.registry/hub/library/alpine:3"},
+		{name: "registry with port", image: "localhost:5000/app:dev", mirrors: mirrors,
+			want: "internal.registry/local/app:dev"},
+		{name: "repository source not matching sibling", image: "quay.io/jetstack-io/app", mirrors: mirrors,
+			want: "quay.io/jetstack-io/app"},
+		{name: "unmapped registry", image: "gcr.io/project/app:1", mirrors: mirrors, want: "gcr.io/project/app:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mirrorImage(tt.image, tt.mirrors); got != tt.want {
+				t.Errorf("mirrorImage(%q) = %q, want %q", tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRegistryMirrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		pairs   []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", want: map[string]string{}},
+		{name: "slashes trimmed", pairs: []string{"ghcr.io/=internal.registry/ghcr/"},
+			want: map[string]string{"ghcr.io": "internal.registry/ghcr"}},
+		{name: "missing mirror", pairs: []string{"ghcr.io="}, wantErr: true},
+		{name: "missing separator", pairs: []string{"ghcr.io"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRegistryMirrors(tt.pairs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRegistryMirrors(%v) error = %v, wantErr %v", tt.pairs, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseRegistryMirrors(%v) = %v, want %v", tt.pairs, got, tt.want)
+			}
+			for source, mirror := range tt.want {
+				if got[source] != mirror {
+					t.Errorf("ParseRegistryMirrors(%v) = %v, want %v", tt.pairs, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	extv1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// MaxChildNameLength is the longest name of generated resources, names of services and jobs end up in labels
+	// and dns labels which are limited to 63 characters.
+	MaxChildNameLength = 63
+	// NamingAnnotation records the naming scheme the generated resources of instance have been migrated to.
+	NamingAnnotation = "codeserver.io/naming"
+	// NamingVersion is the current naming scheme, i.e. names hash-suffixed by ChildName.
+	NamingVersion = "v2"
+	// nameHashLength is the length of "-" and the hex encoded fnv32a hash.
+	nameHashLength = 9
+)
+
+// nameHash returns the hex encoded fnv32a hash of name.
+func nameHash(name string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return fmt.Sprintf("%08x", hash.Sum32())
+}
+
+// shortenName returns name if it fits in max characters, otherwise name is truncated and suffixed by the hash of
+// the full name, so that long names sharing the same prefix stay distinct.
+func shortenName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	return strings.TrimRight(name[:max-nameHashLength], "-.") + "-" + nameHash(name)
+}
+
+// identityName returns the name derived from name normalized from identity, e.g. user names, suffixed by the hash of
+// the raw identity. Normalizing is lossy ("a.b" and "a-b" are both "a-b"), so the hash keeps distinct identities
+// apart, the normalized part is truncated to fit in max characters.
+func identityName(name string, max int, identity string) string {
+	if keep := max - nameHashLength; len(name) > keep {
+		name = strings.TrimRight(name[:keep], "-.")
+	}
+	return name + "-" + nameHash(identity)
+}
+
+// normalizeName lowercases name and replaces characters invalid in names of resources with "-".
+func normalizeName(name string) string {
+	return strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// LegacyChildName returns the name generated resources had before ChildName, i.e. format applied as is.
+func LegacyChildName(format string, args ...interface{}) string {
+	return fmt.Sprintf(format, args...)
+}
+
+// ChildName returns the name of resource generated from format, whose first argument is the name of owner, e.g.
+// ChildName(SSHResource, "foo") is "foo-ssh". The name is kept as is if it fits in MaxChildNameLength, otherwise the
+// owner part is truncated and followed by the hash of the full name, e.g. "<truncated owner>-1a2b3c4d-ssh", so that
+// the kind of resource remains recognizable and different owners never collide after truncation.
+func ChildName(format string, args ...interface{}) string {
+	name := LegacyChildName(format, args...)
+	if len(name) <= MaxChildNameLength || len(args) == 0 || !strings.HasPrefix(format, "%s") {
+		return shortenName(name, MaxChildNameLength)
+	}
+	suffix := fmt.Sprintf(format, append([]interface{}{""}, args[1:]...)...)
+	keep := MaxChildNameLength - nameHashLength - len(suffix)
+	if keep < 1 {
+		return shortenName(name, MaxChildNameLength)
+	}
+	owner := strings.TrimRight(fmt.Sprint(args[0])[:keep], "-.")
+	return owner + "-" + nameHash(name) + suffix
+}
+
+// legacyChild is a resource generated for instance which may exist under its legacy name, it's recreated under the
+// new name by reconcile.
+type legacyChild struct {
+	newObject func() client.Object
+	format    string
+}
+
+// legacyChildren returns the generated resources of older releases whose legacy names are allowed to exceed
+// MaxChildNameLength, i.e. the terminal ingress. Services and jobs with such names could never be created.
+func legacyChildren() []legacyChild {
+	return []legacyChild{
+		{newObject: func() client.Object { return &extv1.Ingress{} }, format: TerminalIngress},
+	}
+}
+
+// reconcileForNaming migrates the generated resources of instance whose legacy names differ from the names of
+// ChildName, which only happens for long instance names. The legacy ones are deleted, it returns true if instance has
+// been updated.
+func (r *CodeServerReconciler) reconcileForNaming(codeServer *csv1alpha1.CodeServer) (bool, error) {
+	if codeServer.Annotations[NamingAnnotation] == NamingVersion {
+		return false, nil
+	}
+	migrated := false
+	for _, child := range legacyChildren() {
+		legacy, name := LegacyChildName(child.format, codeServer.Name), ChildName(child.format, codeServer.Name)
+		if legacy == name {
+			continue
+		}
+		if err := r.migrateChild(codeServer, child, legacy, name); err != nil {
+			return false, err
+		}
+		migrated = true
+	}
+	if !migrated {
+		return false, nil
+	}
+	r.instanceLog(codeServer).Info("generated resources have been migrated to hash-suffixed names")
+	if codeServer.Annotations == nil {
+		codeServer.Annotations = map[string]string{}
+	}
+	codeServer.Annotations[NamingAnnotation] = NamingVersion
+	return true, r.Client.Update(context.TODO(), codeServer)
+}
+
+// migrateChild deletes the resource named legacy, it's created under name by reconcile.
+func (r *CodeServerReconciler) migrateChild(codeServer *csv1alpha1.CodeServer, child legacyChild, legacy,
+	name string) error {
+	obj := child.newObject()
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: legacy, Namespace: codeServer.Namespace}, obj)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.instanceLog(codeServer).Info(fmt.Sprintf("migrating %T %s to %s", obj, legacy, name))
+	if err := r.Client.Delete(context.TODO(), obj); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+func TestChildName(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	tests := []struct {
+		name       string
+		format     string
+		args       []interface{}
+		want       string
+		wantSuffix string
+	}{
+		{name: "short kept", format: SSHResource, args: []interface{}{"foo"}, want: "foo-ssh"},
+		{name: "exactly max kept", format: SSHResource, args: []interface{}{strings.Repeat("a", 59)},
+			want: strings.Repeat("a", 59) + "-ssh"},
+		{name: "long owner hashed before suffix", format: SSHResource, args: []interface{}{long},
+			wantSuffix: "-" + nameHash(long+"-ssh") + "-ssh"},
+		{name: "extra args kept in suffix", format: ShareAuthResource, args: []interface{}{long, "view"},
+			wantSuffix: "-" + nameHash(LegacyChildName(ShareAuthResource, long, "view")) +
+				LegacyChildName(ShareAuthResource, "", "view")},
+		{name: "format without owner prefix shortened", format: "x-%s", args: []interface{}{long},
+			wantSuffix: "-" + nameHash("x-"+long)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ChildName(tt.format, tt.args...)
+			if len(got) > MaxChildNameLength {
+				t.Errorf("ChildName(%q) = %q, longer than %d", tt.format, got, MaxChildNameLength)
+			}
+			if len(tt.want) != 0 && got != tt.want {
+				t.Errorf("ChildName(%q) = %q, want %q", tt.format, got, tt.want)
+			}
+			if len(tt.wantSuffix) != 0 && !strings.HasSuffix(got, tt.wantSuffix) {
+				t.Errorf("ChildName(%q) = %q, want suffix %q", tt.format, got, tt.wantSuffix)
+			}
+		})
+	}
+	if a, b := ChildName(SSHResource, long+"b"), ChildName(SSHResource, long+"c"); a == b {
+		t.Errorf("ChildName() of distinct long owners = %q", a)
+	}
+}
+
+func TestHomeClaimName(t *testing.T) {
+	instance := func(user, claim string) *csv1alpha1.CodeServer {
+		m := &csv1alpha1.CodeServer{ObjectMeta: metav1.ObjectMeta{Name: "ws", Annotations: map[string]string{}},
+			Spec: csv1alpha1.CodeServerSpec{Home: &csv1alpha1.HomeSpec{ClaimName: claim}}}
+		if len(user) != 0 {
+			m.Annotations[UserAnnotation] = user
+		}
+		return m
+	}
+	tests := []struct {
+		name string
+		m    *csv1alpha1.CodeServer
+		want string
+	}{
+		{name: "user hash suffixed", m: instance("alice", ""), want: "home-alice-" + nameHash("user/alice")},
+		{name: "lossy user names kept apart", m: instance("a.b", ""), want: "home-a-b-" + nameHash("user/a.b")},
+		{name: "instance without user", m: instance("", ""), want: "ws-home-" + nameHash("instance/ws")},
+		{name: "claim name specified", m: instance("alice", "data"), want: "data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := homeClaimName(tt.m); got != tt.want {
+				t.Errorf("homeClaimName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
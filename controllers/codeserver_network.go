@@ -0,0 +1,159 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	EgressResource = "%s-egress"
+	DNSPort        = 53
+)
+
+// proxyEnvs returns the proxy environments of instance, both upper and lower cased names are used since tools
+// honor different ones.
+func proxyEnvs(m *csv1alpha1.CodeServer) []corev1.EnvVar {
+	var envs []corev1.EnvVar
+	if m.Spec.Network == nil {
+		return envs
+	}
+	for _, proxy := range []struct{ name, value string }{
+		{"HTTP_PROXY", m.Spec.Network.HTTPProxy},
+		{"http_proxy", m.Spec.Network.HTTPProxy},
+		{"HTTPS_PROXY", m.Spec.Network.HTTPSProxy},
+		{"https_proxy", m.Spec.Network.HTTPSProxy},
+		{"NO_PROXY", m.Spec.Network.NoProxy},
+		{"no_proxy", m.Spec.Network.NoProxy},
+	} {
+		if len(proxy.value) != 0 {
+			envs = append(envs, corev1.EnvVar{Name: proxy.name, Value: proxy.value})
+		}
+	}
+	return envs
+}
+
+// addProxyForPod injects proxy environments into all containers including init containers, environments
+// specified by user explicitly are kept.
+func addProxyForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	envs := proxyEnvs(m)
+	if len(envs) == 0 {
+		return
+	}
+	inject := func(container *corev1.Container) {
+		existing := map[string]bool{}
+		for _, env := range container.Env {
+			existing[env.Name] = true
+		}
+		for _, env := range envs {
+			if !existing[env.Name] {
+				container.Env = append(container.Env, env)
+			}
+		}
+	}
+	for index := range podSpec.InitContainers {
+		inject(&podSpec.InitContainers[index])
+	}
+	for index := range podSpec.Containers {
+		inject(&podSpec.Containers[index])
+	}
+}
+
+// reconcileForEgress blocks direct egress of instance with NetworkPolicy if required.
+func (r *CodeServerReconciler) reconcileForEgress(codeServer *csv1alpha1.CodeServer) error {
+	reqLogger := r.instanceLog(codeServer)
+	name := ChildName(EgressResource, codeServer.Name)
+	if codeServer.Spec.Network == nil || !codeServer.Spec.Network.BlockDirectEgress {
+		return r.deleteResourceIfExists(&networkingv1.NetworkPolicy{}, name, codeServer.Namespace)
+	}
+	reqLogger.Info("Reconciling egress network policy.")
+	newPolicy := r.newEgressPolicy(codeServer)
+	oldPolicy := &networkingv1.NetworkPolicy{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, oldPolicy)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating egress network policy.")
+		r.addCostLabels(codeServer, newPolicy)
+		if err = r.Client.Create(context.TODO(), newPolicy); err != nil {
+			reqLogger.Error(err, "Failed to create egress network policy.")
+			return err
+		}
+		r.recordCreated(codeServer, newPolicy)
+		return nil
+	}
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to get egress network policy for %s.", codeServer.Name))
+		return err
+	}
+	if !equality.Semantic.DeepEqual(oldPolicy.Spec, newPolicy.Spec) {
+		oldPolicy.Spec = newPolicy.Spec
+		reqLogger.Info("Updating egress network policy.")
+		if err = r.Client.Update(context.TODO(), oldPolicy); err != nil {
+			reqLogger.Error(err, "Failed to update egress network policy.")
+			return err
+		}
+		r.recordUpdated(codeServer, oldPolicy)
+	}
+	return nil
+}
+
+// newEgressPolicy returns the NetworkPolicy which only allows DNS and proxy CIDRs as egress destinations.
+func (r *CodeServerReconciler) newEgressPolicy(m *csv1alpha1.CodeServer) *networkingv1.NetworkPolicy {
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	dnsPort := intstr.FromInt(DNSPort)
+	egress := []networkingv1.NetworkPolicyEgressRule{
+		{
+			Ports: []networkingv1.NetworkPolicyPort{
+				{Protocol: &udp, Port: &dnsPort},
+				{Protocol: &tcp, Port: &dnsPort},
+			},
+		},
+	}
+	if len(m.Spec.Network.ProxyCIDRs) != 0 {
+		var peers []networkingv1.NetworkPolicyPeer
+		for _, cidr := range m.Spec.Network.ProxyCIDRs {
+			peers = append(peers, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidr}})
+		}
+		egress = append(egress, networkingv1.NetworkPolicyEgressRule{To: peers})
+	}
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ChildName(EgressResource, m.Name),
+			Namespace: m.Namespace,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: appLabel(m.Name),
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress:      egress,
+		},
+	}
+	// Set CodeServer instance as the owner of the NetworkPolicy.
+	controllerutil.SetControllerReference(m, policy, r.Scheme)
+	return policy
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"github.com/go-logr/logr"
+	"net/http"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const NotificationBufferSize = 100
+
+type notification struct {
+	target    csv1alpha1.NotificationSpec
+	Event     csv1alpha1.NotificationEvent `json:"event"`
+	Namespace string                       `json:"namespace"`
+	Name      string                       `json:"name"`
+	User      string                       `json:"user,omitempty"`
+	Message   string                       `json:"message,omitempty"`
+	Timestamp time.Time                    `json:"timestamp"`
+}
+
+// Notifier fires webhooks configured in operator and instance when code server state transits
+type Notifier struct {
+	Log     logr.Logger
+	Options *CodeServerOption
+	client  *http.Client
+	notifCh chan notification
+}
+
+func NewNotifier(log logr.Logger, options *CodeServerOption) *Notifier {
+	return &Notifier{
+		Log:     log,
+		Options: options,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		notifCh: make(chan notification, NotificationBufferSize),
+	}
+}
+
+// targets collects operator level and instance level webhooks which subscribe the event
+func (n *Notifier) targets(m *csv1alpha1.CodeServer, event csv1alpha1.NotificationEvent) []csv1alpha1.NotificationSpec {
+	var targets []csv1alpha1.NotificationSpec
+	all := m.Spec.Notifications
+	if len(n.Options.Load().NotificationURL) != 0 {
+		all = append([]csv1alpha1.NotificationSpec{{
+			URL:    n.Options.Load().NotificationURL,
+			Format: csv1alpha1.NotificationFormat(n.Options.Load().NotificationFormat),
+		}}, all...)
+	}
+	for _, target := range all {
+		if len(target.URL) == 0 {
+			continue
+		}
+		if len(target.Events) == 0 {
+			targets = append(targets, target)
+			continue
+		}
+		for _, e := range target.Events {
+			if e == event {
+				targets = append(targets, target)
+				break
+			}
+		}
+	}
+	return targets
+}
+
+// Notify enqueues notification for all subscribed webhooks, it's safe to call on nil notifier.
+func (n *Notifier) Notify(m *csv1alpha1.CodeServer, event csv1alpha1.NotificationEvent, message string) {
+	if n == nil {
+		return
+	}
+	for _, target := range n.targets(m, event) {
+		notif := notification{
+			target:    target,
+			Event:     event,
+			Namespace: m.Namespace,
+			Name:      m.Name,
+			User:      m.Annotations[UserAnnotation],
+			Message:   message,
+			Timestamp: time.Now().UTC(),
+		}
+		select {
+		case n.notifCh <- notif:
+		default:
+			n.Log.Info(fmt.Sprintf("notification buffer is full, %s notification for %s/%s dropped", event,
+				m.Namespace, m.Name))
+		}
+	}
+}
+
+// Run sends notifications until stop channel closed, notifications queued by then are still sent.
+func (n *Notifier) Run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case notif := <-n.notifCh:
+			n.send(notif)
+		case <-stopCh:
+			for {
+				select {
+				case notif := <-n.notifCh:
+					n.send(notif)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (n *Notifier) send(notif notification) {
+	var err error
+	if notif.target.Format == csv1alpha1.NotificationSlack {
+		err = postJSON(n.client, notif.target.URL, "application/json", map[string]string{
+			"text": fmt.Sprintf("[%s] code server %s/%s: %s", notif.Event, notif.Namespace, notif.Name,
+				notif.Message),
+		})
+	} else {
+		err = postJSON(n.client, notif.target.URL, "application/json", notif)
+	}
+	if err != nil {
+		n.Log.Error(err, fmt.Sprintf("failed to send %s notification for %s/%s", notif.Event,
+			notif.Namespace, notif.Name))
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// OptionStore merges command line flags, config file and operator config (in ascending priority) into the
+// options shared by all components, listeners are notified once options changed. Merged options are published as
+// an immutable snapshot which readers get with CodeServerOption.Load.
+type OptionStore struct {
+	sync.Mutex
+	Log        logr.Logger
+	options    *CodeServerOption
+	defaults   CodeServerOption
+	fileSpec   *csv1alpha1.CodeServerOperatorConfigSpec
+	configSpec *csv1alpha1.CodeServerOperatorConfigSpec
+	listeners  []func(CodeServerOption)
+}
+
+func NewOptionStore(log logr.Logger, options *CodeServerOption) *OptionStore {
+	options.active = &atomic.Value{}
+	snapshot := *options
+	options.active.Store(&snapshot)
+	return &OptionStore{
+		Log:      log,
+		options:  options,
+		defaults: *options,
+	}
+}
+
+// UpdateDefaults changes options which are decided after the store is created, e.g. by the components enabled.
+func (s *OptionStore) UpdateDefaults(update func(*CodeServerOption)) {
+	s.Lock()
+	defer s.Unlock()
+	update(&s.defaults)
+	s.apply()
+}
+
+// OnChange registers listener invoked with the new options.
+func (s *OptionStore) OnChange(listener func(CodeServerOption)) {
+	s.Lock()
+	defer s.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+// SetOperatorConfig applies the operator config, nil means config has been deleted.
+func (s *OptionStore) SetOperatorConfig(spec *csv1alpha1.CodeServerOperatorConfigSpec) {
+	s.Lock()
+	defer s.Unlock()
+	s.configSpec = spec
+	s.apply()
+}
+
+// SetFileConfig applies the config loaded from file, nil means file has been removed.
+func (s *OptionStore) SetFileConfig(spec *csv1alpha1.CodeServerOperatorConfigSpec) {
+	s.Lock()
+	defer s.Unlock()
+	s.fileSpec = spec
+	s.apply()
+}
+
+func (s *OptionStore) apply() {
+	merged := s.defaults
+	if s.fileSpec != nil {
+		merged = MergeOperatorConfig(merged, s.fileSpec)
+	}
+	if s.configSpec != nil {
+		merged = MergeOperatorConfig(merged, s.configSpec)
+	}
+	if reflect.DeepEqual(merged, *s.options.Load()) {
+		return
+	}
+	s.options.active.Store(&merged)
+	s.Log.Info("operator options have been reloaded")
+	for _, listener := range s.listeners {
+		listener(merged)
+	}
+}
+
+// ConfigFileCheckInterval is the interval to check whether config file has been changed.
+const ConfigFileCheckInterval = 10 * time.Second
+
+// LoadFile loads the config file which has the same schema as the spec of CodeServerOperatorConfig.
+func (s *OptionStore) LoadFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return s.loadContent(path, content)
+}
+
+func (s *OptionStore) loadContent(path string, content []byte) error {
+	spec := &csv1alpha1.CodeServerOperatorConfigSpec{}
+	if err := yaml.UnmarshalStrict(content, spec); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	s.SetFileConfig(spec)
+	return nil
+}
+
+// WatchFile reloads config file once the content changed, content is compared rather than modification time
+// since ConfigMap volume is updated by swapping symlinks.
+func (s *OptionStore) WatchFile(path string, stopCh <-chan struct{}) {
+	last, _ := ioutil.ReadFile(path)
+	ticker := time.NewTicker(ConfigFileCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				s.Log.Error(err, fmt.Sprintf("Failed to read config file %s, keep current options.", path))
+				continue
+			}
+			if bytes.Equal(content, last) {
+				continue
+			}
+			last = content
+			if err := s.loadContent(path, content); err != nil {
+				s.Log.Error(err, fmt.Sprintf("Failed to reload config file %s, keep current options.", path))
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// ServeHTTP reports the active options and the sources they are merged from.
+func (s *OptionStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	status := map[string]interface{}{
+		"active":         s.options.Load(),
+		"flags":          s.defaults,
+		"configFile":     s.fileSpec,
+		"operatorConfig": s.configSpec,
+	}
+	s.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// PausedAnnotation freezes reconciliation and recycling of instance, e.g. during debugging or data recovery
+const PausedAnnotation = "codeserver.io/paused"
+
+func paused(codeServer *csv1alpha1.CodeServer) bool {
+	return strings.EqualFold(codeServer.Annotations[PausedAnnotation], "true")
+}
+
+// reconcilePaused keeps the paused condition in line with the annotation, it returns true if status has been
+// updated, which triggers another reconcile.
+func (r *CodeServerReconciler) reconcilePaused(codeServer *csv1alpha1.CodeServer) (bool, error) {
+	changed := false
+	if paused(codeServer) {
+		changed = SetCondition(&codeServer.Status, NewStateCondition(csv1alpha1.ServerPaused,
+			"reconciliation has been paused by annotation", map[string]string{}, corev1.ConditionTrue))
+	} else {
+		changed = removeCondition(&codeServer.Status, csv1alpha1.ServerPaused)
+	}
+	if !changed {
+		return false, nil
+	}
+	if err := r.Client.Update(context.TODO(), codeServer); err != nil {
+		return false, err
+	}
+	if paused(codeServer) {
+		r.Recorder.Event(codeServer, corev1.EventTypeNormal, EventPaused, "Reconciliation has been paused")
+	} else {
+		r.Recorder.Event(codeServer, corev1.EventTypeNormal, EventResumed, "Reconciliation has been resumed")
+	}
+	return true, nil
+}
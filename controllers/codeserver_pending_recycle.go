@@ -0,0 +1,180 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// PendingRecycleAnnotation records the time code server will be marked inactive if no activity resumes.
+	PendingRecycleAnnotation = "codeserver.io/pending-recycle-at"
+	// KeepAliveAnnotation can be added by users or portals to keep a pending recycle code server alive.
+	KeepAliveAnnotation = "codeserver.io/keep-alive"
+	RecycleAt           = "recycleAt"
+)
+
+// CodeServerInGracePeriod determines whether an inactive code server should stay in pending recycle phase,
+// code server enters the phase at the first time and leaves it once grace period passes.
+func (cs *CodeServerWatcher) CodeServerInGracePeriod(key string, css *CodeServerActiveStatus) bool {
+	reqLogger := keyLogger(cs.Log, css.NamespacedName)
+	grace := time.Duration(cs.Options.Load().InactiveGracePeriod) * time.Second
+	if grace <= 0 {
+		return false
+	}
+	if css.PendingSince.IsZero() {
+		now := time.Now()
+		if cs.pendingRecycleCodeServer(css, now.Add(grace)) {
+			cs.inActiveCache.MarkPending(key, now)
+			return true
+		}
+		return false
+	}
+	if cs.keepAliveRequested(css.NamespacedName) {
+		reqLogger.Info("code server has been requested to keep alive")
+		cs.inActiveCache.KeepAlive(key, time.Now())
+		cs.cancelPendingRecycle(css, "code server has been requested to keep alive")
+		return true
+	}
+	return time.Now().Sub(css.PendingSince) < grace
+}
+
+func (cs *CodeServerWatcher) pendingRecycleCodeServer(css *CodeServerActiveStatus, recycleTime time.Time) bool {
+	reqLogger := keyLogger(cs.Log, css.NamespacedName)
+	codeServer := &csv1alpha1.CodeServer{}
+	err := cs.Client.Get(context.TODO(), css.NamespacedName, codeServer)
+	if err != nil {
+		reqLogger.Error(err, "Failed to get code server for pending recycle.")
+		return false
+	}
+	recycleAt := recycleTime.UTC().Format(time.RFC3339)
+	pendingCondition := NewStateCondition(csv1alpha1.ServerPendingRecycle,
+		"code server will be marked inactive after grace period", map[string]string{RecycleAt: recycleAt},
+		corev1.ConditionTrue)
+	SetCondition(&codeServer.Status, pendingCondition)
+	if codeServer.Annotations == nil {
+		codeServer.Annotations = map[string]string{}
+	}
+	codeServer.Annotations[PendingRecycleAnnotation] = recycleAt
+	delete(codeServer.Annotations, KeepAliveAnnotation)
+	if err := cs.Client.Update(context.TODO(), codeServer); err != nil {
+		reqLogger.Error(err, "Failed to update code server status.")
+		return false
+	}
+	reqLogger.Info(fmt.Sprintf("code server is pending recycle and will be marked inactive at %s", recycleAt))
+	message := fmt.Sprintf("code server is inactive and will be stopped at %s", recycleAt)
+	cs.recorder.Event(codeServer, corev1.EventTypeNormal, EventPendingRecycle, message)
+	cs.notifier.Notify(codeServer, csv1alpha1.NotifyRecycleWarning, message)
+	cs.notifyExporter(css, http.MethodPost, map[string]string{"message": message, RecycleAt: recycleAt})
+	return true
+}
+
+func (cs *CodeServerWatcher) cancelPendingRecycle(css *CodeServerActiveStatus, reason string) {
+	reqLogger := keyLogger(cs.Log, css.NamespacedName)
+	cs.inActiveCache.ClearPending(css.NamespacedName.String())
+	codeServer := &csv1alpha1.CodeServer{}
+	err := cs.Client.Get(context.TODO(), css.NamespacedName, codeServer)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			reqLogger.Error(err, "Failed to get code server for cancelling pending recycle.")
+		}
+		return
+	}
+	if clearPendingRecycle(codeServer, reason) {
+		if err := cs.Client.Update(context.TODO(), codeServer); err != nil {
+			reqLogger.Error(err, "Failed to update code server status.")
+			return
+		}
+		cs.recorder.Event(codeServer, corev1.EventTypeNormal, EventRecycleCanceled, reason)
+	}
+	cs.notifyExporter(css, http.MethodDelete, nil)
+}
+
+func (cs *CodeServerWatcher) keepAliveRequested(req types.NamespacedName) bool {
+	codeServer := &csv1alpha1.CodeServer{}
+	if err := cs.Client.Get(context.TODO(), req, codeServer); err != nil {
+		return false
+	}
+	_, found := codeServer.Annotations[KeepAliveAnnotation]
+	return found
+}
+
+// notifyExporter pushes or withdraws the in-IDE recycle notification via status exporter
+func (cs *CodeServerWatcher) notifyExporter(css *CodeServerActiveStatus, method string, payload map[string]string) {
+	if len(css.NotifyEndpoint) == 0 {
+		return
+	}
+	reqLogger := keyLogger(cs.Log, css.NamespacedName)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		reqLogger.Error(err, "Failed to encode exporter notification.")
+		return
+	}
+	request, err := http.NewRequest(method, css.NotifyEndpoint, bytes.NewReader(body))
+	if err != nil {
+		reqLogger.Error(err, "Failed to build exporter notification.")
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if token := exporterToken(cs.Client, css.NamespacedName.Namespace, css.NamespacedName.Name); len(token) != 0 {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(request)
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to notify exporter with endpoint %s", css.NotifyEndpoint))
+		return
+	}
+	resp.Body.Close()
+}
+
+// pendingRecycleSince returns the time code server entered pending recycle according to its annotation, so that
+// the grace period survives restarts of operator. Zero time is returned if it's not pending recycle.
+func pendingRecycleSince(codeServer *csv1alpha1.CodeServer, gracePeriod int) time.Time {
+	recycleAt, err := time.Parse(time.RFC3339, codeServer.Annotations[PendingRecycleAnnotation])
+	if err != nil {
+		return time.Time{}
+	}
+	return recycleAt.Add(-time.Duration(gracePeriod) * time.Second)
+}
+
+// clearPendingRecycle removes pending recycle condition and annotation, returns true if object changed.
+func clearPendingRecycle(codeServer *csv1alpha1.CodeServer, reason string) bool {
+	changed := false
+	if HasCondition(codeServer.Status, csv1alpha1.ServerPendingRecycle) {
+		SetCondition(&codeServer.Status, NewStateCondition(csv1alpha1.ServerPendingRecycle,
+			reason, map[string]string{}, corev1.ConditionFalse))
+		changed = true
+	}
+	for _, key := range []string{PendingRecycleAnnotation, KeepAliveAnnotation} {
+		if _, found := codeServer.Annotations[key]; found {
+			delete(codeServer.Annotations, key)
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// UserDataResource names the dedicated volume of user data in WorkspaceOnly persistence.
+	UserDataResource = "%s-user-data"
+	UserDataSize     = "1Gi"
+	// UserDataSubPath is where user data is kept on workspace volume in Full persistence.
+	UserDataSubPath = ".code-server"
+)
+
+// persistenceOf returns where user data of instance lives, user data is ephemeral unless instance has workspace
+// volume. Home volume already keeps user data and takes precedence.
+func (r *CodeServerReconciler) persistenceOf(m *csv1alpha1.CodeServer) csv1alpha1.PersistenceStrategy {
+	if len(m.Spec.Persistence) == 0 || homeEnabled(m) || !r.needDeployPVC(m.Spec.StorageName) ||
+		!strings.EqualFold(string(m.Spec.Runtime), string(csv1alpha1.RuntimeCode)) {
+		return csv1alpha1.PersistenceEphemeral
+	}
+	return m.Spec.Persistence
+}
+
+// reconcileForUserData creates the dedicated volume of user data in WorkspaceOnly persistence, the volume is
+// owned by instance and deleted once instance switches to another strategy.
+func (r *CodeServerReconciler) reconcileForUserData(codeServer *csv1alpha1.CodeServer) error {
+	name := ChildName(UserDataResource, codeServer.Name)
+	if r.persistenceOf(codeServer) != csv1alpha1.PersistenceWorkspaceOnly {
+		return r.deleteResourceIfExists(&corev1.PersistentVolumeClaim{}, name, codeServer.Namespace)
+	}
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, pvc)
+	if err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+	quantity, _ := resourcev1.ParseQuantity(UserDataSize)
+	pvc = &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: codeServer.Namespace,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: &codeServer.Spec.StorageName,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: quantity},
+			},
+		},
+	}
+	setOwnedLabels(pvc, codeServer.Name)
+	r.addCostLabels(codeServer, pvc)
+	controllerutil.SetControllerReference(codeServer, pvc, r.Scheme)
+	r.instanceLog(codeServer).Info(fmt.Sprintf("creating user data volume %s", name))
+	if err := r.Client.Create(context.TODO(), pvc); err != nil {
+		return err
+	}
+	r.recordCreated(codeServer, pvc)
+	return nil
+}
+
+// addPersistenceForPod moves the share dir of code server, which is an empty dir by default, onto workspace
+// volume or the dedicated user data volume.
+func (r *CodeServerReconciler) addPersistenceForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	switch r.persistenceOf(m) {
+	case csv1alpha1.PersistenceFull:
+		relocate := func(container *corev1.Container) {
+			for index := range container.VolumeMounts {
+				if container.VolumeMounts[index].Name == VSCodeShareVolume {
+					container.VolumeMounts[index].Name = VSCodeProjectVolume
+					container.VolumeMounts[index].SubPath = UserDataSubPath
+				}
+			}
+		}
+		for index := range podSpec.InitContainers {
+			relocate(&podSpec.InitContainers[index])
+		}
+		for index := range podSpec.Containers {
+			relocate(&podSpec.Containers[index])
+		}
+		var volumes []corev1.Volume
+		for _, volume := range podSpec.Volumes {
+			if volume.Name != VSCodeShareVolume {
+				volumes = append(volumes, volume)
+			}
+		}
+		podSpec.Volumes = volumes
+	case csv1alpha1.PersistenceWorkspaceOnly:
+		for index := range podSpec.Volumes {
+			if podSpec.Volumes[index].Name == VSCodeShareVolume {
+				podSpec.Volumes[index].VolumeSource = corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: ChildName(UserDataResource, m.Name),
+					},
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"sync"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// PortsResource names the service exposing the additional ports of instance.
+	PortsResource = "%s-ports"
+	// PortsLabel marks the services whose external ports are allocated on the shared load balancer ip.
+	PortsLabel = "codeserver.io/additional-ports"
+	// PortsSharingAnnotation lets metallb assign the same ip to the services of all instances.
+	PortsSharingAnnotation = "metallb.universe.tf/allow-shared-ip"
+	PortsSharingKey        = "code-server-operator"
+	// PortEndpointFormat is the key of external endpoint of port in ready condition, e.g. port-game.
+	PortEndpointFormat = "port-%s"
+)
+
+// portAllocator allocates the external ports on the shared load balancer ip, ports are unique regardless of
+// protocol. Reservations cover the services which have been applied but haven't shown up in cache yet, they are
+// only known to this replica, so every shard allocates from its own part of the range.
+type portAllocator struct {
+	sync.Mutex
+	reserved map[int32]string
+}
+
+var additionalPortAllocator = &portAllocator{reserved: map[int32]string{}}
+
+// release drops the reservations of owner.
+func (a *portAllocator) release(owner string) {
+	a.Lock()
+	defer a.Unlock()
+	for port, holder := range a.reserved {
+		if holder == owner {
+			delete(a.reserved, port)
+		}
+	}
+}
+
+// allocate returns the external port of every port name of owner within [min, max], the current port is kept
+// if it's still free. used maps the ports of services in cache to their owners.
+func (a *portAllocator) allocate(owner string, names []string, current map[string]int32, used map[int32]string,
+	min, max int32) (map[string]int32, error) {
+	a.Lock()
+	defer a.Unlock()
+	taken := map[int32]bool{}
+	for port, holder := range used {
+		if holder != owner {
+			taken[port] = true
+		}
+	}
+	for port, holder := range a.reserved {
+		if holder != owner {
+			taken[port] = true
+		}
+	}
+	allocated := map[string]int32{}
+	for _, name := range names {
+		if port, found := current[name]; found && port >= min && port <= max && !taken[port] {
+			allocated[name] = port
+			taken[port] = true
+		}
+	}
+	next := min
+	for _, name := range names {
+		if _, found := allocated[name]; found {
+			continue
+		}
+		for next <= max && taken[next] {
+			next++
+		}
+		if next > max {
+			return nil, fmt.Errorf("no free port left in range %d-%d of shared load balancer", min, max)
+		}
+		allocated[name] = next
+		taken[next] = true
+	}
+	for port, holder := range a.reserved {
+		if holder == owner {
+			delete(a.reserved, port)
+		}
+	}
+	for _, port := range allocated {
+		a.reserved[port] = owner
+	}
+	return allocated, nil
+}
+
+// shardPortRange returns the part of port range [min, max] allocated by shard, the range is split evenly among
+// shards so that replicas never allocate the same port.
+func shardPortRange(min, max int32, shard, count int) (int32, int32, error) {
+	if count <= 1 {
+		return min, max, nil
+	}
+	size := (max - min + 1) / int32(count)
+	if size == 0 {
+		return 0, 0, fmt.Errorf("port range %d-%d is smaller than %d shards", min, max, count)
+	}
+	first := min + int32(shard)*size
+	last := first + size - 1
+	if shard == count-1 {
+		last = max
+	}
+	return first, last, nil
+}
+
+// portsOwner returns the namespace/name of code server which owns the service of additional ports.
+func portsOwner(service *corev1.Service) string {
+	if name, found := service.Labels[InstanceLabel]; found {
+		return fmt.Sprintf("%s/%s", service.Namespace, name)
+	}
+	return fmt.Sprintf("%s/%s", service.Namespace, strings.TrimSuffix(service.Name, "-ports"))
+}
+
+// parsePortRange parses range in the format of 'min-max'.
+func parsePortRange(value string) (int32, int32, error) {
+	bounds := strings.Split(value, "-")
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %s, expected 'min-max'", value)
+	}
+	min, err := strconv.ParseInt(strings.TrimSpace(bounds[0]), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %s: %v", value, err)
+	}
+	max, err := strconv.ParseInt(strings.TrimSpace(bounds[1]), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %s: %v", value, err)
+	}
+	if min <= 0 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %s", value)
+	}
+	return int32(min), int32(max), nil
+}
+
+func additionalPorts(m *csv1alpha1.CodeServer) []csv1alpha1.AdditionalPort {
+	if m.Spec.Network == nil {
+		return nil
+	}
+	return m.Spec.Network.AdditionalPorts
+}
+
+func portProtocol(port *csv1alpha1.AdditionalPort) corev1.Protocol {
+	if port.Protocol == corev1.ProtocolUDP {
+		return corev1.ProtocolUDP
+	}
+	return corev1.ProtocolTCP
+}
+
+// reconcileForAdditionalPorts exposes the additional ports of instance, the service is kept while instance is
+// inactive so that external ports don't change once it wakes up.
+func (r *CodeServerReconciler) reconcileForAdditionalPorts(codeServer *csv1alpha1.CodeServer) (*corev1.Service,
+	error) {
+	name := ChildName(PortsResource, codeServer.Name)
+	ports := additionalPorts(codeServer)
+	if len(ports) == 0 {
+		return nil, r.deleteAdditionalPorts(codeServer.Name, codeServer.Namespace)
+	}
+	live := &corev1.Service{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, live)
+	found := err == nil
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: codeServer.Namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeNodePort,
+			Selector: appLabel(codeServer.Name),
+		},
+	}
+	external := map[string]int32{}
+	if len(r.Options.Load().AdditionalPortsIP) != 0 {
+		if external, err = r.allocateAdditionalPorts(codeServer, ports, live, found); err != nil {
+			return nil, err
+		}
+		service.Labels = map[string]string{PortsLabel: "true"}
+		service.Annotations = map[string]string{PortsSharingAnnotation: PortsSharingKey}
+		service.Spec.Type = corev1.ServiceTypeLoadBalancer
+		service.Spec.LoadBalancerIP = r.Options.Load().AdditionalPortsIP
+	}
+	addIPFamiliesForService(codeServer, service)
+	for i := range ports {
+		port := ports[i].Port
+		if allocated, found := external[ports[i].Name]; found {
+			port = allocated
+		}
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+			Name:       ports[i].Name,
+			Port:       port,
+			Protocol:   portProtocol(&ports[i]),
+			TargetPort: intstr.FromInt(int(ports[i].Port)),
+		})
+	}
+	if err := r.applyOwned(codeServer, service, live); err != nil {
+		return nil, err
+	}
+	return live, nil
+}
+
+// allocateAdditionalPorts allocates the external ports of instance on the shared load balancer ip from the range
+// of shard, ports are kept across reconciles.
+func (r *CodeServerReconciler) allocateAdditionalPorts(codeServer *csv1alpha1.CodeServer,
+	ports []csv1alpha1.AdditionalPort, live *corev1.Service, found bool) (map[string]int32, error) {
+	min, max, err := parsePortRange(r.Options.Load().AdditionalPortRange)
+	if err != nil {
+		return nil, err
+	}
+	min, max, err = shardPortRange(min, max, ShardOf(r.Options, codeServer), r.Options.Load().ShardCount)
+	if err != nil {
+		return nil, err
+	}
+	owner := fmt.Sprintf("%s/%s", codeServer.Namespace, codeServer.Name)
+	current := map[string]int32{}
+	if found && live.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		for _, port := range live.Spec.Ports {
+			current[port.Name] = port.Port
+		}
+	}
+	services := &corev1.ServiceList{}
+	if err := r.Client.List(context.TODO(), services, client.MatchingLabels{PortsLabel: "true"}); err != nil {
+		return nil, err
+	}
+	used := map[int32]string{}
+	for i := range services.Items {
+		service := &services.Items[i]
+		holder := portsOwner(service)
+		for _, port := range service.Spec.Ports {
+			used[port.Port] = holder
+		}
+	}
+	var names []string
+	for i := range ports {
+		names = append(names, ports[i].Name)
+	}
+	return additionalPortAllocator.allocate(owner, names, current, used, min, max)
+}
+
+// deleteAdditionalPorts deletes the service of additional ports and releases its external ports.
+func (r *CodeServerReconciler) deleteAdditionalPorts(name, namespace string) error {
+	if err := r.deleteResourceIfExists(&corev1.Service{}, ChildName(PortsResource, name), namespace); err != nil {
+		return err
+	}
+	additionalPortAllocator.release(fmt.Sprintf("%s/%s", namespace, name))
+	return nil
+}
+
+// additionalPortsInfo returns the external endpoints of additional ports which will be exposed in ready
+// condition, e.g. 203.0.113.10:20001/UDP on load balancer or 31234/TCP on node ports.
+func additionalPortsInfo(service *corev1.Service) map[string]string {
+	info := map[string]string{}
+	if service == nil {
+		return info
+	}
+	host := ""
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		host = ingress.IP
+		if len(ingress.Hostname) != 0 {
+			host = ingress.Hostname
+		}
+		break
+	}
+	for _, port := range service.Spec.Ports {
+		switch {
+		case service.Spec.Type == corev1.ServiceTypeLoadBalancer && len(host) != 0:
+			info[fmt.Sprintf(PortEndpointFormat, port.Name)] = fmt.Sprintf("%s/%s", endpointAddress(host, port.Port),
+				port.Protocol)
+		case service.Spec.Type == corev1.ServiceTypeNodePort && port.NodePort != 0:
+			info[fmt.Sprintf(PortEndpointFormat, port.Name)] = fmt.Sprintf("%d/%s", port.NodePort, port.Protocol)
+		}
+	}
+	return info
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// metadataChanged returns true if metadata the reconciler acts on differs, resource version and managed fields are
+// bumped on every write and are ignored.
+func metadataChanged(old, new client.Object) bool {
+	return !equality.Semantic.DeepEqual(old.GetLabels(), new.GetLabels()) ||
+		!equality.Semantic.DeepEqual(old.GetAnnotations(), new.GetAnnotations()) ||
+		!equality.Semantic.DeepEqual(old.GetFinalizers(), new.GetFinalizers()) ||
+		!equality.Semantic.DeepEqual(old.GetOwnerReferences(), new.GetOwnerReferences()) ||
+		!old.GetDeletionTimestamp().Equal(new.GetDeletionTimestamp())
+}
+
+// conditionStates maps the condition types to their statuses, probe times, reasons and messages are left out.
+func conditionStates(
+	conditions []csv1alpha1.ServerCondition) map[csv1alpha1.ServerConditionType]corev1.ConditionStatus {
+	states := make(map[csv1alpha1.ServerConditionType]corev1.ConditionStatus, len(conditions))
+	for _, condition := range conditions {
+		states[condition.Type] = condition.Status
+	}
+	return states
+}
+
+// codeServerChanged filters the updates of code server which can't change the outcome of reconcile. Status has no
+// subresource and every status write of watcher and status batcher used to trigger a reconcile, only the condition
+// transitions (e.g. marked inactive or recycled) are kept now.
+func codeServerChanged(old, new *csv1alpha1.CodeServer) bool {
+	return metadataChanged(old, new) || !equality.Semantic.DeepEqual(old.Spec, new.Spec) ||
+		!equality.Semantic.DeepEqual(conditionStates(old.Status.Conditions), conditionStates(new.Status.Conditions))
+}
+
+// ownedChanged filters the updates of generated resources which can't change the outcome of reconcile, status is
+// only kept where reconcile waits on it, i.e. availability of deployment, binding of volume and load balancer of
+// ssh service.
+func ownedChanged(old, new client.Object) bool {
+	if metadataChanged(old, new) || old.GetGeneration() != new.GetGeneration() {
+		return true
+	}
+	switch oldObj := old.(type) {
+	case *appsv1.Deployment:
+		newObj := new.(*appsv1.Deployment)
+		return oldObj.Status.ReadyReplicas != newObj.Status.ReadyReplicas ||
+			oldObj.Status.AvailableReplicas != newObj.Status.AvailableReplicas ||
+			HasDeploymentCondition(oldObj.Status, appsv1.DeploymentAvailable) !=
+				HasDeploymentCondition(newObj.Status, appsv1.DeploymentAvailable)
+	case *corev1.PersistentVolumeClaim:
+		newObj := new.(*corev1.PersistentVolumeClaim)
+		return oldObj.Status.Phase != newObj.Status.Phase ||
+			!equality.Semantic.DeepEqual(oldObj.Status.Conditions, newObj.Status.Conditions)
+	case *corev1.Service:
+		// generation of service is never bumped
+		newObj := new.(*corev1.Service)
+		return !equality.Semantic.DeepEqual(oldObj.Spec, newObj.Spec) ||
+			!equality.Semantic.DeepEqual(oldObj.Status.LoadBalancer, newObj.Status.LoadBalancer)
+	}
+	return false
+}
+
+// updatePredicate drops the irrelevant updates of code servers, it passes everything if filtering is disabled.
+func (r *CodeServerReconciler) updatePredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if !r.Options.Load().FilterUpdates {
+				return true
+			}
+			old, ok := e.ObjectOld.(*csv1alpha1.CodeServer)
+			if !ok {
+				return true
+			}
+			new, ok := e.ObjectNew.(*csv1alpha1.CodeServer)
+			if !ok {
+				return true
+			}
+			return codeServerChanged(old, new)
+		},
+	}
+}
+
+// ownedPredicate drops the irrelevant updates of generated resources, it passes everything if filtering is disabled.
+func (r *CodeServerReconciler) ownedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if !r.Options.Load().FilterUpdates || e.ObjectOld == nil || e.ObjectNew == nil {
+				return true
+			}
+			return ownedChanged(e.ObjectOld, e.ObjectNew)
+		},
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	PrepullResource          = "code-server-prepull"
+	PrepullProviderDaemonSet = "daemonset"
+	PrepullProviderFledged   = "kubefledged"
+	PrepullPauseImage        = "k8s.gcr.io/pause:3.7"
+	PrepullLabel             = "codeserver.io/prepull"
+)
+
+var ImageCacheGVK = schema.GroupVersionKind{
+	Group:   "kubefledged.io",
+	Version: "v1alpha2",
+	Kind:    "ImageCache",
+}
+
+// CodeServerPrepuller keeps the images of code servers cached on nodes, either with a DaemonSet whose init
+// containers pull every image or with an ImageCache of kube-fledged.
+type CodeServerPrepuller struct {
+	client.Client
+	Log     logr.Logger
+	Options *CodeServerOption
+}
+
+func NewCodeServerPrepuller(client client.Client, log logr.Logger, options *CodeServerOption) *CodeServerPrepuller {
+	return &CodeServerPrepuller{
+		client,
+		log,
+		options,
+	}
+}
+
+func (p *CodeServerPrepuller) Run(stopCh <-chan struct{}) {
+	interval := p.Options.Load().PrepullInterval
+	if interval <= 0 {
+		interval = 300
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	p.Sync()
+	for {
+		select {
+		case <-ticker.C:
+			p.Sync()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// Sync updates the prepull resource with images currently configured.
+func (p *CodeServerPrepuller) Sync() {
+	reqLogger := p.Log.WithValues("namespace", p.Options.Load().PrepullNamespace, "name", PrepullResource)
+	images := p.images()
+	var err error
+	if p.Options.Load().PrepullProvider == PrepullProviderFledged {
+		err = p.syncImageCache(images)
+	} else {
+		err = p.syncDaemonSet(images)
+	}
+	if err != nil {
+		reqLogger.Error(err, "Failed to sync prepull images.")
+	}
+}
+
+// images returns the sorted images of operator options, default images of templates and the extra ones, rewritten
+// onto their registry mirrors.
+func (p *CodeServerPrepuller) images() []string {
+	found := map[string]bool{}
+	for _, image := range append([]string{p.Options.Load().VSExporterImage, p.Options.Load().RolloutImage}, p.Options.Load().PrepullImages...) {
+		if len(image) != 0 {
+			found[image] = true
+		}
+	}
+	templates := &csv1alpha1.CodeServerTemplateList{}
+	if err := p.Client.List(context.TODO(), templates); err != nil {
+		p.Log.Error(err, "Failed to list templates for prepull, only configured images are pulled.")
+	}
+	for _, template := range templates.Items {
+		if len(template.Spec.Template.Image) != 0 {
+			found[template.Spec.Template.Image] = true
+		}
+	}
+	mirrored := map[string]bool{}
+	for image := range found {
+		mirrored[mirrorImage(image, p.Options.Load().RegistryMirrors)] = true
+	}
+	var images []string
+	for image := range mirrored {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images
+}
+
+func (p *CodeServerPrepuller) syncDaemonSet(images []string) error {
+	reqLogger := p.Log.WithValues("namespace", p.Options.Load().PrepullNamespace, "name", PrepullResource)
+	newDs := p.newDaemonSet(images)
+	oldDs := &appsv1.DaemonSet{}
+	err := p.Client.Get(context.TODO(), types.NamespacedName{Name: PrepullResource,
+		Namespace: p.Options.Load().PrepullNamespace}, oldDs)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		reqLogger.Info(fmt.Sprintf("creating prepull daemonset with %d images", len(images)))
+		return p.Client.Create(context.TODO(), newDs)
+	}
+	if equality.Semantic.DeepDerivative(newDs.Spec, oldDs.Spec) {
+		return nil
+	}
+	reqLogger.Info(fmt.Sprintf("updating prepull daemonset with %d images", len(images)))
+	oldDs.Spec = newDs.Spec
+	return p.Client.Update(context.TODO(), oldDs)
+}
+
+// newDaemonSet returns the DaemonSet pulling every image in an init container, a pause container keeps pods
+// running afterwards. Images are required to provide a shell.
+func (p *CodeServerPrepuller) newDaemonSet(images []string) *appsv1.DaemonSet {
+	labels := map[string]string{PrepullLabel: PrepullResource}
+	resources := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resourcev1.MustParse("1m"),
+			corev1.ResourceMemory: resourcev1.MustParse("8Mi"),
+		},
+	}
+	var initContainers []corev1.Container
+	for i, image := range images {
+		initContainers = append(initContainers, corev1.Container{
+			Name:                     fmt.Sprintf("prepull-%d", i),
+			Image:                    image,
+			ImagePullPolicy:          corev1.PullIfNotPresent,
+			Command:                  []string{"sh", "-c", "exit 0"},
+			Resources:                resources,
+			TerminationMessagePath:   corev1.TerminationMessagePathDefault,
+			TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+		})
+	}
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      PrepullResource,
+			Namespace: p.Options.Load().PrepullNamespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					NodeSelector:   p.Options.Load().PrepullNodeSelector,
+					InitContainers: initContainers,
+					Containers: []corev1.Container{
+						{
+							Name:            "pause",
+							Image:           mirrorImage(PrepullPauseImage, p.Options.Load().RegistryMirrors),
+							ImagePullPolicy: corev1.PullIfNotPresent,
+							Resources:       resources,
+						},
+					},
+					Tolerations: []corev1.Toleration{
+						{
+							Operator: corev1.TolerationOpExists,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (p *CodeServerPrepuller) syncImageCache(images []string) error {
+	reqLogger := p.Log.WithValues("namespace", p.Options.Load().PrepullNamespace, "name", PrepullResource)
+	var cacheImages []interface{}
+	for _, image := range images {
+		cacheImages = append(cacheImages, image)
+	}
+	cacheSpec := map[string]interface{}{"images": cacheImages}
+	if len(p.Options.Load().PrepullNodeSelector) != 0 {
+		selector := map[string]interface{}{}
+		for key, value := range p.Options.Load().PrepullNodeSelector {
+			selector[key] = value
+		}
+		cacheSpec["nodeSelector"] = selector
+	}
+	spec := map[string]interface{}{"cacheSpec": []interface{}{cacheSpec}}
+	cache := &unstructured.Unstructured{}
+	cache.SetGroupVersionKind(ImageCacheGVK)
+	err := p.Client.Get(context.TODO(), types.NamespacedName{Name: PrepullResource,
+		Namespace: p.Options.Load().PrepullNamespace}, cache)
+	if err != nil {
+		if meta.IsNoMatchError(err) {
+			return fmt.Errorf("kube-fledged is not installed: %v", err)
+		}
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		cache.SetName(PrepullResource)
+		cache.SetNamespace(p.Options.Load().PrepullNamespace)
+		cache.SetLabels(map[string]string{PrepullLabel: PrepullResource})
+		cache.Object["spec"] = spec
+		reqLogger.Info(fmt.Sprintf("creating prepull image cache with %d images", len(images)))
+		return p.Client.Create(context.TODO(), cache)
+	}
+	if equality.Semantic.DeepEqual(cache.Object["spec"], spec) {
+		return nil
+	}
+	reqLogger.Info(fmt.Sprintf("updating prepull image cache with %d images", len(images)))
+	cache.Object["spec"] = spec
+	return p.Client.Update(context.TODO(), cache)
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	errrorlib "errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"net/url"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strconv"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// PreviewPortsAnnotation lists the ports inside instance exposed on their own hosts, e.g. "3000,8080".
+	PreviewPortsAnnotation = "codeserver.io/preview-ports"
+	// PreviewResource names the ingress routing the preview ports.
+	PreviewResource = "%s-preview"
+	PreviewPortName = "preview-%d"
+	// PreviewHostSeparator separates subdomain and port in preview hosts, subdomains of instances must not contain
+	// it so that preview hosts never collide with hosts of instances or previews of others.
+	PreviewHostSeparator = "--"
+)
+
+// previewPorts returns the valid ports of annotation in ascending order, ports used by operator are skipped.
+func previewPorts(m *csv1alpha1.CodeServer) []int32 {
+	seen := map[int32]bool{}
+	var ports []int32
+	for _, field := range strings.Split(m.Annotations[PreviewPortsAnnotation], ",") {
+		port, err := strconv.ParseInt(strings.TrimSpace(field), 10, 32)
+		if err != nil || port <= 0 || port > 65535 || port == HttpPort || port == ExporterPort || seen[int32(port)] {
+			continue
+		}
+		seen[int32(port)] = true
+		ports = append(ports, int32(port))
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
+// formatPreviewPorts returns the annotation value of ports.
+func formatPreviewPorts(ports []int32) string {
+	var fields []string
+	for _, port := range ports {
+		fields = append(fields, strconv.Itoa(int(port)))
+	}
+	return strings.Join(fields, ",")
+}
+
+// previewHost returns the host port of instance is exposed on, e.g. <subdomain>--3000.<domain>.
+func previewHost(m *csv1alpha1.CodeServer, port int32, domain string) string {
+	return fmt.Sprintf("%s%s%d.%s", m.Spec.Subdomain, PreviewHostSeparator, port, domain)
+}
+
+// previewServicePorts returns the service ports of preview ports, ports already exposed, e.g. declared in
+// .gitpod.yml, are skipped.
+func previewServicePorts(m *csv1alpha1.CodeServer, existing []corev1.ServicePort) []corev1.ServicePort {
+	exposed := map[int32]bool{}
+	for _, port := range existing {
+		exposed[port.Port] = true
+	}
+	var ports []corev1.ServicePort
+	for _, port := range previewPorts(m) {
+		if exposed[port] {
+			continue
+		}
+		ports = append(ports, corev1.ServicePort{
+			Name:       fmt.Sprintf(PreviewPortName, port),
+			Port:       port,
+			Protocol:   corev1.ProtocolTCP,
+			TargetPort: intstr.FromInt(int(port)),
+		})
+	}
+	return ports
+}
+
+// validatePreview checks preview ports of instance can be routed, they are never public.
+func (r *CodeServerReconciler) validatePreview(m *csv1alpha1.CodeServer) error {
+	if r.ingressProvider(m) != IngressProviderIngress || routingMode(m) != csv1alpha1.RoutingSubdomain {
+		return errrorlib.New("preview ports require subdomain routing of ingress provider")
+	}
+	if len(r.Options.Load().OAuth2ProxyURL) == 0 || len(m.Annotations[UserAnnotation]) == 0 {
+		return errrorlib.New("preview ports require oauth2 proxy and the owner of instance")
+	}
+	if strings.Contains(m.Spec.Subdomain, PreviewHostSeparator) {
+		return fmt.Errorf("preview ports require subdomain without '%s'", PreviewHostSeparator)
+	}
+	return nil
+}
+
+// reconcileForPreview routes every preview port on its own host with ingress of ingress-nginx, the ingress is
+// removed once no port is exposed. Ports whose host is taken by the subdomain of another instance are skipped.
+func (r *CodeServerReconciler) reconcileForPreview(codeServer *csv1alpha1.CodeServer) error {
+	name := ChildName(PreviewResource, codeServer.Name)
+	ports := previewPorts(codeServer)
+	if len(ports) == 0 {
+		return r.deleteResourceIfExists(&extv1.Ingress{}, name, codeServer.Namespace)
+	}
+	if err := r.validatePreview(codeServer); err != nil {
+		r.Recorder.Event(codeServer, corev1.EventTypeWarning, EventPreviewFailed, err.Error())
+		return r.deleteResourceIfExists(&extv1.Ingress{}, name, codeServer.Namespace)
+	}
+	var routed []int32
+	for _, port := range ports {
+		taken := &csv1alpha1.CodeServerList{}
+		subdomain := strings.SplitN(previewHost(codeServer, port, r.Options.Load().DomainName), ".", 2)[0]
+		if err := r.Client.List(context.TODO(), taken, client.MatchingFields{IndexRoute: subdomain}); err != nil {
+			return err
+		}
+		if len(taken.Items) != 0 {
+			r.Recorder.Eventf(codeServer, corev1.EventTypeWarning, EventPreviewFailed,
+				"Host of preview port %d is taken by another instance", port)
+			continue
+		}
+		routed = append(routed, port)
+	}
+	if len(routed) == 0 {
+		return r.deleteResourceIfExists(&extv1.Ingress{}, name, codeServer.Namespace)
+	}
+	return r.applyOwned(codeServer, r.newPreviewIngress(codeServer, routed), &extv1.Ingress{})
+}
+
+// newPreviewIngress returns the ingress of preview ports, only the owner of instance is allowed by oauth2 proxy.
+func (r *CodeServerReconciler) newPreviewIngress(m *csv1alpha1.CodeServer, ports []int32) *extv1.Ingress {
+	annotations := r.annotationsForIngress()
+	addCertificateAnnotation(m, annotations)
+	proxy := strings.TrimSuffix(r.Options.Load().OAuth2ProxyURL, "/")
+	annotations["nginx.ingress.kubernetes.io/auth-url"] = fmt.Sprintf("%s/oauth2/auth?allowed_emails=%s", proxy,
+		url.QueryEscape(m.Annotations[UserAnnotation]))
+	annotations["nginx.ingress.kubernetes.io/auth-signin"] = proxy + "/oauth2/start?rd=https://$host$escaped_request_uri"
+	ingress := &extv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        ChildName(PreviewResource, m.Name),
+			Namespace:   m.Namespace,
+			Annotations: annotations,
+		},
+	}
+	var hosts []string
+	for _, port := range ports {
+		host := previewHost(m, port, r.Options.Load().DomainName)
+		hosts = append(hosts, host)
+		ingress.Spec.Rules = append(ingress.Spec.Rules, extv1.IngressRule{
+			Host: host,
+			IngressRuleValue: extv1.IngressRuleValue{
+				HTTP: &extv1.HTTPIngressRuleValue{
+					Paths: []extv1.HTTPIngressPath{
+						{
+							Path: "/",
+							Backend: extv1.IngressBackend{
+								ServiceName: m.Name,
+								ServicePort: intstr.FromInt(int(port)),
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+	ingress.Spec.TLS = []extv1.IngressTLS{{Hosts: hosts, SecretName: r.Options.Load().HttpsSecretName}}
+	return ingress
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/flowcontrol"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// BackgroundRetryDelay is the delay before background work yielded to user facing work is retried.
+const BackgroundRetryDelay = 2 * time.Second
+
+// BackgroundMaxDelay is the longest time background work yields to user facing work before it runs anyway.
+const BackgroundMaxDelay = 30 * time.Second
+
+// ReconcileScheduler prioritizes user facing transitions (creating and waking up instances) over background work
+// (steady state, recycling and orphan collection): background work only runs on its reserved workers and yields
+// whenever user facing work is in flight. Background work deferred longer than BackgroundMaxDelay, finalizing and
+// recycling no longer yield so that they can't be starved. Creation of instances is rate limited to protect api server.
+type ReconcileScheduler struct {
+	foreground    int32
+	background    chan struct{}
+	createLimiter flowcontrol.RateLimiter
+	lock          sync.Mutex
+	deferred      map[types.NamespacedName]time.Time
+}
+
+func NewReconcileScheduler(options *CodeServerOption) *ReconcileScheduler {
+	concurrency := options.Load().BackgroundConcurrency
+	if concurrency <= 0 {
+		concurrency = options.Load().MaxConcurrency / 2
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	scheduler := &ReconcileScheduler{background: make(chan struct{}, concurrency),
+		deferred: map[types.NamespacedName]time.Time{}}
+	if options.Load().CreateQPS > 0 {
+		scheduler.createLimiter = flowcontrol.NewTokenBucketRateLimiter(float32(options.Load().CreateQPS), options.Load().CreateBurst)
+	}
+	return scheduler
+}
+
+// foregroundWork returns whether reconciling the code server is visible to user, i.e. instance is being created or
+// woken up.
+func foregroundWork(codeServer *csv1alpha1.CodeServer) bool {
+	return codeServer.DeletionTimestamp.IsZero() && !HasCondition(codeServer.Status, csv1alpha1.ServerReady) &&
+		!HasCondition(codeServer.Status, csv1alpha1.ServerInactive) &&
+		!HasCondition(codeServer.Status, csv1alpha1.ServerRecycled)
+}
+
+// urgentWork returns whether background work on the code server must not yield to user facing work, i.e. instance
+// is being finalized or recycled.
+func urgentWork(codeServer *csv1alpha1.CodeServer) bool {
+	return !codeServer.DeletionTimestamp.IsZero() || HasCondition(codeServer.Status, csv1alpha1.ServerInactive)
+}
+
+// BeginForeground marks user facing work in flight, the returned function must be called when work is done.
+func (s *ReconcileScheduler) BeginForeground() func() {
+	if s == nil {
+		return func() {}
+	}
+	atomic.AddInt32(&s.foreground, 1)
+	return func() {
+		atomic.AddInt32(&s.foreground, -1)
+	}
+}
+
+// Busy returns whether user facing work is in flight.
+func (s *ReconcileScheduler) Busy() bool {
+	return s != nil && atomic.LoadInt32(&s.foreground) > 0
+}
+
+// BeginBackground acquires a background worker for the code server, false is returned if background work should
+// yield. Urgent work and work deferred longer than BackgroundMaxDelay only wait for a reserved worker.
+func (s *ReconcileScheduler) BeginBackground(key types.NamespacedName, urgent bool) (func(), bool) {
+	if s == nil {
+		return func() {}, true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	deferredAt, deferred := s.deferred[key]
+	if !deferred {
+		deferredAt = time.Now()
+	}
+	overdue := deferred && time.Since(deferredAt) >= BackgroundMaxDelay
+	if !urgent && !overdue && s.Busy() {
+		s.deferred[key] = deferredAt
+		return nil, false
+	}
+	select {
+	case s.background <- struct{}{}:
+		delete(s.deferred, key)
+		return func() {
+			<-s.background
+		}, true
+	default:
+		s.deferred[key] = deferredAt
+		return nil, false
+	}
+}
+
+// Forget drops the deferral of code server which no longer exists.
+func (s *ReconcileScheduler) Forget(key types.NamespacedName) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.deferred, key)
+}
+
+// AllowCreate returns whether a new instance can be created now.
+func (s *ReconcileScheduler) AllowCreate() bool {
+	return s == nil || s.createLimiter == nil || s.createLimiter.TryAccept()
+}
+
+// deploymentExists returns whether the deployment of instance exists, errors are treated as existing so that
+// creation is never limited by mistake.
+func (r *CodeServerReconciler) deploymentExists(codeServer *csv1alpha1.CodeServer) bool {
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: codeServer.Name, Namespace: codeServer.Namespace},
+		&appsv1.Deployment{})
+	return err == nil || !errors.IsNotFound(err)
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// ProbeBreakerThreshold is the number of consecutive failed probes against an endpoint host which opens its
+	// circuit, instances behind an open circuit are not probed until cool down passes.
+	ProbeBreakerThreshold = 5
+	// ProbeBreakerCooldown is the number of probe intervals an open circuit stays open
+	ProbeBreakerCooldown = 3
+	// ProbeMaxBackoff is the maximum number of probe intervals an instance which failed probes is skipped
+	ProbeMaxBackoff = 4
+)
+
+// probeBreaker tracks consecutive failures of an endpoint host.
+type probeBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// probeResult is the outcome of probing an instance.
+type probeResult struct {
+	css        *CodeServerActiveStatus
+	valid      bool
+	lastActive *time.Time
+}
+
+// ProbePool probes instances concurrently with a fixed number of workers, limits concurrent probes against the same
+// endpoint host and stops probing hosts which keep failing for a while, so that slow or broken instances can't delay
+// the whole probe round.
+type ProbePool struct {
+	Options   *CodeServerOption
+	lock      sync.Mutex
+	breakers  map[string]*probeBreaker
+	transport *http.Transport
+}
+
+func NewProbePool(options *CodeServerOption) *ProbePool {
+	return &ProbePool{
+		Options:   options,
+		breakers:  map[string]*probeBreaker{},
+		transport: newProbeTransport(options),
+	}
+}
+
+// probeHost returns the host instance is probed on, instances without probe endpoint are grouped by themselves.
+func probeHost(css *CodeServerActiveStatus) string {
+	if endpoint, err := url.Parse(css.ProbeEndpoint); err == nil && len(endpoint.Host) != 0 {
+		return endpoint.Host
+	}
+	return css.NamespacedName.String()
+}
+
+// Probe probes instances and returns the results of instances probed in order, instances backing off from failures
+// or behind an open circuit are skipped this round.
+func (p *ProbePool) Probe(statuses []*CodeServerActiveStatus,
+	probe func(css *CodeServerActiveStatus) (bool, *time.Time)) []probeResult {
+	workers := p.Options.Load().ProbeWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	// probes are spread over the first tenth of probe interval
+	jitter := time.Duration(p.Options.Load().ProbeInterval) * time.Second / 10
+	now := time.Now()
+	p.prune(statuses)
+	results := make([]*probeResult, len(statuses))
+	semaphore := make(chan struct{}, workers)
+	hosts := map[string]chan struct{}{}
+	wg := sync.WaitGroup{}
+	for i, css := range statuses {
+		host := probeHost(css)
+		if css.NextProbeAt.After(now) || !p.allow(host, now) {
+			continue
+		}
+		if _, found := hosts[host]; !found && p.Options.Load().ProbeHostConcurrency > 0 {
+			hosts[host] = make(chan struct{}, p.Options.Load().ProbeHostConcurrency)
+		}
+		hostSemaphore := hosts[host]
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(i int, css *CodeServerActiveStatus, host string) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			if jitter > 0 {
+				time.Sleep(time.Duration(rand.Int63n(int64(jitter))))
+			}
+			if hostSemaphore != nil {
+				hostSemaphore <- struct{}{}
+				defer func() {
+					<-hostSemaphore
+				}()
+			}
+			valid, lastActive := probe(css)
+			p.record(host, valid)
+			results[i] = &probeResult{css: css, valid: valid, lastActive: lastActive}
+		}(i, css, host)
+	}
+	wg.Wait()
+	var probed []probeResult
+	for _, result := range results {
+		if result != nil {
+			probed = append(probed, *result)
+		}
+	}
+	return probed
+}
+
+// backoff returns when instance which failed probes for failures times is probed next time, the number of probe
+// intervals skipped doubles with every failure.
+func (p *ProbePool) backoff(failures int) time.Time {
+	intervals := 1
+	for i := 1; i < failures && intervals < ProbeMaxBackoff; i++ {
+		intervals *= 2
+	}
+	if intervals > ProbeMaxBackoff {
+		intervals = ProbeMaxBackoff
+	}
+	return time.Now().Add(time.Duration(intervals*p.Options.Load().ProbeInterval) * time.Second)
+}
+
+// prune forgets circuits of hosts no longer probed.
+func (p *ProbePool) prune(statuses []*CodeServerActiveStatus) {
+	hosts := map[string]bool{}
+	for _, css := range statuses {
+		hosts[probeHost(css)] = true
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for host := range p.breakers {
+		if !hosts[host] {
+			delete(p.breakers, host)
+		}
+	}
+}
+
+// allow returns false if circuit of host is open.
+func (p *ProbePool) allow(host string, now time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	breaker, found := p.breakers[host]
+	return !found || !breaker.openUntil.After(now)
+}
+
+// record updates circuit of host with the outcome of probe.
+func (p *ProbePool) record(host string, succeeded bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if succeeded {
+		delete(p.breakers, host)
+		return
+	}
+	breaker, found := p.breakers[host]
+	if !found {
+		breaker = &probeBreaker{}
+		p.breakers[host] = breaker
+	}
+	breaker.failures++
+	if breaker.failures >= ProbeBreakerThreshold {
+		breaker.openUntil = time.Now().Add(
+			time.Duration(ProbeBreakerCooldown*p.Options.Load().ProbeInterval) * time.Second)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// ProbePeriodSeconds is the period of the probes generated for vs code pod.
+	ProbePeriodSeconds = 10
+	// LivenessInitialDelaySeconds gives IDE time to start before it's restarted by liveness probe.
+	LivenessInitialDelaySeconds = 60
+	// LivenessFailureThreshold is the number of consecutive failures before IDE is restarted.
+	LivenessFailureThreshold = 6
+)
+
+// ideProbeHandler probes the health endpoint of IDE flavor under the base path IDE serves under.
+func ideProbeHandler(m *csv1alpha1.CodeServer) corev1.ProbeHandler {
+	return corev1.ProbeHandler{
+		HTTPGet: &corev1.HTTPGetAction{
+			Path: ideBasePath(m) + "/" + strings.TrimLeft(connectProbe(m), "/"),
+			Port: intstr.FromInt(HttpPort),
+		},
+	}
+}
+
+// overriddenProbe returns the probe specified by instance, http probes always target the IDE port.
+func overriddenProbe(probe *corev1.Probe) *corev1.Probe {
+	probe = probe.DeepCopy()
+	if probe.HTTPGet != nil {
+		probe.HTTPGet.Port = intstr.FromInt(HttpPort)
+	}
+	return probe
+}
+
+// addProbesForPod generates the readiness and liveness probes for IDE and status exporter, so that broken
+// instances are restarted and removed from endpoints by kubelet, the probes specified by instance take precedence.
+func addProbesForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	for index := range podSpec.Containers {
+		container := &podSpec.Containers[index]
+		switch container.Name {
+		case CSNAME:
+			if m.Spec.ReadinessProbe != nil {
+				container.ReadinessProbe = overriddenProbe(m.Spec.ReadinessProbe)
+			} else {
+				container.ReadinessProbe = &corev1.Probe{
+					ProbeHandler:  ideProbeHandler(m),
+					PeriodSeconds: ProbePeriodSeconds,
+				}
+			}
+			if m.Spec.LivenessProbe != nil {
+				container.LivenessProbe = overriddenProbe(m.Spec.LivenessProbe)
+			} else {
+				container.LivenessProbe = &corev1.Probe{
+					ProbeHandler:        ideProbeHandler(m),
+					InitialDelaySeconds: LivenessInitialDelaySeconds,
+					PeriodSeconds:       ProbePeriodSeconds,
+					FailureThreshold:    LivenessFailureThreshold,
+				}
+			}
+		case ExporterContainer:
+			handler := corev1.ProbeHandler{
+				TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(ExporterPort)},
+			}
+			container.ReadinessProbe = &corev1.Probe{ProbeHandler: handler, PeriodSeconds: ProbePeriodSeconds}
+			container.LivenessProbe = &corev1.Probe{
+				ProbeHandler:        handler,
+				InitialDelaySeconds: LivenessInitialDelaySeconds,
+				PeriodSeconds:       ProbePeriodSeconds,
+				FailureThreshold:    LivenessFailureThreshold,
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	StageVolumeBound = "VolumeBound"
+	StageScheduled   = "Scheduled"
+	StageStarted     = "Started"
+	StageReady       = "Ready"
+	// ProgressPollInterval is the interval progress stream checks status of instance
+	ProgressPollInterval = 2 * time.Second
+)
+
+// latestPod returns the newest pod of instance which is not being deleted, nil if none.
+func (r *CodeServerReconciler) latestPod(codeServer *csv1alpha1.CodeServer) (*corev1.Pod, error) {
+	pods := &corev1.PodList{}
+	if err := r.Client.List(context.TODO(), pods, client.InNamespace(codeServer.Namespace),
+		client.MatchingLabels(appLabel(codeServer.Name))); err != nil {
+		return nil, err
+	}
+	var pod *corev1.Pod
+	for i := range pods.Items {
+		if pods.Items[i].DeletionTimestamp != nil {
+			continue
+		}
+		if pod == nil || pod.CreationTimestamp.Before(&pods.Items[i].CreationTimestamp) {
+			pod = &pods.Items[i]
+		}
+	}
+	return pod, nil
+}
+
+// provisioningProgress summarizes the volume, pod, startup step and ready conditions into stages.
+func provisioningProgress(codeServer *csv1alpha1.CodeServer, pod *corev1.Pod, volumeBound bool) *csv1alpha1.ProgressStatus {
+	var stages []csv1alpha1.ProgressStage
+	if volumeBound {
+		stages = append(stages, csv1alpha1.ProgressStage{Name: StageVolumeBound, Phase: csv1alpha1.StageDone})
+	} else {
+		stages = append(stages, csv1alpha1.ProgressStage{Name: StageVolumeBound, Phase: csv1alpha1.StageRunning,
+			Message: "waiting volume to be bound"})
+	}
+	stages = append(stages, scheduledStage(pod))
+	for _, step := range startupSteps {
+		condition := GetCondition(codeServer.Status, step)
+		if condition == nil {
+			continue
+		}
+		stage := csv1alpha1.ProgressStage{Name: strings.TrimPrefix(string(step), "Server"), Phase: csv1alpha1.StageDone}
+		if condition.Status != corev1.ConditionTrue {
+			stage.Phase = csv1alpha1.StageRunning
+			stage.Message = condition.Reason
+			if detail, found := condition.Message["detail"]; found {
+				stage.Message = fmt.Sprintf("%s: %s", condition.Reason, detail)
+			}
+			switch condition.Reason {
+			case "failed":
+				stage.Phase = csv1alpha1.StageFailed
+			case "waiting", "waiting pod to be scheduled":
+				stage.Phase = csv1alpha1.StagePending
+			}
+		}
+		stages = append(stages, stage)
+	}
+	stages = append(stages, startedStage(pod))
+	ready := csv1alpha1.ProgressStage{Name: StageReady, Phase: csv1alpha1.StagePending}
+	if condition := GetCondition(codeServer.Status, csv1alpha1.ServerReady); condition != nil {
+		if condition.Status == corev1.ConditionTrue {
+			ready.Phase = csv1alpha1.StageDone
+		} else {
+			ready.Message = condition.Reason
+		}
+	}
+	stages = append(stages, ready)
+	progress := &csv1alpha1.ProgressStatus{Stages: stages}
+	done := 0
+	for _, stage := range stages {
+		if stage.Phase == csv1alpha1.StageDone {
+			done++
+		} else if len(progress.Stage) == 0 {
+			progress.Stage = stage.Name
+		}
+	}
+	progress.Percent = int32(done * 100 / len(stages))
+	return progress
+}
+
+func scheduledStage(pod *corev1.Pod) csv1alpha1.ProgressStage {
+	stage := csv1alpha1.ProgressStage{Name: StageScheduled, Phase: csv1alpha1.StagePending}
+	if pod == nil {
+		return stage
+	}
+	stage.Phase = csv1alpha1.StageRunning
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type != corev1.PodScheduled {
+			continue
+		}
+		if condition.Status == corev1.ConditionTrue {
+			stage.Phase = csv1alpha1.StageDone
+		} else {
+			stage.Message = condition.Message
+		}
+	}
+	return stage
+}
+
+// startedStage reports whether image of code server container has been pulled and container started.
+func startedStage(pod *corev1.Pod) csv1alpha1.ProgressStage {
+	stage := csv1alpha1.ProgressStage{Name: StageStarted, Phase: csv1alpha1.StagePending}
+	if pod == nil {
+		return stage
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != CSNAME {
+			continue
+		}
+		switch {
+		case status.State.Running != nil:
+			stage.Phase = csv1alpha1.StageDone
+		case status.State.Waiting != nil && (status.State.Waiting.Reason == "ErrImagePull" ||
+			status.State.Waiting.Reason == "ImagePullBackOff" || status.State.Waiting.Reason == "CrashLoopBackOff"):
+			stage.Phase = csv1alpha1.StageFailed
+			stage.Message = fmt.Sprintf("%s: %s", status.State.Waiting.Reason, status.State.Waiting.Message)
+		case status.State.Waiting != nil && status.State.Waiting.Reason == "ContainerCreating":
+			stage.Phase = csv1alpha1.StageRunning
+			stage.Message = "pulling image and creating container"
+		}
+	}
+	return stage
+}
+
+// streamProgress sends progress of code server as server sent events whenever it changes, until the instance
+// becomes ready, errored or recycled.
+func (s *CodeServerAPIServer) streamProgress(w http.ResponseWriter, req *http.Request, namespace, name string,
+	token *APIToken) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusNotImplemented, "streaming is not supported")
+		return
+	}
+	key := types.NamespacedName{Name: name, Namespace: namespace}
+	codeServer, ok := s.getOwnedCodeServer(w, namespace, name, token)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	ticker := time.NewTicker(ProgressPollInterval)
+	defer ticker.Stop()
+	last := ""
+	for {
+		phase := CodeServerPhase(codeServer)
+		content, _ := json.Marshal(map[string]interface{}{"phase": phase, "progress": codeServer.Status.Progress})
+		if string(content) != last {
+			last = string(content)
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", content)
+			flusher.Flush()
+		}
+		if phase == PhaseReady || phase == PhaseErrored || phase == PhaseRecycled {
+			return
+		}
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.Client.Get(context.TODO(), key, codeServer); err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+			flusher.Flush()
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// ExtensionsContainer installs extensions of instance before code server starts
+	ExtensionsContainer = "install-extensions"
+	VSCodeShareDir      = "/home/coder/.local/share/code-server"
+	VSCodeShareVolume   = "code-server-share-dir"
+)
+
+// startupSteps are the conditions instance must satisfy before ready, in the order of execution
+var startupSteps = []csv1alpha1.ServerConditionType{
+	csv1alpha1.ServerInitialized,
+	csv1alpha1.ServerExtensionsInstalled,
+	csv1alpha1.ServerBootstrapped,
+}
+
+// addExtensionsForPod installs the extensions with the image of instance into the share dir of code server.
+func addExtensionsForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	if len(m.Spec.Extensions) == 0 {
+		return
+	}
+	command := []string{"code-server", "--extensions-dir", VSCodeShareDir + "/extensions"}
+	for _, extension := range m.Spec.Extensions {
+		command = append(command, "--install-extension", extension)
+	}
+	podSpec.InitContainers = append(podSpec.InitContainers, corev1.Container{
+		Name:            ExtensionsContainer,
+		Image:           m.Spec.Image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         command,
+		Env:             m.Spec.Envs,
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				MountPath: VSCodeShareDir,
+				Name:      VSCodeShareVolume,
+			},
+		},
+	})
+}
+
+// stepOfContainer returns the startup step init container belongs to.
+func stepOfContainer(name string) csv1alpha1.ServerConditionType {
+	switch name {
+	case ExtensionsContainer:
+		return csv1alpha1.ServerExtensionsInstalled
+	case GitpodInitContainer:
+		return csv1alpha1.ServerBootstrapped
+	}
+	return csv1alpha1.ServerInitialized
+}
+
+// reconcileStartupSteps reflects the init containers of the latest instance pod in the step conditions, steps
+// absent in the pod are removed. It returns whether conditions changed and the first unfinished step.
+func reconcileStartupSteps(codeServer *csv1alpha1.CodeServer, pod *corev1.Pod) (bool, *csv1alpha1.ServerCondition) {
+	conditions := map[csv1alpha1.ServerConditionType]csv1alpha1.ServerCondition{
+		csv1alpha1.ServerInitialized: NewStateCondition(csv1alpha1.ServerInitialized,
+			"waiting pod to be scheduled", map[string]string{}, corev1.ConditionFalse),
+	}
+	if pod != nil {
+		conditions[csv1alpha1.ServerInitialized] = NewStateCondition(csv1alpha1.ServerInitialized,
+			"init containers finished", map[string]string{}, corev1.ConditionTrue)
+		statuses := map[string]corev1.ContainerStatus{}
+		for _, status := range pod.Status.InitContainerStatuses {
+			statuses[status.Name] = status
+		}
+		for _, container := range pod.Spec.InitContainers {
+			step := stepOfContainer(container.Name)
+			condition, found := conditions[step]
+			if !found {
+				condition = NewStateCondition(step, "step finished", map[string]string{}, corev1.ConditionTrue)
+			}
+			// the first unfinished container of step is reported
+			if condition.Status == corev1.ConditionTrue {
+				if reason, message, finished := initContainerState(statuses[container.Name]); !finished {
+					condition = NewStateCondition(step, reason, message, corev1.ConditionFalse)
+					condition.Message["container"] = container.Name
+				}
+			}
+			conditions[step] = condition
+		}
+	}
+	changed := false
+	var pending *csv1alpha1.ServerCondition
+	for _, step := range startupSteps {
+		condition, found := conditions[step]
+		if !found {
+			changed = removeCondition(&codeServer.Status, step) || changed
+			continue
+		}
+		changed = SetCondition(&codeServer.Status, condition) || changed
+		if pending == nil && condition.Status != corev1.ConditionTrue {
+			pending = &condition
+		}
+	}
+	return changed, pending
+}
+
+// initContainerState describes the state of init container, it returns whether container exited successfully.
+func initContainerState(status corev1.ContainerStatus) (string, map[string]string, bool) {
+	switch {
+	case status.State.Terminated != nil && status.State.Terminated.ExitCode == 0:
+		return "", nil, true
+	case status.State.Terminated != nil:
+		return "failed", map[string]string{"detail": fmt.Sprintf("exit code %d: %s",
+			status.State.Terminated.ExitCode, strings.TrimSpace(status.State.Terminated.Message))}, false
+	case status.LastTerminationState.Terminated != nil:
+		return "retrying", map[string]string{"detail": fmt.Sprintf("last exit code %d",
+			status.LastTerminationState.Terminated.ExitCode)}, false
+	case status.State.Running != nil:
+		return "running", map[string]string{}, false
+	}
+	if status.State.Waiting != nil && len(status.State.Waiting.Reason) != 0 {
+		return "waiting", map[string]string{"detail": status.State.Waiting.Reason}, false
+	}
+	return "waiting", map[string]string{}, false
+}
+
+// isStartupStep checks whether condition is one of the startup steps, which are kept once ready.
+func isStartupStep(conditionType csv1alpha1.ServerConditionType) bool {
+	for _, step := range startupSteps {
+		if step == conditionType {
+			return true
+		}
+	}
+	return false
+}
+
+func removeCondition(status *csv1alpha1.CodeServerStatus, conditionType csv1alpha1.ServerConditionType) bool {
+	var conditions []csv1alpha1.ServerCondition
+	for _, condition := range status.Conditions {
+		if condition.Type != conditionType {
+			conditions = append(conditions, condition)
+		}
+	}
+	if len(conditions) == len(status.Conditions) {
+		return false
+	}
+	status.Conditions = conditions
+	return true
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"path"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	SessionRecorderContainer = "session-recorder"
+	SessionRecorderInit      = "session-recorder-init"
+	// SessionSpoolVolume holds the sessions being recorded, it's the only recording volume workspace can write
+	SessionSpoolVolume = "session-spool"
+	SessionSpoolDir    = "/var/log/code-server-sessions"
+	// SessionRecordingsVolume holds the finished sessions, it's only mounted in the sidecar
+	SessionRecordingsVolume = "session-recordings"
+	SessionRecordingsDir    = "/var/lib/session-recordings"
+	SessionShellVolume      = "session-shell"
+	SessionShellDir         = "/opt/session-recorder"
+	SessionShell            = "shell"
+	SessionCollectInterval  = 5
+	SessionUploadInterval   = 60
+)
+
+// sessionShellScript records the terminal session with script of util-linux, terminals are refused rather than
+// left unrecorded if script is unavailable.
+const sessionShellScript = `#!/bin/sh
+if ! command -v script >/dev/null 2>&1; then
+  echo "terminal session recording requires script of util-linux" >&2
+  exit 1
+fi
+name=%s/$(hostname)-$(date +%%Y%%m%%d-%%H%%M%%S)-$$
+script -q -f --timing="$name.timing" "$name.log" -c "$RECORDED_SHELL $*"
+status=$?
+touch "$name.done"
+exit $status
+`
+
+// sessionUploadScript moves finished sessions out of the spool shared with workspace into the volume only sidecar
+// mounts, copies them to object store periodically and prunes the expired ones. Sessions still being recorded are
+// moved and copied before the pod stops.
+const sessionUploadScript = `remote="$SESSION_STORE/$NAMESPACE/$INSTANCE"
+collect() {
+  for marker in %[1]s/*.done; do
+    [ -e "$marker" ] || continue
+    name="${marker%%.done}"
+    mv "$name.log" "$name.timing" %[2]s/ 2>/dev/null
+    rm -f "$marker"
+  done
+}
+trap 'collect; mv %[1]s/*.log %[1]s/*.timing %[2]s/ 2>/dev/null; rclone copy %[2]s "$remote"; exit 0' TERM
+elapsed=%[4]d
+while true; do
+  collect
+  if [ "$elapsed" -ge %[4]d ]; then
+    rclone copy %[2]s "$remote"
+    rclone delete --min-age %[5]dd "$remote"
+    elapsed=0
+  fi
+  sleep %[3]d & wait $!
+  elapsed=$((elapsed + %[3]d))
+done
+`
+
+// sessionRecordingEnabled returns whether terminal sessions of instance are recorded, recording is enforced by
+// operator for all instances with --record-sessions, instances may only opt in.
+func sessionRecordingEnabled(options *CodeServerOption, m *csv1alpha1.CodeServer) bool {
+	if !strings.EqualFold(string(m.Spec.Runtime), string(csv1alpha1.RuntimeCode)) {
+		return false
+	}
+	return options.Load().RecordSessions || (m.Spec.Audit != nil && m.Spec.Audit.RecordSessions)
+}
+
+func (r *CodeServerReconciler) validateSessionRecording(m *csv1alpha1.CodeServer) error {
+	if sessionRecordingEnabled(r.Options, m) && len(r.Options.Load().SessionStoreURL) == 0 {
+		return errors.New("terminal session recording requires session store of operator")
+	}
+	return nil
+}
+
+// addSessionRecorderForPod wraps the shell of code server container with the session recorder, sessions are
+// written into a spool shared with the sidecar, which moves finished ones into its own volume and uploads them.
+func (r *CodeServerReconciler) addSessionRecorderForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	if !sessionRecordingEnabled(r.Options, m) {
+		return
+	}
+	shell := path.Join(SessionShellDir, SessionShell)
+	spoolMount := corev1.VolumeMount{Name: SessionSpoolVolume, MountPath: SessionSpoolDir}
+	podSpec.InitContainers = append(podSpec.InitContainers, corev1.Container{
+		Name:            SessionRecorderInit,
+		Image:           r.Options.Load().SessionRecorderImage,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		// spool can't be listed by workspace, so that other sessions are not looked up for tampering
+		Command: []string{"sh", "-c", fmt.Sprintf("cat > %s <<'EOF'\n%sEOF\nchmod 755 %s && chmod 1733 %s",
+			shell, fmt.Sprintf(sessionShellScript, SessionSpoolDir), shell, SessionSpoolDir)},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: SessionShellVolume, MountPath: SessionShellDir},
+			spoolMount,
+		},
+	})
+	for index := range podSpec.Containers {
+		container := &podSpec.Containers[index]
+		if container.Name != CSNAME {
+			continue
+		}
+		userShell := "/bin/bash"
+		var envs []corev1.EnvVar
+		for _, env := range container.Env {
+			if env.Name == "SHELL" {
+				userShell = env.Value
+				continue
+			}
+			envs = append(envs, env)
+		}
+		container.Env = append(envs,
+			corev1.EnvVar{Name: "SHELL", Value: shell},
+			corev1.EnvVar{Name: "RECORDED_SHELL", Value: userShell})
+		container.VolumeMounts = append(container.VolumeMounts,
+			corev1.VolumeMount{Name: SessionShellVolume, MountPath: SessionShellDir, ReadOnly: true},
+			spoolMount)
+	}
+	recorder := corev1.Container{
+		Name:            SessionRecorderContainer,
+		Image:           r.Options.Load().SessionRecorderImage,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command: []string{"sh", "-c", fmt.Sprintf(sessionUploadScript, SessionSpoolDir, SessionRecordingsDir,
+			SessionCollectInterval, SessionUploadInterval, r.Options.Load().SessionRetentionDays)},
+		Env: []corev1.EnvVar{
+			{Name: "SESSION_STORE", Value: r.Options.Load().SessionStoreURL},
+			{Name: "NAMESPACE", Value: m.Namespace},
+			{Name: "INSTANCE", Value: m.Name},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			spoolMount,
+			{Name: SessionRecordingsVolume, MountPath: SessionRecordingsDir},
+		},
+	}
+	if len(r.Options.Load().SessionStoreSecret) != 0 {
+		recorder.EnvFrom = []corev1.EnvFromSource{
+			{SecretRef: &corev1.SecretEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: r.Options.Load().SessionStoreSecret},
+			}},
+		}
+	}
+	podSpec.Containers = append(podSpec.Containers, recorder)
+	podSpec.Volumes = append(podSpec.Volumes,
+		corev1.Volume{Name: SessionShellVolume, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		corev1.Volume{Name: SessionSpoolVolume, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		corev1.Volume{Name: SessionRecordingsVolume, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}})
+}
@@ -31,6 +31,7 @@ type CodeServerRecycleStatus struct {
 	Duration         int64
 	LastInactiveTime metav1.Time
 	NamespacedName   types.NamespacedName
+	Warned           bool
 }
 
 func (c *CodeServerRecycleCache) AddOrUpdate(req CodeServerRequest) {
@@ -64,6 +65,15 @@ func (c *CodeServerRecycleCache) DeleteFromName(req types.NamespacedName) {
 	}
 }
 
+func (c *CodeServerRecycleCache) MarkWarned(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if obj, found := c.Caches[key]; found {
+		obj.Warned = true
+		c.Caches[key] = obj
+	}
+}
+
 func (c *CodeServerRecycleCache) Get(key string) *CodeServerRecycleStatus {
 	c.RLock()
 	defer c.RUnlock()
@@ -0,0 +1,95 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// ReplicatedFromLabel marks the secrets replicated by operator, the value is the source namespace
+const ReplicatedFromLabel = "codeserver.io/replicated-from"
+
+// addPullSecretsForPod attaches the pull secrets of instance and the default one of operator.
+func (r *CodeServerReconciler) addPullSecretsForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	existing := map[string]bool{}
+	for _, secret := range podSpec.ImagePullSecrets {
+		existing[secret.Name] = true
+	}
+	secrets := m.Spec.ImagePullSecrets
+	if len(r.Options.Load().ImagePullSecret) != 0 {
+		secrets = append(secrets, corev1.LocalObjectReference{Name: r.Options.Load().ImagePullSecret})
+	}
+	for _, secret := range secrets {
+		if !existing[secret.Name] {
+			existing[secret.Name] = true
+			podSpec.ImagePullSecrets = append(podSpec.ImagePullSecrets, secret)
+		}
+	}
+}
+
+// reconcileForPullSecret replicates the default pull secret into namespace of instance if enabled, the replica
+// is shared by instances in the namespace and kept in sync with the source.
+func (r *CodeServerReconciler) reconcileForPullSecret(codeServer *csv1alpha1.CodeServer) error {
+	if len(r.Options.Load().ImagePullSecret) == 0 || len(r.Options.Load().PullSecretNamespace) == 0 ||
+		r.Options.Load().PullSecretNamespace == codeServer.Namespace {
+		return nil
+	}
+	reqLogger := r.instanceLog(codeServer)
+	source := &corev1.Secret{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: r.Options.Load().ImagePullSecret,
+		Namespace: r.Options.Load().PullSecretNamespace}, source)
+	if err != nil {
+		return fmt.Errorf("failed to get pull secret %s/%s: %v", r.Options.Load().PullSecretNamespace,
+			r.Options.Load().ImagePullSecret, err)
+	}
+	replica := &corev1.Secret{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: source.Name, Namespace: codeServer.Namespace}, replica)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		replica = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      source.Name,
+				Namespace: codeServer.Namespace,
+				Labels:    map[string]string{ReplicatedFromLabel: source.Namespace},
+			},
+			Type: source.Type,
+			Data: source.Data,
+		}
+		reqLogger.Info(fmt.Sprintf("replicating pull secret %s from namespace %s", source.Name, source.Namespace))
+		return r.Client.Create(context.TODO(), replica)
+	}
+	// secrets created by others are left untouched
+	if replica.Labels[ReplicatedFromLabel] != source.Namespace {
+		return nil
+	}
+	if equality.Semantic.DeepEqual(replica.Data, source.Data) {
+		return nil
+	}
+	reqLogger.Info(fmt.Sprintf("updating pull secret %s replicated from namespace %s", source.Name, source.Namespace))
+	replica.Data = source.Data
+	return r.Client.Update(context.TODO(), replica)
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"sort"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// RecommendMinSamples is the count of samples required before recommending.
+	RecommendMinSamples = 30
+	// RecommendMaxSamples is the count of latest samples kept for every instance.
+	RecommendMaxSamples = 4320
+	// RecommendCPUPercentile is the percentile of cpu usage recommended, memory is recommended with the peak
+	// usage since memory is incompressible.
+	RecommendCPUPercentile = 0.9
+	// RecommendMarginPercent is the safety margin added on recommendations.
+	RecommendMarginPercent = 15
+	MinRecommendedMilliCPU = 100
+	MinRecommendedMemory   = 128 * 1024 * 1024
+)
+
+// usageHistory holds the latest cpu (in millicores) and memory (in bytes) samples of instance.
+type usageHistory struct {
+	cpu    []int64
+	memory []int64
+}
+
+func (h *usageHistory) add(cpu, memory int64) {
+	h.cpu = append(h.cpu, cpu)
+	h.memory = append(h.memory, memory)
+	if len(h.cpu) > RecommendMaxSamples {
+		h.cpu = h.cpu[len(h.cpu)-RecommendMaxSamples:]
+		h.memory = h.memory[len(h.memory)-RecommendMaxSamples:]
+	}
+}
+
+// Recommend records the usage sample of instance and returns recommendations once enough samples collected.
+func (u *UsageCollector) Recommend(key string, usage *csv1alpha1.UsageStatus) *csv1alpha1.RightSizingStatus {
+	if usage.CPU == nil || usage.Memory == nil {
+		return nil
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	history, found := u.history[key]
+	if !found {
+		history = &usageHistory{}
+		u.history[key] = history
+	}
+	history.add(usage.CPU.MilliValue(), usage.Memory.Value())
+	if len(history.cpu) < RecommendMinSamples {
+		return nil
+	}
+	cpu := make([]int64, len(history.cpu))
+	copy(cpu, history.cpu)
+	sort.Slice(cpu, func(i, j int) bool { return cpu[i] < cpu[j] })
+	percentileCPU := cpu[int(float64(len(cpu)-1)*RecommendCPUPercentile)]
+	var peakMemory int64
+	for _, memory := range history.memory {
+		if memory > peakMemory {
+			peakMemory = memory
+		}
+	}
+	withMargin := func(value, minimum int64) int64 {
+		value = value * (100 + RecommendMarginPercent) / 100
+		if value < minimum {
+			return minimum
+		}
+		return value
+	}
+	return &csv1alpha1.RightSizingStatus{
+		RecommendedCPU:    resource.NewMilliQuantity(withMargin(percentileCPU, MinRecommendedMilliCPU), resource.DecimalSI),
+		RecommendedMemory: resource.NewQuantity(withMargin(peakMemory, MinRecommendedMemory), resource.BinarySI),
+		Samples:           int32(len(history.cpu)),
+	}
+}
+
+// Forget drops the usage history of instance.
+func (u *UsageCollector) Forget(key string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.history, key)
+}
+
+func autoResizeEnabled(m *csv1alpha1.CodeServer) bool {
+	return m.Spec.RightSizing != nil && m.Spec.RightSizing.AutoResize
+}
+
+// reconcileForRightSizing takes the recommendations as the resources applied when instance is about to be started,
+// it returns true if status changed.
+func (r *CodeServerReconciler) reconcileForRightSizing(codeServer *csv1alpha1.CodeServer) (bool, error) {
+	rightSizing := codeServer.Status.RightSizing
+	if !autoResizeEnabled(codeServer) || rightSizing == nil || rightSizing.RecommendedCPU == nil ||
+		rightSizing.RecommendedMemory == nil {
+		return false, nil
+	}
+	if rightSizing.AppliedCPU != nil && rightSizing.AppliedCPU.Equal(*rightSizing.RecommendedCPU) &&
+		rightSizing.AppliedMemory != nil && rightSizing.AppliedMemory.Equal(*rightSizing.RecommendedMemory) {
+		return false, nil
+	}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: codeServer.Name, Namespace: codeServer.Namespace},
+		&appsv1.Deployment{})
+	if err == nil {
+		// running instance is resized next time it starts
+		return false, nil
+	}
+	if !errors.IsNotFound(err) {
+		return false, err
+	}
+	cpu, memory := rightSizing.RecommendedCPU.DeepCopy(), rightSizing.RecommendedMemory.DeepCopy()
+	rightSizing.AppliedCPU, rightSizing.AppliedMemory = &cpu, &memory
+	r.instanceLog(codeServer).Info(
+		"applying resource recommendations", "cpu", cpu.String(), "memory", memory.String())
+	return true, nil
+}
+
+// addRightSizingForPod replaces cpu and memory requests of code server container with the applied
+// recommendations, requests never exceed limits.
+func addRightSizingForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	if !autoResizeEnabled(m) || m.Status.RightSizing == nil {
+		return
+	}
+	applied := map[corev1.ResourceName]*resource.Quantity{
+		corev1.ResourceCPU:    m.Status.RightSizing.AppliedCPU,
+		corev1.ResourceMemory: m.Status.RightSizing.AppliedMemory,
+	}
+	for index := range podSpec.Containers {
+		container := &podSpec.Containers[index]
+		if container.Name != CSNAME {
+			continue
+		}
+		requests := corev1.ResourceList{}
+		for name, value := range container.Resources.Requests {
+			requests[name] = value
+		}
+		for name, value := range applied {
+			if value == nil {
+				continue
+			}
+			request := value.DeepCopy()
+			if limit, ok := container.Resources.Limits[name]; ok && request.Cmp(limit) > 0 {
+				request = limit.DeepCopy()
+			}
+			requests[name] = request
+		}
+		container.Resources.Requests = requests
+	}
+}
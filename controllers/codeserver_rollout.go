@@ -0,0 +1,150 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// RolloutAnnotation records the image rolled out by operator
+const RolloutAnnotation = "codeserver.io/rollout-image"
+
+// CodeServerRollout rolls out operator wide code server image to existing instances
+type CodeServerRollout struct {
+	client.Client
+	Log     logr.Logger
+	Options *CodeServerOption
+}
+
+func NewCodeServerRollout(client client.Client, log logr.Logger, options *CodeServerOption) *CodeServerRollout {
+	return &CodeServerRollout{
+		client,
+		log,
+		options,
+	}
+}
+
+func (r *CodeServerRollout) Run(stopCh <-chan struct{}) {
+	interval := r.Options.Load().RolloutInterval
+	if interval <= 0 {
+		interval = 60
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.RolloutBatch()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// RolloutBatch updates the image of inactive instances directly and at most maxUnavailable running instances
+// with Rolling policy, idle instances are updated first.
+func (r *CodeServerRollout) RolloutBatch() {
+	reqLogger := r.Log.WithValues("image", r.Options.Load().RolloutImage)
+	codeServers, err := listCodeServers(r.Client, UnrecycledPhases)
+	if err != nil {
+		reqLogger.Error(err, "Failed to list code servers for rollout.")
+		return
+	}
+	var candidates []*csv1alpha1.CodeServer
+	unavailable := 0
+	for i := range codeServers {
+		codeServer := &codeServers[i]
+		if !InShard(r.Options, codeServer) {
+			continue
+		}
+		if !strings.EqualFold(string(codeServer.Spec.Runtime), string(csv1alpha1.RuntimeCode)) {
+			continue
+		}
+		policy := codeServer.Spec.UpdatePolicy
+		if len(policy) == 0 || policy == csv1alpha1.UpdateNever || HasCondition(codeServer.Status, csv1alpha1.ServerRecycled) {
+			continue
+		}
+		if codeServer.Annotations[RolledBackAnnotation] == r.Options.Load().RolloutImage {
+			// image has been rolled back due to crash loop, don't roll it out again
+			continue
+		}
+		inactive := HasCondition(codeServer.Status, csv1alpha1.ServerInactive)
+		if codeServer.Spec.Image == r.Options.Load().RolloutImage {
+			if policy == csv1alpha1.UpdateRolling && !inactive && codeServer.Annotations[RolloutAnnotation] == r.Options.Load().RolloutImage &&
+				!HasCondition(codeServer.Status, csv1alpha1.ServerReady) {
+				unavailable++
+			}
+			continue
+		}
+		if inactive {
+			// deployment has been removed, new image will be used on next activation
+			r.updateImage(codeServer)
+		} else if policy == csv1alpha1.UpdateRolling {
+			candidates = append(candidates, codeServer)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return idleRank(candidates[i]) < idleRank(candidates[j])
+	})
+	slots := r.Options.Load().RolloutMaxUnavail - unavailable
+	if len(candidates) != 0 {
+		reqLogger.Info(fmt.Sprintf("%d instances waiting to be rolled out, %d instances unavailable", len(candidates), unavailable))
+	}
+	for _, codeServer := range candidates {
+		if slots <= 0 {
+			break
+		}
+		if r.updateImage(codeServer) {
+			slots--
+		}
+	}
+}
+
+func (r *CodeServerRollout) updateImage(codeServer *csv1alpha1.CodeServer) bool {
+	reqLogger := instanceLogger(r.Log, codeServer)
+	previous := codeServer.Spec.Image
+	codeServer.Spec.Image = r.Options.Load().RolloutImage
+	if codeServer.Annotations == nil {
+		codeServer.Annotations = map[string]string{}
+	}
+	codeServer.Annotations[RolloutAnnotation] = r.Options.Load().RolloutImage
+	if err := r.Client.Update(context.TODO(), codeServer); err != nil {
+		reqLogger.Error(err, "Failed to update code server image.")
+		return false
+	}
+	reqLogger.Info(fmt.Sprintf("code server image has been updated from %s to %s", previous, r.Options.Load().RolloutImage))
+	return true
+}
+
+// idleRank sorts unbound instances first, then instances pending recycle and finally the ones in use.
+func idleRank(codeServer *csv1alpha1.CodeServer) int {
+	if !HasCondition(codeServer.Status, csv1alpha1.ServerBound) {
+		return 0
+	}
+	if HasCondition(codeServer.Status, csv1alpha1.ServerPendingRecycle) {
+		return 1
+	}
+	return 2
+}
@@ -0,0 +1,298 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
+	"sync"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	DefaultRootlessUID = 1000
+	// WorkspaceOwnerAnnotation records the uid and gid which workspace volume has been prepared for.
+	WorkspaceOwnerAnnotation = "codeserver.io/workspace-owner"
+	OwnershipResource        = "%s-ownership"
+	OwnershipMountPath       = "/workspace"
+	OwnershipBackoffLimit    = 3
+)
+
+type userCacheEntry struct {
+	user      string
+	expiredAt time.Time
+}
+
+var imageUsers = struct {
+	sync.Mutex
+	entries map[string]userCacheEntry
+}{entries: map[string]userCacheEntry{}}
+
+func rootlessEnabled(m *csv1alpha1.CodeServer) bool {
+	return m.Spec.Rootless != nil && m.Spec.Rootless.Enabled
+}
+
+// rootlessUser returns uid and gid which instance runs as.
+func rootlessUser(m *csv1alpha1.CodeServer) (int64, int64) {
+	uid := int64(DefaultRootlessUID)
+	if m.Spec.Rootless.UID != nil {
+		uid = *m.Spec.Rootless.UID
+	}
+	gid := uid
+	if m.Spec.Rootless.GID != nil {
+		gid = *m.Spec.Rootless.GID
+	}
+	return uid, gid
+}
+
+// validateRootless checks whether image supports running as non-root user, the check will be skipped if
+// registry is unreachable or requires credentials.
+func (r *CodeServerReconciler) validateRootless(m *csv1alpha1.CodeServer) error {
+	if !rootlessEnabled(m) {
+		return nil
+	}
+	if strings.EqualFold(string(m.Spec.Runtime), string(csv1alpha1.RuntimeLxd)) {
+		return fmt.Errorf("rootless mode is unsupported for runtime %s", m.Spec.Runtime)
+	}
+	if len(m.Spec.Image) == 0 {
+		return nil
+	}
+	reqLogger := r.instanceLog(m)
+	user, err := getImageUser(mirrorImage(m.Spec.Image, r.Options.Load().RegistryMirrors))
+	if err != nil {
+		reqLogger.Info(fmt.Sprintf("skip checking user of image %s: %v", m.Spec.Image, err))
+		return nil
+	}
+	name := strings.Split(user, ":")[0]
+	if len(name) == 0 || name == "root" || name == "0" {
+		return fmt.Errorf("image %s runs as root and doesn't support rootless mode", m.Spec.Image)
+	}
+	return nil
+}
+
+func getImageUser(image string) (string, error) {
+	imageUsers.Lock()
+	entry, found := imageUsers.entries[image]
+	imageUsers.Unlock()
+	if found && time.Now().Before(entry.expiredAt) {
+		return entry.user, nil
+	}
+	registry, repository, reference := parseImageReference(image)
+	client := &registryClient{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		registry:   registry,
+		repository: repository,
+	}
+	user, err := client.user(reference)
+	if err != nil {
+		return "", err
+	}
+	imageUsers.Lock()
+	imageUsers.entries[image] = userCacheEntry{
+		user:      user,
+		expiredAt: time.Now().Add(ArchCacheSeconds * time.Second),
+	}
+	imageUsers.Unlock()
+	return user, nil
+}
+
+// user returns the default user of image, the first manifest is used if reference is a manifest list.
+func (c *registryClient) user(reference string) (string, error) {
+	accept := strings.Join([]string{MediaTypeDockerSet, MediaTypeOCIIndex, MediaTypeDockerV2, MediaTypeOCI}, ",")
+	manifest := imageManifest{}
+	if err := c.getJSON(fmt.Sprintf("manifests/%s", reference), accept, &manifest); err != nil {
+		return "", err
+	}
+	if len(manifest.Manifests) != 0 {
+		digest := manifest.Manifests[0].Digest
+		manifest = imageManifest{}
+		if err := c.getJSON(fmt.Sprintf("manifests/%s", digest), accept, &manifest); err != nil {
+			return "", err
+		}
+	}
+	if len(manifest.Config.Digest) == 0 {
+		return "", fmt.Errorf("config of image %s/%s not found", c.registry, c.repository)
+	}
+	config := struct {
+		Config struct {
+			User string `json:"User"`
+		} `json:"config"`
+	}{}
+	if err := c.getJSON(fmt.Sprintf("blobs/%s", manifest.Config.Digest), "*/*", &config); err != nil {
+		return "", err
+	}
+	return config.Config.User, nil
+}
+
+// addRootlessForPod runs instance pod as the non-root user, fields specified in pod security context are kept.
+func addRootlessForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	if !rootlessEnabled(m) {
+		return
+	}
+	uid, gid := rootlessUser(m)
+	if podSpec.SecurityContext == nil {
+		podSpec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	securityContext := podSpec.SecurityContext
+	if securityContext.RunAsUser == nil {
+		securityContext.RunAsUser = &uid
+	}
+	if securityContext.RunAsGroup == nil {
+		securityContext.RunAsGroup = &gid
+	}
+	if securityContext.FSGroup == nil {
+		securityContext.FSGroup = &gid
+	}
+	if securityContext.RunAsNonRoot == nil {
+		runAsNonRoot := true
+		securityContext.RunAsNonRoot = &runAsNonRoot
+	}
+}
+
+// reconcileForWorkspaceOwnership prepares the ownership of workspace volume for rootless instance via a job,
+// since fsGroup is not honored by all volume types. It returns true once ownership is ready.
+func (r *CodeServerReconciler) reconcileForWorkspaceOwnership(codeServer *csv1alpha1.CodeServer) (bool, error) {
+	if !rootlessEnabled(codeServer) || !r.needDeployPVC(codeServer.Spec.StorageName) {
+		return true, nil
+	}
+	reqLogger := r.instanceLog(codeServer)
+	uid, gid := rootlessUser(codeServer)
+	owner := fmt.Sprintf("%d:%d", uid, gid)
+	name := ChildName(OwnershipResource, codeServer.Name)
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: codeServer.Name, Namespace: codeServer.Namespace}, pvc)
+	if err != nil {
+		return false, err
+	}
+	if pvc.Annotations[WorkspaceOwnerAnnotation] == owner {
+		return true, r.deleteJob(name, codeServer.Namespace)
+	}
+	job := &batchv1.Job{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, job)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info(fmt.Sprintf("Creating job to prepare workspace ownership for %s.", owner))
+		newJob := r.newOwnershipJob(codeServer, owner)
+		if err = r.Client.Create(context.TODO(), newJob); err != nil {
+			return false, err
+		}
+		r.recordCreated(codeServer, newJob)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if job.Status.Succeeded > 0 {
+		if pvc.Annotations == nil {
+			pvc.Annotations = map[string]string{}
+		}
+		pvc.Annotations[WorkspaceOwnerAnnotation] = owner
+		if err := r.Client.Update(context.TODO(), pvc); err != nil {
+			return false, err
+		}
+		reqLogger.Info(fmt.Sprintf("workspace ownership has been prepared for %s", owner))
+		return true, r.deleteJob(name, codeServer.Namespace)
+	}
+	if job.Status.Failed > OwnershipBackoffLimit {
+		return false, fmt.Errorf("job %s failed to prepare workspace ownership", name)
+	}
+	return false, nil
+}
+
+func (r *CodeServerReconciler) deleteJob(name, namespace string) error {
+	job := &batchv1.Job{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, job)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	err = r.Client.Delete(context.TODO(), job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// newOwnershipJob returns the job which changes the ownership of workspace volume, it's the only step running
+// as root with capabilities limited to file ownership.
+func (r *CodeServerReconciler) newOwnershipJob(m *csv1alpha1.CodeServer, owner string) *batchv1.Job {
+	backoffLimit := int32(OwnershipBackoffLimit)
+	rootUser := int64(0)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ChildName(OwnershipResource, m.Name),
+			Namespace: m.Namespace,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyOnFailure,
+					NodeSelector:  nodeSelectorForPod(m),
+					Containers: []corev1.Container{
+						{
+							Name:    "ownership",
+							Image:   r.Options.Load().OwnershipImage,
+							Command: []string{"chown", "-R", owner, OwnershipMountPath},
+							SecurityContext: &corev1.SecurityContext{
+								RunAsUser: &rootUser,
+								Capabilities: &corev1.Capabilities{
+									Drop: []corev1.Capability{"ALL"},
+									Add:  []corev1.Capability{"CHOWN", "DAC_OVERRIDE", "FOWNER"},
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "workspace",
+									MountPath: OwnershipMountPath,
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "workspace",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: m.Name,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	pinPodToNode(&job.Spec.Template.Spec, m.Annotations[PinnedNodeAnnotation])
+	addRegistryMirrorsForPod(&job.Spec.Template.Spec, r.Options.Load().RegistryMirrors)
+	r.addCostLabels(m, job)
+	// Set CodeServer instance as the owner of the job.
+	controllerutil.SetControllerReference(m, job, r.Scheme)
+	return job
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	extv1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strconv"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// PathPrefixFormat is the path prefix of instance, namespace and name can't contain slash so that prefixes of
+	// instances with the same name in different namespaces are distinct.
+	PathPrefixFormat = "/ws/%s/%s"
+	PathPrefixRoot   = "/ws/"
+	// IngressProviderIngress routes instances with Ingress of ingress-nginx.
+	IngressProviderIngress = "ingress"
+	// IngressProviderIstio routes instances with VirtualService of istio gateway.
+	IngressProviderIstio = "istio"
+	// IngressProviderTraefik routes instances with IngressRoute and Middlewares of traefik.
+	IngressProviderTraefik = "traefik"
+	// IngressProviderNone routes no instance, they're only reachable in cluster.
+	IngressProviderNone = "none"
+)
+
+// routingMode returns the routing mode of instance, subdomain is used unless path prefix is specified.
+func routingMode(m *csv1alpha1.CodeServer) csv1alpha1.RoutingMode {
+	if m.Spec.Network != nil && m.Spec.Network.Routing == csv1alpha1.RoutingPathPrefix {
+		return csv1alpha1.RoutingPathPrefix
+	}
+	return csv1alpha1.RoutingSubdomain
+}
+
+// routeHost returns the host which instance is served on under domain.
+func routeHost(m *csv1alpha1.CodeServer, domain string) string {
+	if routingMode(m) == csv1alpha1.RoutingPathPrefix {
+		return domain
+	}
+	return fmt.Sprintf("%s.%s", m.Spec.Subdomain, domain)
+}
+
+// instanceHost returns the host which instance is served on.
+func (r *CodeServerReconciler) instanceHost(m *csv1alpha1.CodeServer) string {
+	return routeHost(m, r.Options.Load().DomainName)
+}
+
+// instancePathPrefix returns the path prefix without trailing slash, it's empty in subdomain mode.
+func instancePathPrefix(m *csv1alpha1.CodeServer) string {
+	if routingMode(m) == csv1alpha1.RoutingPathPrefix {
+		return fmt.Sprintf(PathPrefixFormat, m.Namespace, m.Name)
+	}
+	return ""
+}
+
+// instanceURL builds the url of instance with scheme and path relative to the root of instance, headless instance
+// is addressed by its service over plain http.
+func (r *CodeServerReconciler) instanceURL(m *csv1alpha1.CodeServer, scheme, relative string) string {
+	if r.ingressProvider(m) == IngressProviderNone {
+		return fmt.Sprintf("%s://%s/%s", strings.TrimSuffix(scheme, "s"), net.JoinHostPort(
+			fmt.Sprintf(ServiceHostTemplate, m.Name, m.Namespace), strconv.Itoa(HttpPort)), strings.TrimLeft(relative, "/"))
+	}
+	return fmt.Sprintf("%s://%s%s/%s", scheme, r.instanceHost(m), instancePathPrefix(m),
+		strings.TrimLeft(relative, "/"))
+}
+
+// activityHost returns the key of instance used to match ingress access logs, path prefix is appended
+// since all instances share the same host in path prefix mode.
+func (r *CodeServerReconciler) activityHost(m *csv1alpha1.CodeServer) string {
+	return r.instanceHost(m) + instancePathPrefix(m)
+}
+
+// ingressPath returns the path of ingress rule, in path prefix mode the prefix is captured so that it can be
+// stripped before requests reach the instance.
+func ingressPath(m *csv1alpha1.CodeServer) string {
+	if routingMode(m) == csv1alpha1.RoutingPathPrefix {
+		return fmt.Sprintf("%s(/|$)(.*)", instancePathPrefix(m))
+	}
+	return "/"
+}
+
+// addRoutingAnnotations adds the rewrite annotations of ingress-nginx required by path prefix mode.
+func addRoutingAnnotations(m *csv1alpha1.CodeServer, annotations map[string]string) {
+	if routingMode(m) != csv1alpha1.RoutingPathPrefix {
+		return
+	}
+	annotations["nginx.ingress.kubernetes.io/use-regex"] = "true"
+	annotations["nginx.ingress.kubernetes.io/rewrite-target"] = "/$2"
+	annotations["nginx.ingress.kubernetes.io/x-forwarded-prefix"] = instancePathPrefix(m)
+}
+
+// absProxyArguments returns the code server arguments which make absolute proxy urls honor the path prefix.
+func absProxyArguments(m *csv1alpha1.CodeServer) []string {
+	if routingMode(m) != csv1alpha1.RoutingPathPrefix {
+		return nil
+	}
+	return []string{"--abs-proxy-base-path", instancePathPrefix(m)}
+}
+
+// ingressProvider returns the provider routing the instance, the operator wide provider is used unless instance
+// is headless or mesh is switched on or off explicitly in spec.
+func (r *CodeServerReconciler) ingressProvider(m *csv1alpha1.CodeServer) string {
+	if m.Spec.Network != nil && m.Spec.Network.Headless {
+		return IngressProviderNone
+	}
+	provider := r.Options.Load().IngressProvider
+	if len(provider) == 0 {
+		provider = IngressProviderIngress
+	}
+	if m.Spec.Network != nil && m.Spec.Network.Mesh != nil {
+		if *m.Spec.Network.Mesh {
+			return IngressProviderIstio
+		}
+		if provider == IngressProviderIstio {
+			return IngressProviderIngress
+		}
+	}
+	return provider
+}
+
+// reconcileForRoute reconciles the resources of the selected provider and deletes the ones of other providers
+// in case provider has been switched.
+func (r *CodeServerReconciler) reconcileForRoute(codeServer *csv1alpha1.CodeServer) error {
+	provider := r.ingressProvider(codeServer)
+	if provider != IngressProviderIstio && len(r.Options.Load().MeshGateway) != 0 {
+		if err := r.deleteMeshResources(codeServer.Name, codeServer.Namespace); err != nil {
+			return err
+		}
+	}
+	if provider != IngressProviderTraefik && r.Options.Load().IngressProvider == IngressProviderTraefik {
+		if err := r.deleteTraefikResources(codeServer.Name, codeServer.Namespace); err != nil {
+			return err
+		}
+	}
+	if provider != IngressProviderIngress {
+		if err := r.deleteResourceIfExists(&extv1.Ingress{}, ChildName(TerminalIngress, codeServer.Name),
+			codeServer.Namespace); err != nil {
+			return err
+		}
+	}
+	switch provider {
+	case IngressProviderIngress:
+		_, err := r.reconcileForIngress(codeServer)
+		return err
+	case IngressProviderIstio:
+		return r.reconcileForMesh(codeServer)
+	case IngressProviderTraefik:
+		return r.reconcileForTraefik(codeServer)
+	case IngressProviderNone:
+		return nil
+	default:
+		return fmt.Errorf("unsupported ingress provider %s", provider)
+	}
+}
+
+// reconcileForUnstructured creates or updates the custom resource of third party, e.g. istio. Only spec is
+// compared and updated since status and defaulted fields are maintained by others.
+func (r *CodeServerReconciler) reconcileForUnstructured(codeServer *csv1alpha1.CodeServer,
+	newObj *unstructured.Unstructured) error {
+	reqLogger := r.instanceLog(codeServer)
+	setOwnedLabels(newObj, codeServer.Name)
+	// Set CodeServer instance as the owner of the resource.
+	if err := controllerutil.SetControllerReference(codeServer, newObj, r.Scheme); err != nil {
+		return err
+	}
+	kind := newObj.GetKind()
+	oldObj := &unstructured.Unstructured{}
+	oldObj.SetGroupVersionKind(newObj.GroupVersionKind())
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: newObj.GetName(), Namespace: newObj.GetNamespace()},
+		oldObj)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info(fmt.Sprintf("Creating a %s.", kind))
+		r.addCostLabels(codeServer, newObj)
+		if err = r.Client.Create(context.TODO(), newObj); err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to create %s.", kind))
+			return err
+		}
+		r.recordCreated(codeServer, newObj)
+		return nil
+	}
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to get %s for %s.", kind, codeServer.Name))
+		return err
+	}
+	if err = r.adoptResource(codeServer, oldObj); err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to adopt %s.", kind))
+		return err
+	}
+	if !equality.Semantic.DeepEqual(oldObj.Object["spec"], newObj.Object["spec"]) {
+		oldObj.Object["spec"] = newObj.Object["spec"]
+		reqLogger.Info(fmt.Sprintf("Updating a %s.", kind))
+		if err = r.Client.Update(context.TODO(), oldObj); err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to update %s.", kind))
+			return err
+		}
+		r.recordUpdated(codeServer, oldObj)
+	}
+	return nil
+}
+
+// deleteUnstructuredIfExists deletes the custom resource of third party, missing CRD is treated as not found.
+func (r *CodeServerReconciler) deleteUnstructuredIfExists(gvk schema.GroupVersionKind, name, namespace string) error {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	err := r.deleteResourceIfExists(obj, name, namespace)
+	if err != nil && meta.IsNoMatchError(err) {
+		return nil
+	}
+	return err
+}
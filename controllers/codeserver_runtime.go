@@ -0,0 +1,251 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"net/http"
+	"net/url"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// Runtime is the backend which bootstraps code server instances, new runtimes only need to implement this
+// interface and be registered on reconciler.
+type Runtime interface {
+	// CreateWorkload returns the deployment which hosts the instance.
+	CreateWorkload(m *csv1alpha1.CodeServer) (*appsv1.Deployment, error)
+	// Delete releases resources the runtime allocated out of the deployment when instance is stopped.
+	Delete(m *csv1alpha1.CodeServer) error
+	// Probe returns the endpoint used to probe liveness and the endpoint used for in-IDE notification, empty
+	// notify endpoint means notification is unsupported.
+	Probe(m *csv1alpha1.CodeServer, service *corev1.Service) (string, string)
+	// URL returns the endpoint exposed to user.
+	URL(m *csv1alpha1.CodeServer) string
+}
+
+// SnapshotRuntime is implemented by runtimes which snapshot and restore instances by themselves rather than
+// snapshotting the workspace volume.
+type SnapshotRuntime interface {
+	// Snapshot starts a snapshot of the instance with the name, the background operation is returned if any.
+	Snapshot(m *csv1alpha1.CodeServer, name string) (string, error)
+	// Restore starts restoring the instance from the snapshot with the name, the background operation is returned
+	// if any.
+	Restore(m *csv1alpha1.CodeServer, name string) (string, error)
+	// OperationDone returns whether the background operation is done without waiting for it, error is returned if
+	// the operation failed.
+	OperationDone(m *csv1alpha1.CodeServer, operation string) (bool, error)
+}
+
+// CleanupRuntime is implemented by runtimes which keep resources out of kubernetes, e.g. lxd instances and their
+// snapshots, the resources are removed when instance is recycled or deleted.
+type CleanupRuntime interface {
+	// Cleanup removes all external resources of the instance, resources which don't exist are ignored.
+	Cleanup(m *csv1alpha1.CodeServer) error
+}
+
+// SchedulingRuntime is implemented by runtimes which place instances on backends out of kubernetes, e.g. lxd
+// remotes. Placement is recorded on instance before its workload is created.
+type SchedulingRuntime interface {
+	// Schedule records the placement of instance in its annotations, it returns true if instance is changed.
+	Schedule(m *csv1alpha1.CodeServer) (bool, error)
+}
+
+// RegisterRuntime registers the runtime backend for the runtime type, runtime type is case insensitive.
+func (r *CodeServerReconciler) RegisterRuntime(runtimeType csv1alpha1.RuntimeType, runtime Runtime) {
+	if r.Runtimes == nil {
+		r.Runtimes = make(map[csv1alpha1.RuntimeType]Runtime)
+	}
+	r.Runtimes[csv1alpha1.RuntimeType(strings.ToLower(string(runtimeType)))] = runtime
+}
+
+func (r *CodeServerReconciler) getRuntime(m *csv1alpha1.CodeServer) (Runtime, error) {
+	if runtime, ok := r.Runtimes[csv1alpha1.RuntimeType(strings.ToLower(string(m.Spec.Runtime)))]; ok {
+		return runtime, nil
+	}
+	return nil, fmt.Errorf("unsupported runtime %s", m.Spec.Runtime)
+}
+
+// deleteRuntimeResource releases resources allocated by runtime, unsupported runtime is ignored.
+func (r *CodeServerReconciler) deleteRuntimeResource(m *csv1alpha1.CodeServer) error {
+	instanceRuntime, err := r.getRuntime(m)
+	if err != nil {
+		return nil
+	}
+	return instanceRuntime.Delete(m)
+}
+
+// reconcileForRuntimeScheduling persists the placement of instance chosen by runtime, so that building workload
+// never updates instance, e.g. in dry run.
+func (r *CodeServerReconciler) reconcileForRuntimeScheduling(m *csv1alpha1.CodeServer) error {
+	instanceRuntime, err := r.getRuntime(m)
+	if err != nil {
+		return nil
+	}
+	scheduler, ok := instanceRuntime.(SchedulingRuntime)
+	if !ok {
+		return nil
+	}
+	if changed, err := scheduler.Schedule(m); err != nil || !changed {
+		return err
+	}
+	return r.Client.Update(context.TODO(), m)
+}
+
+func (r *CodeServerReconciler) cleanupRuntimeResource(m *csv1alpha1.CodeServer) error {
+	instanceRuntime, err := r.getRuntime(m)
+	if err != nil {
+		return nil
+	}
+	if cleaner, ok := instanceRuntime.(CleanupRuntime); ok {
+		return cleaner.Cleanup(m)
+	}
+	return nil
+}
+
+// probeEndpoint returns the endpoint used to probe instance. No matter tls is enabled or nor we both expose
+// upstream via http for internal probe.
+func probeEndpoint(m *csv1alpha1.CodeServer, service *corev1.Service) string {
+	return fmt.Sprintf("http://%s:%d%s/%s", service.Spec.ClusterIP, HttpPort, ideBasePath(m),
+		strings.TrimLeft(connectProbe(m), "/"))
+}
+
+// VSCodeRuntime runs VS code instance with an active exporter sidecar.
+type VSCodeRuntime struct {
+	r *CodeServerReconciler
+}
+
+func NewVSCodeRuntime(r *CodeServerReconciler) *VSCodeRuntime {
+	return &VSCodeRuntime{r: r}
+}
+
+func (v *VSCodeRuntime) CreateWorkload(m *csv1alpha1.CodeServer) (*appsv1.Deployment, error) {
+	return v.r.deploymentForVSCodeServer(m), nil
+}
+
+func (v *VSCodeRuntime) Delete(m *csv1alpha1.CodeServer) error {
+	return nil
+}
+
+func (v *VSCodeRuntime) Probe(m *csv1alpha1.CodeServer, service *corev1.Service) (string, string) {
+	return probeEndpoint(m, service), fmt.Sprintf("http://%s:%d/notify", service.Spec.ClusterIP, ExporterPort)
+}
+
+func (v *VSCodeRuntime) URL(m *csv1alpha1.CodeServer) string {
+	return v.r.instanceURL(m, "https", ideFlavorOf(m).urlQuery(VSCodeProjectDir))
+}
+
+// GenericRuntime runs application container, e.g. gotty and pgweb.
+type GenericRuntime struct {
+	r *CodeServerReconciler
+}
+
+func NewGenericRuntime(r *CodeServerReconciler) *GenericRuntime {
+	return &GenericRuntime{r: r}
+}
+
+func (g *GenericRuntime) CreateWorkload(m *csv1alpha1.CodeServer) (*appsv1.Deployment, error) {
+	return g.r.deploymentForGeneric(m), nil
+}
+
+func (g *GenericRuntime) Delete(m *csv1alpha1.CodeServer) error {
+	return nil
+}
+
+func (g *GenericRuntime) Probe(m *csv1alpha1.CodeServer, service *corev1.Service) (string, string) {
+	return probeEndpoint(m, service), ""
+}
+
+func (g *GenericRuntime) URL(m *csv1alpha1.CodeServer) string {
+	instanceRuntime := string(m.Spec.Runtime)
+	if strings.EqualFold(instanceRuntime, string(csv1alpha1.RuntimeGotty)) {
+		return g.r.instanceURL(m, "wss", "ws")
+	} else if strings.EqualFold(instanceRuntime, string(csv1alpha1.RuntimeGeneric)) {
+		return fmt.Sprintf(m.Spec.ConnectionString, m.Spec.Subdomain, g.r.Options.Load().DomainName)
+	}
+	return g.r.instanceURL(m, "https", "")
+}
+
+// LxdRuntime runs gotty based terminal which connects to system container on lxd, the lxd server on node is
+// used unless remote pool is specified.
+type LxdRuntime struct {
+	r    *CodeServerReconciler
+	pool *LxdRemotePool
+}
+
+func NewLxdRuntime(r *CodeServerReconciler, pool *LxdRemotePool) *LxdRuntime {
+	return &LxdRuntime{r: r, pool: pool}
+}
+
+func (l *LxdRuntime) Schedule(m *csv1alpha1.CodeServer) (bool, error) {
+	if l.pool == nil {
+		return false, nil
+	}
+	return l.pool.Schedule(m)
+}
+
+func (l *LxdRuntime) CreateWorkload(m *csv1alpha1.CodeServer) (*appsv1.Deployment, error) {
+	if l.pool != nil {
+		remote := l.pool.Remote(m.Annotations[LxdRemoteAnnotation])
+		if remote == nil {
+			return nil, fmt.Errorf("lxd instance %s has not been scheduled on any remote", m.Name)
+		}
+		dep := l.r.deploymentForLxd(m)
+		useLxdRemote(dep, remote, l.r.Options.Load().LxdClientSecretName)
+		return dep, nil
+	}
+	if len(l.r.Options.Load().LxdClientSecretName) == 0 {
+		return nil, fmt.Errorf("lxd client secret is required for runtime %s", m.Spec.Runtime)
+	}
+	return l.r.deploymentForLxd(m), nil
+}
+
+func (l *LxdRuntime) Delete(m *csv1alpha1.CodeServer) error {
+	return nil
+}
+
+// Cleanup force stops and deletes the lxd instance, snapshots of the instance are deleted together.
+func (l *LxdRuntime) Cleanup(m *csv1alpha1.CodeServer) error {
+	lxd, err := l.newLxdClient(m)
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/1.0/instances/%s", url.PathEscape(m.Name))
+	// stopping fails if instance has been stopped already, which is fine for deletion
+	if err := lxd.execute(http.MethodPut, path+"/state", map[string]interface{}{"action": "stop", "force": true}); err != nil {
+		if lxdNotFound(err) {
+			return nil
+		}
+		l.r.Log.Info(fmt.Sprintf("failed to stop lxd instance %s before deletion: %v", m.Name, err))
+	}
+	if err := lxd.execute(http.MethodDelete, path, nil); err != nil && !lxdNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (l *LxdRuntime) Probe(m *csv1alpha1.CodeServer, service *corev1.Service) (string, string) {
+	return probeEndpoint(m, service), ""
+}
+
+func (l *LxdRuntime) URL(m *csv1alpha1.CodeServer) string {
+	return l.r.instanceURL(m, "wss", "ws")
+}
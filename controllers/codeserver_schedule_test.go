@@ -0,0 +1,94 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		wantErr bool
+	}{
+		{name: "every minute", spec: "* * * * *"},
+		{name: "lists ranges and steps", spec: "0,30 9-17 */2 1-6/2 1-5"},
+		{name: "sunday as 7", spec: "0 0 * * 7"},
+		{name: "macro", spec: "@daily"},
+		{name: "macro with spaces", spec: " @hourly "},
+		{name: "too few fields", spec: "0 0 * *", wantErr: true},
+		{name: "too many fields", spec: "0 0 * * * *", wantErr: true},
+		{name: "minute out of range", spec: "60 * * * *", wantErr: true},
+		{name: "day of month zero", spec: "0 0 0 * *", wantErr: true},
+		{name: "reversed range", spec: "0 5-1 * * *", wantErr: true},
+		{name: "zero step", spec: "*/0 * * * *", wantErr: true},
+		{name: "invalid value", spec: "a * * * *", wantErr: true},
+		{name: "unknown macro", spec: "@never", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCronSchedule(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseCronSchedule(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// 2024-01-01 is a monday
+	base := time.Date(2024, 1, 1, 10, 15, 30, 0, time.UTC)
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{name: "next minute", spec: "* * * * *", from: base, want: time.Date(2024, 1, 1, 10, 16, 0, 0, time.UTC)},
+		{name: "strictly after", spec: "16 10 * * *", from: time.Date(2024, 1, 1, 10, 16, 0, 0, time.UTC),
+			want: time.Date(2024, 1, 2, 10, 16, 0, 0, time.UTC)},
+		{name: "later today", spec: "0 18 * * *", from: base, want: time.Date(2024, 1, 1, 18, 0, 0, 0, time.UTC)},
+		{name: "tomorrow", spec: "0 9 * * *", from: base, want: time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC)},
+		{name: "step minutes", spec: "*/20 * * * *", from: base, want: time.Date(2024, 1, 1, 10, 20, 0, 0, time.UTC)},
+		{name: "weekday", spec: "0 9 * * 5", from: base, want: time.Date(2024, 1, 5, 9, 0, 0, 0, time.UTC)},
+		{name: "sunday as 7", spec: "0 9 * * 7", from: base, want: time.Date(2024, 1, 7, 9, 0, 0, 0, time.UTC)},
+		{name: "sunday as 0", spec: "0 9 * * 0", from: base, want: time.Date(2024, 1, 7, 9, 0, 0, 0, time.UTC)},
+		{name: "weekday range", spec: "0 8 * * 1-5", from: time.Date(2024, 1, 5, 9, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 1, 8, 8, 0, 0, 0, time.UTC)},
+		{name: "day of month or day of week", spec: "0 0 15 * 3", from: base,
+			want: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{name: "day of month with star day of week", spec: "0 0 15 * *", from: base,
+			want: time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{name: "next month", spec: "0 0 1 * *", from: base, want: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "leap day", spec: "0 0 29 2 *", from: base, want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{name: "next year", spec: "@yearly", from: base, want: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "never matches", spec: "0 0 31 2 *", from: base, want: time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := ParseCronSchedule(tt.spec)
+			if err != nil {
+				t.Fatalf("ParseCronSchedule(%q) error = %v", tt.spec, err)
+			}
+			if got := schedule.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%v) of %q = %v, want %v", tt.from, tt.spec, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// addSchedulingForPod applies the scheduling profile, data locality, pinned node and topology spread constraints of
+// instance,
+// instances of the same team are spread across topology domains by default if team label is configured.
+func (r *CodeServerReconciler) addSchedulingForPod(m *csv1alpha1.CodeServer, template *corev1.PodTemplateSpec) error {
+	if err := r.addSchedulingProfileForPod(m, &template.Spec); err != nil {
+		return err
+	}
+	if err := r.addDataLocalityForPod(m, &template.Spec); err != nil {
+		return err
+	}
+	pinPodToNode(&template.Spec, m.Annotations[PinnedNodeAnnotation])
+	if m.Spec.Scheduling != nil && len(m.Spec.Scheduling.TopologySpreadConstraints) != 0 {
+		template.Spec.TopologySpreadConstraints = m.Spec.Scheduling.TopologySpreadConstraints
+		return nil
+	}
+	if len(r.Options.Load().TeamLabel) == 0 || len(r.Options.Load().SpreadTopologyKey) == 0 {
+		return nil
+	}
+	team, ok := m.Labels[r.Options.Load().TeamLabel]
+	if !ok {
+		return nil
+	}
+	// team label is required on pod for counting instances of the same team
+	if template.Labels == nil {
+		template.Labels = map[string]string{}
+	}
+	template.Labels[r.Options.Load().TeamLabel] = team
+	template.Spec.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{
+		{
+			MaxSkew:           1,
+			TopologyKey:       r.Options.Load().SpreadTopologyKey,
+			WhenUnsatisfiable: corev1.ScheduleAnyway,
+			LabelSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app":                      appLabel(m.Name)["app"],
+					r.Options.Load().TeamLabel: team,
+				},
+			},
+		},
+	}
+	return nil
+}
+
+// addSchedulingProfileForPod expands the scheduling profile referred by instance.
+func (r *CodeServerReconciler) addSchedulingProfileForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) error {
+	if m.Spec.Scheduling == nil || len(m.Spec.Scheduling.Profile) == 0 {
+		return nil
+	}
+	var profile *csv1alpha1.SchedulingProfile
+	for i := range r.Options.Load().SchedulingProfiles {
+		if r.Options.Load().SchedulingProfiles[i].Name == m.Spec.Scheduling.Profile {
+			profile = &r.Options.Load().SchedulingProfiles[i]
+		}
+	}
+	if profile == nil {
+		return fmt.Errorf("scheduling profile %s is not defined in operator config", m.Spec.Scheduling.Profile)
+	}
+	if len(profile.NodeSelector) != 0 {
+		selector := map[string]string{}
+		for key, value := range profile.NodeSelector {
+			selector[key] = value
+		}
+		for key, value := range podSpec.NodeSelector {
+			selector[key] = value
+		}
+		podSpec.NodeSelector = selector
+	}
+	podSpec.Tolerations = append(podSpec.Tolerations, profile.Tolerations...)
+	if profile.Affinity != nil {
+		podSpec.Affinity = profile.Affinity.DeepCopy()
+	}
+	return nil
+}
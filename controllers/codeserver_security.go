@@ -0,0 +1,131 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// SecurityWebhookPath is the path of validating webhook which keeps security context of instance within the
+// privileges granted by spec.privileged and operator.
+const SecurityWebhookPath = "/validate-cs-opensourceways-com-v1alpha1-codeserver-security"
+
+// +kubebuilder:webhook:path=/validate-cs-opensourceways-com-v1alpha1-codeserver-security,mutating=false,failurePolicy=fail,sideEffects=None,groups=cs.opensourceways.com,resources=codeservers,verbs=create;update,versions=v1alpha1,name=vcodeserversecurity.kb.io,admissionReviewVersions=v1
+
+// CodeServerSecurityValidator denies security context of instance or its sidecars which grants more privileges than
+// spec.privileged, e.g. privileged containers or added capabilities, or privileged instances once docker is disabled
+// by operator. Updates are only checked if security context, spec.privileged or sidecars changed.
+type CodeServerSecurityValidator struct {
+	Log     logr.Logger
+	Options *CodeServerOption
+}
+
+func NewCodeServerSecurityValidator(log logr.Logger, options *CodeServerOption) *CodeServerSecurityValidator {
+	return &CodeServerSecurityValidator{
+		Log:     log,
+		Options: options,
+	}
+}
+
+func (v *CodeServerSecurityValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	codeServer := &csv1alpha1.CodeServer{}
+	if err := json.Unmarshal(req.Object.Raw, codeServer); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if req.Operation == admissionv1.Update {
+		old := &csv1alpha1.CodeServer{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if equality.Semantic.DeepEqual(old.Spec.SecurityContext, codeServer.Spec.SecurityContext) &&
+			equality.Semantic.DeepEqual(old.Spec.Privileged, codeServer.Spec.Privileged) &&
+			equality.Semantic.DeepEqual(old.Spec.Sidecars, codeServer.Spec.Sidecars) {
+			return admission.Allowed("")
+		}
+	}
+	if err := validateSecurityContext(codeServer, v.Options.Load().DisableDocker); err != nil {
+		v.Log.Info(fmt.Sprintf("code server %s/%s is denied: %v", req.Namespace, codeServer.Name, err))
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+// validateSecurityContext returns error if security context of instance or its sidecars grants privileges beyond
+// spec.privileged, spec.privileged is denied at all if privileged containers are disabled.
+func validateSecurityContext(m *csv1alpha1.CodeServer, disablePrivileged bool) error {
+	privileged := m.Spec.Privileged != nil && *m.Spec.Privileged
+	if privileged && disablePrivileged {
+		return fmt.Errorf("spec.privileged has been disallowed by operator")
+	}
+	if err := validateContainerSecurityContext("spec.securityContext", m.Spec.SecurityContext, privileged); err != nil {
+		return err
+	}
+	for index, sidecar := range m.Spec.Sidecars {
+		if err := validateContainerSecurityContext(fmt.Sprintf("spec.sidecars[%d].securityContext", index),
+			sidecar.SecurityContext, privileged); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateContainerSecurityContext(field string, securityContext *corev1.SecurityContext, privileged bool) error {
+	if securityContext == nil || privileged {
+		return nil
+	}
+	if securityContext.Privileged != nil && *securityContext.Privileged {
+		return fmt.Errorf("%s.privileged requires spec.privileged", field)
+	}
+	if securityContext.Capabilities != nil && len(securityContext.Capabilities.Add) != 0 {
+		return fmt.Errorf("%s.capabilities.add requires spec.privileged", field)
+	}
+	if securityContext.ProcMount != nil && *securityContext.ProcMount == corev1.UnmaskedProcMount {
+		return fmt.Errorf("unmasked %s.procMount requires spec.privileged", field)
+	}
+	return nil
+}
+
+// addSecurityContextForPod applies the pod and container security context of instance, privileged of container
+// falls back to spec.privileged.
+func addSecurityContextForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	if m.Spec.PodSecurityContext != nil {
+		podSpec.SecurityContext = m.Spec.PodSecurityContext.DeepCopy()
+	}
+	if m.Spec.SecurityContext == nil {
+		return
+	}
+	for index := range podSpec.Containers {
+		if podSpec.Containers[index].Name != CSNAME {
+			continue
+		}
+		securityContext := m.Spec.SecurityContext.DeepCopy()
+		if securityContext.Privileged == nil {
+			securityContext.Privileged = m.Spec.Privileged
+		}
+		podSpec.Containers[index].SecurityContext = securityContext
+	}
+}
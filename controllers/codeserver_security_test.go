@@ -0,0 +1,78 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+func TestValidateSecurityContext(t *testing.T) {
+	yes := true
+	unmasked := corev1.UnmaskedProcMount
+	tests := []struct {
+		name              string
+		spec              csv1alpha1.CodeServerSpec
+		disablePrivileged bool
+		wantErr           string
+	}{
+		{name: "no security context"},
+		{name: "privileged instance", spec: csv1alpha1.CodeServerSpec{Privileged: &yes}},
+		{name: "privileged instance disallowed", spec: csv1alpha1.CodeServerSpec{Privileged: &yes},
+			disablePrivileged: true, wantErr: "spec.privileged"},
+		{name: "privileged container without spec.privileged", spec: csv1alpha1.CodeServerSpec{
+			SecurityContext: &corev1.SecurityContext{Privileged: &yes}}, wantErr: "spec.securityContext.privileged"},
+		{name: "privileged container with spec.privileged", spec: csv1alpha1.CodeServerSpec{Privileged: &yes,
+			SecurityContext: &corev1.SecurityContext{Privileged: &yes}}},
+		{name: "privileged container disallowed", spec: csv1alpha1.CodeServerSpec{Privileged: &yes,
+			SecurityContext: &corev1.SecurityContext{Privileged: &yes}}, disablePrivileged: true,
+			wantErr: "spec.privileged"},
+		{name: "added capabilities", spec: csv1alpha1.CodeServerSpec{SecurityContext: &corev1.SecurityContext{
+			Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"SYS_ADMIN"}}}},
+			wantErr: "spec.securityContext.capabilities.add"},
+		{name: "dropped capabilities", spec: csv1alpha1.CodeServerSpec{SecurityContext: &corev1.SecurityContext{
+			Capabilities: &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}}}}},
+		{name: "unmasked proc mount", spec: csv1alpha1.CodeServerSpec{SecurityContext: &corev1.SecurityContext{
+			ProcMount: &unmasked}}, wantErr: "spec.securityContext.procMount"},
+		{name: "privileged sidecar", spec: csv1alpha1.CodeServerSpec{Sidecars: []corev1.Container{
+			{Name: "tools"}, {Name: "proxy", SecurityContext: &corev1.SecurityContext{Privileged: &yes}}}},
+			wantErr: "spec.sidecars[1].securityContext.privileged"},
+		{name: "sidecar adding capabilities", spec: csv1alpha1.CodeServerSpec{Sidecars: []corev1.Container{
+			{Name: "proxy", SecurityContext: &corev1.SecurityContext{
+				Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN"}}}}}},
+			wantErr: "spec.sidecars[0].securityContext.capabilities.add"},
+		{name: "privileged sidecar with spec.privileged", spec: csv1alpha1.CodeServerSpec{Privileged: &yes,
+			Sidecars: []corev1.Container{{Name: "proxy", SecurityContext: &corev1.SecurityContext{Privileged: &yes}}}}},
+		{name: "unprivileged sidecar", spec: csv1alpha1.CodeServerSpec{Sidecars: []corev1.Container{
+			{Name: "proxy", SecurityContext: &corev1.SecurityContext{RunAsNonRoot: &yes}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSecurityContext(&csv1alpha1.CodeServer{Spec: tt.spec}, tt.disablePrivileged)
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Errorf("validateSecurityContext() = %v, want nil", err)
+			}
+			if len(tt.wantErr) != 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateSecurityContext() = %v, want error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// SettingsResource names the ConfigMap holding the settings fetched from settings sync server.
+	SettingsResource      = "%s-settings"
+	SettingsVolume        = "code-server-settings"
+	SettingsDir           = "/etc/code-server-settings"
+	SettingsContainer     = "settings-sync"
+	SettingsFile          = "settings.json"
+	KeybindingsFile       = "keybindings.json"
+	SettingsFetchTimeout  = 10 * time.Second
+	settingsSyncAPIPrefix = "/v1/resource/"
+	// settingsScript copies the files absent in user data, settings changed by user are kept.
+	settingsScript = `mkdir -p "$USER_DIR" && for file in ` + SettingsFile + ` ` + KeybindingsFile + `; do ` +
+		`if [ -s "` + SettingsDir + `/$file" ] && [ ! -e "$USER_DIR/$file" ]; then ` +
+		`cp "` + SettingsDir + `/$file" "$USER_DIR/$file"; fi; done`
+)
+
+// syncData is the resource stored by settings sync server, content is the resource specific json.
+type syncData struct {
+	Version int    `json:"version"`
+	Content string `json:"content"`
+}
+
+func settingsSyncEnabled(m *csv1alpha1.CodeServer) bool {
+	return m.Spec.SettingsSync != nil && (len(m.Spec.SettingsSync.URL) != 0 || len(m.Spec.SettingsSync.ConfigMap) != 0) &&
+		strings.EqualFold(string(m.Spec.Runtime), string(csv1alpha1.RuntimeCode))
+}
+
+// settingsConfigMap returns the ConfigMap settings are provisioned from.
+func settingsConfigMap(m *csv1alpha1.CodeServer) string {
+	if len(m.Spec.SettingsSync.ConfigMap) != 0 {
+		return m.Spec.SettingsSync.ConfigMap
+	}
+	return ChildName(SettingsResource, m.Name)
+}
+
+// fetchSyncResource returns the content of the latest resource on settings sync server, empty if the resource
+// has never been synced.
+func fetchSyncResource(url, token, resource string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(url, "/")+settingsSyncAPIPrefix+resource+"/latest",
+		nil)
+	if err != nil {
+		return "", err
+	}
+	if len(token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := http.Client{Timeout: SettingsFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch %s from settings sync server, status code %d", resource,
+			resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || len(body) == 0 {
+		return "", err
+	}
+	data := syncData{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return "", fmt.Errorf("invalid %s of settings sync server: %v", resource, err)
+	}
+	return data.Content, nil
+}
+
+// fetchSettings returns settings.json and keybindings.json of settings sync server, keybindings of linux are used
+// since code server always runs on linux.
+func fetchSettings(url, token string) (map[string]string, error) {
+	files := map[string]string{}
+	content, err := fetchSyncResource(url, token, "settings")
+	if err != nil {
+		return nil, err
+	}
+	if len(content) != 0 {
+		settings := struct {
+			Settings string `json:"settings"`
+		}{}
+		if err := json.Unmarshal([]byte(content), &settings); err != nil {
+			return nil, fmt.Errorf("invalid settings of settings sync server: %v", err)
+		}
+		files[SettingsFile] = settings.Settings
+	}
+	if content, err = fetchSyncResource(url, token, "keybindings"); err != nil {
+		return nil, err
+	}
+	if len(content) != 0 {
+		keybindings := struct {
+			Linux string `json:"linux"`
+			All   string `json:"all"`
+		}{}
+		if err := json.Unmarshal([]byte(content), &keybindings); err != nil {
+			return nil, fmt.Errorf("invalid keybindings of settings sync server: %v", err)
+		}
+		files[KeybindingsFile] = keybindings.Linux
+		if len(keybindings.Linux) == 0 {
+			files[KeybindingsFile] = keybindings.All
+		}
+	}
+	return files, nil
+}
+
+// reconcileForSettingsSync fetches settings from settings sync server into a ConfigMap once, so that instance
+// keeps the configuration it was created with across restarts.
+func (r *CodeServerReconciler) reconcileForSettingsSync(codeServer *csv1alpha1.CodeServer) error {
+	name := ChildName(SettingsResource, codeServer.Name)
+	if !settingsSyncEnabled(codeServer) || len(codeServer.Spec.SettingsSync.ConfigMap) != 0 {
+		return r.deleteResourceIfExists(&corev1.ConfigMap{}, name, codeServer.Namespace)
+	}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace},
+		&corev1.ConfigMap{})
+	if err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+	token := ""
+	if secretName := codeServer.Spec.SettingsSync.TokenSecret; len(secretName) != 0 {
+		secret := &corev1.Secret{}
+		if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: secretName,
+			Namespace: codeServer.Namespace}, secret); err != nil {
+			return err
+		}
+		token = string(secret.Data["token"])
+	}
+	files, err := fetchSettings(codeServer.Spec.SettingsSync.URL, token)
+	if err != nil {
+		return err
+	}
+	settings := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: codeServer.Namespace,
+		},
+		Data: files,
+	}
+	setOwnedLabels(settings, codeServer.Name)
+	controllerutil.SetControllerReference(codeServer, settings, r.Scheme)
+	r.addCostLabels(codeServer, settings)
+	r.instanceLog(codeServer).Info(fmt.Sprintf("Creating settings fetched from %s.", codeServer.Spec.SettingsSync.URL))
+	if err := r.Client.Create(context.TODO(), settings); err != nil {
+		return err
+	}
+	r.recordCreated(codeServer, settings)
+	return nil
+}
+
+// addSettingsSyncForPod copies the provisioned settings into user data before code server starts.
+func addSettingsSyncForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	if !settingsSyncEnabled(m) {
+		return
+	}
+	podSpec.InitContainers = append(podSpec.InitContainers, corev1.Container{
+		Name:            SettingsContainer,
+		Image:           m.Spec.Image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"sh", "-c", settingsScript},
+		Env:             []corev1.EnvVar{{Name: "USER_DIR", Value: VSCodeShareDir + "/User"}},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				MountPath: VSCodeShareDir,
+				Name:      VSCodeShareVolume,
+			},
+			{
+				MountPath: SettingsDir,
+				Name:      SettingsVolume,
+				ReadOnly:  true,
+			},
+		},
+	})
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: SettingsVolume,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: settingsConfigMap(m)},
+			},
+		},
+	})
+}
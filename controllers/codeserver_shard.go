@@ -0,0 +1,89 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"hash/fnv"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"strconv"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// ShardLabel records the shard which code server is assigned to, valid label always wins over hashing so that
+// assignments stick when shard count changes, remove the label to rebalance.
+const ShardLabel = "codeserver.io/shard"
+
+// jumpHash is the jump consistent hash, only 1/n keys move when shard count grows to n.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// ShardOf returns the shard of code server from its shard label or the consistent hash of namespace/name.
+func ShardOf(options *CodeServerOption, obj metav1.Object) int {
+	if options.Load().ShardCount <= 1 {
+		return 0
+	}
+	if value, found := obj.GetLabels()[ShardLabel]; found {
+		if shard, err := strconv.Atoi(value); err == nil && shard >= 0 && shard < options.Load().ShardCount {
+			return shard
+		}
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(obj.GetNamespace() + "/" + obj.GetName()))
+	return jumpHash(hash.Sum64(), options.Load().ShardCount)
+}
+
+// InShard returns whether code server is handled by this operator replica.
+func InShard(options *CodeServerOption, obj metav1.Object) bool {
+	return options.Load().ShardCount <= 1 || ShardOf(options, obj) == options.Load().ShardID
+}
+
+// assignShard records the shard of code server in label, returns true if code server has been updated.
+func (r *CodeServerReconciler) assignShard(codeServer *csv1alpha1.CodeServer) (bool, error) {
+	if r.Options.Load().ShardCount <= 1 {
+		return false, nil
+	}
+	shard := strconv.Itoa(ShardOf(r.Options, codeServer))
+	if codeServer.Labels[ShardLabel] == shard {
+		return false, nil
+	}
+	if codeServer.Labels == nil {
+		codeServer.Labels = map[string]string{}
+	}
+	codeServer.Labels[ShardLabel] = shard
+	if err := r.Client.Update(context.TODO(), codeServer); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// shardPredicate filters out the code servers of other shards.
+func (r *CodeServerReconciler) shardPredicate() predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return InShard(r.Options, obj)
+	})
+}
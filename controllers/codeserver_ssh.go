@@ -0,0 +1,264 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"path"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strconv"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	SSHServerName     = "ssh-server"
+	SSHContainerPort  = 2222
+	SSHServicePort    = 22
+	SSHKeysVolume     = "ssh-authorized-keys"
+	SSHKeysDir        = "/ssh-keys"
+	SSHAuthorizedKeys = "authorized_keys"
+	SSHResource       = "%s-ssh"
+	SSHEndpoint       = "sshEndpoint"
+	SSHNodePort       = "sshNodePort"
+)
+
+func sshEnabled(m *csv1alpha1.CodeServer) bool {
+	return m.Spec.SSH != nil && m.Spec.SSH.Enabled
+}
+
+// addSSHServerForPod injects ssh server sidecar into pod, the workspace volume is shared with ssh server.
+func (r *CodeServerReconciler) addSSHServerForPod(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec, baseDir,
+	baseDirVolume string) {
+	if !sshEnabled(m) {
+		return
+	}
+	image := r.Options.Load().SSHImage
+	if len(m.Spec.SSH.Image) != 0 {
+		image = m.Spec.SSH.Image
+	}
+	podSpec.Containers = append(podSpec.Containers, corev1.Container{
+		Image:           image,
+		Name:            SSHServerName,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Env: []corev1.EnvVar{
+			{
+				Name:  "USER_NAME",
+				Value: "coder",
+			},
+			{
+				Name:  "PUBLIC_KEY_FILE",
+				Value: path.Join(SSHKeysDir, SSHAuthorizedKeys),
+			},
+			{
+				Name:  "PASSWORD_ACCESS",
+				Value: "false",
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				MountPath: baseDir,
+				Name:      baseDirVolume,
+			},
+			{
+				MountPath: SSHKeysDir,
+				Name:      SSHKeysVolume,
+				ReadOnly:  true,
+			},
+		},
+		Ports: []corev1.ContainerPort{{
+			ContainerPort: SSHContainerPort,
+			Name:          "ssh",
+		}},
+	})
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: SSHKeysVolume,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: ChildName(SSHResource, m.Name),
+			},
+		},
+	})
+}
+
+func (r *CodeServerReconciler) reconcileForSSH(codeServer *csv1alpha1.CodeServer) (*corev1.Service, error) {
+	reqLogger := r.instanceLog(codeServer)
+	name := ChildName(SSHResource, codeServer.Name)
+	if !sshEnabled(codeServer) {
+		if err := r.deleteResourceIfExists(&corev1.Service{}, name, codeServer.Namespace); err != nil {
+			return nil, err
+		}
+		return nil, r.deleteResourceIfExists(&corev1.Secret{}, name, codeServer.Namespace)
+	}
+	reqLogger.Info("Reconciling ssh access.")
+	//reconcile authorized keys for ssh server
+	newSecret, err := r.newSSHSecret(codeServer)
+	if err != nil {
+		reqLogger.Error(err, "Failed to assemble ssh authorized keys.")
+		return nil, err
+	}
+	oldSecret := &corev1.Secret{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, oldSecret)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating ssh secret.")
+		r.addCostLabels(codeServer, newSecret)
+		if err = r.Client.Create(context.TODO(), newSecret); err != nil {
+			reqLogger.Error(err, "Failed to create ssh secret.")
+			return nil, err
+		}
+	} else {
+		if err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to get ssh secret for %s.", codeServer.Name))
+			return nil, err
+		}
+		if !equality.Semantic.DeepEqual(oldSecret.Data, newSecret.Data) {
+			oldSecret.Data = newSecret.Data
+			reqLogger.Info("Updating ssh secret.")
+			if err = r.Client.Update(context.TODO(), oldSecret); err != nil {
+				reqLogger.Error(err, "Failed to update ssh secret.")
+				return nil, err
+			}
+		}
+	}
+	//reconcile service for ssh server
+	newService := r.newSSHService(codeServer)
+	setOwnedLabels(newService, codeServer.Name)
+	oldService := &corev1.Service{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: codeServer.Namespace}, oldService)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating ssh service.")
+		r.addCostLabels(codeServer, newService)
+		if err = r.Client.Create(context.TODO(), newService); err != nil {
+			reqLogger.Error(err, "Failed to create ssh service.")
+			return nil, err
+		}
+		r.recordCreated(codeServer, newService)
+		return newService, nil
+	}
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to get ssh service for %s.", codeServer.Name))
+		return nil, err
+	}
+	if err = r.adoptResource(codeServer, oldService); err != nil {
+		reqLogger.Error(err, "Failed to adopt ssh service.")
+		return nil, err
+	}
+	if oldService.Spec.Type != newService.Spec.Type ||
+		!equality.Semantic.DeepEqual(oldService.Spec.Selector, newService.Spec.Selector) ||
+		ipFamiliesChanged(oldService, newService) {
+		oldService.Spec.Type = newService.Spec.Type
+		oldService.Spec.Selector = newService.Spec.Selector
+		oldService.Spec.Ports = newService.Spec.Ports
+		addIPFamiliesForService(codeServer, oldService)
+		reqLogger.Info("Updating ssh service.")
+		if err = r.Client.Update(context.TODO(), oldService); err != nil {
+			reqLogger.Error(err, "Failed to update ssh service.")
+			return nil, err
+		}
+		r.recordUpdated(codeServer, oldService)
+	}
+	return oldService, nil
+}
+
+// newSSHSecret assembles authorized keys from spec and the referenced secret.
+func (r *CodeServerReconciler) newSSHSecret(m *csv1alpha1.CodeServer) (*corev1.Secret, error) {
+	keys := append([]string{}, m.Spec.SSH.PublicKeys...)
+	if ref := m.Spec.SSH.PublicKeysSecretRef; ref != nil {
+		secret := &corev1.Secret{}
+		err := r.Client.Get(context.TODO(), types.NamespacedName{Name: ref.Name, Namespace: m.Namespace}, secret)
+		if err != nil {
+			if !(errors.IsNotFound(err) && ref.Optional != nil && *ref.Optional) {
+				return nil, err
+			}
+		} else if value, ok := secret.Data[ref.Key]; ok {
+			keys = append(keys, strings.TrimSpace(string(value)))
+		} else if ref.Optional == nil || !*ref.Optional {
+			return nil, fmt.Errorf("could not found key %s in secret %s", ref.Key, ref.Name)
+		}
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ChildName(SSHResource, m.Name),
+			Namespace: m.Namespace,
+		},
+		Data: map[string][]byte{
+			SSHAuthorizedKeys: []byte(strings.Join(keys, "\n") + "\n"),
+		},
+	}
+	// Set CodeServer instance as the owner of the secret.
+	controllerutil.SetControllerReference(m, secret, r.Scheme)
+	return secret, nil
+}
+
+func (r *CodeServerReconciler) newSSHService(m *csv1alpha1.CodeServer) *corev1.Service {
+	serviceType := corev1.ServiceTypeNodePort
+	if m.Spec.SSH.ServiceType == corev1.ServiceTypeLoadBalancer {
+		serviceType = corev1.ServiceTypeLoadBalancer
+	}
+	ser := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ChildName(SSHResource, m.Name),
+			Namespace: m.Namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     serviceType,
+			Selector: appLabel(m.Name),
+			Ports: []corev1.ServicePort{
+				{
+					Port:       SSHServicePort,
+					Name:       "ssh",
+					Protocol:   corev1.ProtocolTCP,
+					TargetPort: intstr.FromInt(SSHContainerPort),
+				},
+			},
+		},
+	}
+	addIPFamiliesForService(m, ser)
+	// Set CodeServer instance as the owner of the Service.
+	controllerutil.SetControllerReference(m, ser, r.Scheme)
+	return ser
+}
+
+// sshConnectionInfo returns the ssh access information which will be exposed in ready condition.
+func sshConnectionInfo(service *corev1.Service) map[string]string {
+	info := map[string]string{}
+	if service == nil {
+		return info
+	}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		host := ingress.IP
+		if len(ingress.Hostname) != 0 {
+			host = ingress.Hostname
+		}
+		info[SSHEndpoint] = fmt.Sprintf("ssh://coder@%s", endpointAddress(host, SSHServicePort))
+		break
+	}
+	for _, port := range service.Spec.Ports {
+		if port.NodePort != 0 {
+			info[SSHNodePort] = strconv.Itoa(int(port.NodePort))
+		}
+	}
+	return info
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sync"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const DefaultStatusFlushInterval = 15 * time.Second
+
+// StatusMutation changes the status of code server in place.
+type StatusMutation func(status *csv1alpha1.CodeServerStatus)
+
+// StatusBatcher coalesces the status reports of watcher and writes them in batches, mutations of the same code
+// server between two flushes are applied together in one merge patch which only contains the changed fields, and
+// patches changing nothing are skipped. Lists such as conditions are replaced as a whole by merge patch, so patches
+// are guarded by resource version and mutations are reapplied on conflict instead of overwriting concurrent writes.
+type StatusBatcher struct {
+	client.Client
+	Log     logr.Logger
+	Options *CodeServerOption
+	lock    sync.Mutex
+	pending map[types.NamespacedName][]StatusMutation
+}
+
+func NewStatusBatcher(client client.Client, log logr.Logger, options *CodeServerOption) *StatusBatcher {
+	return &StatusBatcher{
+		Client:  client,
+		Log:     log,
+		Options: options,
+		pending: map[types.NamespacedName][]StatusMutation{},
+	}
+}
+
+// Enqueue records the mutation which will be written on next flush.
+func (b *StatusBatcher) Enqueue(req types.NamespacedName, mutation StatusMutation) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pending[req] = append(b.pending[req], mutation)
+}
+
+func (b *StatusBatcher) Run(stopCh <-chan struct{}) {
+	interval := time.Duration(b.Options.Load().StatusFlushInterval) * time.Second
+	if interval <= 0 {
+		interval = DefaultStatusFlushInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.Flush()
+		case <-stopCh:
+			b.Flush()
+			return
+		}
+	}
+}
+
+// Flush writes all pending mutations.
+func (b *StatusBatcher) Flush() {
+	b.lock.Lock()
+	pending := b.pending
+	b.pending = map[types.NamespacedName][]StatusMutation{}
+	b.lock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	patched, skipped := 0, 0
+	for req, mutations := range pending {
+		changed := false
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			codeServer := &csv1alpha1.CodeServer{}
+			if err := b.Client.Get(context.TODO(), req, codeServer); err != nil {
+				return err
+			}
+			original := codeServer.DeepCopy()
+			for _, mutation := range mutations {
+				mutation(&codeServer.Status)
+			}
+			if changed = !equality.Semantic.DeepEqual(original.Status, codeServer.Status); !changed {
+				return nil
+			}
+			return b.Client.Patch(context.TODO(), codeServer,
+				client.MergeFromWithOptions(original, client.MergeFromWithOptimisticLock{}))
+		})
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				b.Log.Error(err, "Failed to patch code server status.", "codeserver", req)
+			}
+			continue
+		}
+		if changed {
+			patched++
+		} else {
+			skipped++
+		}
+	}
+	b.Log.Info(fmt.Sprintf("flushed status of %d code servers, %d patched and %d unchanged", len(pending),
+		patched, skipped))
+}
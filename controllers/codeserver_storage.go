@@ -0,0 +1,69 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	errrorlib "errors"
+	corev1 "k8s.io/api/core/v1"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	SnapshotAPIGroup = "snapshot.storage.k8s.io"
+	SnapshotKind     = "VolumeSnapshot"
+)
+
+// workspaceDataSource returns the VolumeSnapshot or PersistentVolumeClaim the workspace volume is populated from,
+// CSI driver of the storage class must support snapshot restore or volume cloning.
+func workspaceDataSource(m *csv1alpha1.CodeServer) (*corev1.TypedLocalObjectReference, error) {
+	if m.Spec.Storage == nil {
+		return nil, nil
+	}
+	sources := 0
+	if len(m.Spec.Storage.SourceSnapshot) != 0 {
+		sources++
+	}
+	if len(m.Spec.Storage.SourcePVC) != 0 {
+		sources++
+	}
+	if m.Spec.Storage.SourcePrebuild != nil {
+		sources++
+	}
+	if len(m.Spec.Storage.SourceArchive) != 0 {
+		sources++
+	}
+	if sources > 1 {
+		return nil, errrorlib.New(
+			"only one of sourceSnapshot, sourcePVC, sourcePrebuild and sourceArchive can be specified")
+	}
+	if len(m.Spec.Storage.SourceSnapshot) != 0 {
+		apiGroup := SnapshotAPIGroup
+		return &corev1.TypedLocalObjectReference{
+			APIGroup: &apiGroup,
+			Kind:     SnapshotKind,
+			Name:     m.Spec.Storage.SourceSnapshot,
+		}, nil
+	}
+	if len(m.Spec.Storage.SourcePVC) != 0 {
+		return &corev1.TypedLocalObjectReference{
+			Kind: "PersistentVolumeClaim",
+			Name: m.Spec.Storage.SourcePVC,
+		}, nil
+	}
+	return nil, nil
+}
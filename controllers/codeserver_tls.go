@@ -0,0 +1,118 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// tlsVersions are the versions accepted for the minimal tls version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses the minimal tls version, e.g. 1.2.
+func ParseTLSVersion(version string) (uint16, error) {
+	if value, found := tlsVersions[strings.TrimSpace(version)]; found {
+		return value, nil
+	}
+	return 0, fmt.Errorf("unsupported tls version %q, 1.0, 1.1, 1.2 and 1.3 are supported", version)
+}
+
+// ParseCipherSuites parses the IANA names of cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Suites
+// with known security issues are rejected, cipher suites of tls 1.3 are not configurable and are ignored by go.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	insecure := map[string]bool{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+	var ids []uint16
+	for _, name := range names {
+		if insecure[name] {
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+		id, found := suites[name]
+		if !found {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// LoadCertPool returns the pool of PEM encoded certificates in file, system pool is used if file is empty.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// ServerTLSOptions returns the function which applies the configured minimal version and cipher suites to tls
+// config of the servers, i.e. webhook and metrics.
+func ServerTLSOptions(options *CodeServerOption) func(config *tls.Config) {
+	return func(config *tls.Config) {
+		if options.Load().TLSMinVersion != 0 {
+			config.MinVersion = options.Load().TLSMinVersion
+		}
+		if len(options.Load().TLSCipherSuites) != 0 {
+			config.CipherSuites = options.Load().TLSCipherSuites
+		}
+	}
+}
+
+// probeTLSConfig returns the tls config instances are probed with, certificates are verified against the probe
+// authorities (system pool if none) unless skipVerify is set.
+func probeTLSConfig(options *CodeServerOption, skipVerify bool) *tls.Config {
+	config := &tls.Config{
+		RootCAs:            options.Load().ProbeRootCAs,
+		InsecureSkipVerify: skipVerify,
+	}
+	ServerTLSOptions(options)(config)
+	return config
+}
+
+// newProbeTransport returns the transport instances are probed with, it's shared by probes so that connections are
+// reused.
+func newProbeTransport(options *CodeServerOption) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = probeTLSConfig(options, false)
+	return transport
+}
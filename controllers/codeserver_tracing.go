@@ -0,0 +1,406 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TracingServiceName is the service name of spans exported by operator
+	TracingServiceName = "code-server-operator"
+	// TracingBatchInterval is the interval in seconds of exporting finished spans
+	TracingBatchInterval = 5
+	// TracingQueueSize is the number of finished spans buffered, spans are dropped when exporter falls behind
+	TracingQueueSize = 4096
+)
+
+// otlp span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+	statusCodeError  = 2
+)
+
+// Tracer records spans of reconciles, probes and calls to kubernetes and lxd, and exports them to an
+// OTLP/HTTP endpoint. A nil tracer and the spans it returns are no-ops, so tracing costs nothing when disabled.
+type Tracer struct {
+	endpoint string
+	http     *http.Client
+	log      logr.Logger
+	spans    chan *Span
+	lock     sync.Mutex
+	// active is the innermost unfinished span of each instance, calls made on behalf of instance are nested into it
+	active map[types.NamespacedName]*Span
+}
+
+// Span is a timed operation of a trace.
+type Span struct {
+	tracer   *Tracer
+	parent   *Span
+	key      *types.NamespacedName
+	traceID  [16]byte
+	spanID   [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []string
+	err      error
+	finished bool
+}
+
+// NewTracer returns the tracer exporting to endpoint, nil if endpoint is empty.
+func NewTracer(endpoint string, log logr.Logger) *Tracer {
+	if len(endpoint) == 0 {
+		return nil
+	}
+	return &Tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		http:     &http.Client{Timeout: 10 * time.Second},
+		log:      log,
+		spans:    make(chan *Span, TracingQueueSize),
+		active:   map[types.NamespacedName]*Span{},
+	}
+}
+
+// Start starts a span under parent, a new trace is started if parent is nil. attrs are key value pairs.
+func (t *Tracer) Start(parent *Span, name string, attrs ...string) *Span {
+	if t == nil {
+		return nil
+	}
+	span := &Span{
+		tracer: t,
+		parent: parent,
+		name:   name,
+		kind:   spanKindInternal,
+		start:  time.Now(),
+		attrs:  attrs,
+	}
+	if parent != nil {
+		span.traceID = parent.traceID
+	} else {
+		_, _ = rand.Read(span.traceID[:])
+	}
+	_, _ = rand.Read(span.spanID[:])
+	return span
+}
+
+// startClient starts the span of calling a remote service.
+func (t *Tracer) startClient(parent *Span, name string, attrs ...string) *Span {
+	span := t.Start(parent, name, attrs...)
+	if span != nil {
+		span.kind = spanKindClient
+	}
+	return span
+}
+
+// StartInstance starts a span working on the instance, spans of calls made for the instance are nested into it
+// until it ends.
+func (t *Tracer) StartInstance(parent *Span, key types.NamespacedName, name string, attrs ...string) *Span {
+	span := t.Start(parent, name, append([]string{"codeserver.namespace", key.Namespace,
+		"codeserver.name", key.Name}, attrs...)...)
+	if span == nil {
+		return nil
+	}
+	span.key = &key
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.active[key] = span
+	return span
+}
+
+// Active returns the innermost unfinished span of instance.
+func (t *Tracer) Active(key types.NamespacedName) *Span {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.active[key]
+}
+
+// Child starts a span under s, it becomes the active span of instance if s is.
+func (s *Span) Child(name string, attrs ...string) *Span {
+	if s == nil {
+		return nil
+	}
+	if s.key != nil {
+		return s.tracer.StartInstance(s, *s.key, name, attrs...)
+	}
+	return s.tracer.Start(s, name, attrs...)
+}
+
+// End finishes the span and queues it for export, err marks the span as failed.
+func (s *Span) End(err error) {
+	if s == nil || s.finished {
+		return
+	}
+	s.finished, s.end, s.err = true, time.Now(), err
+	t := s.tracer
+	if s.key != nil {
+		t.lock.Lock()
+		if t.active[*s.key] == s {
+			if s.parent != nil && s.parent.key != nil && *s.parent.key == *s.key && !s.parent.finished {
+				t.active[*s.key] = s.parent
+			} else {
+				delete(t.active, *s.key)
+			}
+		}
+		t.lock.Unlock()
+	}
+	select {
+	case t.spans <- s:
+	default:
+	}
+}
+
+func (t *Tracer) Run(stopCh <-chan struct{}) {
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(TracingBatchInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.export(); err != nil {
+				t.log.Error(err, "Failed to export spans.")
+			}
+		case <-stopCh:
+			if err := t.export(); err != nil {
+				t.log.Error(err, "Failed to export spans.")
+			}
+			return
+		}
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(attrs ...string) []otlpAttribute {
+	var result []otlpAttribute
+	for i := 0; i+1 < len(attrs); i += 2 {
+		result = append(result, otlpAttribute{Key: attrs[i], Value: otlpValue{StringValue: attrs[i+1]}})
+	}
+	return result
+}
+
+func (s *Span) otlp() otlpSpan {
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attrs...),
+	}
+	if s.parent != nil {
+		span.ParentSpanID = hex.EncodeToString(s.parent.spanID[:])
+	}
+	if s.err != nil {
+		span.Status = otlpStatus{Code: statusCodeError, Message: s.err.Error()}
+	}
+	return span
+}
+
+// export posts all queued spans in one OTLP/HTTP JSON request.
+func (t *Tracer) export() error {
+	var spans []otlpSpan
+	for len(spans) < TracingQueueSize {
+		select {
+		case span := <-t.spans:
+			spans = append(spans, span.otlp())
+			continue
+		default:
+		}
+		break
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes("service.name", TracingServiceName),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": TracingServiceName},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := t.http.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp endpoint %s responded with status code %d, %d spans dropped", t.endpoint,
+			resp.StatusCode, len(spans))
+	}
+	return nil
+}
+
+// tracingClient records a span for each call to kubernetes api, nested into the active span of the code server
+// the object belongs to.
+type tracingClient struct {
+	client.Client
+	tracer *Tracer
+}
+
+// NewTracingClient wraps c to trace its calls, c is returned as is if tracing is disabled.
+func NewTracingClient(c client.Client, tracer *Tracer) client.Client {
+	if tracer == nil {
+		return c
+	}
+	return &tracingClient{Client: c, tracer: tracer}
+}
+
+// startCall starts the span of calling verb on the object named key.
+func (c *tracingClient) startCall(verb string, obj runtime.Object, key client.ObjectKey,
+	owner *metav1.OwnerReference) *Span {
+	kind := obj.GetObjectKind().GroupVersionKind().Kind
+	if gvk, err := apiutil.GVKForObject(obj, c.Scheme()); err == nil {
+		kind = gvk.Kind
+	}
+	// owned resources are named after or controlled by their code server
+	parent := c.tracer.Active(key)
+	if parent == nil && owner != nil {
+		parent = c.tracer.Active(types.NamespacedName{Namespace: key.Namespace, Name: owner.Name})
+	}
+	return c.tracer.startClient(parent, fmt.Sprintf("k8s %s %s", verb, kind), "k8s.verb", verb, "k8s.kind",
+		kind, "k8s.namespace", key.Namespace, "k8s.name", key.Name)
+}
+
+// startWrite starts the span of writing obj.
+func (c *tracingClient) startWrite(verb string, obj client.Object) *Span {
+	return c.startCall(verb, obj, client.ObjectKeyFromObject(obj), metav1.GetControllerOf(obj))
+}
+
+func (c *tracingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	span := c.startCall("get", obj, key, nil)
+	err := c.Client.Get(ctx, key, obj)
+	span.End(err)
+	return err
+}
+
+func (c *tracingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	span := c.startCall("list", list, client.ObjectKey{Namespace: listOpts.Namespace}, nil)
+	err := c.Client.List(ctx, list, opts...)
+	span.End(err)
+	return err
+}
+
+func (c *tracingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	span := c.startWrite("create", obj)
+	err := c.Client.Create(ctx, obj, opts...)
+	span.End(err)
+	return err
+}
+
+func (c *tracingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	span := c.startWrite("delete", obj)
+	err := c.Client.Delete(ctx, obj, opts...)
+	span.End(err)
+	return err
+}
+
+func (c *tracingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	span := c.startWrite("update", obj)
+	err := c.Client.Update(ctx, obj, opts...)
+	span.End(err)
+	return err
+}
+
+func (c *tracingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch,
+	opts ...client.PatchOption) error {
+	span := c.startWrite("patch", obj)
+	err := c.Client.Patch(ctx, obj, patch, opts...)
+	span.End(err)
+	return err
+}
+
+func (c *tracingClient) Status() client.StatusWriter {
+	return &tracingStatusWriter{StatusWriter: c.Client.Status(), client: c}
+}
+
+type tracingStatusWriter struct {
+	client.StatusWriter
+	client *tracingClient
+}
+
+func (w *tracingStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	span := w.client.startWrite("update status", obj)
+	err := w.StatusWriter.Update(ctx, obj, opts...)
+	span.End(err)
+	return err
+}
+
+func (w *tracingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch,
+	opts ...client.PatchOption) error {
+	span := w.client.startWrite("patch status", obj)
+	err := w.StatusWriter.Patch(ctx, obj, patch, opts...)
+	span.End(err)
+	return err
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	TraefikAPIGroup   = "traefik.containo.us"
+	TraefikMiddleware = "%s-%s"
+	TraefikAuth       = "auth"
+	TraefikStrip      = "strip"
+	TraefikHeaders    = "headers"
+	TraefikCompress   = "compress"
+)
+
+var IngressRouteGVK = schema.GroupVersionKind{
+	Group:   TraefikAPIGroup,
+	Version: "v1alpha1",
+	Kind:    "IngressRoute",
+}
+
+var MiddlewareGVK = schema.GroupVersionKind{
+	Group:   TraefikAPIGroup,
+	Version: "v1alpha1",
+	Kind:    "Middleware",
+}
+
+// TraefikMiddlewareOrder is the order middlewares are applied in, authentication goes first.
+var TraefikMiddlewareOrder = []string{TraefikAuth, TraefikStrip, TraefikHeaders, TraefikCompress}
+
+// traefikMiddlewares returns the specs of middlewares of instance, disabled ones are nil.
+func (r *CodeServerReconciler) traefikMiddlewares(m *csv1alpha1.CodeServer) map[string]map[string]interface{} {
+	middlewares := map[string]map[string]interface{}{
+		TraefikAuth:  nil,
+		TraefikStrip: nil,
+		// code server and exporter rely on the forwarded headers to build redirects and websocket origins
+		TraefikHeaders: {
+			"headers": map[string]interface{}{
+				"customRequestHeaders": map[string]interface{}{"X-Forwarded-Proto": "https"},
+			},
+		},
+		TraefikCompress: {"compress": map[string]interface{}{}},
+	}
+	if len(r.Options.Load().TraefikAuthURL) != 0 {
+		middlewares[TraefikAuth] = map[string]interface{}{
+			"forwardAuth": map[string]interface{}{
+				"address":            r.Options.Load().TraefikAuthURL,
+				"trustForwardHeader": true,
+			},
+		}
+	}
+	if prefix := instancePathPrefix(m); len(prefix) != 0 {
+		middlewares[TraefikStrip] = map[string]interface{}{
+			"stripPrefix": map[string]interface{}{"prefixes": []interface{}{prefix}},
+		}
+	}
+	return middlewares
+}
+
+// reconcileForTraefik routes instance with traefik IngressRoute, the middlewares are reconciled before route
+// since traefik rejects routes referring to missing middlewares.
+func (r *CodeServerReconciler) reconcileForTraefik(codeServer *csv1alpha1.CodeServer) error {
+	var enabled []interface{}
+	middlewares := r.traefikMiddlewares(codeServer)
+	for _, name := range TraefikMiddlewareOrder {
+		spec := middlewares[name]
+		middlewareName := fmt.Sprintf(TraefikMiddleware, codeServer.Name, name)
+		if spec == nil {
+			if err := r.deleteUnstructuredIfExists(MiddlewareGVK, middlewareName, codeServer.Namespace); err != nil {
+				return err
+			}
+			continue
+		}
+		middleware := &unstructured.Unstructured{}
+		middleware.SetGroupVersionKind(MiddlewareGVK)
+		middleware.SetName(middlewareName)
+		middleware.SetNamespace(codeServer.Namespace)
+		middleware.Object["spec"] = spec
+		if err := r.reconcileForUnstructured(codeServer, middleware); err != nil {
+			return err
+		}
+		enabled = append(enabled, map[string]interface{}{"name": middlewareName})
+	}
+	return r.reconcileForUnstructured(codeServer, r.newIngressRoute(codeServer, enabled))
+}
+
+func (r *CodeServerReconciler) deleteTraefikResources(name, namespace string) error {
+	if err := r.deleteUnstructuredIfExists(IngressRouteGVK, ChildName(TerminalIngress, name), namespace); err != nil {
+		return err
+	}
+	for _, middleware := range TraefikMiddlewareOrder {
+		if err := r.deleteUnstructuredIfExists(MiddlewareGVK, fmt.Sprintf(TraefikMiddleware, name, middleware),
+			namespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newIngressRoute returns the IngressRoute of instance on the configured entry points.
+func (r *CodeServerReconciler) newIngressRoute(m *csv1alpha1.CodeServer, middlewares []interface{}) *unstructured.Unstructured {
+	match := fmt.Sprintf("Host(`%s`)", r.instanceHost(m))
+	if prefix := instancePathPrefix(m); len(prefix) != 0 {
+		match = fmt.Sprintf("%s && PathPrefix(`%s`)", match, prefix)
+	}
+	var entryPoints []interface{}
+	for _, entryPoint := range r.Options.Load().TraefikEntryPoints {
+		entryPoints = append(entryPoints, entryPoint)
+	}
+	route := map[string]interface{}{
+		"match": match,
+		"kind":  "Rule",
+		"services": []interface{}{
+			map[string]interface{}{"name": m.Name, "port": int64(HttpPort)},
+		},
+	}
+	if len(middlewares) != 0 {
+		route["middlewares"] = middlewares
+	}
+	spec := map[string]interface{}{
+		"routes": []interface{}{route},
+	}
+	if len(entryPoints) != 0 {
+		spec["entryPoints"] = entryPoints
+	}
+	if len(r.Options.Load().HttpsSecretName) != 0 {
+		spec["tls"] = map[string]interface{}{"secretName": r.Options.Load().HttpsSecretName}
+	}
+	ir := &unstructured.Unstructured{}
+	ir.SetGroupVersionKind(IngressRouteGVK)
+	ir.SetName(ChildName(TerminalIngress, m.Name))
+	ir.SetNamespace(m.Namespace)
+	ir.Object["spec"] = spec
+	return ir
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// CodeServerTTL deletes or hibernates instances once their ttl expired regardless of activity, e.g. instances of
+// workshops which must disappear after the event.
+type CodeServerTTL struct {
+	client.Client
+	Log      logr.Logger
+	Options  *CodeServerOption
+	recorder record.EventRecorder
+}
+
+func NewCodeServerTTL(client client.Client, log logr.Logger, options *CodeServerOption,
+	recorder record.EventRecorder) *CodeServerTTL {
+	return &CodeServerTTL{
+		client,
+		log,
+		options,
+		recorder,
+	}
+}
+
+func (t *CodeServerTTL) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(t.Options.Load().TTLInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.Sweep()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// expiry returns the time instance expires, zero if no ttl applies.
+func expiry(codeServer *csv1alpha1.CodeServer) time.Time {
+	var expireAt time.Time
+	earlier := func(at time.Time) {
+		if expireAt.IsZero() || at.Before(expireAt) {
+			expireAt = at
+		}
+	}
+	if ttl := codeServer.Spec.TTLSecondsAfterCreation; ttl != nil {
+		earlier(codeServer.CreationTimestamp.Add(time.Duration(*ttl) * time.Second))
+	}
+	if ttl := codeServer.Spec.TTLSecondsAfterReady; ttl != nil && codeServer.Status.FirstReadyTime != nil {
+		earlier(codeServer.Status.FirstReadyTime.Add(time.Duration(*ttl) * time.Second))
+	}
+	return expireAt
+}
+
+// Sweep deletes or hibernates the expired instances of this shard, paused instances are skipped.
+func (t *CodeServerTTL) Sweep() {
+	codeServers := &csv1alpha1.CodeServerList{}
+	if err := t.Client.List(context.TODO(), codeServers); err != nil {
+		t.Log.Error(err, "Failed to list code servers for ttl.")
+		return
+	}
+	now := time.Now()
+	for i := range codeServers.Items {
+		codeServer := &codeServers.Items[i]
+		if !InShard(t.Options, codeServer) || paused(codeServer) || !codeServer.DeletionTimestamp.IsZero() {
+			continue
+		}
+		expireAt := expiry(codeServer)
+		if expireAt.IsZero() || now.Before(expireAt) {
+			continue
+		}
+		if codeServer.Spec.TTLAction == csv1alpha1.TTLHibernate {
+			t.hibernate(codeServer, expireAt)
+		} else {
+			t.delete(codeServer, expireAt)
+		}
+	}
+}
+
+func (t *CodeServerTTL) delete(codeServer *csv1alpha1.CodeServer, expireAt time.Time) {
+	reqLogger := instanceLogger(t.Log, codeServer)
+	if err := t.Client.Delete(context.TODO(), codeServer); err != nil && !errors.IsNotFound(err) {
+		reqLogger.Error(err, "Failed to delete expired code server.")
+		return
+	}
+	reqLogger.Info(fmt.Sprintf("code server expired at %s has been deleted", expireAt.UTC().Format(time.RFC3339)))
+	t.recorder.Event(codeServer, corev1.EventTypeNormal, EventExpired, "Code server has expired and been deleted")
+}
+
+// hibernate marks expired instance inactive, instance woken afterwards is marked inactive again.
+func (t *CodeServerTTL) hibernate(codeServer *csv1alpha1.CodeServer, expireAt time.Time) {
+	if HasCondition(codeServer.Status, csv1alpha1.ServerInactive) ||
+		HasCondition(codeServer.Status, csv1alpha1.ServerRecycled) {
+		return
+	}
+	reqLogger := instanceLogger(t.Log, codeServer)
+	reason := fmt.Sprintf("code server expired at %s", expireAt.UTC().Format(time.RFC3339))
+	clearPendingRecycle(codeServer, reason)
+	if !SetCondition(&codeServer.Status, NewStateCondition(csv1alpha1.ServerInactive, reason, map[string]string{},
+		corev1.ConditionTrue)) {
+		return
+	}
+	if err := t.Client.Update(context.TODO(), codeServer); err != nil {
+		reqLogger.Error(err, "Failed to hibernate expired code server.")
+		return
+	}
+	t.recorder.Event(codeServer, corev1.EventTypeNormal, EventExpired,
+		"Code server has expired, compute resources will be released")
+}
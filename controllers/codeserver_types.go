@@ -17,9 +17,14 @@ limitations under the License.
 package controllers
 
 import (
+	"crypto/x509"
 	"k8s.io/apimachinery/pkg/types"
+	"sync/atomic"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
 )
 
 type CodeServerOption struct {
@@ -31,6 +36,137 @@ type CodeServerOption struct {
 	LxdClientSecretName string
 	EnableUserIngress   bool
 	MaxConcurrency      int
+	DisableDocker       bool
+	DindImage           string
+	BuildkitImage       string
+	SSHImage            string
+	AuditSinkType       string
+	AuditSinkURL        string
+	AuditKafkaTopic     string
+	// AuditDeletionWebhook is set if deletions are recorded by CodeServerDeletionAuditor.
+	AuditDeletionWebhook  bool
+	NotificationURL       string
+	NotificationFormat    string
+	RecycleNotifyLead     int
+	InactiveGracePeriod   int
+	RolloutImage          string
+	RolloutInterval       int
+	RolloutMaxUnavail     int
+	SkipArchCheck         bool
+	APIServerAddr         string
+	APITokenFile          string
+	APIServerCertDir      string
+	OperatorConfigName    string
+	ConfigFile            string
+	LxdRemotesFile        string
+	TeamLabel             string
+	SpreadTopologyKey     string
+	OwnershipImage        string
+	ActivityAddr          string
+	ActivityPushURL       string
+	IngressAccessLog      string
+	FinalizerTimeout      int
+	GCInterval            int
+	WatchNamespaces       []string
+	ShardCount            int
+	ShardID               int
+	CreateQPS             float64
+	CreateBurst           int
+	BackgroundConcurrency int
+	StatusFlushInterval   int
+	IngressProvider       string
+	MeshGateway           string
+	TraefikEntryPoints    []string
+	TraefikAuthURL        string
+	ActivatorAddr         string
+	ActivatorService      string
+	ActivatorTimeout      int
+	JupyterHubTemplate    string
+	PrepullNamespace      string
+	PrepullProvider       string
+	PrepullImages         []string
+	PrepullNodeSelector   map[string]string
+	PrepullInterval       int
+	ImagePullSecret       string
+	PullSecretNamespace   string
+	SchedulingProfiles    []csv1alpha1.SchedulingProfile
+	ResourceBounds        []csv1alpha1.ResourceBounds
+	SessionStoreURL       string
+	SessionStoreSecret    string
+	SessionRecorderImage  string
+	SessionRetentionDays  int
+	RecordSessions        bool
+	DriftMode             string
+	DryRun                bool
+	TTLInterval           int
+	FleetStatusInterval   int
+	TracingEndpoint       string
+	LogEvents             bool
+	ProbeWorkers          int
+	ProbeTimeout          int
+	ProbeHostConcurrency  int
+	FilterUpdates         bool
+	ArchiveImage          string
+	CostLabels            bool
+	PriceSheet            *PriceSheet
+	BudgetInterval        int
+	EntitlementInterval   int
+	LDAPURL               string
+	LDAPBindDN            string
+	LDAPBindPasswordFile  string
+	LDAPUserBaseDN        string
+	LDAPUserFilter        string
+	LDAPUserAttribute     string
+	LDAPGroupAttribute    string
+	OAuth2ProxyURL        string
+	AdditionalPortsIP     string
+	AdditionalPortRange   string
+	ACMEDirectoryURL      string
+	ACMEEmail             string
+	ACMEAccountKeyFile    string
+	// ACMEAccountSecret is the secret <namespace>/<name> the generated acme account key is kept in when no key
+	// file is specified.
+	ACMEAccountSecret string
+	IngressIPFamilies []string
+	RegistryMirrors   map[string]string
+	TLSMinVersion     uint16
+	TLSCipherSuites   []uint16
+	ProbeRootCAs      *x509.CertPool
+	// ProbeVerifyCertificates requires certificates served on hosts of instances to be verified when probing them.
+	ProbeVerifyCertificates bool
+	// UserNamespaces places the instances of every code server user in a namespace dedicated to the user.
+	UserNamespaces      bool
+	UserNamespacePrefix string
+	UserNamespaceRole   string
+	// InstanceDefaults are the lowest level of hierarchical defaulting of instance spec.
+	InstanceDefaults *csv1alpha1.CodeServerSpec
+	// HostPathPrefixes are the directories of node whose tenant sub directories, i.e. <namespace>[/<user>],
+	// instances are allowed to mount, host paths are denied if empty.
+	HostPathPrefixes []string
+	// ShareIngressNamespace is the namespace of ingress controller, the only peer allowed to connect to the pods
+	// serving workspaces to collaborators.
+	ShareIngressNamespace string
+	// ArchiveURLPrefixes are the urls workspace archives are allowed to be exported to and imported from, e.g. the
+	// bucket of object store, archives are denied if empty.
+	ArchiveURLPrefixes []string
+	// SMBDriver is the csi driver mounting SMB shared folders.
+	SMBDriver string
+	// EnableBucketMounts allows the privileged FUSE sidecars mounting buckets, they are denied by default.
+	EnableBucketMounts bool
+	BucketMountImage   string
+	// active holds the snapshot published by OptionStore, options are never modified in place once published.
+	active *atomic.Value
+}
+
+// Load returns the active options which must not be modified, options are replaced as a whole on reload so that
+// readers never observe options half reloaded. Options not managed by OptionStore are returned as is.
+func (o *CodeServerOption) Load() *CodeServerOption {
+	if o.active != nil {
+		if active, ok := o.active.Load().(*CodeServerOption); ok {
+			return active
+		}
+	}
+	return o
 }
 
 type WatchType string
@@ -43,9 +179,13 @@ const (
 )
 
 type CodeServerRequest struct {
-	resource     types.NamespacedName
-	duration     int64
-	operate      WatchType
-	endpoint     string
-	inactiveTime metav1.Time
+	resource       types.NamespacedName
+	duration       int64
+	operate        WatchType
+	endpoint       string
+	notifyEndpoint string
+	inactiveTime   metav1.Time
+	activity       *csv1alpha1.ActivitySpec
+	host           string
+	pendingSince   time.Time
 }
@@ -0,0 +1,259 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"math"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sync"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// StatsCacheSeconds is the duration node stats summary is reused among instances on the same node.
+const StatsCacheSeconds = 10
+
+// UsageRefreshInterval is the interval update time of unchanged usage is refreshed.
+const UsageRefreshInterval = 5 * time.Minute
+
+// UsageChangeRatio is the relative change of usage which is reported before the reported usage becomes stale.
+const UsageChangeRatio = 0.1
+
+var PodMetricsGVK = schema.GroupVersionKind{Group: "metrics.k8s.io", Version: "v1beta1", Kind: "PodMetrics"}
+
+// statsSummary is the part of kubelet stats summary used for volume usage.
+type statsSummary struct {
+	Pods []struct {
+		PodRef struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"podRef"`
+		Volume []struct {
+			UsedBytes     *int64 `json:"usedBytes"`
+			CapacityBytes *int64 `json:"capacityBytes"`
+			PVCRef        *struct {
+				Name string `json:"name"`
+			} `json:"pvcRef"`
+		} `json:"volume"`
+	} `json:"pods"`
+}
+
+type statsCacheEntry struct {
+	summary   *statsSummary
+	expiredAt time.Time
+}
+
+// UsageCollector collects resource consumption of instances from metrics server and kubelet stats summary.
+type UsageCollector struct {
+	client.Client
+	Log        logr.Logger
+	kubeClient kubernetes.Interface
+	lock       sync.Mutex
+	stats      map[string]statsCacheEntry
+	history    map[string]*usageHistory
+}
+
+func NewUsageCollector(client client.Client, kubeClient kubernetes.Interface, log logr.Logger) *UsageCollector {
+	return &UsageCollector{
+		Client:     client,
+		Log:        log,
+		kubeClient: kubeClient,
+		stats:      make(map[string]statsCacheEntry),
+		history:    make(map[string]*usageHistory),
+	}
+}
+
+// Collect returns the usage of instance, usage unavailable (e.g. metrics server not installed) is left empty.
+func (u *UsageCollector) Collect(m *csv1alpha1.CodeServer) (*csv1alpha1.UsageStatus, error) {
+	pods := &corev1.PodList{}
+	if err := u.Client.List(context.TODO(), pods, client.InNamespace(m.Namespace),
+		client.MatchingLabels(appLabel(m.Name))); err != nil {
+		return nil, err
+	}
+	var pod *corev1.Pod
+	for index := range pods.Items {
+		if pods.Items[index].Status.Phase == corev1.PodRunning {
+			pod = &pods.Items[index]
+			break
+		}
+	}
+	usage := &csv1alpha1.UsageStatus{}
+	if pod == nil {
+		return usage, nil
+	}
+	reqLogger := instanceLogger(u.Log, m)
+	if err := u.collectMetrics(pod, usage); err != nil {
+		reqLogger.Info(fmt.Sprintf("skip collecting cpu and memory usage: %v", err))
+	}
+	if err := u.collectVolume(pod, m.Name, usage); err != nil {
+		reqLogger.Info(fmt.Sprintf("skip collecting workspace volume usage: %v", err))
+	}
+	return usage, nil
+}
+
+func (u *UsageCollector) collectMetrics(pod *corev1.Pod, usage *csv1alpha1.UsageStatus) error {
+	metrics := &unstructured.Unstructured{}
+	metrics.SetGroupVersionKind(PodMetricsGVK)
+	if err := u.Client.Get(context.TODO(), types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace},
+		metrics); err != nil {
+		return err
+	}
+	containers, _, err := unstructured.NestedSlice(metrics.Object, "containers")
+	if err != nil {
+		return err
+	}
+	cpu, memory := resource.Quantity{}, resource.Quantity{}
+	for _, container := range containers {
+		values, ok := container.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for name, total := range map[string]*resource.Quantity{"cpu": &cpu, "memory": &memory} {
+			value, _, _ := unstructured.NestedString(values, "usage", name)
+			if quantity, err := resource.ParseQuantity(value); err == nil {
+				total.Add(quantity)
+			}
+		}
+	}
+	usage.CPU, usage.Memory = &cpu, &memory
+	return nil
+}
+
+func (u *UsageCollector) collectVolume(pod *corev1.Pod, claimName string, usage *csv1alpha1.UsageStatus) error {
+	if len(pod.Spec.NodeName) == 0 {
+		return nil
+	}
+	summary, err := u.nodeStats(pod.Spec.NodeName)
+	if err != nil {
+		return err
+	}
+	for _, podStats := range summary.Pods {
+		if podStats.PodRef.Name != pod.Name || podStats.PodRef.Namespace != pod.Namespace {
+			continue
+		}
+		for _, volume := range podStats.Volume {
+			if volume.PVCRef == nil || volume.PVCRef.Name != claimName {
+				continue
+			}
+			if volume.UsedBytes != nil {
+				usage.StorageUsed = resource.NewQuantity(*volume.UsedBytes, resource.BinarySI)
+			}
+			if volume.CapacityBytes != nil {
+				usage.StorageCapacity = resource.NewQuantity(*volume.CapacityBytes, resource.BinarySI)
+			}
+		}
+	}
+	return nil
+}
+
+// nodeStats returns kubelet stats summary of node via api server proxy.
+func (u *UsageCollector) nodeStats(node string) (*statsSummary, error) {
+	u.lock.Lock()
+	entry, found := u.stats[node]
+	u.lock.Unlock()
+	if found && time.Now().Before(entry.expiredAt) {
+		return entry.summary, nil
+	}
+	content, err := u.kubeClient.CoreV1().RESTClient().Get().Resource("nodes").Name(node).
+		SubResource("proxy").Suffix("stats/summary").DoRaw(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	summary := &statsSummary{}
+	if err := json.Unmarshal(content, summary); err != nil {
+		return nil, err
+	}
+	u.lock.Lock()
+	u.stats[node] = statsCacheEntry{
+		summary:   summary,
+		expiredAt: time.Now().Add(StatsCacheSeconds * time.Second),
+	}
+	u.lock.Unlock()
+	return summary, nil
+}
+
+// reportUsage refreshes the usage in status of the active instance.
+func (cs *CodeServerWatcher) reportUsage(req types.NamespacedName, lastActive time.Time) {
+	if cs.usage == nil {
+		return
+	}
+	reqLogger := keyLogger(cs.Log, req)
+	codeServer := &csv1alpha1.CodeServer{}
+	if err := cs.Client.Get(context.TODO(), req, codeServer); err != nil {
+		if errors.IsNotFound(err) {
+			cs.usage.Forget(req.String())
+			return
+		}
+		reqLogger.Error(err, "Failed to get code server for usage report.")
+		return
+	}
+	usage, err := cs.usage.Collect(codeServer)
+	if err != nil {
+		reqLogger.Error(err, "Failed to collect code server usage.")
+		return
+	}
+	lastActiveTime := metav1.NewTime(lastActive)
+	usage.LastActiveTime = &lastActiveTime
+	recommendation := cs.usage.Recommend(req.String(), usage)
+	cs.status.Enqueue(req, func(status *csv1alpha1.CodeServerStatus) {
+		// small fluctuations are only reported once the reported usage becomes stale, so that status
+		// is not written on every probe
+		if status.Usage == nil || status.Usage.UpdateTime == nil ||
+			time.Since(status.Usage.UpdateTime.Time) >= UsageRefreshInterval || usageChanged(status.Usage, usage) {
+			now := metav1.Now()
+			usage.UpdateTime = &now
+			status.Usage = usage
+		}
+		if recommendation != nil {
+			if status.RightSizing != nil {
+				recommendation.AppliedCPU = status.RightSizing.AppliedCPU
+				recommendation.AppliedMemory = status.RightSizing.AppliedMemory
+			}
+			status.RightSizing = recommendation
+		}
+	})
+}
+
+// usageChanged returns whether current usage differs noticeably from the reported one.
+func usageChanged(reported, current *csv1alpha1.UsageStatus) bool {
+	return quantityChanged(reported.CPU, current.CPU) || quantityChanged(reported.Memory, current.Memory) ||
+		quantityChanged(reported.StorageUsed, current.StorageUsed) ||
+		!equality.Semantic.DeepEqual(reported.StorageCapacity, current.StorageCapacity)
+}
+
+// quantityChanged returns whether current quantity differs from the reported one by more than UsageChangeRatio.
+func quantityChanged(reported, current *resource.Quantity) bool {
+	if reported == nil || current == nil {
+		return reported != current
+	}
+	diff := math.Abs(float64(current.MilliValue() - reported.MilliValue()))
+	return diff > UsageChangeRatio*math.Abs(float64(reported.MilliValue()))
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// ViewSessionAnnotation opens a read-only view session into the instance for support, the value is the admin
+	// the session is opened for.
+	ViewSessionAnnotation = "codeserver.io/view-session"
+	// ViewSessionExpiresAnnotation is the time in RFC3339 when the view session ends, session without it ends
+	// immediately.
+	ViewSessionExpiresAnnotation = "codeserver.io/view-session-expires"
+	// ViewSessionStartedAnnotation marks the credentials secret whose session has been recorded as started.
+	ViewSessionStartedAnnotation = "codeserver.io/view-session-started"
+	// ViewSessionResource names the secret which holds the credentials of view session.
+	ViewSessionResource = "%s-view-session"
+	ViewSessionDataDir  = "/tmp/code-server-view"
+	// ViewSessionSettingsKey is the key of user settings of view session in credentials secret, which are mounted
+	// read-only so that they can't be changed in session.
+	ViewSessionSettingsKey    = "settings.json"
+	DefaultViewSessionMinutes = 30
+	MaxViewSessionMinutes     = 240
+)
+
+// viewSessionAccess serves the view session next to the accesses of collaborators, it's never granted to
+// collaborators.
+const viewSessionAccess csv1alpha1.CollaboratorAccess = "ViewSession"
+
+// viewSessionSettings disable the terminal of view session, every shell profile detected is removed and the only
+// one left exits immediately, so that the session can't run commands in the pod.
+const viewSessionSettings = `{
+  "terminal.integrated.profiles.linux": {
+    "disabled": {"path": "/bin/false"},
+    "bash": null,
+    "sh": null,
+    "zsh": null,
+    "fish": null,
+    "tmux": null,
+    "pwsh": null
+  },
+  "terminal.integrated.defaultProfile.linux": "disabled",
+  "terminal.integrated.automationProfile.linux": {"path": "/bin/false"},
+  "terminal.integrated.shell.linux": "/bin/false",
+  "terminal.integrated.inheritEnv": false,
+  "task.autoDetect": "off",
+  "extensions.autoUpdate": false
+}
+`
+
+// viewSession is the active view session of instance.
+type viewSession struct {
+	Admin    string
+	Password []byte
+	Expires  time.Time
+}
+
+// viewSessionCredentials returns the credentials secret of view session for admin, password is generated if
+// secret doesn't exist, belongs to another admin or rotate is requested. A new password starts a new session.
+func viewSessionCredentials(c client.Client, m *csv1alpha1.CodeServer, admin string, rotate bool) (*corev1.Secret,
+	error) {
+	name := ChildName(ViewSessionResource, m.Name)
+	secret := &corev1.Secret{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: m.Namespace}, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	found := err == nil
+	if found && !rotate && string(secret.Data["user"]) == admin && len(secret.Data["password"]) != 0 {
+		if string(secret.Data[ViewSessionSettingsKey]) == viewSessionSettings {
+			return secret, nil
+		}
+		// sessions opened before keep their password
+		secret.Data[ViewSessionSettingsKey] = []byte(viewSessionSettings)
+		return secret, c.Update(context.TODO(), secret)
+	}
+	password, err := randomHex(AuthPasswordBytes)
+	if err != nil {
+		return nil, err
+	}
+	secret.Name, secret.Namespace = name, m.Namespace
+	secret.Annotations = nil
+	secret.Data = map[string][]byte{"user": []byte(admin), "password": []byte(password),
+		ViewSessionSettingsKey: []byte(viewSessionSettings)}
+	setOwnedLabels(secret, m.Name)
+	if found {
+		return secret, c.Update(context.TODO(), secret)
+	}
+	secret.OwnerReferences = []metav1.OwnerReference{
+		*metav1.NewControllerRef(m, csv1alpha1.GroupVersion.WithKind("CodeServer"))}
+	return secret, c.Create(context.TODO(), secret)
+}
+
+// reconcileForViewSession returns the active view session of instance and the time until it ends, negative if
+// there's none. Session which expired or can't be served is ended and its annotations are removed.
+func (r *CodeServerReconciler) reconcileForViewSession(codeServer *csv1alpha1.CodeServer,
+	now time.Time) (*viewSession, time.Duration, error) {
+	admin := codeServer.Annotations[ViewSessionAnnotation]
+	if len(admin) == 0 {
+		return nil, -1, r.deleteResourceIfExists(&corev1.Secret{}, ChildName(ViewSessionResource,
+			codeServer.Name), codeServer.Namespace)
+	}
+	expires, err := time.Parse(time.RFC3339, codeServer.Annotations[ViewSessionExpiresAnnotation])
+	if err != nil {
+		return nil, -1, r.endViewSession(codeServer, admin, corev1.EventTypeWarning,
+			fmt.Sprintf("invalid expiry of view session: %v", err))
+	}
+	if !expires.After(now) {
+		return nil, -1, r.endViewSession(codeServer, admin, corev1.EventTypeNormal, "session expired")
+	}
+	if err := r.validateCollaborators(codeServer); err != nil {
+		return nil, -1, r.endViewSession(codeServer, admin, corev1.EventTypeWarning, err.Error())
+	}
+	secret, err := viewSessionCredentials(r.Client, codeServer, admin, false)
+	if err != nil {
+		return nil, -1, err
+	}
+	if len(secret.Annotations[ViewSessionStartedAnnotation]) == 0 {
+		message := fmt.Sprintf("Read-only view session opened for %s until %s", admin,
+			expires.UTC().Format(time.RFC3339))
+		r.instanceLog(codeServer).Info(message)
+		r.Recorder.Event(codeServer, corev1.EventTypeNormal, EventViewSessionStarted, message)
+		r.Auditor.Record(codeServer, AuditViewSessionStarted, message)
+		secret.Annotations = map[string]string{ViewSessionStartedAnnotation: now.UTC().Format(time.RFC3339)}
+		if err := r.Client.Update(context.TODO(), secret); err != nil {
+			return nil, -1, err
+		}
+	}
+	return &viewSession{Admin: admin, Password: secret.Data["password"], Expires: expires}, expires.Sub(now), nil
+}
+
+// endViewSession removes the annotations and credentials of view session and records why it ended, resources
+// serving the session are removed by share reconcile.
+func (r *CodeServerReconciler) endViewSession(codeServer *csv1alpha1.CodeServer, admin, eventType,
+	reason string) error {
+	delete(codeServer.Annotations, ViewSessionAnnotation)
+	delete(codeServer.Annotations, ViewSessionExpiresAnnotation)
+	if err := r.Client.Update(context.TODO(), codeServer); err != nil {
+		return err
+	}
+	if err := r.deleteResourceIfExists(&corev1.Secret{}, ChildName(ViewSessionResource, codeServer.Name),
+		codeServer.Namespace); err != nil {
+		return err
+	}
+	message := fmt.Sprintf("Read-only view session of %s ended: %s", admin, reason)
+	r.instanceLog(codeServer).Info(message)
+	r.Recorder.Event(codeServer, eventType, EventViewSessionEnded, message)
+	r.Auditor.Record(codeServer, AuditViewSessionEnded, message)
+	return nil
+}
+
+// addViewSessionSettings mounts the settings of view session read-only and leaves no shell to the container, so
+// that the terminal is disabled.
+func addViewSessionSettings(m *csv1alpha1.CodeServer, podSpec *corev1.PodSpec) {
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "view-session-settings",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: ChildName(ViewSessionResource, m.Name),
+				Items:      []corev1.KeyToPath{{Key: ViewSessionSettingsKey, Path: ViewSessionSettingsKey}},
+			},
+		},
+	})
+	container := &podSpec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "view-session-settings",
+		MountPath: ViewSessionDataDir + "/User/" + ViewSessionSettingsKey,
+		SubPath:   ViewSessionSettingsKey,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env, corev1.EnvVar{Name: "SHELL", Value: "/bin/false"})
+}
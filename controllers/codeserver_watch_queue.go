@@ -0,0 +1,84 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sync"
+)
+
+// WatchQueueName names the queue of watcher in workqueue metrics, e.g. workqueue_depth and workqueue_retries_total.
+const WatchQueueName = "codeserver_watcher"
+
+type watchItemKind string
+
+const (
+	// inactiveWatchItem and recycleWatchItem apply the latest watch request of instance sent by reconciler
+	inactiveWatchItem watchItemKind = "InactiveWatch"
+	recycleWatchItem  watchItemKind = "RecycleWatch"
+	// markInactiveItem and markRecycledItem transit instance, they are retried with backoff until succeeded
+	markInactiveItem watchItemKind = "MarkInactive"
+	markRecycledItem watchItemKind = "MarkRecycled"
+)
+
+// watchItem is the unit of work of watcher.
+type watchItem struct {
+	resource types.NamespacedName
+	kind     watchItemKind
+}
+
+// WatchQueue passes watch requests from reconciler to watcher and the transitions decided by watcher to its worker.
+// Adding never blocks nor drops work, and multiple requests of the same instance are collapsed into the latest one.
+type WatchQueue struct {
+	queue  workqueue.RateLimitingInterface
+	lock   sync.Mutex
+	latest map[watchItem]CodeServerRequest
+}
+
+func NewWatchQueue() *WatchQueue {
+	return &WatchQueue{
+		queue:  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), WatchQueueName),
+		latest: map[watchItem]CodeServerRequest{},
+	}
+}
+
+// Add queues the watch request of reconciler.
+func (q *WatchQueue) Add(req CodeServerRequest) {
+	item := watchItem{resource: req.resource, kind: inactiveWatchItem}
+	if req.operate == AddRecycleWatch || req.operate == DeleteRecycleWatch {
+		item.kind = recycleWatchItem
+	}
+	q.lock.Lock()
+	q.latest[item] = req
+	q.lock.Unlock()
+	q.queue.Add(item)
+}
+
+// mark queues the transition of instance.
+func (q *WatchQueue) mark(resource types.NamespacedName, kind watchItemKind) {
+	q.queue.Add(watchItem{resource: resource, kind: kind})
+}
+
+// request pops the latest watch request of item.
+func (q *WatchQueue) request(item watchItem) (CodeServerRequest, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	req, found := q.latest[item]
+	delete(q.latest, item)
+	return req, found
+}
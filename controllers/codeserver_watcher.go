@@ -25,6 +25,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"net/http"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"strings"
@@ -42,144 +43,294 @@ type CodeServerWatcher struct {
 	Log           logr.Logger
 	Scheme        *runtime.Scheme
 	Options       *CodeServerOption
-	reqCh         <-chan CodeServerRequest
+	watches       *WatchQueue
 	probeCh       <-chan time.Time
 	inActiveCache *CodeServerActiveCache
 	recyclCache   *CodeServerRecycleCache
+	auditor       *Auditor
+	notifier      *Notifier
+	usage         *UsageCollector
+	activityCh    <-chan ActivityEvent
+	sources       map[csv1alpha1.ActivitySourceType]ActivitySource
+	recorder      record.EventRecorder
+	status        *StatusBatcher
+	tracer        *Tracer
+	probes        *ProbePool
 }
 
-func (cs *CodeServerWatcher) inActiveCodeServer(req types.NamespacedName) {
-	reqLogger := cs.Log.WithValues("codeserverwatcher", req)
+func (cs *CodeServerWatcher) inActiveCodeServer(req types.NamespacedName) error {
+	reqLogger := keyLogger(cs.Log, req)
 	codeServer := &csv1alpha1.CodeServer{}
 	err := cs.Client.Get(context.TODO(), req, codeServer)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			reqLogger.Info("CodeServer has been deleted. Ignore inactive code server.")
-			return
+			return nil
 		}
+		return err
+	}
+	if paused(codeServer) {
+		reqLogger.Info("CodeServer has been paused. Ignore inactive code server.")
+		return nil
 	}
 	if !HasCondition(codeServer.Status, csv1alpha1.ServerInactive) && !HasCondition(codeServer.Status, csv1alpha1.ServerRecycled) {
 		inactiveCondition := NewStateCondition(csv1alpha1.ServerInactive,
 			"code server has been marked inactive", map[string]string{}, corev1.ConditionTrue)
+		clearPendingRecycle(codeServer, "code server has been marked inactive")
 		if SetCondition(&codeServer.Status, inactiveCondition) {
-			err := cs.Client.Update(context.TODO(), codeServer)
-			if err != nil {
-				reqLogger.Error(err, "Failed to update code server status.")
+			if err := cs.Client.Update(context.TODO(), codeServer); err != nil {
+				return err
 			}
+			cs.auditor.Record(codeServer, AuditInactive, inactiveCondition.Reason)
+			cs.recorder.Event(codeServer, corev1.EventTypeNormal, EventInactive,
+				"Code server has been marked inactive, compute resources will be released")
 		}
 	}
+	return nil
 }
 
-func (cs *CodeServerWatcher) recycleCodeServer(req types.NamespacedName) {
-	reqLogger := cs.Log.WithValues("codeserverwatcher", req)
+func (cs *CodeServerWatcher) recycleCodeServer(req types.NamespacedName) error {
+	reqLogger := keyLogger(cs.Log, req)
 	codeServer := &csv1alpha1.CodeServer{}
 	err := cs.Client.Get(context.TODO(), req, codeServer)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			reqLogger.Info("CodeServer has been deleted. Ignore recycle code server.")
-			return
+			return nil
 		}
+		return err
+	}
+	if paused(codeServer) {
+		reqLogger.Info("CodeServer has been paused. Ignore recycle code server.")
+		return nil
 	}
 	if !HasCondition(codeServer.Status, csv1alpha1.ServerRecycled) {
 		recycleCondition := NewStateCondition(csv1alpha1.ServerRecycled,
 			"code server has been marked recycled", map[string]string{}, corev1.ConditionTrue)
 		if SetCondition(&codeServer.Status, recycleCondition) {
-			err := cs.Client.Update(context.TODO(), codeServer)
-			if err != nil {
-				reqLogger.Error(err, "Failed to update code server status.")
+			if err := cs.Client.Update(context.TODO(), codeServer); err != nil {
+				return err
 			}
+			cs.auditor.Record(codeServer, AuditRecycled, recycleCondition.Reason)
+			cs.recorder.Event(codeServer, corev1.EventTypeNormal, EventRecycled,
+				"Code server has been recycled, all resources will be released")
 		}
 	}
+	return nil
+}
+
+func (cs *CodeServerWatcher) warnRecycleCodeServer(req types.NamespacedName, recycleTime time.Time) {
+	reqLogger := keyLogger(cs.Log, req)
+	codeServer := &csv1alpha1.CodeServer{}
+	err := cs.Client.Get(context.TODO(), req, codeServer)
+	if err != nil {
+		reqLogger.Error(err, "Failed to get code server for recycle warning.")
+		return
+	}
+	cs.notifier.Notify(codeServer, csv1alpha1.NotifyRecycleWarning,
+		fmt.Sprintf("code server will be recycled at %s", recycleTime.UTC().Format(time.RFC3339)))
 }
 
 func NewCodeServerWatcher(client client.Client, log logr.Logger, schema *runtime.Scheme,
-	options *CodeServerOption, reqCh <-chan CodeServerRequest, probeCh <-chan time.Time) *CodeServerWatcher {
+	options *CodeServerOption, watches *WatchQueue, probeCh <-chan time.Time,
+	auditor *Auditor, notifier *Notifier, usage *UsageCollector, activityCh <-chan ActivityEvent,
+	recorder record.EventRecorder, status *StatusBatcher, tracer *Tracer) *CodeServerWatcher {
 	cache := CodeServerActiveCache{}
 	cache.InactiveCaches = make(map[string]*CodeServerActiveStatus)
 	recycleCache := CodeServerRecycleCache{}
 	recycleCache.Caches = make(map[string]CodeServerRecycleStatus)
-	return &CodeServerWatcher{
+	watcher := &CodeServerWatcher{
 		client,
 		log,
 		schema,
 		options,
-		reqCh,
+		watches,
 		probeCh,
 		&cache,
 		&recycleCache,
+		auditor,
+		notifier,
+		usage,
+		activityCh,
+		map[csv1alpha1.ActivitySourceType]ActivitySource{},
+		recorder,
+		status,
+		tracer,
+		NewProbePool(options),
 	}
+	watcher.RegisterActivitySource(csv1alpha1.ActivitySourceExporter, &exporterActivitySource{cs: watcher})
+	watcher.RegisterActivitySource(csv1alpha1.ActivitySourceEndpoints, &endpointsActivitySource{
+		cs: watcher,
+		client: &http.Client{
+			Timeout:   time.Duration(options.Load().ProbeTimeout) * time.Second,
+			Transport: watcher.probes.transport,
+		},
+	})
+	return watcher
 }
 
 func (cs *CodeServerWatcher) Run(stopCh <-chan struct{}) {
+	processed := make(chan struct{})
+	go func() {
+		defer close(processed)
+		cs.processQueue()
+	}()
 	for {
 		select {
-		case event := <-cs.reqCh:
-			switch event.operate {
-			case AddInactiveWatch:
-				cs.inActiveCache.AddOrUpdate(event)
-			case DeleteInactiveWatch:
-				cs.inActiveCache.Delete(event)
-			case AddRecycleWatch:
-				cs.recyclCache.AddOrUpdate(event)
-			case DeleteRecycleWatch:
-				cs.recyclCache.Delete(event)
-			}
+		case event := <-cs.activityCh:
+			cs.receiveActivity(event)
 		case <-cs.probeCh:
-			cs.ProbeAllCodeServer()
-			cs.ProbeAllInactivedCodeServer()
+			span := cs.tracer.Start(nil, "probe code servers")
+			cs.ProbeAllCodeServer(span)
+			cs.ProbeAllInactivedCodeServer(span)
+			span.End(nil)
 		case <-stopCh:
+			cs.discard()
+			// transitions queued so far are still processed, requests sent afterwards are ignored as watches are
+			// rebuilt by reconciling all instances on startup, and pending recycles are restored from annotation
+			cs.watches.queue.ShutDown()
+			<-processed
 			return
 		}
 	}
 }
 
-func (cs *CodeServerWatcher) ProbeAllInactivedCodeServer() {
+// discard consumes activities after watcher stopped, so that activity server doesn't block on sending them.
+func (cs *CodeServerWatcher) discard() {
+	go func() {
+		for range cs.activityCh {
+		}
+	}()
+}
+
+// processQueue applies watch requests and transitions instances until queue shuts down, failed transitions are
+// retried with backoff.
+func (cs *CodeServerWatcher) processQueue() {
+	for {
+		obj, shutdown := cs.watches.queue.Get()
+		if shutdown {
+			return
+		}
+		item := obj.(watchItem)
+		span := cs.tracer.StartInstance(nil, item.resource, string(item.kind))
+		err := cs.process(item)
+		span.End(err)
+		if err != nil {
+			keyLogger(cs.Log, item.resource).Error(err, fmt.Sprintf("Failed to process %s, it will be retried.",
+				item.kind))
+			cs.watches.queue.AddRateLimited(item)
+		} else {
+			cs.watches.queue.Forget(item)
+		}
+		cs.watches.queue.Done(item)
+	}
+}
+
+func (cs *CodeServerWatcher) process(item watchItem) error {
+	switch item.kind {
+	case markInactiveItem:
+		return cs.inActiveCodeServer(item.resource)
+	case markRecycledItem:
+		return cs.recycleCodeServer(item.resource)
+	}
+	req, found := cs.watches.request(item)
+	if !found {
+		return nil
+	}
+	switch req.operate {
+	case AddInactiveWatch:
+		cs.inActiveCache.AddOrUpdate(req)
+	case DeleteInactiveWatch:
+		cs.inActiveCache.Delete(req)
+	case AddRecycleWatch:
+		cs.recyclCache.AddOrUpdate(req)
+	case DeleteRecycleWatch:
+		cs.recyclCache.Delete(req)
+	}
+	return nil
+}
+
+func (cs *CodeServerWatcher) ProbeAllInactivedCodeServer(span *Span) {
 	reqLogger := cs.Log.WithName("codeserverwatcher")
 	for _, key := range cs.recyclCache.GetKeys() {
 		css := cs.recyclCache.Get(key)
 		if css != nil {
+			probe := cs.tracer.StartInstance(span, css.NamespacedName, "probe recycle")
 			reqLogger.Info(fmt.Sprintf("starting to determine whether inactive code server %s should be deleted", key))
 			if cs.CodeServerNowShouldDelete(css.LastInactiveTime.Time, css.NamespacedName.String(), css.Duration) {
-				cs.recycleCodeServer(css.NamespacedName)
+				cs.watches.mark(css.NamespacedName, markRecycledItem)
 				cs.recyclCache.DeleteFromName(css.NamespacedName)
+			} else if !css.Warned && cs.CodeServerRecycleApproaching(css.LastInactiveTime.Time, css.Duration) {
+				cs.warnRecycleCodeServer(css.NamespacedName, css.LastInactiveTime.Time.Add(
+					time.Duration(css.Duration)*time.Second))
+				cs.recyclCache.MarkWarned(key)
 			}
+			probe.End(nil)
 		}
 	}
 }
 
-func (cs *CodeServerWatcher) ProbeAllCodeServer() {
+func (cs *CodeServerWatcher) ProbeAllCodeServer(span *Span) {
 	reqLogger := cs.Log.WithName("codeserverwatcher")
+	var statuses []*CodeServerActiveStatus
 	for _, key := range cs.inActiveCache.GetKeys() {
-		css := cs.inActiveCache.Get(key)
-		if css != nil {
-			reqLogger.Info(fmt.Sprintf("starting to probe code server endpoint %s", key))
-			valid, t := cs.ProbeCodeServer(key, css)
-			if !valid {
-				if css.FailureCount > cs.Options.MaxProbeRetry {
-					reqLogger.Info(fmt.Sprintf("probe code server %s failed and exceed max retries", key))
-					cs.inActiveCodeServer(css.NamespacedName)
-					cs.inActiveCache.DeleteFromName(css.NamespacedName)
-				} else {
-					reqLogger.Info(fmt.Sprintf("probe code server %s failed failure count will be bumped", key))
-					cs.inActiveCache.BumpFailureCount(key)
-				}
+		if css := cs.inActiveCache.Get(key); css != nil {
+			statuses = append(statuses, css)
+		}
+	}
+	probed := cs.probes.Probe(statuses, func(css *CodeServerActiveStatus) (bool, *time.Time) {
+		probe := cs.tracer.StartInstance(span, css.NamespacedName, "probe activity")
+		defer probe.End(nil)
+		return cs.lastActive(css)
+	})
+	for _, result := range probed {
+		css := result.css
+		key := css.NamespacedName.String()
+		if !result.valid {
+			if css.FailureCount > cs.Options.Load().MaxProbeRetry {
+				reqLogger.Info(fmt.Sprintf("probe code server %s failed and exceed max retries", key))
+				cs.watches.mark(css.NamespacedName, markInactiveItem)
+				cs.inActiveCache.DeleteFromName(css.NamespacedName)
 			} else {
-				if cs.CodeServerNowInactive(*t, key, css.Duration) {
-					cs.inActiveCodeServer(css.NamespacedName)
+				reqLogger.Info(fmt.Sprintf("probe code server %s failed failure count will be bumped", key))
+				cs.inActiveCache.BumpFailureCount(key, cs.probes.backoff(css.FailureCount+1))
+				cs.recordEvent(css.NamespacedName, corev1.EventTypeWarning, EventProbeFailed,
+					fmt.Sprintf("Failed to probe activity of code server, %d of %d retries",
+						css.FailureCount+1, cs.Options.Load().MaxProbeRetry))
+			}
+		} else {
+			if css.FailureCount > 0 {
+				cs.inActiveCache.ResetFailureCount(key)
+			}
+			lastActive := *result.lastActive
+			if css.KeepAliveAt.After(lastActive) {
+				lastActive = css.KeepAliveAt
+			}
+			cs.reportUsage(css.NamespacedName, lastActive)
+			if cs.CodeServerNowInactive(lastActive, key, css.Duration) {
+				if !cs.CodeServerInGracePeriod(key, css) {
+					cs.watches.mark(css.NamespacedName, markInactiveItem)
 					cs.inActiveCache.DeleteFromName(css.NamespacedName)
 				}
+			} else if !css.PendingSince.IsZero() {
+				reqLogger.Info(fmt.Sprintf("code server %s becomes active again, cancel pending recycle", key))
+				cs.cancelPendingRecycle(css, "code server becomes active again")
 			}
 		}
 	}
 }
 
 func (cs *CodeServerWatcher) ProbeCodeServer(key string, css *CodeServerActiveStatus) (bool, *time.Time) {
-	reqLogger := cs.Log.WithValues("codeserverwatcher", key)
+	reqLogger := keyLogger(cs.Log, css.NamespacedName)
 	if !strings.HasPrefix(css.ProbeEndpoint, "http") {
 		reqLogger.Info(fmt.Sprintf("failed to probe the codeserver %s, only http or https supported", key))
 		return false, nil
 	}
-	resp, err := http.Get(css.ProbeEndpoint)
+	client := http.Client{
+		Timeout:   time.Duration(cs.Options.Load().ProbeTimeout) * time.Second,
+		Transport: cs.probes.transport,
+	}
+	resp, err := client.Get(css.ProbeEndpoint)
 	if err != nil {
 		reqLogger.Error(err, fmt.Sprintf("failed to probe the codeserver %s with endpoint %s",
 			key, css.ProbeEndpoint))
@@ -218,6 +369,15 @@ func (cs *CodeServerWatcher) CodeServerNowInactive(mtime time.Time, key string,
 	return false
 }
 
+func (cs *CodeServerWatcher) CodeServerRecycleApproaching(mtime time.Time, duration int64) bool {
+	lead := int64(cs.Options.Load().RecycleNotifyLead)
+	if lead <= 0 {
+		return false
+	}
+	elapsed := time.Now().Sub(mtime)
+	return elapsed.Seconds() > float64(duration-lead)
+}
+
 func (cs *CodeServerWatcher) CodeServerNowShouldDelete(mtime time.Time, key string, duration int64) bool {
 	reqLogger := cs.Log.WithName("codeserverwatcher")
 	elapsed := time.Now().Sub(mtime)
@@ -0,0 +1,255 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// MigratingAnnotation keeps the instance inactive while it's being migrated, the value is the migration.
+	MigratingAnnotation = "codeserver.io/migrating"
+	// MovedToAnnotation redirects requests to the migrated instance to the url of instance on target cluster.
+	MovedToAnnotation = "codeserver.io/moved-to"
+	// MigratedFromAnnotation records the migration which the instance on target cluster is created by.
+	MigratedFromAnnotation = "codeserver.io/migrated-from"
+	MigrationPollInterval  = 10 * time.Second
+)
+
+func migrating(m *csv1alpha1.CodeServer) bool {
+	_, migrating := m.Annotations[MigratingAnnotation]
+	_, moved := m.Annotations[MovedToAnnotation]
+	return migrating || moved
+}
+
+// CodeServerMigrationReconciler moves instances between clusters, the instance is stopped and exported with its
+// spec on source cluster, and created from the exported archive and spec on target cluster.
+type CodeServerMigrationReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeservermigrations,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeservermigrations/status,verbs=get;update;patch
+func (r *CodeServerMigrationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	reqLogger := r.Log.WithValues("codeservermigration", req.NamespacedName)
+	migration := &csv1alpha1.CodeServerMigration{}
+	err := r.Client.Get(context.TODO(), req.NamespacedName, migration)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		reqLogger.Error(err, "Failed to get CodeServerMigration.")
+		return reconcile.Result{}, err
+	}
+	if migration.Status.Phase == csv1alpha1.MigrationCompleted || migration.Status.Phase == csv1alpha1.MigrationFailed {
+		return reconcile.Result{}, nil
+	}
+	status := *migration.Status.DeepCopy()
+	if status.StartTime == nil {
+		now := metav1.Now()
+		status.StartTime = &now
+	}
+	if migration.Spec.Role == csv1alpha1.MigrationTarget {
+		err = r.reconcileTarget(migration, &status)
+	} else {
+		err = r.reconcileSource(migration, &status)
+	}
+	if err != nil {
+		reqLogger.Error(err, "Failed to migrate code server.")
+		return reconcile.Result{Requeue: true}, err
+	}
+	if status.Phase == csv1alpha1.MigrationCompleted || status.Phase == csv1alpha1.MigrationFailed {
+		now := metav1.Now()
+		status.CompletionTime = &now
+		reqLogger.Info(fmt.Sprintf("Migration of code server %s finished in phase %s.", migration.Spec.CodeServer,
+			status.Phase))
+	}
+	if !equality.Semantic.DeepEqual(migration.Status, status) {
+		migration.Status = status
+		if err := r.Client.Update(context.TODO(), migration); err != nil {
+			reqLogger.Error(err, "Failed to update code server migration status.")
+			return reconcile.Result{Requeue: true}, nil
+		}
+	}
+	if status.Phase == csv1alpha1.MigrationCompleted || status.Phase == csv1alpha1.MigrationFailed {
+		return reconcile.Result{}, nil
+	}
+	// progress of instance is polled rather than watched
+	return reconcile.Result{RequeueAfter: MigrationPollInterval}, nil
+}
+
+func failMigration(status *csv1alpha1.CodeServerMigrationStatus, format string, args ...interface{}) {
+	status.Phase = csv1alpha1.MigrationFailed
+	status.Message = fmt.Sprintf(format, args...)
+}
+
+// reconcileSource stops the instance, waits until its deployment is gone so that workspace is no longer written,
+// and exports the workspace. Instance stays inactive afterwards and is recycled as usual.
+func (r *CodeServerMigrationReconciler) reconcileSource(migration *csv1alpha1.CodeServerMigration,
+	status *csv1alpha1.CodeServerMigrationStatus) error {
+	codeServer := &csv1alpha1.CodeServer{}
+	key := types.NamespacedName{Name: migration.Spec.CodeServer, Namespace: migration.Namespace}
+	if err := r.Client.Get(context.TODO(), key, codeServer); err != nil {
+		if errors.IsNotFound(err) {
+			failMigration(status, "code server %s not found", key.Name)
+			return nil
+		}
+		return err
+	}
+	if HasCondition(codeServer.Status, csv1alpha1.ServerRecycled) {
+		failMigration(status, "code server %s has been recycled", key.Name)
+		return r.releaseSource(codeServer)
+	}
+	switch status.Phase {
+	case "":
+		if codeServer.Annotations == nil {
+			codeServer.Annotations = map[string]string{}
+		}
+		codeServer.Annotations[MigratingAnnotation] = migration.Name
+		if !HasCondition(codeServer.Status, csv1alpha1.ServerInactive) {
+			clearPendingRecycle(codeServer, "code server is being migrated")
+			SetCondition(&codeServer.Status, NewStateCondition(csv1alpha1.ServerInactive,
+				"code server is being migrated", map[string]string{}, corev1.ConditionTrue))
+		}
+		if err := r.Client.Update(context.TODO(), codeServer); err != nil {
+			return err
+		}
+		status.Phase = csv1alpha1.MigrationStopping
+	case csv1alpha1.MigrationStopping:
+		err := r.Client.Get(context.TODO(), key, &appsv1.Deployment{})
+		if err == nil {
+			return nil
+		}
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		delete(codeServer.Annotations, LastExportAnnotation)
+		codeServer.Annotations[ExportAnnotation] = migration.Spec.ArchiveURL
+		if err := r.Client.Update(context.TODO(), codeServer); err != nil {
+			return err
+		}
+		status.Phase = csv1alpha1.MigrationExporting
+	case csv1alpha1.MigrationExporting:
+		if _, found := codeServer.Annotations[ExportAnnotation]; found {
+			return nil
+		}
+		if codeServer.Annotations[LastExportAnnotation] != ExportSucceeded {
+			failMigration(status, "failed to export workspace of code server %s, see its events", key.Name)
+			return r.releaseSource(codeServer)
+		}
+		spec := codeServer.Spec.DeepCopy()
+		// sources of volume refer to objects of source cluster
+		spec.Storage = nil
+		status.ExportedSpec = spec
+		status.Phase = csv1alpha1.MigrationCompleted
+		if len(migration.Spec.TargetURL) != 0 {
+			codeServer.Annotations[MovedToAnnotation] = migration.Spec.TargetURL
+			if err := r.Client.Update(context.TODO(), codeServer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// releaseSource allows the instance on source cluster to be woken again after migration failed.
+func (r *CodeServerMigrationReconciler) releaseSource(codeServer *csv1alpha1.CodeServer) error {
+	if _, found := codeServer.Annotations[MigratingAnnotation]; !found {
+		return nil
+	}
+	delete(codeServer.Annotations, MigratingAnnotation)
+	return r.Client.Update(context.TODO(), codeServer)
+}
+
+// reconcileTarget creates the instance whose workspace is populated from the exported archive, and waits until it
+// becomes ready.
+func (r *CodeServerMigrationReconciler) reconcileTarget(migration *csv1alpha1.CodeServerMigration,
+	status *csv1alpha1.CodeServerMigrationStatus) error {
+	if migration.Spec.Template == nil {
+		failMigration(status, "template is required on target cluster")
+		return nil
+	}
+	codeServer := &csv1alpha1.CodeServer{}
+	key := types.NamespacedName{Name: migration.Spec.CodeServer, Namespace: migration.Namespace}
+	err := r.Client.Get(context.TODO(), key, codeServer)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if errors.IsNotFound(err) {
+		if status.Phase == csv1alpha1.MigrationImporting {
+			failMigration(status, "code server %s has been deleted during migration", key.Name)
+			return nil
+		}
+		spec := migration.Spec.Template.DeepCopy()
+		spec.Storage = &csv1alpha1.StorageSpec{SourceArchive: migration.Spec.ArchiveURL}
+		if spec.InactiveAfterSeconds == nil {
+			inactive := int64(MaxActiveSeconds)
+			spec.InactiveAfterSeconds = &inactive
+		}
+		codeServer = &csv1alpha1.CodeServer{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        key.Name,
+				Namespace:   key.Namespace,
+				Annotations: map[string]string{MigratedFromAnnotation: migration.Name},
+			},
+			Spec: *spec,
+		}
+		if err := r.Client.Create(context.TODO(), codeServer); err != nil {
+			return err
+		}
+		status.Phase = csv1alpha1.MigrationImporting
+		return nil
+	}
+	if codeServer.Annotations[MigratedFromAnnotation] != migration.Name {
+		failMigration(status, "code server %s already exists on target cluster", key.Name)
+		return nil
+	}
+	status.Phase = csv1alpha1.MigrationImporting
+	status.Message = ""
+	// errors are retried by reconciler, e.g. archive not uploaded yet
+	if errored := GetCondition(codeServer.Status, csv1alpha1.ServerErrored); errored != nil &&
+		errored.Status == corev1.ConditionTrue {
+		status.Message = errored.Reason
+	} else if ready := GetCondition(codeServer.Status, csv1alpha1.ServerReady); ready != nil &&
+		ready.Status == corev1.ConditionTrue {
+		status.Phase = csv1alpha1.MigrationCompleted
+	}
+	return nil
+}
+
+func (r *CodeServerMigrationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&csv1alpha1.CodeServerMigration{}).
+		Complete(r)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+// CodeServerOperatorConfigReconciler applies the cluster scoped operator config on the shared options at runtime
+type CodeServerOperatorConfigReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// Store merges config into options shared by all controllers.
+	Store *OptionStore
+	// ConfigName is the name of the config honored by operator.
+	ConfigName string
+}
+
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeserveroperatorconfigs,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeserveroperatorconfigs/status,verbs=get;update;patch
+func (r *CodeServerOperatorConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	reqLogger := r.Log.WithValues("codeserveroperatorconfig", req.Name)
+	if req.Name != r.ConfigName {
+		reqLogger.Info(fmt.Sprintf("Ignore operator config, only %s is honored.", r.ConfigName))
+		return reconcile.Result{}, nil
+	}
+	config := &csv1alpha1.CodeServerOperatorConfig{}
+	err := r.Client.Get(context.TODO(), req.NamespacedName, config)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			reqLogger.Info("Operator config has been deleted, restore options.")
+			r.Store.SetOperatorConfig(nil)
+			return reconcile.Result{}, nil
+		}
+		reqLogger.Error(err, "Failed to get operator config.")
+		return reconcile.Result{}, err
+	}
+	r.Store.SetOperatorConfig(&config.Spec)
+	reqLogger.Info(fmt.Sprintf("Operator config generation %d has been applied.", config.Generation))
+	if config.Status.ObservedGeneration != config.Generation {
+		now := metav1.Now()
+		config.Status.ObservedGeneration = config.Generation
+		config.Status.AppliedTime = &now
+		if err := r.Client.Update(context.TODO(), config); err != nil {
+			reqLogger.Error(err, "Failed to update operator config status.")
+			return reconcile.Result{Requeue: true}, nil
+		}
+	}
+	return reconcile.Result{}, nil
+}
+
+// MergeOperatorConfig overrides options with the fields specified in config.
+func MergeOperatorConfig(options CodeServerOption, spec *csv1alpha1.CodeServerOperatorConfigSpec) CodeServerOption {
+	mergeString := func(target *string, value string) {
+		if len(value) != 0 {
+			*target = value
+		}
+	}
+	mergeInt := func(target *int, value *int) {
+		if value != nil {
+			*target = *value
+		}
+	}
+	mergeBool := func(target *bool, value *bool) {
+		if value != nil {
+			*target = *value
+		}
+	}
+	mergeString(&options.DomainName, spec.DomainName)
+	mergeString(&options.VSExporterImage, spec.VSExporterImage)
+	mergeInt(&options.ProbeInterval, spec.ProbeInterval)
+	mergeInt(&options.MaxProbeRetry, spec.MaxProbeRetry)
+	mergeString(&options.HttpsSecretName, spec.HttpsSecretName)
+	mergeString(&options.LxdClientSecretName, spec.LxdClientSecretName)
+	mergeBool(&options.EnableUserIngress, spec.EnableUserIngress)
+	mergeBool(&options.DisableDocker, spec.DisableDocker)
+	mergeString(&options.DindImage, spec.DindImage)
+	mergeString(&options.BuildkitImage, spec.BuildkitImage)
+	mergeString(&options.SSHImage, spec.SSHImage)
+	mergeString(&options.NotificationURL, spec.NotificationURL)
+	mergeString(&options.NotificationFormat, spec.NotificationFormat)
+	mergeInt(&options.RecycleNotifyLead, spec.RecycleNotifyLead)
+	mergeInt(&options.InactiveGracePeriod, spec.InactiveGracePeriod)
+	mergeString(&options.RolloutImage, spec.RolloutImage)
+	mergeInt(&options.RolloutMaxUnavail, spec.RolloutMaxUnavailable)
+	mergeBool(&options.SkipArchCheck, spec.SkipArchCheck)
+	mergeString(&options.ImagePullSecret, spec.ImagePullSecret)
+	mergeString(&options.PullSecretNamespace, spec.PullSecretNamespace)
+	mergeString(&options.DriftMode, spec.DriftMode)
+	if len(spec.SchedulingProfiles) != 0 {
+		options.SchedulingProfiles = spec.SchedulingProfiles
+	}
+	if len(spec.ResourceBounds) != 0 {
+		options.ResourceBounds = spec.ResourceBounds
+	}
+	if len(spec.RegistryMirrors) != 0 {
+		options.RegistryMirrors = spec.RegistryMirrors
+	}
+	if spec.InstanceDefaults != nil {
+		options.InstanceDefaults = spec.InstanceDefaults
+	}
+	return options
+}
+
+func (r *CodeServerOperatorConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&csv1alpha1.CodeServerOperatorConfig{}).
+		Complete(r)
+}
@@ -0,0 +1,448 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"path"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sort"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+	"github.com/opensourceways/code-server-operator/controllers/initplugins/git"
+)
+
+const (
+	PrebuildResource = "%s-%s-%s"
+	// PrebuildRequestedAnnotation holds the time prebuild was requested via api server
+	PrebuildRequestedAnnotation = "codeserver.io/prebuild-requested"
+	PrebuildLabel               = "codeserver.io/prebuild-of"
+	PrebuildBranchLabel         = "codeserver.io/prebuild-branch"
+	PrebuildWorkspace           = "/workspace"
+	PrebuildVolume              = "workspace"
+	PrebuildBackoffLimit        = 1
+	// PrebuildBranchMaxName is the longest part of names and labels derived from branch, hash included
+	PrebuildBranchMaxName    = 29
+	PrebuildCheckInterval    = 10 * time.Second
+	DefaultPrebuildRetention = 2
+)
+
+// CodeServerPrebuildReconciler bootstraps repositories into volumes on schedule or request and snapshots them
+// per branch, so that instances restored from the snapshots start with warm caches.
+type CodeServerPrebuildReconciler struct {
+	client.Client
+	Log     logr.Logger
+	Scheme  *runtime.Scheme
+	Options *CodeServerOption
+}
+
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeserverprebuilds,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeserverprebuilds/status,verbs=get;update;patch
+func (r *CodeServerPrebuildReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	reqLogger := r.Log.WithValues("namespace", req.Namespace, "name", req.Name)
+	prebuild := &csv1alpha1.CodeServerPrebuild{}
+	err := r.Client.Get(context.TODO(), req.NamespacedName, prebuild)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		reqLogger.Error(err, "Failed to get prebuild.")
+		return reconcile.Result{}, err
+	}
+	original := prebuild.Status.DeepCopy()
+	var branches []csv1alpha1.PrebuildBranchStatus
+	requeue := time.Duration(0)
+	for _, branch := range prebuild.Spec.Branches {
+		status := csv1alpha1.PrebuildBranchStatus{Branch: branch}
+		for _, existing := range prebuild.Status.Branches {
+			if existing.Branch == branch {
+				status = existing
+			}
+		}
+		next, err := r.reconcileBranch(prebuild, &status)
+		if err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to prebuild branch %s.", branch))
+			next = PrebuildCheckInterval
+		}
+		if next > 0 && (requeue == 0 || next < requeue) {
+			requeue = next
+		}
+		branches = append(branches, status)
+	}
+	prebuild.Status.Branches = branches
+	if !equality.Semantic.DeepEqual(original, &prebuild.Status) {
+		if err := r.Client.Update(context.TODO(), prebuild); err != nil {
+			reqLogger.Error(err, "Failed to update prebuild status.")
+			return reconcile.Result{Requeue: true}, nil
+		}
+	}
+	if requeue > 0 {
+		return reconcile.Result{RequeueAfter: requeue}, nil
+	}
+	return reconcile.Result{}, nil
+}
+
+// reconcileBranch moves the prebuild of branch forward and returns when it should be checked again.
+func (r *CodeServerPrebuildReconciler) reconcileBranch(prebuild *csv1alpha1.CodeServerPrebuild,
+	status *csv1alpha1.PrebuildBranchStatus) (time.Duration, error) {
+	switch status.Phase {
+	case csv1alpha1.PrebuildBuilding:
+		return PrebuildCheckInterval, r.checkBuild(prebuild, status)
+	case csv1alpha1.PrebuildSnapshotting:
+		return PrebuildCheckInterval, r.checkSnapshot(prebuild, status)
+	}
+	due, next, err := prebuildDue(prebuild, status)
+	if err != nil || !due {
+		return next, err
+	}
+	return PrebuildCheckInterval, r.startBuild(prebuild, status)
+}
+
+// prebuildDue returns whether branch should be prebuilt now, otherwise the duration until next scheduled
+// prebuild, zero means never.
+func prebuildDue(prebuild *csv1alpha1.CodeServerPrebuild, status *csv1alpha1.PrebuildBranchStatus) (bool,
+	time.Duration, error) {
+	if status.StartTime == nil {
+		return true, 0, nil
+	}
+	if value, found := prebuild.Annotations[PrebuildRequestedAnnotation]; found {
+		requested, err := time.Parse(time.RFC3339, value)
+		if err == nil && requested.After(status.StartTime.Time) {
+			return true, 0, nil
+		}
+	}
+	if len(prebuild.Spec.Schedule) == 0 {
+		return false, 0, nil
+	}
+	schedule, err := ParseCronSchedule(prebuild.Spec.Schedule)
+	if err != nil {
+		return false, 0, err
+	}
+	next := schedule.Next(status.StartTime.Time)
+	if next.IsZero() {
+		return false, 0, nil
+	}
+	if wait := time.Until(next); wait > 0 {
+		return false, wait, nil
+	}
+	return true, 0, nil
+}
+
+// startBuild creates the volume and the job bootstrapping repository into it.
+func (r *CodeServerPrebuildReconciler) startBuild(prebuild *csv1alpha1.CodeServerPrebuild,
+	status *csv1alpha1.PrebuildBranchStatus) error {
+	quantity, err := resourcev1.ParseQuantity(prebuild.Spec.StorageSize)
+	if err != nil {
+		return fmt.Errorf("invalid storage size %s: %v", prebuild.Spec.StorageSize, err)
+	}
+	now := metav1.Now()
+	name := ChildName(PrebuildResource, prebuild.Name, sanitizeBranch(status.Branch),
+		now.UTC().Format(BackupTimeLayout))
+	labels := map[string]string{PrebuildLabel: prebuild.Name, PrebuildBranchLabel: sanitizeBranch(status.Branch)}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: prebuild.Namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: &prebuild.Spec.StorageName,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: quantity},
+			},
+		},
+	}
+	controllerutil.SetControllerReference(prebuild, pvc, r.Scheme)
+	if err := r.Client.Create(context.TODO(), pvc); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	job, err := r.newPrebuildJob(prebuild, status.Branch, name, labels)
+	if err != nil {
+		return err
+	}
+	if err := r.Client.Create(context.TODO(), job); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	r.Log.Info(fmt.Sprintf("prebuild %s of branch %s has been started", name, status.Branch),
+		"namespace", prebuild.Namespace)
+	status.Phase = csv1alpha1.PrebuildBuilding
+	status.Current = name
+	status.StartTime = &now
+	status.Message = ""
+	return nil
+}
+
+// checkBuild snapshots the volume once job succeeded, resources of failed build are released.
+func (r *CodeServerPrebuildReconciler) checkBuild(prebuild *csv1alpha1.CodeServerPrebuild,
+	status *csv1alpha1.PrebuildBranchStatus) error {
+	job := &batchv1.Job{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: status.Current, Namespace: prebuild.Namespace}, job)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return r.failBuild(prebuild, status, "prebuild job has been deleted")
+		}
+		return err
+	}
+	if condition := jobCondition(job, batchv1.JobFailed); condition != nil {
+		return r.failBuild(prebuild, status, fmt.Sprintf("prebuild job %s failed: %s", job.Name, condition.Message))
+	}
+	if jobCondition(job, batchv1.JobComplete) == nil {
+		return nil
+	}
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(VolumeSnapshotGVK)
+	snapshot.SetName(status.Current)
+	snapshot.SetNamespace(prebuild.Namespace)
+	snapshot.SetLabels(job.Labels)
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{"persistentVolumeClaimName": status.Current},
+	}
+	if len(prebuild.Spec.VolumeSnapshotClassName) != 0 {
+		spec["volumeSnapshotClassName"] = prebuild.Spec.VolumeSnapshotClassName
+	}
+	snapshot.Object["spec"] = spec
+	controllerutil.SetControllerReference(prebuild, snapshot, r.Scheme)
+	if err := r.Client.Create(context.TODO(), snapshot); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	status.Phase = csv1alpha1.PrebuildSnapshotting
+	return nil
+}
+
+// checkSnapshot publishes the snapshot once it's ready to use, the volume and job are released then.
+func (r *CodeServerPrebuildReconciler) checkSnapshot(prebuild *csv1alpha1.CodeServerPrebuild,
+	status *csv1alpha1.PrebuildBranchStatus) error {
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(VolumeSnapshotGVK)
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: status.Current, Namespace: prebuild.Namespace},
+		snapshot)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return r.failBuild(prebuild, status, "prebuild snapshot has been deleted")
+		}
+		return err
+	}
+	if message, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found {
+		return r.failBuild(prebuild, status, message)
+	}
+	if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); !ready {
+		return nil
+	}
+	status.Phase = csv1alpha1.PrebuildSucceeded
+	status.Snapshot = status.Current
+	r.Log.Info(fmt.Sprintf("prebuild %s of branch %s is ready", status.Current, status.Branch),
+		"namespace", prebuild.Namespace)
+	if err := r.releaseBuild(prebuild.Namespace, status.Current); err != nil {
+		return err
+	}
+	r.pruneSnapshots(prebuild, status.Branch)
+	return nil
+}
+
+func (r *CodeServerPrebuildReconciler) failBuild(prebuild *csv1alpha1.CodeServerPrebuild,
+	status *csv1alpha1.PrebuildBranchStatus, message string) error {
+	status.Phase = csv1alpha1.PrebuildFailed
+	status.Message = message
+	r.Log.Info(fmt.Sprintf("prebuild %s of branch %s failed: %s", status.Current, status.Branch, message),
+		"namespace", prebuild.Namespace)
+	if err := r.releaseBuild(prebuild.Namespace, status.Current); err != nil {
+		return err
+	}
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(VolumeSnapshotGVK)
+	snapshot.SetName(status.Current)
+	snapshot.SetNamespace(prebuild.Namespace)
+	if err := r.Client.Delete(context.TODO(), snapshot); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// releaseBuild deletes the job and volume of prebuild.
+func (r *CodeServerPrebuildReconciler) releaseBuild(namespace, name string) error {
+	job := &batchv1.Job{}
+	job.Name, job.Namespace = name, namespace
+	err := r.Client.Delete(context.TODO(), job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.Name, pvc.Namespace = name, namespace
+	if err := r.Client.Delete(context.TODO(), pvc); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// pruneSnapshots deletes the oldest snapshots of branch which exceed retention count.
+func (r *CodeServerPrebuildReconciler) pruneSnapshots(prebuild *csv1alpha1.CodeServerPrebuild, branch string) {
+	retention := prebuild.Spec.Retention
+	if retention <= 0 {
+		retention = DefaultPrebuildRetention
+	}
+	snapshots := &unstructured.UnstructuredList{}
+	snapshots.SetGroupVersionKind(VolumeSnapshotGVK.GroupVersion().WithKind(SnapshotKind + "List"))
+	if err := r.Client.List(context.TODO(), snapshots, client.InNamespace(prebuild.Namespace),
+		client.MatchingLabels{PrebuildLabel: prebuild.Name, PrebuildBranchLabel: sanitizeBranch(branch)}); err != nil {
+		r.Log.Error(err, "Failed to list prebuild snapshots.", "namespace", prebuild.Namespace)
+		return
+	}
+	items := snapshots.Items
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].GetCreationTimestamp().After(items[j].GetCreationTimestamp().Time)
+	})
+	for i := retention; i < len(items); i++ {
+		if err := r.Client.Delete(context.TODO(), &items[i]); err != nil && !errors.IsNotFound(err) {
+			r.Log.Error(err, fmt.Sprintf("Failed to delete prebuild snapshot %s.", items[i].GetName()))
+		}
+	}
+}
+
+// jobCondition returns the condition of job in true status, nil if it's absent.
+func jobCondition(job *batchv1.Job, conditionType batchv1.JobConditionType) *batchv1.JobCondition {
+	for index := range job.Status.Conditions {
+		condition := &job.Status.Conditions[index]
+		if condition.Type == conditionType && condition.Status == corev1.ConditionTrue {
+			return condition
+		}
+	}
+	return nil
+}
+
+// newPrebuildJob returns the job which clones branch into volume and runs the bootstrap commands.
+func (r *CodeServerPrebuildReconciler) newPrebuildJob(prebuild *csv1alpha1.CodeServerPrebuild, branch, name string,
+	labels map[string]string) (*batchv1.Job, error) {
+	backoffLimit := int32(PrebuildBackoffLimit)
+	folder := prebuild.Spec.Folder
+	if len(folder) == 0 {
+		folder = path.Base(strings.TrimSuffix(strings.TrimSuffix(prebuild.Spec.Repository, "/"), ".git"))
+	}
+	workDir := path.Join(PrebuildWorkspace, folder)
+	if !strings.HasPrefix(workDir, PrebuildWorkspace+"/") {
+		return nil, fmt.Errorf("prebuild folder %s is outside of %s", folder, PrebuildWorkspace)
+	}
+	mounts := []corev1.VolumeMount{{Name: PrebuildVolume, MountPath: PrebuildWorkspace}}
+	commands := "true"
+	if len(prebuild.Spec.Commands) != 0 {
+		commands = strings.Join(prebuild.Spec.Commands, " && ")
+	}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: prebuild.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{
+						{
+							Name:  "clone",
+							Image: git.DefaultImageUrl,
+							Command: []string{"sh", "-c", `rm -rf "$PREBUILD_WORKDIR" && ` +
+								`git clone --branch "$PREBUILD_BRANCH" -- "$PREBUILD_REPOSITORY" "$PREBUILD_WORKDIR"`},
+							Env: []corev1.EnvVar{
+								{Name: "PREBUILD_REPOSITORY", Value: prebuild.Spec.Repository},
+								{Name: "PREBUILD_BRANCH", Value: branch},
+								{Name: "PREBUILD_WORKDIR", Value: workDir},
+							},
+							VolumeMounts: mounts,
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:         "bootstrap",
+							Image:        prebuild.Spec.Image,
+							Command:      []string{"sh", "-c", commands},
+							WorkingDir:   workDir,
+							VolumeMounts: mounts,
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: PrebuildVolume,
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: name},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if r.Options != nil {
+		addRegistryMirrorsForPod(&job.Spec.Template.Spec, r.Options.Load().RegistryMirrors)
+	}
+	// Set CodeServerPrebuild as the owner of the job.
+	controllerutil.SetControllerReference(prebuild, job, r.Scheme)
+	return job, nil
+}
+
+// sanitizeBranch converts branch into a valid part of resource name and label value, it's suffixed by the hash of
+// branch so that branches normalized to the same name, e.g. "feature/a" and "feature-a", stay distinct.
+func sanitizeBranch(branch string) string {
+	return identityName(normalizeName(branch), PrebuildBranchMaxName, branch)
+}
+
+func (r *CodeServerPrebuildReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&csv1alpha1.CodeServerPrebuild{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
+
+// prebuildDataSource returns the latest snapshot of the prebuild referred by instance, nil if none is ready.
+func (r *CodeServerReconciler) prebuildDataSource(m *csv1alpha1.CodeServer) (*corev1.TypedLocalObjectReference, error) {
+	ref := m.Spec.Storage.SourcePrebuild
+	prebuild := &csv1alpha1.CodeServerPrebuild{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: ref.Name, Namespace: m.Namespace}, prebuild)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range prebuild.Status.Branches {
+		if status.Branch == ref.Branch && len(status.Snapshot) != 0 {
+			apiGroup := SnapshotAPIGroup
+			return &corev1.TypedLocalObjectReference{
+				APIGroup: &apiGroup,
+				Kind:     SnapshotKind,
+				Name:     status.Snapshot,
+			}, nil
+		}
+	}
+	r.Log.Info(fmt.Sprintf("prebuild %s has no snapshot of branch %s yet, workspace starts empty", ref.Name,
+		ref.Branch), "namespace", m.Namespace, "name", m.Name)
+	return nil, nil
+}
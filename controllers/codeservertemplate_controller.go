@@ -0,0 +1,285 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	TemplateQuotaResource      = "%s-quota"
+	TemplateLimitRangeResource = "%s-limits"
+	// TemplateLabel records the template resource quota and limit range are provisioned for.
+	TemplateLabel = "codeserver.io/template"
+	// CodeServerCountResource is the object count quota of code servers.
+	CodeServerCountResource = corev1.ResourceName("count/codeservers.cs.opensourceways.com")
+	// TemplateSidecarCPU and TemplateSidecarMemory are the limits LimitRange defaults containers without them to,
+	// requests default to a quarter of them.
+	TemplateSidecarCPU    = "200m"
+	TemplateSidecarMemory = "256Mi"
+	// TemplateSidecarsPerInstance is the number of defaulted containers, e.g. injected sidecars and init containers,
+	// quota allows per instance.
+	TemplateSidecarsPerInstance = 2
+)
+
+// CodeServerTemplateReconciler provisions the ResourceQuota and LimitRange of templates, so that tenancy
+// guardrails of namespaces dedicated to workspaces stay in sync with the templates.
+type CodeServerTemplateReconciler struct {
+	client.Client
+	Log     logr.Logger
+	Scheme  *runtime.Scheme
+	Options *CodeServerOption
+}
+
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeservertemplates,verbs=get;list;watch
+// +kubebuilder:rbac:groups=,resources=resourcequotas,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=,resources=limitranges,verbs=get;list;watch;create;update;patch;delete
+func (r *CodeServerTemplateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	reqLogger := r.Log.WithValues("codeservertemplate", req.NamespacedName)
+	template := &csv1alpha1.CodeServerTemplate{}
+	err := r.Client.Get(context.TODO(), req.NamespacedName, template)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			reqLogger.Info("CodeServerTemplate has been deleted, quota will be garbage collected.")
+			return reconcile.Result{}, nil
+		}
+		reqLogger.Error(err, "Failed to get CodeServerTemplate.")
+		return reconcile.Result{}, err
+	}
+	quotaName := ChildName(TemplateQuotaResource, template.Name)
+	limitRangeName := ChildName(TemplateLimitRangeResource, template.Name)
+	if template.Spec.Quota == nil {
+		if err := r.deleteOwned(template, &corev1.ResourceQuota{}, quotaName); err != nil {
+			return reconcile.Result{Requeue: true}, err
+		}
+		return reconcile.Result{}, r.deleteOwned(template, &corev1.LimitRange{}, limitRangeName)
+	}
+	if err := r.reconcileForQuota(template, quotaName); err != nil {
+		reqLogger.Error(err, "Failed to reconcile ResourceQuota.")
+		return reconcile.Result{Requeue: true}, err
+	}
+	if template.Spec.Quota.SkipLimitRange {
+		return reconcile.Result{}, r.deleteOwned(template, &corev1.LimitRange{}, limitRangeName)
+	}
+	if err := r.reconcileForLimitRange(template, limitRangeName); err != nil {
+		reqLogger.Error(err, "Failed to reconcile LimitRange.")
+		return reconcile.Result{Requeue: true}, err
+	}
+	return reconcile.Result{}, nil
+}
+
+func (r *CodeServerTemplateReconciler) reconcileForQuota(template *csv1alpha1.CodeServerTemplate,
+	name string) error {
+	desired := &corev1.ResourceQuota{
+		ObjectMeta: r.templateObjectMeta(template, name),
+		Spec:       corev1.ResourceQuotaSpec{Hard: templateQuota(template)},
+	}
+	controllerutil.SetControllerReference(template, desired, r.Scheme)
+	quota := &corev1.ResourceQuota{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: template.Namespace}, quota)
+	if errors.IsNotFound(err) {
+		r.Log.Info(fmt.Sprintf("Creating ResourceQuota %s/%s.", template.Namespace, name))
+		return r.Client.Create(context.TODO(), desired)
+	}
+	if err != nil {
+		return err
+	}
+	if equality.Semantic.DeepEqual(quota.Spec.Hard, desired.Spec.Hard) {
+		return nil
+	}
+	r.Log.Info(fmt.Sprintf("Updating ResourceQuota %s/%s.", template.Namespace, name))
+	quota.Spec.Hard = desired.Spec.Hard
+	return r.Client.Update(context.TODO(), quota)
+}
+
+func (r *CodeServerTemplateReconciler) reconcileForLimitRange(template *csv1alpha1.CodeServerTemplate,
+	name string) error {
+	desired := &corev1.LimitRange{
+		ObjectMeta: r.templateObjectMeta(template, name),
+		Spec:       templateLimitRange(template),
+	}
+	controllerutil.SetControllerReference(template, desired, r.Scheme)
+	limitRange := &corev1.LimitRange{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: template.Namespace},
+		limitRange)
+	if errors.IsNotFound(err) {
+		r.Log.Info(fmt.Sprintf("Creating LimitRange %s/%s.", template.Namespace, name))
+		return r.Client.Create(context.TODO(), desired)
+	}
+	if err != nil {
+		return err
+	}
+	if equality.Semantic.DeepEqual(limitRange.Spec, desired.Spec) {
+		return nil
+	}
+	r.Log.Info(fmt.Sprintf("Updating LimitRange %s/%s.", template.Namespace, name))
+	limitRange.Spec = desired.Spec
+	return r.Client.Update(context.TODO(), limitRange)
+}
+
+func (r *CodeServerTemplateReconciler) templateObjectMeta(template *csv1alpha1.CodeServerTemplate,
+	name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: template.Namespace,
+		Labels:    map[string]string{TemplateLabel: template.Name},
+	}
+}
+
+// deleteOwned deletes the object named name if it's controlled by template, objects created by others are kept.
+func (r *CodeServerTemplateReconciler) deleteOwned(template *csv1alpha1.CodeServerTemplate, obj client.Object,
+	name string) error {
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: template.Namespace}, obj)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if owner := metav1.GetControllerOf(obj); owner == nil || owner.UID != template.UID {
+		return nil
+	}
+	r.Log.Info(fmt.Sprintf("Deleting %s/%s of template %s.", template.Namespace, name, template.Name))
+	if err := r.Client.Delete(context.TODO(), obj); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// instanceResources returns the requests and limits of all containers of an instance created from template, requests
+// default to limits the same as kubernetes does.
+func instanceResources(template *csv1alpha1.CodeServerTemplate) (corev1.ResourceList, corev1.ResourceList) {
+	requests, limits := corev1.ResourceList{}, corev1.ResourceList{}
+	containers := []corev1.ResourceRequirements{template.Spec.Template.Resources}
+	if docker := template.Spec.Template.Docker; docker != nil && docker.Enabled {
+		containers = append(containers, docker.Resources)
+	}
+	for _, resources := range containers {
+		for name, value := range resources.Limits {
+			addQuantity(limits, name, value, 1)
+			if _, found := resources.Requests[name]; !found {
+				addQuantity(requests, name, value, 1)
+			}
+		}
+		for name, value := range resources.Requests {
+			addQuantity(requests, name, value, 1)
+		}
+	}
+	return requests, limits
+}
+
+// templateQuota returns the hard limits allowing the expected number of instances of template plus headroom, only
+// compute resources support limits in quota while extended resources are limited by requests.
+func templateQuota(template *csv1alpha1.CodeServerTemplate) corev1.ResourceList {
+	instances := int64(template.Spec.Quota.Instances)
+	requests, limits := instanceResources(template)
+	hard := corev1.ResourceList{CodeServerCountResource: *resourcev1.NewQuantity(instances, resourcev1.DecimalSI)}
+	for name, value := range requests {
+		addQuantity(hard, corev1.ResourceName(corev1.DefaultResourceRequestsPrefix+string(name)), value, instances)
+	}
+	for name, value := range limits {
+		if name == corev1.ResourceCPU || name == corev1.ResourceMemory || name == corev1.ResourceEphemeralStorage {
+			addQuantity(hard, corev1.ResourceName("limits."+string(name)), value, instances)
+		}
+	}
+	if !template.Spec.Quota.SkipLimitRange {
+		sidecarRequests, sidecarLimits := sidecarResources(template.Spec.Template.Resources.Limits)
+		for name, value := range sidecarRequests {
+			addQuantity(hard, corev1.ResourceName(corev1.DefaultResourceRequestsPrefix+string(name)), value,
+				instances*TemplateSidecarsPerInstance)
+		}
+		for name, value := range sidecarLimits {
+			addQuantity(hard, corev1.ResourceName("limits."+string(name)), value,
+				instances*TemplateSidecarsPerInstance)
+		}
+	}
+	if size, err := resourcev1.ParseQuantity(template.Spec.Template.StorageSize); err == nil && !size.IsZero() {
+		addQuantity(hard, corev1.ResourceRequestsStorage, size, instances)
+	}
+	for name, value := range template.Spec.Quota.Headroom {
+		addQuantity(hard, name, value, 1)
+	}
+	return hard
+}
+
+// sidecarResources returns the requests and limits containers without them are defaulted to, the sidecar defaults
+// capped by limits of instance.
+func sidecarResources(caps corev1.ResourceList) (corev1.ResourceList, corev1.ResourceList) {
+	requests, limits := corev1.ResourceList{}, corev1.ResourceList{}
+	for name, value := range map[corev1.ResourceName]string{
+		corev1.ResourceCPU:    TemplateSidecarCPU,
+		corev1.ResourceMemory: TemplateSidecarMemory,
+	} {
+		limit := resourcev1.MustParse(value)
+		if capped, found := caps[name]; found && capped.Cmp(limit) < 0 {
+			limit = capped
+		}
+		limits[name] = limit
+		requests[name] = *resourcev1.NewMilliQuantity(limit.MilliValue()/4, limit.Format)
+	}
+	return requests, limits
+}
+
+// templateLimitRange defaults the requests and limits of containers without them to small sidecar resources,
+// otherwise pods of jobs and sidecars would be rejected by the quota of limits.
+func templateLimitRange(template *csv1alpha1.CodeServerTemplate) corev1.LimitRangeSpec {
+	return sidecarLimitRange(template.Spec.Template.Resources.Limits)
+}
+
+// sidecarLimitRange defaults the requests and limits of containers without them to sidecar resources capped by caps.
+func sidecarLimitRange(caps corev1.ResourceList) corev1.LimitRangeSpec {
+	requests, limits := sidecarResources(caps)
+	return corev1.LimitRangeSpec{Limits: []corev1.LimitRangeItem{{
+		Type:           corev1.LimitTypeContainer,
+		Default:        limits,
+		DefaultRequest: requests,
+	}}}
+}
+
+// addQuantity adds value times count to the quantity of name in list.
+func addQuantity(list corev1.ResourceList, name corev1.ResourceName, value resourcev1.Quantity, count int64) {
+	total := list[name]
+	if count == 1 {
+		total.Add(value)
+	} else {
+		total.Add(*resourcev1.NewMilliQuantity(value.MilliValue()*count, value.Format))
+	}
+	list[name] = total
+}
+
+func (r *CodeServerTemplateReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&csv1alpha1.CodeServerTemplate{}).
+		Owns(&corev1.ResourceQuota{}).
+		Owns(&corev1.LimitRange{}).
+		Complete(r)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+func TestTemplateQuota(t *testing.T) {
+	tests := []struct {
+		name           string
+		limits         corev1.ResourceList
+		skipLimitRange bool
+		want           map[corev1.ResourceName]string
+	}{
+		{name: "sidecars accounted", limits: corev1.ResourceList{
+			corev1.ResourceCPU: resourcev1.MustParse("2"), corev1.ResourceMemory: resourcev1.MustParse("4Gi")},
+			want: map[corev1.ResourceName]string{
+				corev1.ResourceLimitsCPU: "4800m", corev1.ResourceLimitsMemory: "9216Mi",
+				corev1.ResourceRequestsCPU: "4200m", corev1.ResourceRequestsMemory: "8448Mi",
+				CodeServerCountResource: "2"}},
+		{name: "sidecars capped by template", limits: corev1.ResourceList{
+			corev1.ResourceCPU: resourcev1.MustParse("100m"), corev1.ResourceMemory: resourcev1.MustParse("128Mi")},
+			want: map[corev1.ResourceName]string{
+				corev1.ResourceLimitsCPU: "600m", corev1.ResourceLimitsMemory: "768Mi",
+				corev1.ResourceRequestsCPU: "300m", corev1.ResourceRequestsMemory: "384Mi"}},
+		{name: "no limit range", skipLimitRange: true, limits: corev1.ResourceList{
+			corev1.ResourceCPU: resourcev1.MustParse("2")},
+			want: map[corev1.ResourceName]string{corev1.ResourceLimitsCPU: "4", corev1.ResourceRequestsCPU: "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := &csv1alpha1.CodeServerTemplate{Spec: csv1alpha1.CodeServerTemplateSpec{
+				Template: csv1alpha1.CodeServerSpec{Resources: corev1.ResourceRequirements{Limits: tt.limits}},
+				Quota:    &csv1alpha1.TemplateQuotaSpec{Instances: 2, SkipLimitRange: tt.skipLimitRange},
+			}}
+			hard := templateQuota(template)
+			for name, want := range tt.want {
+				if got := hard[name]; got.Cmp(resourcev1.MustParse(want)) != 0 {
+					t.Errorf("templateQuota()[%s] = %s, want %s", name, got.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestTemplateLimitRange(t *testing.T) {
+	tests := []struct {
+		name                   string
+		limits                 corev1.ResourceList
+		wantCPU, wantMemory    string
+		wantCPUReq, wantMemReq string
+	}{
+		{name: "sidecar defaults", limits: corev1.ResourceList{corev1.ResourceCPU: resourcev1.MustParse("8")},
+			wantCPU: TemplateSidecarCPU, wantMemory: TemplateSidecarMemory, wantCPUReq: "50m", wantMemReq: "64Mi"},
+		{name: "capped by template", limits: corev1.ResourceList{corev1.ResourceMemory: resourcev1.MustParse("64Mi")},
+			wantCPU: TemplateSidecarCPU, wantMemory: "64Mi", wantCPUReq: "50m", wantMemReq: "16Mi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := &csv1alpha1.CodeServerTemplate{Spec: csv1alpha1.CodeServerTemplateSpec{
+				Template: csv1alpha1.CodeServerSpec{Resources: corev1.ResourceRequirements{Limits: tt.limits}},
+			}}
+			item := templateLimitRange(template).Limits[0]
+			for _, check := range []struct {
+				list corev1.ResourceList
+				name corev1.ResourceName
+				want string
+			}{
+				{item.Default, corev1.ResourceCPU, tt.wantCPU},
+				{item.Default, corev1.ResourceMemory, tt.wantMemory},
+				{item.DefaultRequest, corev1.ResourceCPU, tt.wantCPUReq},
+				{item.DefaultRequest, corev1.ResourceMemory, tt.wantMemReq},
+			} {
+				if got := check.list[check.name]; got.Cmp(resourcev1.MustParse(check.want)) != 0 {
+					t.Errorf("templateLimitRange() %s = %s, want %s", check.name, got.String(), check.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sort"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	UserOwnerLabel       = "codeserver.io/owner"
+	UserEnvironmentLabel = "codeserver.io/environment"
+	UserInstanceName     = "%s-%s"
+	DefaultMaxInstances  = 1
+)
+
+// CodeServerUserReconciler creates and garbage collects code servers for users on demand
+type CodeServerUserReconciler struct {
+	client.Client
+	Log     logr.Logger
+	Scheme  *runtime.Scheme
+	Options *CodeServerOption
+}
+
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeserverusers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeserverusers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeservertemplates,verbs=get;list;watch
+// +kubebuilder:rbac:groups=,resources=namespaces,verbs=get;list;watch;create;update;delete
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=get;list;watch;create;update;delete
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles,verbs=bind,resourceNames=view
+func (r *CodeServerUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	reqLogger := r.Log.WithValues("codeserveruser", req.NamespacedName)
+	user := &csv1alpha1.CodeServerUser{}
+	err := r.Client.Get(context.TODO(), req.NamespacedName, user)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			reqLogger.Info("CodeServerUser has been deleted, code servers will be garbage collected.")
+			return reconcile.Result{}, nil
+		}
+		reqLogger.Error(err, "Failed to get CodeServerUser.")
+		return reconcile.Result{}, err
+	}
+	if user.DeletionTimestamp != nil {
+		return r.finalizeUser(user)
+	}
+	status := csv1alpha1.CodeServerUserStatus{}
+	namespace := r.instanceNamespace(user)
+	if r.Options.Load().UserNamespaces {
+		if err := r.reconcileForUserNamespace(user); err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to reconcile namespace %s of user.", namespace))
+			status.Instances = user.Status.Instances
+			status.Recycled = user.Status.Recycled
+			status.Message = fmt.Sprintf("failed to reconcile namespace %s: %v", namespace, err)
+			r.updateUserStatus(user, status)
+			return reconcile.Result{Requeue: true, RequeueAfter: time.Second * 30}, nil
+		}
+	}
+	template := &csv1alpha1.CodeServerTemplate{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: user.Spec.TemplateRef, Namespace: user.Namespace}, template)
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to get CodeServerTemplate %s.", user.Spec.TemplateRef))
+		status.Instances = user.Status.Instances
+		status.Recycled = user.Status.Recycled
+		status.Message = fmt.Sprintf("failed to get template %s: %v", user.Spec.TemplateRef, err)
+		r.updateUserStatus(user, status)
+		return reconcile.Result{Requeue: true, RequeueAfter: time.Second * 30}, nil
+	}
+
+	desired := map[string]bool{}
+	for _, env := range user.Spec.Environments {
+		desired[env] = true
+	}
+	recycled := map[string]bool{}
+	for _, env := range user.Status.Recycled {
+		if desired[env] {
+			recycled[env] = true
+		}
+	}
+	owned := &csv1alpha1.CodeServerList{}
+	if err := r.Client.List(context.TODO(), owned, client.InNamespace(namespace),
+		client.MatchingLabels{UserOwnerLabel: user.Name}); err != nil {
+		reqLogger.Error(err, "Failed to list code servers of user.")
+		return reconcile.Result{Requeue: true}, err
+	}
+	existing := map[string]bool{}
+	for i := range owned.Items {
+		codeServer := &owned.Items[i]
+		env := codeServer.Labels[UserEnvironmentLabel]
+		if desired[env] && !HasCondition(codeServer.Status, csv1alpha1.ServerRecycled) {
+			existing[env] = true
+			status.Instances = append(status.Instances, codeServer.Name)
+			continue
+		}
+		if desired[env] {
+			recycled[env] = true
+		}
+		reqLogger.Info(fmt.Sprintf("Deleting code server %s of environment %s.", codeServer.Name, env))
+		if err := r.Client.Delete(context.TODO(), codeServer); err != nil && !errors.IsNotFound(err) {
+			reqLogger.Error(err, fmt.Sprintf("Failed to delete code server %s.", codeServer.Name))
+			return reconcile.Result{Requeue: true}, err
+		}
+	}
+
+	maxInstances := DefaultMaxInstances
+	if user.Spec.MaxInstances != nil {
+		maxInstances = int(*user.Spec.MaxInstances)
+	}
+	for _, env := range user.Spec.Environments {
+		if existing[env] || recycled[env] {
+			continue
+		}
+		if len(existing) >= maxInstances {
+			status.Message = fmt.Sprintf("maximum %d instances reached, remaining environments are pending",
+				maxInstances)
+			break
+		}
+		codeServer := r.newCodeServerForUser(user, template, namespace, env)
+		reqLogger.Info(fmt.Sprintf("Creating code server %s of environment %s.", codeServer.Name, env))
+		if err := r.Client.Create(context.TODO(), codeServer); err != nil && !errors.IsAlreadyExists(err) {
+			reqLogger.Error(err, fmt.Sprintf("Failed to create code server %s.", codeServer.Name))
+			status.Message = fmt.Sprintf("failed to create code server %s: %v", codeServer.Name, err)
+			break
+		}
+		existing[env] = true
+		status.Instances = append(status.Instances, codeServer.Name)
+	}
+	for env := range recycled {
+		status.Recycled = append(status.Recycled, env)
+	}
+	sort.Strings(status.Instances)
+	sort.Strings(status.Recycled)
+	if err := r.updateUserStatus(user, status); err != nil {
+		return reconcile.Result{Requeue: true}, nil
+	}
+	return reconcile.Result{}, nil
+}
+
+func (r *CodeServerUserReconciler) updateUserStatus(user *csv1alpha1.CodeServerUser,
+	status csv1alpha1.CodeServerUserStatus) error {
+	if equality.Semantic.DeepEqual(user.Status, status) {
+		return nil
+	}
+	user.Status = status
+	if err := r.Client.Update(context.TODO(), user); err != nil {
+		r.Log.WithValues("namespace", user.Namespace, "name", user.Name).Error(err,
+			"Failed to update code server user status.")
+		return err
+	}
+	return nil
+}
+
+// newCodeServerForUser creates code server from template in namespace, resources are capped by the limits of user.
+func (r *CodeServerUserReconciler) newCodeServerForUser(user *csv1alpha1.CodeServerUser,
+	template *csv1alpha1.CodeServerTemplate, namespace, env string) *csv1alpha1.CodeServer {
+	codeServer := NewCodeServerFromTemplate(template, fmt.Sprintf(UserInstanceName, user.Name, env),
+		namespace, userIdentity(user))
+	codeServer.Labels[UserOwnerLabel] = user.Name
+	codeServer.Labels[UserEnvironmentLabel] = env
+	capResources(&codeServer.Spec.Resources, user.Spec.Limits)
+	if namespace != user.Namespace {
+		// owner can't live in another namespace, instance goes with the dedicated namespace instead
+		codeServer.Labels[UserOwnerNamespaceLabel] = user.Namespace
+		return codeServer
+	}
+	// Set CodeServerUser instance as the owner of the CodeServer.
+	controllerutil.SetControllerReference(user, codeServer, r.Scheme)
+	return codeServer
+}
+
+// NewCodeServerFromTemplate creates code server from template and annotates the user it belongs to.
+func NewCodeServerFromTemplate(template *csv1alpha1.CodeServerTemplate, name, namespace,
+	user string) *csv1alpha1.CodeServer {
+	labels := map[string]string{}
+	for key, value := range template.Spec.Labels {
+		labels[key] = value
+	}
+	annotations := map[string]string{}
+	for key, value := range template.Spec.Annotations {
+		annotations[key] = value
+	}
+	if len(user) != 0 {
+		annotations[UserAnnotation] = user
+	}
+	annotations[TemplateAnnotation] = template.Name
+	spec := template.Spec.Template.DeepCopy()
+	if len(spec.Subdomain) == 0 {
+		spec.Subdomain = name
+	}
+	if spec.InactiveAfterSeconds == nil {
+		inactive := int64(MaxActiveSeconds)
+		spec.InactiveAfterSeconds = &inactive
+	}
+	return &csv1alpha1.CodeServer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: *spec,
+	}
+}
+
+func userIdentity(user *csv1alpha1.CodeServerUser) string {
+	if len(user.Spec.Email) != 0 {
+		return user.Spec.Email
+	}
+	if len(user.Spec.Subject) != 0 {
+		return user.Spec.Subject
+	}
+	return user.Name
+}
+
+// capResources lowers requests and limits to the upper bound, limits are added if missing.
+func capResources(resources *corev1.ResourceRequirements, upper corev1.ResourceList) {
+	if len(upper) == 0 {
+		return
+	}
+	if resources.Limits == nil {
+		resources.Limits = corev1.ResourceList{}
+	}
+	for name, bound := range upper {
+		if value, ok := resources.Requests[name]; ok && value.Cmp(bound) > 0 {
+			resources.Requests[name] = bound.DeepCopy()
+		}
+		if value, ok := resources.Limits[name]; !ok || value.Cmp(bound) > 0 {
+			resources.Limits[name] = bound.DeepCopy()
+		}
+	}
+}
+
+func (r *CodeServerUserReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&csv1alpha1.CodeServerUser{}).Owns(&csv1alpha1.CodeServer{}).
+		Watches(&source.Kind{Type: &csv1alpha1.CodeServer{}}, handler.EnqueueRequestsFromMapFunc(userInstanceRequests)).
+		Complete(r)
+}
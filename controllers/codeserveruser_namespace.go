@@ -0,0 +1,266 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"strings"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	// UserNamespaceFinalizer guarantees the dedicated namespace of user is deleted along with the user.
+	UserNamespaceFinalizer = "codeserver.io/user-namespace"
+	// UserNamespaceLabel marks the namespaces dedicated to users, instances of other users are isolated from them.
+	UserNamespaceLabel = "codeserver.io/user-namespace"
+	// UserOwnerNamespaceLabel records the namespace of the user owning a dedicated namespace and its instances.
+	UserOwnerNamespaceLabel = "codeserver.io/owner-namespace"
+	UserNamespaceResource   = "codeserver-user"
+	// maxNamespaceLength is the maximum length of namespace names, i.e. a DNS label.
+	maxNamespaceLength = 63
+)
+
+// userNamespaceName returns the dedicated namespace of user. Names are suffixed by the hash of namespace and name
+// of user, since both may contain dashes, e.g. users a-b/c and a/b-c, and dots of user names are replaced. Long names
+// are truncated before the hash.
+func userNamespaceName(prefix string, user *csv1alpha1.CodeServerUser) string {
+	digest := sha256.Sum256([]byte(user.Namespace + "/" + user.Name))
+	suffix := "-" + hex.EncodeToString(digest[:])[:8]
+	name := strings.ReplaceAll(prefix+user.Namespace+"-"+user.Name, ".", "-")
+	if len(name) > maxNamespaceLength-len(suffix) {
+		name = strings.TrimRight(name[:maxNamespaceLength-len(suffix)], "-")
+	}
+	return name + suffix
+}
+
+// instanceNamespace returns the namespace instances of user are placed in.
+func (r *CodeServerUserReconciler) instanceNamespace(user *csv1alpha1.CodeServerUser) string {
+	if r.Options.Load().UserNamespaces {
+		return userNamespaceName(r.Options.Load().UserNamespacePrefix, user)
+	}
+	return user.Namespace
+}
+
+// userNamespaceLabels returns the labels of dedicated namespace and the resources provisioned in it.
+func userNamespaceLabels(user *csv1alpha1.CodeServerUser) map[string]string {
+	return map[string]string{
+		UserNamespaceLabel:      "true",
+		UserOwnerLabel:          user.Name,
+		UserOwnerNamespaceLabel: user.Namespace,
+	}
+}
+
+// reconcileForUserNamespace creates the dedicated namespace of user with its quota, network policy and role
+// binding, they are kept in sync with user.
+func (r *CodeServerUserReconciler) reconcileForUserNamespace(user *csv1alpha1.CodeServerUser) error {
+	if !controllerutil.ContainsFinalizer(user, UserNamespaceFinalizer) {
+		controllerutil.AddFinalizer(user, UserNamespaceFinalizer)
+		if err := r.Client.Update(context.TODO(), user); err != nil {
+			return err
+		}
+	}
+	name := r.instanceNamespace(user)
+	namespace := &corev1.Namespace{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name}, namespace)
+	if errors.IsNotFound(err) {
+		r.Log.Info(fmt.Sprintf("Creating namespace %s of user %s/%s.", name, user.Namespace, user.Name))
+		namespace = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: userNamespaceLabels(user)}}
+		if err := r.Client.Create(context.TODO(), namespace); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if namespace.Labels[UserOwnerLabel] != user.Name || namespace.Labels[UserOwnerNamespaceLabel] != user.Namespace {
+		return fmt.Errorf("namespace %s exists but isn't dedicated to user %s/%s", name, user.Namespace, user.Name)
+	}
+	if err := r.applyUserResource(user, name, &corev1.ResourceQuota{}, func(obj client.Object) bool {
+		quota := obj.(*corev1.ResourceQuota)
+		hard := userQuota(user)
+		if equality.Semantic.DeepEqual(quota.Spec.Hard, hard) {
+			return false
+		}
+		quota.Spec.Hard = hard
+		return true
+	}); err != nil {
+		return err
+	}
+	if err := r.applyUserResource(user, name, &corev1.LimitRange{}, func(obj client.Object) bool {
+		limitRange := obj.(*corev1.LimitRange)
+		spec := sidecarLimitRange(user.Spec.Limits)
+		if equality.Semantic.DeepEqual(limitRange.Spec, spec) {
+			return false
+		}
+		limitRange.Spec = spec
+		return true
+	}); err != nil {
+		return err
+	}
+	if err := r.applyUserResource(user, name, &networkingv1.NetworkPolicy{}, func(obj client.Object) bool {
+		policy := obj.(*networkingv1.NetworkPolicy)
+		spec := userNetworkPolicy()
+		if equality.Semantic.DeepEqual(policy.Spec, spec) {
+			return false
+		}
+		policy.Spec = spec
+		return true
+	}); err != nil {
+		return err
+	}
+	if len(r.Options.Load().UserNamespaceRole) == 0 {
+		return nil
+	}
+	return r.applyUserResource(user, name, &rbacv1.RoleBinding{}, func(obj client.Object) bool {
+		binding := obj.(*rbacv1.RoleBinding)
+		roleRef := rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: r.Options.Load().UserNamespaceRole}
+		subjects := []rbacv1.Subject{{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: userIdentity(user)}}
+		if equality.Semantic.DeepEqual(binding.RoleRef, roleRef) &&
+			equality.Semantic.DeepEqual(binding.Subjects, subjects) {
+			return false
+		}
+		// role of binding is immutable, binding is recreated instead
+		if len(binding.RoleRef.Name) != 0 && !equality.Semantic.DeepEqual(binding.RoleRef, roleRef) {
+			if err := r.Client.Delete(context.TODO(), binding); err != nil && !errors.IsNotFound(err) {
+				r.Log.Error(err, fmt.Sprintf("Failed to delete role binding of namespace %s.", name))
+			}
+			binding.ResourceVersion = ""
+		}
+		binding.RoleRef = roleRef
+		binding.Subjects = subjects
+		return true
+	})
+}
+
+// applyUserResource creates the resource named UserNamespaceResource in namespace or updates it if mutate changed
+// it.
+func (r *CodeServerUserReconciler) applyUserResource(user *csv1alpha1.CodeServerUser, namespace string,
+	obj client.Object, mutate func(obj client.Object) bool) error {
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: UserNamespaceResource, Namespace: namespace}, obj)
+	if errors.IsNotFound(err) {
+		obj.SetName(UserNamespaceResource)
+		obj.SetNamespace(namespace)
+		obj.SetLabels(userNamespaceLabels(user))
+		mutate(obj)
+		return r.Client.Create(context.TODO(), obj)
+	}
+	if err != nil {
+		return err
+	}
+	if !mutate(obj) {
+		return nil
+	}
+	if len(obj.GetResourceVersion()) == 0 {
+		return r.Client.Create(context.TODO(), obj)
+	}
+	return r.Client.Update(context.TODO(), obj)
+}
+
+// userQuota allows the maximum number of instances of user and, if user is limited, as many times the limits of
+// every instance plus its sidecars defaulted by the LimitRange.
+func userQuota(user *csv1alpha1.CodeServerUser) corev1.ResourceList {
+	instances := int64(DefaultMaxInstances)
+	if user.Spec.MaxInstances != nil {
+		instances = int64(*user.Spec.MaxInstances)
+	}
+	hard := corev1.ResourceList{CodeServerCountResource: *resourcev1.NewQuantity(instances, resourcev1.DecimalSI)}
+	for name, value := range user.Spec.Limits {
+		if name == corev1.ResourceCPU || name == corev1.ResourceMemory || name == corev1.ResourceEphemeralStorage {
+			addQuantity(hard, corev1.ResourceName("limits."+string(name)), value, instances)
+		}
+		addQuantity(hard, corev1.ResourceName(corev1.DefaultResourceRequestsPrefix+string(name)), value, instances)
+	}
+	sidecarRequests, sidecarLimits := sidecarResources(user.Spec.Limits)
+	for name, value := range sidecarLimits {
+		if _, found := user.Spec.Limits[name]; found {
+			addQuantity(hard, corev1.ResourceName("limits."+string(name)), value,
+				instances*TemplateSidecarsPerInstance)
+			addQuantity(hard, corev1.ResourceName(corev1.DefaultResourceRequestsPrefix+string(name)),
+				sidecarRequests[name], instances*TemplateSidecarsPerInstance)
+		}
+	}
+	return hard
+}
+
+// userNetworkPolicy admits traffic from the namespace itself and from namespaces not dedicated to users, e.g.
+// ingress controllers and operator, so that instances of users are isolated from each other.
+func userNetworkPolicy() networkingv1.NetworkPolicySpec {
+	return networkingv1.NetworkPolicySpec{
+		PodSelector: metav1.LabelSelector{},
+		PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+		Ingress: []networkingv1.NetworkPolicyIngressRule{
+			{
+				From: []networkingv1.NetworkPolicyPeer{
+					{PodSelector: &metav1.LabelSelector{}},
+					{NamespaceSelector: &metav1.LabelSelector{
+						MatchExpressions: []metav1.LabelSelectorRequirement{
+							{Key: UserNamespaceLabel, Operator: metav1.LabelSelectorOpDoesNotExist},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// finalizeUser deletes the dedicated namespace of user being deleted along with everything in it, and removes the
+// finalizer afterwards.
+func (r *CodeServerUserReconciler) finalizeUser(user *csv1alpha1.CodeServerUser) (reconcile.Result, error) {
+	if !controllerutil.ContainsFinalizer(user, UserNamespaceFinalizer) {
+		return reconcile.Result{}, nil
+	}
+	// namespaces are found by labels rather than name, so that namespaces named by a former prefix are deleted too
+	namespaces := &corev1.NamespaceList{}
+	if err := r.Client.List(context.TODO(), namespaces, client.MatchingLabels(userNamespaceLabels(user))); err != nil {
+		return reconcile.Result{Requeue: true}, err
+	}
+	for i := range namespaces.Items {
+		namespace := &namespaces.Items[i]
+		r.Log.Info(fmt.Sprintf("Deleting namespace %s of user %s/%s.", namespace.Name, user.Namespace, user.Name))
+		if err := r.Client.Delete(context.TODO(), namespace); err != nil && !errors.IsNotFound(err) {
+			return reconcile.Result{Requeue: true}, err
+		}
+	}
+	controllerutil.RemoveFinalizer(user, UserNamespaceFinalizer)
+	return reconcile.Result{}, r.Client.Update(context.TODO(), user)
+}
+
+// userInstanceRequests maps the instances in dedicated namespaces to their users, they can't be owned by users of
+// other namespaces.
+func userInstanceRequests(obj client.Object) []reconcile.Request {
+	labels := obj.GetLabels()
+	if len(labels[UserOwnerLabel]) == 0 || len(labels[UserOwnerNamespaceLabel]) == 0 {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{
+		Name:      labels[UserOwnerLabel],
+		Namespace: labels[UserOwnerNamespaceLabel],
+	}}}
+}
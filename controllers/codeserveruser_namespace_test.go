@@ -0,0 +1,62 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+func TestUserNamespaceName(t *testing.T) {
+	user := func(namespace, name string) *csv1alpha1.CodeServerUser {
+		return &csv1alpha1.CodeServerUser{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	}
+	tests := []struct {
+		name       string
+		user       *csv1alpha1.CodeServerUser
+		other      *csv1alpha1.CodeServerUser
+		wantPrefix string
+	}{
+		{name: "short", user: user("team", "alice"), other: user("team", "bob"), wantPrefix: "codeserver-team-alice-"},
+		{name: "dashes", user: user("a-b", "c"), other: user("a", "b-c"), wantPrefix: "codeserver-a-b-c-"},
+		{name: "dots", user: user("team", "alice.smith"), other: user("team", "alice-smith"),
+			wantPrefix: "codeserver-team-alice-smith-"},
+		{name: "truncated", user: user("team", strings.Repeat("a", 60)),
+			other: user("team", strings.Repeat("a", 61)), wantPrefix: "codeserver-team-aaaa"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := userNamespaceName("codeserver-", tt.user)
+			if !strings.HasPrefix(got, tt.wantPrefix) {
+				t.Errorf("userNamespaceName(%s/%s) = %q, want prefix %q", tt.user.Namespace, tt.user.Name, got,
+					tt.wantPrefix)
+			}
+			if errs := validation.IsDNS1123Label(got); len(errs) != 0 {
+				t.Errorf("userNamespaceName(%s/%s) = %q, invalid: %v", tt.user.Namespace, tt.user.Name, got, errs)
+			}
+			if other := userNamespaceName("codeserver-", tt.other); other == got {
+				t.Errorf("userNamespaceName(%s/%s) = userNamespaceName(%s/%s) = %q", tt.user.Namespace,
+					tt.user.Name, tt.other.Namespace, tt.other.Name, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"strings"
+	"time"
+
+	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
+)
+
+const (
+	WorkshopLabel            = "codeserver.io/workshop"
+	WorkshopParticipantLabel = "codeserver.io/participant"
+	WorkshopInstanceName     = "%s-%s"
+	AnonymousParticipant     = "participant-%d"
+)
+
+// CodeServerWorkshopReconciler fans out code servers of workshop participants from template and tears them down
+// once workshop finished
+type CodeServerWorkshopReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeserverworkshops,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=cs.opensourceways.com,resources=codeserverworkshops/status,verbs=get;update;patch
+func (r *CodeServerWorkshopReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	reqLogger := r.Log.WithValues("codeserverworkshop", req.NamespacedName)
+	workshop := &csv1alpha1.CodeServerWorkshop{}
+	err := r.Client.Get(context.TODO(), req.NamespacedName, workshop)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			reqLogger.Info("CodeServerWorkshop has been deleted, code servers will be garbage collected.")
+			return reconcile.Result{}, nil
+		}
+		reqLogger.Error(err, "Failed to get CodeServerWorkshop.")
+		return reconcile.Result{}, err
+	}
+	owned := &csv1alpha1.CodeServerList{}
+	if err := r.Client.List(context.TODO(), owned, client.InNamespace(workshop.Namespace),
+		client.MatchingLabels{WorkshopLabel: workshop.Name}); err != nil {
+		reqLogger.Error(err, "Failed to list code servers of workshop.")
+		return reconcile.Result{Requeue: true}, err
+	}
+	// instances are matched with participants by user rather than name, so that instances named by older releases
+	// are kept
+	desired := map[string]bool{}
+	if !workshop.Spec.Finished {
+		for _, participant := range workshopParticipants(workshop) {
+			desired[participant] = true
+		}
+	}
+	existing := map[string]*csv1alpha1.CodeServer{}
+	for i := range owned.Items {
+		codeServer := &owned.Items[i]
+		participant := codeServer.Annotations[UserAnnotation]
+		if _, found := existing[participant]; desired[participant] && !found {
+			existing[participant] = codeServer
+			continue
+		}
+		reqLogger.Info(fmt.Sprintf("Deleting code server %s of workshop.", codeServer.Name))
+		if err := r.Client.Delete(context.TODO(), codeServer); err != nil && !errors.IsNotFound(err) {
+			reqLogger.Error(err, fmt.Sprintf("Failed to delete code server %s.", codeServer.Name))
+			return reconcile.Result{Requeue: true}, err
+		}
+	}
+	if workshop.Spec.Finished {
+		r.updateWorkshopStatus(workshop, csv1alpha1.CodeServerWorkshopStatus{Phase: csv1alpha1.WorkshopFinished})
+		return reconcile.Result{}, nil
+	}
+
+	status := csv1alpha1.CodeServerWorkshopStatus{}
+	template := &csv1alpha1.CodeServerTemplate{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: workshop.Spec.TemplateRef,
+		Namespace: workshop.Namespace}, template)
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to get CodeServerTemplate %s.", workshop.Spec.TemplateRef))
+		status.Message = fmt.Sprintf("failed to get template %s: %v", workshop.Spec.TemplateRef, err)
+	}
+	for _, participant := range workshopParticipants(workshop) {
+		name := workshopInstanceName(workshop, participant)
+		codeServer, found := existing[participant]
+		if found {
+			name = codeServer.Name
+		} else if err == nil {
+			codeServer = r.newCodeServerForParticipant(workshop, template, participant)
+			reqLogger.Info(fmt.Sprintf("Creating code server %s of participant %s.", name, participant))
+			if err := r.Client.Create(context.TODO(), codeServer); err != nil && !errors.IsAlreadyExists(err) {
+				reqLogger.Error(err, fmt.Sprintf("Failed to create code server %s.", name))
+				status.Message = fmt.Sprintf("failed to create code server %s: %v", name, err)
+			}
+		}
+		participantStatus := csv1alpha1.WorkshopParticipantStatus{Name: participant, Instance: name}
+		if codeServer != nil {
+			if ready := GetCondition(codeServer.Status, csv1alpha1.ServerReady); ready != nil &&
+				ready.Status == corev1.ConditionTrue {
+				participantStatus.Ready = true
+				participantStatus.URL = ready.Message[InstanceEndpoint]
+			}
+			participantStatus.CredentialsSecret = codeServer.Status.AuthSecretName
+		}
+		if participantStatus.Ready {
+			status.Ready++
+		}
+		status.Total++
+		status.Participants = append(status.Participants, participantStatus)
+	}
+	status.Phase = csv1alpha1.WorkshopProvisioning
+	if status.Ready == status.Total {
+		status.Phase = csv1alpha1.WorkshopReady
+	}
+	if err := r.updateWorkshopStatus(workshop, status); err != nil {
+		return reconcile.Result{Requeue: true}, nil
+	}
+	if len(status.Message) != 0 {
+		return reconcile.Result{Requeue: true, RequeueAfter: time.Second * 30}, nil
+	}
+	return reconcile.Result{}, nil
+}
+
+// workshopParticipants returns the listed participants, or the anonymous ones if not listed.
+func workshopParticipants(workshop *csv1alpha1.CodeServerWorkshop) []string {
+	if len(workshop.Spec.Participants) != 0 || workshop.Spec.Count == nil {
+		return workshop.Spec.Participants
+	}
+	var participants []string
+	for index := 1; index <= int(*workshop.Spec.Count); index++ {
+		participants = append(participants, fmt.Sprintf(AnonymousParticipant, index))
+	}
+	return participants
+}
+
+// workshopInstanceName returns the instance name of participant, it's suffixed by the hash of the raw participant
+// so that participants whose names normalize to the same name, e.g. "a.b" and "a-b", get distinct instances.
+func workshopInstanceName(workshop *csv1alpha1.CodeServerWorkshop, participant string) string {
+	return identityName(fmt.Sprintf(WorkshopInstanceName, workshop.Name, normalizeName(participant)),
+		MaxChildNameLength, fmt.Sprintf("%s/%s", workshop.Name, participant))
+}
+
+func (r *CodeServerWorkshopReconciler) updateWorkshopStatus(workshop *csv1alpha1.CodeServerWorkshop,
+	status csv1alpha1.CodeServerWorkshopStatus) error {
+	if equality.Semantic.DeepEqual(workshop.Status, status) {
+		return nil
+	}
+	workshop.Status = status
+	if err := r.Client.Update(context.TODO(), workshop); err != nil {
+		r.Log.WithValues("namespace", workshop.Namespace, "name", workshop.Name).Error(err,
+			"Failed to update code server workshop status.")
+		return err
+	}
+	return nil
+}
+
+// newCodeServerForParticipant creates code server from template, authentication is always enabled so that every
+// participant gets its own credentials.
+func (r *CodeServerWorkshopReconciler) newCodeServerForParticipant(workshop *csv1alpha1.CodeServerWorkshop,
+	template *csv1alpha1.CodeServerTemplate, participant string) *csv1alpha1.CodeServer {
+	name := workshopInstanceName(workshop, participant)
+	codeServer := NewCodeServerFromTemplate(template, name, workshop.Namespace, participant)
+	codeServer.Labels[WorkshopLabel] = workshop.Name
+	codeServer.Labels[WorkshopParticipantLabel] = strings.TrimPrefix(name, workshop.Name+"-")
+	codeServer.Spec.Auth = workshop.Spec.Auth
+	if len(codeServer.Spec.Auth) == 0 {
+		codeServer.Spec.Auth = csv1alpha1.AuthPassword
+	}
+	// Set CodeServerWorkshop instance as the owner of the CodeServer.
+	controllerutil.SetControllerReference(workshop, codeServer, r.Scheme)
+	return codeServer
+}
+
+func (r *CodeServerWorkshopReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&csv1alpha1.CodeServerWorkshop{}).
+		Owns(&csv1alpha1.CodeServer{}).
+		Complete(r)
+}
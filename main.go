@@ -17,19 +17,32 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	csv1alpha1 "github.com/opensourceways/code-server-operator/api/v1alpha1"
 	"github.com/opensourceways/code-server-operator/controllers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -38,9 +51,8 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
-const (
-	REQUEST_CHAN_SIZE = 10
-)
+// LeaderElectionID is the lease held by the leader of operator replicas.
+const LeaderElectionID = "code-server-operator"
 
 func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
@@ -71,10 +83,32 @@ func SetupSignalHandler() (stopCh <-chan struct{}) {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var enableWebhook bool
+	var watchNamespaces, traefikEntryPoints, prepullImages, prepullNodeSelector, ingressIPFamilies string
+	var registryMirrors, hostPathPrefixes, archiveURLPrefixes string
+	var tlsMinVersion, tlsCipherSuites, probeCAFile, metricsCertDir string
+	var metricsAuth, metricsTokenFile string
+	var logLevelName string
+	var leaseDuration, renewDeadline, retryPeriod time.Duration
+	var releaseOnCancel bool
+	var gracefulShutdownTimeout time.Duration
+	var resyncPeriod time.Duration
+	var priceSheet string
 	csOption := controllers.CodeServerOption{}
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
+	flag.DurationVar(&leaseDuration, "leader-election-lease-duration", 15*time.Second,
+		"Duration that non-leader candidates will wait to force acquire leadership.")
+	flag.DurationVar(&renewDeadline, "leader-election-renew-deadline", 10*time.Second,
+		"Duration that the leader will retry refreshing leadership before giving up.")
+	flag.DurationVar(&retryPeriod, "leader-election-retry-period", 2*time.Second,
+		"Duration the leader election clients should wait between tries of actions.")
+	flag.DurationVar(&gracefulShutdownTimeout, "graceful-shutdown-timeout", 30*time.Second,
+		"Duration given to in-flight reconciles and workers to finish on shutdown, it should be shorter than the "+
+			"termination grace period of operator pod.")
+	flag.BoolVar(&releaseOnCancel, "leader-election-release-on-cancel", true,
+		"Release the leader lease on shutdown once all workers stopped, so that the new leader takes over immediately.")
 	flag.StringVar(&csOption.DomainName, "domain-name", "pool1.playground.osinfra.cn", "Code server domain name.")
 	flag.StringVar(&csOption.VSExporterImage, "vs-default-exporter", "tommylike/active-exporter-x86:latest",
 		"Default exporter image used as a code server sidecar for VS code instance.")
@@ -86,50 +120,699 @@ func main() {
 	flag.StringVar(&csOption.LxdClientSecretName, "lxd-client-secret-name", "lxd-client-secret", "Secret which holds the key and secret for lxc client to communicate to server.")
 	flag.BoolVar(&csOption.EnableUserIngress, "enable-user-ingress", false, "enable user ingress for visiting.")
 	flag.IntVar(&csOption.MaxConcurrency, "max-concurrency", 10, "Max concurrency of reconcile worker.")
+	flag.BoolVar(&csOption.DisableDocker, "disable-docker", false, "Disallow docker in docker or buildkit sidecar and privileged containers for all instances.")
+	flag.StringVar(&csOption.DindImage, "dind-image", "docker:20.10-dind", "Default image used for docker in docker sidecar.")
+	flag.StringVar(&csOption.BuildkitImage, "buildkit-image", "moby/buildkit:v0.10.3", "Default image used for buildkit sidecar.")
+	flag.BoolVar(&csOption.EnableBucketMounts, "enable-bucket-mounts", false,
+		"Allow the privileged FUSE sidecars mounting S3 or GCS buckets, instances with buckets are denied otherwise.")
+	flag.StringVar(&csOption.BucketMountImage, "bucket-mount-image", "rclone/rclone:1.65",
+		"Default image used for the sidecars mounting S3 or GCS buckets.")
+	flag.StringVar(&csOption.SSHImage, "ssh-image", "linuxserver/openssh-server:latest", "Default image used for ssh server sidecar.")
+	flag.StringVar(&csOption.AuditSinkType, "audit-sink-type", "webhook", "Type of audit sink, 'webhook', 'cloudevents' and 'kafka' are supported.")
+	flag.StringVar(&csOption.AuditSinkURL, "audit-sink-url", "", "Url of audit sink (kafka rest proxy for kafka sink), audit will be disabled if empty.")
+	flag.StringVar(&csOption.AuditKafkaTopic, "audit-kafka-topic", "", "Kafka topic audit records will be produced to.")
+	flag.StringVar(&csOption.NotificationURL, "notification-url", "", "Webhook notified for all code server instances, disabled if empty.")
+	flag.StringVar(&csOption.NotificationFormat, "notification-format", "json", "Payload format of operator webhook, 'json' and 'slack' are supported.")
+	flag.IntVar(&csOption.RecycleNotifyLead, "recycle-notify-lead", 600, "time in seconds before recycle to send recycle warning notification.")
+	flag.IntVar(&csOption.InactiveGracePeriod, "inactive-grace-period", 300,
+		"time in seconds code server stays pending recycle before marking inactive, 0 means marking inactive immediately.")
+	flag.StringVar(&csOption.RolloutImage, "rollout-image", "",
+		"code server image rolled out to vs code instances whose update policy is not Never, disabled if empty.")
+	flag.IntVar(&csOption.RolloutInterval, "rollout-interval", 60, "time in seconds between two rollout batches.")
+	flag.IntVar(&csOption.RolloutMaxUnavail, "rollout-max-unavailable", 1,
+		"maximum number of instances that can be unavailable during rolling image update.")
+	flag.BoolVar(&csOption.SkipArchCheck, "skip-arch-check", false,
+		"Skip checking whether image manifest contains the architecture specified in code server.")
+	flag.StringVar(&csOption.APIServerAddr, "api-server-addr", "",
+		"The address the provisioning api server binds to, disabled if empty.")
+	flag.StringVar(&csOption.APITokenFile, "api-token-file", "",
+		"File of bearer tokens for api server, every line is in the format of 'token,user,namespace1;namespace2'.")
+	flag.StringVar(&csOption.APIServerCertDir, "api-server-cert-dir", "",
+		"Directory of tls.crt and tls.key the api server is served over https with, a self signed certificate is used if empty.")
+	flag.StringVar(&csOption.OperatorConfigName, "operator-config-name", "default",
+		"Name of the cluster scoped CodeServerOperatorConfig which overrides flags at runtime.")
+	flag.StringVar(&csOption.ConfigFile, "config-file", "",
+		"Config file (usually mounted from ConfigMap) which overrides flags and is reloaded on change.")
+	flag.StringVar(&csOption.LxdRemotesFile, "lxd-remotes-file", "",
+		"File of lxd remotes which lxd instances are scheduled across, every line is in the format of 'name,endpoint,secret,capacity', lxd server on node is used if empty.")
+	flag.StringVar(&csOption.TeamLabel, "team-label", "",
+		"Label of code server identifying its team, instances of the same team are spread across topology domains by default, disabled if empty.")
+	flag.StringVar(&csOption.SpreadTopologyKey, "spread-topology-key", corev1.LabelTopologyZone,
+		"Node label key of topology domains which instances of the same team are spread across.")
+	flag.BoolVar(&enableWebhook, "enable-webhook", false,
+		"Enable mutating webhook which applies restricted security context defaults and validating webhooks which enforce allowed groups of templates and resource bounds, serving certs are required.")
+	flag.StringVar(&csOption.OwnershipImage, "ownership-image", "busybox:1.35",
+		"Image used by the job which prepares workspace ownership for rootless instances.")
+	flag.StringVar(&csOption.ActivityAddr, "activity-addr", "",
+		"The address the activity server binds to, exporters push activity events instead of being probed, disabled if empty.")
+	flag.StringVar(&csOption.ActivityPushURL, "activity-push-url", "",
+		"In cluster url of activity server injected into exporters, e.g. 'http://code-server-operator.code-server-system:8090'.")
+	flag.StringVar(&csOption.IngressAccessLog, "ingress-access-log", "",
+		"File of ingress access logs in json lines written by log adapter, enables 'ingress' activity source if not empty.")
+	flag.IntVar(&csOption.FinalizerTimeout, "finalizer-timeout", 600,
+		"time in seconds to retry cleaning up a deleted code server before its finalizer is forcibly removed, 0 means retrying forever.")
+	flag.IntVar(&csOption.GCInterval, "gc-interval", 600,
+		"time in seconds between two sweeps of orphan resources whose code server no longer exists, 0 disables the sweeper.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma separated namespaces operator watches, all namespaces are watched if empty. Namespace scoped permissions are enough when specified.")
+	flag.IntVar(&csOption.ShardCount, "shard-count", 1,
+		"Number of operator replicas code servers are sharded across by consistent hash of namespace/name.")
+	flag.IntVar(&csOption.ShardID, "shard-id", -1,
+		"Shard handled by this replica, ordinal suffix of hostname (e.g. statefulset pod name) is used if negative.")
+	flag.Float64Var(&csOption.CreateQPS, "create-qps", 0,
+		"Maximum number of instances created per second, unlimited if not positive.")
+	flag.IntVar(&csOption.CreateBurst, "create-burst", 10, "Maximum burst of instance creation.")
+	flag.IntVar(&csOption.BackgroundConcurrency, "background-concurrency", 0,
+		"Reconcile workers available for background work, e.g. steady state and recycling, half of max concurrency if not positive.")
+	flag.IntVar(&csOption.StatusFlushInterval, "status-flush-interval", 15,
+		"time in seconds between two batches of status reports written by watcher.")
+	flag.StringVar(&csOption.IngressProvider, "ingress-provider", controllers.IngressProviderIngress,
+		"Provider used to route instances, 'ingress', 'istio', 'traefik' and 'none' are supported, instances are only reachable in cluster with 'none'.")
+	flag.StringVar(&csOption.MeshGateway, "mesh-gateway", "",
+		"Istio gateway bound by VirtualService of instances in form of <namespace>/<name>, required by istio provider.")
+	flag.StringVar(&traefikEntryPoints, "traefik-entrypoints", "websecure",
+		"Comma separated traefik entry points of IngressRoute of instances.")
+	flag.StringVar(&csOption.TraefikAuthURL, "traefik-auth-url", "",
+		"Address of forward authentication service applied to instances routed by traefik, disabled if empty.")
+	flag.StringVar(&csOption.ActivatorAddr, "activator-addr", "",
+		"The address activator binds to, requests to inactive instances are served by activator if specified.")
+	flag.StringVar(&csOption.ActivatorService, "activator-service", "",
+		"DNS name of the service exposing activator on port 8080, inactive instances are routed to it if specified.")
+	flag.IntVar(&csOption.ActivatorTimeout, "activator-timeout", 300,
+		"time in seconds activator holds request until woken instance becomes ready.")
+	flag.StringVar(&csOption.JupyterHubTemplate, "jupyterhub-template", "",
+		"Default CodeServerTemplate of servers spawned by JupyterHub via api server.")
+	flag.StringVar(&csOption.PrepullNamespace, "prepull-namespace", "",
+		"Namespace of the resource pre-pulling images of code servers to nodes, disabled if empty.")
+	flag.StringVar(&csOption.PrepullProvider, "prepull-provider", controllers.PrepullProviderDaemonSet,
+		"Provider pre-pulling images, 'daemonset' and 'kubefledged' are supported.")
+	flag.StringVar(&prepullImages, "prepull-images", "",
+		"Comma separated images pre-pulled besides exporter, rollout and template images.")
+	flag.StringVar(&prepullNodeSelector, "prepull-node-selector", "",
+		"Nodes images are pre-pulled to in form of key1=value1,key2=value2, all nodes if empty.")
+	flag.IntVar(&csOption.PrepullInterval, "prepull-interval", 300,
+		"time in seconds between two syncs of pre-pulled images.")
+	flag.StringVar(&csOption.ImagePullSecret, "image-pull-secret", "",
+		"Default pull secret attached to pods of all instances, it must exist in namespaces of instances unless replicated.")
+	flag.StringVar(&csOption.SessionStoreURL, "session-store-url", "",
+		"Rclone remote path terminal session recordings are uploaded to, e.g. s3:bucket/sessions, required to record sessions.")
+	flag.StringVar(&csOption.SessionStoreSecret, "session-store-secret", "",
+		"Secret in namespaces of instances whose keys are rclone environments of session store, e.g. RCLONE_CONFIG_S3_TYPE.")
+	flag.StringVar(&csOption.SessionRecorderImage, "session-recorder-image", "rclone/rclone:1.59",
+		"Image of the sidecar uploading terminal session recordings.")
+	flag.IntVar(&csOption.SessionRetentionDays, "session-retention-days", 90,
+		"Days terminal session recordings are kept in session store.")
+	flag.BoolVar(&csOption.RecordSessions, "record-sessions", false,
+		"Record terminal sessions of all instances of vscode runtime, instances may opt in with spec.audit.recordSessions otherwise.")
+	flag.StringVar(&csOption.PullSecretNamespace, "pull-secret-namespace", "",
+		"Namespace the default pull secret is replicated from into namespaces of instances, replication is disabled if empty.")
+	flag.StringVar(&csOption.DriftMode, "drift-mode", controllers.DriftModeEnforce,
+		"How out-of-band edits of generated deployments, services and ingresses are handled, 'enforce' reverts them and 'detect' records ServerDrifted condition.")
+	flag.BoolVar(&csOption.DryRun, "dry-run", false,
+		"Record the resources of all instances in <name>-dry-run config maps instead of applying them.")
+	flag.IntVar(&csOption.TTLInterval, "ttl-interval", 60,
+		"time in seconds between two sweeps of instances whose ttl expired, 0 disables ttl enforcement.")
+	flag.IntVar(&csOption.BudgetInterval, "budget-interval", 300,
+		"time in seconds between two accountings of instance budgets, 0 disables budget enforcement.")
+	flag.IntVar(&csOption.EntitlementInterval, "entitlement-interval", 600,
+		"time in seconds between two syncs of ldap groups referred by templates, 0 disables sync.")
+	flag.StringVar(&csOption.LDAPURL, "ldap-url", "",
+		"ldaps:// or ldap:// url (upgraded by StartTLS) of directory which group membership is synced from, disabled if empty.")
+	flag.StringVar(&csOption.LDAPBindDN, "ldap-bind-dn", "", "DN to bind to directory with, anonymous if empty.")
+	flag.StringVar(&csOption.LDAPBindPasswordFile, "ldap-bind-password-file", "",
+		"File which holds the password of bind DN.")
+	flag.StringVar(&csOption.LDAPUserBaseDN, "ldap-user-base-dn", "", "DN under which users are searched.")
+	flag.StringVar(&csOption.LDAPUserFilter, "ldap-user-filter", "(objectClass=person)",
+		"Filter of users, only equality and presence filters combined with & and | are supported, values are escaped as in RFC 4515.")
+	flag.StringVar(&csOption.LDAPUserAttribute, "ldap-user-attribute", "mail",
+		"Attribute of user entry matched against the user annotation of instances.")
+	flag.StringVar(&csOption.LDAPGroupAttribute, "ldap-group-attribute", "memberOf",
+		"Attribute of user entry which lists the DNs of groups user is member of.")
+	flag.IntVar(&csOption.FleetStatusInterval, "fleet-status-interval", 30,
+		"time in seconds between two refreshes of the cluster scoped fleet status, 0 disables it.")
+	flag.StringVar(&csOption.TracingEndpoint, "tracing-endpoint", "",
+		"OTLP/HTTP endpoint where spans of reconciles, probes and api calls are exported, e.g. "+
+			"http://otel-collector:4318, tracing is disabled if empty.")
+	flag.IntVar(&csOption.ProbeWorkers, "probe-workers", 20,
+		"Number of instances probed concurrently in every probe round.")
+	flag.IntVar(&csOption.ProbeTimeout, "probe-timeout", 5, "time in seconds before probing an instance times out.")
+	flag.IntVar(&csOption.ProbeHostConcurrency, "probe-host-concurrency", 2,
+		"Number of concurrent probes against the same endpoint host, 0 means no limit.")
+	flag.BoolVar(&csOption.FilterUpdates, "filter-updates", true,
+		"Skip reconciling on updates which only touch status or bookkeeping metadata of instances and generated resources.")
+	flag.DurationVar(&resyncPeriod, "resync-period", 10*time.Hour,
+		"Period all watched resources are resynced and reconciled again regardless of updates.")
+	flag.StringVar(&csOption.ArchiveImage, "archive-image", "curlimages/curl:7.85.0",
+		"Image used by the jobs which export workspaces to and import workspaces from tar.gz archives, curl and tar are required.")
+	flag.BoolVar(&csOption.CostLabels, "cost-labels", false,
+		"Stamp cost allocation labels (instance, user, team and template) on generated resources and pods of instances.")
+	flag.StringVar(&priceSheet, "price-sheet", "",
+		"Price sheet file of hourly resource prices which instance costs in status are estimated with, disabled if empty.")
+	flag.StringVar(&csOption.OAuth2ProxyURL, "oauth2-proxy-url", "",
+		"Url of oauth2 proxy which authenticates collaborators by their emails, collaborators get generated passwords of basic auth if empty.")
+	flag.StringVar(&csOption.AdditionalPortsIP, "additional-ports-ip", "",
+		"Load balancer ip shared by the additional tcp and udp ports of instances, ports are exposed by node ports if empty.")
+	flag.StringVar(&csOption.AdditionalPortRange, "additional-port-range", "20000-29999",
+		"Range of external ports allocated to the additional ports of instances on the shared load balancer ip.")
+	flag.StringVar(&csOption.ACMEDirectoryURL, "acme-directory-url", "",
+		"Directory url of ACME CA which certificates of instance hosts are issued by with http-01 challenges answered by activator, e.g. https://acme-v02.api.letsencrypt.org/directory. Disabled if empty.")
+	flag.StringVar(&csOption.ACMEEmail, "acme-email", "", "Contact email of the ACME account.")
+	flag.StringVar(&csOption.ACMEAccountKeyFile, "acme-account-key-file", "",
+		"PEM file of the ecdsa P-256 key of ACME account, the key is generated and kept in --acme-account-secret if empty.")
+	flag.StringVar(&csOption.ACMEAccountSecret, "acme-account-secret", "code-server/cs-operator-acme-account",
+		"Secret <namespace>/<name> the generated key of ACME account is kept in, so that restarts and replicas share the account.")
+	flag.StringVar(&ingressIPFamilies, "ingress-ip-families", "IPv4",
+		"Comma separated ip families the ingress controller reaches services with, instances whose services can't be reached are rejected.")
+	flag.StringVar(&registryMirrors, "registry-mirrors", "",
+		"Comma separated mapping of registries to their mirrors applied to all images of instances and jobs, e.g. 'ghcr.io=internal.registry/ghcr,docker.io=internal.registry/hub'.")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", "1.2",
+		"Minimal tls version of webhook and metrics servers and of probing instances, '1.0', '1.1', '1.2' and '1.3' are supported.")
+	flag.StringVar(&tlsCipherSuites, "tls-cipher-suites", "",
+		"Comma separated IANA names of cipher suites allowed for tls 1.2 and below, defaults of go are used if empty.")
+	flag.StringVar(&metricsCertDir, "metrics-cert-dir", "",
+		"Directory of tls.crt and tls.key the metrics endpoint is served with over https, plain http is served if empty unless metrics auth is enabled.")
+	flag.StringVar(&metricsAuth, "metrics-auth", controllers.MetricsAuthNone,
+		"Authentication of metrics endpoint, 'none', 'token' (bearer token of --metrics-token-file) and 'rbac' (token and subject access reviews) are supported, metrics are served over https if enabled.")
+	flag.StringVar(&metricsTokenFile, "metrics-token-file", "",
+		"File of the bearer token required by metrics endpoint with 'token' auth.")
+	flag.StringVar(&probeCAFile, "probe-ca-file", "",
+		"File of PEM encoded certificate authorities instance certificates are verified against when probing, system authorities are used if empty.")
+	flag.BoolVar(&csOption.ProbeVerifyCertificates, "probe-verify-certificates", false,
+		"Verify the certificates served on hosts of instances when probing which certificate they are served with.")
+	flag.BoolVar(&csOption.UserNamespaces, "user-namespaces", false,
+		"Place the instances of every code server user in a namespace dedicated to the user, with quota, network policy and role binding.")
+	flag.StringVar(&csOption.UserNamespacePrefix, "user-namespace-prefix", "codeserver-",
+		"Prefix of dedicated namespaces of users, which are named '<prefix><namespace of user>-<user>-<hash>'.")
+	flag.StringVar(&csOption.UserNamespaceRole, "user-namespace-role", "view",
+		"Cluster role bound to the user in the dedicated namespace, no role is bound if empty.")
+	flag.StringVar(&hostPathPrefixes, "host-path-prefixes", "",
+		"Comma separated directories of node whose '<namespace>[/<user>]' sub directories instances are allowed to mount as host paths, "+
+			"e.g. /mnt/nvme, host paths are denied if empty.")
+	flag.StringVar(&csOption.ShareIngressNamespace, "share-ingress-namespace", "ingress-nginx",
+		"Namespace of ingress controller, the only peer allowed to connect to the pods serving workspaces to collaborators.")
+	flag.StringVar(&archiveURLPrefixes, "archive-url-prefixes", "",
+		"Comma separated urls workspace archives are allowed to be exported to and imported from, "+
+			"e.g. https://bucket.s3.amazonaws.com/archives/, archives are denied if empty.")
+	flag.StringVar(&csOption.SMBDriver, "smb-driver", "smb.csi.k8s.io",
+		"The csi driver mounting SMB shared folders of instances, which must support inline volumes.")
+	flag.StringVar(&logLevelName, "log-level", controllers.LogLevelInfo,
+		"Log level of operator, 'error', 'info' and 'debug' are supported, it can be changed at runtime on /log-level.")
+	flag.BoolVar(&csOption.LogEvents, "log-events", false,
+		"Record the log lines of reconciling each instance as events of the instance as well.")
 	flag.Parse()
+	csOption.WatchNamespaces = splitList(watchNamespaces)
+	csOption.TraefikEntryPoints = splitList(traefikEntryPoints)
+	csOption.IngressIPFamilies = splitList(ingressIPFamilies)
+	csOption.PrepullImages = splitList(prepullImages)
+	csOption.HostPathPrefixes = splitList(hostPathPrefixes)
+	csOption.ArchiveURLPrefixes = splitList(archiveURLPrefixes)
+	if len(priceSheet) != 0 {
+		sheet, err := controllers.LoadPriceSheet(priceSheet)
+		if err != nil {
+			setupLog.Error(err, "invalid price sheet")
+			os.Exit(1)
+		}
+		csOption.PriceSheet = sheet
+	}
+	if mirrors, err := controllers.ParseRegistryMirrors(splitList(registryMirrors)); err != nil {
+		setupLog.Error(err, "invalid registry mirrors")
+		os.Exit(1)
+	} else {
+		csOption.RegistryMirrors = mirrors
+	}
+	if version, err := controllers.ParseTLSVersion(tlsMinVersion); err != nil {
+		setupLog.Error(err, "invalid tls min version")
+		os.Exit(1)
+	} else {
+		csOption.TLSMinVersion = version
+	}
+	if suites, err := controllers.ParseCipherSuites(splitList(tlsCipherSuites)); err != nil {
+		setupLog.Error(err, "invalid tls cipher suites")
+		os.Exit(1)
+	} else {
+		csOption.TLSCipherSuites = suites
+	}
+	if pool, err := controllers.LoadCertPool(probeCAFile); err != nil {
+		setupLog.Error(err, "invalid probe ca file")
+		os.Exit(1)
+	} else {
+		csOption.ProbeRootCAs = pool
+	}
+	if len(prepullNodeSelector) != 0 {
+		selector, err := labels.ConvertSelectorToLabelsMap(prepullNodeSelector)
+		if err != nil {
+			setupLog.Error(err, "invalid prepull node selector")
+			os.Exit(1)
+		}
+		csOption.PrepullNodeSelector = selector
+	}
+	if csOption.ShardCount > 1 {
+		if csOption.ShardID < 0 {
+			csOption.ShardID = hostnameOrdinal()
+		}
+		if csOption.ShardID < 0 || csOption.ShardID >= csOption.ShardCount {
+			setupLog.Error(nil, "invalid shard id", "shard", csOption.ShardID, "count", csOption.ShardCount)
+			os.Exit(1)
+		}
+	}
 
-	ctrl.SetLogger(zap.New(func(o *zap.Options) {
+	logLevel, err := controllers.NewLogLevel(logLevelName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ctrl.SetLogger(logLevel.Wrap(zap.New(func(o *zap.Options) {
 		o.Development = true
-	}))
+	})))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	mgrOptions := ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
 		LeaderElection:     enableLeaderElection,
-		Port:               9443,
-	})
+		WebhookServer: &webhook.Server{
+			Port:    9443,
+			TLSOpts: []func(*tls.Config){controllers.ServerTLSOptions(&csOption)},
+		},
+		LeaseDuration: &leaseDuration,
+		RenewDeadline: &renewDeadline,
+		RetryPeriod:   &retryPeriod,
+		// workers below run as runnables of manager, which stops them before releasing the lease
+		LeaderElectionReleaseOnCancel: releaseOnCancel,
+		GracefulShutdownTimeout:       &gracefulShutdownTimeout,
+		SyncPeriod:                    &resyncPeriod,
+		// secrets are read from api server, only their metadata is cached for watches
+		ClientDisableCacheFor: []client.Object{&corev1.Secret{}},
+	}
+	if csOption.ShardCount > 1 {
+		setupLog.Info("handling shard", "shard", csOption.ShardID, "count", csOption.ShardCount)
+	}
+	mgrOptions.LeaderElectionID = leaderElectionID(csOption.ShardID, csOption.ShardCount)
+	if len(csOption.WatchNamespaces) != 0 && csOption.UserNamespaces {
+		setupLog.Error(nil, "dedicated namespaces of users can't be watched when watching namespaces")
+		os.Exit(1)
+	}
+	if len(csOption.WatchNamespaces) != 0 {
+		setupLog.Info("watching namespaces", "namespaces", csOption.WatchNamespaces)
+		mgrOptions.NewCache = cache.MultiNamespacedCacheBuilder(csOption.WatchNamespaces)
+	}
+	restConfig := ctrl.GetConfigOrDie()
+	var metricsServer *controllers.MetricsServer
+	if len(metricsCertDir) != 0 || metricsAuth != controllers.MetricsAuthNone {
+		reviewClient, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			setupLog.Error(err, "unable to create kubernetes client")
+			os.Exit(1)
+		}
+		authorizer, err := controllers.NewMetricsAuthorizer(metricsAuth, metricsTokenFile, reviewClient)
+		if err != nil {
+			setupLog.Error(err, "invalid metrics auth")
+			os.Exit(1)
+		}
+		metricsServer, err = controllers.NewMetricsServer(ctrl.Log.WithName("controllers").WithName("MetricsServer"),
+			&csOption, metricsAddr, metricsCertDir, authorizer)
+		if err != nil {
+			setupLog.Error(err, "unable to create metrics server")
+			os.Exit(1)
+		}
+		// metrics are served over https by metrics server in front of manager
+		mgrOptions.MetricsBindAddress = controllers.MetricsLoopbackAddr
+	}
+	mgr, err := ctrl.NewManager(restConfig, mgrOptions)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
-	csRequest := make(chan controllers.CodeServerRequest, REQUEST_CHAN_SIZE)
-	if err = (&controllers.CodeServerReconciler{
+	if err := controllers.SetupIndexes(mgr); err != nil {
+		setupLog.Error(err, "unable to setup field indexes")
+		os.Exit(1)
+	}
+	optionStore := controllers.NewOptionStore(ctrl.Log.WithName("controllers").WithName("OptionStore"), &csOption)
+	if len(csOption.ConfigFile) != 0 {
+		if err := optionStore.LoadFile(csOption.ConfigFile); err != nil {
+			setupLog.Error(err, "unable to load config file")
+			os.Exit(1)
+		}
+	}
+	if err := mgr.AddMetricsExtraHandler("/active-config", optionStore); err != nil {
+		setupLog.Error(err, "unable to serve active config")
+		os.Exit(1)
+	}
+	if err := mgr.AddMetricsExtraHandler("/log-level", logLevel); err != nil {
+		setupLog.Error(err, "unable to serve log level")
+		os.Exit(1)
+	}
+	auditor, err := controllers.NewAuditor(ctrl.Log.WithName("controllers").WithName("CodeServerAuditor"), &csOption)
+	if err != nil {
+		setupLog.Error(err, "unable to create auditor")
+		os.Exit(1)
+	}
+	notifier := controllers.NewNotifier(ctrl.Log.WithName("controllers").WithName("CodeServerNotifier"), &csOption)
+	watches := controllers.NewWatchQueue()
+	tracer := controllers.NewTracer(csOption.TracingEndpoint, ctrl.Log.WithName("controllers").WithName("Tracer"))
+	codeServerReconciler := &controllers.CodeServerReconciler{
+		Client:   controllers.NewTracingClient(mgr.GetClient(), tracer),
+		Log:      ctrl.Log.WithName("controllers").WithName("CodeServer"),
+		Scheme:   mgr.GetScheme(),
+		Options:  &csOption,
+		Watches:  watches,
+		Auditor:  auditor,
+		Notifier: notifier,
+		Recorder: mgr.GetEventRecorderFor(controllers.EventSource),
+		Tracer:   tracer,
+	}
+	reconcileScheduler := controllers.NewReconcileScheduler(&csOption)
+	codeServerReconciler.Scheduler = reconcileScheduler
+	codeServerReconciler.RegisterRuntime(csv1alpha1.RuntimeCode, controllers.NewVSCodeRuntime(codeServerReconciler))
+	codeServerReconciler.RegisterRuntime(csv1alpha1.RuntimeGeneric, controllers.NewGenericRuntime(codeServerReconciler))
+	codeServerReconciler.RegisterRuntime(csv1alpha1.RuntimeGotty, controllers.NewGenericRuntime(codeServerReconciler))
+	codeServerReconciler.RegisterRuntime(csv1alpha1.RuntimePGWeb, controllers.NewGenericRuntime(codeServerReconciler))
+	var lxdRemotePool *controllers.LxdRemotePool
+	if len(csOption.LxdRemotesFile) != 0 {
+		remotes, err := controllers.LoadLxdRemotes(csOption.LxdRemotesFile)
+		if err != nil {
+			setupLog.Error(err, "unable to load lxd remotes")
+			os.Exit(1)
+		}
+		lxdRemotePool = controllers.NewLxdRemotePool(mgr.GetClient(),
+			ctrl.Log.WithName("controllers").WithName("LxdRemotePool"), &csOption, remotes)
+	}
+	codeServerReconciler.RegisterRuntime(csv1alpha1.RuntimeLxd, controllers.NewLxdRuntime(codeServerReconciler, lxdRemotePool))
+	if err = codeServerReconciler.SetupWithManager(mgr, csOption.MaxConcurrency); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "CodeServer")
+		os.Exit(1)
+	}
+	// operator config is cluster scoped which is not accessible with namespace scoped permissions
+	if len(csOption.WatchNamespaces) != 0 {
+		setupLog.Info("operator config is disabled when watching specified namespaces, use config file instead")
+	} else if err = (&controllers.CodeServerOperatorConfigReconciler{
+		Client:     mgr.GetClient(),
+		Log:        ctrl.Log.WithName("controllers").WithName("CodeServerOperatorConfig"),
+		Scheme:     mgr.GetScheme(),
+		Store:      optionStore,
+		ConfigName: csOption.OperatorConfigName,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "CodeServerOperatorConfig")
+		os.Exit(1)
+	}
+	if err = (&controllers.CodeServerUserReconciler{
 		Client:  mgr.GetClient(),
-		Log:     ctrl.Log.WithName("controllers").WithName("CodeServer"),
+		Log:     ctrl.Log.WithName("controllers").WithName("CodeServerUser"),
 		Scheme:  mgr.GetScheme(),
 		Options: &csOption,
-		ReqCh:   csRequest,
-	}).SetupWithManager(mgr, csOption.MaxConcurrency); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "CodeServer")
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "CodeServerUser")
 		os.Exit(1)
 	}
+	// quotas of templates are provisioned by the first shard for all shards
+	if csOption.ShardID <= 0 {
+		if err = (&controllers.CodeServerTemplateReconciler{
+			Client:  mgr.GetClient(),
+			Log:     ctrl.Log.WithName("controllers").WithName("CodeServerTemplate"),
+			Scheme:  mgr.GetScheme(),
+			Options: &csOption,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "CodeServerTemplate")
+			os.Exit(1)
+		}
+	}
+	// prebuilds are shared by all shards, only the unsharded or first shard builds them
+	if csOption.ShardID <= 0 {
+		if err = (&controllers.CodeServerPrebuildReconciler{
+			Client:  mgr.GetClient(),
+			Log:     ctrl.Log.WithName("controllers").WithName("CodeServerPrebuild"),
+			Scheme:  mgr.GetScheme(),
+			Options: &csOption,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "CodeServerPrebuild")
+			os.Exit(1)
+		}
+	}
+	// workshops fan out instances of all shards, only the unsharded or first shard provisions them
+	if csOption.ShardID <= 0 {
+		if err = (&controllers.CodeServerWorkshopReconciler{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("controllers").WithName("CodeServerWorkshop"),
+			Scheme: mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "CodeServerWorkshop")
+			os.Exit(1)
+		}
+	}
+	// migrations move instances of all shards, only the unsharded or first shard migrates them
+	if csOption.ShardID <= 0 {
+		if err = (&controllers.CodeServerMigrationReconciler{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("controllers").WithName("CodeServerMigration"),
+			Scheme: mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "CodeServerMigration")
+			os.Exit(1)
+		}
+	}
+	if enableWebhook {
+		if err = (&csv1alpha1.CodeServer{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "CodeServer")
+			os.Exit(1)
+		}
+		mgr.GetWebhookServer().Register(controllers.EntitlementWebhookPath, &webhook.Admission{
+			Handler: controllers.NewCodeServerEntitlementValidator(mgr.GetClient(),
+				ctrl.Log.WithName("webhooks").WithName("CodeServerEntitlement")),
+		})
+		mgr.GetWebhookServer().Register(controllers.BoundsWebhookPath, &webhook.Admission{
+			Handler: controllers.NewCodeServerBoundsValidator(ctrl.Log.WithName("webhooks").WithName("CodeServerBounds"),
+				&csOption),
+		})
+		mgr.GetWebhookServer().Register(controllers.SecurityWebhookPath, &webhook.Admission{
+			Handler: controllers.NewCodeServerSecurityValidator(
+				ctrl.Log.WithName("webhooks").WithName("CodeServerSecurity"), &csOption),
+		})
+		if auditor != nil {
+			mgr.GetWebhookServer().Register(controllers.DeletionAuditWebhookPath, &webhook.Admission{
+				Handler: controllers.NewCodeServerDeletionAuditor(
+					ctrl.Log.WithName("webhooks").WithName("CodeServerDeletionAuditor"), auditor),
+			})
+			optionStore.UpdateDefaults(func(option *controllers.CodeServerOption) {
+				option.AuditDeletionWebhook = true
+			})
+		}
+	}
 	// +kubebuilder:scaffold:builder
-	probeTicker := time.NewTicker(time.Duration(csOption.ProbeInterval) * time.Second)
+	kubeClient, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		setupLog.Error(err, "unable to create kubernetes client")
+		os.Exit(1)
+	}
+	probeTicker := time.NewTicker(time.Duration(csOption.Load().ProbeInterval) * time.Second)
 	defer probeTicker.Stop()
+	probeInterval := csOption.Load().ProbeInterval
+	optionStore.OnChange(func(option controllers.CodeServerOption) {
+		if option.ProbeInterval > 0 && option.ProbeInterval != probeInterval {
+			setupLog.Info("probe interval changed", "seconds", option.ProbeInterval)
+			probeInterval = option.ProbeInterval
+			probeTicker.Reset(time.Duration(probeInterval) * time.Second)
+		}
+	})
+	activityEvents := make(chan controllers.ActivityEvent, controllers.ActivityEventBuffer)
+	statusBatcher := controllers.NewStatusBatcher(
+		mgr.GetClient(),
+		ctrl.Log.WithName("controllers").WithName("StatusBatcher"),
+		&csOption)
 	//setup code server watcher
 	codeServerWatcher := controllers.NewCodeServerWatcher(
-		mgr.GetClient(),
+		controllers.NewTracingClient(mgr.GetClient(), tracer),
 		ctrl.Log.WithName("controllers").WithName("CodeServerWatcher"),
 		mgr.GetScheme(),
 		&csOption,
-		csRequest,
-		probeTicker.C)
+		watches,
+		probeTicker.C,
+		auditor,
+		notifier,
+		controllers.NewUsageCollector(mgr.GetClient(), kubeClient,
+			ctrl.Log.WithName("controllers").WithName("UsageCollector")),
+		activityEvents,
+		mgr.GetEventRecorderFor(controllers.EventSource),
+		statusBatcher,
+		tracer)
 	stopContext := ctrl.SetupSignalHandler()
-	go codeServerWatcher.Run(stopContext.Done())
+	if len(csOption.IngressAccessLog) != 0 {
+		ingressLogSource := controllers.NewIngressLogSource(
+			ctrl.Log.WithName("controllers").WithName("IngressLogSource"), csOption.IngressAccessLog)
+		codeServerWatcher.RegisterActivitySource(csv1alpha1.ActivitySourceIngress, ingressLogSource)
+		go ingressLogSource.Run(stopContext.Done())
+	}
+	addWorker(mgr, codeServerWatcher.Run)
+	addWorker(mgr, statusBatcher.Run)
+	// sinks outlive workers, they are stopped after manager stopped all workers and ship what's queued before exit
+	sinkStop := make(chan struct{})
+	sinks := sync.WaitGroup{}
+	runSink := func(run func(stopCh <-chan struct{})) {
+		sinks.Add(1)
+		go func() {
+			defer sinks.Done()
+			run(sinkStop)
+		}()
+	}
+	runSink(notifier.Run)
+	if tracer != nil {
+		runSink(tracer.Run)
+	}
+	if lxdRemotePool != nil {
+		go lxdRemotePool.Run(stopContext.Done())
+	}
+	if len(csOption.ConfigFile) != 0 {
+		go optionStore.WatchFile(csOption.ConfigFile, stopContext.Done())
+	}
+	backup := controllers.NewCodeServerBackup(
+		mgr.GetClient(),
+		ctrl.Log.WithName("controllers").WithName("CodeServerBackup"),
+		&csOption)
+	addWorker(mgr, backup.Run)
+	if len(csOption.APIServerAddr) != 0 {
+		apiServer, err := controllers.NewCodeServerAPIServer(
+			mgr.GetClient(),
+			ctrl.Log.WithName("controllers").WithName("CodeServerAPIServer"),
+			&csOption)
+		if err != nil {
+			setupLog.Error(err, "unable to create api server")
+			os.Exit(1)
+		}
+		go apiServer.Run(stopContext.Done())
+	}
+	if len(csOption.ActivityAddr) != 0 {
+		activityServer := controllers.NewCodeServerActivityServer(
+			mgr.GetClient(),
+			ctrl.Log.WithName("controllers").WithName("CodeServerActivityServer"),
+			&csOption,
+			activityEvents)
+		go activityServer.Run(stopContext.Done())
+	}
+	if len(csOption.ActivatorAddr) != 0 {
+		activator := controllers.NewCodeServerActivator(
+			mgr.GetClient(),
+			ctrl.Log.WithName("controllers").WithName("CodeServerActivator"),
+			&csOption,
+			mgr.GetEventRecorderFor(controllers.EventSource))
+		go activator.Run(stopContext.Done())
+	}
+	if metricsServer != nil {
+		go metricsServer.Run(stopContext.Done())
+	}
+	// orphans of all shards are collected by the first shard
+	if csOption.GCInterval > 0 && csOption.ShardID <= 0 {
+		orphanCollector := controllers.NewOrphanCollector(
+			mgr.GetClient(),
+			ctrl.Log.WithName("controllers").WithName("OrphanCollector"),
+			mgr.GetScheme(),
+			&csOption,
+			reconcileScheduler)
+		if err := mgr.AddMetricsExtraHandler("/metrics/orphans", orphanCollector); err != nil {
+			setupLog.Error(err, "unable to register orphan metrics handler")
+			os.Exit(1)
+		}
+		addWorker(mgr, orphanCollector.Run)
+	}
+	// images are pre-pulled by the first shard for all shards
+	if len(csOption.PrepullNamespace) != 0 && csOption.ShardID <= 0 {
+		prepuller := controllers.NewCodeServerPrepuller(
+			mgr.GetClient(),
+			ctrl.Log.WithName("controllers").WithName("CodeServerPrepuller"),
+			&csOption)
+		addWorker(mgr, prepuller.Run)
+	}
+	// fleet status covers all shards, it's reported by the first shard
+	if csOption.FleetStatusInterval > 0 && csOption.ShardID <= 0 {
+		fleetReporter := controllers.NewCodeServerFleetReporter(
+			mgr.GetClient(),
+			ctrl.Log.WithName("controllers").WithName("CodeServerFleetReporter"),
+			&csOption)
+		addWorker(mgr, fleetReporter.Run)
+	}
+	if csOption.TTLInterval > 0 {
+		ttl := controllers.NewCodeServerTTL(
+			mgr.GetClient(),
+			ctrl.Log.WithName("controllers").WithName("CodeServerTTL"),
+			&csOption,
+			mgr.GetEventRecorderFor(controllers.EventSource))
+		addWorker(mgr, ttl.Run)
+	}
+	if csOption.BudgetInterval > 0 {
+		budget := controllers.NewCodeServerBudget(
+			mgr.GetClient(),
+			ctrl.Log.WithName("controllers").WithName("CodeServerBudget"),
+			&csOption,
+			mgr.GetEventRecorderFor(controllers.EventSource))
+		addWorker(mgr, budget.Run)
+	}
+	// groups are cluster scoped, they're synced by the first shard
+	if csOption.EntitlementInterval > 0 && len(csOption.LDAPURL) != 0 && csOption.ShardID <= 0 {
+		entitlement := controllers.NewCodeServerEntitlement(
+			mgr.GetClient(),
+			ctrl.Log.WithName("controllers").WithName("CodeServerEntitlement"),
+			&csOption)
+		addWorker(mgr, entitlement.Run)
+	}
+	if len(csOption.Load().RolloutImage) != 0 {
+		rollout := controllers.NewCodeServerRollout(
+			mgr.GetClient(),
+			ctrl.Log.WithName("controllers").WithName("CodeServerRollout"),
+			&csOption)
+		addWorker(mgr, rollout.Run)
+	}
+	if auditor != nil {
+		runSink(auditor.Run)
+	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(stopContext); err != nil {
+	err = mgr.Start(stopContext)
+	setupLog.Info("manager stopped, flushing notifications, audit records and spans")
+	close(sinkStop)
+	sinks.Wait()
+	if err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
+
+// addWorker runs the background worker as runnable of manager, which only starts it once elected as leader and
+// waits for it to stop before releasing the leader lease on shutdown.
+func addWorker(mgr ctrl.Manager, run func(stopCh <-chan struct{})) {
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		run(ctx.Done())
+		return nil
+	})); err != nil {
+		setupLog.Error(err, "unable to add worker to manager")
+		os.Exit(1)
+	}
+}
+
+// leaderElectionID returns the name of the lease held by the leader, every shard elects its own leader.
+func leaderElectionID(shardID, shardCount int) string {
+	if shardCount > 1 {
+		return fmt.Sprintf("%s-shard-%d", LeaderElectionID, shardID)
+	}
+	return LeaderElectionID
+}
+
+// splitList parses the comma separated items, e.g. namespaces, empty items are ignored.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// hostnameOrdinal returns the ordinal suffix of hostname, e.g. 2 for code-server-operator-2, -1 if absent.
+func hostnameOrdinal() int {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return -1
+	}
+	ordinal, err := strconv.Atoi(hostname[strings.LastIndex(hostname, "-")+1:])
+	if err != nil {
+		return -1
+	}
+	return ordinal
+}
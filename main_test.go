@@ -0,0 +1,62 @@
+/*
+Copyright 2019 tommylikehu@gmail.com.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+func TestLeaderElectionID(t *testing.T) {
+	tests := []struct {
+		name       string
+		shardID    int
+		shardCount int
+		want       string
+	}{
+		{name: "unsharded", shardCount: 0, want: "code-server-operator"},
+		{name: "single shard", shardCount: 1, want: "code-server-operator"},
+		{name: "first shard", shardID: 0, shardCount: 3, want: "code-server-operator-shard-0"},
+		{name: "last shard", shardID: 2, shardCount: 3, want: "code-server-operator-shard-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := leaderElectionID(tt.shardID, tt.shardCount)
+			if id != tt.want {
+				t.Errorf("leaderElectionID(%d, %d) = %q, want %q", tt.shardID, tt.shardCount, id, tt.want)
+			}
+			// the rest mapper is lazy so that manager is created without api server
+			_, err := ctrl.NewManager(&rest.Config{Host: "https://127.0.0.1:6443"}, ctrl.Options{
+				Scheme:                  scheme,
+				MetricsBindAddress:      "0",
+				LeaderElection:          true,
+				LeaderElectionID:        id,
+				LeaderElectionNamespace: "code-server",
+				MapperProvider: func(c *rest.Config) (meta.RESTMapper, error) {
+					return apiutil.NewDynamicRESTMapper(c, apiutil.WithLazyDiscovery)
+				},
+			})
+			if err != nil {
+				t.Errorf("NewManager() with leader election = %v, want nil", err)
+			}
+		})
+	}
+}
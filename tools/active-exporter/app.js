@@ -1,9 +1,21 @@
 const express = require('express');
 const app = express();
+let crypto = require('crypto');
 let fs = require('fs');
+let path = require('path');
+let url = require('url');
+
+app.use(express.json());
 
 let stat_file = process.env.STAT_FILE;
 let listen_port = process.env.LISTEN_PORT;
+let notice_file = process.env.NOTICE_FILE || path.join(path.dirname(stat_file), 'recycle-notice.json');
+let connection_port = parseInt(process.env.CONNECTION_PORT || '8080', 10);
+let push_url = process.env.ACTIVITY_PUSH_URL;
+let push_interval = parseInt(process.env.ACTIVITY_PUSH_INTERVAL || '20', 10) * 1000;
+let cs_namespace = process.env.CS_NAMESPACE;
+let cs_name = process.env.CS_NAME;
+let exporter_token = process.env.EXPORTER_TOKEN;
 
 console.log(`state file at: ${stat_file}`)
 
@@ -17,4 +29,143 @@ app.get('/active-time', (req, res) => {
     }
 });
 
+// established connections to code server, containers of pod share the same network namespace.
+app.get('/connections', (req, res) => {
+    let count = 0;
+    for (let table of ['/proc/net/tcp', '/proc/net/tcp6']) {
+        if (!fs.existsSync(table)) {
+            continue;
+        }
+        let lines = fs.readFileSync(table, 'utf8').trim().split('\n').slice(1);
+        for (let line of lines) {
+            let fields = line.trim().split(/\s+/);
+            let local_port = parseInt(fields[1].split(':').pop(), 16);
+            // state 01 stands for ESTABLISHED
+            if (local_port === connection_port && fields[3] === '01') {
+                count++;
+            }
+        }
+    }
+    res.setHeader('content-type', 'text/plain');
+    res.status(200).send(`${count}`);
+});
+
+// containers of pod share the same network namespace, requests from IDE extensions come from loopback and are
+// trusted, other requests must present the exporter token generated by operator.
+function authorized(req) {
+    let remote = req.socket.remoteAddress || '';
+    if (remote === '127.0.0.1' || remote === '::1' || remote === '::ffff:127.0.0.1') {
+        return true;
+    }
+    if (!exporter_token) {
+        return false;
+    }
+    let expected = Buffer.from(`Bearer ${exporter_token}`);
+    let actual = Buffer.from(req.get('authorization') || '');
+    return actual.length === expected.length && crypto.timingSafeEqual(actual, expected);
+}
+
+function authenticate(req, res, next) {
+    if (!authorized(req)) {
+        res.status(401).send();
+        return;
+    }
+    next();
+}
+
+// notification pushed by operator before code server is recycled, IDE extensions can watch the notice file.
+app.get('/notify', authenticate, (req, res) => {
+    if (!fs.existsSync(notice_file)) {
+        res.status(204).send()
+    } else {
+        res.setHeader('content-type', 'application/json');
+        res.status(200).send(fs.readFileSync(notice_file));
+    }
+});
+
+app.post('/notify', authenticate, (req, res) => {
+    console.log(`recycle notice received: ${JSON.stringify(req.body)}`)
+    fs.writeFileSync(notice_file, JSON.stringify(req.body));
+    res.status(200).send();
+});
+
+app.delete('/notify', authenticate, (req, res) => {
+    if (fs.existsSync(notice_file)) {
+        fs.unlinkSync(notice_file);
+    }
+    res.status(200).send();
+});
+
+// push activity event to operator, operator stops probing this instance while events keep coming.
+function push_activity(type, time, clients) {
+    if (!push_url) {
+        return;
+    }
+    let target = url.parse(push_url);
+    let client = require(target.protocol === 'https:' ? 'https' : 'http');
+    let event = {namespace: cs_namespace, name: cs_name, type: type, time: time};
+    if (clients !== undefined) {
+        event.clients = clients;
+    }
+    let body = JSON.stringify(event);
+    let req = client.request({
+        hostname: target.hostname,
+        port: target.port,
+        path: target.path,
+        method: 'POST',
+        headers: {'content-type': 'application/json', 'content-length': Buffer.byteLength(body)},
+        timeout: 5000,
+    }, (res) => {
+        if (res.statusCode !== 202) {
+            console.log(`failed to push ${type} activity, status code ${res.statusCode}`)
+        }
+        res.resume();
+    });
+    req.on('timeout', () => req.destroy());
+    req.on('error', (err) => console.log(`failed to push ${type} activity: ${err.message}`));
+    req.end(body);
+}
+
+function stat_time() {
+    if (!fs.existsSync(stat_file)) {
+        return undefined;
+    }
+    return fs.statSync(stat_file).mtime;
+}
+
+// IDE extensions report keystroke, terminal and connected clients events which are forwarded to operator.
+app.post('/activity', authenticate, (req, res) => {
+    let type = req.body.type;
+    if (['keystroke', 'terminal', 'clients'].indexOf(type) < 0) {
+        res.status(400).send(`unsupported activity type ${type}`);
+        return;
+    }
+    push_activity(type, new Date(), req.body.clients);
+    res.status(202).send();
+});
+
+// keep alive touches the heartbeat file so that operator will treat code server as active.
+app.all('/keep-alive', authenticate, (req, res) => {
+    let now = new Date();
+    if (!fs.existsSync(stat_file)) {
+        fs.writeFileSync(stat_file, '');
+    }
+    fs.utimesSync(stat_file, now, now);
+    if (fs.existsSync(notice_file)) {
+        fs.unlinkSync(notice_file);
+    }
+    push_activity('heartbeat', now);
+    res.status(200).send('code server has been kept alive');
+});
+
+if (push_url) {
+    // heartbeat file is touched by code server on user activity, push at once when it changes.
+    fs.watchFile(stat_file, {interval: 1000}, (curr, prev) => {
+        if (curr.mtimeMs !== prev.mtimeMs && curr.mtimeMs > 0) {
+            push_activity('heartbeat', curr.mtime);
+        }
+    });
+    setInterval(() => push_activity('heartbeat', stat_time()), push_interval);
+}
+
 app.listen(listen_port, () => console.log(`active-exporter app listening on port ${listen_port}!`));
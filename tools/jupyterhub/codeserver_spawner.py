@@ -0,0 +1,70 @@
+"""JupyterHub spawner which spawns code servers via the api server of code-server-operator.
+
+Configure in jupyterhub_config.py:
+
+    from codeserver_spawner import CodeServerSpawner
+    c.JupyterHub.spawner_class = CodeServerSpawner
+    c.CodeServerSpawner.api_url = "http://<operator service>:<api server port>"
+    c.CodeServerSpawner.api_token = "<token in --api-token-file>"
+    c.CodeServerSpawner.namespace = "default"
+    c.CodeServerSpawner.template = "vscode"
+"""
+import asyncio
+import json
+
+from jupyterhub.spawner import Spawner
+from tornado.httpclient import AsyncHTTPClient, HTTPClientError, HTTPRequest
+from traitlets import Integer, Unicode
+
+
+class CodeServerSpawner(Spawner):
+    api_url = Unicode(help="Url of api server of code-server-operator.").tag(config=True)
+    api_token = Unicode(help="Bearer token of api server.").tag(config=True)
+    namespace = Unicode("default", help="Namespace code servers are spawned in.").tag(config=True)
+    template = Unicode("", help="CodeServerTemplate, operator default is used if empty.").tag(config=True)
+    poll_period = Integer(3, help="Seconds between two polls while waiting code server ready.").tag(config=True)
+
+    def _url(self):
+        url = "%s/spawner/v1/namespaces/%s/users/%s" % (self.api_url.rstrip("/"), self.namespace, self.user.name)
+        if self.name:
+            url += "/servers/%s" % self.name
+        return url
+
+    async def _request(self, method, url, body=None):
+        request = HTTPRequest(url, method=method, body=body,
+                              headers={"Authorization": "Bearer %s" % self.api_token,
+                                       "Content-Type": "application/json"})
+        response = await AsyncHTTPClient().fetch(request)
+        return json.loads(response.body) if response.body else None
+
+    async def start(self):
+        body = json.dumps({"template": self.template})
+        while True:
+            try:
+                status = await self._request("POST", self._url(), body)
+            except HTTPClientError as e:
+                # recycled code server is being removed before spawned again
+                if e.code != 503:
+                    raise
+                status = {}
+            if status.get("phase") == "Ready" and status.get("url"):
+                return status["url"]
+            if status.get("phase") == "Errored":
+                raise RuntimeError("code server %s errored" % status.get("name"))
+            await asyncio.sleep(self.poll_period)
+
+    async def poll(self):
+        try:
+            status = await self._request("GET", self._url())
+        except HTTPClientError as e:
+            if e.code == 404:
+                return 0
+            raise
+        return None if status.get("running") else 0
+
+    async def stop(self, now=False):
+        try:
+            await self._request("DELETE", self._url())
+        except HTTPClientError as e:
+            if e.code != 404:
+                raise